@@ -0,0 +1,150 @@
+import base64
+import hashlib
+import json
+import os
+import shutil
+import socket
+import ssl
+import sys
+import tempfile
+import threading
+import time
+import unittest
+
+from yourtestsrv import acme
+from yourtestsrv.acme import _der, _der_children, _der_int, _der_oid, _der_read, _der_seq
+from yourtestsrv.config import ACMEConfig
+from yourtestsrv.http_server import HTTPResponse, HTTPServer
+
+
+def unb64(text):
+    return base64.urlsafe_b64decode(text + '=' * (-len(text) % 4))
+
+
+class FakeCA:
+    """Just enough of an ACME server: checks every JWS and the dns-01 TXT value, issues for 90 days."""
+
+    def __init__(self, test, txt_log):
+        self.test = test
+        self.txt_log = txt_log
+        self.ca_key = acme.RSAKey.generate(1024)
+        self.account = None
+        self.nonces = set()
+        self.requests = 0
+        self.status = 'pending'
+        sock = socket.create_server(('127.0.0.1', 0))
+        self.base = f'http://127.0.0.1:{sock.getsockname()[1]}'
+        stop = threading.Event()
+        test.addCleanup(stop.set)
+        threading.Thread(target=HTTPServer(0, '127.0.0.1', handler=self.handle).serve, args=(stop, sock),
+                         daemon=True).start()
+
+    def reply(self, body=None, code=200, headers=None):
+        nonce = os.urandom(8).hex()
+        self.nonces.add(nonce)
+        headers = dict(headers or {}, **{'Replay-Nonce': nonce})
+        data = body if isinstance(body, bytes) else json.dumps(body or {}).encode()
+        return HTTPResponse(code, 'OK' if code < 400 else 'Error', headers, data)
+
+    def verify(self, req):
+        jws = json.loads(req.body)
+        protected = json.loads(unb64(jws['protected']))
+        self.test.assertIn(protected.pop('nonce'), self.nonces)
+        self.test.assertEqual(protected['url'], self.base + req.path)
+        if 'jwk' in protected:
+            self.account = protected['jwk']
+        else:
+            self.test.assertEqual(protected['kid'], self.base + '/acct/1')
+        n, e = (int.from_bytes(unb64(self.account[k]), 'big') for k in ('n', 'e'))
+        signed = pow(int.from_bytes(unb64(jws['signature']), 'big'), e, n).to_bytes((n.bit_length() + 7) // 8, 'big')
+        digest = hashlib.sha256(f'{jws["protected"]}.{jws["payload"]}'.encode()).digest()
+        self.test.assertTrue(signed.startswith(b'\x00\x01\xff') and signed.endswith(digest))
+        return json.loads(unb64(jws['payload'])) if jws['payload'] else None
+
+    def handle(self, req):
+        self.requests += 1
+        if req.path == '/directory':
+            return self.reply({k: f'{self.base}/{k}' for k in ('newNonce', 'newAccount', 'newOrder')})
+        if req.path == '/newNonce':
+            return self.reply(b'')
+        payload = self.verify(req)
+        if req.path == '/newAccount':
+            self.test.assertEqual(payload, {'termsOfServiceAgreed': True, 'contact': ['mailto:lab@example.com']})
+            return self.reply({'status': 'valid'}, 201, {'Location': self.base + '/acct/1'})
+        if req.path == '/newOrder':
+            self.domains = [i['value'] for i in payload['identifiers']]
+            return self.reply({'status': 'pending', 'authorizations': [self.base + '/authz/1'],
+                               'finalize': self.base + '/finalize'}, 201, {'Location': self.base + '/order/1'})
+        if req.path == '/authz/1':
+            return self.reply({'status': self.status, 'identifier': {'type': 'dns', 'value': self.domains[0]},
+                               'challenges': [{'type': 'http-01', 'url': self.base + '/chall/http', 'token': 'x'},
+                                              {'type': 'dns-01', 'url': self.base + '/chall/dns', 'token': 'tok'}]})
+        if req.path == '/chall/dns':
+            thumbprint = acme.RSAKey(int.from_bytes(unb64(self.account['n']), 'big'), 65537, 0, 0, 0).thumbprint()
+            expected = acme.b64url(hashlib.sha256(f'tok.{thumbprint}'.encode()).digest())
+            with open(self.txt_log) as f:
+                self.test.assertEqual(f.read().split(), ['present', f'_acme-challenge.{self.domains[0]}.', expected])
+            self.status = 'valid'
+            return self.reply({'status': 'processing'})
+        if req.path == '/finalize':
+            self.certificate = self.issue(unb64(payload['csr']))
+            return self.reply({'status': 'valid', 'certificate': self.base + '/cert/1'})
+        if req.path == '/cert/1':
+            return self.reply(self.certificate.encode())
+        return self.reply({'type': 'urn:ietf:params:acme:error:malformed'}, 404)
+
+    def issue(self, csr):
+        _, request, _ = _der_read(csr)
+        info = _der_children(_der_read(request)[1])
+        public_key_info = _der(info[2][0], info[2][1])
+        self.test.assertIn(self.domains[0].encode(), request)
+        now = time.time()
+        validity = _der_seq(*(_der(0x17, time.strftime('%y%m%d%H%M%SZ', time.gmtime(t)).encode())
+                              for t in (now, now + 90 * 86400)))
+        name = _der_seq(_der(0x31, _der_seq(_der_oid(acme.COMMON_NAME), _der(0x0c, b'Fake CA'))))
+        algorithm = _der_seq(_der_oid(acme.SHA256_WITH_RSA), b'\x05\x00')
+        tbs = _der_seq(_der(0xa0, _der_int(2)), _der_int(1), algorithm, name, validity, name, public_key_info)
+        cert = _der_seq(tbs, algorithm, _der(0x03, b'\x00' + self.ca_key.sign(tbs)))
+        return acme._pem('CERTIFICATE', cert)
+
+
+class TestACME(unittest.TestCase):
+    def setUp(self):
+        self.dir = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, self.dir)
+
+    def test_key_roundtrip_and_csr(self):
+        key = acme.RSAKey.generate(1024)
+        self.assertEqual(key.n.bit_length(), 1024)
+        self.assertEqual(acme.RSAKey.from_pem(key.to_pem()).d, key.d)
+        signed = pow(int.from_bytes(key.sign(b'msg'), 'big'), key.e, key.n).to_bytes(key.size, 'big')
+        self.assertTrue(signed.endswith(hashlib.sha256(b'msg').digest()))
+        csr = acme.make_csr(key, ['lab.example.com', '*.lab.example.com'])
+        self.assertIn(b'\x82\x11*.lab.example.com', csr)
+
+    def test_dns01_issue_and_reuse(self):
+        txt_log = os.path.join(self.dir, 'txt.log')
+        hook = os.path.join(self.dir, 'hook.py')
+        with open(hook, 'w') as f:
+            f.write('import sys\n'
+                    f'if sys.argv[1] == "present": open({txt_log!r}, "w").write(" ".join(sys.argv[1:]))\n')
+        ca = FakeCA(self, txt_log)
+        cfg = ACMEConfig(domains=['lab.example.com'], email='lab@example.com', directory=ca.base + '/directory',
+                         dns_hook=f'{sys.executable} {hook}', dns_wait='0s', dir=os.path.join(self.dir, 'acme'))
+        cert_file, key_file = acme.ensure_certificate(cfg, key_bits=1024)
+        self.assertEqual(cert_file, os.path.join(self.dir, 'acme', 'lab.example.com', 'cert.pem'))
+        ctx = ssl.SSLContext(ssl.PROTOCOL_TLS_SERVER)
+        ctx.set_ciphers('DEFAULT:@SECLEVEL=0')  # the test keys are 1024-bit for speed
+        ctx.load_cert_chain(cert_file, key_file)
+        self.assertEqual(os.stat(key_file).st_mode & 0o777, 0o600)
+        with open(cert_file) as f:
+            self.assertAlmostEqual(acme.certificate_not_after(f.read()) - time.time(), 90 * 86400, delta=60)
+        requests = ca.requests
+        self.assertEqual(acme.ensure_certificate(cfg, key_bits=1024), (cert_file, key_file))
+        self.assertEqual(ca.requests, requests)
+        with self.assertRaises(ValueError):
+            ACMEConfig(domains=['lab.example.com'])
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,363 @@
+import json
+import os
+import socket
+import tempfile
+import threading
+import time
+import unittest
+
+from yourtestsrv import netutil, stats
+from yourtestsrv.admin_server import AdminServer
+from yourtestsrv.clock import VirtualClock
+from yourtestsrv.http_server import HTTPServer
+from yourtestsrv.mqtt_client import MQTTClient
+from yourtestsrv.mqtt_server import MQTTServer
+from yourtestsrv.tcp_server import TCPServer
+
+
+def get_free_port():
+    with socket.socket() as s:
+        s.bind(('127.0.0.1', 0))
+        return s.getsockname()[1]
+
+
+def wait_tcp(port, timeout=2.0):
+    deadline = time.time() + timeout
+    while time.time() < deadline:
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=0.1):
+                return
+        except (ConnectionRefusedError, socket.timeout, OSError):
+            time.sleep(0.05)
+    raise RuntimeError(f'server not ready on port {port}')
+
+
+def http_get(port, path):
+    return http_request(port, 'GET', path)
+
+
+def http_request(port, method, path, body=None):
+    with socket.create_connection(('127.0.0.1', port)) as conn:
+        payload = json.dumps(body).encode() if body is not None else b''
+        conn.sendall(f'{method} {path} HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n'
+                     f'Content-Length: {len(payload)}\r\n\r\n'.encode() + payload)
+        conn.settimeout(2.0)
+        data = b''
+        while True:
+            chunk = conn.recv(4096)
+            if not chunk:
+                break
+            data += chunk
+    head, body = data.split(b'\r\n\r\n', 1)
+    return head, body
+
+
+class TestAdminStats(unittest.TestCase):
+    def test_parse_error_counted(self):
+        http_port = get_free_port()
+        admin_port = get_free_port()
+        stop = threading.Event()
+        srv = HTTPServer(http_port, '127.0.0.1')
+        admin = AdminServer(admin_port)
+        for target in (srv.listen_and_serve, admin.listen_and_serve):
+            threading.Thread(target=target, args=(stop,), daemon=True).start()
+        wait_tcp(http_port)
+        wait_tcp(admin_port)
+        try:
+            with socket.create_connection(('127.0.0.1', http_port)) as conn:
+                conn.sendall(b'garbage\r\n')
+                conn.settimeout(2.0)
+                self.assertIn(b'400', conn.recv(4096))
+            head, body = http_get(admin_port, '/stats')
+            self.assertIn(b'200', head)
+            snapshot = json.loads(body)
+            self.assertEqual(snapshot[f'http:{http_port}']['errors']['parse'], 1)
+        finally:
+            stop.set()
+
+    def test_unknown_endpoint(self):
+        admin_port = get_free_port()
+        stop = threading.Event()
+        admin = AdminServer(admin_port)
+        threading.Thread(target=admin.listen_and_serve, args=(stop,), daemon=True).start()
+        wait_tcp(admin_port)
+        try:
+            head, _ = http_get(admin_port, '/nope')
+            self.assertIn(b'404', head)
+        finally:
+            stop.set()
+
+    def test_connection_table_and_watchdog(self):
+        tcp_port = get_free_port()
+        admin_port = get_free_port()
+        stop = threading.Event()
+        srv = TCPServer(tcp_port, '127.0.0.1')
+        admin = AdminServer(admin_port)
+        for target in (srv.listen_and_serve, admin.listen_and_serve):
+            threading.Thread(target=target, args=(stop,), daemon=True).start()
+        wait_tcp(tcp_port)
+        wait_tcp(admin_port)
+        try:
+            with socket.create_connection(('127.0.0.1', tcp_port)) as conn:
+                conn.sendall(b'hello')
+                conn.settimeout(2.0)
+                conn.recv(16)
+                _, body = http_get(admin_port, '/debug/connections')
+                mine = [c for c in json.loads(body) if c['server'] == f'tcp:{tcp_port}']
+                self.assertEqual(len(mine), 1)
+                self.assertEqual(mine[0]['peak_buffered'], 5)
+                time.sleep(0.2)
+                flagged = stats.ConnectionWatchdog(max_idle=0.1).check()
+                self.assertIn('idle', next(c for c in flagged if c.server == f'tcp:{tcp_port}').flags)
+        finally:
+            stop.set()
+
+    def test_watchdog_pooled_connections(self):
+        # A pool worker that returns without closing its entry is flagged once it serves another
+        # connection; the connection it serves now is not.
+        pool = netutil.WorkerPool(1, 'test')
+        opened = []
+        release = threading.Event()
+        self.addCleanup(release.set)
+
+        def serve(name, block):
+            info = stats.connections.open(name, ('127.0.0.1', 1))
+            opened.append(info)
+            if block:
+                release.wait(5.0)
+                stats.connections.close(info)
+
+        pool.submit(serve, 'pool-test:leaked', False)
+        pool.submit(serve, 'pool-test:busy', True)
+        deadline = time.time() + 2.0
+        while len(opened) < 2 and time.time() < deadline:
+            time.sleep(0.01)
+        try:
+            flagged = {info.server: info.flags for info in stats.ConnectionWatchdog().check()}
+            self.assertIn('thread-dead', flagged['pool-test:leaked'])
+            self.assertNotIn('pool-test:busy', flagged)
+        finally:
+            stats.connections.close(opened[0])
+
+    def test_classify_error(self):
+        self.assertEqual(stats.classify_error(socket.timeout()), stats.ERROR_TIMEOUT)
+        self.assertEqual(stats.classify_error(ConnectionResetError()), stats.ERROR_RESET)
+        self.assertEqual(stats.classify_error(ValueError()), stats.ERROR_PARSE)
+
+    def test_persisted_counters(self):
+        with tempfile.TemporaryDirectory() as d:
+            persister = stats.StatsPersister(os.path.join(d, 'stats.json'))
+            before = stats.ServerStats()
+            stats.register('persist-test:1', before)
+            before.record_error(stats.ERROR_RESET)
+            before.record_error(stats.ERROR_RESET)
+            persister.save()
+            stats.unregister('persist-test:1')
+            # A restart: the file is loaded before the new server registers.
+            self.assertGreaterEqual(persister.load(), 1)
+            after = stats.ServerStats()
+            stats.register('persist-test:1', after)
+            try:
+                after.record_error(stats.ERROR_RESET)
+                self.assertEqual(after.errors.get(stats.ERROR_RESET), 3)
+            finally:
+                stats.unregister('persist-test:1')
+                stats._restored.clear()
+
+
+class TestAdminSessions(unittest.TestCase):
+    def test_session_lifecycle(self):
+        admin_port = get_free_port()
+        stop = threading.Event()
+        admin = AdminServer(admin_port)
+        threading.Thread(target=admin.listen_and_serve, args=(stop,), daemon=True).start()
+        wait_tcp(admin_port)
+        try:
+            spec = {'name': 'run1', 'servers': [{'type': 'tcp'}, {'type': 'udp'}]}
+            head, body = http_request(admin_port, 'POST', '/sessions', spec)
+            self.assertIn(b'201', head)
+            listeners = json.loads(body)['listeners']
+            tcp_port = int(listeners[0]['addr'].rsplit(':', 1)[1])
+            udp_port = int(listeners[1]['addr'].rsplit(':', 1)[1])
+            with socket.create_connection(('127.0.0.1', tcp_port), timeout=2.0) as conn:
+                conn.sendall(b'hi')
+                self.assertEqual(conn.recv(16), b'hi')
+            with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as conn:
+                conn.settimeout(2.0)
+                conn.sendto(b'hi', ('127.0.0.1', udp_port))
+                self.assertEqual(conn.recvfrom(16)[0], b'hi')
+
+            head, _ = http_request(admin_port, 'POST', '/sessions', spec)
+            self.assertIn(b'400', head)
+            head, _ = http_request(admin_port, 'POST', '/sessions', {'name': 'bad', 'servers': [{'type': 'ftp'}]})
+            self.assertIn(b'400', head)
+            head, body = http_get(admin_port, '/sessions')
+            self.assertEqual([s['name'] for s in json.loads(body)], ['run1'])
+
+            head, _ = http_request(admin_port, 'DELETE', '/sessions/run1')
+            self.assertIn(b'200', head)
+            head, _ = http_get(admin_port, '/sessions/run1')
+            self.assertIn(b'404', head)
+            self.assertFalse({f'tcp:{tcp_port}', f'udp:{udp_port}'} & set(stats.snapshot()))
+            time.sleep(1.5)
+            with self.assertRaises(OSError):
+                socket.create_connection(('127.0.0.1', tcp_port), timeout=0.5).close()
+        finally:
+            stop.set()
+
+
+class TestAdminMQTTState(unittest.TestCase):
+    def start_mqtt(self, stop):
+        sock = socket.create_server(('127.0.0.1', 0))
+        srv = MQTTServer(0, '127.0.0.1')
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        return srv, sock.getsockname()[1]
+
+    def test_publish_validation(self):
+        admin_port = get_free_port()
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+        srv, _ = self.start_mqtt(stop)
+        admin = AdminServer(admin_port, mqtt_servers=[srv])
+        threading.Thread(target=admin.listen_and_serve, args=(stop,), daemon=True).start()
+        wait_tcp(admin_port)
+        for bad in ({'topic': 't', 'payload': 5}, {'topic': 't', 'payload_hex': 'zz'}, {'payload': 'x'}):
+            head, body = http_request(admin_port, 'POST', '/mqtt/publish', bad)
+            self.assertIn(b' 400 ', head.split(b'\r\n')[0], bad)
+            self.assertIn('invalid publish request', json.loads(body)['error'])
+        head, _ = http_request(admin_port, 'POST', '/mqtt/publish', {'topic': 't', 'payload': 'x'})
+        self.assertIn(b' 200 ', head.split(b'\r\n')[0])
+
+    def test_export_and_preload(self):
+        admin_port = get_free_port()
+        stop = threading.Event()
+        first, first_port = self.start_mqtt(stop)
+        second, second_port = self.start_mqtt(stop)
+        admin = AdminServer(admin_port, mqtt_servers=[first])
+        threading.Thread(target=admin.listen_and_serve, args=(stop,), daemon=True).start()
+        wait_tcp(admin_port)
+        path = os.path.join(tempfile.mkdtemp(), 'state.json')
+        try:
+            client = MQTTClient('127.0.0.1', first_port, 'dev1', clean_session=False)
+            client.connect()
+            client.subscribe('a/#', qos=1)
+            client.publish('a/1', b'x', retain=True)
+            client.disconnect()
+
+            head, body = http_request(admin_port, 'POST', '/mqtt/state/export', {'path': path})
+            self.assertIn(b'200', head)
+            with open(path) as f:
+                state = json.load(f)
+            self.assertEqual(state['retained'], [{'topic': 'a/1', 'payload_hex': '78', 'qos': 0}])
+            self.assertEqual(state['subscriptions'], {'dev1': {'a/#': 1}})
+
+            admin.mqtt_servers = [second]
+            head, body = http_request(admin_port, 'POST', '/mqtt/state/load', {'path': path})
+            self.assertEqual(json.loads(body), {'servers': 1, 'retained': 1, 'subscriptions': 1})
+
+            received = []
+            client = MQTTClient('127.0.0.1', second_port, 'dev1', clean_session=False,
+                                on_message=lambda *m: received.append(m))
+            self.assertEqual(client.connect()[0], 1, 'session present')
+            second.publish('a/2', b'y')
+            deadline = time.time() + 2.0
+            while not received and time.time() < deadline:
+                time.sleep(0.02)
+            self.assertEqual(received, [('a/2', b'y', 0, False)])
+            client.disconnect()
+        finally:
+            stop.set()
+
+
+class TestAdminHandlers(unittest.TestCase):
+    def serve(self, srv, stop):
+        sock = socket.create_server(('127.0.0.1', 0))
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        return sock.getsockname()[1]
+
+    def test_swap_without_dropping_connections(self):
+        stop = threading.Event()
+        tcp, http, mqtt = TCPServer(0, '127.0.0.1'), HTTPServer(0, '127.0.0.1'), MQTTServer(0, '127.0.0.1')
+        tcp_port, http_port, mqtt_port = (self.serve(srv, stop) for srv in (tcp, http, mqtt))
+        admin_port = get_free_port()
+        threading.Thread(target=AdminServer(admin_port, servers=[tcp, http, mqtt]).listen_and_serve,
+                         args=(stop,), daemon=True).start()
+        wait_tcp(admin_port)
+        try:
+            with socket.create_connection(('127.0.0.1', tcp_port), timeout=2.0) as conn:
+                conn.sendall(b'PING')
+                self.assertEqual(conn.recv(16), b'PING')
+                spec = {'server': f'tcp:{tcp_port}', 'rules': [{'exact': 'PING', 'reply': 'PONG'}]}
+                head, body = http_request(admin_port, 'PUT', '/handlers/pong', spec)
+                self.assertIn(b'201', head)
+                conn.sendall(b'PING')
+                self.assertEqual(conn.recv(16), b'PONG')
+                spec['rules'][0]['reply'] = 'PONG2'
+                head, body = http_request(admin_port, 'PUT', '/handlers/pong', spec)
+                self.assertTrue(json.loads(body)['replaced'])
+                conn.sendall(b'PING')
+                self.assertEqual(conn.recv(16), b'PONG2')
+                head, _ = http_request(admin_port, 'DELETE', '/handlers/pong')
+                self.assertIn(b'200', head)
+                conn.sendall(b'PING')
+                self.assertEqual(conn.recv(16), b'PING')
+
+            spec = {'server': 'http', 'route': '^/api/status', 'status': 503, 'json': {'state': 'maintenance'}}
+            self.assertIn(b'201', http_request(admin_port, 'PUT', '/handlers/down', spec)[0])
+            head, body = http_get(http_port, '/api/status')
+            self.assertTrue(head.startswith(b'HTTP/1.1 503'))
+            self.assertEqual(json.loads(body), {'state': 'maintenance'})
+            self.assertIn(b'200', http_get(http_port, '/other')[0])
+
+            spec = {'server': 'mqtt', 'topic': 'dev/+/cmd', 'reply_topic': '{topic}/ack', 'payload': 'ok'}
+            self.assertIn(b'201', http_request(admin_port, 'PUT', '/handlers/ack', spec)[0])
+            received = []
+            client = MQTTClient('127.0.0.1', mqtt_port, 'dev1', on_message=lambda *m: received.append(m))
+            client.connect()
+            client.subscribe('dev/1/cmd/ack')
+            client.publish('dev/1/cmd', b'reboot')
+            deadline = time.time() + 2.0
+            while not received and time.time() < deadline:
+                time.sleep(0.02)
+            self.assertEqual(received, [('dev/1/cmd/ack', b'ok', 0, False)])
+            client.disconnect()
+
+            _, body = http_get(admin_port, '/handlers')
+            self.assertEqual(sorted(h['name'] for h in json.loads(body)), ['ack', 'down'])
+            self.assertIn(b'400', http_request(admin_port, 'PUT', '/handlers/x', {'server': 'http'})[0])
+            self.assertIn(b'404', http_request(admin_port, 'PUT', '/handlers/x',
+                                               {'server': 'tcp:1', 'response_hex': '00'})[0])
+        finally:
+            stop.set()
+
+
+class TestAdminClock(unittest.TestCase):
+    def test_advance_virtual_clock(self):
+        admin_port = get_free_port()
+        stop = threading.Event()
+        clock = VirtualClock(start=5000.0)
+        threading.Thread(target=AdminServer(admin_port, clock=clock).listen_and_serve, args=(stop,),
+                         daemon=True).start()
+        wait_tcp(admin_port)
+        try:
+            head, body = http_request(admin_port, 'POST', '/clock/advance', {'by': '1m30s'})
+            self.assertIn(b'200', head)
+            self.assertEqual(json.loads(body), {'time': 5090.0, 'virtual': True})
+            self.assertEqual(clock.time(), 5090.0)
+        finally:
+            stop.set()
+
+    def test_real_clock_cannot_advance(self):
+        admin_port = get_free_port()
+        stop = threading.Event()
+        threading.Thread(target=AdminServer(admin_port).listen_and_serve, args=(stop,), daemon=True).start()
+        wait_tcp(admin_port)
+        try:
+            head, _ = http_request(admin_port, 'POST', '/clock/advance', {'by': '1s'})
+            self.assertIn(b'409', head)
+        finally:
+            stop.set()
+
+
+if __name__ == '__main__':
+    unittest.main()
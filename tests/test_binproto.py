@@ -0,0 +1,48 @@
+import unittest
+
+from yourtestsrv.binproto import BinaryTemplate, crc16_ccitt, crc16_modbus, crc16_xmodem
+
+
+FRAME = {'fields': [
+    {'name': 'magic', 'type': 'u16', 'value': 0xABCD},
+    {'name': 'len', 'type': 'u8', 'length_of': ['cmd', 'seq', 'data']},
+    {'name': 'cmd', 'type': 'u8', 'value': 0x81},
+    {'name': 'seq', 'type': 'bytes', 'from_request': [2, 4]},
+    {'name': 'data', 'type': 'bytes', 'text': 'ok'},
+    {'name': 'crc', 'type': 'u16', 'endian': 'little', 'checksum': 'crc16_modbus',
+     'over': ['len', 'cmd', 'seq', 'data']},
+]}
+
+
+class TestBinaryTemplate(unittest.TestCase):
+    def test_crc_check_values(self):
+        self.assertEqual(crc16_modbus(b'123456789'), 0x4B37)
+        self.assertEqual(crc16_ccitt(b'123456789'), 0x29B1)
+        self.assertEqual(crc16_xmodem(b'123456789'), 0x31C3)
+
+    def test_length_and_checksum(self):
+        frame = BinaryTemplate(FRAME).build(b'\x00\x00\x12\x34')
+        body = bytes([5, 0x81, 0x12, 0x34]) + b'ok'
+        self.assertEqual(frame[:2], b'\xab\xcd')
+        self.assertEqual(frame[2:-2], body)
+        self.assertEqual(int.from_bytes(frame[-2:], 'little'), crc16_modbus(body))
+
+    def test_default_checksum_covers_preceding_fields(self):
+        t = BinaryTemplate([{'name': 'a', 'type': 'bytes', 'hex': '0102'},
+                            {'name': 'sum', 'type': 'u8', 'checksum': 'sum8'}])
+        self.assertEqual(t.build(), b'\x01\x02\x03')
+
+    def test_invalid_templates(self):
+        for spec in ([],
+                     [{'name': 'x', 'type': 'u24'}],
+                     [{'name': 'x', 'type': 'u8', 'value': 256}],
+                     [{'name': 'x', 'type': 'u8', 'length_of': ['nope']}],
+                     [{'name': 'x', 'type': 'u16', 'checksum': 'md5'}],
+                     [{'name': 'len', 'type': 'u8', 'length_of': ['crc']},
+                      {'name': 'crc', 'type': 'u8', 'checksum': 'xor8'}]):
+            with self.assertRaises(ValueError, msg=spec):
+                BinaryTemplate(spec)
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,68 @@
+import socket
+import sys
+import threading
+import unittest
+
+from yourtestsrv.admin_server import AdminServer
+from yourtestsrv.bisect import AdminRunner, BisectSpec, Bisector, format_report
+
+ECHO_CHECK = ('import socket, sys; c = socket.create_connection((sys.argv[1], int(sys.argv[2])), timeout=5); '
+              'c.sendall(b"ping"); sys.exit(0 if c.recv(16) == b"ping" else 1)')
+
+
+def fake_runner(culprits):
+    def run(names):
+        return set(culprits) <= set(names), ''
+    return run
+
+
+class TestBisect(unittest.TestCase):
+    def spec(self, *names):
+        return BisectSpec({name: True for name in names}, command='true')
+
+    def test_minimal_combination(self):
+        spec = BisectSpec({'delay': '2s', 'corrupt_rate': 0.01, 'stall': True,
+                           'reset': {'close_mode': 'rst', 'close_after_bytes': 100}}, server={'port': 9500})
+        bisector = Bisector(spec, fake_runner(['corrupt_rate', 'reset']))
+        report = bisector.run()
+        self.assertEqual(report['verdict'], 'minimal')
+        self.assertEqual(sorted(report['minimal']), ['corrupt_rate', 'reset'])
+        self.assertEqual(report['options'], {'type': 'tcp', 'port': 9500, 'corrupt_rate': 0.01,
+                                             'close_mode': 'rst', 'close_after_bytes': 100})
+        combinations = [tuple(run['faults']) for run in report['runs']]
+        self.assertEqual(len(combinations), len(set(combinations)))
+        self.assertIn('Minimal failing combination: ', format_report(report))
+
+    def test_single_culprit_among_many(self):
+        names = [f'f{i}' for i in range(12)]
+        report = Bisector(self.spec(*names), fake_runner(['f7'])).run()
+        self.assertEqual(report['minimal'], ['f7'])
+        self.assertLess(len(report['runs']), 12)
+
+    def test_verdicts(self):
+        self.assertEqual(Bisector(self.spec('a', 'b'), lambda names: (False, '')).run()['verdict'], 'not_reproduced')
+        report = Bisector(self.spec('a', 'b'), lambda names: (True, 'exit status 1')).run()
+        self.assertEqual(report['verdict'], 'fails_without_faults')
+        self.assertIn('FAIL (exit status 1)', format_report(report))
+        with self.assertRaises(ValueError):
+            BisectSpec({})
+
+
+class TestBisectAdmin(unittest.TestCase):
+    def test_sessions_through_admin(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        stop = threading.Event()
+        admin = AdminServer(0)
+        threading.Thread(target=admin.serve, args=(stop, sock), daemon=True).start()
+        self.addCleanup(stop.set)
+        spec = BisectSpec({'delay': '10ms', 'corrupt_rate': 1.0, 'idle_timeout': '5s'},
+                          command=f'"{sys.executable}" -c \'{ECHO_CHECK}\' {{host}} {{port}}',
+                          admin=f'127.0.0.1:{sock.getsockname()[1]}', timeout='10s')
+        report = Bisector(spec, AdminRunner(spec)).run()
+        self.assertEqual(report['verdict'], 'minimal')
+        self.assertEqual(report['minimal'], ['corrupt_rate'])
+        self.assertEqual(admin.sessions.list(), [])
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,77 @@
+import os
+import subprocess
+import sys
+import tarfile
+import tempfile
+import threading
+import time
+import unittest
+
+from yourtestsrv import stats
+from yourtestsrv.bundle import EventBundler
+
+ROOT = os.path.dirname(os.path.dirname(os.path.abspath(__file__)))
+
+
+def wait_for_bundle(out_dir, timeout=3.0):
+    deadline = time.time() + timeout
+    while time.time() < deadline:
+        if os.path.isdir(out_dir) and os.listdir(out_dir):
+            return [os.path.join(out_dir, name) for name in os.listdir(out_dir)]
+        time.sleep(0.05)
+    raise AssertionError('no bundle written')
+
+
+class TestEventBundler(unittest.TestCase):
+    def test_parse_error_bundle(self):
+        out_dir = os.path.join(tempfile.mkdtemp(), 'bundles')
+        config_path = out_dir + '-config.json'
+        with open(config_path, 'w') as f:
+            f.write('{"server": {}}')
+        server_stats = stats.ServerStats()
+        stats.register('bundle-test:1', server_stats)
+        stop = threading.Event()
+        bundler = EventBundler(['parse_error'], out_dir, config_path=config_path, interval=0.1)
+        threading.Thread(target=bundler.run, args=(stop,), daemon=True).start()
+        try:
+            time.sleep(0.2)
+            server_stats.record_error(stats.ERROR_PARSE)
+            paths = wait_for_bundle(out_dir)
+        finally:
+            stop.set()
+            stats.unregister('bundle-test:1')
+        self.assertEqual(len(paths), 1)
+        self.assertIn('parse_error', os.path.basename(paths[0]))
+        with tarfile.open(paths[0]) as tar:
+            names = sorted(os.path.basename(n) for n in tar.getnames())
+        self.assertEqual(names, ['config.json', 'connections.json', 'log.txt', 'manifest.json', 'stats.json'])
+
+    def test_disconnect_storm_and_cooldown(self):
+        out_dir = os.path.join(tempfile.mkdtemp(), 'bundles')
+        table = stats.ConnectionTable()
+        stop = threading.Event()
+        bundler = EventBundler(['disconnect_storm'], out_dir, storm_threshold=5, storm_window=5.0,
+                               interval=0.1, table=table)
+        threading.Thread(target=bundler.run, args=(stop,), daemon=True).start()
+        try:
+            time.sleep(0.2)
+            for _ in range(5):
+                table.close(table.open('tcp:0', ('127.0.0.1', 1)))
+            wait_for_bundle(out_dir)
+            self.assertIsNone(bundler.fire('disconnect_storm'))
+        finally:
+            stop.set()
+
+    def test_unknown_event(self):
+        with self.assertRaises(ValueError):
+            EventBundler(['meteor'])
+        result = subprocess.run([sys.executable, os.path.join(ROOT, 'yourtestsrv.py'), 'serve-all',
+                                 '--config', os.path.join(ROOT, 'config.json'), '--bundle-on-event',
+                                 'parse_error,meteor'], capture_output=True, text=True, timeout=30)
+        self.assertEqual(result.returncode, 2)
+        self.assertIn('unknown event(s) meteor', result.stderr)
+        self.assertNotIn('Traceback', result.stderr)
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,124 @@
+import os
+import shutil
+import socket
+import struct
+import tempfile
+import threading
+import unittest
+
+from yourtestsrv import capture
+from yourtestsrv.config import TCPConfig
+from yourtestsrv.payload import make_generator
+from yourtestsrv.udp_server import UDPServer
+
+DEVICE = ('192.168.1.20', 40000)
+SERVER = ('192.168.1.1', 5683)
+
+
+def ip_frame(proto, src, dst, payload):
+    """An Ethernet + IPv4 + TCP/UDP frame carrying payload."""
+    ports = struct.pack('>HH', src[1], dst[1])
+    if proto == 'udp':
+        l4 = ports + struct.pack('>HH', 8 + len(payload), 0)
+    else:
+        l4 = ports + struct.pack('>IIBBHHH', 1, 0, 5 << 4, 0x18, 65535, 0, 0)
+    body = l4 + payload
+    ip = struct.pack('>BBHHHBBH4s4s', 0x45, 0, 20 + len(body), 0, 0x4000, 64, 17 if proto == 'udp' else 6, 0,
+                     socket.inet_aton(src[0]), socket.inet_aton(dst[0]))
+    return b'\x00\x11\x22\x33\x44\x55\x66\x77\x88\x99\xaa\xbb\x08\x00' + ip + body
+
+
+FRAMES = [
+    ip_frame('udp', DEVICE, SERVER, b'\x40\x01\x00\x01'),
+    ip_frame('udp', SERVER, DEVICE, b'\x60\x45\x00\x01\xffok'),
+    ip_frame('tcp', DEVICE, ('192.168.1.1', 9000), b'GET'),
+    ip_frame('tcp', ('192.168.1.1', 9000), DEVICE, b'part1-'),
+    ip_frame('tcp', ('192.168.1.1', 9000), DEVICE, b'part2'),
+]
+
+
+def write_pcap(path, frames):
+    with open(path, 'wb') as f:
+        f.write(struct.pack('<IHHiIII', 0xa1b2c3d4, 2, 4, 0, 0, 65535, 1))
+        for frame in frames:
+            f.write(struct.pack('<IIII', 0, 0, len(frame), len(frame)) + frame)
+
+
+def write_pcapng(path, frames):
+    def block(kind, body):
+        body += b'\x00' * (-len(body) % 4)
+        return struct.pack('<II', kind, len(body) + 12) + body + struct.pack('<I', len(body) + 12)
+    with open(path, 'wb') as f:
+        f.write(block(0x0A0D0D0A, struct.pack('<IHHq', 0x1A2B3C4D, 1, 0, -1)))
+        f.write(block(1, struct.pack('<HHI', 1, 0, 65535)))
+        for frame in frames:
+            f.write(block(6, struct.pack('<IIIII', 0, 0, 0, len(frame), len(frame)) + frame))
+
+
+def wireshark_hexdump(frame):
+    lines = []
+    for offset in range(0, len(frame), 16):
+        chunk = frame[offset:offset + 16]
+        text = ''.join(chr(b) if 32 <= b < 127 else '.' for b in chunk)
+        lines.append(f'{offset:04x}   {" ".join(f"{b:02x}" for b in chunk):<47}   {text}')
+    return '\n'.join(lines)
+
+
+class TestCapture(unittest.TestCase):
+    def setUp(self):
+        self.dir = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, self.dir)
+
+    def path(self, name):
+        return os.path.join(self.dir, name)
+
+    def test_pcap_and_pcapng_filters(self):
+        write_pcap(self.path('a.pcap'), FRAMES)
+        write_pcapng(self.path('a.pcapng'), FRAMES)
+        for name in ('a.pcap', 'a.pcapng'):
+            packets = capture.read_packets(self.path(name))
+            self.assertEqual(capture.select(packets, {'proto': 'udp', 'src_port': 5683}), [b'\x60\x45\x00\x01\xffok'])
+            self.assertEqual(capture.select(packets, {'packet': 3}), [b'GET'])
+            self.assertEqual([p.stream for p in packets], [0, 0, 0, 0, 0])
+            self.assertEqual(capture.extract(self.path(name), {'proto': 'tcp', 'src_port': '9000'}, join=True),
+                             [b'part1-part2'])
+        with self.assertRaises(ValueError):
+            capture.extract(self.path('a.pcap'), {'dst_port': 1})
+        with self.assertRaises(ValueError):
+            capture.select([], {'bogus': 1})
+
+    def test_hexdump(self):
+        with open(self.path('dump.txt'), 'w') as f:
+            f.write('Frame 2: 60 bytes\n' + wireshark_hexdump(FRAMES[1]) + '\n\n' + wireshark_hexdump(FRAMES[2]) + '\n')
+        packets = capture.read_packets(self.path('dump.txt'))
+        self.assertEqual([p.payload for p in packets], [b'\x60\x45\x00\x01\xffok', b'GET'])
+        with open(self.path('stream.txt'), 'w') as f:
+            f.write('a5 5a 01 02\n')
+        self.assertEqual(capture.extract(self.path('stream.txt')), [b'\xa5\x5a\x01\x02'])
+        self.assertEqual(capture.parse_filter('proto=udp, packet=2'), {'proto': 'udp', 'packet': '2'})
+
+    def test_responses_and_generator(self):
+        write_pcap(self.path('a.pcap'), FRAMES)
+        cfg = TCPConfig(response_capture={'file': self.path('a.pcap'), 'filter': {'proto': 'tcp', 'port': 9000,
+                                                                                 'src_host': '192.168.1.1'}})
+        self.assertEqual(cfg.response.build(b'x'), b'part1-')
+        gen = make_generator({'type': 'capture', 'file': self.path('a.pcap'), 'filter': {'proto': 'udp'}})
+        self.assertEqual([gen.next() for _ in range(3)],
+                         [b'\x40\x01\x00\x01', b'\x60\x45\x00\x01\xffok', b'\x40\x01\x00\x01'])
+        srv = UDPServer(0, '127.0.0.1', response=capture.load_response(
+            {'file': self.path('a.pcap'), 'filter': {'src_port': 5683}}))
+        sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        sock.bind(('127.0.0.1', 0))
+        stop = threading.Event()
+        threading.Thread(target=srv.serve_udp, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as client:
+                client.settimeout(2.0)
+                client.sendto(b'\x40\x01\x00\x02', sock.getsockname())
+                self.assertEqual(client.recv(64), b'\x60\x45\x00\x01\xffok')
+        finally:
+            stop.set()
+
+
+if __name__ == '__main__':
+    unittest.main()
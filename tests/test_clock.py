@@ -0,0 +1,67 @@
+import socket
+import threading
+import time
+import unittest
+
+from yourtestsrv.clock import VirtualClock
+from yourtestsrv.tcp_server import TCPServer
+from yourtestsrv.udp_server import UDPServer
+
+
+class TestVirtualClock(unittest.TestCase):
+    def test_sleep_released_by_advance(self):
+        clock = VirtualClock(start=1000.0)
+        done = threading.Event()
+        threading.Thread(target=lambda: (clock.sleep(10), done.set()), daemon=True).start()
+        self.assertTrue(clock.wait_for_sleepers(1))
+        clock.advance(9)
+        self.assertFalse(done.wait(0.1))
+        clock.advance(1)
+        self.assertTrue(done.wait(1.0))
+        self.assertEqual(clock.time(), 1010.0)
+
+    def test_wait_returns_when_event_set(self):
+        clock = VirtualClock()
+        event = threading.Event()
+        threading.Timer(0.05, event.set).start()
+        self.assertTrue(clock.wait(event, 3600))
+
+    def test_tcp_delay_follows_virtual_time(self):
+        clock = VirtualClock()
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = TCPServer(0, '127.0.0.1', delay=30.0, clock=clock)
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+                conn.sendall(b'tick')
+                self.assertTrue(clock.wait_for_sleepers(1))
+                start = time.time()
+                clock.advance(30)
+                self.assertEqual(conn.recv(16), b'tick')
+                self.assertLess(time.time() - start, 1.0)
+        finally:
+            stop.set()
+
+    def test_udp_delay_follows_virtual_time(self):
+        clock = VirtualClock()
+        sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        sock.bind(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = UDPServer(0, '127.0.0.1', delay=60.0, clock=clock)
+        threading.Thread(target=srv.serve_udp, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as conn:
+                conn.settimeout(2.0)
+                conn.sendto(b'tock', ('127.0.0.1', port))
+                self.assertTrue(clock.wait_for_sleepers(1))
+                clock.advance(60)
+                self.assertEqual(conn.recvfrom(16)[0], b'tock')
+        finally:
+            stop.set()
+
+
+if __name__ == '__main__':
+    unittest.main()
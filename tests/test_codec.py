@@ -0,0 +1,54 @@
+import json
+import unittest
+
+from yourtestsrv import codec
+
+DOC = {'id': 'dev-1', 'seq': 70000, 'temp': -12.5, 'ok': True, 'err': None, 'raw': b'\x01\x02',
+       'n': [-1, -200, 2 ** 40, -2 ** 40], 'tags': ['a' * 40]}
+
+
+class TestCodec(unittest.TestCase):
+    def test_round_trip(self):
+        for fmt in ('cbor', 'msgpack'):
+            self.assertEqual(codec.decode(codec.encode(DOC, fmt), fmt), DOC)
+        self.assertEqual(codec.decode(codec.encode(DOC, 'json'), 'json')['raw'], '0102')
+
+    def test_known_encodings(self):
+        # RFC 8949 appendix A and the MessagePack spec.
+        self.assertEqual(codec.encode({'a': 1, 'b': [2, 3]}, 'cbor').hex(), 'a26161016162820203')
+        self.assertEqual(codec.decode(bytes.fromhex('f93e00'), 'cbor'), 1.5)
+        self.assertEqual(codec.decode(bytes.fromhex('c11a514b67b0'), 'cbor'), 1363896240)
+        self.assertEqual(codec.decode(bytes.fromhex('bf6346756ef563416d7421ff'), 'cbor'), {'Fun': True, 'Amt': -2})
+        self.assertEqual(codec.decode(bytes.fromhex('7f657374726561646d696e67ff'), 'cbor'), 'streaming')
+        self.assertEqual(codec.encode({'compact': True, 'schema': 0}, 'msgpack').hex(),
+                         '82a7636f6d70616374c3a6736368656d6100')
+        self.assertEqual(codec.decode(bytes.fromhex('93ffd0809201cd0100'), 'msgpack'), [-1, -128, [1, 256]])
+
+    def test_errors(self):
+        with self.assertRaises(ValueError):
+            codec.decode(b'\xa2\x61\x61', 'cbor')
+        with self.assertRaises(ValueError):
+            codec.decode(b'\x01\x02', 'msgpack')
+        with self.assertRaises(ValueError):
+            codec.decode(b'\xc1', 'msgpack')
+
+    def test_hostile_structures(self):
+        bodies = [(b'\xa1\xa0\x00', 'cbor'), (b'\xa1\x80\x00', 'cbor'), (b'\x81\x90\x00', 'msgpack'),
+                  (b'\x81' * 5000 + b'\x00', 'cbor'), (b'\xc0' * 5000 + b'\x00', 'cbor'),
+                  (b'\x91' * 5000 + b'\x00', 'msgpack'), (b'\x7f\x41\x00\xff', 'cbor')]
+        for data, fmt in bodies:
+            with self.assertRaises(ValueError):
+                codec.decode(data, fmt)
+        value = codec.decode(b'\xa1\x41\x01\x02', 'cbor')
+        self.assertEqual(json.loads(codec.encode(value, 'json')), {'01': 2})
+
+    def test_media_types(self):
+        self.assertEqual(codec.format_of('application/cbor'), 'cbor')
+        self.assertEqual(codec.format_of('application/senml+cbor; charset=x'), 'cbor')
+        self.assertEqual(codec.format_of('application/x-msgpack'), 'msgpack')
+        self.assertIsNone(codec.format_of('text/plain'))
+        self.assertEqual(codec.accepted_format('text/html, application/msgpack;q=0.9'), 'msgpack')
+
+
+if __name__ == '__main__':
+    unittest.main()
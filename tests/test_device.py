@@ -0,0 +1,81 @@
+import json
+import queue
+import socket
+import threading
+import time
+import unittest
+
+from yourtestsrv.device_sim import DeviceSimulator
+from yourtestsrv.http_server import HTTPServer, HTTPResponse
+from yourtestsrv.mqtt_client import MQTTClient
+from yourtestsrv.mqtt_server import MQTTServer
+
+
+def get_free_port():
+    with socket.socket() as s:
+        s.bind(('127.0.0.1', 0))
+        return s.getsockname()[1]
+
+
+def wait_tcp(port, timeout=2.0):
+    deadline = time.time() + timeout
+    while time.time() < deadline:
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=0.1):
+                return
+        except (ConnectionRefusedError, socket.timeout, OSError):
+            time.sleep(0.05)
+    raise RuntimeError(f'server not ready on port {port}')
+
+
+class TestDeviceSimulator(unittest.TestCase):
+    def test_mqtt_telemetry_and_command(self):
+        port = get_free_port()
+        stop = threading.Event()
+        srv = MQTTServer(port, '127.0.0.1')
+        threading.Thread(target=srv.listen_and_serve, args=(stop,), daemon=True).start()
+        wait_tcp(port)
+        messages = queue.Queue()
+        observer = MQTTClient('127.0.0.1', port, 'observer',
+                              on_message=lambda topic, payload, qos, retain: messages.put((topic, payload)))
+        try:
+            observer.connect()
+            observer.subscribe('devices/dev1/#')
+            sim = DeviceSimulator('dev1', interval=0.1, mqtt_host='127.0.0.1', mqtt_port=port)
+            threading.Thread(target=sim.run, args=(stop,), daemon=True).start()
+            topic, payload = messages.get(timeout=2.0)
+            self.assertEqual(topic, 'devices/dev1/telemetry')
+            self.assertIn('seq', json.loads(payload))
+            observer.publish('devices/dev1/commands', b'reboot')
+            while True:
+                topic, payload = messages.get(timeout=2.0)
+                if topic == 'devices/dev1/responses':
+                    break
+            self.assertEqual(json.loads(payload)['command'], 'reboot')
+        finally:
+            observer.close()
+            stop.set()
+
+    def test_http_telemetry(self):
+        port = get_free_port()
+        stop = threading.Event()
+        bodies = queue.Queue()
+
+        def handler(req):
+            bodies.put(req.body)
+            return HTTPResponse(204, 'No Content')
+
+        srv = HTTPServer(port, '127.0.0.1', handler=handler)
+        threading.Thread(target=srv.listen_and_serve, args=(stop,), daemon=True).start()
+        wait_tcp(port)
+        try:
+            sim = DeviceSimulator('dev2', interval=0.1, payload={'type': 'pattern', 'pattern': 'hi'},
+                                  http_url=f'http://127.0.0.1:{port}/ingest')
+            threading.Thread(target=sim.run, args=(stop,), daemon=True).start()
+            self.assertEqual(bodies.get(timeout=2.0), b'hi')
+        finally:
+            stop.set()
+
+
+if __name__ == '__main__':
+    unittest.main()
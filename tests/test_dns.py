@@ -0,0 +1,261 @@
+import base64
+import socket
+import ssl
+import struct
+import tempfile
+import threading
+import time
+import unittest
+
+from yourtestsrv import dns_server as dns
+from yourtestsrv.config import DNSConfig
+from yourtestsrv.http_probe import parse_responses
+from yourtestsrv.http_server import HTTPRequest, HTTPServer
+from yourtestsrv.tcp_server import TCPServer
+from yourtestsrv.udp_server import UDPServer
+
+ADDR = ('10.1.2.3', 5353)
+RECORDS = {
+    'device.example.com': ['192.0.2.10', '2001:db8::10'],
+    'api.example.com': {'CNAME': 'device.example.com', 'ttl': 5},
+    '*.lab.example.com': {'A': '192.0.2.20'},
+    'big.example.com': [f'192.0.2.{i}' for i in range(1, 41)],
+}
+
+
+def query(name, qtype='A', id=0x1234, edns_size=0):
+    additional = b''
+    if edns_size:
+        additional = b'\x00' + struct.pack('>HHIH', dns.TYPES['OPT'], edns_size, 0, 0)
+    header = struct.pack('>HHHHHH', id, 0x0100, 1, 0, 0, 1 if edns_size else 0)
+    return header + dns.encode_name(name) + struct.pack('>HH', dns.TYPES[qtype], 1) + additional
+
+
+def answers(response):
+    return [(name, rtype, value) for name, rtype, _, value in dns.parse_response(response)[3]]
+
+
+def make_temp_cert():
+    from cryptography import x509
+    from cryptography.x509.oid import NameOID
+    from cryptography.hazmat.primitives import hashes, serialization
+    from cryptography.hazmat.primitives.asymmetric import rsa
+    import datetime
+    key = rsa.generate_private_key(public_exponent=65537, key_size=2048)
+    subject = issuer = x509.Name([x509.NameAttribute(NameOID.COMMON_NAME, 'localhost')])
+    now = datetime.datetime.now(datetime.timezone.utc)
+    cert = (x509.CertificateBuilder()
+            .subject_name(subject).issuer_name(issuer)
+            .public_key(key.public_key())
+            .serial_number(x509.random_serial_number())
+            .not_valid_before(now - datetime.timedelta(hours=1))
+            .not_valid_after(now + datetime.timedelta(hours=1))
+            .sign(key, hashes.SHA256()))
+    td = tempfile.mkdtemp()
+    with open(td + '/cert.pem', 'wb') as f:
+        f.write(cert.public_bytes(serialization.Encoding.PEM))
+    with open(td + '/key.pem', 'wb') as f:
+        f.write(key.private_bytes(serialization.Encoding.PEM, serialization.PrivateFormat.TraditionalOpenSSL,
+                                  serialization.NoEncryption()))
+    return td + '/cert.pem', td + '/key.pem'
+
+
+def tcp_exchange(conn, message):
+    conn.sendall(struct.pack('>H', len(message)) + message)
+    data = b''
+    while len(data) < 2 or len(data) < 2 + struct.unpack_from('>H', data)[0]:
+        chunk = conn.recv(4096)
+        if not chunk:
+            break
+        data += chunk
+    return data[2:]
+
+
+class TestDNSResponder(unittest.TestCase):
+    def test_records(self):
+        responder = dns.DNSResponder(RECORDS)
+        response = responder.respond(ADDR, query('Device.Example.com'))
+        id, flags, rcode, _ = dns.parse_response(response)
+        self.assertEqual((id, rcode, flags & 0x8000, flags & 0x0100), (0x1234, dns.NOERROR, 0x8000, 0x0100))
+        # The owner name keeps the question's case, as resolvers randomising it expect.
+        self.assertEqual(answers(response), [('Device.Example.com', 'A', '192.0.2.10')])
+        self.assertEqual(answers(responder.respond(ADDR, query('device.example.com', 'AAAA'))),
+                         [('device.example.com', 'AAAA', '2001:db8::10')])
+        self.assertEqual(answers(responder.respond(ADDR, query('api.example.com'))),
+                         [('api.example.com', 'CNAME', 'device.example.com'),
+                          ('device.example.com', 'A', '192.0.2.10')])
+        self.assertEqual(dns.parse_response(responder.respond(ADDR, query('api.example.com')))[3][0][2], 5)
+        self.assertEqual(answers(responder.respond(ADDR, query('x.lab.example.com'))),
+                         [('x.lab.example.com', 'A', '192.0.2.20')])
+        response = responder.respond(ADDR, query('x.lab.example.com', 'AAAA'))
+        self.assertEqual((dns.parse_response(response)[2], answers(response)), (dns.NOERROR, []))
+        self.assertEqual(dns.parse_response(responder.respond(ADDR, query('nope.example.com')))[2], dns.NXDOMAIN)
+        self.assertIsNone(responder.respond(ADDR, b'\x00\x01'))
+
+    def test_truncation(self):
+        responder = dns.DNSResponder(RECORDS)
+        response = responder.respond(ADDR, query('big.example.com'))
+        self.assertTrue(dns.parse_response(response)[1] & 0x0200)
+        self.assertEqual(answers(response), [])
+        self.assertEqual(len(answers(responder.respond(ADDR, query('big.example.com'), tcp=True))), 40)
+        self.assertEqual(len(answers(responder.respond(ADDR, query('big.example.com', edns_size=1232)))), 40)
+
+    def test_modes(self):
+        for mode, rcode in (('nxdomain', dns.NXDOMAIN), ('servfail', dns.SERVFAIL), ('refused', dns.REFUSED)):
+            with self.subTest(mode=mode):
+                response = dns.DNSResponder(RECORDS, mode=mode).respond(ADDR, query('device.example.com'))
+                self.assertEqual(dns.parse_response(response)[2], rcode)
+        truncating = dns.DNSResponder(RECORDS, mode='truncate')
+        self.assertTrue(dns.parse_response(truncating.respond(ADDR, query('device.example.com')))[1] & 0x0200)
+        self.assertEqual(len(answers(truncating.respond(ADDR, query('device.example.com'), tcp=True))), 1)
+        ipv6_only = dns.DNSResponder(RECORDS, mode='aaaa_only')
+        self.assertEqual(answers(ipv6_only.respond(ADDR, query('api.example.com'))),
+                         [('api.example.com', 'CNAME', 'device.example.com')])
+        self.assertEqual(answers(ipv6_only.respond(ADDR, query('device.example.com', 'AAAA'))),
+                         [('device.example.com', 'AAAA', '2001:db8::10')])
+        self.assertIsNone(dns.DNSResponder(RECORDS, mode='silent').respond(ADDR, query('device.example.com')))
+
+    def test_scenarios(self):
+        responder = dns.DNSResponder(RECORDS, scenarios=[
+            {'name': 'api.example.com', 'mode': 'servfail'},
+            {'name': '*.example.com', 'type': 'AAAA', 'mode': 'silent'},
+            {'name': 'device.example.com', 'delay': '100ms'},
+        ])
+        self.assertEqual(dns.parse_response(responder.respond(ADDR, query('api.example.com')))[2], dns.SERVFAIL)
+        self.assertIsNone(responder.respond(ADDR, query('device.example.com', 'AAAA')))
+        started = time.monotonic()
+        self.assertEqual(len(answers(responder.respond(ADDR, query('device.example.com')))), 1)
+        self.assertGreaterEqual(time.monotonic() - started, 0.1)
+        for bad in ({'mode': 'nope'}, {'rate': 2}, {'type': 'XYZ'}, {'name': 'a', 'extra': 1}):
+            with self.assertRaises(ValueError):
+                dns.Scenario(bad)
+
+    def test_config(self):
+        cfg = DNSConfig(records=RECORDS, scenarios=[{'name': '*', 'mode': 'nxdomain'}], delay='1s')
+        self.assertEqual((cfg.port, cfg.delay), (1053, 1.0))
+        for bad in ({'mode': 'nope'}, {'records': {'a.example.com': 'not-an-ip'}},
+                    {'records': {'a.example.com': {'CNAME': 'b.example.com', 'A': '192.0.2.1'}}},
+                    {'scenarios': [{'mode': 'nope'}]}, {'dot_mode': 'http_error'}, {'doh_mode': 'reset'}):
+            with self.assertRaises(ValueError):
+                DNSConfig(**bad)
+
+
+class TestDNSServer(unittest.TestCase):
+    def test_udp_then_tcp_retry(self):
+        responder = dns.DNSResponder(RECORDS)
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+        udp_sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        udp_sock.bind(('127.0.0.1', 0))
+        port = udp_sock.getsockname()[1]
+        tcp_sock = socket.create_server(('127.0.0.1', port))
+        threading.Thread(target=UDPServer(port, '127.0.0.1', handler=responder.handle_udp).serve_udp,
+                         args=(stop, udp_sock), daemon=True).start()
+        threading.Thread(target=TCPServer(port, '127.0.0.1', handler=responder.handle_tcp).serve,
+                         args=(stop, tcp_sock), daemon=True).start()
+
+        with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as client:
+            client.settimeout(2.0)
+            client.sendto(query('big.example.com'), ('127.0.0.1', port))
+            self.assertTrue(dns.parse_response(client.recv(512))[1] & 0x0200)
+        with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+            message = query('big.example.com')
+            conn.sendall(struct.pack('>H', len(message)) + message)
+            length = struct.unpack('>H', conn.recv(2))[0]
+            data = b''
+            while len(data) < length:
+                data += conn.recv(length - len(data))
+            self.assertEqual(len(answers(data)), 40)
+
+
+class TestDoH(unittest.TestCase):
+    def request(self, handler, method, path, body=b'', content_type=dns.DOH_TYPE):
+        return handler(HTTPRequest(method, path, 'HTTP/1.1', {'content-type': content_type}, body))
+
+    def test_get_and_post(self):
+        handler = dns.DoHHandler(dns.DNSResponder(RECORDS))
+        param = base64.urlsafe_b64encode(query('api.example.com', id=0)).rstrip(b'=').decode()
+        resp = self.request(handler, 'GET', f'/dns-query?dns={param}')
+        self.assertEqual((resp.code, resp.headers['Content-Type']), (200, dns.DOH_TYPE))
+        self.assertEqual(resp.headers['Cache-Control'], 'max-age=5')
+        self.assertEqual(answers(resp.body)[-1], ('device.example.com', 'A', '192.0.2.10'))
+        resp = self.request(handler, 'POST', '/dns-query', query('big.example.com'))
+        # Never truncated: HTTPS has no UDP size limit.
+        self.assertEqual(len(answers(resp.body)), 40)
+        self.assertEqual(dns.parse_response(self.request(handler, 'POST', '/dns-query',
+                                                         query('nope.example.com')).body)[2], dns.NXDOMAIN)
+
+    def test_bad_requests(self):
+        handler = dns.DoHHandler(dns.DNSResponder(RECORDS))
+        self.assertEqual(self.request(handler, 'GET', '/other').code, 404)
+        self.assertEqual(self.request(handler, 'GET', '/dns-query').code, 400)
+        self.assertEqual(self.request(handler, 'GET', '/dns-query?dns=%%%').code, 400)
+        self.assertEqual(self.request(handler, 'POST', '/dns-query', query('a.example.com'), 'text/plain').code, 415)
+        resp = self.request(handler, 'PUT', '/dns-query', query('a.example.com'))
+        self.assertEqual((resp.code, resp.headers['Allow']), (405, 'GET, POST'))
+
+    def test_transport_modes(self):
+        responder = dns.DNSResponder(RECORDS)
+        servfail = responder.with_mode('servfail')
+        self.assertIs(responder.with_mode('http_error'), responder)
+        self.assertIs(servfail.zone, responder.zone)
+        self.assertEqual(responder.mode, 'normal')
+        resp = self.request(dns.DoHHandler(servfail), 'POST', '/dns-query', query('device.example.com'))
+        self.assertEqual(dns.parse_response(resp.body)[2], dns.SERVFAIL)
+        failing = dns.DoHHandler(responder, http_error=True)
+        self.assertEqual(self.request(failing, 'POST', '/dns-query', query('device.example.com')).code, 503)
+        silent = dns.DoHHandler(responder.with_mode('silent'))
+        self.assertEqual(self.request(silent, 'POST', '/dns-query', query('device.example.com')).code, 504)
+
+    def test_over_http_server(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+        srv = HTTPServer(port, '127.0.0.1', handler=dns.DoHHandler(dns.DNSResponder(RECORDS), path='/q'))
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        message = query('device.example.com', 'AAAA')
+        raw = (f'POST /q HTTP/1.1\r\nHost: x\r\nContent-Type: {dns.DOH_TYPE}\r\n'
+               f'Content-Length: {len(message)}\r\nConnection: close\r\n\r\n').encode() + message
+        with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+            conn.sendall(raw)
+            data = b''
+            while chunk := conn.recv(4096):
+                data += chunk
+        status, _, body = parse_responses(data)[0]
+        self.assertEqual((status, answers(body)), (200, [('device.example.com', 'AAAA', '2001:db8::10')]))
+
+
+class TestDoT(unittest.TestCase):
+    def start(self, srv):
+        try:
+            cert_path, key_path = make_temp_cert()
+        except ImportError:
+            self.skipTest('cryptography package not available')
+        sock = socket.create_server(('127.0.0.1', 0))
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+        threading.Thread(target=srv.serve_tls, args=(stop, sock, cert_path, key_path), daemon=True).start()
+        ctx = ssl.create_default_context()
+        ctx.check_hostname = False
+        ctx.verify_mode = ssl.CERT_NONE
+        return ctx, sock.getsockname()[1]
+
+    def test_query_over_tls(self):
+        ctx, port = self.start(TCPServer(0, '127.0.0.1', handler=dns.DNSResponder(RECORDS).handle_tcp))
+        with ctx.wrap_socket(socket.create_connection(('127.0.0.1', port), timeout=5.0)) as conn:
+            self.assertEqual(len(answers(tcp_exchange(conn, query('big.example.com')))), 40)
+            self.assertEqual(answers(tcp_exchange(conn, query('x.lab.example.com'))),
+                             [('x.lab.example.com', 'A', '192.0.2.20')])
+
+    def test_reset_before_handshake(self):
+        srv = TCPServer(0, '127.0.0.1', handler=dns.DNSResponder(RECORDS).handle_tcp, accept_close_rate=1.0,
+                        accept_close_mode='rst')
+        ctx, port = self.start(srv)
+        with self.assertRaises(OSError):
+            with ctx.wrap_socket(socket.create_connection(('127.0.0.1', port), timeout=5.0)) as conn:
+                tcp_exchange(conn, query('device.example.com'))
+
+
+if __name__ == '__main__':
+    unittest.main()
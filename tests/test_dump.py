@@ -0,0 +1,71 @@
+import os
+import socket
+import tempfile
+import threading
+import unittest
+
+from yourtestsrv.dump import TrafficDump, hexdump
+from yourtestsrv.tcp_server import TCPServer
+from yourtestsrv.udp_server import UDPServer
+
+
+class TestHexdump(unittest.TestCase):
+    def test_format(self):
+        lines = hexdump(b'hello, world!\x00\x01\x02\xff')
+        self.assertEqual(lines[0], '  00000000  68 65 6c 6c 6f 2c 20 77  6f 72 6c 64 21 00 01 02  |hello, world!...|')
+        self.assertEqual(lines[1], '  00000010  ff' + ' ' * 47 + ' |.|')
+
+
+class TestTrafficDump(unittest.TestCase):
+    def setUp(self):
+        fd, self.path = tempfile.mkstemp()
+        os.close(fd)
+        self.dump = TrafficDump(self.path)
+
+    def tearDown(self):
+        self.dump.close()
+        os.unlink(self.path)
+
+    def read(self):
+        with open(self.path) as f:
+            return f.read()
+
+    def test_tcp_both_directions(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = TCPServer(0, '127.0.0.1', dump=self.dump)
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+                conn.sendall(b'ping')
+                self.assertEqual(conn.recv(16), b'ping')
+        finally:
+            stop.set()
+        text = self.read()
+        self.assertIn(f'tcp:{port}', text)
+        self.assertIn(' rx 4 bytes', text)
+        self.assertIn(' tx 4 bytes', text)
+        self.assertIn('|ping|', text)
+
+    def test_udp(self):
+        sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        sock.bind(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = UDPServer(0, '127.0.0.1', dump=self.dump)
+        threading.Thread(target=srv.serve_udp, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as conn:
+                conn.settimeout(2.0)
+                conn.sendto(b'\x01\x02', ('127.0.0.1', port))
+                conn.recvfrom(16)
+        finally:
+            stop.set()
+        text = self.read()
+        self.assertIn(f'udp:{port}', text)
+        self.assertEqual(text.count('|..|'), 2)
+
+
+if __name__ == '__main__':
+    unittest.main()
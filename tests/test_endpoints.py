@@ -0,0 +1,51 @@
+import io
+import json
+import os
+import shutil
+import socket
+import tempfile
+import threading
+import unittest
+
+from yourtestsrv import endpoints
+from yourtestsrv.http_server import HTTPServer
+from yourtestsrv.tcp_server import TCPServer
+from yourtestsrv.udp_server import UDPServer
+
+
+class TestEndpoints(unittest.TestCase):
+    def test_banner(self):
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+        tcp, udp = TCPServer(0, '127.0.0.1'), UDPServer(0, '127.0.0.1')
+        threading.Thread(target=tcp.serve, args=(stop, socket.create_server(('127.0.0.1', 0))), daemon=True).start()
+        threading.Thread(target=udp.listen_and_serve, args=(stop,), daemon=True).start()
+        # Never started, as when its port is taken.
+        http = HTTPServer(8443, '127.0.0.1')
+        info = endpoints.banner([('tcp', tcp, False), ('udp', udp, False), ('http', http, True)], 'v1.0.0', 'nbiot',
+                                timeout=1.0)
+        self.assertEqual((info['event'], info['version'], info['pid'], info['network_profile']),
+                         ('ready', 'v1.0.0', os.getpid(), 'nbiot'))
+        self.assertEqual(info['endpoints'], [
+            {'protocol': 'tcp', 'transport': 'tcp', 'address': '127.0.0.1', 'port': tcp.addr()[1], 'tls': False,
+             'listening': True},
+            {'protocol': 'udp', 'transport': 'udp', 'address': '127.0.0.1', 'port': udp.addr()[1], 'tls': False,
+             'listening': True},
+            {'protocol': 'http', 'transport': 'tcp', 'address': '127.0.0.1', 'port': 8443, 'tls': True,
+             'listening': False},
+        ])
+        self.assertIsNone(endpoints.banner([], 'v1.0.0')['network_profile'])
+
+        tmp = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, tmp)
+        path = os.path.join(tmp, 'endpoints.json')
+        out = io.StringIO()
+        endpoints.announce(info, path, out)
+        line, = out.getvalue().splitlines()
+        self.assertEqual(json.loads(line), info)
+        with open(path) as f:
+            self.assertEqual(json.load(f), info)
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,73 @@
+import json
+import os
+import shutil
+import tempfile
+import threading
+import unittest
+import xml.etree.ElementTree as ET
+
+from yourtestsrv import expect, stats
+from yourtestsrv.sequence import SequenceField, SequenceTracker
+
+
+class TestExpectations(unittest.TestCase):
+    def setUp(self):
+        self.dir = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, self.dir)
+        for key, connections in (('exptest:1', 3), ('exptest:2', 4)):
+            server_stats = stats.ServerStats()
+            server_stats.traffic.incr('connections', connections)
+            stats.register(key, server_stats)
+            self.addCleanup(stats.unregister, key)
+        stats._registry['exptest:2'].record_error(stats.ERROR_PARSE)
+
+    def write(self, name, data):
+        path = os.path.join(self.dir, name)
+        with open(path, 'w') as f:
+            json.dump(data, f)
+        return path
+
+    def test_checks_and_junit(self):
+        path = self.write('nightly.json', {'expectations': [
+            {'name': 'devices', 'server': 'exptest', 'metric': 'connections', 'min': 7},
+            {'server': 'exptest:1', 'metric': 'errors.parse', 'max': 0},
+            {'server': 'exptest', 'metric': 'errors.parse', 'equals': 0},
+        ]})
+        junit = os.path.join(self.dir, 'out', 'junit.xml')
+        run = expect.ScenarioRun(0.0, expect.load(path), junit, suite='nightly')
+        self.assertEqual(run.finish(), expect.EXIT_FAILED)
+        suite = ET.parse(junit).getroot().find('testsuite')
+        self.assertEqual((suite.get('name'), suite.get('tests'), suite.get('failures')), ('nightly', '3', '1'))
+        failure = suite.findall('testcase')[2].find('failure')
+        self.assertEqual(failure.get('message'), 'errors.parse = 1 (expected 0)')
+        with self.assertRaises(ValueError):
+            expect.load(self.write('bad.json', [{'metric': 'traffic.nope', 'min': 1}]))
+        with self.assertRaises(ValueError):
+            expect.load(self.write('bad.json', [{'metric': 'connections', 'minimum': 1}]))
+
+    def test_sequence_metric(self):
+        stats._registry['exptest:1'].sequence = SequenceTracker(SequenceField('0:1'))
+        for data in (b'\x01', b'\x04'):
+            stats._registry['exptest:1'].sequence.record('dev:1', data)
+        lost = expect.Expectation('sequence.lost', max=0)
+        self.assertEqual(lost.value(stats.snapshot()), 2)
+        self.assertFalse(lost.check(stats.snapshot()).passed)
+
+    def test_failed_server_is_startup_error(self):
+        junit = os.path.join(self.dir, 'junit.xml')
+        run = expect.ScenarioRun(5.0, [expect.Expectation('connections', min=0)], junit)
+        stop = threading.Event()
+
+        def listen(_):
+            raise OSError('Address already in use')
+        thread = threading.Thread(target=run.guard(listen, stop), args=(stop,))
+        thread.start()
+        run.wait(stop)
+        thread.join()
+        self.assertEqual(run.finish(), expect.EXIT_STARTUP)
+        self.assertEqual(ET.parse(junit).getroot().find('testsuite/testcase/error').get('message'),
+                         'Address already in use')
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,127 @@
+import queue
+import socket
+import threading
+import time
+import unittest
+
+from yourtestsrv import integrity
+from yourtestsrv.faultrules import FaultRuleSet
+from yourtestsrv.http_server import HTTPServer
+from yourtestsrv.mqtt_client import MQTTClient
+from yourtestsrv.mqtt_server import MQTTServer
+from yourtestsrv.tcp_server import TCPServer
+
+
+def start(srv):
+    sock = socket.create_server(('127.0.0.1', 0))
+    stop = threading.Event()
+    threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+    return stop, sock.getsockname()[1]
+
+
+def http_post(port, path, body=b''):
+    with socket.create_connection(('127.0.0.1', port), timeout=3.0) as conn:
+        conn.sendall(f'POST {path} HTTP/1.1\r\nHost: x\r\nConnection: close\r\n'
+                     f'Content-Length: {len(body)}\r\n\r\n'.encode() + body)
+        data = b''
+        while True:
+            chunk = conn.recv(4096)
+            if not chunk:
+                return data
+            data += chunk
+
+
+class TestFaultRuleMatch(unittest.TestCase):
+    def test_json_and_scope(self):
+        rules = FaultRuleSet([
+            {'json': {'cmd': 'fw_download', 'meta.part': 2}, 'delay': '1s'},
+            {'path': '^/firmware/', 'error_code': 503},
+            {'topic': 'devices/+/firmware', 'prefix_hex': 'a5', 'drop_rate': 1},
+        ])
+        self.assertEqual(rules.match(b'{"cmd": "fw_download", "meta": {"part": 2}}').delay, 1.0)
+        self.assertIsNone(rules.match(b'{"cmd": "heartbeat"}'))
+        self.assertIsNone(rules.match(b'not json'))
+        self.assertEqual(rules.match(b'', path='/firmware/v2.bin').error_code, 503)
+        self.assertIsNone(rules.match(b'\xa5\x01', topic='devices/a/status'))
+        self.assertEqual(rules.match(b'\xa5\x01', topic='devices/a/firmware').drop_rate, 1.0)
+        with self.assertRaises(ValueError):
+            FaultRuleSet([{'regex': 'x', 'drop_rate': 2}])
+        with self.assertRaises(ValueError):
+            FaultRuleSet([{'regex': 'x', 'bogus': 1}])
+
+
+class TestFaultRuleServers(unittest.TestCase):
+    def test_tcp_only_matching_frames(self):
+        rules = FaultRuleSet([{'prefix': 'FW', 'drop_rate': 1}, {'prefix': 'SLOW', 'delay': '300ms'}])
+        stop, port = start(TCPServer(0, '127.0.0.1', framing='delim', fault_rules=rules))
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=3.0) as conn:
+                conn.sendall(b'FW chunk\nHB\n')
+                self.assertEqual(conn.recv(16), b'HB\n')
+                started = time.monotonic()
+                conn.sendall(b'SLOW\n')
+                self.assertEqual(conn.recv(16), b'SLOW\n')
+                self.assertGreaterEqual(time.monotonic() - started, 0.25)
+        finally:
+            stop.set()
+
+    def test_http_path_and_body(self):
+        rules = FaultRuleSet([{'path': '^/firmware/', 'error_code': 503},
+                              {'json': {'cmd': 'fw_download'}, 'drop_rate': 1}])
+        stop, port = start(HTTPServer(0, '127.0.0.1', fault_rules=rules))
+        try:
+            self.assertTrue(http_post(port, '/firmware/v2.bin').startswith(b'HTTP/1.1 503'))
+            self.assertTrue(http_post(port, '/heartbeat').startswith(b'HTTP/1.1 200'))
+            self.assertEqual(http_post(port, '/api', b'{"cmd": "fw_download"}'), b'')
+        finally:
+            stop.set()
+
+    def test_http_integrity_mismatch(self):
+        rules = FaultRuleSet([{'path': '^/md5/', 'integrity': 'content_md5'},
+                              {'path': '^/digest/', 'integrity': 'digest'},
+                              {'path': '^/trailer/', 'integrity': 'trailer'}])
+        stop, port = start(HTTPServer(0, '127.0.0.1', fault_rules=rules))
+        try:
+            for path, names in (('/md5/fw.bin', ['Content-MD5']), ('/digest/fw.bin', ['Digest', 'Repr-Digest'])):
+                head, body = http_post(port, path).split(b'\r\n\r\n', 1)
+                headers = dict(line.split(': ', 1) for line in head.decode().split('\r\n')[1:])
+                for name in names:
+                    self.assertFalse(integrity.verify(name, headers[name], body), name)
+                    self.assertTrue(integrity.verify(name, headers[name], body[:-1] + bytes([body[-1] ^ 1])), name)
+            head, chunked = http_post(port, '/trailer/fw.bin').split(b'\r\n\r\n', 1)
+            self.assertIn(b'Transfer-Encoding: chunked', head)
+            self.assertIn(b'Trailer: Repr-Digest', head)
+            size, rest = chunked.split(b'\r\n', 1)
+            body, trailer = rest[:int(size, 16)], rest[int(size, 16):]
+            self.assertTrue(trailer.startswith(b'\r\n0\r\nRepr-Digest: ') and trailer.endswith(b'\r\n\r\n'))
+            value = trailer.split(b': ', 1)[1].strip().decode()
+            self.assertFalse(integrity.verify('Repr-Digest', value, body))
+            self.assertNotIn(b'Content-MD5', http_post(port, '/heartbeat'))
+        finally:
+            stop.set()
+        with self.assertRaises(ValueError):
+            FaultRuleSet([{'path': 'x', 'integrity': 'crc32'}])
+
+    def test_mqtt_drops_matching_topic(self):
+        rules = FaultRuleSet([{'topic': 'devices/+/firmware', 'drop_rate': 1}])
+        stop, port = start(MQTTServer(0, '127.0.0.1', fault_rules=rules))
+        try:
+            received = queue.Queue()
+            sub = MQTTClient('127.0.0.1', port, 'sub', on_message=lambda t, p, q, r: received.put((t, p)))
+            pub = MQTTClient('127.0.0.1', port, 'pub')
+            try:
+                sub.connect()
+                sub.subscribe('devices/#')
+                pub.connect()
+                pub.publish('devices/a/firmware', b'chunk', qos=1)
+                pub.publish('devices/a/heartbeat', b'ok', qos=1)
+                self.assertEqual(received.get(timeout=2.0), ('devices/a/heartbeat', b'ok'))
+            finally:
+                sub.close()
+                pub.close()
+        finally:
+            stop.set()
+
+
+if __name__ == '__main__':
+    unittest.main()
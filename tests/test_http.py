@@ -1,3 +1,5 @@
+import base64
+import json
 import os
 import socket
 import ssl
@@ -5,8 +7,12 @@ import tempfile
 import threading
 import time
 import unittest
+from email.utils import parsedate_to_datetime
 
-from yourtestsrv.http_server import HTTPServer
+from yourtestsrv import codec, signing
+from yourtestsrv.clock import VirtualClock
+from yourtestsrv.http_probe import HTTPProber, parse_responses
+from yourtestsrv.http_server import HTTPResponse, HTTPServer, parse_range
 
 
 def get_free_port():
@@ -58,6 +64,64 @@ def wait_tcp(port, timeout=2.0):
     raise RuntimeError(f'server not ready on port {port}')
 
 
+def http_exchange(port, raw):
+    with socket.create_connection(('127.0.0.1', port)) as conn:
+        conn.sendall(raw)
+        conn.settimeout(2.0)
+        data = b''
+        while True:
+            chunk = conn.recv(4096)
+            if not chunk:
+                break
+            data += chunk
+    return data
+
+
+def start_server(srv):
+    stop = threading.Event()
+    t = threading.Thread(target=srv.listen_and_serve, args=(stop,), daemon=True)
+    t.start()
+    wait_tcp(srv.port)
+    return stop
+
+
+class TestHTTPStrict(unittest.TestCase):
+    def test_strict_rejections(self):
+        srv = HTTPServer(get_free_port(), '127.0.0.1', strict=True)
+        stop = start_server(srv)
+        try:
+            cases = [
+                (b'GET / HTTP/1.1\r\nConnection: close\r\n\r\n', b'400'),
+                (b'GET / HTTP/1.1\nHost: x\nConnection: close\n\n', b'400'),
+                (b'GET / HTTP/1.1\r\nHost: x\r\nBad Name: v\r\n\r\n', b'400'),
+                (b'POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n', b'400'),
+                (b'GET / HTTP/2.0\r\nHost: x\r\n\r\n', b'505'),
+                (b'POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip\r\n\r\n', b'501'),
+            ]
+            for raw, code in cases:
+                status_line = http_exchange(srv.port, raw).split(b'\r\n', 1)[0]
+                self.assertIn(code, status_line, raw)
+        finally:
+            stop.set()
+
+    def test_lenient_accepts_and_decodes_chunked(self):
+        srv = HTTPServer(get_free_port(), '127.0.0.1')
+        stop = start_server(srv)
+        try:
+            data = http_exchange(srv.port, b'GET / HTTP/1.1\r\nConnection: close\r\n\r\n')
+            self.assertIn(b'200', data.split(b'\r\n', 1)[0])
+            received = []
+            srv.handler = lambda req: received.append(req.body) or srv._default_handle(req)
+            http_exchange(srv.port, b'POST / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n'
+                                    b'Transfer-Encoding: chunked\r\n\r\n'
+                                    b'5\r\nhello\r\n6 ; ext\r\n world\r\n0\r\n\r\n')
+            http_exchange(srv.port, b'POST / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n'
+                                    b'Transfer-Encoding: gzip\r\nContent-Length: 3\r\n\r\nabc')
+            self.assertEqual(received, [b'hello world', b'abc'])
+        finally:
+            stop.set()
+
+
 class TestHTTPBasic(unittest.TestCase):
     def test_basic(self):
         port = get_free_port()
@@ -80,6 +144,65 @@ class TestHTTPBasic(unittest.TestCase):
         finally:
             stop.set()
 
+    def test_serve_injected_listener(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = HTTPServer(0, '127.0.0.1')
+        t = threading.Thread(target=srv.serve, args=(stop, sock), daemon=True)
+        t.start()
+        try:
+            resp = http_exchange(port, b'GET /healthz HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n')
+            self.assertTrue(resp.startswith(b'HTTP/1.1 200'))
+            self.assertEqual(srv.addr(), ('127.0.0.1', port))
+        finally:
+            stop.set()
+
+    def test_traffic_totals(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        stop = threading.Event()
+        srv = HTTPServer(0, '127.0.0.1')
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            raw = (b'POST /a HTTP/1.1\r\nHost: x\r\nContent-Length: 2\r\n\r\nhi'
+                   b'GET /b HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n')
+            resp = http_exchange(sock.getsockname()[1], raw)
+            self.assertEqual(resp.count(b'HTTP/1.1 200'), 2)
+            deadline = time.time() + 2.0
+            while srv.traffic_totals()['frames_out'] < 2 and time.time() < deadline:
+                time.sleep(0.02)
+            self.assertEqual(srv.traffic_totals(), {'connections': 1, 'bytes_in': len(raw), 'bytes_out': len(resp),
+                                                    'frames_in': 2, 'frames_out': 2})
+        finally:
+            stop.set()
+
+    def test_unix_socket(self):
+        path = os.path.join(tempfile.mkdtemp(), 'http.sock')
+        stop = threading.Event()
+        srv = HTTPServer(0, unix_socket=path)
+        t = threading.Thread(target=srv.listen_and_serve, args=(stop,), daemon=True)
+        t.start()
+        deadline = time.time() + 2.0
+        while True:
+            conn = socket.socket(socket.AF_UNIX)
+            try:
+                conn.connect(path)
+                break
+            except OSError:
+                conn.close()
+                if time.time() > deadline:
+                    raise
+                time.sleep(0.05)
+        try:
+            with conn:
+                conn.settimeout(2.0)
+                conn.sendall(b'GET /healthz HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n')
+                self.assertTrue(conn.recv(4096).startswith(b'HTTP/1.1 200'))
+        finally:
+            stop.set()
+        t.join(3.0)
+        self.assertFalse(os.path.exists(path))
+
     def test_chunked(self):
         port = get_free_port()
         stop = threading.Event()
@@ -123,6 +246,74 @@ class TestHTTPBasic(unittest.TestCase):
         finally:
             stop.set()
 
+    def test_date_offset(self):
+        port = get_free_port()
+        stop = threading.Event()
+        srv = HTTPServer(port, '127.0.0.1', date_offset=-86400 * 400)
+        t = threading.Thread(target=srv.listen_and_serve, args=(stop,), daemon=True)
+        t.start()
+        wait_tcp(port)
+        try:
+            with socket.create_connection(('127.0.0.1', port)) as conn:
+                conn.sendall(b'GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n')
+                conn.settimeout(2.0)
+                data = b''
+                while True:
+                    chunk = conn.recv(4096)
+                    if not chunk:
+                        break
+                    data += chunk
+                headers = dict(line.split(': ', 1) for line in
+                               data.split(b'\r\n\r\n')[0].decode().split('\r\n')[1:])
+                skew = time.time() - parsedate_to_datetime(headers['Date']).timestamp()
+                self.assertGreater(skew, 86400 * 399)
+                self.assertIn('Last-Modified', headers)
+                self.assertIn('Expires', headers)
+        finally:
+            stop.set()
+
+    def test_http10_default_close(self):
+        port = get_free_port()
+        stop = threading.Event()
+        srv = HTTPServer(port, '127.0.0.1')
+        t = threading.Thread(target=srv.listen_and_serve, args=(stop,), daemon=True)
+        t.start()
+        wait_tcp(port)
+        try:
+            with socket.create_connection(('127.0.0.1', port)) as conn:
+                conn.sendall(b'GET / HTTP/1.0\r\n\r\n')
+                conn.settimeout(2.0)
+                data = b''
+                while True:
+                    chunk = conn.recv(4096)
+                    if not chunk:
+                        break
+                    data += chunk
+                self.assertIn(b'Connection: close', data)
+        finally:
+            stop.set()
+
+    def test_break_keepalive(self):
+        port = get_free_port()
+        stop = threading.Event()
+        srv = HTTPServer(port, '127.0.0.1', break_keepalive=True)
+        t = threading.Thread(target=srv.listen_and_serve, args=(stop,), daemon=True)
+        t.start()
+        wait_tcp(port)
+        try:
+            with socket.create_connection(('127.0.0.1', port)) as conn:
+                conn.sendall(b'GET / HTTP/1.1\r\nHost: localhost\r\n\r\n')
+                conn.settimeout(2.0)
+                data = b''
+                while True:
+                    chunk = conn.recv(4096)
+                    if not chunk:
+                        break
+                    data += chunk
+                self.assertIn(b'Connection: keep-alive', data)
+        finally:
+            stop.set()
+
     def test_tls(self):
         try:
             cert_path, key_path = make_temp_cert()
@@ -139,7 +330,10 @@ class TestHTTPBasic(unittest.TestCase):
             ctx.check_hostname = False
             ctx.verify_mode = ssl.CERT_NONE
             ctx.minimum_version = ssl.TLSVersion.TLSv1_2
-            with ctx.wrap_socket(socket.create_connection(('127.0.0.1', port))) as conn:
+            # A client that never starts its handshake holds up no one else.
+            silent = socket.create_connection(('127.0.0.1', port))
+            self.addCleanup(silent.close)
+            with ctx.wrap_socket(socket.create_connection(('127.0.0.1', port), timeout=2.0)) as conn:
                 conn.sendall(b'GET /healthz HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n')
                 conn.settimeout(2.0)
                 data = b''
@@ -154,5 +348,309 @@ class TestHTTPBasic(unittest.TestCase):
             stop.set()
 
 
+class TestHTTPStructuredBodies(unittest.TestCase):
+    def post(self, port, body, content_type, accept=''):
+        accept = f'Accept: {accept}\r\n' if accept else ''
+        raw = (f'POST /telemetry HTTP/1.1\r\nHost: x\r\nContent-Type: {content_type}\r\n{accept}'
+               f'Content-Length: {len(body)}\r\nConnection: close\r\n\r\n').encode() + body
+        return parse_responses(http_exchange(port, raw))[0]
+
+    def test_cbor_and_msgpack_echo(self):
+        srv = HTTPServer(get_free_port(), '127.0.0.1')
+        stop = start_server(srv)
+        try:
+            doc = {'temp': 21, 'raw': b'\xa5'}
+            status, headers, body = self.post(srv.port, codec.encode(doc, 'cbor'), 'application/cbor')
+            self.assertEqual((status, headers['content-type']), (200, 'application/cbor'))
+            self.assertEqual(codec.decode(body, 'cbor')['body'], doc)
+            status, headers, body = self.post(srv.port, codec.encode(doc, 'cbor'), 'application/cbor',
+                                              'application/msgpack')
+            self.assertEqual(codec.decode(body, 'msgpack')['body'], doc)
+            status, _, body = self.post(srv.port, codec.encode(doc, 'msgpack'), 'application/x-msgpack',
+                                        'application/json')
+            self.assertEqual(json.loads(body)['body'], {'temp': 21, 'raw': 'a5'})
+            self.assertEqual(self.post(srv.port, b'\xa2\x61', 'application/cbor')[0], 400)
+            for body, content_type in ((b'\xa1\xa0\x00', 'application/cbor'), (b'\x81\x90\x00', 'application/msgpack'),
+                                       (b'\x81' * 5000 + b'\x00', 'application/cbor'),
+                                       (b'\x91' * 5000 + b'\x00', 'application/msgpack')):
+                self.assertEqual(self.post(srv.port, body, content_type)[0], 400)
+            self.assertIn(b'Method: POST', self.post(srv.port, b'x', 'text/plain')[2])
+        finally:
+            stop.set()
+
+
+class TestHTTPAuthLockout(unittest.TestCase):
+    def get(self, port, credentials):
+        auth = base64.b64encode(credentials.encode()).decode() if credentials else ''
+        raw = f'GET / HTTP/1.1\r\nHost: x\r\nAuthorization: Basic {auth}\r\nConnection: close\r\n\r\n'
+        return parse_responses(http_exchange(port, raw.encode()))[0]
+
+    def test_lockout_and_cooldown(self):
+        clock = VirtualClock()
+        srv = HTTPServer(get_free_port(), '127.0.0.1', auth='admin:secret', lockout_after=2,
+                         lockout_duration=60.0, lockout_code=423, clock=clock)
+        stop = start_server(srv)
+        try:
+            self.assertEqual(self.get(srv.port, 'admin:secret')[0], 200)
+            self.assertEqual(self.get(srv.port, 'admin:wrong')[0], 401)
+            self.assertEqual(self.get(srv.port, 'admin:wrong')[0], 401)
+            status, headers, _ = self.get(srv.port, 'admin:secret')
+            self.assertEqual((status, headers['retry-after']), (423, '60'))
+            clock.advance(30)
+            self.assertEqual(self.get(srv.port, 'admin:secret')[1]['retry-after'], '30')
+            clock.advance(31)
+            self.assertEqual(self.get(srv.port, 'admin:secret')[0], 200)
+        finally:
+            stop.set()
+
+
+class TestHTTPSessionTokens(unittest.TestCase):
+    def request(self, port, method, path, token=''):
+        auth = f'Authorization: Bearer {token}\r\n' if token else ''
+        raw = f'{method} {path} HTTP/1.1\r\nHost: x\r\n{auth}Content-Length: 0\r\nConnection: close\r\n\r\n'
+        return parse_responses(http_exchange(port, raw.encode()))[0]
+
+    def login(self, port):
+        status, headers, body = self.request(port, 'POST', '/login')
+        self.assertEqual(status, 200)
+        token = json.loads(body)['token']
+        self.assertIn(f'session={token}', headers['set-cookie'])
+        return token
+
+    def test_expiry(self):
+        clock = VirtualClock()
+        srv = HTTPServer(get_free_port(), '127.0.0.1', session_ttl=30.0, clock=clock)
+        stop = start_server(srv)
+        try:
+            self.assertEqual(self.request(srv.port, 'GET', '/api/status')[0], 401)
+            self.assertEqual(self.request(srv.port, 'GET', '/healthz')[0], 200)
+            token = self.login(srv.port)
+            clock.advance(20)
+            self.assertEqual(self.request(srv.port, 'GET', '/api/status', token)[0], 200)
+            clock.advance(11)
+            status, headers, _ = self.request(srv.port, 'GET', '/api/status', token)
+            self.assertEqual(status, 401)
+            self.assertIn('error="invalid_token"', headers['www-authenticate'])
+        finally:
+            stop.set()
+
+    def test_sliding_renewal(self):
+        clock = VirtualClock()
+        srv = HTTPServer(get_free_port(), '127.0.0.1', session_ttl=30.0, session_sliding=True, clock=clock)
+        stop = start_server(srv)
+        try:
+            token = self.login(srv.port)
+            for _ in range(3):
+                clock.advance(20)
+                self.assertEqual(self.request(srv.port, 'GET', '/api/status', token)[0], 200)
+            clock.advance(31)
+            self.assertEqual(self.request(srv.port, 'GET', '/api/status', token)[0], 401)
+        finally:
+            stop.set()
+
+
+class TestHTTPReverseProxy(unittest.TestCase):
+    def setUp(self):
+        self.hits = 0
+
+        def handler(req):
+            self.hits += 1
+            return HTTPResponse(200, 'OK', {'Content-Type': 'text/plain', 'X-Origin': 'yes'},
+                                f'version {self.hits:02d} '.encode() + b'x' * 9)
+
+        self.upstream = HTTPServer(get_free_port(), '127.0.0.1', handler=handler)
+        self.stops = [start_server(self.upstream)]
+
+    def tearDown(self):
+        for stop in self.stops:
+            stop.set()
+
+    def proxy(self, **kwargs):
+        self.clock = VirtualClock()
+        srv = HTTPServer(get_free_port(), '127.0.0.1', upstream=('127.0.0.1', self.upstream.port),
+                         clock=self.clock, **kwargs)
+        self.stops.append(start_server(srv))
+        return srv.port
+
+    def get(self, port, path='/fw.bin'):
+        raw = f'GET {path} HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n'.encode()
+        return http_exchange(port, raw)
+
+    def test_forward_and_ttl(self):
+        port = self.proxy(cache_ttl=30.0)
+        status, headers, body = parse_responses(self.get(port))[0]
+        self.assertEqual((status, headers['x-cache'], headers['x-origin']), (200, 'MISS', 'yes'))
+        self.assertEqual(body, b'version 01 xxxxxxxxx')
+        self.clock.advance(10)
+        status, headers, body = parse_responses(self.get(port))[0]
+        self.assertEqual((headers['x-cache'], headers['age'], body), ('HIT', '10', b'version 01 xxxxxxxxx'))
+        self.clock.advance(21)
+        status, headers, body = parse_responses(self.get(port))[0]
+        self.assertEqual((headers['x-cache'], body), ('MISS', b'version 02 xxxxxxxxx'))
+        self.assertEqual(self.hits, 2)
+
+    def test_uncached_and_bad_gateway(self):
+        port = self.proxy()
+        for n in (1, 2):
+            status, headers, body = parse_responses(self.get(port))[0]
+            self.assertNotIn('x-cache', headers)
+            self.assertEqual(body, f'version {n:02d} xxxxxxxxx'.encode())
+        bad = HTTPServer(get_free_port(), '127.0.0.1', upstream=('127.0.0.1', get_free_port()))
+        self.stops.append(start_server(bad))
+        self.assertEqual(parse_responses(self.get(bad.port))[0][0], 502)
+
+    def test_stale(self):
+        port = self.proxy(cache_ttl=30.0, cache_fault='stale')
+        self.get(port)
+        self.clock.advance(3600)
+        status, headers, body = parse_responses(self.get(port))[0]
+        self.assertEqual((headers['x-cache'], headers['age'], body), ('HIT', '3600', b'version 01 xxxxxxxxx'))
+        self.assertEqual(self.hits, 1)
+
+    def test_wrong_content_length(self):
+        port = self.proxy(cache_ttl=30.0, cache_fault='partial')
+        self.get(port)
+        head, _, body = self.get(port).partition(b'\r\n\r\n')
+        self.assertIn(b'Content-Length: 20\r\n', head)
+        self.assertEqual(body, b'version 01')
+        port = self.proxy(cache_ttl=30.0, cache_fault='short_length')
+        self.get(port)
+        head, _, body = self.get(port).partition(b'\r\n\r\n')
+        self.assertIn(b'Content-Length: 10\r\n', head)
+        self.assertEqual(body, b'version 02 xxxxxxxxx')
+
+
+class TestHTTPSigning(unittest.TestCase):
+    def get(self, port):
+        raw = b'GET /bytes/64 HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n'
+        return parse_responses(http_exchange(port, raw))[0]
+
+    def test_valid_and_faulty_signatures(self):
+        for method in signing.METHODS:
+            srv = HTTPServer(get_free_port(), '127.0.0.1', sign=method, sign_key='k3y')
+            stop = start_server(srv)
+            try:
+                _, headers, body = self.get(srv.port)
+                self.assertTrue(signing.verify(method, b'k3y', body, headers['x-signature']))
+                for fault in ('corrupt', 'wrong_key', 'tamper', 'missing'):
+                    srv.signer.fault = fault
+                    _, headers, body = self.get(srv.port)
+                    self.assertEqual(len(body), 64)
+                    self.assertFalse(signing.verify(method, b'k3y', body, headers.get('x-signature')), fault)
+            finally:
+                stop.set()
+
+    def test_corrupt_changes_decoded_signature(self):
+        def decode(method, value):
+            if method == 'hmac':
+                return bytes.fromhex(value.split('=', 1)[1])
+            signature = value.rsplit('.', 1)[1]
+            return base64.urlsafe_b64decode(signature + '=' * (-len(signature) % 4))
+
+        for method in signing.METHODS:
+            signer = signing.ResponseSigner(method, 'k3y', fault='corrupt')
+            for i in range(500):
+                body = os.urandom(i % 64)
+                resp = signer.apply(HTTPResponse(200, 'OK', {}, body))
+                good = signing.sign_hmac(b'k3y', body) if method == 'hmac' else signing.sign_jws(b'k3y', body)
+                self.assertNotEqual(decode(method, resp.headers['X-Signature']), decode(method, good))
+
+    def test_jws_format(self):
+        protected, payload, signature = signing.sign_jws(b'k', b'body').split('.')
+        self.assertEqual(payload, '')
+        header = json.loads(base64.urlsafe_b64decode(protected + '=' * (-len(protected) % 4)))
+        self.assertEqual(header['alg'], 'HS256')
+
+
+class TestHTTPRange(unittest.TestCase):
+    def get(self, port, path, range_header):
+        raw = f'GET {path} HTTP/1.1\r\nHost: x\r\nRange: {range_header}\r\nConnection: close\r\n\r\n'
+        return parse_responses(http_exchange(port, raw.encode()))[0]
+
+    def test_parse_range(self):
+        self.assertEqual(parse_range('bytes=0-9,-5,95-', 100), [(0, 9), (95, 99), (95, 99)])
+        self.assertEqual(parse_range('bytes=200-300', 100), [])
+        self.assertIsNone(parse_range('bytes=9-0', 100))
+        self.assertIsNone(parse_range('items=0-1', 100))
+
+    def test_single_and_multipart(self):
+        srv = HTTPServer(get_free_port(), '127.0.0.1')
+        stop = start_server(srv)
+        try:
+            status, headers, body = self.get(srv.port, '/bytes/1000', 'bytes=10-19')
+            self.assertEqual((status, body), (206, bytes(range(10, 20))))
+            self.assertEqual(headers['content-range'], 'bytes 10-19/1000')
+
+            status, headers, body = self.get(srv.port, '/bytes/1000', 'bytes=0-1,998-')
+            self.assertEqual(status, 206)
+            boundary = headers['content-type'].split('boundary=')[1]
+            parts = body.split(f'--{boundary}'.encode())
+            self.assertEqual(len(parts), 4)
+            self.assertTrue(parts[1].endswith(b'\r\n\r\n\x00\x01\r\n'))
+            self.assertIn(b'Content-Range: bytes 998-999/1000', parts[2])
+            self.assertEqual(parts[3], b'--\r\n')
+
+            status, headers, _ = self.get(srv.port, '/bytes/10', 'bytes=50-60')
+            self.assertEqual((status, headers['content-range']), (416, 'bytes */10'))
+
+            status, _, body = self.get(srv.port, '/bytes/100', 'bytes=' + ','.join(['0-'] * 51))
+            self.assertEqual((status, len(body)), (200, 100))
+        finally:
+            stop.set()
+
+    def test_handler_response_reused(self):
+        shared = HTTPResponse(200, 'OK', {'Content-Type': 'text/plain'}, b'0123456789')
+        srv = HTTPServer(get_free_port(), '127.0.0.1', handler=lambda req: shared)
+        stop = start_server(srv)
+        try:
+            self.assertEqual(self.get(srv.port, '/', 'bytes=0-1,4-5')[0], 206)
+            self.assertEqual(shared.headers, {'Content-Type': 'text/plain'})
+            status, headers, body = self.get(srv.port, '/', '')
+            self.assertEqual((status, headers['content-type'], body), (200, 'text/plain', b'0123456789'))
+        finally:
+            stop.set()
+
+    def test_range_faults(self):
+        srv = HTTPServer(get_free_port(), '127.0.0.1', range_fault='wrong_boundary')
+        stop = start_server(srv)
+        try:
+            _, headers, body = self.get(srv.port, '/bytes/100', 'bytes=0-1,5-6')
+            boundary = headers['content-type'].split('boundary=')[1]
+            self.assertNotIn(f'--{boundary}\r\n'.encode(), body)
+            srv.range_fault = 'missing_close'
+            _, headers, body = self.get(srv.port, '/bytes/100', 'bytes=0-1,5-6')
+            self.assertNotIn(b'--\r\n', body)
+            srv.range_fault = 'ignore'
+            status, _, body = self.get(srv.port, '/bytes/100', 'bytes=0-1,5-6')
+            self.assertEqual((status, len(body)), (200, 100))
+        finally:
+            stop.set()
+
+
+class TestHTTPProbe(unittest.TestCase):
+    def test_probe_strict_server(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        threading.Thread(target=HTTPServer(0, '127.0.0.1', strict=True).serve, args=(stop, sock),
+                         daemon=True).start()
+        try:
+            results = HTTPProber('127.0.0.1', port, timeout=1.0).run(
+                ['baseline', 'missing_host', 'pipelining', 'unsupported_version'])
+        finally:
+            stop.set()
+        self.assertEqual({r.name: r.statuses for r in results},
+                         {'baseline': [200], 'missing_host': [400], 'pipelining': [200, 200],
+                          'unsupported_version': [505]})
+        self.assertTrue(all(r.closed for r in results))
+
+    def test_parse_responses(self):
+        data = (b'HTTP/1.1 100 Continue\r\n\r\n'
+                b'HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n'
+                b'HTTP/1.1 404 Not Found\r\nContent-Length: 2\r\n\r\nno')
+        self.assertEqual([(s, b) for s, _, b in parse_responses(data)],
+                         [(100, b''), (200, b'abc'), (404, b'no')])
+
+
 if __name__ == '__main__':
     unittest.main()
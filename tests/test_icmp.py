@@ -0,0 +1,43 @@
+import struct
+import unittest
+
+from yourtestsrv import icmp_server as icmp
+
+
+def ipv4_packet(payload):
+    header = struct.pack('>BBHHHBBH4s4s', 0x45, 0, 20 + len(payload), 0, 0, 64, 1, 0,
+                         bytes([10, 0, 0, 2]), bytes([10, 0, 0, 1]))
+    return header + payload
+
+
+def echo_request(identifier, sequence, data):
+    header = struct.pack('>BBHHH', icmp.ICMP_ECHO_REQUEST, 0, 0, identifier, sequence)
+    csum = icmp.checksum(header + data)
+    return struct.pack('>BBHHH', icmp.ICMP_ECHO_REQUEST, 0, csum, identifier, sequence) + data
+
+
+class TestICMP(unittest.TestCase):
+    def test_checksum(self):
+        # RFC 1071 section 3 example
+        self.assertEqual(icmp.checksum(bytes.fromhex('0001f203f4f5f6f7')), 0x220D)
+        self.assertEqual(icmp.checksum(b'\x01'), ~0x0100 & 0xFFFF)
+
+    def test_echo_round_trip(self):
+        packet = ipv4_packet(echo_request(0x1234, 7, b'ping-data'))
+        self.assertEqual(icmp.parse_echo_request(packet), (0x1234, 7, b'ping-data'))
+        reply = icmp.build_echo_reply(0x1234, 7, b'ping-data')
+        self.assertEqual(reply[0], icmp.ICMP_ECHO_REPLY)
+        self.assertEqual(icmp.checksum(reply), 0)
+        self.assertEqual(reply[4:], struct.pack('>HH', 0x1234, 7) + b'ping-data')
+
+    def test_ignores_other_packets(self):
+        reply = ipv4_packet(icmp.build_echo_reply(1, 1, b'x'))
+        self.assertIsNone(icmp.parse_echo_request(reply))
+        corrupted = bytearray(ipv4_packet(echo_request(1, 1, b'x')))
+        corrupted[-1] ^= 0xFF
+        self.assertIsNone(icmp.parse_echo_request(bytes(corrupted)))
+        self.assertIsNone(icmp.parse_echo_request(b'\x45'))
+
+
+if __name__ == '__main__':
+    unittest.main()
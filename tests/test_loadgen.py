@@ -0,0 +1,75 @@
+import json
+import socket
+import threading
+import unittest
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+
+from yourtestsrv import loadgen
+from yourtestsrv.config import LoadGenConfig
+from yourtestsrv.mqtt_client import MQTTClient
+from yourtestsrv.mqtt_server import MQTTServer
+
+
+class TestLoadGenerator(unittest.TestCase):
+    def test_mqtt_devices(self):
+        srv = MQTTServer(0, '127.0.0.1')
+        sock = socket.create_server(('127.0.0.1', 0))
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        host, port = sock.getsockname()
+        received = []
+        sub = MQTTClient(host, port, 'watcher', on_message=lambda topic, payload, qos, retain:
+                         received.append((topic, json.loads(payload))))
+        sub.connect()
+        self.addCleanup(sub.disconnect)
+        sub.subscribe('fleet/#')
+
+        template = {'type': 'json', 'template': '{"id": "${device}", "seq": ${seq}}'}
+        gen = loadgen.LoadGenerator(f'mqtt://{host}:{port}', devices=5, device_id='meter-${index}', interval=0.1,
+                                    duration=0.55, topic='fleet/${device}', qos=1, templates=[{'payload': template}])
+        report = gen.run(threading.Event())
+        self.assertEqual((report['devices'], report['connects'], report['failed']), (5, 5, 0))
+        self.assertGreaterEqual(report['sent'], 15)
+        self.assertGreater(report['bytes'], 0)
+        self.assertIn(('fleet/meter-3', {'id': 'meter-3', 'seq': 1}), received)
+        self.assertEqual({topic for topic, _ in received}, {f'fleet/meter-{i}' for i in range(1, 6)})
+
+    def test_http_devices(self):
+        posts = []
+
+        class Handler(BaseHTTPRequestHandler):
+            def do_POST(self):
+                posts.append((self.path, self.rfile.read(int(self.headers['Content-Length']))))
+                self.send_response(503 if self.path.endswith('/2') else 204)
+                self.end_headers()
+
+            def log_message(self, *args):
+                pass
+
+        server = ThreadingHTTPServer(('127.0.0.1', 0), Handler)
+        self.addCleanup(server.server_close)
+        threading.Thread(target=server.serve_forever, daemon=True).start()
+        self.addCleanup(server.shutdown)
+        gen = loadgen.LoadGenerator(f'http://127.0.0.1:{server.server_port}/ingest/${{index}}', devices=3,
+                                    interval=0.2, duration=0.3,
+                                    templates=[{'payload': {'type': 'pattern', 'pattern': 'x', 'size': 8}}])
+        report = gen.run(threading.Event())
+        self.assertEqual((report['sent'], report['rejected'], report['failed']), (3, 2, 0))
+        self.assertEqual(sorted(set(posts)), [('/ingest/1', b'x' * 8), ('/ingest/2', b'x' * 8),
+                                              ('/ingest/3', b'x' * 8)])
+        self.assertIn('rejected 2', loadgen.format_report(report))
+
+    def test_config(self):
+        cfg = LoadGenConfig(target='mqtts://broker:8883', interval='2s', templates=[
+            {'payload': {'type': 'random', 'size': 4}, 'weight': 3}])
+        self.assertEqual((cfg.interval, cfg.templates[0]['weight']), (2.0, 3))
+        self.assertEqual(loadgen.parse_target('https://cloud/v1?key=1'), ('https', 'cloud', 443, '/v1?key=1'))
+        for bad in ({'target': 'tcp://broker'}, {'devices': 0}, {'qos': 3}, {'interval': '0s'},
+                    {'templates': [{'payload': {'type': 'nope'}}]}):
+            with self.assertRaises(ValueError):
+                LoadGenConfig(**bad)
+
+
+if __name__ == '__main__':
+    unittest.main()
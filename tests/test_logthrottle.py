@@ -0,0 +1,70 @@
+import logging
+import unittest
+
+from yourtestsrv import logthrottle
+from yourtestsrv.clock import VirtualClock
+
+
+class ListHandler(logging.Handler):
+    def __init__(self):
+        super().__init__()
+        self.messages = []
+
+    def emit(self, record):
+        self.messages.append(record.getMessage())
+
+
+class TestLogThrottle(unittest.TestCase):
+    def setUp(self):
+        self.clock = VirtualClock(start=1000.0)
+        self.handler = ListHandler()
+        self.log = logging.getLogger('test.logthrottle')
+        self.log.propagate = False
+        self.log.setLevel(logging.INFO)
+        self.log.addHandler(self.handler)
+        summaries = logging.getLogger('yourtestsrv.logthrottle')
+        summaries.addHandler(self.handler)
+        summaries.setLevel(logging.INFO)
+        self.addCleanup(summaries.setLevel, logging.NOTSET)
+        self.addCleanup(summaries.removeHandler, self.handler)
+        self.addCleanup(self.log.removeHandler, self.handler)
+
+    def use(self, specs):
+        throttle = logthrottle.LogThrottle(specs, clock=self.clock)
+        self.handler.addFilter(throttle)
+        return throttle
+
+    def test_every_and_summary(self):
+        throttle = self.use([{'event': 'udp.rx', 'every': 100, 'summary': '10s'}])
+        for i in range(250):
+            self.log.info(f'UDP received {i}', extra=logthrottle.event('udp.rx'))
+        self.log.info('UDP server listening')
+        self.assertEqual(self.handler.messages,
+                         ['UDP received 0', 'UDP received 100', 'UDP received 200', 'UDP server listening'])
+        self.clock.advance(10)
+        throttle.flush()
+        self.assertEqual(self.handler.messages[-1],
+                         'log throttle: udp.rx 250 events in 10s (25.0/s), 3 logged, 247 suppressed')
+        throttle.flush()
+        self.assertEqual(len(self.handler.messages), 5)
+
+    def test_max_rate_per_event_type(self):
+        self.use([{'event': '*', 'max_rate': 2}])
+        for _ in range(5):
+            self.log.info('rx', extra=logthrottle.event('tcp.rx'))
+            self.log.info('pub', extra=logthrottle.event('mqtt.publish'))
+        self.clock.advance(1)
+        self.log.info('rx', extra=logthrottle.event('tcp.rx'))
+        self.assertEqual(self.handler.messages, ['rx', 'pub', 'rx', 'pub', 'rx'])
+
+    def test_invalid_rules(self):
+        with self.assertRaises(ValueError):
+            logthrottle.LogThrottle([{'event': 'udp.bogus'}])
+        with self.assertRaises(ValueError):
+            logthrottle.LogThrottle([{'event': 'udp.rx', 'every': 0}])
+        with self.assertRaises(ValueError):
+            logthrottle.LogThrottle([{'event': 'udp.rx', 'sample': 10}])
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -7,7 +7,12 @@ import threading
 import time
 import unittest
 
-from yourtestsrv.mqtt_server import MQTTServer, MQTT_CONNECT, MQTT_CONNACK, MQTT_PUBLISH
+from yourtestsrv import codec, traffic
+from yourtestsrv.mqtt_server import (MQTTCluster, MQTTServer, MQTT_CONNECT, MQTT_CONNACK, MQTT_DISCONNECT,
+                                     MQTT_PUBACK, MQTT_PUBLISH, MQTT_SUBSCRIBE, MQTT_SUBACK, topic_matches)
+from yourtestsrv.mqtt_conformance import ConformanceRunner
+from yourtestsrv.payload import make_generator
+from yourtestsrv.payloadschema import ValidatorSet
 
 
 def get_free_port():
@@ -87,6 +92,13 @@ def build_connect(client_id):
     return build_mqtt_packet(MQTT_CONNECT, 0, payload)
 
 
+def build_connect_v5(client_id, clean=True):
+    payload = append_mqtt_string(b'', 'MQTT')
+    payload += bytes([5, 2 if clean else 0, 0, 60, 0])
+    payload = append_mqtt_string(payload, client_id)
+    return build_mqtt_packet(MQTT_CONNECT, 0, payload)
+
+
 def build_publish(topic, msg):
     payload = b''
     payload = append_mqtt_string(payload, topic)
@@ -94,6 +106,45 @@ def build_publish(topic, msg):
     return build_mqtt_packet(MQTT_PUBLISH, 0, payload)
 
 
+def build_subscribe(packet_id, topic_filter, qos=0):
+    payload = struct.pack('>H', packet_id)
+    payload = append_mqtt_string(payload, topic_filter)
+    payload += bytes([qos])
+    return build_mqtt_packet(MQTT_SUBSCRIBE, 2, payload)
+
+
+def build_subscribe_v5(packet_id, topic_filter, qos=0):
+    payload = append_mqtt_string(struct.pack('>H', packet_id) + b'\x00', topic_filter)
+    return build_mqtt_packet(MQTT_SUBSCRIBE, 2, payload + bytes([qos]))
+
+
+def read_packet(conn):
+    first = conn.recv(1)
+    length = 0
+    multiplier = 1
+    while True:
+        b = conn.recv(1)[0]
+        length += (b & 127) * multiplier
+        multiplier *= 128
+        if (b & 128) == 0:
+            break
+    payload = b''
+    while len(payload) < length:
+        payload += conn.recv(length - len(payload))
+    return first[0] >> 4, payload
+
+
+def connect_and_subscribe(port, client_id, topic_filter):
+    conn = socket.create_connection(('127.0.0.1', port))
+    conn.settimeout(2.0)
+    conn.sendall(build_connect(client_id))
+    read_packet(conn)
+    conn.sendall(build_subscribe(1, topic_filter))
+    packet_type, _ = read_packet(conn)
+    assert packet_type == MQTT_SUBACK
+    return conn
+
+
 class TestMQTTConnect(unittest.TestCase):
     def test_connect(self):
         port = get_free_port()
@@ -113,6 +164,52 @@ class TestMQTTConnect(unittest.TestCase):
         finally:
             stop.set()
 
+    def test_serve_injected_listener(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = MQTTServer(0, '127.0.0.1')
+        t = threading.Thread(target=srv.serve, args=(stop, sock), daemon=True)
+        t.start()
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+                conn.sendall(build_connect('ln'))
+                self.assertEqual(conn.recv(4)[0] >> 4, MQTT_CONNACK)
+            self.assertEqual(srv.addr(), ('127.0.0.1', port))
+        finally:
+            stop.set()
+
+    def test_idle_timeout_caps_keep_alive(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = MQTTServer(0, '127.0.0.1', idle_timeout=0.3)
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+                conn.sendall(build_connect('idle'))
+                self.assertEqual(conn.recv(4)[0] >> 4, MQTT_CONNACK)
+                start = time.time()
+                self.assertEqual(conn.recv(16), b'')
+                self.assertLess(time.time() - start, 1.5)
+        finally:
+            stop.set()
+
+    def test_max_connections_connack_banner(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = MQTTServer(0, '127.0.0.1', max_connections=1, over_limit='banner')
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=2.0) as first:
+                first.sendall(build_connect('one'))
+                self.assertEqual(first.recv(4), bytes([MQTT_CONNACK << 4, 2, 0, 0]))
+                with socket.create_connection(('127.0.0.1', port), timeout=2.0) as second:
+                    self.assertEqual(second.recv(4), bytes([MQTT_CONNACK << 4, 2, 0, 3]))
+        finally:
+            stop.set()
+
     def test_publish(self):
         port = get_free_port()
         stop = threading.Event()
@@ -140,6 +237,102 @@ class TestMQTTConnect(unittest.TestCase):
         finally:
             stop.set()
 
+    def test_traffic_totals(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        stop = threading.Event()
+        srv = MQTTServer(0, '127.0.0.1')
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            connect = build_connect('counted')
+            publish = build_mqtt_packet(MQTT_PUBLISH, 0x02, b'\x00\x01t\x00\x07hi')
+            with socket.create_connection(sock.getsockname(), timeout=2.0) as conn:
+                conn.sendall(connect + publish + build_mqtt_packet(MQTT_DISCONNECT, 0, b''))
+                self.assertEqual(read_packet(conn)[0], MQTT_CONNACK)
+                self.assertEqual(read_packet(conn)[0], MQTT_PUBACK)
+            deadline = time.time() + 2.0
+            while srv.traffic_totals()['frames_in'] < 3 and time.time() < deadline:
+                time.sleep(0.02)
+            self.assertEqual(srv.traffic_totals(), {'connections': 1, 'bytes_in': len(connect) + len(publish) + 2,
+                                                    'bytes_out': 8, 'frames_in': 3, 'frames_out': 2})
+        finally:
+            stop.set()
+
+    def test_lifecycle_hooks(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        stop = threading.Event()
+        events = []
+        closed = threading.Event()
+
+        def on_close(conn, addr, error):
+            events.append(('close', error))
+            closed.set()
+
+        srv = MQTTServer(0, '127.0.0.1', on_accept=lambda conn, addr: events.append(('accept', addr)),
+                         on_close=on_close)
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.create_connection(sock.getsockname(), timeout=2.0) as conn:
+                conn.sendall(build_connect('hooked'))
+                self.assertEqual(read_packet(conn)[0], MQTT_CONNACK)
+                self.assertEqual(events, [('accept', conn.getsockname())])
+                conn.sendall(build_mqtt_packet(MQTT_DISCONNECT, 0, b''))
+                self.assertTrue(closed.wait(2.0))
+            self.assertEqual(events[1], ('close', None))
+        finally:
+            stop.set()
+
+    def test_routing(self):
+        port = get_free_port()
+        stop = threading.Event()
+        srv = MQTTServer(port, '127.0.0.1')
+        t = threading.Thread(target=srv.listen_and_serve, args=(stop,), daemon=True)
+        t.start()
+        wait_tcp(port)
+        try:
+            with connect_and_subscribe(port, 'sub', 'sensors/+/temp') as sub, \
+                    socket.create_connection(('127.0.0.1', port)) as pub:
+                pub.sendall(build_connect('pub'))
+                pub.settimeout(2.0)
+                read_packet(pub)
+                pub.sendall(build_publish('sensors/a/humidity', b'ignored'))
+                pub.sendall(build_publish('sensors/a/temp', b'21.5'))
+                packet_type, payload = read_packet(sub)
+                self.assertEqual(packet_type, MQTT_PUBLISH)
+                self.assertTrue(payload.endswith(b'sensors/a/temp21.5'))
+        finally:
+            stop.set()
+
+    def test_inject_generated_payload(self):
+        port = get_free_port()
+        stop = threading.Event()
+        srv = MQTTServer(port, '127.0.0.1')
+        t = threading.Thread(target=srv.listen_and_serve, args=(stop,), daemon=True)
+        t.start()
+        wait_tcp(port)
+        try:
+            with connect_and_subscribe(port, 'sub', 'cmd/#') as sub:
+                gen = make_generator({'type': 'json', 'template': '{"seq": ${counter}}', 'start': 7})
+                self.assertEqual(srv.publish('cmd/reboot', gen.next()), 1)
+                _, payload = read_packet(sub)
+                self.assertTrue(payload.endswith(b'{"seq": 7}'))
+        finally:
+            stop.set()
+
+    def test_topic_matches(self):
+        self.assertTrue(topic_matches('a/#', 'a/b/c'))
+        self.assertTrue(topic_matches('a/+/c', 'a/b/c'))
+        self.assertFalse(topic_matches('a/+', 'a/b/c'))
+        self.assertFalse(topic_matches('#', '$SYS/uptime'))
+
+    def test_payload_generators(self):
+        self.assertEqual(make_generator({'type': 'pattern', 'pattern_hex': 'a55a', 'size': 5}).next(),
+                         b'\xa5\x5a\xa5\x5a\xa5')
+        counter = make_generator({'type': 'counter', 'start': 1, 'width': 2})
+        self.assertEqual([counter.next(), counter.next()], [b'\x00\x01', b'\x00\x02'])
+        self.assertEqual(len(make_generator({'type': 'random', 'size': 8}).next()), 8)
+        with self.assertRaises(ValueError):
+            make_generator({'type': 'nope'})
+
     def test_tls(self):
         try:
             cert_path, key_path = make_temp_cert()
@@ -156,7 +349,10 @@ class TestMQTTConnect(unittest.TestCase):
             ctx.check_hostname = False
             ctx.verify_mode = ssl.CERT_NONE
             ctx.minimum_version = ssl.TLSVersion.TLSv1_2
-            with ctx.wrap_socket(socket.create_connection(('127.0.0.1', port))) as conn:
+            # A client that never starts its handshake holds up no one else.
+            silent = socket.create_connection(('127.0.0.1', port))
+            self.addCleanup(silent.close)
+            with ctx.wrap_socket(socket.create_connection(('127.0.0.1', port), timeout=2.0)) as conn:
                 conn.sendall(build_connect('tls-client'))
                 conn.settimeout(2.0)
                 buf = b''
@@ -167,5 +363,148 @@ class TestMQTTConnect(unittest.TestCase):
             stop.set()
 
 
+class TestMQTTRedirect(unittest.TestCase):
+    def start(self, srv):
+        sock = socket.create_server(('127.0.0.1', 0))
+        stop = threading.Event()
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        self.addCleanup(stop.set)
+        return sock.getsockname()[1]
+
+    def test_connect_redirected(self):
+        port = self.start(MQTTServer(0, '127.0.0.1', redirect='broker2:1884', redirect_code='server_moved'))
+        with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+            conn.sendall(build_connect_v5('dev'))
+            packet_type, payload = read_packet(conn)
+            self.assertEqual(packet_type, MQTT_CONNACK)
+            self.assertEqual(payload, b'\x00\x9d\x0f\x1c\x00\x0cbroker2:1884')
+            self.assertEqual(conn.recv(1), b'')
+        with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+            conn.sendall(build_connect('old'))
+            self.assertEqual(read_packet(conn), (MQTT_CONNACK, b'\x00\x03'))
+
+    def test_redirect_clients_disconnects(self):
+        srv = MQTTServer(0, '127.0.0.1')
+        port = self.start(srv)
+        with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+            conn.sendall(build_connect_v5('dev'))
+            self.assertEqual(read_packet(conn), (MQTT_CONNACK, b'\x00\x00\x00'))
+            self.assertEqual(srv.redirect_clients('broker2:1884'), 1)
+            packet_type, payload = read_packet(conn)
+            self.assertEqual(packet_type, MQTT_DISCONNECT)
+            self.assertEqual(payload[0], 0x9C)
+            self.assertTrue(payload.endswith(b'broker2:1884'))
+        srv.redirect_clients('')
+        with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+            conn.sendall(build_connect('back'))
+            self.assertEqual(read_packet(conn), (MQTT_CONNACK, b'\x00\x00'))
+
+    def test_cluster_shares_state(self):
+        cluster = MQTTCluster()
+        broker = MQTTServer(0, '127.0.0.1', retain_messages=True, cluster=cluster)
+        first = self.start(broker)
+        second = self.start(MQTTServer(0, '127.0.0.1', cluster=cluster))
+        with socket.create_connection(('127.0.0.1', first), timeout=2.0) as conn:
+            conn.sendall(build_connect_v5('dev', clean=False))
+            read_packet(conn)
+            conn.sendall(build_subscribe_v5(1, 'cmd/dev'))
+            self.assertEqual(read_packet(conn), (MQTT_SUBACK, b'\x00\x01\x00\x00'))
+        with connect_and_subscribe(second, 'app', 'state/#') as sub, \
+                socket.create_connection(('127.0.0.1', first), timeout=2.0) as pub:
+            pub.sendall(build_connect('pub'))
+            read_packet(pub)
+            pub.sendall(build_publish('state/dev', b'on'))
+            packet_type, payload = read_packet(sub)
+            self.assertEqual(packet_type, MQTT_PUBLISH)
+            self.assertTrue(payload.endswith(b'state/devon'))
+        # Failing over to the other member resumes the stored session with its subscription.
+        with socket.create_connection(('127.0.0.1', second), timeout=2.0) as conn:
+            time.sleep(0.1)
+            conn.sendall(build_connect_v5('dev', clean=False))
+            self.assertEqual(read_packet(conn), (MQTT_CONNACK, b'\x01\x00\x00'))
+            with connect_and_subscribe(first, 'late', 'state/#') as late:
+                self.assertTrue(read_packet(late)[1].endswith(b'state/devon'))
+                broker.publish('cmd/dev', b'reboot')
+                packet_type, payload = read_packet(conn)
+                self.assertEqual(payload, b'\x00\x07cmd/dev\x00reboot')
+
+
+class TestMQTTPayloadValidation(unittest.TestCase):
+    def start(self, specs):
+        sock = socket.create_server(('127.0.0.1', 0))
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+        srv = MQTTServer(0, '127.0.0.1', validators=ValidatorSet(specs))
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        return srv, sock.getsockname()[1]
+
+    def test_violation_counted_and_delivered(self):
+        srv, port = self.start([{'topic': 'devices/+/telemetry',
+                                 'json_schema': {'type': 'object', 'required': ['temp']}}])
+        received = []
+
+        class Handler:
+            def on_publish(self, topic, qos, payload, packet_id):
+                received.append(payload)
+        srv.handler = Handler()
+        sub = traffic.subscribe(protocol='mqtt')
+        self.addCleanup(traffic.unsubscribe, sub)
+        with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+            conn.sendall(build_connect('dev-1'))
+            self.assertEqual(read_packet(conn)[0], MQTT_CONNACK)
+            conn.sendall(build_publish('devices/dev-1/telemetry', b'{"temp": 21}'))
+            conn.sendall(build_publish('devices/dev-1/telemetry', b'{"hum": 40}'))
+            deadline = time.time() + 2.0
+            while len(received) < 2 and time.time() < deadline:
+                time.sleep(0.02)
+        self.assertEqual(received, [b'{"temp": 21}', b'{"hum": 40}'])
+        self.assertEqual(srv.stats.errors.get('schema'), 1)
+        events = iter(lambda: sub.get(0.5), None)
+        event = next(e for e in events if e['kind'] == 'violation')
+        self.assertEqual((event['topic'], event['client'], event['reason']),
+                         ('devices/dev-1/telemetry', 'dev-1', "$: missing 'temp'"))
+
+    def test_disconnect_on_violation(self):
+        srv, port = self.start([{'topic': 'devices/#', 'cddl': 'reading = {temp: float}', 'disconnect': True}])
+        received = []
+
+        class Handler:
+            def on_publish(self, topic, qos, payload, packet_id):
+                received.append(payload)
+        srv.handler = Handler()
+        with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+            conn.sendall(build_connect_v5('dev-5'))
+            self.assertEqual(read_packet(conn)[0], MQTT_CONNACK)
+            publish = append_mqtt_string(b'', 'devices/dev-5') + b'\x00' + codec.encode({'temp': 'hot'}, 'cbor')
+            conn.sendall(build_mqtt_packet(MQTT_PUBLISH, 0, publish))
+            self.assertEqual(read_packet(conn), (MQTT_DISCONNECT, bytes([0x99])))
+            self.assertEqual(conn.recv(16), b'')
+        with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+            conn.sendall(build_connect('dev-3'))
+            self.assertEqual(read_packet(conn)[0], MQTT_CONNACK)
+            conn.sendall(build_publish('devices/dev-3', b'{"temp": 1}'))
+            self.assertEqual(conn.recv(16), b'')
+        self.assertEqual(received, [])
+        self.assertEqual(srv.stats.errors.get('schema'), 2)
+
+
+class TestMQTTConformance(unittest.TestCase):
+    def test_builtin_broker_passes(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        threading.Thread(target=MQTTServer(0, '127.0.0.1').serve, args=(stop, sock), daemon=True).start()
+        try:
+            results = ConformanceRunner('127.0.0.1', port, timeout=2.0).run()
+        finally:
+            stop.set()
+        self.assertEqual([(r.name, r.detail) for r in results if not r.passed], [])
+        self.assertIn('will', [r.name for r in results])
+
+    def test_unreachable_broker_fails(self):
+        results = ConformanceRunner('127.0.0.1', get_free_port(), timeout=0.5).run(['connect', 'ping'])
+        self.assertEqual([r.passed for r in results], [False, False])
+
+
 if __name__ == '__main__':
     unittest.main()
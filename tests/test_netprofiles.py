@@ -0,0 +1,87 @@
+import socket
+import threading
+import time
+import unittest
+
+from yourtestsrv import netprofiles
+from yourtestsrv.config import ServerConfig
+from yourtestsrv.session import Session
+from yourtestsrv.shaping import Latency, jittered
+from yourtestsrv.udp_server import UDPServer
+
+
+class TestNetworkProfiles(unittest.TestCase):
+    def test_config_precedence(self):
+        server = ServerConfig(network_profile='nb-iot', udp={'drop_rate': 0.1})
+        self.assertEqual((server.tcp.delay, server.tcp.jitter, server.tcp.rate_limit), (1.5, 0.5, 2500.0))
+        self.assertEqual((server.udp.delay, server.udp.drop_rate, server.udp.rate_limit), (1.5, 0.1, 2500.0))
+        self.assertEqual(ServerConfig().udp.delay, 0.0)
+        with self.assertRaisesRegex(ValueError, 'unknown network profile'):
+            ServerConfig(network_profile='5g')
+
+        # On the command line the profile wins over the config file.
+        netprofiles.apply(server, 'lte-m')
+        self.assertEqual((round(server.udp.delay, 3), round(server.udp.jitter, 3), server.udp.drop_rate),
+                         (0.15, 0.05, 0.005))
+        self.assertEqual(server.network_profile, 'lte-m')
+
+        session = Session('s', [{'type': 'udp'}, {'type': 'tcp', 'delay': '0s'}, {'type': 'http'}],
+                          network_profile='gprs')
+        (_, udp), (_, tcp), _ = session.servers
+        self.assertEqual((round(udp.delay, 3), udp.jitter, udp.drop_rate), (0.7, 0.2, 0.02))
+        self.assertEqual((tcp.delay, tcp.jitter), (0.0, 0.2))
+
+    def test_jitter(self):
+        self.assertEqual(jittered(0.2, 0.0), 0.2)
+        samples = [jittered(0.2, 0.1) for _ in range(200)]
+        self.assertTrue(all(0.1 <= s <= 0.3 for s in samples))
+        self.assertGreater(max(samples) - min(samples), 0.1)
+        self.assertTrue(all(s >= 0 for s in (jittered(0.0, 0.05) for _ in range(50))))
+
+    def test_latency_model(self):
+        normal = Latency({'distribution': 'normal', 'mean': '200ms', 'stddev': '100ms', 'min': '150ms', 'max': '250ms'})
+        samples = [normal.sample() for _ in range(500)]
+        self.assertTrue(all(0.15 <= s <= 0.25 for s in samples))
+        self.assertIn(0.15, samples)
+        pareto = Latency({'distribution': 'pareto', 'min': '100ms', 'mean': '300ms'})
+        self.assertEqual(pareto.distribution.spec, 'pareto:100ms:1.5')
+        self.assertTrue(all(s >= 0.1 for s in (pareto.sample() for _ in range(100))))
+        self.assertTrue(all(0.1 <= s <= 0.2 for s in (Latency('uniform:100ms:200ms').sample() for _ in range(100))))
+        for spec in ({'distribution': 'normal', 'mean': '1s'}, {'distribution': 'gamma'}, {'mean': '1s'},
+                     {'distribution': 'uniform', 'min': '2s', 'max': '1s'}, {'distribution': 'pareto', 'min': '0s'},
+                     {'distribution': 'exponential', 'mean': '1s', 'median': '1s'}, 'normal:1s'):
+            with self.assertRaises(ValueError, msg=spec):
+                Latency(spec)
+        self.assertIsNone(ServerConfig().http.latency)
+        self.assertEqual(ServerConfig(tcp={'latency': 'exponential:50ms'}).tcp.latency.distribution.name, 'exponential')
+
+        sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        sock.bind(('127.0.0.1', 0))
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+        srv = UDPServer(0, '127.0.0.1', delay=5.0, latency=Latency('uniform:100ms:150ms'))
+        threading.Thread(target=srv.serve_udp, args=(stop, sock), daemon=True).start()
+        with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as conn:
+            conn.settimeout(2.0)
+            start = time.monotonic()
+            conn.sendto(b'ping', sock.getsockname())
+            self.assertEqual(conn.recvfrom(16)[0], b'ping')
+            self.assertTrue(0.1 <= time.monotonic() - start < 1.0)
+
+    def test_udp_bandwidth(self):
+        sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        sock.bind(('127.0.0.1', 0))
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+        srv = UDPServer(0, '127.0.0.1', rate_limit=10000.0)
+        threading.Thread(target=srv.serve_udp, args=(stop, sock), daemon=True).start()
+        with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as conn:
+            conn.settimeout(2.0)
+            start = time.monotonic()
+            conn.sendto(b'x' * 1500, sock.getsockname())
+            self.assertEqual(len(conn.recvfrom(2048)[0]), 1500)
+            self.assertGreaterEqual(time.monotonic() - start, 0.14)
+
+
+if __name__ == '__main__':
+    unittest.main()
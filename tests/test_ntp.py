@@ -0,0 +1,79 @@
+import socket
+import struct
+import threading
+import unittest
+
+from yourtestsrv import clock, ntp_server as ntp
+from yourtestsrv.config import NTPConfig
+from yourtestsrv.udp_server import UDPServer
+
+ADDR = ('10.1.2.3', 123)
+TRANSMIT = 0x1234567890ABCDEF
+
+
+def request(version=4, mode=ntp.MODE_CLIENT):
+    return struct.pack('>BBbbII4sQQQQ', version << 3 | mode, 0, 6, 0, 0, 0, b'\x00' * 4, 0, 0, 0, TRANSMIT)
+
+
+class TestNTPResponder(unittest.TestCase):
+    def setUp(self):
+        self.clock = clock.VirtualClock(start=1700000000.0)
+
+    def served(self, responder):
+        reply = ntp.parse_packet(responder.respond(ADDR, request()))
+        return reply, ntp.from_ntp(reply['transmit']) - self.clock.time()
+
+    def test_reply(self):
+        reply, offset = self.served(ntp.NTPResponder(clock=self.clock, refid='GPS', stratum=1))
+        self.assertEqual((reply['mode'], reply['version'], reply['leap']), (ntp.MODE_SERVER, 4, 0))
+        self.assertEqual((reply['stratum'], reply['refid'], reply['poll']), (1, b'GPS\x00', 6))
+        self.assertEqual(reply['originate'], TRANSMIT)
+        self.assertAlmostEqual(offset, 0.0, places=6)
+        self.assertAlmostEqual(ntp.from_ntp(reply['receive']), self.clock.time(), places=6)
+        self.assertEqual(ntp.parse_packet(ntp.NTPResponder(clock=self.clock).respond(ADDR, request(version=3)))
+                         ['version'], 3)
+        self.assertIsNone(ntp.NTPResponder(clock=self.clock).respond(ADDR, request(mode=4)))
+        self.assertIsNone(ntp.NTPResponder(clock=self.clock).respond(ADDR, b'\x23' * 12))
+
+    def test_skew(self):
+        responder = ntp.NTPResponder(offset=-90.0, drift=1000.0, flap=60.0, leap=3, stratum=16, clock=self.clock)
+        reply, offset = self.served(responder)
+        self.assertAlmostEqual(offset, -90.0, places=5)
+        self.assertEqual((reply['leap'], reply['stratum']), (3, 16))
+        self.clock.advance(30)
+        self.assertAlmostEqual(self.served(responder)[1], -90.0 + 0.03, places=5)
+        # The second flap period serves the right time, the third the skewed one again.
+        self.clock.advance(40)
+        self.assertAlmostEqual(self.served(responder)[1], 0.0, places=5)
+        self.clock.advance(60)
+        self.assertAlmostEqual(self.served(responder)[1], -90.0 + 0.13, places=5)
+
+        jittery = ntp.NTPResponder(offset=10.0, jitter=0.5, clock=self.clock)
+        for _ in range(20):
+            self.assertLessEqual(abs(self.served(jittery)[1] - 10.0), 0.5 + 1e-6)
+
+    def test_config(self):
+        cfg = NTPConfig(offset='-2h', jitter='100ms', refid='PPS')
+        self.assertEqual((cfg.port, cfg.offset, cfg.jitter), (1123, -7200.0, 0.1))
+        for bad in ({'stratum': 17}, {'leap': 4}, {'refid': 'TOOLONG'}):
+            with self.assertRaises(ValueError):
+                NTPConfig(**bad)
+
+    def test_udp(self):
+        responder = ntp.NTPResponder(offset=3600.0)
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+        sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        sock.bind(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        threading.Thread(target=UDPServer(port, '127.0.0.1', handler=responder.handle_udp).serve_udp,
+                         args=(stop, sock), daemon=True).start()
+        with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as client:
+            client.settimeout(2.0)
+            client.sendto(request(), ('127.0.0.1', port))
+            reply = ntp.parse_packet(client.recv(512))
+        self.assertAlmostEqual(ntp.from_ntp(reply['transmit']) - clock.get().time(), 3600.0, delta=1.0)
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,99 @@
+import base64
+import socket
+import threading
+import time
+import unittest
+
+from yourtestsrv import ntrip_server as ntrip
+from yourtestsrv.tcp_server import TCPServer
+
+
+def bits(data, offset, size, signed=False):
+    """Field of size bits at offset into the body of a framed RTCM3 message."""
+    body = int.from_bytes(data[3:-3], 'big')
+    value = (body >> ((len(data) - 6) * 8 - offset - size)) & ((1 << size) - 1)
+    return value - (1 << size) if signed and value >> (size - 1) else value
+
+
+class TestRTCM(unittest.TestCase):
+    def test_framing(self):
+        self.assertEqual(ntrip.crc24q(b'123456789'), 0xCDE703)
+        mount = ntrip.Mountpoint('LAB', latitude=31.2, longitude=121.5, height=10.0, station_id=7)
+        frames = ntrip.split_frames(b'junk' + mount.epoch(0, 1.8e9) + b'\xd3\x00')
+        self.assertEqual([ntrip.message_number(f) for f in frames], [1005, 1077, 1087, 1097, 1127])
+        x, y, z = ntrip.ecef(31.2, 121.5, 10.0)
+        arp = frames[0]
+        self.assertEqual((bits(arp, 0, 12), bits(arp, 12, 12)), (1005, 7))
+        self.assertAlmostEqual(bits(arp, 34, 38, True) / 1e4, x, places=3)
+        self.assertAlmostEqual(bits(arp, 74, 38, True) / 1e4, y, places=3)
+        self.assertAlmostEqual(bits(arp, 114, 38, True) / 1e4, z, places=3)
+        # Only the last MSM of an epoch clears the multiple message bit.
+        self.assertEqual([bits(f, 54, 1) for f in frames[1:]], [1, 1, 1, 0])
+        self.assertEqual(len(ntrip.group_epochs(frames * 3)), 3)
+
+
+class TestCaster(unittest.TestCase):
+    def start(self, *mountpoints, auth=''):
+        sock = socket.create_server(('127.0.0.1', 0))
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+        caster = ntrip.NTRIPCaster(list(mountpoints), auth)
+        threading.Thread(target=TCPServer(0, '127.0.0.1', handler=caster.handle).serve, args=(stop, sock),
+                         daemon=True).start()
+        self.port = sock.getsockname()[1]
+
+    def request(self, path, v2=False, credentials=None):
+        conn = socket.create_connection(('127.0.0.1', self.port), timeout=2.0)
+        self.addCleanup(conn.close)
+        headers = 'Ntrip-Version: Ntrip/2.0\r\n' if v2 else ''
+        if credentials:
+            headers += f'Authorization: Basic {base64.b64encode(credentials.encode()).decode()}\r\n'
+        conn.sendall(f'GET {path} HTTP/1.{int(v2)}\r\nUser-Agent: NTRIP test\r\n{headers}\r\n'.encode())
+        return conn
+
+    def read_head(self, conn):
+        data = b''
+        while b'\r\n\r\n' not in data:
+            data += conn.recv(1)
+        return data.decode()
+
+    def test_sourcetable_and_auth(self):
+        self.start(ntrip.Mountpoint('OPEN', auth=''), ntrip.Mountpoint('VRS', require_gga=True), auth='dev:pw')
+        conn = self.request('/')
+        self.assertTrue(self.read_head(conn).startswith('SOURCETABLE 200 OK'))
+        table = b''
+        while not table.endswith(b'ENDSOURCETABLE\r\n'):
+            table += conn.recv(4096)
+        self.assertIn(b'STR;OPEN;OPEN;RTCM 3.2;', table)
+        self.assertIn(b';none;N;N;9600;', table)
+        self.assertIn(b';1;0;yourtestsrv;none;B;N;9600;', table)
+        self.assertIn('401 Unauthorized', self.read_head(self.request('/VRS', credentials='dev:bad')))
+        self.assertIn('404 Not Found', self.read_head(self.request('/NOPE', v2=True)))
+        conn = self.request('/OPEN')
+        self.assertEqual(self.read_head(conn), 'ICY 200 OK\r\n\r\n')
+        self.assertEqual(ntrip.message_number(conn.recv(25)), 1005)
+
+    def test_gga_and_disconnect(self):
+        self.start(ntrip.Mountpoint('VRS', messages=[1005], interval='50ms', require_gga=True,
+                                    disconnect_after='1s'))
+        conn = self.request('/VRS', v2=True, credentials='any:thing')
+        self.assertIn('Transfer-Encoding: chunked', self.read_head(conn))
+        conn.settimeout(0.3)
+        with self.assertRaises(socket.timeout):
+            conn.recv(1)
+        conn.sendall(b'$GPGGA,000000.00,3112.0000,N,12130.0000,E,1,08,1.0,10.0,M,0.0,M,,*00\r\n')
+        conn.settimeout(2.0)
+        self.assertEqual(conn.recv(4), b'19\r\n')
+        start = time.time()
+        data = b''
+        while True:
+            chunk = conn.recv(4096)
+            if not chunk:
+                break
+            data += chunk
+        self.assertLess(time.time() - start, 1.5)
+        self.assertGreater(len(ntrip.split_frames(data)), 3)
+
+
+if __name__ == '__main__':
+    unittest.main()
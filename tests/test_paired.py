@@ -0,0 +1,41 @@
+import socket
+import threading
+import unittest
+
+from yourtestsrv import netutil, stats
+from yourtestsrv.paired import PairedEchoService
+
+
+class TestPairedEcho(unittest.TestCase):
+    def test_shared_port_faults_and_stats(self):
+        tcp_sock = netutil.listen_tcp('127.0.0.1', 0)
+        port = tcp_sock.getsockname()[1]
+        udp_sock = netutil.bind_udp('127.0.0.1', port)
+        stop = threading.Event()
+        srv = PairedEchoService(0, '127.0.0.1')
+        threading.Thread(target=srv.serve, args=(stop, tcp_sock, udp_sock), daemon=True).start()
+        try:
+            with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as udp:
+                udp.settimeout(2.0)
+                udp.sendto(b'udp', ('127.0.0.1', port))
+                self.assertEqual(udp.recvfrom(16)[0], b'udp')
+                srv.configure(drop_rate=1.0, corrupt_rate=1.0)
+                udp.settimeout(0.3)
+                udp.sendto(b'udp', ('127.0.0.1', port))
+                with self.assertRaises(socket.timeout):
+                    udp.recvfrom(16)
+            with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+                conn.sendall(b'tcp')
+                # UDP is dropped but TCP still answers, corrupted like UDP would be.
+                self.assertNotEqual(conn.recv(16), b'tcp')
+            srv.stats.record_error(stats.ERROR_PARSE)
+            self.assertEqual(stats.snapshot()[f'paired:{port}']['errors'][stats.ERROR_PARSE], 1)
+            self.assertNotIn(f'udp:{port}', stats.snapshot())
+            with self.assertRaises(ValueError):
+                srv.configure(rate_limit=1)
+        finally:
+            stop.set()
+
+
+if __name__ == '__main__':
+    unittest.main()
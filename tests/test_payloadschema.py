@@ -0,0 +1,141 @@
+import os
+import shutil
+import struct
+import tempfile
+import unittest
+
+from yourtestsrv import codec
+from yourtestsrv.payloadschema import (CDDLValidator, JSONSchemaValidator, ProtobufValidator, ValidatorSet,
+                                       Violation)
+
+
+def varint(n):
+    out = b''
+    while True:
+        b, n = n & 0x7F, n >> 7
+        out += bytes([b | (0x80 if n else 0)])
+        if not n:
+            return out
+
+
+def vint(number, value):
+    return varint(number << 3) + varint(value)
+
+
+def ld(number, data):
+    data = data.encode() if isinstance(data, str) else data
+    return varint(number << 3 | 2) + varint(len(data)) + data
+
+
+def field(name, number, label, kind, type_name=''):
+    return ld(1, name) + vint(3, number) + vint(4, label) + vint(5, kind) + (ld(6, type_name) if type_name else b'')
+
+
+# package iot; message Telemetry { optional float temp = 1; required string id = 2;
+# repeated uint32 samples = 3; optional Location loc = 4; message Location { optional double lat = 1; } }
+LOCATION = ld(1, 'Location') + ld(2, field('lat', 1, 1, 1))
+TELEMETRY = (ld(1, 'Telemetry') + ld(2, field('temp', 1, 1, 2)) + ld(2, field('id', 2, 2, 9))
+             + ld(2, field('samples', 3, 3, 13)) + ld(2, field('loc', 4, 1, 11, '.iot.Telemetry.Location'))
+             + ld(3, LOCATION))
+DESCRIPTOR_SET = ld(1, ld(1, 'telemetry.proto') + ld(2, 'iot') + ld(4, TELEMETRY))
+
+
+def violation(validator, data):
+    try:
+        validator.check(data)
+    except Violation as e:
+        return str(e)
+    return None
+
+
+class TestValidators(unittest.TestCase):
+    def test_json_schema(self):
+        v = JSONSchemaValidator({
+            'type': 'object', 'required': ['temp'], 'additionalProperties': False,
+            'properties': {'temp': {'type': 'number', 'minimum': -40, 'maximum': 85}, 'id': {'$ref': '#/$defs/id'},
+                           'tags': {'type': 'array', 'items': {'type': 'string'}, 'maxItems': 2}},
+            '$defs': {'id': {'type': 'string', 'pattern': '^dev-'}},
+        })
+        self.assertIsNone(violation(v, b'{"temp": 21.5, "id": "dev-1", "tags": ["a"]}'))
+        self.assertEqual(violation(v, b'{"temp": 99}'), '$.temp: 99 out of range')
+        self.assertEqual(violation(v, b'{"id": "dev-1"}'), "$: missing 'temp'")
+        self.assertEqual(violation(v, b'{"temp": 1, "hum": 2}'), "$: unexpected property 'hum'")
+        self.assertEqual(violation(v, b'{"temp": 1, "id": "x"}'), "$.id: 'x' does not match ^dev-")
+        self.assertIn('not of type string', violation(v, b'{"temp": 1, "tags": [1]}'))
+        self.assertTrue(violation(v, b'{"temp": 1, "tags": ["a", "b", "c"]}'))
+        self.assertTrue(violation(v, b'{"temp": true}'))
+        self.assertTrue(violation(v, b'temp=21').startswith('not json'))
+        # The same schema over CBOR-encoded telemetry.
+        cbor = JSONSchemaValidator(v.schema, 'cbor')
+        self.assertIsNone(violation(cbor, codec.encode({'temp': 20}, 'cbor')))
+        self.assertTrue(violation(cbor, codec.encode({'temp': 'hot'}, 'cbor')))
+        with self.assertRaisesRegex(ValueError, 'unresolvable'):
+            JSONSchemaValidator({'$ref': '#/$defs/missing'})
+
+    def test_cddl(self):
+        v = CDDLValidator('''
+            reading = {header, temp: float, ? hum: 0..100, ? status: status, * tstr => int}
+            header = (id: tstr .size (1..16), seq: uint)
+            status = "ok" / "fault"
+        ''')
+        ok = {'id': 'dev-1', 'seq': 7, 'temp': 21.5}
+        self.assertIsNone(violation(v, codec.encode(ok, 'cbor')))
+        self.assertIsNone(violation(v, codec.encode({**ok, 'hum': 40, 'status': 'fault', 'rssi': -70}, 'cbor')))
+        self.assertEqual(violation(v, codec.encode({**ok, 'status': 'meh'}, 'cbor')),
+                         "$.status: 'meh' is not status")
+        self.assertEqual(violation(v, codec.encode({'id': 'dev-1', 'temp': 1.0}, 'cbor')), "$: missing 'seq'")
+        self.assertEqual(violation(v, codec.encode({**ok, 'id': ''}, 'cbor')),
+                         "$.id: '' is not tstr .size 1..16")
+        self.assertEqual(violation(v, codec.encode({**ok, 'note': 'x'}, 'cbor')), "$: unexpected key 'note'")
+        self.assertTrue(violation(v, b'\xff'))
+
+        arrays = CDDLValidator('batch = [version: 1, + (ts: uint, value: int / float)]')
+        self.assertIsNone(violation(arrays, codec.encode([1, 100, 20, 101, 20.5], 'cbor')))
+        self.assertTrue(violation(arrays, codec.encode([1, 100, 20, 101], 'cbor')))
+        self.assertTrue(violation(arrays, codec.encode([1], 'cbor')))
+        self.assertTrue(violation(arrays, codec.encode([2, 100, 20], 'cbor')))
+        with self.assertRaisesRegex(ValueError, 'undefined'):
+            CDDLValidator('a = {b: c}')
+        with self.assertRaisesRegex(ValueError, 'unsupported control'):
+            CDDLValidator('a = bstr .cbor b')
+
+    def test_protobuf(self):
+        v = ProtobufValidator(DESCRIPTOR_SET)
+        self.assertEqual(v.message, 'iot.Telemetry')
+        temp = varint(1 << 3 | 5) + struct.pack('<f', 21.5)
+        loc = ld(4, varint(1 << 3 | 1) + struct.pack('<d', 48.1))
+        self.assertIsNone(violation(v, temp + ld(2, 'dev-1') + vint(3, 5) + ld(3, varint(6) + varint(300)) + loc))
+        self.assertEqual(violation(v, temp), '$: missing required id in iot.Telemetry')
+        self.assertEqual(violation(v, ld(2, 'dev-1') + vint(9, 1)), '$: unknown field 9 in iot.Telemetry')
+        self.assertEqual(violation(v, ld(2, 'dev-1') + vint(1, 21)), '$.temp: wire type 0, expected 5')
+        self.assertEqual(violation(v, ld(2, b'\xff')), '$.id: invalid UTF-8')
+        self.assertIn('$.loc: not a iot.Telemetry.Location', violation(v, ld(2, 'x') + ld(4, b'\x09\x00')))
+        self.assertIn('truncated', violation(v, ld(2, 'dev-1')[:-1]))
+        with self.assertRaisesRegex(ValueError, 'not in the descriptor set'):
+            ProtobufValidator(DESCRIPTOR_SET, 'iot.Missing')
+
+    def test_topic_table(self):
+        tmp = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, tmp)
+        desc = os.path.join(tmp, 'telemetry.desc')
+        with open(desc, 'wb') as f:
+            f.write(DESCRIPTOR_SET)
+        table = ValidatorSet([
+            {'topic': 'devices/+/json', 'json_schema': {'type': 'object'}},
+            {'topic': 'devices/+/pb', 'protobuf': desc, 'message': '.iot.Telemetry', 'disconnect': True},
+            {'topic': 'devices/#', 'cddl': 'any = tstr', 'format': 'json'},
+        ])
+        self.assertIsNone(table.check('other/topic', b'\x00'))
+        self.assertIsNone(table.check('devices/1/json', b'{}'))
+        validator, reason = table.check('devices/1/json', b'[]')
+        self.assertEqual((validator.name, reason), ('json_schema of devices/+/json', '$: [] is not of type object'))
+        self.assertTrue(table.check('devices/1/pb', b'\x08')[0].disconnect)
+        self.assertIsNone(table.check('devices/1/x', b'"text"'))
+        with self.assertRaisesRegex(ValueError, 'exactly one'):
+            ValidatorSet([{'topic': 't', 'json_schema': {}, 'cddl': 'a = int'}])
+        with self.assertRaisesRegex(ValueError, 'unknown payload validator keys'):
+            ValidatorSet([{'topic': 't', 'cddl': 'a = int', 'strict': True}])
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,58 @@
+import os
+import socket
+import subprocess
+import sys
+import unittest
+
+from yourtestsrv import netutil, privbind
+
+ROOT = os.path.dirname(os.path.dirname(os.path.abspath(__file__)))
+
+
+class TestPrivbind(unittest.TestCase):
+    def test_parse_spec(self):
+        self.assertEqual(privbind.parse_spec('tcp:80'), ('tcp', '0.0.0.0', 80))
+        self.assertEqual(privbind.parse_spec('udp:[::]:53'), ('udp', '::', 53))
+        self.assertEqual(privbind.format_entry('udp', '::', 53, 4), 'udp:[::]:53=4')
+        for bad in ('sctp:80', 'tcp', 'tcp:http', 'udp:70000'):
+            with self.assertRaises(ValueError):
+                privbind.parse_spec(bad)
+
+    def test_inherited_sockets(self):
+        inherited = netutil.listen_tcp('127.0.0.1', 0)
+        self.addCleanup(inherited.close)
+        port = inherited.getsockname()[1]
+        privbind.load({privbind.ENV: f'tcp:127.0.0.1:{port}={inherited.fileno()},bogus'})
+        self.addCleanup(privbind.load, {})
+        with netutil.listen_tcp('0.0.0.0', port) as sock:
+            self.assertNotEqual(sock.fileno(), inherited.fileno())
+            self.assertEqual(sock.getsockname(), ('127.0.0.1', port))
+            with socket.create_connection(('127.0.0.1', port), timeout=2.0):
+                conn, _ = sock.accept()
+                conn.close()
+        # Taken again after closing, as a UDP listener reopening after an outage would.
+        with netutil.listen_tcp('127.0.0.1', port) as sock:
+            self.assertEqual(sock.getsockname()[1], port)
+        self.assertIsNone(privbind.take('udp', '127.0.0.1', port))
+
+    def test_guidance(self):
+        text = privbind.guidance('udp', 53)
+        for hint in ('CAP_NET_BIND_SERVICE', 'setcap', 'ip_unprivileged_port_start=53', 'privbind udp:53'):
+            self.assertIn(hint, text)
+        self.assertTrue(privbind.can_bind(0))
+        self.assertIn(53, privbind.status([53])['ports'])
+
+    @unittest.skipUnless(hasattr(os, 'geteuid'), 'POSIX only')
+    def test_helper_passes_sockets(self):
+        child = ('import os, socket; entries = os.environ["YOURTESTSRV_FDS"].split(","); '
+                 'print([socket.socket(fileno=int(e.rpartition("=")[2])).type.name for e in entries])')
+        user = ['--user', str(os.geteuid())] if os.geteuid() == 0 else []
+        result = subprocess.run([sys.executable, os.path.join(ROOT, 'yourtestsrv.py'), 'privbind', *user,
+                                 'tcp:127.0.0.1:0', 'udp:127.0.0.1:0', '--', sys.executable, '-c', child],
+                                capture_output=True, text=True, timeout=30)
+        self.assertEqual(result.returncode, 0, result.stderr)
+        self.assertEqual(result.stdout.strip(), "['SOCK_STREAM', 'SOCK_DGRAM']")
+
+
+if __name__ == '__main__':
+    unittest.main()
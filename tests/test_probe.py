@@ -0,0 +1,70 @@
+import socket
+import sys
+import threading
+import time
+import unittest
+
+from yourtestsrv import expect, netutil, stats
+from yourtestsrv.config import MQTTConfig, TCPConfig
+from yourtestsrv.mqtt_server import MQTTServer
+from yourtestsrv.tcp_server import TCPServer
+
+
+def start(srv):
+    sock = socket.create_server(('127.0.0.1', 0))
+    stop = threading.Event()
+    threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+    return stop, sock.getsockname()
+
+
+def wait_for(condition, timeout=3.0):
+    deadline = time.time() + timeout
+    while time.time() < deadline and not condition():
+        time.sleep(0.02)
+    return condition()
+
+
+class TestIdleProbing(unittest.TestCase):
+    def test_tcp_payload_probes(self):
+        srv = TCPServer(0, '127.0.0.1', framing='delim', probe_idle=0.2, probe_payload=b'?\n', probe_timeout=0.3)
+        stop, addr = start(srv)
+        self.addCleanup(stop.set)
+        with socket.create_connection(addr, timeout=2.0) as alive, socket.create_connection(addr, timeout=2.0) as dead:
+            self.assertEqual(alive.recv(16), b'?\n')
+            alive.sendall(b'here\n')
+            self.assertTrue(wait_for(lambda: srv.stats.snapshot()['probes']['zombies'] == 1))
+            probes = srv.stats.snapshot()['probes']
+            self.assertGreaterEqual(probes['answered'], 1)
+            self.assertGreaterEqual(probes['silent'], 1)
+            zombie, = [c for c in stats.connections.snapshot() if 'zombie' in c['flags']]
+            self.assertEqual(zombie['remote'], str(dead.getsockname()))
+            self.assertGreaterEqual(zombie['probe']['unanswered'], 1)
+            self.assertEqual(expect.Expectation('probes.zombies', server=srv.stats_key, max=0)
+                             .value({srv.stats_key: srv.stats.snapshot()}), 1)
+
+            # Any data later clears the flag.
+            dead.sendall(b'late\n')
+            self.assertTrue(wait_for(lambda: srv.stats.snapshot()['probes']['zombies'] == 0))
+        with self.assertRaises(ValueError):
+            TCPConfig(probe_idle='1m', probe_timeout='0s')
+
+    def test_mqtt_probe_holds_the_send_lock(self):
+        srv = MQTTServer(0, '127.0.0.1', probe_idle=0.1, probe_payload=b'\xd0\x00', probe_timeout=0.2)
+        stop, addr = start(srv)
+        self.addCleanup(stop.set)
+        with socket.create_connection(addr, timeout=2.0) as conn:
+            self.assertEqual(conn.recv(16), b'\xd0\x00')
+            self.assertTrue(wait_for(lambda: srv.stats.snapshot()['probes']['zombies'] == 1))
+        self.assertEqual(MQTTConfig(probe_idle='2m', probe_payload='\\xd0\\x00').probe_payload, b'\xd0\x00')
+
+    @unittest.skipUnless(sys.platform.startswith('linux'), 'TCP_INFO probe counts are Linux specific')
+    def test_keepalive_probe_count(self):
+        with socket.create_server(('127.0.0.1', 0)) as server:
+            with socket.create_connection(server.getsockname()) as conn:
+                netutil.set_keepalive_probes(conn, 60, 10)
+                self.assertEqual(conn.getsockopt(socket.SOL_SOCKET, socket.SO_KEEPALIVE), 1)
+                self.assertEqual(netutil.unanswered_keepalive_probes(conn), 0)
+
+
+if __name__ == '__main__':
+    unittest.main()
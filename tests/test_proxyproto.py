@@ -0,0 +1,99 @@
+import socket
+import threading
+import time
+import unittest
+
+from yourtestsrv import proxyproto, stats
+from yourtestsrv.http_server import HTTPServer
+from yourtestsrv.tcp_server import TCPServer
+
+SOURCE = ('203.0.113.7', 40001)
+DEST = ('198.51.100.1', 9000)
+
+
+def start(srv):
+    sock = socket.create_server(('127.0.0.1', 0))
+    stop = threading.Event()
+    threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+    return stop, sock.getsockname()[1]
+
+
+def rejected(conn):
+    """True once the server closes conn, with or without a reset."""
+    try:
+        return recv_all(conn) == b''
+    except ConnectionResetError:
+        return True
+
+
+def recv_all(conn):
+    data = b''
+    while True:
+        chunk = conn.recv(4096)
+        if not chunk:
+            return data
+        data += chunk
+
+
+class TestProxyParse(unittest.TestCase):
+    def test_v1(self):
+        header = proxyproto.parse_v1(proxyproto.build_v1(SOURCE, DEST)[:-2])
+        self.assertEqual((header.version, header.family, header.source, header.dest), (1, 'TCP4', SOURCE, DEST))
+        self.assertEqual(proxyproto.parse_v1(b'PROXY UNKNOWN').family, 'UNKNOWN')
+        with self.assertRaises(ValueError):
+            proxyproto.parse_v1(b'PROXY TCP4 1.2.3.4 ::1 1 2')
+
+    def test_v2(self):
+        raw = proxyproto.build_v2(('2001:db8::1', 1234), ('2001:db8::2', 443))
+        header = proxyproto.parse_v2(raw[:16], raw[16:])
+        self.assertEqual((header.version, header.family, header.source), (2, 'TCP6', ('2001:db8::1', 1234)))
+        local = proxyproto.V2_SIGNATURE + bytes([0x20, 0x00, 0, 0])
+        self.assertEqual(proxyproto.parse_v2(local, b'').command, 'LOCAL')
+
+
+class TestProxyTCP(unittest.TestCase):
+    def test_optional(self):
+        stop, port = start(TCPServer(0, '127.0.0.1', proxy_protocol='optional'))
+        try:
+            for header in (proxyproto.build_v1(SOURCE, DEST), proxyproto.build_v2(SOURCE, DEST), b''):
+                with socket.create_connection(('127.0.0.1', port), timeout=3.0) as conn:
+                    conn.sendall(header + b'hello')
+                    self.assertEqual(conn.recv(16), b'hello')
+        finally:
+            stop.set()
+
+    def test_strict_rejects_missing_header(self):
+        srv = TCPServer(0, '127.0.0.1', proxy_protocol='strict')
+        stop, port = start(srv)
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=3.0) as conn:
+                conn.sendall(b'hello')
+                self.assertTrue(rejected(conn))
+            with socket.create_connection(('127.0.0.1', port), timeout=3.0) as conn:
+                conn.sendall(proxyproto.build_v1(SOURCE, DEST) + b'hi')
+                self.assertEqual(conn.recv(16), b'hi')
+                conns = [c for c in stats.connections.snapshot() if c['server'] == srv.stats_key]
+                self.assertEqual(conns[0]['remote'], str(SOURCE))
+                self.assertEqual(conns[0]['proxy']['dest'], list(DEST))
+        finally:
+            stop.set()
+
+
+class TestProxyHTTP(unittest.TestCase):
+    def test_echoes_proxy_header(self):
+        stop, port = start(HTTPServer(0, '127.0.0.1', proxy_protocol='strict'))
+        try:
+            request = b'GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n'
+            with socket.create_connection(('127.0.0.1', port), timeout=3.0) as conn:
+                conn.sendall(proxyproto.build_v2(SOURCE, DEST) + request)
+                self.assertIn(b'Proxy: v2 203.0.113.7:40001 -> 198.51.100.1:9000', recv_all(conn))
+            with socket.create_connection(('127.0.0.1', port), timeout=3.0) as conn:
+                time.sleep(0.05)
+                conn.sendall(request)
+                self.assertTrue(rejected(conn))
+        finally:
+            stop.set()
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,95 @@
+import http.client
+import json
+import socket
+import threading
+import unittest
+
+from yourtestsrv import scenarios
+from yourtestsrv.admin_server import AdminServer
+from yourtestsrv.session import Session
+
+
+def start_admin(test):
+    admin = AdminServer(0)
+    stop = threading.Event()
+    test.addCleanup(stop.set)
+    sock = socket.create_server(('127.0.0.1', 0))
+    threading.Thread(target=admin.serve, args=(stop, sock), daemon=True).start()
+    return sock.getsockname()[1]
+
+
+def request(port, method, path, body=None):
+    conn = http.client.HTTPConnection('127.0.0.1', port, timeout=2.0)
+    try:
+        conn.request(method, path, json.dumps(body) if body is not None else None)
+        response = conn.getresponse()
+        return response.status, response.getheader('Content-Type'), response.read()
+    finally:
+        conn.close()
+
+
+class TestScenarios(unittest.TestCase):
+    def test_registry_builds(self):
+        # Every scenario's defaults give a session the servers accept.
+        for name in scenarios.NAMES:
+            with self.subTest(scenario=name):
+                info = scenarios.describe(name)
+                self.assertTrue(info['description'] and info['protocols'])
+                spec = scenarios.session_spec(name)
+                Session(spec['name'], spec['servers'], network_profile=spec.get('network_profile', ''))
+                self.assertEqual(info['example']['body']['params'],
+                                 {p: s['default'] for p, s in info['parameters'].items()})
+
+    def test_parameters(self):
+        self.assertEqual(scenarios.resolve('reset-mid-stream', {'bytes': 10})['servers'],
+                         [{'type': 'tcp', 'close_mode': 'rst', 'close_after_bytes': 10}])
+        self.assertEqual(scenarios.resolve('corrupt-bytes', {'rate': 1})['servers'][0]['corrupt_rate'], 1)
+        self.assertEqual(scenarios.session_spec('cellular-link', {'profile': 'gprs'}, 'run', '::1'),
+                         {'name': 'run', 'bind': '::1', 'network_profile': 'gprs',
+                          'servers': [{'type': 'tcp'}, {'type': 'udp'}]})
+        self.assertEqual(scenarios.protocols('cellular-link'), ['tcp', 'udp'])
+        for name, params in (('nope', {}), ('reset-mid-stream', {'size': 1}), ('reset-mid-stream', {'bytes': '1'}),
+                             ('reset-mid-stream', {'bytes': 1.5}), ('corrupt-bytes', {'rate': True})):
+            with self.assertRaises(ValueError):
+                scenarios.resolve(name, params)
+        self.assertIn('half-open', scenarios.format_table())
+
+
+class TestAdminScenarios(unittest.TestCase):
+    def test_list_describe_apply(self):
+        port = start_admin(self)
+        _, _, body = request(port, 'GET', '/scenarios')
+        self.assertEqual([s['name'] for s in json.loads(body)], list(scenarios.NAMES))
+        _, content_type, body = request(port, 'GET', '/scenarios?format=text')
+        self.assertEqual(content_type, 'text/plain')
+        self.assertIn(b'reset-mid-stream', body)
+        _, _, body = request(port, 'GET', '/scenarios/http-error')
+        self.assertEqual(json.loads(body)['session'], {'servers': [{'type': 'http', 'error_code': 503}]})
+        self.assertEqual(request(port, 'GET', '/scenarios/nope')[0], 404)
+
+        status, _, body = request(port, 'POST', '/scenarios/reset-mid-stream',
+                                  {'session': 'reset', 'params': {'bytes': 4}})
+        self.assertEqual(status, 201)
+        applied = json.loads(body)
+        self.assertEqual((applied['scenario'], applied['name']), ('reset-mid-stream', 'reset'))
+        tcp_port = int(applied['listeners'][0]['addr'].rsplit(':', 1)[1])
+        with socket.create_connection(('127.0.0.1', tcp_port), timeout=2.0) as conn:
+            conn.sendall(b'hello world')
+            received = b''
+            with self.assertRaises(ConnectionResetError):
+                while True:
+                    chunk = conn.recv(64)
+                    if not chunk:
+                        break
+                    received += chunk
+            self.assertEqual(received, b'hell')
+        _, _, body = request(port, 'GET', '/sessions')
+        self.assertEqual([s['name'] for s in json.loads(body)], ['reset'])
+
+        self.assertEqual(request(port, 'POST', '/scenarios/reset-mid-stream', {'params': {'bytes': 'x'}})[0], 400)
+        self.assertEqual(request(port, 'POST', '/scenarios/reset-mid-stream', {'session': 'reset'})[0], 400)
+        self.assertEqual(request(port, 'DELETE', '/scenarios/reset-mid-stream')[0], 405)
+
+
+if __name__ == '__main__':
+    unittest.main()
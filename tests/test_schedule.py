@@ -0,0 +1,101 @@
+import datetime
+import socket
+import threading
+import time
+import unittest
+
+from yourtestsrv.schedule import CronTrigger, Scheduler, parse_schedule
+from yourtestsrv.tcp_server import TCPServer
+from yourtestsrv.udp_server import UDPServer
+
+
+def get_free_port():
+    with socket.socket() as s:
+        s.bind(('127.0.0.1', 0))
+        return s.getsockname()[1]
+
+
+def wait_tcp(port, timeout=2.0):
+    deadline = time.time() + timeout
+    while time.time() < deadline:
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=0.1):
+                return
+        except (ConnectionRefusedError, socket.timeout, OSError):
+            time.sleep(0.05)
+    raise RuntimeError(f'server not ready on port {port}')
+
+
+class TestSchedule(unittest.TestCase):
+    def test_cron_next_after(self):
+        trigger = CronTrigger('*/15 9-17 * * 1-5')
+        friday_evening = datetime.datetime(2024, 5, 31, 17, 50).timestamp()
+        fired = datetime.datetime.fromtimestamp(trigger.next_after(friday_evening))
+        self.assertEqual(fired, datetime.datetime(2024, 6, 3, 9, 0))
+        # Leap days are more than a year apart.
+        leap_day = datetime.datetime.fromtimestamp(CronTrigger('30 6 29 2 *').next_after(friday_evening))
+        self.assertEqual(leap_day, datetime.datetime(2028, 2, 29, 6, 30))
+
+    def test_invalid_entries(self):
+        for spec in ({'every': '1s', 'action': 'nope'},
+                     {'action': 'tcp_push'},
+                     {'cron': '61 * * * *', 'action': 'tcp_push'},
+                     {'cron': '0 0 31 4,6 *', 'action': 'tcp_push'},
+                     {'every': '1s', 'action': 'mqtt_publish'}):
+            with self.assertRaises(ValueError, msg=spec):
+                parse_schedule([spec])
+
+    def test_tcp_push_and_udp_heartbeat(self):
+        tcp_port = get_free_port()
+        stop = threading.Event()
+        tcp_srv = TCPServer(tcp_port, '127.0.0.1')
+        udp_srv = UDPServer(0, '127.0.0.1')
+        threading.Thread(target=tcp_srv.listen_and_serve, args=(stop,), daemon=True).start()
+        threading.Thread(target=udp_srv.listen_and_serve, args=(stop,), daemon=True).start()
+        wait_tcp(tcp_port)
+        try:
+            with socket.create_connection(('127.0.0.1', tcp_port)) as conn, \
+                    socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as peer:
+                peer.bind(('127.0.0.1', 0))
+                time.sleep(0.1)
+                actions = parse_schedule([
+                    {'every': '100ms', 'action': 'tcp_push', 'payload': 'tick'},
+                    {'every': '100ms', 'action': 'udp_heartbeat', 'payload': 'beat',
+                     'target': f'127.0.0.1:{peer.getsockname()[1]}'},
+                ])
+                threading.Thread(target=Scheduler(actions, [tcp_srv], [udp_srv]).run,
+                                 args=(stop,), daemon=True).start()
+                conn.settimeout(2.0)
+                self.assertEqual(conn.recv(4), b'tick')
+                peer.settimeout(2.0)
+                self.assertEqual(peer.recvfrom(16)[0], b'beat')
+        finally:
+            stop.set()
+
+    def test_unreachable_trigger_drops_only_its_action(self):
+        class Exhausted:
+            def next_after(self, t):
+                raise ValueError('no future match')
+
+        tcp_port = get_free_port()
+        stop = threading.Event()
+        tcp_srv = TCPServer(tcp_port, '127.0.0.1')
+        threading.Thread(target=tcp_srv.listen_and_serve, args=(stop,), daemon=True).start()
+        wait_tcp(tcp_port)
+        try:
+            with socket.create_connection(('127.0.0.1', tcp_port)) as conn:
+                time.sleep(0.1)
+                actions = parse_schedule([{'every': '1s', 'action': 'tcp_push', 'payload': 'gone'},
+                                          {'every': '100ms', 'action': 'tcp_push', 'payload': 'tick'}])
+                actions[0].trigger = Exhausted()
+                with self.assertLogs('yourtestsrv.schedule', 'WARNING') as logs:
+                    threading.Thread(target=Scheduler(actions, [tcp_srv]).run, args=(stop,), daemon=True).start()
+                    conn.settimeout(2.0)
+                    self.assertEqual(conn.recv(4), b'tick')
+                self.assertIn('tcp_push dropped: no future match', logs.output[0])
+        finally:
+            stop.set()
+
+
+if __name__ == '__main__':
+    unittest.main()
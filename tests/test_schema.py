@@ -0,0 +1,148 @@
+import inspect
+import json
+import os
+import re
+import shutil
+import tempfile
+import unittest
+
+from yourtestsrv import config, schema
+
+ROOT = os.path.dirname(os.path.dirname(os.path.abspath(__file__)))
+
+TYPES = {'object': dict, 'array': list, 'string': str, 'boolean': bool, 'null': type(None)}
+
+
+def is_type(value, name):
+    if name == 'integer':
+        return isinstance(value, int) and not isinstance(value, bool)
+    if name == 'number':
+        return isinstance(value, (int, float)) and not isinstance(value, bool)
+    return isinstance(value, TYPES[name])
+
+
+def errors(s, value, path='$'):
+    """The keywords the schema uses, checked just far enough for these tests."""
+    found = []
+    types = s.get('type')
+    if types is not None:
+        types = [types] if isinstance(types, str) else types
+        if not any(is_type(value, t) for t in types):
+            return [f'{path}: not {types}']
+    if 'enum' in s and value not in s['enum']:
+        found.append(f'{path}: {value!r} not in {s["enum"]}')
+    if 'const' in s and value != s['const']:
+        found.append(f'{path}: not {s["const"]!r}')
+    if 'pattern' in s and isinstance(value, str) and not re.search(s['pattern'], value):
+        found.append(f'{path}: {value!r} does not match {s["pattern"]}')
+    if isinstance(value, (int, float)) and not isinstance(value, bool):
+        if value < s.get('minimum', value) or value > s.get('maximum', value):
+            found.append(f'{path}: {value} out of range')
+    if isinstance(value, dict):
+        properties = s.get('properties', {})
+        for key in s.get('required', []):
+            if key not in value:
+                found.append(f'{path}: missing {key}')
+        for key, item in value.items():
+            if key in properties:
+                found += errors(properties[key], item, f'{path}.{key}')
+            elif s.get('additionalProperties') is False:
+                found.append(f'{path}: unknown key {key}')
+            elif isinstance(s.get('additionalProperties'), dict):
+                found += errors(s['additionalProperties'], item, f'{path}.{key}')
+    if isinstance(value, list) and 'items' in s:
+        if len(value) < s.get('minItems', 0) or len(value) > s.get('maxItems', len(value)):
+            found.append(f'{path}: wrong number of items')
+        for i, item in enumerate(value):
+            found += errors(s['items'], item, f'{path}[{i}]')
+    if 'anyOf' in s and all(errors(sub, value, path) for sub in s['anyOf']):
+        found.append(f'{path}: matches none of anyOf')
+    if 'oneOf' in s and sum(not errors(sub, value, path) for sub in s['oneOf']) != 1:
+        found.append(f'{path}: does not match exactly one of oneOf')
+    return found
+
+
+FULL = {
+    '$schema': './yourtestsrv.schema.json',
+    'server': {
+        'tcp': {
+            'port': 9100, 'framing': 'delim', 'close_mode': 'rst', 'keepalive': 'off', 'rate_limit': '16kbps',
+            'rules': [{'prefix': 'PING', 'reply': 'PONG\\n'}, {'regex': '^AT', 'action': 'close', 'delay': '1s'},
+                      {'exact_hex': 'a5', 'template': [{'type': 'u8', 'value': 1}]}],
+            'fault_rules': [{'json': {'cmd': 'fw_download'}, 'delay': '3s', 'drop_rate': 0.2}],
+            'socket_options': {'rcvbuf': 4096, 'user_timeout': '10s', 'dscp': 'EF'},
+        },
+        'udp': {'response': {'endian': 'little', 'fields': [
+                    {'name': 'len', 'type': 'u16', 'length_of': ['data']},
+                    {'name': 'data', 'hex': '0a0b'},
+                    {'type': 'u16', 'checksum': 'crc16_modbus'}]},
+                'multicast': ['239.1.2.3'], 'encap_length_base': 4, 'latency': 'pareto:100ms:1.5'},
+        'http': {'latency': {'distribution': 'normal', 'mean': '200ms', 'stddev': '50ms', 'max': '1s'},
+                 'range_fault': 'ignore', 'sign': 'hmac', 'sign_key': 'k', 'lockout_code': 423,
+                 'fault_rules': [{'path': '^/firmware/', 'error_code': 503},
+                                 {'path': '^/ota/', 'integrity': 'trailer'}]},
+        'mqtt': {'publish': [{'topic': 't', 'payload': {'type': 'counter', 'format': 'text'}, 'interval': '500ms'}],
+                 'validators': [{'topic': 'devices/#', 'cddl': 'reading = {temp: float}', 'disconnect': True}]},
+        'ntrip': {'mountpoints': [{'name': 'RTCM3', 'messages': [1005], 'disconnect_after': '30s', 'auth': None}]},
+        'telnet': {'responses': {'show version': 'v1'}},
+        'tls': {'min_version': '1.2', 'alpn': ['h2'], 'acme': {'challenge': 'http-01'}},
+    },
+    'logging': {'level': 'debug', 'throttle': [{'event': 'udp.rx', 'every': 1000, 'summary': '10s'}]},
+    'schedule': [{'every': '30s', 'action': 'tcp_push', 'payload': 'hello'},
+                 {'cron': '0 * * * *', 'action': 'mqtt_publish', 'topic': 'ota',
+                  'payload': {'type': 'json', 'template': '{}'}}],
+    'bundle': {'events': ['assertion']},
+}
+
+
+class TestSchema(unittest.TestCase):
+    def setUp(self):
+        self.schema = schema.schema()
+
+    def test_examples_validate(self):
+        with open(os.path.join(ROOT, 'config.json')) as f:
+            self.assertEqual(errors(self.schema, json.load(f)), [])
+        self.assertEqual(errors(self.schema, FULL), [])
+        config.Config(**{key: value for key, value in FULL.items() if key != '$schema'})
+        json.dumps(self.schema)
+
+    def test_covers_every_setting(self):
+        server = self.schema['properties']['server']['properties']
+        servers = config.ServerConfig()
+        for name, section in server.items():
+            if section.get('type') == 'object':
+                cls = type(getattr(servers, name))
+                self.assertEqual(set(section['properties']), set(inspect.signature(cls).parameters), name)
+
+        class NewConfig:
+            def __init__(self, port=1, frames=None):
+                pass
+        with self.assertRaisesRegex(KeyError, 'NewConfig.frames has no schema'):
+            schema.from_signature(NewConfig)
+
+    def test_rejects_bad_configs(self):
+        def fails(section, settings):
+            return errors(self.schema, {'server': {section: settings}})
+        self.assertTrue(fails('tcp', {'prot': 9000}))
+        self.assertTrue(fails('tcp', {'close_mode': 'slam'}))
+        self.assertTrue(fails('tcp', {'delay': '5 seconds'}))
+        self.assertTrue(fails('tcp', {'rules': [{'prefix': 'a', 'reply': 'b', 'then': 'c'}]}))
+        self.assertTrue(fails('udp', {'response': {'fields': [{'type': 'u24'}]}}))
+        self.assertTrue(fails('mqtt', {'publish': [{'topic': 't', 'payload': {'type': 'random', 'size': 'x'}}]}))
+        self.assertTrue(fails('ntrip', {'mountpoints': [{'messages': [1005]}]}))
+        self.assertTrue(errors(self.schema, {'schedule': [{'action': 'tcp_push'}]}))
+
+    def test_config_ignores_schema_key(self):
+        with open(os.path.join(ROOT, 'config.json')) as f:
+            data = json.load(f)
+        data['$schema'] = './yourtestsrv.schema.json'
+        tmp = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, tmp)
+        path = os.path.join(tmp, 'config.json')
+        with open(path, 'w') as f:
+            json.dump(data, f)
+        self.assertEqual(config.load(path).server.tcp.port, 9000)
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,83 @@
+import socket
+import struct
+import threading
+import time
+import unittest
+
+from yourtestsrv.sequence import ClientSequence, SequenceField, SequenceTracker
+from yourtestsrv.udp_server import UDPServer
+
+
+def kinds(state, numbers):
+    return [state.record(n) for n in numbers]
+
+
+class TestSequence(unittest.TestCase):
+    def test_counting(self):
+        state = ClientSequence(32)
+        self.assertEqual(kinds(state, [1, 2, 5, 3, 3, 6, 4]),
+                         ['first', 'next', 'gap', 'reordered', 'duplicate', 'next', 'reordered'])
+        self.assertEqual(state.snapshot(), {'received': 7, 'lost': 0, 'gaps': 1, 'duplicates': 1, 'reordered': 2,
+                                            'resets': 0, 'unparsable': 0, 'last': 6})
+        self.assertEqual(kinds(state, [10, 11]), ['gap', 'next'])
+        self.assertEqual(state.counts['lost'], 3)
+        # A device restart starts counting afresh instead of a huge reorder.
+        self.assertEqual(kinds(state, [5000, 1, 2]), ['gap', 'reset', 'next'])
+        self.assertEqual(state.counts['resets'], 1)
+
+    def test_wraparound(self):
+        state = ClientSequence(16)
+        self.assertEqual(kinds(state, [65534, 65535, 0, 2, 1]), ['first', 'next', 'next', 'gap', 'reordered'])
+        self.assertEqual((state.counts['lost'], state.counts['gaps']), (0, 1))
+        narrow = ClientSequence(8)
+        self.assertEqual(narrow.window, 127)
+        self.assertEqual(kinds(narrow, [250, 255, 3]), ['first', 'gap', 'gap'])
+
+    def test_fields(self):
+        self.assertEqual(SequenceField('2:2').read(b'\xaa\xbb\x01\x02'), 0x0102)
+        self.assertEqual(SequenceField('0:4:little').read(struct.pack('<I', 70000)), 70000)
+        self.assertIsNone(SequenceField('2:4').read(b'\x00\x01'))
+        self.assertEqual(SequenceField('json:hdr.seq').read(b'{"hdr": {"seq": 42}}'), 42)
+        self.assertEqual(SequenceField('json:frames.1').read(b'{"frames": [3, 4]}'), 4)
+        self.assertIsNone(SequenceField('json:seq').read(b'{"seq": "7"}'))
+        self.assertIsNone(SequenceField('json:seq').read(b'\xff'))
+        self.assertEqual(SequenceField(r'regex:SEQ=(\d+)').read(b'T=21.5;SEQ=17'), 17)
+        self.assertIsNone(SequenceField(r'regex:SEQ=(\d+)').read(b'T=21.5'))
+        for spec in ('0:3', '-1:2', 'x:2', '0:2:middle', 'json:', 'regex:seq'):
+            with self.assertRaises(ValueError, msg=spec):
+                SequenceField(spec)
+
+    def test_tracker(self):
+        tracker = SequenceTracker(SequenceField('0:1'))
+        for client, data in (('a:1', b'\x01'), ('a:1', b'\x03'), ('b:2', b'\x07'), ('b:2', b'\x07'), ('b:2', b'')):
+            tracker.record(client, data)
+        snap = tracker.snapshot()
+        self.assertEqual((snap['received'], snap['lost'], snap['duplicates'], snap['unparsable']), (4, 1, 1, 1))
+        self.assertEqual(snap['clients']['a:1']['last'], 3)
+
+    def test_udp_server(self):
+        sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        sock.bind(('127.0.0.1', 0))
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+        srv = UDPServer(0, '127.0.0.1', sequence_field=SequenceField('0:2'))
+        threading.Thread(target=srv.serve_udp, args=(stop, sock), daemon=True).start()
+        with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as conn:
+            conn.bind(('127.0.0.1', 0))
+            conn.settimeout(2.0)
+            for seq in (1, 2, 4, 4, 3):
+                data = struct.pack('>H', seq) + b'payload'
+                conn.sendto(data, sock.getsockname())
+                self.assertEqual(conn.recvfrom(64)[0], data)
+            client = '%s:%d' % conn.getsockname()
+        deadline = time.monotonic() + 2.0
+        while srv.stats.snapshot()['sequence']['received'] < 5 and time.monotonic() < deadline:
+            time.sleep(0.01)
+        snap = srv.stats.snapshot()['sequence']
+        self.assertEqual((snap['received'], snap['lost'], snap['gaps'], snap['duplicates'], snap['reordered']),
+                         (5, 0, 1, 1, 1))
+        self.assertIn(client, snap['clients'])
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,178 @@
+import os
+import shutil
+import socket
+import struct
+import subprocess
+import tempfile
+import threading
+import unittest
+
+from yourtestsrv import sftp_server as sftp
+from yourtestsrv.sshcrypto import Ed25519Key, chacha20, poly1305, x25519
+from yourtestsrv.tcp_server import TCPServer
+
+
+class TestSSHCrypto(unittest.TestCase):
+    def test_vectors(self):
+        # RFC 7748 5.2, RFC 8032 7.1 test 1, RFC 7539 2.5.2 and the all-zero ChaCha20 block.
+        scalar = bytes.fromhex('a546e36bf0527c9d3b16154b82465edd62144c0ac1fc5a18506a2244ba449ac4')
+        u = bytes.fromhex('e6db6867583030db3594c1a424b15f7c726624ec26b3353b10a903a6d0ab1c4c')
+        self.assertEqual(x25519(scalar, u).hex(), 'c3da55379de9c6908e94ea4df28d084f32eccf03491c71f754b4075577a28552')
+        key = Ed25519Key(bytes.fromhex('9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60'))
+        self.assertEqual(key.public.hex(), 'd75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a')
+        self.assertEqual(key.sign(b'').hex(), 'e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e06522490155'
+                                              '5fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b')
+        self.assertEqual(poly1305(bytes.fromhex('85d6be7857556d337f4452fe42d506a80103808afb0db2fd4abff6af4149f51b'),
+                                  b'Cryptographic Forum Research Group').hex(), 'a8061dc1305136c6c22b8baf0c0127a9')
+        self.assertEqual(chacha20(bytes(32), bytes(8), 0, bytes(16)).hex(), '76b8e0ada0f13d90405d6ae55386bd28')
+
+
+class FakeChannel:
+    """Feeds SFTP requests to a session and collects its replies."""
+
+    def __init__(self, requests):
+        self.input = bytearray(b''.join(struct.pack('>I', len(r)) + r for r in requests))
+        self.output = b''
+
+    def read(self, n):
+        data = bytes(self.input[:n])
+        del self.input[:n]
+        return data
+
+    def read_exact(self, n):
+        data = self.read(n)
+        if len(data) < n:
+            raise EOFError('channel closed')
+        return data
+
+    def write(self, data):
+        self.output += data
+
+    def replies(self):
+        out, pos = [], 0
+        while pos < len(self.output):
+            length = struct.unpack('>I', self.output[pos:pos + 4])[0]
+            out.append(sftp.Reader(self.output[pos + 4:pos + 4 + length]))
+            pos += 4 + length
+        return out
+
+
+def request(msg, rid, *fields):
+    body = b''.join(sftp.pack_string(f) if isinstance(f, (str, bytes)) else struct.pack('>I', f) for f in fields)
+    return bytes([msg]) + struct.pack('>I', rid) + body
+
+
+class TestSFTPSession(unittest.TestCase):
+    def setUp(self):
+        self.dir = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, self.dir)
+        with open(os.path.join(self.dir, 'data.bin'), 'wb') as f:
+            f.write(bytes(range(256)) * 4)
+
+    def run_session(self, requests, **faults):
+        channel = FakeChannel(requests)
+        session = sftp.SFTPSession(channel, sftp.FileRoot(self.dir), sftp.FileFaults(**faults))
+        self.assertEqual(session.run(), 0)
+        return channel.replies()
+
+    def status(self, reply):
+        self.assertEqual(reply.byte(), sftp.FXP_STATUS)
+        reply.uint32()
+        return reply.uint32()
+
+    def data(self, reply):
+        self.assertEqual(reply.byte(), sftp.FXP_DATA)
+        reply.uint32()
+        return reply.string()
+
+    def read_request(self, rid, offset, size):
+        return request(sftp.FXP_READ, rid, b'0') + struct.pack('>QI', offset, size)
+
+    def test_files(self):
+        write = request(sftp.FXP_WRITE, 3, b'1') + struct.pack('>Q', 0) + sftp.pack_string(b'hello')
+        replies = self.run_session([
+            b'\x01' + struct.pack('>I', 3),
+            request(sftp.FXP_OPEN, 1, '/data.bin', sftp.FXF_READ, 0),
+            self.read_request(2, 1000, 100),
+            request(sftp.FXP_OPEN, 4, 'up.txt', sftp.FXF_WRITE | sftp.FXF_CREAT | sftp.FXF_TRUNC, 0),
+            write,
+            request(sftp.FXP_CLOSE, 5, b'1'),
+            request(sftp.FXP_STAT, 6, '/up.txt'),
+            request(sftp.FXP_REALPATH, 7, '../sub/..'),
+            request(sftp.FXP_OPEN, 8, '/missing', sftp.FXF_READ, 0),
+        ])
+        self.assertEqual(replies[0].byte(), sftp.FXP_VERSION)
+        self.assertEqual(replies[1].byte(), sftp.FXP_HANDLE)
+        self.assertEqual(self.data(replies[2]), bytes(range(232, 256)))
+        self.assertEqual([self.status(r) for r in replies[4:6]], [sftp.FX_OK, sftp.FX_OK])
+        attrs = replies[6]
+        self.assertEqual((attrs.byte(), attrs.uint32(), attrs.uint32(), attrs.uint64()), (sftp.FXP_ATTRS, 6, 15, 5))
+        name = replies[7]
+        self.assertEqual((name.byte(), name.uint32(), name.uint32(), name.text()), (sftp.FXP_NAME, 7, 1, '/'))
+        self.assertEqual(self.status(replies[8]), sftp.FX_NO_SUCH_FILE)
+        with open(os.path.join(self.dir, 'up.txt'), 'rb') as f:
+            self.assertEqual(f.read(), b'hello')
+
+    def test_download_fault_and_read_only(self):
+        replies = self.run_session([request(sftp.FXP_OPEN, 1, 'data.bin', sftp.FXF_READ, 0),
+                                    self.read_request(2, 0, 512), self.read_request(3, 512, 512),
+                                    request(sftp.FXP_OPEN, 4, 'new', sftp.FXF_WRITE | sftp.FXF_CREAT, 0),
+                                    request(sftp.FXP_REMOVE, 5, 'data.bin')],
+                                   fail_download_after=600, read_only=True)
+        self.assertEqual(len(self.data(replies[1])), 512)
+        self.assertEqual(len(self.data(replies[2])), 88)
+        self.assertEqual([self.status(r) for r in replies[3:]], [sftp.FX_PERMISSION_DENIED] * 2)
+        replies = self.run_session([request(sftp.FXP_OPEN, 1, 'data.bin', sftp.FXF_READ, 0),
+                                    self.read_request(2, 600, 100)], fail_download_after=600)
+        self.assertEqual(self.status(replies[1]), sftp.FX_FAILURE)
+
+    def test_stays_in_root(self):
+        os.symlink('/', os.path.join(self.dir, 'escape'))
+        replies = self.run_session([request(sftp.FXP_OPEN, 1, '/../../etc/passwd', sftp.FXF_READ, 0),
+                                    request(sftp.FXP_OPENDIR, 2, '/escape/etc')])
+        self.assertEqual([self.status(r) for r in replies], [sftp.FX_NO_SUCH_FILE, sftp.FX_PERMISSION_DENIED])
+
+
+@unittest.skipUnless(shutil.which('sftp') and shutil.which('scp'), 'OpenSSH client not installed')
+class TestOpenSSHClient(unittest.TestCase):
+    def setUp(self):
+        self.dir = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, self.dir)
+        os.mkdir(os.path.join(self.dir, 'root'))
+        self.payload = os.urandom(100000)
+        with open(os.path.join(self.dir, 'root', 'fw.bin'), 'wb') as f:
+            f.write(self.payload)
+
+    def serve(self, **faults):
+        handler = sftp.SFTPHandler(os.path.join(self.dir, 'root'), faults=sftp.FileFaults(**faults))
+        sock = socket.create_server(('127.0.0.1', 0))
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+        threading.Thread(target=TCPServer(0, '127.0.0.1', handler=handler.handle).serve, args=(stop, sock),
+                         daemon=True).start()
+        return sock.getsockname()[1]
+
+    def client(self, program, port, *args):
+        options = ['-o', 'StrictHostKeyChecking=no', '-o', 'UserKnownHostsFile=/dev/null', '-o', 'BatchMode=yes',
+                   '-o', 'LogLevel=ERROR', '-P', str(port)]
+        return subprocess.run([program, *options, *args], capture_output=True, timeout=30).returncode
+
+    def test_sftp_and_legacy_scp(self):
+        port = self.serve()
+        local = os.path.join(self.dir, 'local.bin')
+        self.assertEqual(self.client('sftp', port, 'dev@127.0.0.1:fw.bin', local), 0)
+        with open(local, 'rb') as f:
+            self.assertEqual(f.read(), self.payload)
+        self.assertEqual(self.client('scp', port, '-O', local, 'dev@127.0.0.1:up.bin'), 0)
+        with open(os.path.join(self.dir, 'root', 'up.bin'), 'rb') as f:
+            self.assertEqual(f.read(), self.payload)
+
+    def test_upload_fault(self):
+        port = self.serve(fail_upload_after=40000)
+        local = os.path.join(self.dir, 'root', 'fw.bin')
+        self.assertNotEqual(self.client('scp', port, '-O', local, 'dev@127.0.0.1:up.bin'), 0)
+        self.assertEqual(os.path.getsize(os.path.join(self.dir, 'root', 'up.bin')), 40000)
+
+
+if __name__ == '__main__':
+    unittest.main()
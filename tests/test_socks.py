@@ -0,0 +1,98 @@
+import socket
+import threading
+import time
+import unittest
+
+from yourtestsrv import socks_server as socks
+from yourtestsrv.tcp_server import TCPServer
+
+
+def start(srv):
+    sock = socket.create_server(('127.0.0.1', 0))
+    stop = threading.Event()
+    threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+    return stop, sock.getsockname()[1]
+
+
+def socks_connect(port, target, auth=None):
+    """Open a SOCKS5 CONNECT to target; returns (conn, reply code)."""
+    conn = socket.create_connection(('127.0.0.1', port), timeout=3.0)
+    conn.sendall(b'\x05\x01' + (b'\x02' if auth else b'\x00'))
+    assert conn.recv(2) == (b'\x05\x02' if auth else b'\x05\x00')
+    if auth:
+        user, password = (s.encode() for s in auth.split(':'))
+        conn.sendall(bytes([1, len(user)]) + user + bytes([len(password)]) + password)
+        if conn.recv(2) != b'\x01\x00':
+            conn.close()
+            return None, None
+    conn.sendall(b'\x05\x01\x00' + socks.encode_address(*target))
+    head = socks.recv_exact(conn, 4)
+    socks.read_address(conn, head[3])
+    return conn, head[1]
+
+
+class TestSOCKS5(unittest.TestCase):
+    def setUp(self):
+        self.echo_stop, self.echo_port = start(TCPServer(0, '127.0.0.1'))
+
+    def tearDown(self):
+        self.echo_stop.set()
+
+    def test_connect_and_relay(self):
+        stop, port = start(TCPServer(0, '127.0.0.1', handler=socks.SOCKS5Handler(delay=0.2).handle))
+        try:
+            conn, code = socks_connect(port, ('127.0.0.1', self.echo_port))
+            with conn:
+                self.assertEqual(code, socks.REP_SUCCEEDED)
+                start_time = time.time()
+                conn.sendall(b'hello')
+                self.assertEqual(conn.recv(16), b'hello')
+                # Delayed once on the way out and once on the way back.
+                self.assertGreater(time.time() - start_time, 0.35)
+            conn, code = socks_connect(port, ('localhost', self.echo_port))
+            conn.close()
+            self.assertEqual(code, socks.REP_SUCCEEDED)
+        finally:
+            stop.set()
+
+    def test_failures(self):
+        with socket.socket() as s:
+            s.bind(('127.0.0.1', 0))
+            closed_port = s.getsockname()[1]
+        handler = socks.SOCKS5Handler()
+        stop, port = start(TCPServer(0, '127.0.0.1', handler=handler.handle))
+        try:
+            conn, code = socks_connect(port, ('127.0.0.1', closed_port))
+            conn.close()
+            self.assertEqual(code, socks.REP_CONNECTION_REFUSED)
+            handler.reply_code = socks.REP_NOT_ALLOWED
+            conn, code = socks_connect(port, ('127.0.0.1', self.echo_port))
+            conn.close()
+            self.assertEqual(code, socks.REP_NOT_ALLOWED)
+            handler.reply_code, handler.drop_rate = 0, 1.0
+            conn = socket.create_connection(('127.0.0.1', port), timeout=3.0)
+            with conn:
+                conn.sendall(b'\x05\x01\x00')
+                conn.recv(2)
+                conn.sendall(b'\x05\x01\x00' + socks.encode_address('127.0.0.1', self.echo_port))
+                self.assertEqual(conn.recv(16), b'')
+        finally:
+            stop.set()
+
+    def test_auth(self):
+        stop, port = start(TCPServer(0, '127.0.0.1', handler=socks.SOCKS5Handler(auth='dev:secret').handle))
+        try:
+            conn, code = socks_connect(port, ('127.0.0.1', self.echo_port), auth='dev:secret')
+            conn.close()
+            self.assertEqual(code, socks.REP_SUCCEEDED)
+            conn, code = socks_connect(port, ('127.0.0.1', self.echo_port), auth='dev:wrong')
+            self.assertIsNone(conn)
+            with socket.create_connection(('127.0.0.1', port), timeout=3.0) as conn:
+                conn.sendall(b'\x05\x01\x00')
+                self.assertEqual(conn.recv(2), b'\x05\xff')
+        finally:
+            stop.set()
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,117 @@
+import os
+import shutil
+import socket
+import sqlite3
+import tempfile
+import threading
+import time
+import unittest
+
+from yourtestsrv import recording, stats, storage
+from yourtestsrv.http_server import HTTPServer
+from yourtestsrv.mqtt_server import load_mqtt_state
+from yourtestsrv.tcp_server import TCPServer
+
+
+class TestStores(unittest.TestCase):
+    def setUp(self):
+        self.dir = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, self.dir)
+
+    def stores(self):
+        files = storage.FileStore()
+        db = storage.open_store('sqlite', os.path.join(self.dir, 'state'))
+        for store in (files, db):
+            self.addCleanup(store.close)
+        return (('files', files, os.path.join(self.dir, 'log.jsonl'), os.path.join(self.dir, 'doc.json')),
+                ('sqlite', db, 'log.jsonl', 'doc.json'))
+
+    def test_backends(self):
+        for backend, store, log, doc in self.stores():
+            with self.subTest(backend):
+                with self.assertRaises(FileNotFoundError):
+                    store.entries(log)
+                store.append(log, {'n': 1})
+                store.append(log, {'n': 2})
+                self.assertEqual(store.entries(log), [{'n': 1}, {'n': 2}])
+                store.clear(log)
+                self.assertEqual(store.entries(log), [])
+                self.assertIsNone(store.load(doc))
+                store.save(doc, {'retained': []})
+                store.save(doc, {'retained': [{'topic': 't'}]})
+                self.assertEqual(store.load(doc), {'retained': [{'topic': 't'}]})
+        self.assertTrue(os.path.exists(os.path.join(self.dir, 'state', storage.DATABASE)))
+
+    def test_specs(self):
+        self.assertIsInstance(storage.open_store('files'), storage.FileStore)
+        path = os.path.join(self.dir, 'lab.db')
+        store = storage.open_store(f'sqlite:{path}')
+        store.save('stats.json', {'tcp:9000': {}})
+        store.close()
+        with sqlite3.connect(path) as db:
+            self.assertEqual(db.execute('SELECT name FROM documents').fetchall(), [('stats.json',)])
+        for spec in ('postgres', 'files:x', ''):
+            with self.assertRaises(ValueError, msg=spec):
+                storage.check_spec(spec)
+        with self.assertRaises(OSError):
+            storage.SQLiteStore(os.path.join(self.dir, 'missing', 'x.db'))
+
+    def test_servers_use_the_store(self):
+        store = storage.open_store(f'sqlite:{os.path.join(self.dir, "lab.db")}')
+        self.addCleanup(store.close)
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+
+        tcp_sock = socket.create_server(('127.0.0.1', 0))
+        recorder = recording.SessionRecorder('session.jsonl', store)
+        threading.Thread(target=TCPServer(0, '127.0.0.1', recorder=recorder).serve, args=(stop, tcp_sock),
+                         daemon=True).start()
+        with socket.create_connection(tcp_sock.getsockname(), timeout=2.0) as conn:
+            conn.sendall(b'ping')
+            self.assertEqual(conn.recv(16), b'ping')
+
+        http_sock = socket.create_server(('127.0.0.1', 0))
+        http = HTTPServer(0, '127.0.0.1', capture='requests.jsonl', store=store)
+        threading.Thread(target=http.serve, args=(stop, http_sock), daemon=True).start()
+        with socket.create_connection(http_sock.getsockname(), timeout=2.0) as conn:
+            conn.sendall(b'POST /api/telemetry HTTP/1.1\r\nHost: x\r\nContent-Length: 9\r\n'
+                         b'Connection: close\r\n\r\n{"t": 21}')
+            self.assertTrue(conn.recv(1024).startswith(b'HTTP/1.1 200'))
+
+        deadline = time.time() + 2.0
+        while time.time() < deadline:
+            try:
+                if store.entries('requests.jsonl') and len(recording.load('session.jsonl', store)[0]) == 2:
+                    break
+            except FileNotFoundError:
+                pass
+            time.sleep(0.01)
+        self.assertEqual(recording.load('session.jsonl', store), [[('rx', b'ping'), ('tx', b'ping')]])
+        self.assertEqual(recording.SessionReplay.from_store('session.jsonl', store).next_connection()[0], 1)
+        request, = store.entries('requests.jsonl')
+        self.assertEqual((request['method'], request['path'], request['body'], request['status']),
+                         ('POST', '/api/telemetry', '{"t": 21}', 200))
+        self.assertEqual(request['headers']['host'], 'x')
+
+        store.save('broker-state.json', {'retained': [], 'subscriptions': {}})
+        self.assertEqual(load_mqtt_state('broker-state.json', store), {'retained': [], 'subscriptions': {}})
+        with self.assertRaises(FileNotFoundError):
+            load_mqtt_state('other.json', store)
+
+        persister = stats.StatsPersister('stats.json', store=store)
+        server_stats = stats.ServerStats()
+        server_stats.record_error(stats.ERROR_RESET)
+        stats.register('storage-test:1', server_stats)
+        try:
+            persister.save()
+        finally:
+            stats.unregister('storage-test:1')
+        try:
+            self.assertGreaterEqual(persister.load(), 1)
+            self.assertEqual(stats._restored['storage-test:1']['errors']['reset'], 1)
+        finally:
+            stats._restored.clear()
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,160 @@
+import os
+import socket
+import struct
+import threading
+import unittest
+
+from yourtestsrv import stun_server as stun
+from yourtestsrv.config import UDPConfig
+from yourtestsrv.tcp_server import TCPServer
+from yourtestsrv.udp_server import UDPServer
+
+TXID = bytes(range(12))
+
+
+def binding_request(txid=TXID):
+    return struct.pack('>HHI', stun.BINDING_REQUEST, 0, stun.MAGIC_COOKIE) + txid
+
+
+def mapped_address(response):
+    msg_type, txid, attrs = stun.parse_message(response)
+    for attr_type, value in attrs:
+        if attr_type == stun.ATTR_XOR_MAPPED_ADDRESS:
+            return msg_type, stun.decode_address(value, txid)
+        if attr_type == stun.ATTR_MAPPED_ADDRESS:
+            return msg_type, stun.decode_address(value)
+    return msg_type, None
+
+
+class TestSTUNResponder(unittest.TestCase):
+    def test_normal(self):
+        response = stun.STUNResponder().respond(('10.1.2.3', 5000), binding_request())
+        msg_type, txid, attrs = stun.parse_message(response)
+        self.assertEqual(msg_type, stun.BINDING_SUCCESS)
+        self.assertEqual(txid, TXID)
+        self.assertEqual(mapped_address(response), (stun.BINDING_SUCCESS, ('10.1.2.3', 5000)))
+        self.assertEqual(attrs[-1][0], stun.ATTR_FINGERPRINT)
+
+    def test_ipv6(self):
+        response = stun.STUNResponder().respond(('2001:db8::1', 5000, 0, 0), binding_request())
+        self.assertEqual(mapped_address(response)[1], ('2001:db8::1', 5000))
+
+    def test_wrong_answer_modes(self):
+        addr = ('10.1.2.3', 5000)
+        cases = {
+            'wrong_port': ('10.1.2.3', 5001),
+            'wrong_ip': (stun.WRONG_IP, 5000),
+            'legacy': ('10.1.2.3', 5000),
+            'no_address': None,
+        }
+        for mode, expected in cases.items():
+            with self.subTest(mode=mode):
+                response = stun.STUNResponder(mode).respond(addr, binding_request())
+                self.assertEqual(mapped_address(response)[1], expected)
+        response = stun.STUNResponder('unxored').respond(addr, binding_request())
+        self.assertNotEqual(mapped_address(response)[1], addr)
+        self.assertEqual(stun.parse_message(stun.STUNResponder('error').respond(addr, binding_request()))[0],
+                         stun.BINDING_ERROR)
+        self.assertIsNone(stun.STUNResponder('silent').respond(addr, binding_request()))
+
+    def test_mapped_override(self):
+        response = stun.STUNResponder('normal', '203.0.113.7:40000').respond(('10.1.2.3', 5000), binding_request())
+        self.assertEqual(mapped_address(response)[1], ('203.0.113.7', 40000))
+
+    def test_ignores_non_stun(self):
+        responder = stun.STUNResponder()
+        self.assertIsNone(responder.respond(('10.1.2.3', 5000), b'hello'))
+        self.assertIsNone(responder.respond(('10.1.2.3', 5000), os.urandom(20)))
+
+    def test_unknown_mode(self):
+        with self.assertRaises(ValueError):
+            stun.STUNResponder('bogus')
+
+
+class TestSTUNServers(unittest.TestCase):
+    def test_udp(self):
+        sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        sock.bind(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = UDPServer(0, '127.0.0.1', handler=stun.STUNResponder().handle_udp)
+        threading.Thread(target=srv.serve_udp, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as client:
+                client.settimeout(2.0)
+                client.sendto(binding_request(), ('127.0.0.1', port))
+                data, _ = client.recvfrom(1024)
+                self.assertEqual(mapped_address(data)[1], ('127.0.0.1', client.getsockname()[1]))
+        finally:
+            stop.set()
+
+    def test_udp_dual_stack(self):
+        try:
+            sock = socket.socket(socket.AF_INET6, socket.SOCK_DGRAM)
+            sock.setsockopt(socket.IPPROTO_IPV6, socket.IPV6_V6ONLY, 0)
+            sock.bind(('::', 0))
+        except (OSError, AttributeError) as e:
+            self.skipTest(f'no dual-stack IPv6: {e}')
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = UDPServer(0, '::', handler=stun.STUNResponder().handle_udp)
+        threading.Thread(target=srv.serve_udp, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as client:
+                client.settimeout(2.0)
+                client.sendto(binding_request(), ('127.0.0.1', port))
+                data, _ = client.recvfrom(1024)
+                attrs = dict(stun.parse_message(data)[2])
+                # Family 0x01: the client's reflexive IPv4 address, not ::ffff:127.0.0.1.
+                self.assertEqual(attrs[stun.ATTR_XOR_MAPPED_ADDRESS][1], 0x01)
+                self.assertEqual(mapped_address(data)[1], ('127.0.0.1', client.getsockname()[1]))
+        finally:
+            stop.set()
+
+    def test_udp_echo_port(self):
+        cfg = UDPConfig(stun='wrong_ip', stun_mapped='203.0.113.7:40000')
+        sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        sock.bind(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        threading.Thread(target=UDPServer(0, '127.0.0.1', stun=cfg.stun).serve_udp, args=(stop, sock),
+                         daemon=True).start()
+        try:
+            with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as client:
+                client.settimeout(2.0)
+                client.sendto(binding_request(), ('127.0.0.1', port))
+                self.assertEqual(mapped_address(client.recvfrom(1024)[0]), (stun.BINDING_SUCCESS,
+                                                                            ('203.0.113.7', 40000)))
+                # Anything that is not a binding request is echoed, including other STUN messages.
+                indication = struct.pack('>HHI', 0x0011, 0, stun.MAGIC_COOKIE) + TXID
+                for payload in (b'hello', indication):
+                    client.sendto(payload, ('127.0.0.1', port))
+                    self.assertEqual(client.recvfrom(1024)[0], payload)
+        finally:
+            stop.set()
+        self.assertIsNone(UDPConfig().stun)
+        with self.assertRaises(ValueError):
+            UDPConfig(stun='bogus')
+
+    def test_tcp(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = TCPServer(0, '127.0.0.1', handler=stun.STUNResponder('wrong_port').handle_tcp)
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+                conn.sendall(binding_request() + binding_request(bytes(12)))
+                data = b''
+                while len(data) < 2 * 48:
+                    data += conn.recv(1024)
+                host, client_port = conn.getsockname()
+            first, second = data[:len(data) // 2], data[len(data) // 2:]
+            self.assertEqual(mapped_address(first)[1], (host, client_port + 1))
+            self.assertEqual(stun.parse_message(second)[1], bytes(12))
+        finally:
+            stop.set()
+
+
+if __name__ == '__main__':
+    unittest.main()
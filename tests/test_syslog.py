@@ -0,0 +1,112 @@
+import http.client
+import json
+import socket
+import threading
+import time
+import unittest
+
+from yourtestsrv import syslog_server as syslog
+from yourtestsrv.admin_server import AdminServer
+from yourtestsrv.config import SyslogConfig
+from yourtestsrv.tcp_server import TCPServer
+from yourtestsrv.udp_server import UDPServer
+
+RFC5424 = (b'<27>1 2026-01-02T03:04:05.678Z dev-1 ota 412 FAIL [meta@1 step="verify" note="a \\"b\\" \\]"][x@2] '
+           b'\xef\xbb\xbfbad image\n')
+RFC3164 = b'<13>Oct 11 22:14:15 dev-2 sshd[23]: login failed'
+
+
+class TestSyslogParse(unittest.TestCase):
+    def test_rfc5424(self):
+        fields = syslog.parse(RFC5424)
+        self.assertEqual((fields['format'], fields['facility'], fields['severity']), ('rfc5424', 'daemon', 'err'))
+        self.assertEqual((fields['timestamp'], fields['hostname'], fields['app_name'], fields['procid'],
+                          fields['msgid']), ('2026-01-02T03:04:05.678Z', 'dev-1', 'ota', '412', 'FAIL'))
+        self.assertEqual(fields['structured_data'], {'meta@1': {'step': 'verify', 'note': 'a "b" ]'}, 'x@2': {}})
+        self.assertEqual(fields['message'], 'bad image')
+        nil = syslog.parse(b'<14>1 - - - - - -')
+        self.assertEqual((nil['hostname'], nil['structured_data'], nil['message']), (None, {}, ''))
+
+    def test_rfc3164(self):
+        fields = syslog.parse(RFC3164)
+        self.assertEqual((fields['format'], fields['facility'], fields['severity']), ('rfc3164', 'user', 'notice'))
+        self.assertEqual((fields['timestamp'], fields['hostname'], fields['app_name'], fields['procid'],
+                          fields['message']), ('Oct 11 22:14:15', 'dev-2', 'sshd', '23', 'login failed'))
+        no_host = syslog.parse(b'<30>Oct  1 22:14:15 dhcpd: lease renewed')
+        self.assertEqual((no_host['hostname'], no_host['app_name'], no_host['message']),
+                         (None, 'dhcpd', 'lease renewed'))
+        for raw in (b'no pri at all', b'<999>out of range', b'<14>1 broken header'):
+            fields = syslog.parse(raw)
+            self.assertEqual(fields['format'], 'rfc3164')
+            self.assertIn(fields['message'], raw.decode())
+
+    def test_log(self):
+        log = syslog.MessageLog(limit=3)
+        for raw in (b'<11>a', b'<14>b', b'<134>c', b'<12>d'):
+            log.add(syslog.parse(raw))
+        self.assertEqual([m['message'] for m in log.query()], ['b', 'c', 'd'])
+        self.assertEqual([m['message'] for m in log.query(severity='warning')], ['d'])
+        self.assertEqual([m['message'] for m in log.query(facility='local0')], ['c'])
+        self.assertEqual([m['seq'] for m in log.query(since=3, limit=1)], [4])
+        for bad in ({'severity': 'loud'}, {'facility': 'nope'}, {'since': 'x'}):
+            with self.assertRaises(ValueError):
+                log.query(**bad)
+        self.assertEqual(log.clear(), 3)
+        self.assertEqual(log.query(), [])
+        with self.assertRaises(ValueError):
+            SyslogConfig(limit=0)
+
+
+class TestSyslogServer(unittest.TestCase):
+    def setUp(self):
+        syslog.log.clear()
+        self.addCleanup(syslog.log.clear)
+
+    def test_udp_tcp_and_admin(self):
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+        receiver = syslog.SyslogReceiver()
+        udp_sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        udp_sock.bind(('127.0.0.1', 0))
+        port = udp_sock.getsockname()[1]
+        tcp_sock = socket.create_server(('127.0.0.1', port))
+        admin_sock = socket.create_server(('127.0.0.1', 0))
+        threading.Thread(target=UDPServer(port, '127.0.0.1', handler=receiver.handle_udp).serve_udp,
+                         args=(stop, udp_sock), daemon=True).start()
+        threading.Thread(target=TCPServer(port, '127.0.0.1', handler=receiver.handle_tcp).serve,
+                         args=(stop, tcp_sock), daemon=True).start()
+        threading.Thread(target=AdminServer(0).serve, args=(stop, admin_sock), daemon=True).start()
+
+        def wait_for(count):
+            deadline = time.monotonic() + 2.0
+            while len(syslog.log.query()) < count and time.monotonic() < deadline:
+                time.sleep(0.01)
+
+        with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as client:
+            client.sendto(RFC5424, ('127.0.0.1', port))
+        wait_for(1)
+        with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+            framed = b'<13>1 - dev-3 app - - - counted\nline'
+            conn.sendall(str(len(framed)).encode() + b' ' + framed + RFC3164 + b'\n<14>last, unterminated')
+        wait_for(4)
+        messages = syslog.log.query()
+        self.assertEqual([(m['transport'], m['message']) for m in messages],
+                         [('udp', 'bad image'), ('tcp', 'counted\nline'), ('tcp', 'login failed'),
+                          ('tcp', 'last, unterminated')])
+        self.assertIn('dev-1 ota[412]: <daemon.err> bad image', syslog.format_message(messages[0]))
+
+        admin_port = admin_sock.getsockname()[1]
+        self.assertEqual([m['hostname'] for m in syslog.fetch('127.0.0.1', admin_port, {'severity': 'err'})], ['dev-1'])
+        self.assertEqual(len(syslog.fetch('127.0.0.1', admin_port, {'app': 'sshd'}, clear=True)), 1)
+        self.assertEqual(syslog.log.query(), [])
+        with self.assertRaises(ValueError):
+            syslog.fetch('127.0.0.1', admin_port, {'severity': 'loud'})
+        conn = http.client.HTTPConnection('127.0.0.1', admin_port, timeout=2.0)
+        conn.request('GET', '/syslog?colour=red')
+        response = conn.getresponse()
+        self.assertEqual((response.status, 'colour' in json.loads(response.read())['error']), (400, True))
+        conn.close()
+
+
+if __name__ == '__main__':
+    unittest.main()
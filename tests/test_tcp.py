@@ -1,3 +1,4 @@
+import os
 import socket
 import ssl
 import tempfile
@@ -5,6 +6,10 @@ import threading
 import time
 import unittest
 
+from yourtestsrv import faults, netutil, recording, stats
+from yourtestsrv.binproto import BinaryTemplate, FixedResponse
+from yourtestsrv.config import TCPConfig, parse_banner, parse_socket_options
+from yourtestsrv.shaping import parse_rate
 from yourtestsrv.tcp_server import TCPServer
 
 
@@ -76,6 +81,368 @@ class TestTCPEcho(unittest.TestCase):
         finally:
             stop.set()
 
+    def test_serve_injected_listener(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = TCPServer(0, '127.0.0.1')
+        t = threading.Thread(target=srv.serve, args=(stop, sock), daemon=True)
+        t.start()
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+                conn.sendall(b'ln')
+                self.assertEqual(conn.recv(16), b'ln')
+            self.assertEqual(srv.addr(), ('127.0.0.1', port))
+            self.assertEqual(srv.stats_key, f'tcp:{port}')
+        finally:
+            stop.set()
+
+    def test_response_template(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        template = BinaryTemplate([{'name': 'echo', 'type': 'bytes', 'from_request': [0, 1]},
+                                   {'name': 'sum', 'type': 'u8', 'checksum': 'sum8'}])
+        srv = TCPServer(0, '127.0.0.1', response=template)
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+                conn.sendall(b'\x07rest')
+                self.assertEqual(conn.recv(16), b'\x07\x07')
+        finally:
+            stop.set()
+
+    def test_unix_socket(self):
+        path = os.path.join(tempfile.mkdtemp(), 'tcp.sock')
+        stale = socket.socket(socket.AF_UNIX)
+        stale.bind(path)
+        stale.close()
+        stop = threading.Event()
+        srv = TCPServer(0, unix_socket=path)
+        t = threading.Thread(target=srv.listen_and_serve, args=(stop,), daemon=True)
+        t.start()
+        deadline = time.time() + 2.0
+        while True:
+            conn = socket.socket(socket.AF_UNIX)
+            try:
+                conn.connect(path)
+                break
+            except OSError:
+                conn.close()
+                if time.time() > deadline:
+                    raise
+                time.sleep(0.05)
+        try:
+            with conn:
+                conn.sendall(b'uds')
+                conn.settimeout(2.0)
+                self.assertEqual(conn.recv(16), b'uds')
+            self.assertEqual(srv.stats_key, f'tcp:{path}')
+        finally:
+            stop.set()
+        t.join(3.0)
+        self.assertFalse(os.path.exists(path))
+
+    def test_delimiter_framing(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = TCPServer(0, '127.0.0.1', framing='delim', delimiter=b'\r\n', max_line_length=8)
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+                conn.sendall(b'AT\r\nAT+GMR\r')
+                time.sleep(0.1)
+                conn.sendall(b'\nAT+')
+                data = b''
+                while data.count(b'\r\n') < 2:
+                    data += conn.recv(64)
+                self.assertEqual(data, b'AT\r\nAT+GMR\r\n')
+                conn.sendall(b'TOO-LONG-LINE')
+                self.assertEqual(conn.recv(64), b'')
+            self.assertEqual(srv.stats.errors.get('parse'), 1)
+        finally:
+            stop.set()
+
+    def test_traffic_totals(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        stop = threading.Event()
+        srv = TCPServer(0, '127.0.0.1', framing='delim')
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            with self.assertLogs('yourtestsrv.stats', 'INFO') as logs:
+                with socket.create_connection(sock.getsockname(), timeout=2.0) as conn:
+                    conn.sendall(b'ab\ncd\n')
+                    data = b''
+                    while len(data) < 6:
+                        data += conn.recv(16)
+                deadline = time.time() + 2.0
+                while not logs.output and time.time() < deadline:
+                    time.sleep(0.02)
+            self.assertEqual(srv.traffic_totals(), {'connections': 1, 'bytes_in': 6, 'bytes_out': 6,
+                                                    'frames_in': 2, 'frames_out': 2})
+            self.assertRegex(logs.output[0], rf'Connection summary: server=tcp:{srv.port} .* bytes_in=6 '
+                                             r'bytes_out=6 duration=[0-9.]+ frames_in=2 frames_out=2')
+        finally:
+            stop.set()
+
+    def test_lifecycle_hooks(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        stop = threading.Event()
+        events = []
+        closed = threading.Event()
+
+        def on_accept(conn, addr):
+            if events:
+                raise ValueError('one connection only')
+            events.append(('accept', addr))
+
+        def on_close(conn, addr, error):
+            events.append(('close', addr, error))
+            closed.set()
+
+        srv = TCPServer(0, '127.0.0.1', idle_timeout=0.2, on_accept=on_accept, on_close=on_close)
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.create_connection(sock.getsockname(), timeout=2.0) as conn:
+                addr = conn.getsockname()
+                conn.sendall(b'hi')
+                self.assertEqual(conn.recv(16), b'hi')
+                self.assertTrue(closed.wait(2.0))
+                self.assertEqual(conn.recv(16), b'')
+            self.assertEqual(events[0], ('accept', addr))
+            self.assertEqual(events[1][:2], ('close', addr))
+            self.assertIsInstance(events[1][2], socket.timeout)
+            closed.clear()
+            with socket.create_connection(sock.getsockname(), timeout=2.0) as conn:
+                self.assertEqual(conn.recv(16), b'')
+            self.assertTrue(closed.wait(2.0))
+            self.assertIsInstance(events[2][2], ValueError)
+        finally:
+            stop.set()
+
+    def test_canned_response_per_frame(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = TCPServer(0, '127.0.0.1', response=FixedResponse.from_hex('0600'), framing='delim')
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+                conn.sendall(b'one\ntwo\n')
+                data = b''
+                while len(data) < 4:
+                    data += conn.recv(16)
+                self.assertEqual(data, b'\x06\x00\x06\x00')
+        finally:
+            stop.set()
+
+    def test_response_config(self):
+        self.assertEqual(TCPConfig(response_hex='ff01').response.build(b'x'), b'\xff\x01')
+        with self.assertRaises(ValueError):
+            TCPConfig(response_hex='ff', response_file='reply.bin')
+
+    def test_rate_limit(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = TCPServer(0, '127.0.0.1', rate_limit=parse_rate('160kbps'))
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        payload = bytes(range(256)) * 80
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=5.0) as conn:
+                start = time.time()
+                conn.sendall(payload)
+                data = b''
+                while len(data) < len(payload):
+                    data += conn.recv(65536)
+                elapsed = time.time() - start
+            self.assertEqual(data, payload)
+            # 20480 bytes at 20000 B/s, less the initial burst.
+            self.assertGreater(elapsed, 0.8)
+        finally:
+            stop.set()
+
+    def test_trickle(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        stop = threading.Event()
+        srv = TCPServer(0, '127.0.0.1', trickle_delay=0.1, trickle_chunk=2)
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.create_connection(sock.getsockname(), timeout=2.0) as conn:
+                start = time.time()
+                conn.sendall(b'abcdef')
+                pieces = []
+                while sum(map(len, pieces)) < 6:
+                    pieces.append(conn.recv(16))
+                elapsed = time.time() - start
+            self.assertEqual(pieces, [b'ab', b'cd', b'ef'])
+            self.assertGreater(elapsed, 0.18)
+            with self.assertRaises(ValueError):
+                TCPConfig(trickle_chunk=0)
+        finally:
+            stop.set()
+
+    def test_parse_rate(self):
+        self.assertEqual(parse_rate('16kbps'), 2000)
+        self.assertEqual(parse_rate('2KB/s'), 2000)
+        self.assertEqual(parse_rate(''), 0)
+        with self.assertRaises(ValueError):
+            parse_rate('fast')
+
+    def test_corrupt_rate(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = TCPServer(0, '127.0.0.1', corrupt_rate=1.0)
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+                conn.sendall(b'\x00' * 64)
+                data = b''
+                while len(data) < 64:
+                    data += conn.recv(64)
+            self.assertTrue(all(b != 0 for b in data))
+        finally:
+            stop.set()
+        self.assertEqual(faults.corrupt(b'abc', 0.0), b'abc')
+
+    def test_socket_options(self):
+        self.assertEqual(parse_socket_options({'dscp': 'AF41'}).tos, 34 << 2)
+        self.assertEqual(parse_socket_options({'tos': '0xb8'}).tos, 0xb8)
+        self.assertFalse(parse_socket_options({}))
+        for bad in ({'dscp': 'EF', 'tos': 0}, {'dscp': 64}, {'sndbuf': -1}, {'ttl': 1}):
+            with self.assertRaises(ValueError):
+                parse_socket_options(bad)
+        seen = {}
+
+        def on_accept(conn, addr):
+            seen['tos'] = conn.getsockopt(socket.IPPROTO_IP, socket.IP_TOS)
+            seen['rcvbuf'] = conn.getsockopt(socket.SOL_SOCKET, socket.SO_RCVBUF)
+
+        sock = socket.create_server(('127.0.0.1', 0))
+        stop = threading.Event()
+        srv = TCPServer(0, '127.0.0.1', socket_options=netutil.SocketOptions(rcvbuf=4096, tos=0xb8),
+                        on_accept=on_accept)
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.create_connection(sock.getsockname(), timeout=2.0) as conn:
+                conn.sendall(b'qos')
+                self.assertEqual(conn.recv(16), b'qos')
+            self.assertEqual(seen['tos'], 0xb8)
+            self.assertLessEqual(seen['rcvbuf'], 2 * 4096)
+        finally:
+            stop.set()
+
+    def test_disconnect_rate(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        stop = threading.Event()
+        srv = TCPServer(0, '127.0.0.1', framing='delim', disconnect_rate=1.0)
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.create_connection(sock.getsockname(), timeout=2.0) as conn:
+                conn.sendall(b'partial')
+                conn.settimeout(0.2)
+                with self.assertRaises(socket.timeout):
+                    conn.recv(16)
+                conn.settimeout(2.0)
+                conn.sendall(b' line\n')
+                self.assertEqual(conn.recv(16), b'')
+            with self.assertRaises(ValueError):
+                TCPConfig(disconnect_rate=1.5)
+        finally:
+            stop.set()
+
+    def test_accept_close(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+        srv = TCPServer(0, '127.0.0.1', accept_close_rate=1.0, accept_close_bytes=8)
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        for _ in range(5):
+            with socket.create_connection(sock.getsockname(), timeout=2.0) as conn:
+                received = b''
+                while chunk := conn.recv(16):
+                    received += chunk
+                self.assertLessEqual(len(received), 8)
+        self.assertEqual(srv.stats.traffic.get('connections'), 5)
+
+        srv = TCPServer(0, '127.0.0.1', accept_close_rate=1.0, accept_close_mode='rst')
+        sock = socket.create_server(('127.0.0.1', 0))
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        # The reset may already arrive while connecting.
+        with self.assertRaises(ConnectionResetError):
+            with socket.create_connection(sock.getsockname(), timeout=2.0) as conn:
+                time.sleep(0.1)
+                conn.sendall(b'hello')
+                conn.recv(16)
+        with self.assertRaises(ValueError):
+            TCPConfig(accept_close_mode='slam')
+
+    def test_buffer_pool_and_zero_copy(self):
+        for zero_copy in (False, True):
+            sock = socket.create_server(('127.0.0.1', 0))
+            stop = threading.Event()
+            srv = TCPServer(0, '127.0.0.1', buffer_size=8, zero_copy=zero_copy)
+            threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+            try:
+                payload = bytes(range(256)) * 40
+                with socket.create_connection(sock.getsockname(), timeout=2.0) as conn:
+                    conn.sendall(payload)
+                    data = b''
+                    while len(data) < len(payload):
+                        data += conn.recv(4096)
+                    self.assertEqual(data, payload)
+                deadline = time.time() + 2.0
+                while srv.stats.traffic.snapshot().get('bytes_out', 0) < len(payload) and time.time() < deadline:
+                    time.sleep(0.01)
+                self.assertEqual(srv.stats.traffic.snapshot()['bytes_in'], len(payload))
+                if zero_copy and hasattr(os, 'splice'):
+                    self.assertEqual(srv.buffers._idle, [])
+                else:
+                    while not srv.buffers._idle and time.time() < deadline:
+                        time.sleep(0.01)
+                    self.assertEqual([len(b) for b in srv.buffers._idle], [8])
+            finally:
+                stop.set()
+
+    def test_record_and_replay(self):
+        path = os.path.join(tempfile.mkdtemp(), 'session.jsonl')
+        self.addCleanup(os.remove, path)
+        recorder = recording.SessionRecorder(path)
+
+        def start(**kwargs):
+            sock = socket.create_server(('127.0.0.1', 0))
+            stop = threading.Event()
+            self.addCleanup(stop.set)
+            srv = TCPServer(0, '127.0.0.1', **kwargs)
+            threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+            return srv, sock.getsockname()
+
+        srv, addr = start(banner=parse_banner('HELLO\\n'), recorder=recorder)
+        with socket.create_connection(addr, timeout=2.0) as conn:
+            self.assertEqual(conn.recv(16), b'HELLO\n')
+            conn.sendall(b'ping')
+            self.assertEqual(conn.recv(16), b'ping')
+        deadline = time.time() + 2.0
+        while len(recording.load(path)[0]) < 3 and time.time() < deadline:
+            time.sleep(0.01)
+        self.assertEqual(recording.load(path), [[('tx', b'HELLO\n'), ('rx', b'ping'), ('tx', b'ping')]])
+
+        srv, addr = start(replay=recording.SessionReplay.from_store(path))
+        with socket.create_connection(addr, timeout=2.0) as conn:
+            self.assertEqual(conn.recv(16), b'HELLO\n')
+            conn.sendall(b'pi')
+            time.sleep(0.05)
+            conn.sendall(b'ng')
+            self.assertEqual(conn.recv(16), b'ping')
+        with socket.create_connection(addr, timeout=2.0) as conn:
+            self.assertEqual(conn.recv(16), b'HELLO\n')
+            conn.sendall(b'pong')
+            with self.assertRaises(ConnectionResetError):
+                conn.recv(16)
+        self.assertEqual(srv.stats.errors.snapshot().get('parse'), 1)
+
     def test_delay(self):
         port = get_free_port()
         stop = threading.Event()
@@ -114,6 +481,355 @@ class TestTCPEcho(unittest.TestCase):
         finally:
             stop.set()
 
+    def test_rst_after_bytes(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = TCPServer(0, '127.0.0.1', close_mode='rst', close_after_bytes=4)
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+                conn.sendall(b'abcdef')
+                self.assertEqual(conn.recv(16), b'abcd')
+                with self.assertRaises(ConnectionResetError):
+                    conn.recv(16)
+        finally:
+            stop.set()
+
+    def test_upstream_forward(self):
+        up_sock = socket.create_server(('127.0.0.1', 0))
+        up_port = up_sock.getsockname()[1]
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        upstream = TCPServer(0, '127.0.0.1', response=FixedResponse(b'backend:'))
+        proxy = TCPServer(0, '127.0.0.1', delay=0.2, close_after_bytes=12, upstream=('127.0.0.1', up_port))
+        threading.Thread(target=upstream.serve, args=(stop, up_sock), daemon=True).start()
+        threading.Thread(target=proxy.serve, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+                start = time.time()
+                conn.sendall(b'ping')
+                self.assertEqual(conn.recv(16), b'backend:')
+                self.assertGreater(time.time() - start, 0.35)
+                conn.sendall(b'ping')
+                self.assertEqual(conn.recv(16), b'back')
+                self.assertEqual(conn.recv(16), b'')
+        finally:
+            stop.set()
+
+    def test_banner(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        cfg = TCPConfig(banner='220 ${remote_host} #${counter}\\r\\n')
+        srv = TCPServer(0, '127.0.0.1', banner=cfg.banner)
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            for n in range(2):
+                with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+                    self.assertEqual(conn.recv(64), f'220 127.0.0.1 #{n}\r\n'.encode())
+                    conn.sendall(b'hi')
+                    self.assertEqual(conn.recv(64), b'hi')
+        finally:
+            stop.set()
+
+    def test_rules(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        cfg = TCPConfig(framing='delim', rules=[
+            {'exact': 'PING', 'reply': 'PONG\\n'},
+            {'regex': '^AT\\+CSQ', 'reply': 'OK\\n', 'delay': '200ms'},
+            {'prefix_hex': 'a55a', 'template': {'fields': [{'type': 'bytes', 'from_request': [2, 3]}]}},
+            {'exact': 'quiet', 'action': 'ignore'},
+            {'prefix': 'QUIT', 'action': 'rst'},
+        ])
+        srv = TCPServer(0, '127.0.0.1', framing='delim', rules=cfg.rules)
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+                conn.sendall(b'PING\n')
+                self.assertEqual(conn.recv(64), b'PONG\n')
+                start = time.time()
+                conn.sendall(b'AT+CSQ\n')
+                self.assertEqual(conn.recv(64), b'OK\n')
+                self.assertGreater(time.time() - start, 0.15)
+                conn.sendall(b'\xa5\x5aX\n')
+                self.assertEqual(conn.recv(64), b'X')
+                conn.sendall(b'quiet\nother\n')
+                self.assertEqual(conn.recv(64), b'other\n')
+                conn.sendall(b'QUIT now\n')
+                with self.assertRaises(ConnectionResetError):
+                    conn.recv(64)
+        finally:
+            stop.set()
+        with self.assertRaises(ValueError):
+            TCPConfig(rules=[{'exact': 'x', 'prefix': 'y', 'reply': 'z'}])
+        with self.assertRaises(ValueError):
+            TCPConfig(rules=[{'exact': 'x'}])
+
+    def test_upstream_config(self):
+        self.assertEqual(TCPConfig(upstream='backend:9000').upstream, ('backend', 9000))
+        self.assertEqual(TCPConfig(upstream='[::1]:9000').upstream, ('::1', 9000))
+        with self.assertRaises(ValueError):
+            TCPConfig(upstream='backend')
+
+    def test_rst_on_accept(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = TCPServer(0, '127.0.0.1', close_mode='rst')
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            # On loopback the RST can beat connect() returning, so either call may see it.
+            with self.assertRaises(ConnectionResetError):
+                with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+                    conn.recv(16)
+        finally:
+            stop.set()
+
+    def test_idle_timeout(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = TCPServer(0, '127.0.0.1', idle_timeout=0.3)
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+                conn.sendall(b'x')
+                self.assertEqual(conn.recv(16), b'x')
+                self.assertEqual(conn.recv(16), b'')
+        finally:
+            stop.set()
+
+    def test_keepalive(self):
+        self.assertIsNone(TCPConfig().keepalive)
+        self.assertEqual(TCPConfig(keepalive='off').keepalive, 0.0)
+        self.assertEqual(TCPConfig(keepalive='1m').keepalive, 60.0)
+        with self.assertRaises(ValueError):
+            TCPConfig(keepalive='soon')
+        seen = {}
+
+        def handler(conn, addr):
+            seen['on'] = bool(conn.getsockopt(socket.SOL_SOCKET, socket.SO_KEEPALIVE))
+            if hasattr(socket, 'TCP_KEEPIDLE'):
+                seen['idle'] = conn.getsockopt(socket.IPPROTO_TCP, socket.TCP_KEEPIDLE)
+                seen['interval'] = conn.getsockopt(socket.IPPROTO_TCP, socket.TCP_KEEPINTVL)
+            conn.sendall(b'ok')
+
+        for keepalive in (7.0, 0.0):
+            sock = socket.create_server(('127.0.0.1', 0))
+            stop = threading.Event()
+            srv = TCPServer(0, '127.0.0.1', handler=handler, keepalive=keepalive)
+            threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+            try:
+                with socket.create_connection(sock.getsockname(), timeout=2.0) as conn:
+                    self.assertEqual(conn.recv(16), b'ok')
+                self.assertEqual(seen['on'], bool(keepalive))
+                if keepalive and 'idle' in seen:
+                    self.assertEqual((seen['idle'], seen['interval']), (7, 7))
+            finally:
+                stop.set()
+
+    def test_max_connections(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = TCPServer(0, '127.0.0.1', max_connections=1, over_limit='banner', over_limit_banner=b'FULL\r\n')
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=2.0) as first:
+                first.sendall(b'a')
+                self.assertEqual(first.recv(16), b'a')
+                with socket.create_connection(('127.0.0.1', port), timeout=2.0) as second:
+                    self.assertEqual(second.recv(16), b'FULL\r\n')
+                    self.assertEqual(second.recv(16), b'')
+            # The slot is released once the first client has gone.
+            deadline = time.time() + 2.0
+            while srv.limit.active and time.time() < deadline:
+                time.sleep(0.02)
+            with socket.create_connection(('127.0.0.1', port), timeout=2.0) as third:
+                third.sendall(b'c')
+                self.assertEqual(third.recv(16), b'c')
+        finally:
+            stop.set()
+
+    def test_max_connections_queue(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = TCPServer(0, '127.0.0.1', max_connections=1, over_limit='queue')
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            first = socket.create_connection(('127.0.0.1', port), timeout=2.0)
+            first.sendall(b'a')
+            self.assertEqual(first.recv(16), b'a')
+            with socket.create_connection(('127.0.0.1', port), timeout=2.0) as second:
+                second.sendall(b'b')
+                second.settimeout(0.3)
+                with self.assertRaises(socket.timeout):
+                    second.recv(16)
+                first.close()
+                second.settimeout(3.0)
+                self.assertEqual(second.recv(16), b'b')
+        finally:
+            stop.set()
+
+    def test_accept_delay(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = TCPServer(0, '127.0.0.1', accept_delay=0.3)
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            start = time.time()
+            first = socket.create_connection(('127.0.0.1', port), timeout=3.0)
+            second = socket.create_connection(('127.0.0.1', port), timeout=3.0)
+            with first, second:
+                second.sendall(b'b')
+                self.assertEqual(second.recv(16), b'b')
+                # The second connection waited for the first one's accept delay too.
+                self.assertGreater(time.time() - start, 0.5)
+        finally:
+            stop.set()
+
+    def test_accept_rate(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        stop = threading.Event()
+        threading.Thread(target=TCPServer(0, '127.0.0.1', accept_rate=5).serve, args=(stop, sock),
+                         daemon=True).start()
+        try:
+            start = time.time()
+            conns = [socket.create_connection(sock.getsockname(), timeout=3.0) for _ in range(3)]
+            for conn in conns:
+                with conn:
+                    conn.sendall(b'x')
+                    self.assertEqual(conn.recv(16), b'x')
+            # Accepts are paced 200ms apart.
+            self.assertGreater(time.time() - start, 0.35)
+        finally:
+            stop.set()
+
+    def test_workers(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        stop = threading.Event()
+        srv = TCPServer(0, '127.0.0.1', workers=1)
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            first = socket.create_connection(sock.getsockname(), timeout=3.0)
+            second = socket.create_connection(sock.getsockname(), timeout=3.0)
+            with first, second:
+                first.sendall(b'a')
+                self.assertEqual(first.recv(16), b'a')
+                # The only worker is busy with the first connection.
+                second.sendall(b'b')
+                second.settimeout(0.5)
+                with self.assertRaises(socket.timeout):
+                    second.recv(16)
+                self.assertEqual(srv.workers.waiting, 1)
+                first.close()
+                second.settimeout(3.0)
+                self.assertEqual(second.recv(16), b'b')
+            with self.assertRaises(ValueError):
+                TCPConfig(workers=-1)
+        finally:
+            stop.set()
+
+    def test_stall(self):
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = TCPServer(0, '127.0.0.1', stall=True)
+        threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+                conn.setblocking(False)
+                sent = 0
+                with self.assertRaises(BlockingIOError):
+                    for _ in range(10000):
+                        sent += conn.send(b'x' * 65536)
+                self.assertGreater(sent, 0)
+        finally:
+            stop.set()
+
+    def test_serve_connection(self):
+        srv = TCPServer(0, '127.0.0.1', max_connections=1)
+        ours, theirs = socket.socketpair()
+        self.addCleanup(ours.close)
+        self.assertTrue(srv.serve_connection(theirs, ('bridge', 0)))
+        ours.settimeout(2.0)
+        ours.sendall(b'hello')
+        self.assertEqual(ours.recv(16), b'hello')
+        extra, rejected = socket.socketpair()
+        self.addCleanup(extra.close)
+        self.assertFalse(srv.serve_connection(rejected, ('bridge', 1)))
+        self.assertEqual(extra.recv(16), b'')
+
+    def test_stall_tls(self):
+        try:
+            cert_path, key_path = make_temp_cert()
+        except ImportError:
+            self.skipTest('cryptography package not available')
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = TCPServer(0, '127.0.0.1', stall=True)
+        threading.Thread(target=srv.serve_tls, args=(stop, sock, cert_path, key_path), daemon=True).start()
+
+        def open_entries():
+            return [c for c in stats.connections.list() if c.server == srv.stats_key]
+
+        try:
+            ctx = ssl.create_default_context()
+            ctx.check_hostname = False
+            ctx.verify_mode = ssl.CERT_NONE
+            with ctx.wrap_socket(socket.create_connection(('127.0.0.1', port), timeout=5.0)) as conn:
+                conn.sendall(b'hello')
+                # Still stalled after the server's first checks: no close, no echo.
+                conn.settimeout(2.5)
+                with self.assertRaises(socket.timeout):
+                    conn.recv(16)
+                self.assertEqual(len(open_entries()), 1)
+            deadline = time.time() + 3.0
+            while open_entries() and time.time() < deadline:
+                time.sleep(0.05)
+            self.assertEqual(open_entries(), [])
+        finally:
+            stop.set()
+
+    def test_bind_ipv6(self):
+        if not socket.has_ipv6:
+            self.skipTest('IPv6 not available')
+        try:
+            with socket.socket(socket.AF_INET6) as s:
+                s.bind(('::1', 0))
+                port = s.getsockname()[1]
+        except OSError:
+            self.skipTest('IPv6 loopback not available')
+        stop = threading.Event()
+        srv = TCPServer(port, '[::1]')
+        t = threading.Thread(target=srv.listen_and_serve, args=(stop,), daemon=True)
+        t.start()
+        try:
+            deadline = time.time() + 2.0
+            while True:
+                try:
+                    conn = socket.create_connection(('::1', port), timeout=0.5)
+                    break
+                except OSError:
+                    if time.time() > deadline:
+                        raise
+                    time.sleep(0.05)
+            with conn:
+                conn.sendall(b'v6')
+                conn.settimeout(2.0)
+                self.assertEqual(conn.recv(16), b'v6')
+            with self.assertRaises(OSError):
+                socket.create_connection(('127.0.0.1', port), timeout=0.5).close()
+        finally:
+            stop.set()
+
     def test_tls(self):
         try:
             cert_path, key_path = make_temp_cert()
@@ -130,6 +846,36 @@ class TestTCPEcho(unittest.TestCase):
             ctx.check_hostname = False
             ctx.verify_mode = ssl.CERT_NONE
             ctx.minimum_version = ssl.TLSVersion.TLSv1_2
+            # A client that never starts its handshake holds up no one else.
+            silent = socket.create_connection(('127.0.0.1', port))
+            self.addCleanup(silent.close)
+            with ctx.wrap_socket(socket.create_connection(('127.0.0.1', port), timeout=2.0)) as conn:
+                conn.sendall(b'hello')
+                conn.settimeout(2.0)
+                data = b''
+                while len(data) < 5:
+                    data += conn.recv(16)
+                self.assertEqual(data, b'hello')
+        finally:
+            stop.set()
+
+    def test_tls_client_cert(self):
+        try:
+            cert_path, key_path = make_temp_cert()
+        except ImportError:
+            self.skipTest('cryptography package not available')
+        # The self-signed server certificate doubles as the client CA and client certificate.
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = TCPServer(port, '127.0.0.1')
+        threading.Thread(target=srv.serve_tls, args=(stop, sock, cert_path, key_path, cert_path, True),
+                         daemon=True).start()
+        try:
+            ctx = ssl.create_default_context()
+            ctx.check_hostname = False
+            ctx.verify_mode = ssl.CERT_NONE
+            ctx.load_cert_chain(cert_path, key_path)
             with ctx.wrap_socket(socket.create_connection(('127.0.0.1', port))) as conn:
                 conn.sendall(b'hello')
                 conn.settimeout(2.0)
@@ -137,9 +883,109 @@ class TestTCPEcho(unittest.TestCase):
                 while len(data) < 5:
                     data += conn.recv(16)
                 self.assertEqual(data, b'hello')
+            anonymous = ssl.create_default_context()
+            anonymous.check_hostname = False
+            anonymous.verify_mode = ssl.CERT_NONE
+            with self.assertRaises(OSError):
+                with anonymous.wrap_socket(socket.create_connection(('127.0.0.1', port), timeout=2.0)) as conn:
+                    conn.sendall(b'hello')
+                    if not conn.recv(16):
+                        raise ConnectionResetError('closed without a client certificate')
         finally:
             stop.set()
 
+    def test_tls_version_and_cipher_pinning(self):
+        try:
+            cert_path, key_path = make_temp_cert()
+        except ImportError:
+            self.skipTest('cryptography package not available')
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = TCPServer(port, '127.0.0.1')
+        threading.Thread(target=srv.serve_tls, daemon=True,
+                         args=(stop, sock, cert_path, key_path, '', False, '', '1.2',
+                               'ECDHE-RSA-AES128-GCM-SHA256')).start()
+        try:
+            ctx = ssl.create_default_context()
+            ctx.check_hostname = False
+            ctx.verify_mode = ssl.CERT_NONE
+            with ctx.wrap_socket(socket.create_connection(('127.0.0.1', port))) as conn:
+                self.assertEqual(conn.version(), 'TLSv1.2')
+                self.assertEqual(conn.cipher()[0], 'ECDHE-RSA-AES128-GCM-SHA256')
+            ctx.minimum_version = ssl.TLSVersion.TLSv1_3
+            with self.assertRaises(ssl.SSLError):
+                ctx.wrap_socket(socket.create_connection(('127.0.0.1', port), timeout=2.0)).close()
+        finally:
+            stop.set()
+
+    def test_client_hello_alpn(self):
+        ctx = ssl.create_default_context()
+        ctx.set_alpn_protocols(['mqtt', 'x-custom'])
+        outgoing = ssl.MemoryBIO()
+        tls = ctx.wrap_bio(ssl.MemoryBIO(), outgoing, server_hostname='device.local')
+        with self.assertRaises(ssl.SSLWantReadError):
+            tls.do_handshake()
+        hello = outgoing.read()
+        self.assertEqual(netutil.client_hello_alpn(hello), ['mqtt', 'x-custom'])
+        self.assertIsNone(netutil.client_hello_alpn(hello[:40]))
+        self.assertIsNone(netutil.client_hello_alpn(b'GET / HTTP/1.1\r\n'))
+
+    def test_tls_alpn(self):
+        try:
+            cert_path, key_path = make_temp_cert()
+        except ImportError:
+            self.skipTest('cryptography package not available')
+        sock = socket.create_server(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = TCPServer(port, '127.0.0.1')
+        threading.Thread(target=srv.serve_tls, daemon=True,
+                         args=(stop, sock, cert_path, key_path, '', False, '', '', '', ['mqtt'], True)).start()
+
+        def connect(protocols):
+            ctx = ssl.create_default_context()
+            ctx.check_hostname = False
+            ctx.verify_mode = ssl.CERT_NONE
+            if protocols:
+                ctx.set_alpn_protocols(protocols)
+            return ctx.wrap_socket(socket.create_connection(('127.0.0.1', port), timeout=2.0))
+
+        try:
+            with connect(['x-other', 'mqtt']) as conn:
+                self.assertEqual(conn.selected_alpn_protocol(), 'mqtt')
+                conn.sendall(b'hi')
+                self.assertEqual(conn.recv(16), b'hi')
+            with connect(None) as conn:
+                self.assertIsNone(conn.selected_alpn_protocol())
+            with self.assertRaisesRegex(ssl.SSLError, 'no application protocol'):
+                connect(['h2']).close()
+        finally:
+            stop.set()
+
+    def test_tls_mid_stream_failure(self):
+        try:
+            cert_path, key_path = make_temp_cert()
+        except ImportError:
+            self.skipTest('cryptography package not available')
+        ctx = ssl.create_default_context()
+        ctx.check_hostname = False
+        ctx.verify_mode = ssl.CERT_NONE
+        for mode, error in (('alert', 'alert bad record mac'), ('truncate', 'EOF')):
+            sock = socket.create_server(('127.0.0.1', 0))
+            stop = threading.Event()
+            srv = TCPServer(0, '127.0.0.1', close_mode=mode, close_after_bytes=4)
+            threading.Thread(target=srv.serve_tls, args=(stop, sock, cert_path, key_path), daemon=True).start()
+            try:
+                with ctx.wrap_socket(socket.create_connection(sock.getsockname(), timeout=3.0),
+                                     suppress_ragged_eofs=False) as conn:
+                    conn.sendall(b'hello')
+                    self.assertEqual(conn.recv(16), b'hell')
+                    with self.assertRaisesRegex(ssl.SSLError, error):
+                        conn.recv(16)
+            finally:
+                stop.set()
+
 
 if __name__ == '__main__':
     unittest.main()
@@ -0,0 +1,75 @@
+import socket
+import threading
+import time
+import unittest
+
+from yourtestsrv import telnet_server as telnet
+from yourtestsrv.tcp_server import TCPServer
+from yourtestsrv.telnet_server import DO, DONT, IAC, SB, SE, WILL, WONT
+
+NAWS = 31
+TTYPE = 24
+
+
+class TestTelnet(unittest.TestCase):
+    def start(self, **kwargs):
+        sock = socket.create_server(('127.0.0.1', 0))
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+        responder = telnet.TelnetResponder(**kwargs)
+        threading.Thread(target=TCPServer(0, '127.0.0.1', handler=responder.handle).serve, args=(stop, sock),
+                         daemon=True).start()
+        conn = socket.create_connection(sock.getsockname(), timeout=2.0)
+        self.addCleanup(conn.close)
+        return conn
+
+    def read_until(self, conn, marker):
+        data = b''
+        deadline = time.time() + 2.0
+        while marker not in data and time.time() < deadline:
+            chunk = conn.recv(1024)
+            if not chunk:
+                break
+            data += chunk
+        self.assertIn(marker, data)
+        return data
+
+    def test_negotiation_and_echo(self):
+        conn = self.start(prompt='gw> ', banner='Welcome', responses={'show version': 'v1.2.3'})
+        data = self.read_until(conn, b'gw> ')
+        self.assertTrue(data.startswith(bytes([IAC, WILL, 1, IAC, WILL, 3])))
+        self.assertIn(b'Welcome\r\n', data)
+        # Agreeing to what was offered gets no answer; unknown options are refused and subnegotiation skipped.
+        conn.sendall(bytes([IAC, DO, 1, IAC, DO, 3, IAC, WILL, NAWS, IAC, DO, TTYPE,
+                            IAC, SB, NAWS, 0, 80, 0, 24, IAC, SE]))
+        conn.sendall(b'show vers')
+        conn.sendall(b'ion\r\n')
+        data = self.read_until(conn, b'gw> ')
+        self.assertEqual(data, bytes([IAC, DONT, NAWS, IAC, WONT, TTYPE]) + b'show version\r\nv1.2.3\r\ngw> ')
+        conn.sendall(b'helo\x7fp\r\x00ping\xff\xff\r\n')
+        data = self.read_until(conn, b'ping\xff\r\ngw> ')
+        self.assertEqual(data, b'helo\b \bp\r\ngw> ping\xff\r\ngw> ')
+        conn.sendall(bytes([IAC, DONT, 1]) + b'quiet\r\n')
+        data = self.read_until(conn, b'gw> ')
+        self.assertEqual(data, bytes([IAC, WONT, 1]) + b'gw> ')
+        conn.sendall(b'exit\r\n')
+        self.assertEqual(conn.recv(1024), b'')
+
+    def test_login_and_raw(self):
+        conn = self.start(username='admin', password='secret')
+        self.read_until(conn, b'login: ')
+        conn.sendall(b'admin\r\n')
+        data = self.read_until(conn, b'Password: ')
+        self.assertTrue(data.startswith(b'admin\r\n'))
+        conn.sendall(b'secret\r\n')
+        self.assertEqual(self.read_until(conn, b'$ '), b'\r\n$ ')
+
+        conn = self.start(username='admin', password='secret', negotiate=False)
+        self.assertEqual(self.read_until(conn, b'login: '), b'login: ')
+        conn.sendall(b'admin\nwrong\n')
+        self.assertEqual(self.read_until(conn, b'Login incorrect\r\n'), b'Password: \r\nLogin incorrect\r\n')
+        self.assertEqual(conn.recv(1024), b'')
+
+
+if __name__ == '__main__':
+    unittest.main()
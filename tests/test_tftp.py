@@ -0,0 +1,160 @@
+import os
+import shutil
+import socket
+import struct
+import tempfile
+import threading
+import time
+import unittest
+
+from yourtestsrv import tftp_server as tftp
+from yourtestsrv.config import TFTPConfig
+from yourtestsrv.udp_server import UDPServer
+
+
+class Client:
+    """Lock-step TFTP client retransmitting its last packet on a timeout."""
+
+    def __init__(self, port, timeout=0.1, tries=50):
+        self.server = ('127.0.0.1', port)
+        self.sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        self.sock.settimeout(timeout)
+        self.tries = tries
+        self.peer = None
+
+    def close(self):
+        self.sock.close()
+
+    def exchange(self, packet):
+        """Send packet (to the transfer's port once known) until a reply comes."""
+        for _ in range(self.tries):
+            self.sock.sendto(packet, self.peer or self.server)
+            try:
+                data, addr = self.sock.recvfrom(70000)
+            except socket.timeout:
+                continue
+            if self.peer and addr != self.peer:
+                continue
+            self.peer = addr
+            opcode = struct.unpack_from('>H', data)[0]
+            if opcode == tftp.ERROR:
+                raise OSError(struct.unpack_from('>H', data, 2)[0], data[4:-1].decode())
+            return opcode, data
+        raise TimeoutError('no reply')
+
+    def get(self, filename, mode='octet', options=None):
+        opcode, data = self.exchange(tftp.encode_request(tftp.RRQ, filename, mode, options))
+        blksize, oack = 512, {}
+        if opcode == tftp.OACK:
+            fields = data[2:].split(b'\x00')[:-1]
+            oack = {fields[i].decode(): fields[i + 1].decode() for i in range(0, len(fields), 2)}
+            blksize = int(oack.get('blksize', 512))
+            opcode, data = self.exchange(struct.pack('>HH', tftp.ACK, 0))
+        received, expected = b'', 1
+        while True:
+            number = struct.unpack_from('>H', data, 2)[0]
+            if number == expected:
+                received += data[4:]
+                expected += 1
+            ack = struct.pack('>HH', tftp.ACK, number)
+            if number == expected - 1 and len(data) - 4 < blksize:
+                self.sock.sendto(ack, self.peer)
+                return received, oack
+            opcode, data = self.exchange(ack)
+
+    def put(self, filename, content, options=None):
+        opcode, data = self.exchange(tftp.encode_request(tftp.WRQ, filename, 'octet', options))
+        blksize = int(options['blksize']) if opcode == tftp.OACK and options and 'blksize' in options else 512
+        block = 1
+        while True:
+            chunk = content[(block - 1) * blksize:block * blksize]
+            while True:
+                opcode, data = self.exchange(struct.pack('>HH', tftp.DATA, block) + chunk)
+                if opcode == tftp.ACK and struct.unpack_from('>H', data, 2)[0] == block:
+                    break
+            if len(chunk) < blksize:
+                return
+            block += 1
+
+
+class TestTFTPPackets(unittest.TestCase):
+    def test_request(self):
+        packet = tftp.encode_request(tftp.RRQ, 'fw/app.bin', 'OCTET', {'blksize': 1428, 'tsize': 0})
+        self.assertEqual(tftp.parse_request(packet), (tftp.RRQ, 'fw/app.bin', 'octet', {'blksize': '1428',
+                                                                                           'tsize': '0'}))
+        for bad in (b'\x00\x03\x00\x01', b'\x00\x01name', b'\x00\x01name\x00octet\x00blksize\x00'):
+            with self.assertRaises(ValueError):
+                tftp.parse_request(bad)
+
+    def test_netascii(self):
+        self.assertEqual(tftp.to_netascii(b'a\nb\rc'), b'a\r\nb\r\x00c')
+        self.assertEqual(tftp.from_netascii(tftp.to_netascii(b'a\nb\rc\r\n')), b'a\nb\rc\r\n')
+
+    def test_config(self):
+        cfg = TFTPConfig(delay='20ms', timeout='2s')
+        self.assertEqual((cfg.port, cfg.delay, cfg.timeout, cfg.blksize), (1069, 0.02, 2.0, 65464))
+        for bad in ({'blksize': 4}, {'drop_rate': 2}, {'retries': -1}):
+            with self.assertRaises(ValueError):
+                TFTPConfig(**bad)
+
+
+class TestTFTPServer(unittest.TestCase):
+    def start(self, **options):
+        root = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, root)
+        responder = tftp.TFTPResponder(root, timeout=0.05, retries=20, **options)
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+        sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        sock.bind(('127.0.0.1', 0))
+        threading.Thread(target=UDPServer(0, '127.0.0.1', handler=responder.handle_udp).serve_udp,
+                         args=(stop, sock), daemon=True).start()
+        self.port = sock.getsockname()[1]
+        return root, responder
+
+    def client(self):
+        client = Client(self.port)
+        self.addCleanup(client.close)
+        return client
+
+    def test_read_with_options(self):
+        root, _ = self.start(blksize=1024)
+        firmware = os.urandom(5000)
+        with open(os.path.join(root, 'fw.bin'), 'wb') as f:
+            f.write(firmware)
+        received, oack = self.client().get('/fw.bin', options={'blksize': 1428, 'tsize': 0, 'timeout': 1})
+        self.assertEqual(received, firmware)
+        self.assertEqual(oack, {'blksize': '1024', 'tsize': '5000', 'timeout': '1'})
+        with open(os.path.join(root, 'notes.txt'), 'wb') as f:
+            f.write(b'line\n' * 200)
+        self.assertEqual(self.client().get('notes.txt', 'netascii')[0], b'line\r\n' * 200)
+
+    def test_errors(self):
+        root, _ = self.start(read_only=True)
+        os.symlink(tempfile.gettempdir(), os.path.join(root, 'escape'))
+        for filename, code in (('../../missing.bin', tftp.NOT_FOUND), ('escape/x', tftp.ACCESS_VIOLATION)):
+            with self.assertRaises(OSError) as raised:
+                self.client().get(filename)
+            self.assertEqual(raised.exception.errno, code)
+        with self.assertRaises(OSError) as raised:
+            self.client().put('fw.bin', b'x')
+        self.assertEqual(raised.exception.errno, tftp.ACCESS_VIOLATION)
+
+    def test_loss_and_write(self):
+        root, responder = self.start(drop_rate=0.3)
+        firmware = os.urandom(512 * 12)
+        self.client().put('upload.bin', firmware)
+        self.assertEqual(self.client().get('upload.bin')[0], firmware)
+        self.assertGreater(responder.dropped, 0)
+        # The server counts a read once it has the final ACK, which the client sends without waiting.
+        deadline = time.monotonic() + 2.0
+        while responder.completed < 2 and time.monotonic() < deadline:
+            time.sleep(0.01)
+        self.assertEqual((responder.completed, responder.failed), (2, 0))
+        self.assertFalse(os.path.exists(os.path.join(root, 'upload.bin.part')))
+        with open(os.path.join(root, 'upload.bin'), 'rb') as f:
+            self.assertEqual(f.read(), firmware)
+
+
+if __name__ == '__main__':
+    unittest.main()
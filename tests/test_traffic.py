@@ -0,0 +1,83 @@
+import queue
+import socket
+import threading
+import time
+import unittest
+
+from yourtestsrv import traffic
+from yourtestsrv.admin_server import AdminServer
+from yourtestsrv.http_server import HTTPServer
+from yourtestsrv.mqtt_client import MQTTClient
+from yourtestsrv.mqtt_server import MQTTServer
+
+
+def serve(srv, stop):
+    sock = socket.create_server(('127.0.0.1', 0))
+    threading.Thread(target=srv.serve, args=(stop, sock), daemon=True).start()
+    return sock.getsockname()[1]
+
+
+class TestTrafficFilters(unittest.TestCase):
+    def event(self, **fields):
+        return dict({'time': 0.0, 'protocol': 'mqtt', 'server': 'mqtt:1883', 'peer': '10.0.0.5:40000',
+                     'kind': 'publish'}, **fields)
+
+    def test_matches(self):
+        sub = traffic.Subscription(protocol='mqtt', topic='devices/#')
+        self.assertTrue(sub.matches(self.event(topic='devices/a/temp')))
+        self.assertFalse(sub.matches(self.event(topic='other/a')))
+        self.assertFalse(sub.matches(self.event(kind='connect')))
+        self.assertFalse(sub.matches(self.event(protocol='tcp', topic='devices/a')))
+        sub = traffic.Subscription(path='^/api/', client='dev-1')
+        self.assertTrue(sub.matches(self.event(protocol='http', path='/api/x', client='dev-10')))
+        self.assertFalse(sub.matches(self.event(protocol='http', path='/login', client='dev-1')))
+        self.assertTrue(traffic.Subscription(client='10.0.0.5').matches(self.event()))
+        with self.assertRaises(ValueError):
+            traffic.Subscription(protocol='ftp')
+
+    def test_format_event(self):
+        line = traffic.format_event(self.event(client='dev-1', topic='devices/a', qos=1, hex=b'21.5'.hex()))
+        self.assertTrue(line.endswith('mqtt:1883 10.0.0.5:40000 client=dev-1 publish devices/a qos=1 (4 bytes): 21.5'))
+        line = traffic.format_event(self.event(protocol='http', kind='request', method='POST', path='/d',
+                                               content_type='application/cbor', hex='a1617401'))
+        self.assertTrue(line.endswith('request POST /d (4 bytes): {"t": 1}'))
+        self.assertTrue(traffic.format_event(self.event(kind='rx', hex='00ff')).endswith('rx (2 bytes): 00ff'))
+
+
+class TestTrafficTail(unittest.TestCase):
+    def test_follow_through_admin(self):
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+        admin_port = serve(AdminServer(0), stop)
+        mqtt_port = serve(MQTTServer(0, '127.0.0.1'), stop)
+        http_port = serve(HTTPServer(0, '127.0.0.1'), stop)
+        events = queue.Queue()
+
+        def tail(**filters):
+            for event in traffic.follow('127.0.0.1', admin_port, timeout=5.0, **filters):
+                events.put(event)
+
+        threading.Thread(target=tail, kwargs={'topic': 'devices/#'}, daemon=True).start()
+        deadline = time.time() + 2.0
+        while not traffic.active() and time.time() < deadline:
+            time.sleep(0.02)
+        client = MQTTClient('127.0.0.1', mqtt_port, 'dev-1')
+        client.connect()
+        client.publish('other/x', b'skip')
+        client.publish('devices/dev-1/temp', b'21.5', qos=1)
+        client.close()
+        with socket.create_connection(('127.0.0.1', http_port)) as conn:
+            conn.sendall(b'GET /devices HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n')
+            conn.recv(4096)
+        event = events.get(timeout=2.0)
+        self.assertEqual((event['protocol'], event['kind'], event['client'], event['topic'], event['qos']),
+                         ('mqtt', 'publish', 'dev-1', 'devices/dev-1/temp', 1))
+        self.assertEqual(bytes.fromhex(event['hex']), b'21.5')
+        self.assertEqual(event['server'], f'mqtt:{mqtt_port}')
+        self.assertTrue(events.empty())
+        with self.assertRaises(ValueError):
+            list(traffic.follow('127.0.0.1', admin_port, timeout=5.0, path='('))
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -1,8 +1,14 @@
 import socket
+import sys
 import threading
 import time
 import unittest
 
+from yourtestsrv import netutil
+from yourtestsrv.clock import VirtualClock
+from yourtestsrv.config import UDPConfig
+from yourtestsrv.faultrules import FaultRuleSet
+from yourtestsrv.shaping import Distribution, JitterBuffer
 from yourtestsrv.udp_server import UDPServer
 
 
@@ -36,6 +42,24 @@ class TestUDPEcho(unittest.TestCase):
         finally:
             stop.set()
 
+    def test_serve_injected_socket(self):
+        sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        sock.bind(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = UDPServer(0, '127.0.0.1')
+        t = threading.Thread(target=srv.serve_udp, args=(stop, sock), daemon=True)
+        t.start()
+        try:
+            with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as conn:
+                conn.settimeout(2.0)
+                conn.sendto(b'ping', ('127.0.0.1', port))
+                data, _ = conn.recvfrom(64)
+                self.assertEqual(data, b'ping')
+            self.assertEqual(srv.addr(), ('127.0.0.1', port))
+        finally:
+            stop.set()
+
     def test_packet_loss(self):
         port = get_free_udp_port()
         stop = threading.Event()
@@ -55,6 +79,64 @@ class TestUDPEcho(unittest.TestCase):
         finally:
             stop.set()
 
+    def test_duplicate_replies(self):
+        sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        sock.bind(('127.0.0.1', 0))
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+        srv = UDPServer(0, '127.0.0.1', duplicate_rate=1.0, duplicate_count=3, duplicate_gap=0.05)
+        threading.Thread(target=srv.serve_udp, args=(stop, sock), daemon=True).start()
+        with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as conn:
+            conn.settimeout(2.0)
+            start = time.monotonic()
+            conn.sendto(b'seq=1', sock.getsockname())
+            self.assertEqual([conn.recvfrom(64)[0] for _ in range(3)], [b'seq=1'] * 3)
+            self.assertGreaterEqual(time.monotonic() - start, 0.09)
+            conn.settimeout(0.2)
+            with self.assertRaises(socket.timeout):
+                conn.recvfrom(64)
+        with self.assertRaisesRegex(ValueError, 'duplicate_count'):
+            UDPConfig(duplicate_count=1)
+
+    def test_reorder(self):
+        sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        sock.bind(('127.0.0.1', 0))
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+        srv = UDPServer(0, '127.0.0.1', reorder=Distribution('uniform:0:200ms'))
+        threading.Thread(target=srv.serve_udp, args=(stop, sock), daemon=True).start()
+        sent = [b'%02d' % i for i in range(40)]
+        with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as conn:
+            conn.settimeout(2.0)
+            for data in sent:
+                conn.sendto(data, sock.getsockname())
+            received = [conn.recvfrom(64)[0] for _ in sent]
+        self.assertEqual(sorted(received), sent)
+        self.assertNotEqual(received, sent)
+
+    def test_reorder_distributions(self):
+        samples = [Distribution('normal:20ms:10ms').sample() for _ in range(500)]
+        self.assertTrue(all(s >= 0 for s in samples))
+        self.assertAlmostEqual(sum(samples) / len(samples), 0.02, delta=0.004)
+        self.assertTrue(all(0.01 <= Distribution('pareto:10ms:1.5').sample() for _ in range(100)))
+        self.assertTrue(all(0.0 <= Distribution('uniform:0:5ms').sample() <= 0.005 for _ in range(100)))
+        for spec in ('poisson:5ms', 'uniform:5ms', 'uniform:50ms:10ms', 'exponential:0s', 'normal:x:1ms'):
+            with self.assertRaises(ValueError, msg=spec):
+                Distribution(spec)
+
+        clock = VirtualClock()
+        buffer = JitterBuffer(clock)
+        self.addCleanup(buffer.close)
+        released = []
+        for name, delay in (('a', 0.3), ('b', 0.1), ('c', 0.2)):
+            buffer.put(delay, released.append, name)
+        clock.wait_for_sleepers(1)
+        clock.advance(0.25)
+        deadline = time.time() + 2.0
+        while len(released) < 2 and time.time() < deadline:
+            time.sleep(0.01)
+        self.assertEqual((released, len(buffer)), (['b', 'c'], 1))
+
     def test_delay(self):
         port = get_free_udp_port()
         stop = threading.Event()
@@ -73,6 +155,219 @@ class TestUDPEcho(unittest.TestCase):
         finally:
             stop.set()
 
+    def test_amplify(self):
+        port = get_free_udp_port()
+        stop = threading.Event()
+        srv = UDPServer(port, '127.0.0.1', amplify=20, amplify_cap=50)
+        t = threading.Thread(target=srv.listen_and_serve, args=(stop,), daemon=True)
+        t.start()
+        time.sleep(0.1)
+        try:
+            with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as conn:
+                conn.settimeout(2.0)
+                conn.sendto(b'abc', ('127.0.0.1', port))
+                data, _ = conn.recvfrom(4096)
+                self.assertEqual(len(data), 50)
+                self.assertEqual(data[:6], b'abcabc')
+        finally:
+            stop.set()
+
+    def test_truncate_to(self):
+        sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        sock.bind(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = UDPServer(0, '127.0.0.1', truncate_to=4, encap_header=2)
+        t = threading.Thread(target=srv.serve_udp, args=(stop, sock), daemon=True)
+        t.start()
+        try:
+            with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as conn:
+                conn.settimeout(2.0)
+                # The outer header is kept; only the payload is cut.
+                conn.sendto(b'\x01\x02abcdefgh', ('127.0.0.1', port))
+                self.assertEqual(conn.recvfrom(4096)[0], b'\x01\x02abcd')
+                conn.sendto(b'\x01\x02ab', ('127.0.0.1', port))
+                self.assertEqual(conn.recvfrom(4096)[0], b'\x01\x02ab')
+        finally:
+            stop.set()
+        with self.assertRaises(ValueError):
+            UDPConfig(truncate_to=-1)
+
+    def test_pad_to(self):
+        sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        sock.bind(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = UDPServer(0, '127.0.0.1', pad_to=4096, encap_header=2)
+        t = threading.Thread(target=srv.serve_udp, args=(stop, sock), daemon=True)
+        t.start()
+        try:
+            with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as conn:
+                conn.settimeout(2.0)
+                # The whole datagram, outer header included, is padded to pad_to; longer replies are left alone.
+                conn.sendto(b'\x01\x02abc', ('127.0.0.1', port))
+                self.assertEqual(conn.recvfrom(65536)[0], b'\x01\x02abc' + bytes(4091))
+                big = b'\x01\x02' + b'x' * 5000
+                conn.sendto(big, ('127.0.0.1', port))
+                self.assertEqual(conn.recvfrom(65536)[0], big)
+        finally:
+            stop.set()
+        for bad in (-1, 70000):
+            with self.assertRaises(ValueError):
+                UDPConfig(pad_to=bad)
+
+    def test_encapsulated_echo(self):
+        sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        sock.bind(('127.0.0.1', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        # GTP-U style: 8-byte header, length at offset 2 counting the bytes after it.
+        srv = UDPServer(0, '127.0.0.1', amplify=2, encap_header=8, encap_length_offset=2)
+        t = threading.Thread(target=srv.serve_udp, args=(stop, sock), daemon=True)
+        t.start()
+        try:
+            with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as conn:
+                conn.settimeout(2.0)
+                outer = bytes([0x30, 0xFF, 0x00, 0x03, 0x12, 0x34, 0x56, 0x78])
+                conn.sendto(outer + b'abc', ('127.0.0.1', port))
+                data, _ = conn.recvfrom(4096)
+                self.assertEqual(data, bytes([0x30, 0xFF, 0x00, 0x06, 0x12, 0x34, 0x56, 0x78]) + b'abcabc')
+                conn.sendto(b'short', ('127.0.0.1', port))
+                with self.assertRaises(socket.timeout):
+                    conn.settimeout(0.3)
+                    conn.recvfrom(4096)
+        finally:
+            stop.set()
+
+    @unittest.skipUnless(sys.platform.startswith('linux'), 'IP_RECVTTL value is Linux specific')
+    def test_fault_rules_mark_replies(self):
+        sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        sock.bind(('127.0.0.1', 0))
+        stop = threading.Event()
+        rules = FaultRuleSet([{'prefix': 'mark', 'ttl': 3, 'dscp': 'EF'}, {'prefix': 'drop', 'drop_rate': 1.0}])
+        srv = UDPServer(0, '127.0.0.1', fault_rules=rules)
+        threading.Thread(target=srv.serve_udp, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as conn:
+                conn.settimeout(2.0)
+                conn.setsockopt(socket.IPPROTO_IP, 12, 1)  # IP_RECVTTL
+                conn.setsockopt(socket.IPPROTO_IP, socket.IP_RECVTOS, 1)
+
+                def exchange(payload):
+                    conn.sendto(payload, sock.getsockname())
+                    data, ancillary, _, _ = conn.recvmsg(64, 64)
+                    marks = {kind: cdata[0] for _, kind, cdata in ancillary}
+                    return data, marks.get(socket.IP_TTL), marks.get(socket.IP_TOS)
+
+                self.assertEqual(exchange(b'mark me'), (b'mark me', 3, 0xb8))
+                _, ttl, tos = exchange(b'plain')
+                self.assertNotEqual(ttl, 3)
+                self.assertEqual(tos, 0)
+                conn.sendto(b'drop me', sock.getsockname())
+                conn.settimeout(0.3)
+                with self.assertRaises(socket.timeout):
+                    conn.recvfrom(64)
+        finally:
+            stop.set()
+
+    @unittest.skipUnless(sys.platform.startswith('linux') and socket.has_ipv6, 'needs IPv6 and IPV6_FREEBIND')
+    def test_ipv6_scenarios(self):
+        self.assertEqual(netutil.same_64('2001:db8:1:2::17', '::2'), '2001:db8:1:2::2')
+        self.assertTrue(netutil.is_link_local(('fe80::1%eth0', 5683, 0, 2)))
+        self.assertFalse(netutil.is_link_local(('fd00::1', 5683, 0, 0)))
+        self.assertFalse(netutil.is_link_local(('10.0.0.1', 5683)))
+        try:
+            sock = socket.socket(socket.AF_INET6, socket.SOCK_DGRAM)
+            sock.bind(('::', 0))
+        except OSError as e:
+            self.skipTest(f'no IPv6: {e}')
+        stop = threading.Event()
+        srv = UDPServer(0, '::', reply_from_64='::2', drop_link_local=True)
+        threading.Thread(target=srv.serve_udp, args=(stop, sock), daemon=True).start()
+        port = sock.getsockname()[1]
+        try:
+            with socket.socket(socket.AF_INET6, socket.SOCK_DGRAM) as conn:
+                conn.settimeout(2.0)
+                conn.sendto(b'v6', ('::1', port))
+                data, addr = conn.recvfrom(64)
+                self.assertEqual((data, addr[0]), (b'v6', '::2'))
+            with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as conn:
+                conn.settimeout(2.0)
+                conn.sendto(b'v4', ('127.0.0.1', port))
+                self.assertEqual(conn.recvfrom(64), (b'v4', ('127.0.0.1', port)))
+        finally:
+            stop.set()
+
+    def test_multicast(self):
+        group = '239.255.42.99'
+        sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        sock.bind(('0.0.0.0', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        srv = UDPServer(0, '0.0.0.0', multicast=[group], multicast_interface='127.0.0.1')
+        threading.Thread(target=srv.serve_udp, args=(stop, sock), daemon=True).start()
+        try:
+            with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as conn:
+                conn.settimeout(0.5)
+                conn.setsockopt(socket.IPPROTO_IP, socket.IP_MULTICAST_IF, socket.inet_aton('127.0.0.1'))
+                deadline = time.time() + 2.0
+                while True:
+                    conn.sendto(b'M-SEARCH', (group, port))
+                    try:
+                        self.assertEqual(conn.recvfrom(64)[0], b'M-SEARCH')
+                        break
+                    except socket.timeout:
+                        if time.time() > deadline:
+                            self.skipTest('no multicast on the loopback interface')
+        finally:
+            stop.set()
+        with self.assertRaises(ValueError):
+            UDPConfig(multicast=['10.0.0.1'])
+        self.assertEqual(UDPConfig(multicast='239.1.2.3, ff02::fb').multicast, ['239.1.2.3', 'ff02::fb'])
+
+    def test_broadcast_discovery(self):
+        sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        sock.bind(('0.0.0.0', 0))
+        port = sock.getsockname()[1]
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+        reply = UDPConfig(discovery_reply='{"ip": "${local}", "to": "${broadcast}"}\\n').discovery_reply
+        srv = UDPServer(0, '0.0.0.0', discovery_reply=reply)
+        threading.Thread(target=srv.serve_udp, args=(stop, sock), daemon=True).start()
+        time.sleep(0.1)
+        with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as conn:
+            conn.settimeout(2.0)
+            conn.setsockopt(socket.SOL_SOCKET, socket.SO_BROADCAST, 1)
+            conn.sendto(b'DISCOVER', ('127.255.255.255', port))
+            data, addr = conn.recvfrom(256)
+            self.assertEqual(data, b'{"ip": "127.0.0.1", "to": "127.255.255.255"}\n')
+            self.assertEqual(addr, ('127.0.0.1', port))
+            # Unicast datagrams get the usual echo.
+            conn.sendto(b'hello', ('127.0.0.1', port))
+            self.assertEqual(conn.recvfrom(64)[0], b'hello')
+        self.assertEqual(UDPConfig(discovery_reply_hex='a55a').discovery_reply, b'\xa5\x5a')
+        with self.assertRaises(ValueError):
+            UDPConfig(discovery_reply='x', discovery_reply_hex='00')
+
+    def test_outage(self):
+        port = get_free_udp_port()
+        stop = threading.Event()
+        srv = UDPServer(port, '127.0.0.1')
+        t = threading.Thread(target=srv.listen_and_serve, args=(stop,), daemon=True)
+        t.start()
+        time.sleep(0.1)
+        try:
+            srv.start_outage(2.0)
+            time.sleep(1.2)
+            with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as conn:
+                conn.connect(('127.0.0.1', port))
+                conn.settimeout(1.0)
+                conn.send(b'hello')
+                with self.assertRaises(ConnectionRefusedError):
+                    conn.recv(64)
+        finally:
+            stop.set()
+
 
 if __name__ == '__main__':
     unittest.main()
@@ -0,0 +1,79 @@
+import base64
+import os
+import socket
+import threading
+import time
+import unittest
+
+from yourtestsrv import websocket
+from yourtestsrv.tcp_server import TCPServer
+
+
+def ws_connect(port):
+    conn = socket.create_connection(('127.0.0.1', port), timeout=2.0)
+    key = base64.b64encode(os.urandom(16)).decode()
+    conn.sendall(('GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n'
+                  f'Sec-WebSocket-Key: {key}\r\nSec-WebSocket-Version: 13\r\n\r\n').encode())
+    status, headers = websocket.read_request_head(conn)
+    assert status.startswith('HTTP/1.1 101'), status
+    assert headers['sec-websocket-accept'] == websocket.accept_key(key)
+    return conn
+
+
+class TestWebSocketBridge(unittest.TestCase):
+    def start(self, target, **kwargs):
+        sock = socket.create_server(('127.0.0.1', 0))
+        stop = threading.Event()
+        self.addCleanup(stop.set)
+        bridge = websocket.WebSocketBridge(0, '127.0.0.1', target, **kwargs)
+        threading.Thread(target=bridge.serve, args=(stop, sock), daemon=True).start()
+        return sock.getsockname()[1]
+
+    def test_accept_key(self):
+        # RFC 6455 section 1.3 example
+        self.assertEqual(websocket.accept_key('dGhlIHNhbXBsZSBub25jZQ=='), 's3pPLMBiTxaQ9kYGzzhZRbK+xOo=')
+
+    def test_echo_through_tcp_scenarios(self):
+        port = self.start(TCPServer(0, '127.0.0.1', framing='delim'))
+        with ws_connect(port) as conn:
+            conn.sendall(websocket.encode_frame(websocket.OP_TEXT, b'hello\nwor', mask=os.urandom(4)))
+            conn.sendall(websocket.encode_frame(websocket.OP_BINARY, b'ld\n', mask=os.urandom(4)))
+            data = b''
+            while data != b'hello\nworld\n':
+                fin, opcode, payload = websocket.read_frame(conn)
+                self.assertEqual(opcode, websocket.OP_BINARY)
+                data += payload
+            conn.sendall(websocket.encode_frame(websocket.OP_PING, b'p', mask=os.urandom(4)))
+            self.assertEqual(websocket.read_frame(conn), (True, websocket.OP_PONG, b'p'))
+            conn.sendall(websocket.encode_frame(websocket.OP_CLOSE, b'', mask=os.urandom(4)))
+            self.assertEqual(websocket.read_frame(conn)[1], websocket.OP_CLOSE)
+
+    def test_server_close_scenario(self):
+        port = self.start(TCPServer(0, '127.0.0.1', close_after_bytes=3))
+        with ws_connect(port) as conn:
+            conn.sendall(websocket.encode_frame(websocket.OP_BINARY, b'abcdef', mask=os.urandom(4)))
+            self.assertEqual(websocket.read_frame(conn), (True, websocket.OP_BINARY, b'abc'))
+            self.assertEqual(websocket.read_frame(conn)[1], websocket.OP_CLOSE)
+
+    def test_ping_policy(self):
+        port = self.start(TCPServer(0, '127.0.0.1'), ping_interval=0.1, pong_timeout=0.3, ignore_pings=True)
+        with ws_connect(port) as conn:
+            self.assertEqual(websocket.read_frame(conn), (True, websocket.OP_PING, b'1'))
+            conn.sendall(websocket.encode_frame(websocket.OP_PONG, b'1', mask=os.urandom(4)))
+            self.assertEqual(websocket.read_frame(conn), (True, websocket.OP_PING, b'2'))
+            # Unanswered: client pings get no pong and the missing pong drops the connection.
+            conn.sendall(websocket.encode_frame(websocket.OP_PING, b'hi', mask=os.urandom(4)))
+            started = time.time()
+            with self.assertRaises((EOFError, ConnectionResetError)):
+                websocket.read_frame(conn)
+            self.assertGreater(time.time() - started, 0.2)
+
+    def test_rejects_plain_http(self):
+        port = self.start(TCPServer(0, '127.0.0.1'))
+        with socket.create_connection(('127.0.0.1', port), timeout=2.0) as conn:
+            conn.sendall(b'GET / HTTP/1.1\r\nHost: localhost\r\n\r\n')
+            self.assertTrue(conn.recv(1024).startswith(b'HTTP/1.1 400'))
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -2,17 +2,47 @@
 """yourtestsrv - Network test server for embedded devices."""
 
 import argparse
+import ipaddress
+import json
 import logging
 import os
 import signal
 import sys
 import threading
+import tracemalloc
 
+from yourtestsrv import clock
 from yourtestsrv import config as cfg_module
+from yourtestsrv import acme, bisect, endpoints, expect, http_probe, logthrottle, mqtt_conformance, netprofiles
+from yourtestsrv import loadgen, netutil, privbind, scenarios, schema, stats, storage, syslog_server, traffic
 from yourtestsrv.tcp_server import TCPServer
-from yourtestsrv.udp_server import UDPServer
+from yourtestsrv.udp_server import MAX_UDP_PAYLOAD, UDPServer
 from yourtestsrv.http_server import HTTPServer
-from yourtestsrv.mqtt_server import MQTTServer
+from yourtestsrv.mqtt_server import MQTTCluster, MQTTServer, load_mqtt_state
+from yourtestsrv.admin_server import AdminServer
+from yourtestsrv.binproto import BinaryTemplate, FixedResponse
+from yourtestsrv.bundle import EVENTS as BUNDLE_EVENTS, EventBundler
+from yourtestsrv.device_sim import DeviceSimulator
+from yourtestsrv.dump import TrafficDump
+from yourtestsrv.icmp_server import ICMPResponder
+from yourtestsrv.ntrip_server import Mountpoint, NTRIPCaster
+from yourtestsrv.paired import PairedEchoService
+from yourtestsrv.payloadschema import ValidatorSet
+from yourtestsrv.recording import SessionRecorder, SessionReplay
+from yourtestsrv.telnet_server import TelnetResponder
+from yourtestsrv.capture import load_response as load_capture_response, parse_filter as parse_capture_filter
+from yourtestsrv.faultrules import FaultRuleSet
+from yourtestsrv.rules import RuleSet
+from yourtestsrv.schedule import Scheduler
+from yourtestsrv.sequence import SequenceField
+from yourtestsrv.shaping import Distribution, Latency, parse_rate
+from yourtestsrv.sftp_server import FAIL_MODES as SFTP_FAIL_MODES, FileFaults, SFTPHandler, load_host_key
+from yourtestsrv.socks_server import SOCKS5Handler
+from yourtestsrv.websocket import WebSocketBridge
+from yourtestsrv.stun_server import MODES as STUN_MODES, STUNResponder
+from yourtestsrv.dns_server import DOH_MODES, DOT_MODES, MODES as DNS_MODES, DNSResponder, DoHHandler
+from yourtestsrv.ntp_server import NTPResponder
+from yourtestsrv.tftp_server import TFTPResponder
 
 logging.basicConfig(level=logging.INFO, format='%(asctime)s %(levelname)s %(message)s')
 logger = logging.getLogger(__name__)
@@ -23,7 +53,85 @@ VERSION = 'v1.0.0'
 def load_config(path):
     if not path or not os.path.exists(path):
         return cfg_module.default()
-    return cfg_module.load(path)
+    cfg = cfg_module.load(path)
+    logthrottle.install(cfg.log_throttle)
+    return cfg
+
+
+def use_storage(cfg):
+    """Open the store the config selects as the default for recordings, captures and state."""
+    try:
+        storage.use(storage.open_store(cfg.storage, cfg.state_dir))
+    except OSError as e:
+        sys.exit(f'storage {cfg.storage!r}: {e}')
+
+
+def load_response_template(path):
+    """Load a binary response template (see yourtestsrv/binproto.py) from a JSON file."""
+    with open(path) as f:
+        return BinaryTemplate(json.load(f))
+
+
+def add_capture_args(parser):
+    parser.add_argument('--response-capture', default=None,
+                        help='Reply with a payload taken from a pcap/pcapng file or Wireshark hex dump')
+    parser.add_argument('--capture-filter', default='',
+                        help="Which packet to take, e.g. 'proto=udp,src_port=5683' or 'packet=12'")
+    parser.add_argument('--capture-join', action='store_true',
+                        help='Concatenate all matching payloads (a reply split over TCP segments)')
+
+
+def capture_response(opts):
+    """The --response-capture reply, or None without the flag."""
+    if not opts.response_capture:
+        return None
+    return load_capture_response({'file': opts.response_capture, 'filter': parse_capture_filter(opts.capture_filter),
+                                  'join': opts.capture_join})
+
+
+def load_rules(path):
+    """Load a TCP rule table (see yourtestsrv/rules.py) from a JSON file."""
+    with open(path) as f:
+        return RuleSet(json.load(f))
+
+
+def load_fault_rules(path):
+    """Load content-keyed fault rules (see yourtestsrv/faultrules.py) from a JSON file."""
+    with open(path) as f:
+        return FaultRuleSet(json.load(f))
+
+
+def add_fault_rules_arg(parser):
+    parser.add_argument('--fault-rules', default=None,
+                        help='JSON file with delays/faults applied only to matching messages')
+
+
+def add_network_profile_arg(parser):
+    parser.add_argument('--network-profile', choices=netprofiles.NAMES, default=None,
+                        help='Emulate this radio link on TCP and UDP replies (latency, jitter, bandwidth, '
+                             'UDP loss)')
+
+
+def add_latency_arg(parser):
+    parser.add_argument('--latency', default=None, metavar='DIST',
+                        help="Draw each reply delay from a distribution, e.g. 'normal:200ms:50ms', "
+                             "'uniform:100ms:300ms', 'pareto:100ms:1.5' (see server.*.latency for bounds)")
+
+
+def latency_option(parser, opts, section):
+    """The --latency model, else the one configured for the server."""
+    if opts.latency is None:
+        return section.latency
+    try:
+        return Latency(opts.latency) if opts.latency else None
+    except ValueError as e:
+        parser.error(f'--latency: {e}')
+
+
+def apply_network_profile(opts, cfg):
+    """The --network-profile overrides the config file; explicit flags still override it."""
+    if opts.network_profile:
+        netprofiles.apply(cfg.server, opts.network_profile)
 
 
 def apply_defaults(cfg):
@@ -40,6 +148,244 @@ def apply_defaults(cfg):
         cfg.server.mqtt.tls_port = cfg.server.mqtt.port + 10000
 
 
+def build_tcp_server(cfg, port, dump=None, recorder=None, replay=None):
+    tcp = cfg.server.tcp
+    return TCPServer(port, cfg.server.bind, tcp.delay, tcp.close_after, response=tcp.response,
+                     framing=tcp.framing, delimiter=tcp.delimiter, max_line_length=tcp.max_line_length,
+                     rate_limit=tcp.rate_limit, corrupt_rate=tcp.corrupt_rate, close_mode=tcp.close_mode,
+                     close_after_bytes=tcp.close_after_bytes, stall=tcp.stall, idle_timeout=tcp.idle_timeout,
+                     max_connections=tcp.max_connections, over_limit=tcp.over_limit,
+                     over_limit_banner=tcp.over_limit_banner, accept_delay=tcp.accept_delay,
+                     handshake_rate=tcp.handshake_rate, accept_rate=tcp.accept_rate, workers=tcp.workers,
+                     proxy_protocol=tcp.proxy_protocol,
+                     upstream=tcp.upstream, banner=tcp.banner, dump=dump, rules=tcp.rules,
+                     fault_rules=tcp.fault_rules, keepalive=tcp.keepalive, trickle_delay=tcp.trickle_delay,
+                     trickle_chunk=tcp.trickle_chunk, disconnect_rate=tcp.disconnect_rate,
+                     socket_options=tcp.socket_options, buffer_size=tcp.buffer_size, zero_copy=tcp.zero_copy,
+                     drop_link_local=tcp.drop_link_local, recorder=recorder, replay=replay, jitter=tcp.jitter,
+                     latency=tcp.latency, accept_close_rate=tcp.accept_close_rate,
+                     accept_close_bytes=tcp.accept_close_bytes, accept_close_mode=tcp.accept_close_mode,
+                     probe_idle=tcp.probe_idle, probe_payload=tcp.probe_payload, probe_timeout=tcp.probe_timeout)
+
+
+def build_udp_server(cfg, dump=None):
+    udp = cfg.server.udp
+    return UDPServer(udp.port, cfg.server.bind, udp.drop_rate, udp.delay,
+                     amplify=udp.amplify, amplify_cap=udp.amplify_cap,
+                     outage_every=udp.outage_every, outage_duration=udp.outage_duration,
+                     response=udp.response, encap_header=udp.encap_header,
+                     encap_length_offset=udp.encap_length_offset, encap_length_base=udp.encap_length_base,
+                     dump=dump, socket_options=udp.socket_options, fault_rules=udp.fault_rules,
+                     reply_from_64=udp.reply_from_64, drop_link_local=udp.drop_link_local, multicast=udp.multicast,
+                     multicast_interface=udp.multicast_interface, jitter=udp.jitter, rate_limit=udp.rate_limit,
+                     discovery_reply=udp.discovery_reply, duplicate_rate=udp.duplicate_rate,
+                     duplicate_count=udp.duplicate_count, duplicate_gap=udp.duplicate_gap, reorder=udp.reorder,
+                     reorder_rate=udp.reorder_rate, sequence_field=udp.sequence_field, latency=udp.latency,
+                     truncate_to=udp.truncate_to, pad_to=udp.pad_to, stun=udp.stun)
+
+
+def build_http_server(cfg, port):
+    http = cfg.server.http
+    return HTTPServer(port, cfg.server.bind, http.slow_response, http.slow_duration,
+                      http.error_code, http.chunked, date_offset=http.date_offset,
+                      break_keepalive=http.break_keepalive, strict=http.strict, range_fault=http.range_fault,
+                      accept_delay=http.accept_delay, handshake_rate=http.handshake_rate, accept_rate=http.accept_rate,
+                      workers=http.workers,
+                      proxy_protocol=http.proxy_protocol, auth=http.auth, lockout_after=http.lockout_after,
+                      lockout_duration=http.lockout_duration, lockout_code=http.lockout_code,
+                      sign=http.sign, sign_key=http.sign_key, sign_header=http.sign_header,
+                      sign_fault=http.sign_fault, fault_rules=http.fault_rules, session_ttl=http.session_ttl,
+                      session_sliding=http.session_sliding, session_login_path=http.session_login_path,
+                      session_protect=http.session_protect, socket_options=http.socket_options,
+                      capture=http.capture, latency=http.latency, upstream=http.upstream, cache_ttl=http.cache_ttl,
+                      cache_fault=http.cache_fault)
+
+
+def build_mqtt_server(cfg, port, cluster=None):
+    mqtt = cfg.server.mqtt
+    srv = MQTTServer(port, cfg.server.bind, mqtt.retain, publish=mqtt.publish, idle_timeout=mqtt.idle_timeout,
+                     max_connections=mqtt.max_connections, over_limit=mqtt.over_limit,
+                     over_limit_banner=mqtt.over_limit_banner, accept_delay=mqtt.accept_delay,
+                     handshake_rate=mqtt.handshake_rate, accept_rate=mqtt.accept_rate, workers=mqtt.workers,
+                     fault_rules=mqtt.fault_rules, redirect=mqtt.redirect,
+                     redirect_code=mqtt.redirect_code, cluster=cluster, socket_options=mqtt.socket_options,
+                     validators=mqtt.validators, probe_idle=mqtt.probe_idle, probe_payload=mqtt.probe_payload,
+                     probe_timeout=mqtt.probe_timeout)
+    if mqtt.preload:
+        srv.load_state(load_mqtt_state(mqtt.preload))
+    return srv
+
+
+def add_connection_limit_args(parser):
+    parser.add_argument('--max-connections', type=int, default=None,
+                        help='Concurrent connection limit (0 = unlimited)')
+    parser.add_argument('--over-limit', choices=netutil.OVER_LIMIT_MODES, default=None,
+                        help='When full: close new connections, leave them in the backlog, or send a banner first')
+    parser.add_argument('--over-limit-banner', default=None, help='Banner for --over-limit banner (escapes allowed)')
+
+
+def connection_limit_options(opts, server_cfg):
+    """Return (max_connections, over_limit, over_limit_banner) from flags, falling back to config."""
+    max_connections = opts.max_connections if opts.max_connections is not None else server_cfg.max_connections
+    over_limit = opts.over_limit or server_cfg.over_limit
+    banner = (cfg_module.parse_escaped(opts.over_limit_banner) if opts.over_limit_banner is not None
+              else server_cfg.over_limit_banner)
+    return max_connections, over_limit, banner
+
+
+def add_pacing_args(parser):
+    parser.add_argument('--accept-delay', default=None,
+                        help='Pause the accept loop this long after each accept (overloaded accept queue)')
+    parser.add_argument('--handshake-rate', type=float, default=None, help='Maximum TLS handshakes per second')
+    parser.add_argument('--accept-rate', type=float, default=None,
+                        help='Maximum connections accepted per second; the rest wait in the listen backlog')
+    parser.add_argument('--workers', type=int, default=None,
+                        help='Serve connections on at most this many threads; others are accepted but wait unread')
+
+
+def pacing_options(opts, server_cfg):
+    """Return (accept_delay, handshake_rate, accept_rate, workers) from flags, falling back to config."""
+    accept_delay = (cfg_module.parse_duration(opts.accept_delay) if opts.accept_delay is not None
+                    else server_cfg.accept_delay)
+    handshake_rate = opts.handshake_rate if opts.handshake_rate is not None else server_cfg.handshake_rate
+    accept_rate = opts.accept_rate if opts.accept_rate is not None else server_cfg.accept_rate
+    workers = opts.workers if opts.workers is not None else server_cfg.workers
+    return (accept_delay, handshake_rate) + cfg_module.parse_accept_pool(accept_rate, workers)
+
+
+def add_probe_args(parser):
+    parser.add_argument('--probe-idle', default=None,
+                        help="Probe connections silent this long and report those not answering, e.g. '5m'")
+    parser.add_argument('--probe-payload', default=None,
+                        help="Probe with these bytes (escapes allowed, e.g. '\\r\\n'); default: TCP keepalive probes")
+    parser.add_argument('--probe-timeout', default=None, help='How long a probe may go unanswered (default 10s)')
+
+
+def probe_options(parser, opts, server_cfg):
+    """Return the probe_idle, probe_payload and probe_timeout server arguments from flags, falling back to config."""
+    idle = cfg_module.parse_duration(opts.probe_idle) if opts.probe_idle is not None else server_cfg.probe_idle
+    payload = (cfg_module.parse_escaped(opts.probe_payload) if opts.probe_payload is not None
+               else server_cfg.probe_payload)
+    timeout = (cfg_module.parse_duration(opts.probe_timeout) if opts.probe_timeout is not None
+               else server_cfg.probe_timeout)
+    if idle and timeout <= 0:
+        parser.error('--probe-timeout must be positive')
+    return {'probe_idle': idle, 'probe_payload': payload, 'probe_timeout': timeout}
+
+
+def add_socket_option_args(parser):
+    parser.add_argument('--rcvbuf', type=int, default=None, help='SO_RCVBUF size in bytes (default: OS)')
+    parser.add_argument('--sndbuf', type=int, default=None, help='SO_SNDBUF size in bytes (default: OS)')
+    parser.add_argument('--user-timeout', default=None,
+                        help="TCP_USER_TIMEOUT: drop connections with data unacknowledged this long, e.g. '10s'")
+    parser.add_argument('--dscp', default=None, help="Mark sent packets with this DSCP value or class, e.g. 46 or 'EF'")
+
+
+def socket_options(opts, server_cfg):
+    """Return SocketOptions from flags, each falling back to config."""
+    base = server_cfg.socket_options
+    return netutil.SocketOptions(
+        opts.rcvbuf if opts.rcvbuf is not None else base.rcvbuf,
+        opts.sndbuf if opts.sndbuf is not None else base.sndbuf,
+        cfg_module.parse_duration(opts.user_timeout) if opts.user_timeout is not None else base.user_timeout,
+        cfg_module.parse_dscp(opts.dscp) << 2 if opts.dscp is not None else base.tos)
+
+
+def add_proxy_protocol_arg(parser):
+    parser.add_argument('--proxy-protocol', choices=('optional', 'strict'), default=None,
+                        help='Accept HAProxy PROXY v1/v2 headers; strict rejects connections without one')
+
+
+def add_tls_args(parser):
+    parser.add_argument('--client-ca', default=None,
+                        help='Verify client certificates against this CA bundle (mutual TLS)')
+    parser.add_argument('--require-client-cert', action='store_true', default=None,
+                        help='Fail TLS handshakes without a valid client certificate (needs --client-ca)')
+    parser.add_argument('--tls-min-version', choices=('1.0', '1.1', '1.2', '1.3'), default=None,
+                        help='Oldest TLS version accepted (default 1.2; 1.0/1.1 for legacy devices)')
+    parser.add_argument('--tls-max-version', choices=('1.0', '1.1', '1.2', '1.3'), default=None,
+                        help='Newest TLS version offered')
+    parser.add_argument('--tls-ciphers', default=None,
+                        help="OpenSSL cipher list for TLS 1.2 and older, e.g. 'ECDHE-RSA-AES128-GCM-SHA256'")
+    parser.add_argument('--alpn', default=None,
+                        help="Comma-separated ALPN protocols to advertise, e.g. 'mqtt' or 'h2,http/1.1'")
+    parser.add_argument('--alpn-strict', action='store_true', default=None,
+                        help='Fail handshakes whose ALPN offer has none of the --alpn protocols')
+
+
+def tls_options(opts, cfg):
+    """Return (client_ca_file, require_client_cert, min_version, max_version, ciphers,
+    alpn, alpn_strict) from flags, falling back to config."""
+    tls = cfg.server.tls
+    client_ca_file = opts.client_ca if opts.client_ca is not None else tls.client_ca_file
+    require = opts.require_client_cert if opts.require_client_cert is not None else tls.require_client_cert
+    if require and not client_ca_file:
+        raise SystemExit('--require-client-cert needs --client-ca (or server.tls.client_ca_file)')
+    min_version = opts.tls_min_version or tls.min_version
+    max_version = opts.tls_max_version or tls.max_version
+    ciphers = opts.tls_ciphers if opts.tls_ciphers is not None else tls.ciphers
+    alpn = [p.strip() for p in opts.alpn.split(',') if p.strip()] if opts.alpn is not None else tls.alpn
+    alpn_strict = opts.alpn_strict if opts.alpn_strict is not None else tls.alpn_strict
+    if alpn_strict and not alpn:
+        raise SystemExit('--alpn-strict needs --alpn (or server.tls.alpn)')
+    return client_ca_file, require, min_version, max_version, ciphers, alpn, alpn_strict
+
+
+def add_acme_args(parser):
+    parser.add_argument('--acme-domain', action='append', default=None,
+                        help='Get the TLS certificate for this name via ACME and keep it renewed (repeatable)')
+    parser.add_argument('--acme-email', default=None, help='Contact address registered with the ACME account')
+    parser.add_argument('--acme-challenge', choices=acme.CHALLENGES, default=None,
+                        help='Prove control of the names with a TXT record (default) or on port 80')
+    parser.add_argument('--acme-dns-hook', default=None,
+                        help="Command publishing the dns-01 TXT record, run as '<hook> present|cleanup <fqdn> <value>'")
+    parser.add_argument('--acme-directory', default=None,
+                        help="ACME directory URL (default Let's Encrypt; 'staging' for its staging CA)")
+
+
+def tls_certificate(opts, cfg, bind, stop_event):
+    """Return (cert_file, key_file): cert.pem/key.pem, or an ACME certificate (renewed in the
+    background) when ACME domains are set by flags or server.tls.acme."""
+    settings = cfg.server.tls.acme
+    settings.domains = opts.acme_domain or settings.domains
+    if not settings.domains:
+        return 'cert.pem', 'key.pem'
+    settings.email = opts.acme_email if opts.acme_email is not None else settings.email
+    settings.challenge = opts.acme_challenge or settings.challenge
+    settings.dns_hook = opts.acme_dns_hook if opts.acme_dns_hook is not None else settings.dns_hook
+    if opts.acme_directory:
+        settings.directory = acme.LETSENCRYPT_STAGING if opts.acme_directory == 'staging' else opts.acme_directory
+    try:
+        settings.validate()
+        files = acme.ensure_certificate(settings, bind)
+    except (ValueError, OSError, acme.ACMEError) as e:
+        raise SystemExit(f'ACME certificate for {", ".join(settings.domains)}: {e}')
+    threading.Thread(target=acme.keep_renewed, args=(settings, stop_event, bind), daemon=True).start()
+    return files
+
+
+def add_run_args(parser):
+    parser.add_argument('--run-for', default=None,
+                        help="Stop after this long (e.g. '10m') and exit 0 if the expectations hold, 2 if not, "
+                             "3 if the servers failed to start")
+    parser.add_argument('--expect', default=None, help='JSON file of counter expectations checked at the end')
+    parser.add_argument('--junit', default='',
+                        help='Write a JUnit XML report of the run here (default with --expect: junit.xml)')
+
+
+def parse_run_args(parser, args):
+    """parse_args, with usage errors of a --run-for/--expect run exiting with expect.EXIT_STARTUP."""
+    try:
+        opts = parser.parse_args(args)
+    except SystemExit as e:
+        if e.code and any(a.startswith(('--run-for', '--expect')) for a in args):
+            sys.exit(expect.EXIT_STARTUP)
+        raise
+    if opts.expect and not opts.junit:
+        opts.junit = 'junit.xml'
+    return opts
+
+
 def make_stop_event():
     stop_event = threading.Event()
 
@@ -55,57 +401,199 @@ def cmd_serve_all(args, mode):
     parser = argparse.ArgumentParser()
     parser.add_argument('--config', default='config.json')
     parser.add_argument('--bind', default='')
-    opts = parser.parse_args(args)
+    parser.add_argument('--admin-port', type=int, default=None,
+                        help='Serve the admin API (stats) on this port, 0 disables')
+    parser.add_argument('--pprof', action='store_true', default=None,
+                        help='Trace allocations and expose /debug/pprof/ on the admin API')
+    parser.add_argument('--bundle-on-event', default=None,
+                        help='Comma-separated events that write an evidence bundle '
+                             '(parse_error, disconnect_storm, assertion)')
+    parser.add_argument('--bundle-dir', default=None, help='Directory for evidence bundles')
+    parser.add_argument('--virtual-clock', action='store_true',
+                        help='Delays and schedules follow a virtual clock advanced via POST /clock/advance')
+    parser.add_argument('--dump', default='', help='Append a hexdump of all TCP and UDP traffic to this file')
+    parser.add_argument('--state-dir', default=None,
+                        help='Persist counters (and other state) here so they survive restarts')
+    parser.add_argument('--storage', default=None, metavar='BACKEND',
+                        help="Keep recordings, captured requests and state in 'files' (default), 'sqlite' "
+                             "(<state-dir>/yourtestsrv.db) or 'sqlite:PATH'")
+    parser.add_argument('--endpoints-file', default=None, metavar='PATH',
+                        help='Also write the startup banner (every listener, as JSON) to this file')
+    add_network_profile_arg(parser)
+    add_tls_args(parser)
+    add_acme_args(parser)
+    add_run_args(parser)
+    opts = parse_run_args(parser, args)
+    if not (opts.run_for or opts.expect):
+        serve_all(opts, parser, mode)
+        return
+    try:
+        run = expect.ScenarioRun(
+            cfg_module.parse_duration(opts.run_for) if opts.run_for else 0.0,
+            expect.load(opts.expect) if opts.expect else [], opts.junit,
+            suite=os.path.splitext(os.path.basename(opts.expect))[0] if opts.expect else 'yourtestsrv')
+    except (OSError, ValueError) as e:
+        print(f'--run-for/--expect: {e}', file=sys.stderr)
+        sys.exit(expect.EXIT_STARTUP)
+    try:
+        code = serve_all(opts, parser, mode, run)
+    except SystemExit as e:
+        # parser.error() and certificate failures; argparse's status 2 would read as a failed expectation.
+        code = run.startup_failed(e.code if isinstance(e.code, str) else f'exit status {e.code}')
+    except Exception as e:
+        code = run.startup_failed(str(e) or type(e).__name__)
+    sys.exit(code)
+
+
+def serve_all(opts, parser, mode, run=None):
+    """Start every server; with run, serve for its duration and return its exit code."""
     cfg = load_config(opts.config)
     apply_defaults(cfg)
     if opts.bind:
         cfg.server.bind = opts.bind
+    if opts.admin_port is not None:
+        cfg.admin.port = opts.admin_port
+    if opts.pprof is not None:
+        cfg.admin.pprof = opts.pprof
+    if opts.bundle_on_event is not None:
+        cfg.bundle.events = [e.strip() for e in opts.bundle_on_event.split(',') if e.strip()]
+        unknown = [e for e in cfg.bundle.events if e not in BUNDLE_EVENTS]
+        if unknown:
+            parser.error(f'--bundle-on-event: unknown event(s) {", ".join(unknown)} '
+                         f'(use {", ".join(BUNDLE_EVENTS)})')
+    if opts.bundle_dir is not None:
+        cfg.bundle.dir = opts.bundle_dir
+    if opts.state_dir is not None:
+        cfg.state_dir = opts.state_dir
+    if opts.storage is not None:
+        try:
+            storage.check_spec(opts.storage)
+        except ValueError as e:
+            parser.error(str(e))
+        cfg.storage = opts.storage
+    if opts.endpoints_file is not None:
+        cfg.endpoints_file = opts.endpoints_file
+    apply_network_profile(opts, cfg)
+    if cfg.admin.pprof:
+        tracemalloc.start()
+    if opts.virtual_clock:
+        if not cfg.admin.port:
+            parser.error('--virtual-clock needs --admin-port to advance the clock')
+        clock.default = clock.VirtualClock()
 
     stop_event = make_stop_event()
+    dump = TrafficDump(opts.dump) if opts.dump else None
+    use_storage(cfg)
+    # One recording and one replay for the plain and TLS TCP listeners.
+    recorder = SessionRecorder(cfg.server.tcp.record) if cfg.server.tcp.record else None
+    try:
+        replay = SessionReplay.from_store(cfg.server.tcp.replay) if cfg.server.tcp.replay else None
+    except (OSError, ValueError) as e:
+        parser.error(f'replay: {e}')
+    persister = None
+    if cfg.state_dir:
+        os.makedirs(cfg.state_dir, exist_ok=True)
+        persister = stats.StatsPersister(os.path.join(cfg.state_dir, 'stats.json'))
+        persister.load()
     threads = []
+    tcp_servers, udp_servers, http_servers, mqtt_servers = [], [], [], []
+    # (protocol, server, tls) of every listener, for the startup banner.
+    listeners = []
 
     cert_file, key_file = 'cert.pem', 'key.pem'
+    if mode in ('both', 'tls'):
+        cert_file, key_file = tls_certificate(opts, cfg, cfg.server.bind, stop_event)
+    tls_settings = tls_options(opts, cfg)
     tls_available = os.path.exists(cert_file) and os.path.exists(key_file)
     if not tls_available and mode in ('both', 'tls'):
         logger.warning(f'TLS cert/key not found ({cert_file}, {key_file}), TLS servers will not start')
 
     def start(fn, *a):
-        t = threading.Thread(target=fn, args=a, daemon=True)
+        t = threading.Thread(target=run.guard(fn, stop_event) if run else fn, args=a, daemon=True)
         t.start()
         threads.append(t)
 
+    ports = []
     if mode == 'both':
-        start(TCPServer(cfg.server.tcp.port, cfg.server.bind,
-                        cfg.server.tcp.delay, cfg.server.tcp.close_after).listen_and_serve, stop_event)
-        start(HTTPServer(cfg.server.http.port, cfg.server.bind,
-                         cfg.server.http.slow_response, cfg.server.http.slow_duration,
-                         cfg.server.http.error_code, cfg.server.http.chunked).listen_and_serve, stop_event)
-        start(MQTTServer(cfg.server.mqtt.port, cfg.server.bind,
-                         cfg.server.mqtt.retain).listen_and_serve, stop_event)
-
+        ports.append((cfg.server.tcp.port, cfg.server.http.port, cfg.server.mqtt.port, False))
     if mode in ('both', 'tls') and tls_available:
-        start(TCPServer(cfg.server.tcp.tls_port, cfg.server.bind,
-                        cfg.server.tcp.delay, cfg.server.tcp.close_after).listen_and_serve_tls,
-              stop_event, cert_file, key_file)
-        start(HTTPServer(cfg.server.http.tls_port, cfg.server.bind,
-                         cfg.server.http.slow_response, cfg.server.http.slow_duration,
-                         cfg.server.http.error_code, cfg.server.http.chunked).listen_and_serve_tls,
-              stop_event, cert_file, key_file)
-        start(MQTTServer(cfg.server.mqtt.tls_port, cfg.server.bind,
-                         cfg.server.mqtt.retain).listen_and_serve_tls,
-              stop_event, cert_file, key_file)
-
-    start(UDPServer(cfg.server.udp.port, cfg.server.bind,
-                    cfg.server.udp.drop_rate, cfg.server.udp.delay).listen_and_serve, stop_event)
+        ports.append((cfg.server.tcp.tls_port, cfg.server.http.tls_port, cfg.server.mqtt.tls_port, True))
+    for tcp_port, http_port, mqtt_port, tls in ports:
+        tcp_srv = build_tcp_server(cfg, tcp_port, dump, recorder, replay)
+        http_srv = build_http_server(cfg, http_port)
+        cluster = MQTTCluster() if cfg.server.mqtt.cluster_port and not tls else None
+        mqtt_srv = build_mqtt_server(cfg, mqtt_port, cluster)
+        if cluster:
+            # The peer is reached through the cluster, so publishes and redirects go via mqtt_srv.
+            peer = MQTTServer(cfg.server.mqtt.cluster_port, cfg.server.bind, cfg.server.mqtt.retain,
+                              idle_timeout=cfg.server.mqtt.idle_timeout, cluster=cluster)
+            start(peer.listen_and_serve, stop_event)
+            listeners.append(('mqtt-cluster', peer, False))
+        tcp_servers.append(tcp_srv)
+        http_servers.append(http_srv)
+        mqtt_servers.append(mqtt_srv)
+        for protocol, srv in (('tcp', tcp_srv), ('http', http_srv), ('mqtt', mqtt_srv)):
+            listeners.append((protocol, srv, tls))
+            if tls:
+                start(srv.listen_and_serve_tls, stop_event, cert_file, key_file, *tls_settings)
+            else:
+                start(srv.listen_and_serve, stop_event)
+
+    if cfg.server.tcp.ws_port and tcp_servers:
+        tcp = cfg.server.tcp
+        bridge = WebSocketBridge(tcp.ws_port, cfg.server.bind, tcp_servers[0], tcp.ws_ping_interval,
+                                 tcp.ws_pong_timeout, tcp.ws_ignore_pings)
+        start(bridge.listen_and_serve, stop_event)
+        listeners.append(('websocket', bridge, False))
+
+    udp_srv = build_udp_server(cfg, dump)
+    udp_servers.append(udp_srv)
+    start(udp_srv.listen_and_serve, stop_event)
+    listeners.append(('udp', udp_srv, False))
+
+    start(Scheduler(cfg.schedule, tcp_servers, udp_servers, mqtt_servers).run, stop_event)
+    if cfg.admin.port:
+        admin = AdminServer(cfg.admin.port, cfg.admin.bind, mqtt_servers, pprof=cfg.admin.pprof,
+                            servers=tcp_servers + http_servers + mqtt_servers)
+        start(admin.listen_and_serve, stop_event)
+        listeners.append(('admin', admin, False))
+    watchdog = stats.ConnectionWatchdog(interval=cfg.admin.watchdog_interval,
+                                        max_idle=cfg.admin.watchdog_max_idle,
+                                        max_buffered=cfg.admin.watchdog_max_buffered)
+    start(watchdog.run, stop_event)
+    if persister:
+        start(persister.run, stop_event)
+    bundler = EventBundler(cfg.bundle.events, cfg.bundle.dir, config_path=opts.config,
+                           cooldown=cfg.bundle.cooldown, storm_threshold=cfg.bundle.storm_threshold,
+                           storm_window=cfg.bundle.storm_window)
+    start(bundler.run, stop_event)
 
     logger.info('All servers started')
     logger.info(f'TCP: {cfg.server.tcp.port}, TCP TLS: {cfg.server.tcp.tls_port}')
+    if cfg.server.tcp.ws_port:
+        logger.info(f'TCP over WebSocket: {cfg.server.tcp.ws_port}')
     logger.info(f'UDP: {cfg.server.udp.port}')
     logger.info(f'HTTP: {cfg.server.http.port}, HTTP TLS: {cfg.server.http.tls_port}')
     logger.info(f'MQTT: {cfg.server.mqtt.port}, MQTT TLS: {cfg.server.mqtt.tls_port}')
+    if cfg.server.mqtt.cluster_port and mode == 'both':
+        logger.info(f'MQTT cluster peer: {cfg.server.mqtt.cluster_port}')
+    if cfg.admin.port:
+        logger.info(f'Admin: {cfg.admin.bind}:{cfg.admin.port}')
+    try:
+        endpoints.announce(endpoints.banner(listeners, VERSION, cfg.server.network_profile, stop_event=stop_event),
+                           cfg.endpoints_file)
+    except OSError as e:
+        logger.error(f'endpoints file {cfg.endpoints_file}: {e}')
 
-    stop_event.wait()
+    if run:
+        run.wait(stop_event)
+    else:
+        stop_event.wait()
+    if persister:
+        persister.save_logged()
     logger.info('All servers stopped')
+    if run:
+        return run.finish(bundler)
 
 
 def cmd_tcp(args):
@@ -114,20 +602,182 @@ def cmd_tcp(args):
     parser.add_argument('--bind', default='')
     parser.add_argument('--port', '-p', type=int, default=0)
     parser.add_argument('--tls', action='store_true')
+    add_tls_args(parser)
     parser.add_argument('--delay', default=None)
+    parser.add_argument('--jitter', default=None, help="Spread each delay evenly by up to this much, e.g. '50ms'")
+    add_latency_arg(parser)
+    add_network_profile_arg(parser)
     parser.add_argument('--close-after', default=None)
+    parser.add_argument('--idle-timeout', default=None,
+                        help='Close connections silent for this long (default 30s, 0 never)')
+    parser.add_argument('--keepalive', default=None,
+                        help="TCP keepalive probe period on accepted connections, e.g. '30s', or 'off' (default: OS)")
+    parser.add_argument('--close-after-bytes', type=int, default=None,
+                        help='Close the connection once this many reply bytes were sent')
+    parser.add_argument('--rst', dest='close_mode', action='store_const', const='rst', default=None,
+                        help='Close with RST (SO_LINGER=0) instead of FIN; alone, resets right after accept')
+    parser.add_argument('--tls-close', dest='close_mode', choices=('alert', 'truncate'), default=None,
+                        help='End TLS sessions with a fatal alert or a record cut in half '
+                             '(use with --close-after-bytes)')
+    parser.add_argument('--ws-port', type=int, default=None,
+                        help='Also expose this server over WebSocket on this port (0 disables)')
+    parser.add_argument('--ws-ping-interval', default=None, help='Ping WebSocket clients this often (0 never pings)')
+    parser.add_argument('--ws-pong-timeout', default=None,
+                        help='Drop WebSocket connections whose pong is this late (0 waits forever)')
+    parser.add_argument('--ws-ignore-pings', action='store_true', default=None,
+                        help='Never answer the WebSocket pings of clients')
+    add_connection_limit_args(parser)
+    add_pacing_args(parser)
+    add_proxy_protocol_arg(parser)
+    add_socket_option_args(parser)
+    parser.add_argument('--upstream', default=None,
+                        help='Forward connections to host:port instead of echoing, applying the faults in-line')
+    parser.add_argument('--banner', default=None,
+                        help='Greeting sent on accept; escapes and ${remote}, ${timestamp}, ... are expanded')
+    parser.add_argument('--dump', default='', help='Append a hexdump of the traffic in both directions to this file')
+    parser.add_argument('--record', default=None, metavar='NAME',
+                        help='Record every connection under this name in the storage (a JSON lines file by default), '
+                             'e.g. while forwarding with --upstream')
+    parser.add_argument('--replay', default=None, metavar='NAME',
+                        help='Answer strictly from a recording; clients that diverge from it are reset')
+    parser.add_argument('--rules', default=None,
+                        help='JSON file with a list of match -> reply rules (see server.tcp.rules)')
+    add_fault_rules_arg(parser)
+    parser.add_argument('--stall', action='store_true', default=None,
+                        help='Accept connections but never read, so client writes hit backpressure')
+    parser.add_argument('--unix', default='', help='Listen on a Unix domain socket path instead of TCP')
+    parser.add_argument('--framing', choices=('raw', 'delim'), default=None,
+                        help='Echo raw reads, or one reply per delimited message')
+    parser.add_argument('--delimiter', default=None, help="Message delimiter with escapes (default '\\n')")
+    parser.add_argument('--max-line-length', type=int, default=None,
+                        help='Close the connection when an unterminated message grows past this')
+    parser.add_argument('--rate-limit', default=None,
+                        help="Per-connection throughput cap each way, e.g. '16kbps' or '2KB/s'")
+    parser.add_argument('--trickle-delay', default=None,
+                        help="Send replies a few bytes at a time with this pause between pieces, e.g. '200ms'")
+    parser.add_argument('--trickle-chunk', type=int, default=None,
+                        help='Bytes per piece when trickling replies (default 1)')
+    parser.add_argument('--corrupt-rate', type=float, default=None,
+                        help='Probability (0-1) that each reply byte gets a bit flipped or is replaced')
+    parser.add_argument('--disconnect-rate', type=float, default=None,
+                        help='Probability (0-1) that each received frame closes the connection (RST with --rst)')
+    parser.add_argument('--accept-close-rate', type=float, default=None,
+                        help='Probability (0-1) that a connection is closed right after accept, before any data')
+    parser.add_argument('--accept-close-bytes', type=int, default=None,
+                        help='Send up to this many random bytes before such a close (default 0)')
+    parser.add_argument('--accept-close-mode', choices=cfg_module.ACCEPT_CLOSE_MODES, default=None,
+                        help='Close those connections with a FIN (default) or a RST')
+    add_probe_args(parser)
+    parser.add_argument('--buffer-size', type=int, default=None,
+                        help='Receive buffer per connection in bytes, taken from a shared pool (default 4096)')
+    parser.add_argument('--zero-copy', action='store_true', default=None,
+                        help='Echo with os.splice on Linux when no fault, shaping or reply option is in play')
+    parser.add_argument('--drop-link-local', action='store_true', default=None,
+                        help='Reset connections from IPv6 link-local (fe80::/10) clients')
+    parser.add_argument('--response-template', default=None,
+                        help='JSON binary template to reply with instead of echoing')
+    parser.add_argument('--response-hex', default=None, help='Reply with these bytes (hex) to every message')
+    parser.add_argument('--response-file', default=None, help='Reply with the contents of this file to every message')
+    add_capture_args(parser)
     opts = parser.parse_args(args)
+    if len([r for r in (opts.response_template, opts.response_hex, opts.response_file, opts.response_capture)
+            if r]) > 1:
+        parser.error('use only one of --response-template, --response-hex, --response-file and --response-capture')
     c = load_config(opts.config)
     apply_defaults(c)
+    use_storage(c)
+    apply_network_profile(opts, c)
     bind = opts.bind or c.server.bind
     port = opts.port or (c.server.tcp.tls_port if opts.tls else c.server.tcp.port)
     from yourtestsrv.config import parse_duration
     delay = parse_duration(opts.delay) if opts.delay is not None else c.server.tcp.delay
+    jitter = parse_duration(opts.jitter) if opts.jitter is not None else c.server.tcp.jitter
     close_after = parse_duration(opts.close_after) if opts.close_after is not None else c.server.tcp.close_after
-    srv = TCPServer(port, bind, delay, close_after)
+    if opts.response_template:
+        response = load_response_template(opts.response_template)
+    elif opts.response_hex:
+        response = FixedResponse.from_hex(opts.response_hex)
+    elif opts.response_file:
+        response = FixedResponse.from_file(opts.response_file)
+    elif opts.response_capture:
+        response = capture_response(opts)
+    else:
+        response = c.server.tcp.response
+    framing = opts.framing or c.server.tcp.framing
+    delimiter = cfg_module.parse_delimiter(opts.delimiter) if opts.delimiter is not None else c.server.tcp.delimiter
+    max_line_length = opts.max_line_length if opts.max_line_length is not None else c.server.tcp.max_line_length
+    rate_limit = parse_rate(opts.rate_limit) if opts.rate_limit is not None else c.server.tcp.rate_limit
+    trickle_delay = (parse_duration(opts.trickle_delay) if opts.trickle_delay is not None
+                     else c.server.tcp.trickle_delay)
+    trickle_chunk = opts.trickle_chunk if opts.trickle_chunk is not None else c.server.tcp.trickle_chunk
+    if trickle_chunk < 1:
+        parser.error('--trickle-chunk must be at least 1')
+    corrupt_rate = opts.corrupt_rate if opts.corrupt_rate is not None else c.server.tcp.corrupt_rate
+    disconnect_rate = opts.disconnect_rate if opts.disconnect_rate is not None else c.server.tcp.disconnect_rate
+    if not 0.0 <= disconnect_rate <= 1.0:
+        parser.error('--disconnect-rate must be between 0 and 1')
+    accept_close_rate = (opts.accept_close_rate if opts.accept_close_rate is not None
+                         else c.server.tcp.accept_close_rate)
+    if not 0.0 <= accept_close_rate <= 1.0:
+        parser.error('--accept-close-rate must be between 0 and 1')
+    accept_close_bytes = (opts.accept_close_bytes if opts.accept_close_bytes is not None
+                          else c.server.tcp.accept_close_bytes)
+    if accept_close_bytes < 0:
+        parser.error('--accept-close-bytes must not be negative')
+    accept_close_mode = opts.accept_close_mode or c.server.tcp.accept_close_mode
+    buffer_size = opts.buffer_size if opts.buffer_size is not None else c.server.tcp.buffer_size
+    if buffer_size < 1:
+        parser.error('--buffer-size must be at least 1')
+    zero_copy = c.server.tcp.zero_copy if opts.zero_copy is None else opts.zero_copy
+    drop_link_local = c.server.tcp.drop_link_local if opts.drop_link_local is None else opts.drop_link_local
+    record = opts.record if opts.record is not None else c.server.tcp.record
+    replay = opts.replay or c.server.tcp.replay
+    try:
+        replay = SessionReplay.from_store(replay) if replay else None
+    except (OSError, ValueError) as e:
+        parser.error(f'--replay: {e}')
+    close_mode = opts.close_mode or c.server.tcp.close_mode
+    close_after_bytes = (opts.close_after_bytes if opts.close_after_bytes is not None
+                         else c.server.tcp.close_after_bytes)
+    stall = c.server.tcp.stall if opts.stall is None else opts.stall
+    idle_timeout = parse_duration(opts.idle_timeout) if opts.idle_timeout is not None else c.server.tcp.idle_timeout
+    keepalive = cfg_module.parse_keepalive(opts.keepalive) if opts.keepalive is not None else c.server.tcp.keepalive
+    max_connections, over_limit, over_limit_banner = connection_limit_options(opts, c.server.tcp)
+    accept_delay, handshake_rate, accept_rate, workers = pacing_options(opts, c.server.tcp)
+    proxy_protocol = opts.proxy_protocol if opts.proxy_protocol is not None else c.server.tcp.proxy_protocol
+    upstream = cfg_module.parse_upstream(opts.upstream) if opts.upstream is not None else c.server.tcp.upstream
+    banner = cfg_module.parse_banner(opts.banner) if opts.banner is not None else c.server.tcp.banner
+    rules = load_rules(opts.rules) if opts.rules else c.server.tcp.rules
+    fault_rules = load_fault_rules(opts.fault_rules) if opts.fault_rules else c.server.tcp.fault_rules
+    srv = TCPServer(port, bind, delay, close_after, response=response, unix_socket=opts.unix,
+                    framing=framing, delimiter=delimiter, max_line_length=max_line_length,
+                    rate_limit=rate_limit, corrupt_rate=corrupt_rate, close_mode=close_mode,
+                    close_after_bytes=close_after_bytes, stall=stall, idle_timeout=idle_timeout,
+                    max_connections=max_connections, over_limit=over_limit, over_limit_banner=over_limit_banner,
+                    accept_delay=accept_delay, handshake_rate=handshake_rate, accept_rate=accept_rate, workers=workers,
+                    proxy_protocol=proxy_protocol,
+                    upstream=upstream, banner=banner, dump=TrafficDump(opts.dump) if opts.dump else None,
+                    rules=rules, fault_rules=fault_rules, keepalive=keepalive, trickle_delay=trickle_delay,
+                    trickle_chunk=trickle_chunk, disconnect_rate=disconnect_rate,
+                    socket_options=socket_options(opts, c.server.tcp), buffer_size=buffer_size, zero_copy=zero_copy,
+                    drop_link_local=drop_link_local, recorder=SessionRecorder(record) if record else None,
+                    replay=replay, jitter=jitter, latency=latency_option(parser, opts, c.server.tcp),
+                    accept_close_rate=accept_close_rate, accept_close_bytes=accept_close_bytes,
+                    accept_close_mode=accept_close_mode, **probe_options(parser, opts, c.server.tcp))
+    ws_port = opts.ws_port if opts.ws_port is not None else c.server.tcp.ws_port
     stop_event = make_stop_event()
+    if ws_port:
+        tcp = c.server.tcp
+        bridge = WebSocketBridge(
+            ws_port, bind, srv,
+            ping_interval=parse_duration(opts.ws_ping_interval) if opts.ws_ping_interval is not None
+            else tcp.ws_ping_interval,
+            pong_timeout=parse_duration(opts.ws_pong_timeout) if opts.ws_pong_timeout is not None
+            else tcp.ws_pong_timeout,
+            ignore_pings=tcp.ws_ignore_pings if opts.ws_ignore_pings is None else opts.ws_ignore_pings)
+        threading.Thread(target=bridge.listen_and_serve, args=(stop_event,), daemon=True).start()
     if opts.tls:
-        srv.listen_and_serve_tls(stop_event, 'cert.pem', 'key.pem')
+        srv.listen_and_serve_tls(stop_event, 'cert.pem', 'key.pem', *tls_options(opts, c))
     else:
         srv.listen_and_serve(stop_event)
 
@@ -138,16 +788,151 @@ def cmd_udp(args):
     parser.add_argument('--bind', default='')
     parser.add_argument('--port', '-p', type=int, default=0)
     parser.add_argument('--drop-rate', type=float, default=None)
+    parser.add_argument('--duplicate-rate', type=float, default=None,
+                        help='Fraction of replies sent more than once')
+    parser.add_argument('--duplicate-count', type=int, default=None,
+                        help='Copies of a duplicated reply (default 2)')
+    parser.add_argument('--duplicate-gap', default=None, help="Time between the copies, e.g. '100ms' (default 0s)")
+    parser.add_argument('--reorder', default=None, metavar='DIST',
+                        help="Hold replies for a random extra delay so they overtake each other: 'uniform:MIN:MAX', "
+                             "'normal:MEAN:STDDEV', 'exponential:MEAN' or 'pareto:SCALE:SHAPE'")
+    parser.add_argument('--reorder-rate', type=float, default=None,
+                        help='Fraction of replies given the extra delay (default 1)')
+    parser.add_argument('--sequence-field', default=None, metavar='SPEC',
+                        help="Count lost, duplicate and reordered datagrams per client by this sequence number: "
+                             "'OFFSET:SIZE[:little]', 'json:PATH' or 'regex:PATTERN'")
     parser.add_argument('--delay', default=None)
+    parser.add_argument('--jitter', default=None, help="Spread each delay evenly by up to this much, e.g. '50ms'")
+    add_latency_arg(parser)
+    parser.add_argument('--rate-limit', default=None,
+                        help="Link bandwidth, e.g. '20kbps': each reply waits its transmission time")
+    add_network_profile_arg(parser)
+    parser.add_argument('--amplify', type=int, default=None,
+                        help='Reply with N times the request size')
+    parser.add_argument('--amplify-cap', type=int, default=None,
+                        help='Maximum amplified reply size in bytes')
+    parser.add_argument('--truncate-to', type=int, default=None, metavar='N',
+                        help='Send only the first N bytes of each reply (default 0: the whole reply)')
+    parser.add_argument('--pad-to', type=int, default=None, metavar='N',
+                        help='Pad shorter replies with zero bytes to N bytes, e.g. 4096 to have them IP-fragmented')
+    parser.add_argument('--outage-every', default=None,
+                        help='Close the socket periodically so clients get port unreachable')
+    parser.add_argument('--outage-duration', default=None, help='Length of each outage window')
+    parser.add_argument('--response-template', default=None,
+                        help='JSON binary template to reply with instead of echoing')
+    add_capture_args(parser)
+    parser.add_argument('--encap-header', type=int, default=None,
+                        help='Outer header bytes to skip and copy unchanged to replies (GTP-U: 8)')
+    parser.add_argument('--encap-length-at', type=int, default=None,
+                        help='Offset of a 16-bit outer length field to rewrite (GTP-U: 2)')
+    parser.add_argument('--encap-length-base', type=int, default=None,
+                        help='The length field counts bytes after this offset (default: the header size)')
+    parser.add_argument('--dump', default='', help='Append a hexdump of the traffic in both directions to this file')
+    parser.add_argument('--reply-from-64', default=None, metavar='IID',
+                        help='Reply from this interface identifier (e.g. ::2) in the /64 the request was sent to')
+    parser.add_argument('--drop-link-local', action='store_true', default=None,
+                        help='Ignore datagrams from IPv6 link-local (fe80::/10) clients')
+    parser.add_argument('--multicast', action='append', default=None, metavar='GROUP',
+                        help='Join this multicast group and answer its traffic (repeatable; bind 0.0.0.0 or ::)')
+    parser.add_argument('--multicast-interface', default=None,
+                        help='Interface to join the groups on, by name or IPv4 address (default: the kernel\'s choice)')
+    parser.add_argument('--discovery-reply', default=None,
+                        help='Answer broadcast datagrams unicast with this payload; escapes and ${remote}, ${local}, '
+                             '${broadcast}, ... are expanded (bind 0.0.0.0)')
+    parser.add_argument('--discovery-reply-hex', default=None, help='Answer broadcast datagrams with these bytes (hex)')
+    parser.add_argument('--stun', choices=STUN_MODES, default=None, metavar='MODE',
+                        help='Also answer STUN binding requests on this port, in this stun mode (e.g. normal)')
+    parser.add_argument('--stun-mapped', default=None, help='Report this host:port in STUN answers')
+    add_fault_rules_arg(parser)
+    add_socket_option_args(parser)
     opts = parser.parse_args(args)
     c = load_config(opts.config)
     apply_defaults(c)
+    apply_network_profile(opts, c)
     bind = opts.bind or c.server.bind
     port = opts.port or c.server.udp.port
     from yourtestsrv.config import parse_duration
     drop_rate = opts.drop_rate if opts.drop_rate is not None else c.server.udp.drop_rate
+    duplicate_rate = opts.duplicate_rate if opts.duplicate_rate is not None else c.server.udp.duplicate_rate
+    duplicate_count = opts.duplicate_count if opts.duplicate_count is not None else c.server.udp.duplicate_count
+    if duplicate_count < 2:
+        parser.error('--duplicate-count must be at least 2')
+    duplicate_gap = parse_duration(opts.duplicate_gap) if opts.duplicate_gap is not None else c.server.udp.duplicate_gap
+    try:
+        reorder = Distribution(opts.reorder) if opts.reorder else c.server.udp.reorder
+    except ValueError as e:
+        parser.error(str(e))
+    reorder_rate = opts.reorder_rate if opts.reorder_rate is not None else c.server.udp.reorder_rate
+    if not 0 <= reorder_rate <= 1:
+        parser.error('--reorder-rate must be between 0 and 1')
+    try:
+        sequence_field = SequenceField(opts.sequence_field) if opts.sequence_field else c.server.udp.sequence_field
+    except ValueError as e:
+        parser.error(str(e))
     delay = parse_duration(opts.delay) if opts.delay is not None else c.server.udp.delay
-    srv = UDPServer(port, bind, drop_rate, delay)
+    jitter = parse_duration(opts.jitter) if opts.jitter is not None else c.server.udp.jitter
+    rate_limit = parse_rate(opts.rate_limit) if opts.rate_limit is not None else c.server.udp.rate_limit
+    amplify = opts.amplify if opts.amplify is not None else c.server.udp.amplify
+    amplify_cap = opts.amplify_cap if opts.amplify_cap is not None else c.server.udp.amplify_cap
+    truncate_to = opts.truncate_to if opts.truncate_to is not None else c.server.udp.truncate_to
+    if truncate_to < 0:
+        parser.error('--truncate-to must not be negative')
+    pad_to = opts.pad_to if opts.pad_to is not None else c.server.udp.pad_to
+    if not 0 <= pad_to <= MAX_UDP_PAYLOAD:
+        parser.error(f'--pad-to must be between 0 and {MAX_UDP_PAYLOAD}')
+    outage_every = parse_duration(opts.outage_every) if opts.outage_every is not None else c.server.udp.outage_every
+    outage_duration = (parse_duration(opts.outage_duration) if opts.outage_duration is not None
+                       else c.server.udp.outage_duration)
+    if opts.response_template and opts.response_capture:
+        parser.error('use only one of --response-template and --response-capture')
+    if opts.response_template:
+        response = load_response_template(opts.response_template)
+    else:
+        response = capture_response(opts) or c.server.udp.response
+    if opts.encap_header is not None:
+        encap = cfg_module.parse_encap(opts.encap_header,
+                                       opts.encap_length_at if opts.encap_length_at is not None else -1,
+                                       opts.encap_length_base)
+    else:
+        encap = c.server.udp.encap_header, c.server.udp.encap_length_offset, c.server.udp.encap_length_base
+    try:
+        reply_from_64 = (cfg_module.parse_interface_id(opts.reply_from_64) if opts.reply_from_64 is not None
+                         else c.server.udp.reply_from_64)
+    except ValueError as e:
+        parser.error(str(e))
+    drop_link_local = c.server.udp.drop_link_local if opts.drop_link_local is None else opts.drop_link_local
+    try:
+        multicast = cfg_module.parse_multicast(opts.multicast) if opts.multicast else c.server.udp.multicast
+    except ValueError as e:
+        parser.error(str(e))
+    multicast_interface = (opts.multicast_interface if opts.multicast_interface is not None
+                           else c.server.udp.multicast_interface)
+    if opts.discovery_reply is not None or opts.discovery_reply_hex is not None:
+        try:
+            discovery_reply = cfg_module.parse_discovery_reply(opts.discovery_reply, opts.discovery_reply_hex)
+        except ValueError as e:
+            parser.error(str(e))
+    else:
+        discovery_reply = c.server.udp.discovery_reply
+    if opts.stun is not None or opts.stun_mapped is not None:
+        try:
+            stun = STUNResponder(opts.stun or 'normal', opts.stun_mapped or '')
+        except ValueError as e:
+            parser.error(f'--stun-mapped: {e}')
+    else:
+        stun = c.server.udp.stun
+    srv = UDPServer(port, bind, drop_rate, delay, amplify=amplify, amplify_cap=amplify_cap,
+                    outage_every=outage_every, outage_duration=outage_duration, response=response,
+                    encap_header=encap[0], encap_length_offset=encap[1], encap_length_base=encap[2],
+                    dump=TrafficDump(opts.dump) if opts.dump else None,
+                    socket_options=socket_options(opts, c.server.udp),
+                    fault_rules=load_fault_rules(opts.fault_rules) if opts.fault_rules else c.server.udp.fault_rules,
+                    reply_from_64=reply_from_64, drop_link_local=drop_link_local, multicast=multicast,
+                    multicast_interface=multicast_interface, jitter=jitter, rate_limit=rate_limit,
+                    discovery_reply=discovery_reply, duplicate_rate=duplicate_rate, duplicate_count=duplicate_count,
+                    duplicate_gap=duplicate_gap, reorder=reorder, reorder_rate=reorder_rate,
+                    sequence_field=sequence_field, latency=latency_option(parser, opts, c.server.udp),
+                    truncate_to=truncate_to, pad_to=pad_to, stun=stun)
     stop_event = make_stop_event()
     srv.listen_and_serve(stop_event)
 
@@ -158,24 +943,106 @@ def cmd_http(args):
     parser.add_argument('--bind', default='')
     parser.add_argument('--port', '-p', type=int, default=0)
     parser.add_argument('--tls', action='store_true')
+    add_tls_args(parser)
+    add_acme_args(parser)
     parser.add_argument('--slow-response', action='store_true', default=None)
     parser.add_argument('--slow-duration', default=None)
+    add_latency_arg(parser)
     parser.add_argument('--error-code', type=int, default=None)
     parser.add_argument('--chunked', action='store_true', default=None)
+    parser.add_argument('--date-offset', default=None,
+                        help='Skew Date/Last-Modified/Expires by a duration (e.g. --date-offset=-1h)')
+    parser.add_argument('--break-keepalive', action='store_true', default=None,
+                        help='Violate the negotiated keep-alive/close behavior')
+    parser.add_argument('--strict', action='store_true', default=None,
+                        help='Reject requests violating RFC 7230 instead of parsing leniently')
+    parser.add_argument('--range-fault', choices=('wrong_boundary', 'missing_close', 'ignore'), default=None,
+                        help='Misbehave on Range requests')
+    add_pacing_args(parser)
+    add_proxy_protocol_arg(parser)
+    add_socket_option_args(parser)
+    parser.add_argument('--auth', default=None, help='Require Basic auth with these user:password credentials')
+    parser.add_argument('--lockout-after', type=int, default=None,
+                        help='Lock a client out after this many failed auth attempts (0 never)')
+    parser.add_argument('--lockout-duration', default=None, help='How long a lockout lasts')
+    parser.add_argument('--lockout-code', type=int, choices=(423, 429), default=None,
+                        help='Status returned while locked out')
+    parser.add_argument('--sign', choices=('hmac', 'jws'), default=None,
+                        help='Sign response bodies with HMAC-SHA256 or a detached HS256 JWS')
+    parser.add_argument('--sign-key', default=None, help='Secret key used for signing')
+    parser.add_argument('--sign-header', default=None, help='Header carrying the signature (default X-Signature)')
+    parser.add_argument('--sign-fault', choices=('corrupt', 'wrong_key', 'tamper', 'missing'), default=None,
+                        help='Send invalid signatures')
+    add_fault_rules_arg(parser)
+    parser.add_argument('--session-ttl', default=None,
+                        help='Issue session tokens from POST /login that expire after this long (e.g. 30s)')
+    parser.add_argument('--session-sliding', action='store_true', default=None,
+                        help='Renew a session token on every request that uses it')
+    parser.add_argument('--session-protect', default=None,
+                        help="Regex of paths that need a session token (default '^/api/')")
+    parser.add_argument('--capture', default=None, metavar='NAME',
+                        help='Append every request to this log in the storage (a JSON lines file by default)')
+    parser.add_argument('--upstream', default=None,
+                        help='Reverse-proxy requests to the HTTP server at host:port instead of answering them')
+    parser.add_argument('--cache-ttl', default=None,
+                        help='Cache upstream GET responses for this long (e.g. 30s; 0 disables the cache)')
+    parser.add_argument('--cache-fault', choices=('stale', 'partial', 'short_length'), default=None,
+                        help='Serve cached responses stale, partially cached or with a wrong Content-Length')
+    parser.add_argument('--unix', default='', help='Listen on a Unix domain socket path instead of TCP')
     opts = parser.parse_args(args)
     c = load_config(opts.config)
     apply_defaults(c)
+    use_storage(c)
     bind = opts.bind or c.server.bind
     port = opts.port or (c.server.http.tls_port if opts.tls else c.server.http.port)
+    capture = opts.capture if opts.capture is not None else c.server.http.capture
     from yourtestsrv.config import parse_duration
     slow_response = c.server.http.slow_response if opts.slow_response is None else opts.slow_response
     slow_duration = parse_duration(opts.slow_duration) if opts.slow_duration is not None else c.server.http.slow_duration
     error_code = opts.error_code if opts.error_code is not None else c.server.http.error_code
     chunked = c.server.http.chunked if opts.chunked is None else opts.chunked
-    srv = HTTPServer(port, bind, slow_response, slow_duration, error_code, chunked)
+    date_offset = parse_duration(opts.date_offset) if opts.date_offset is not None else c.server.http.date_offset
+    break_keepalive = c.server.http.break_keepalive if opts.break_keepalive is None else opts.break_keepalive
+    strict = c.server.http.strict if opts.strict is None else opts.strict
+    range_fault = opts.range_fault if opts.range_fault is not None else c.server.http.range_fault
+    accept_delay, handshake_rate, accept_rate, workers = pacing_options(opts, c.server.http)
+    proxy_protocol = opts.proxy_protocol if opts.proxy_protocol is not None else c.server.http.proxy_protocol
+    auth = opts.auth if opts.auth is not None else c.server.http.auth
+    lockout_after = opts.lockout_after if opts.lockout_after is not None else c.server.http.lockout_after
+    lockout_duration = (parse_duration(opts.lockout_duration) if opts.lockout_duration is not None
+                        else c.server.http.lockout_duration)
+    lockout_code = opts.lockout_code if opts.lockout_code is not None else c.server.http.lockout_code
+    sign = opts.sign if opts.sign is not None else c.server.http.sign
+    sign_key = opts.sign_key if opts.sign_key is not None else c.server.http.sign_key
+    sign_header = opts.sign_header or c.server.http.sign_header
+    sign_fault = opts.sign_fault if opts.sign_fault is not None else c.server.http.sign_fault
+    if sign and not sign_key:
+        parser.error('--sign needs --sign-key')
+    fault_rules = load_fault_rules(opts.fault_rules) if opts.fault_rules else c.server.http.fault_rules
+    session_ttl = parse_duration(opts.session_ttl) if opts.session_ttl is not None else c.server.http.session_ttl
+    session_sliding = c.server.http.session_sliding if opts.session_sliding is None else opts.session_sliding
+    session_protect = opts.session_protect or c.server.http.session_protect
+    from yourtestsrv.config import parse_upstream
+    upstream = parse_upstream(opts.upstream) if opts.upstream is not None else c.server.http.upstream
+    cache_ttl = parse_duration(opts.cache_ttl) if opts.cache_ttl is not None else c.server.http.cache_ttl
+    cache_fault = opts.cache_fault if opts.cache_fault is not None else c.server.http.cache_fault
+    if (cache_ttl or cache_fault) and not upstream:
+        parser.error('--cache-ttl and --cache-fault need --upstream')
+    srv = HTTPServer(port, bind, slow_response, slow_duration, error_code, chunked,
+                     date_offset=date_offset, break_keepalive=break_keepalive, strict=strict,
+                     unix_socket=opts.unix, range_fault=range_fault, accept_delay=accept_delay,
+                     handshake_rate=handshake_rate, accept_rate=accept_rate, workers=workers,
+                     proxy_protocol=proxy_protocol, auth=auth,
+                     lockout_after=lockout_after, lockout_duration=lockout_duration, lockout_code=lockout_code,
+                     sign=sign, sign_key=sign_key, sign_header=sign_header, sign_fault=sign_fault,
+                     fault_rules=fault_rules, session_ttl=session_ttl, session_sliding=session_sliding,
+                     session_login_path=c.server.http.session_login_path, session_protect=session_protect,
+                     socket_options=socket_options(opts, c.server.http), capture=capture,
+                     latency=latency_option(parser, opts, c.server.http), upstream=upstream, cache_ttl=cache_ttl,
+                     cache_fault=cache_fault)
     stop_event = make_stop_event()
     if opts.tls:
-        srv.listen_and_serve_tls(stop_event, 'cert.pem', 'key.pem')
+        srv.listen_and_serve_tls(stop_event, *tls_certificate(opts, c, bind, stop_event), *tls_options(opts, c))
     else:
         srv.listen_and_serve(stop_event)
 
@@ -186,25 +1053,737 @@ def cmd_mqtt(args):
     parser.add_argument('--bind', default='')
     parser.add_argument('--port', '-p', type=int, default=0)
     parser.add_argument('--tls', action='store_true')
+    add_tls_args(parser)
+    add_acme_args(parser)
     parser.add_argument('--retain', '-r', dest='retain', action='store_true',
                         help='Enable MQTT message retain')
     parser.add_argument('--no-retain', dest='retain', action='store_false',
                         help='Disable MQTT message retain')
+    parser.add_argument('--idle-timeout', default=None,
+                        help='Close connections silent for this long (default 60s, 0 never); '
+                             'caps the client keep-alive when shorter')
+    add_connection_limit_args(parser)
+    add_pacing_args(parser)
+    parser.add_argument('--preload', default=None,
+                        help='Load retained messages and subscriptions from a state file exported via the admin API')
+    add_fault_rules_arg(parser)
+    parser.add_argument('--redirect', default=None,
+                        help='Refuse connections with a v5 Server Reference to this host:port')
+    parser.add_argument('--redirect-code', choices=('use_another_server', 'server_moved'), default=None,
+                        help='CONNACK reason code sent with --redirect')
+    parser.add_argument('--cluster-port', type=int, default=None,
+                        help='Also run a second broker on this port sharing retained messages and sessions')
+    parser.add_argument('--validators', default=None,
+                        help='JSON file with per-topic payload validators (JSON Schema, CDDL, protobuf)')
+    add_probe_args(parser)
+    add_socket_option_args(parser)
     parser.set_defaults(retain=None)
     opts = parser.parse_args(args)
     c = load_config(opts.config)
     apply_defaults(c)
+    use_storage(c)
     bind = opts.bind or c.server.bind
     port = opts.port or (c.server.mqtt.tls_port if opts.tls else c.server.mqtt.port)
     retain = opts.retain if opts.retain is not None else c.server.mqtt.retain
-    srv = MQTTServer(port, bind, retain)
+    from yourtestsrv.config import parse_duration
+    idle_timeout = parse_duration(opts.idle_timeout) if opts.idle_timeout is not None else c.server.mqtt.idle_timeout
+    max_connections, over_limit, over_limit_banner = connection_limit_options(opts, c.server.mqtt)
+    accept_delay, handshake_rate, accept_rate, workers = pacing_options(opts, c.server.mqtt)
+    fault_rules = load_fault_rules(opts.fault_rules) if opts.fault_rules else c.server.mqtt.fault_rules
+    redirect = opts.redirect if opts.redirect is not None else c.server.mqtt.redirect
+    redirect_code = opts.redirect_code or c.server.mqtt.redirect_code
+    cluster_port = opts.cluster_port if opts.cluster_port is not None else c.server.mqtt.cluster_port
+    cluster = MQTTCluster() if cluster_port else None
+    validators = ValidatorSet.from_file(opts.validators) if opts.validators else c.server.mqtt.validators
+    srv = MQTTServer(port, bind, retain, publish=c.server.mqtt.publish, idle_timeout=idle_timeout,
+                     max_connections=max_connections, over_limit=over_limit, over_limit_banner=over_limit_banner,
+                     accept_delay=accept_delay, handshake_rate=handshake_rate, accept_rate=accept_rate,
+                     workers=workers, fault_rules=fault_rules,
+                     redirect=redirect, redirect_code=redirect_code, cluster=cluster,
+                     socket_options=socket_options(opts, c.server.mqtt), validators=validators,
+                     **probe_options(parser, opts, c.server.mqtt))
+    preload = opts.preload if opts.preload is not None else c.server.mqtt.preload
+    if preload:
+        srv.load_state(load_mqtt_state(preload))
     stop_event = make_stop_event()
+    if cluster:
+        peer = MQTTServer(cluster_port, bind, retain, idle_timeout=idle_timeout, cluster=cluster)
+        threading.Thread(target=peer.listen_and_serve, args=(stop_event,), daemon=True).start()
+        logger.info(f'MQTT cluster peer on port {cluster_port}')
     if opts.tls:
-        srv.listen_and_serve_tls(stop_event, 'cert.pem', 'key.pem')
+        srv.listen_and_serve_tls(stop_event, *tls_certificate(opts, c, bind, stop_event), *tls_options(opts, c))
     else:
         srv.listen_and_serve(stop_event)
 
 
+def cmd_paired(args):
+    parser = argparse.ArgumentParser(prog='yourtestsrv.py paired')
+    parser.add_argument('--config', default='config.json')
+    parser.add_argument('--bind', default='')
+    parser.add_argument('--port', '-p', type=int, default=0)
+    parser.add_argument('--delay', default=None, help='Delay every TCP read and UDP datagram')
+    parser.add_argument('--drop-rate', type=float, default=None, help='Fraction of UDP datagrams dropped')
+    parser.add_argument('--corrupt-rate', type=float, default=None,
+                        help='Per-byte corruption probability for TCP and UDP replies')
+    opts = parser.parse_args(args)
+    c = load_config(opts.config)
+    bind = opts.bind or c.server.bind
+    port = opts.port or c.server.paired.port
+    from yourtestsrv.config import parse_duration
+    delay = parse_duration(opts.delay) if opts.delay is not None else c.server.paired.delay
+    drop_rate = opts.drop_rate if opts.drop_rate is not None else c.server.paired.drop_rate
+    corrupt_rate = opts.corrupt_rate if opts.corrupt_rate is not None else c.server.paired.corrupt_rate
+    srv = PairedEchoService(port, bind, delay, drop_rate, corrupt_rate)
+    srv.listen_and_serve(make_stop_event())
+
+
+def cmd_stun(args):
+    parser = argparse.ArgumentParser(prog='yourtestsrv.py stun')
+    parser.add_argument('--config', default='config.json')
+    parser.add_argument('--bind', default='')
+    parser.add_argument('--port', '-p', type=int, default=0)
+    parser.add_argument('--mode', choices=STUN_MODES, default=None,
+                        help='Answer scenario (normal reports the real reflexive address)')
+    parser.add_argument('--mapped', default=None, help='Report this host:port instead of the client address')
+    parser.add_argument('--no-tcp', dest='tcp', action='store_false', default=None,
+                        help='Serve STUN over UDP only')
+    opts = parser.parse_args(args)
+    c = load_config(opts.config)
+    bind = opts.bind or c.server.bind
+    port = opts.port or c.server.stun.port or 3478
+    mode = opts.mode or c.server.stun.mode
+    mapped = opts.mapped if opts.mapped is not None else c.server.stun.mapped
+    tcp = c.server.stun.tcp if opts.tcp is None else opts.tcp
+    responder = STUNResponder(mode, mapped)
+    stop_event = make_stop_event()
+    if tcp:
+        tcp_srv = TCPServer(port, bind, handler=responder.handle_tcp)
+        threading.Thread(target=tcp_srv.listen_and_serve, args=(stop_event,), daemon=True).start()
+    UDPServer(port, bind, handler=responder.handle_udp).listen_and_serve(stop_event)
+
+
+def cmd_dns(args):
+    parser = argparse.ArgumentParser(prog='yourtestsrv.py dns')
+    parser.add_argument('--config', default='config.json')
+    parser.add_argument('--bind', default='')
+    parser.add_argument('--port', '-p', type=int, default=0)
+    parser.add_argument('--record', action='append', default=None, metavar='NAME=VALUE',
+                        help='Answer NAME with an address, or a CNAME if VALUE is a name '
+                             '(repeatable, added to the configured records)')
+    parser.add_argument('--ttl', type=int, default=None, help='TTL of the answers (default 60)')
+    parser.add_argument('--mode', choices=DNS_MODES, default=None,
+                        help='Answer scenario for every name (normal answers from the records)')
+    parser.add_argument('--scenario', action='append', default=None, metavar='NAME=MODE',
+                        help='Answer scenario for names matching NAME (e.g. "*.example.com=servfail"; repeatable, '
+                             'tried before the configured ones)')
+    parser.add_argument('--delay', default=None, help='Delay every answer')
+    parser.add_argument('--no-tcp', dest='tcp', action='store_false', default=None,
+                        help='Serve DNS over UDP only')
+    parser.add_argument('--dot-port', type=int, default=None,
+                        help='Also serve DNS over TLS on this port (standard 853; needs cert.pem/key.pem)')
+    parser.add_argument('--dot-mode', choices=DOT_MODES, default=None,
+                        help='Answer scenario over TLS only (reset: drop connections before the handshake)')
+    parser.add_argument('--doh-port', type=int, default=None,
+                        help='Also serve DNS over HTTPS on this port (at /dns-query by default; needs cert.pem/key.pem)')
+    parser.add_argument('--doh-mode', choices=DOH_MODES, default=None,
+                        help='Answer scenario over HTTPS only (http_error: 503 for every query)')
+    add_tls_args(parser)
+    opts = parser.parse_args(args)
+    c = load_config(opts.config)
+    dns = c.server.dns
+    bind = opts.bind or c.server.bind
+    port = opts.port or dns.port
+    records = dict(dns.records)
+    for item in opts.record or ():
+        name, sep, value = item.partition('=')
+        if not sep:
+            parser.error(f'--record must be NAME=VALUE: {item!r}')
+        try:
+            ipaddress.ip_address(value)
+        except ValueError:
+            records[name] = {'CNAME': value}
+        else:
+            current = records.get(name)
+            records[name] = (current if isinstance(current, list) else []) + [value]
+    scenarios = []
+    for item in opts.scenario or ():
+        name, sep, mode = item.partition('=')
+        if not sep:
+            parser.error(f'--scenario must be NAME=MODE: {item!r}')
+        scenarios.append({'name': name, 'mode': mode})
+    from yourtestsrv.config import parse_duration
+    try:
+        responder = DNSResponder(records, ttl=dns.ttl if opts.ttl is None else opts.ttl, mode=opts.mode or dns.mode,
+                                 delay=dns.delay if opts.delay is None else parse_duration(opts.delay),
+                                 scenarios=scenarios + dns.scenarios)
+    except ValueError as e:
+        parser.error(str(e))
+    tcp = dns.tcp if opts.tcp is None else opts.tcp
+    dot_port = dns.dot_port if opts.dot_port is None else opts.dot_port
+    doh_port = dns.doh_port if opts.doh_port is None else opts.doh_port
+    dot_mode = opts.dot_mode or dns.dot_mode
+    doh_mode = opts.doh_mode or dns.doh_mode
+    if (dot_port or doh_port) and not (os.path.exists('cert.pem') and os.path.exists('key.pem')):
+        parser.error('DNS over TLS/HTTPS needs cert.pem and key.pem')
+    tls_settings = tls_options(opts, c)
+    stop_event = make_stop_event()
+    if tcp:
+        tcp_srv = TCPServer(port, bind, handler=responder.handle_tcp)
+        threading.Thread(target=tcp_srv.listen_and_serve, args=(stop_event,), daemon=True).start()
+    if dot_port:
+        dot_srv = TCPServer(dot_port, bind, handler=responder.with_mode(dot_mode).handle_tcp,
+                            accept_close_rate=1.0 if dot_mode == 'reset' else 0.0, accept_close_mode='rst')
+        threading.Thread(target=dot_srv.listen_and_serve_tls, args=(stop_event, 'cert.pem', 'key.pem', *tls_settings),
+                         daemon=True).start()
+    if doh_port:
+        doh_srv = HTTPServer(doh_port, bind, handler=DoHHandler(responder.with_mode(doh_mode), dns.doh_path,
+                                                                http_error=doh_mode == 'http_error'))
+        threading.Thread(target=doh_srv.listen_and_serve_tls, args=(stop_event, 'cert.pem', 'key.pem', *tls_settings),
+                         daemon=True).start()
+    UDPServer(port, bind, handler=responder.handle_udp).listen_and_serve(stop_event)
+
+
+def cmd_ntp(args):
+    parser = argparse.ArgumentParser(prog='yourtestsrv.py ntp')
+    parser.add_argument('--config', default='config.json')
+    parser.add_argument('--bind', default='')
+    parser.add_argument('--port', '-p', type=int, default=0)
+    parser.add_argument('--offset', default=None, help="Shift the served time, e.g. '+2h' or (negative) --offset=-90s")
+    parser.add_argument('--drift', type=float, default=None, help='Let the offset grow by this many ppm')
+    parser.add_argument('--jitter', default=None, help='Random extra offset per reply, up to this either way')
+    parser.add_argument('--flap', default=None, help='Apply the offset only every other period of this length')
+    parser.add_argument('--stratum', type=int, default=None, help='Stratum to claim (16: unsynchronized)')
+    parser.add_argument('--leap', type=int, choices=(0, 1, 2, 3), default=None,
+                        help='Leap indicator (3: alarm, clock not synchronized)')
+    parser.add_argument('--refid', default=None, help="Reference id, e.g. 'GPS'")
+    opts = parser.parse_args(args)
+    c = load_config(opts.config)
+    ntp = c.server.ntp
+    bind = opts.bind or c.server.bind
+    port = opts.port or ntp.port
+    from yourtestsrv.config import parse_duration
+    durations = {}
+    for name in ('offset', 'jitter', 'flap'):
+        value = getattr(opts, name)
+        durations[name] = parse_duration(value) if value is not None else getattr(ntp, name)
+    try:
+        responder = NTPResponder(**durations, drift=ntp.drift if opts.drift is None else opts.drift,
+                                 stratum=ntp.stratum if opts.stratum is None else opts.stratum,
+                                 leap=ntp.leap if opts.leap is None else opts.leap,
+                                 refid=ntp.refid if opts.refid is None else opts.refid)
+    except ValueError as e:
+        parser.error(str(e))
+    UDPServer(port, bind, handler=responder.handle_udp).listen_and_serve(make_stop_event())
+
+
+def cmd_tftp(args):
+    parser = argparse.ArgumentParser(prog='yourtestsrv.py tftp')
+    parser.add_argument('--config', default='config.json')
+    parser.add_argument('--bind', default='')
+    parser.add_argument('--port', '-p', type=int, default=0)
+    parser.add_argument('--root', default=None, help='Directory served (default: current directory)')
+    parser.add_argument('--blksize', type=int, default=None,
+                        help='Largest block size granted to clients asking for the blksize option')
+    parser.add_argument('--drop-rate', type=float, default=None,
+                        help='Probability of not sending a DATA/ACK packet (the client must retransmit)')
+    parser.add_argument('--delay', default=None, help='Delay before every DATA/ACK packet (per block)')
+    parser.add_argument('--timeout', default=None, help='Retransmit the last packet after this long without answer')
+    parser.add_argument('--retries', type=int, default=None, help='Retransmissions before a transfer is abandoned')
+    parser.add_argument('--read-only', action='store_true', default=None, help='Refuse write requests')
+    opts = parser.parse_args(args)
+    c = load_config(opts.config)
+    tftp = c.server.tftp
+    bind = opts.bind or c.server.bind
+    port = opts.port or tftp.port
+    root = opts.root if opts.root is not None else tftp.root
+    if not os.path.isdir(root):
+        print(f'tftp: root directory not found: {root}', file=sys.stderr)
+        sys.exit(1)
+    from yourtestsrv.config import parse_duration
+    try:
+        responder = TFTPResponder(
+            root, blksize=tftp.blksize if opts.blksize is None else opts.blksize,
+            drop_rate=tftp.drop_rate if opts.drop_rate is None else opts.drop_rate,
+            delay=parse_duration(opts.delay) if opts.delay is not None else tftp.delay,
+            timeout=parse_duration(opts.timeout) if opts.timeout is not None else tftp.timeout,
+            retries=tftp.retries if opts.retries is None else opts.retries,
+            read_only=tftp.read_only if opts.read_only is None else opts.read_only, bind=bind)
+    except ValueError as e:
+        parser.error(str(e))
+    logger.info(f'TFTP serving {os.path.abspath(root)}')
+    UDPServer(port, bind, handler=responder.handle_udp).listen_and_serve(make_stop_event())
+
+
+def cmd_syslog(args):
+    parser = argparse.ArgumentParser(prog='yourtestsrv.py syslog')
+    parser.add_argument('--config', default='config.json')
+    parser.add_argument('--bind', default='')
+    parser.add_argument('--port', '-p', type=int, default=0)
+    parser.add_argument('--no-tcp', dest='tcp', action='store_false', default=None, help='Listen on UDP only')
+    parser.add_argument('--limit', type=int, default=None, help='Messages kept in memory (oldest dropped first)')
+    parser.add_argument('--admin-port', type=int, default=None,
+                        help='Serve the kept messages on this admin API port (GET/DELETE /syslog)')
+    opts = parser.parse_args(args)
+    c = load_config(opts.config)
+    cfg = c.server.syslog
+    bind = opts.bind or c.server.bind
+    port = opts.port or cfg.port
+    try:
+        syslog_server.log.configure(cfg.limit if opts.limit is None else opts.limit)
+    except ValueError as e:
+        parser.error(str(e))
+    receiver = syslog_server.SyslogReceiver()
+    stop_event = make_stop_event()
+    admin_port = c.admin.port if opts.admin_port is None else opts.admin_port
+    if admin_port:
+        admin = AdminServer(admin_port, c.admin.bind)
+        threading.Thread(target=admin.listen_and_serve, args=(stop_event,), daemon=True).start()
+        logger.info(f'Syslog messages at http://{c.admin.bind}:{admin_port}/syslog')
+    if cfg.tcp if opts.tcp is None else opts.tcp:
+        tcp_srv = TCPServer(port, bind, handler=receiver.handle_tcp)
+        threading.Thread(target=tcp_srv.listen_and_serve, args=(stop_event,), daemon=True).start()
+    UDPServer(port, bind, handler=receiver.handle_udp).listen_and_serve(stop_event)
+
+
+def cmd_icmp(args):
+    parser = argparse.ArgumentParser(prog='yourtestsrv.py icmp')
+    parser.add_argument('--config', default='config.json')
+    parser.add_argument('--bind', default='')
+    parser.add_argument('--drop-rate', type=float, default=None, help='Fraction of echo requests left unanswered')
+    parser.add_argument('--delay', default=None, help='Delay before each echo reply')
+    opts = parser.parse_args(args)
+    c = load_config(opts.config)
+    bind = opts.bind or c.server.bind
+    from yourtestsrv.config import parse_duration
+    drop_rate = opts.drop_rate if opts.drop_rate is not None else c.server.icmp.drop_rate
+    delay = parse_duration(opts.delay) if opts.delay is not None else c.server.icmp.delay
+    srv = ICMPResponder(bind, drop_rate, delay)
+    try:
+        srv.listen_and_serve(make_stop_event())
+    except PermissionError as e:
+        print(e, file=sys.stderr)
+        sys.exit(1)
+
+
+def cmd_socks(args):
+    parser = argparse.ArgumentParser(prog='yourtestsrv.py socks')
+    parser.add_argument('--config', default='config.json')
+    parser.add_argument('--bind', default='')
+    parser.add_argument('--port', '-p', type=int, default=0)
+    parser.add_argument('--delay', default=None, help='Delay the CONNECT reply and every relayed chunk')
+    parser.add_argument('--drop-rate', type=float, default=None,
+                        help='Fraction of CONNECT requests dropped without a reply')
+    parser.add_argument('--reply-code', type=int, default=None,
+                        help='Fail every CONNECT with this reply code (e.g. 5 refused, 4 host unreachable)')
+    parser.add_argument('--auth', default=None, help='Require username/password auth (user:password)')
+    opts = parser.parse_args(args)
+    c = load_config(opts.config)
+    bind = opts.bind or c.server.bind
+    port = opts.port or c.server.socks.port
+    from yourtestsrv.config import parse_duration
+    delay = parse_duration(opts.delay) if opts.delay is not None else c.server.socks.delay
+    drop_rate = opts.drop_rate if opts.drop_rate is not None else c.server.socks.drop_rate
+    reply_code = opts.reply_code if opts.reply_code is not None else c.server.socks.reply_code
+    auth = opts.auth if opts.auth is not None else c.server.socks.auth
+    handler = SOCKS5Handler(delay, drop_rate, reply_code, auth)
+    TCPServer(port, bind, handler=handler.handle).listen_and_serve(make_stop_event())
+
+
+def cmd_sftp(args):
+    parser = argparse.ArgumentParser(prog='yourtestsrv.py sftp')
+    parser.add_argument('--config', default='config.json')
+    parser.add_argument('--bind', default='')
+    parser.add_argument('--port', '-p', type=int, default=0)
+    parser.add_argument('--root', default=None, help='Directory served as / (default: current directory)')
+    parser.add_argument('--user', default=None, help='Only accept this user name')
+    parser.add_argument('--password', default=None, help='Require this password (default: no authentication)')
+    parser.add_argument('--host-key', default=None,
+                        help='File keeping the host key across restarts (created if missing)')
+    parser.add_argument('--delay', default=None, help='Delay every SFTP read/write reply and every SCP file')
+    parser.add_argument('--rate-limit', default=None, help='Limit file transfer speed (e.g. 64kbps, 8KB/s)')
+    parser.add_argument('--fail-upload-after', type=int, default=None,
+                        help='Fail uploads once this many bytes of a file are written')
+    parser.add_argument('--fail-download-after', type=int, default=None,
+                        help='Fail downloads once this many bytes of a file are sent')
+    parser.add_argument('--fail-mode', choices=SFTP_FAIL_MODES, default=None,
+                        help='How a failing transfer ends: error reply, dropped connection or stalled session')
+    parser.add_argument('--read-only', action='store_true', default=None, help='Refuse uploads and changes')
+    opts = parser.parse_args(args)
+    c = load_config(opts.config)
+    bind = opts.bind or c.server.bind
+    port = opts.port or c.server.sftp.port
+    sftp = c.server.sftp
+    from yourtestsrv.config import parse_duration
+    faults = FileFaults(
+        delay=parse_duration(opts.delay) if opts.delay is not None else sftp.delay,
+        rate_limit=parse_rate(opts.rate_limit) if opts.rate_limit is not None else sftp.rate_limit,
+        fail_upload_after=opts.fail_upload_after if opts.fail_upload_after is not None else sftp.fail_upload_after,
+        fail_download_after=(opts.fail_download_after if opts.fail_download_after is not None
+                             else sftp.fail_download_after),
+        fail_mode=opts.fail_mode or sftp.fail_mode,
+        read_only=sftp.read_only if opts.read_only is None else opts.read_only)
+    root = opts.root if opts.root is not None else sftp.root
+    if not os.path.isdir(root):
+        print(f'sftp: root directory not found: {root}', file=sys.stderr)
+        sys.exit(1)
+    handler = SFTPHandler(root, opts.user if opts.user is not None else sftp.username,
+                          opts.password if opts.password is not None else sftp.password,
+                          load_host_key(opts.host_key if opts.host_key is not None else sftp.host_key), faults)
+    logger.info(f'SFTP serving {os.path.abspath(root)}, host key {handler.fingerprint}')
+    TCPServer(port, bind, handler=handler.handle).listen_and_serve(make_stop_event())
+
+
+def cmd_ntrip(args):
+    parser = argparse.ArgumentParser(prog='yourtestsrv.py ntrip')
+    parser.add_argument('--config', default='config.json')
+    parser.add_argument('--bind', default='')
+    parser.add_argument('--port', '-p', type=int, default=0)
+    parser.add_argument('--auth', default=None, help='Require these credentials on every mountpoint (user:password)')
+    parser.add_argument('--mount', action='append', default=None,
+                        help='Serve this mountpoint (repeatable); config settings apply if it is configured')
+    parser.add_argument('--file', default=None, help='Replay this RTCM3 capture instead of synthesized frames')
+    parser.add_argument('--interval', default=None, help='Time between epochs (default 1s)')
+    parser.add_argument('--require-gga', action='store_true', default=None,
+                        help='Stream only after the client sent its GGA position')
+    parser.add_argument('--disconnect-after', default=None, help='Close every stream after this long')
+    parser.add_argument('--stall-after', default=None, help='Stop sending (connection kept open) after this long')
+    parser.add_argument('--outage-every', default=None, help='Period of recurring outages, with --outage-for')
+    parser.add_argument('--outage-for', default=None, help='Silence at the end of every --outage-every period')
+    parser.add_argument('--corrupt-rate', type=float, default=None, help='Fraction of frames sent with a bad CRC')
+    opts = parser.parse_args(args)
+    c = load_config(opts.config)
+    bind = opts.bind or c.server.bind
+    port = opts.port or c.server.ntrip.port
+    specs = {spec['name']: spec for spec in c.server.ntrip.mountpoints}
+    if opts.mount:
+        specs = {name: specs.get(name, {'name': name}) for name in opts.mount}
+    overrides = {key: getattr(opts, key) for key in ('file', 'interval', 'require_gga', 'disconnect_after',
+                                                     'stall_after', 'outage_every', 'outage_for', 'corrupt_rate')
+                 if getattr(opts, key) is not None}
+    try:
+        mountpoints = [Mountpoint(**dict(spec, **overrides)) for spec in specs.values()]
+    except (OSError, ValueError) as e:
+        print(f'ntrip: {e}', file=sys.stderr)
+        sys.exit(1)
+    caster = NTRIPCaster(mountpoints, opts.auth if opts.auth is not None else c.server.ntrip.auth)
+    logger.info(f'NTRIP caster mountpoints: {", ".join(m.name for m in mountpoints)}')
+    TCPServer(port, bind, handler=caster.handle).listen_and_serve(make_stop_event())
+
+
+def cmd_telnet(args):
+    parser = argparse.ArgumentParser(prog='yourtestsrv.py telnet')
+    parser.add_argument('--config', default='config.json')
+    parser.add_argument('--bind', default='')
+    parser.add_argument('--port', '-p', type=int, default=0)
+    parser.add_argument('--prompt', default=None, help='Prompt sent before every line (default "$ ")')
+    parser.add_argument('--banner', default=None, help='Text sent once on connect')
+    parser.add_argument('--login', default=None, help='Ask for and require these credentials (user:password)')
+    parser.add_argument('--respond', action='append', default=None, metavar='COMMAND=REPLY',
+                        help='Canned reply to a command line (repeatable, added to the configured ones)')
+    parser.add_argument('--no-negotiate', dest='negotiate', action='store_false', default=None,
+                        help='Send no Telnet options and leave echoing to the client (raw console)')
+    parser.add_argument('--no-echo', dest='echo', action='store_false', default=None,
+                        help='Refuse the ECHO option so the client echoes locally')
+    parser.add_argument('--delay', default=None, help='Delay every canned reply')
+    opts = parser.parse_args(args)
+    c = load_config(opts.config)
+    telnet = c.server.telnet
+    bind = opts.bind or c.server.bind
+    port = opts.port or telnet.port
+    username, password = telnet.username, telnet.password
+    if opts.login is not None:
+        username, sep, password = opts.login.partition(':')
+        if not sep:
+            parser.error('--login must be user:password')
+    responses = dict(telnet.responses)
+    for item in opts.respond or ():
+        command, sep, reply = item.partition('=')
+        if not sep:
+            parser.error(f'--respond must be COMMAND=REPLY: {item!r}')
+        responses[command.strip()] = reply
+    from yourtestsrv.config import parse_duration
+    responder = TelnetResponder(
+        prompt=telnet.prompt if opts.prompt is None else opts.prompt,
+        banner=telnet.banner if opts.banner is None else opts.banner,
+        username=username, password=password, responses=responses,
+        negotiate=telnet.negotiate if opts.negotiate is None else opts.negotiate,
+        echo=telnet.echo if opts.echo is None else opts.echo,
+        delay=telnet.delay if opts.delay is None else parse_duration(opts.delay))
+    TCPServer(port, bind, handler=responder.handle).listen_and_serve(make_stop_event())
+
+
+def split_host_port(addr, default_port):
+    host, sep, port = addr.rpartition(':')
+    if not sep:
+        return addr, default_port
+    return host.strip('[]'), int(port)
+
+
+def cmd_simulate_device(args):
+    parser = argparse.ArgumentParser(prog='yourtestsrv.py simulate-device')
+    parser.add_argument('--client-id', default='device-1')
+    parser.add_argument('--mqtt', default='', help='Broker address host[:port]')
+    parser.add_argument('--tls', action='store_true', help='Connect to the broker with TLS')
+    parser.add_argument('--http-url', default='', help='POST telemetry to this URL')
+    parser.add_argument('--interval', default='5s', help='Telemetry interval')
+    parser.add_argument('--payload-template', default=None,
+                        help='JSON telemetry template (see payload generators)')
+    parser.add_argument('--telemetry-topic', default=None)
+    parser.add_argument('--command-topic', default=None)
+    parser.add_argument('--response-topic', default=None)
+    opts = parser.parse_args(args)
+    if not opts.mqtt and not opts.http_url:
+        parser.error('at least one of --mqtt or --http-url is required')
+    from yourtestsrv.config import parse_duration
+    payload = {'type': 'json', 'template': opts.payload_template} if opts.payload_template else None
+    mqtt_host, mqtt_port = split_host_port(opts.mqtt, 1883) if opts.mqtt else (None, 1883)
+    sim = DeviceSimulator(opts.client_id, parse_duration(opts.interval), payload,
+                          mqtt_host=mqtt_host, mqtt_port=mqtt_port, mqtt_tls=opts.tls,
+                          telemetry_topic=opts.telemetry_topic, command_topic=opts.command_topic,
+                          response_topic=opts.response_topic, http_url=opts.http_url or None)
+    sim.run(make_stop_event())
+
+
+def cmd_loadgen(args):
+    parser = argparse.ArgumentParser(prog='yourtestsrv.py loadgen')
+    parser.add_argument('--config', default='config.json', help='Settings from its "loadgen" section')
+    parser.add_argument('--target', default=None,
+                        help='mqtt[s]://host[:port] or http[s]://host[:port]/path (${device} allowed in the path)')
+    parser.add_argument('--devices', type=int, default=None, help='Number of virtual devices')
+    parser.add_argument('--interval', default=None, help='Report interval per device, e.g. 10s')
+    parser.add_argument('--jitter', default=None, help='Spread each interval by up to this either way')
+    parser.add_argument('--ramp-up', default=None, help='Start the devices evenly over this long')
+    parser.add_argument('--duration', default=None, help='Stop after this long (default: until interrupted)')
+    parser.add_argument('--topic', default=None, help="MQTT topic, e.g. 'devices/${device}/telemetry'")
+    parser.add_argument('--qos', type=int, choices=(0, 1, 2), default=None)
+    parser.add_argument('--template', action='append', default=None,
+                        help='JSON payload template (repeatable, picked at random); replaces the configured ones')
+    parser.add_argument('--workers', type=int, default=None, help='Reports in flight at most')
+    parser.add_argument('--json', action='store_true', help='Print the report as JSON')
+    opts = parser.parse_args(args)
+    from yourtestsrv.config import parse_duration
+    cfg = load_config(opts.config).loadgen
+    target = opts.target if opts.target is not None else cfg.target
+    if not target:
+        parser.error('a target is required (--target or "target" in the loadgen config)')
+    devices = opts.devices if opts.devices is not None else cfg.devices
+    workers = opts.workers if opts.workers is not None else cfg.workers
+    if devices < 1 or workers < 1:
+        parser.error('--devices and --workers must be at least 1')
+    durations = {}
+    for name in ('interval', 'jitter', 'ramp_up', 'duration'):
+        value = getattr(opts, name)
+        durations[name] = parse_duration(value) if value is not None else getattr(cfg, name)
+    if durations['interval'] <= 0:
+        parser.error('--interval must be positive')
+    templates = cfg.templates
+    if opts.template:
+        templates = [{'payload': {'type': 'json', 'template': t}} for t in opts.template]
+    try:
+        generator = loadgen.LoadGenerator(
+            target, devices=devices, device_id=cfg.device_id, **durations,
+            topic=opts.topic if opts.topic is not None else cfg.topic,
+            qos=opts.qos if opts.qos is not None else cfg.qos, templates=templates, workers=workers,
+            content_type=cfg.content_type, username=cfg.username, password=cfg.password)
+    except ValueError as e:
+        parser.error(str(e))
+    report = generator.run(make_stop_event())
+    print(json.dumps(report, indent=2) if opts.json else loadgen.format_report(report))
+    sys.exit(1 if report['failed'] or report['rejected'] else 0)
+
+
+def cmd_mqtt_conformance(args):
+    parser = argparse.ArgumentParser(prog='yourtestsrv.py mqtt-conformance')
+    parser.add_argument('--target', default='',
+                        help='Broker address host[:port]; without it a built-in broker is tested')
+    parser.add_argument('--tls', action='store_true', help='Connect to the target with TLS')
+    parser.add_argument('--username', default=None)
+    parser.add_argument('--password', default=None)
+    parser.add_argument('--timeout', default='5s', help='Per-step timeout')
+    parser.add_argument('--check', action='append', default=None,
+                        help='Run only this check (repeatable); choices: '
+                             + ', '.join(name for name, _ in mqtt_conformance.CHECKS))
+    parser.add_argument('--json', action='store_true', help='Print the report as JSON')
+    opts = parser.parse_args(args)
+    from yourtestsrv.config import parse_duration
+    stop_event = threading.Event()
+    if opts.target:
+        host, port = split_host_port(opts.target, 1883)
+    else:
+        sock = netutil.listen_tcp('127.0.0.1', 0)
+        host, port = sock.getsockname()
+        threading.Thread(target=MQTTServer(0, '127.0.0.1').serve, args=(stop_event, sock), daemon=True).start()
+    runner = mqtt_conformance.ConformanceRunner(host, port, tls=opts.tls, timeout=parse_duration(opts.timeout),
+                                                username=opts.username, password=opts.password)
+    results = runner.run(opts.check)
+    stop_event.set()
+    if opts.json:
+        print(json.dumps([r.to_dict() for r in results], indent=2))
+    else:
+        print(mqtt_conformance.format_report(results))
+    sys.exit(0 if all(r.passed for r in results) else 1)
+
+
+def cmd_http_probe(args):
+    parser = argparse.ArgumentParser(prog='yourtestsrv.py http-probe')
+    parser.add_argument('--target', required=True, help='Device HTTP server host[:port]')
+    parser.add_argument('--tls', action='store_true', help='Connect with TLS (certificate not verified)')
+    parser.add_argument('--path', default='/', help='Request target used by the probes')
+    parser.add_argument('--timeout', default='3s', help='How long to wait for the server per probe')
+    parser.add_argument('--probe', action='append', default=None,
+                        help='Run only this probe (repeatable); choices: '
+                             + ', '.join(name for name, _, _ in http_probe.PROBES))
+    parser.add_argument('--json', action='store_true', help='Print the report as JSON')
+    opts = parser.parse_args(args)
+    from yourtestsrv.config import parse_duration
+    host, port = split_host_port(opts.target, 443 if opts.tls else 80)
+    prober = http_probe.HTTPProber(host, port, tls=opts.tls, timeout=parse_duration(opts.timeout), path=opts.path)
+    results = prober.run(opts.probe)
+    if opts.json:
+        print(json.dumps([r.to_dict() for r in results], indent=2))
+    else:
+        print(http_probe.format_report(results))
+
+
+def cmd_bisect(args):
+    parser = argparse.ArgumentParser(prog='yourtestsrv.py bisect')
+    parser.add_argument('--spec', required=True, help='JSON bisect spec: server, faults, command, ...')
+    parser.add_argument('--admin', default=None, help='Admin server host[:port] (overrides the spec)')
+    parser.add_argument('--command', default=None,
+                        help='Test command, exit status non-zero on failure; {addr}, {host}, {port} are expanded')
+    parser.add_argument('--json', action='store_true', help='Print the report as JSON')
+    opts = parser.parse_args(args)
+    with open(opts.spec) as f:
+        spec = json.load(f)
+    for key in ('admin', 'command'):
+        if getattr(opts, key) is not None:
+            spec[key] = getattr(opts, key)
+    try:
+        spec = bisect.BisectSpec(**spec)
+    except (TypeError, ValueError) as e:
+        parser.error(f'invalid bisect spec: {e}')
+    if not spec.command:
+        parser.error('a test command is required (--command or "command" in the spec)')
+    try:
+        report = bisect.Bisector(spec).run()
+    except (OSError, ValueError) as e:
+        print(f'bisect: {e}', file=sys.stderr)
+        sys.exit(2)
+    print(json.dumps(report, indent=2) if opts.json else bisect.format_report(report))
+    sys.exit(0 if report['verdict'] == 'minimal' else 1)
+
+
+def cmd_tail(args):
+    parser = argparse.ArgumentParser(prog='yourtestsrv.py tail')
+    parser.add_argument('--admin', default='127.0.0.1:9090', help='Admin server host[:port] of the running servers')
+    parser.add_argument('--protocol', choices=traffic.PROTOCOLS, default=None)
+    parser.add_argument('--topic', default=None, help='MQTT topic filter, e.g. devices/#')
+    parser.add_argument('--path', default=None, help='HTTP path regex')
+    parser.add_argument('--client', default=None, help='MQTT client id or peer address (substring)')
+    parser.add_argument('--json', action='store_true', help='Print the raw events as JSON lines')
+    opts = parser.parse_args(args)
+    host, port = split_host_port(opts.admin, 9090)
+    try:
+        for event in traffic.follow(host, port, protocol=opts.protocol, topic=opts.topic, path=opts.path,
+                                    client=opts.client):
+            print(json.dumps(event) if opts.json else traffic.format_event(event), flush=True)
+    except KeyboardInterrupt:
+        pass
+    except (OSError, ValueError) as e:
+        print(f'tail: {e}', file=sys.stderr)
+        sys.exit(1)
+
+
+def cmd_syslog_dump(args):
+    parser = argparse.ArgumentParser(prog='yourtestsrv.py syslog-dump')
+    parser.add_argument('--admin', default='127.0.0.1:9090', help='Admin server host[:port] of the syslog sink')
+    parser.add_argument('--severity', default=None, help='Only this severity and more severe (e.g. warning)')
+    parser.add_argument('--facility', default=None, help='Only this facility (e.g. daemon, local0)')
+    parser.add_argument('--host', default=None, help='Only messages with this HOSTNAME')
+    parser.add_argument('--app', default=None, help='Only messages with this APP-NAME / tag')
+    parser.add_argument('--text', default=None, help='Only messages containing this text')
+    parser.add_argument('--since', type=int, default=None, help='Only messages after this sequence number')
+    parser.add_argument('--limit', type=int, default=None, help='Only the newest N matching messages')
+    parser.add_argument('--clear', action='store_true', help='Forget all kept messages after printing')
+    parser.add_argument('--count', action='store_true', help='Print the number of matching messages only')
+    parser.add_argument('--json', action='store_true', help='Print the messages as JSON lines')
+    opts = parser.parse_args(args)
+    host, port = split_host_port(opts.admin, 9090)
+    try:
+        filters = {key: getattr(opts, key) for key in ('severity', 'facility', 'host', 'app', 'text', 'since', 'limit')}
+        messages = syslog_server.fetch(host, port, filters, clear=opts.clear)
+    except (OSError, ValueError) as e:
+        print(f'syslog-dump: {e}', file=sys.stderr)
+        sys.exit(1)
+    if opts.count:
+        print(len(messages))
+        return
+    for message in messages:
+        print(json.dumps(message, ensure_ascii=False) if opts.json else syslog_server.format_message(message))
+
+
+def cmd_config_schema(args):
+    parser = argparse.ArgumentParser(prog='yourtestsrv.py config-schema')
+    parser.add_argument('--output', default=None, help='Write the schema to this file instead of stdout')
+    opts = parser.parse_args(args)
+    text = json.dumps(schema.schema(), indent=2, ensure_ascii=False) + '\n'
+    if opts.output:
+        with open(opts.output, 'w', encoding='utf-8') as f:
+            f.write(text)
+    else:
+        sys.stdout.write(text)
+
+
+def cmd_scenarios(args):
+    parser = argparse.ArgumentParser(prog='yourtestsrv.py scenarios')
+    parser.add_argument('name', nargs='?', default='', help='Show this scenario with its session and example')
+    parser.add_argument('--json', action='store_true', help='Print the list as JSON')
+    opts = parser.parse_args(args)
+    try:
+        if opts.name:
+            print(json.dumps(scenarios.describe(opts.name), indent=2))
+        elif opts.json:
+            print(json.dumps([scenarios.summary(name) for name in scenarios.NAMES], indent=2))
+        else:
+            sys.stdout.write(scenarios.format_table())
+    except ValueError as e:
+        print(f'scenarios: {e}', file=sys.stderr)
+        sys.exit(1)
+
+
+def cmd_privbind(args):
+    command = []
+    if '--' in args:
+        args, command = args[:args.index('--')], args[args.index('--') + 1:]
+    parser = argparse.ArgumentParser(prog='yourtestsrv.py privbind',
+                                     usage='%(prog)s [--user USER] SPEC... -- COMMAND... | --check [PORT...]')
+    parser.add_argument('specs', nargs='*', metavar='SPEC',
+                        help='Socket to bind before dropping root: tcp:PORT, udp:PORT or PROTO:ADDRESS:PORT')
+    parser.add_argument('--user', default='', help='Run the command as this user (default: the sudo caller)')
+    parser.add_argument('--check', action='store_true',
+                        help='Report whether this process may bind the given (or the usual) privileged ports')
+    opts = parser.parse_args(args)
+    if opts.check:
+        try:
+            ports = [int(p) for p in opts.specs] or [53, 80, 123, 443]
+        except ValueError:
+            parser.error('--check takes port numbers')
+        report = privbind.status(ports)
+        print(json.dumps(report, indent=2))
+        for port, ok in report['ports'].items():
+            if not ok:
+                print(privbind.guidance('tcp', port), file=sys.stderr)
+                break
+        sys.exit(0 if all(report['ports'].values()) else 1)
+    if not opts.specs or not command:
+        parser.error('give the sockets to bind and, after --, the command to run')
+    try:
+        privbind.run(opts.specs, command, opts.user)
+    except (OSError, ValueError, KeyError) as e:
+        print(f'privbind: {e}', file=sys.stderr)
+        sys.exit(1)
+
+
 HELP = """\
 yourtestsrv - Network test server for embedded devices
 
@@ -214,10 +1793,33 @@ Usage:
 Commands:
   serve-all        Start all servers (plaintext and TLS where supported)
   serve-all-tls    Start all supported servers with TLS (UDP remains plaintext)
+                   (both take --run-for/--expect/--junit for CI runs with pass/fail exit codes)
   tcp              Start TCP server
   udp              Start UDP server
   http             Start HTTP server
   mqtt             Start MQTT server
+  paired           Start TCP and UDP echo on one port with shared faults and stats
+  stun             Start a STUN binding server (UDP and TCP) with wrong-answer modes
+  ntp              Start an SNTP server with a skewed, drifting, jittery or flapping clock
+  syslog           Start a syslog sink (UDP/TCP, RFC 3164/5424) keeping messages for the admin API
+  tftp             Start a TFTP server (read/write, blksize option) with packet loss and per-block delay
+  dns              Start a DNS stub resolver (A/AAAA/CNAME) with NXDOMAIN/SERVFAIL/truncation/delay faults
+                   (--dot-port/--doh-port add DNS over TLS/HTTPS with their own failure modes)
+  icmp             Answer pings with loss/delay (raw socket, needs root)
+  socks            Start a SOCKS5 proxy (CONNECT) with delay/drop/failure faults
+  sftp             Start an SSH server with SFTP and SCP over a directory, with transfer faults
+  ntrip            Start an NTRIP caster streaming RTCM3 corrections, with interruption scenarios
+  telnet           Start a Telnet responder (option negotiation, line echo, prompt, canned replies)
+  simulate-device  Act as a device: publish telemetry and answer commands
+  loadgen          Send telemetry from many virtual devices to a broker or HTTP endpoint (load testing)
+  mqtt-conformance Run MQTT spec checks against a broker (or the built-in one)
+  http-probe       Send edge-case requests to a device's HTTP server and report its answers
+  bisect           Find the minimal fault combination reproducing a device failure (via the admin API)
+  tail             Stream decoded live traffic from running servers (via the admin API)
+  syslog-dump      Print (and optionally clear) the messages a syslog sink received (via the admin API)
+  config-schema    Print the JSON Schema of the config file (for editors and config linting)
+  scenarios        List the ready-made fault scenarios (also served and applied by the admin API)
+  privbind         Bind privileged ports (53, 80, 443, ...) as root, then run a server without root
   version          Print version
 
 Global options:
@@ -246,6 +1848,48 @@ def main():
         cmd_http(args)
     elif command == 'mqtt':
         cmd_mqtt(args)
+    elif command == 'paired':
+        cmd_paired(args)
+    elif command == 'stun':
+        cmd_stun(args)
+    elif command == 'dns':
+        cmd_dns(args)
+    elif command == 'ntp':
+        cmd_ntp(args)
+    elif command == 'syslog':
+        cmd_syslog(args)
+    elif command == 'tftp':
+        cmd_tftp(args)
+    elif command == 'icmp':
+        cmd_icmp(args)
+    elif command == 'socks':
+        cmd_socks(args)
+    elif command == 'sftp':
+        cmd_sftp(args)
+    elif command == 'ntrip':
+        cmd_ntrip(args)
+    elif command == 'telnet':
+        cmd_telnet(args)
+    elif command == 'simulate-device':
+        cmd_simulate_device(args)
+    elif command == 'loadgen':
+        cmd_loadgen(args)
+    elif command == 'mqtt-conformance':
+        cmd_mqtt_conformance(args)
+    elif command == 'http-probe':
+        cmd_http_probe(args)
+    elif command == 'bisect':
+        cmd_bisect(args)
+    elif command == 'tail':
+        cmd_tail(args)
+    elif command == 'syslog-dump':
+        cmd_syslog_dump(args)
+    elif command == 'config-schema':
+        cmd_config_schema(args)
+    elif command == 'scenarios':
+        cmd_scenarios(args)
+    elif command == 'privbind':
+        cmd_privbind(args)
     elif command == 'version':
         print(f'yourtestsrv {VERSION}')
     else:
@@ -0,0 +1,506 @@
+"""ACME (RFC 8555) certificates for publicly reachable lab endpoints.
+
+Orders a certificate for the HTTP/MQTT TLS listeners from Let's Encrypt (or
+any ACME CA) and renews it while the server runs. Control of the names is
+proven with dns-01, publishing the TXT record through a hook command, or
+http-01, answering from a temporary responder on port 80. Stdlib only: the
+RSA keys, JWS signatures and CSR are built here.
+
+The dns-01 hook is called like lego's exec provider and must exit 0:
+
+  <hook> present _acme-challenge.example.com. <txt value>
+  <hook> cleanup _acme-challenge.example.com. <txt value>
+
+Files live under the state directory: account.key, and per certificate
+<first domain>/cert.pem (the full chain) and <first domain>/key.pem.
+"""
+
+import base64
+import calendar
+import hashlib
+import json
+import logging
+import math
+import os
+import secrets
+import shlex
+import subprocess
+import threading
+import time
+import urllib.error
+import urllib.request
+
+from yourtestsrv import netutil
+
+logger = logging.getLogger(__name__)
+
+LETSENCRYPT = 'https://acme-v02.api.letsencrypt.org/directory'
+LETSENCRYPT_STAGING = 'https://acme-staging-v02.api.letsencrypt.org/directory'
+CHALLENGES = ('dns-01', 'http-01')
+CHALLENGE_PATH = '/.well-known/acme-challenge/'
+
+RSA_ENCRYPTION = '1.2.840.113549.1.1.1'
+SHA256_WITH_RSA = '1.2.840.113549.1.1.11'
+COMMON_NAME = '2.5.4.3'
+EXTENSION_REQUEST = '1.2.840.113549.1.9.14'
+SUBJECT_ALT_NAME = '2.5.29.17'
+SHA256_DIGEST_INFO = bytes.fromhex('3031300d060960864801650304020105000420')
+SMALL_PRIMES = [p for p in range(3, 2000, 2) if all(p % d for d in range(3, math.isqrt(p) + 1, 2))]
+
+
+class ACMEError(Exception):
+    pass
+
+
+def b64url(data):
+    return base64.urlsafe_b64encode(data).rstrip(b'=').decode()
+
+
+def _der(tag, content):
+    size = len(content)
+    if size < 0x80:
+        return bytes([tag, size]) + content
+    length = size.to_bytes((size.bit_length() + 7) // 8, 'big')
+    return bytes([tag, 0x80 | len(length)]) + length + content
+
+
+def _der_int(value):
+    return _der(0x02, value.to_bytes(value.bit_length() // 8 + 1, 'big'))
+
+
+def _der_seq(*items):
+    return _der(0x30, b''.join(items))
+
+
+def _der_oid(dotted):
+    parts = [int(p) for p in dotted.split('.')]
+    body = bytearray([parts[0] * 40 + parts[1]])
+    for part in parts[2:]:
+        chunk = [part & 0x7f]
+        while part > 0x7f:
+            part >>= 7
+            chunk.append(0x80 | (part & 0x7f))
+        body += bytes(reversed(chunk))
+    return _der(0x06, bytes(body))
+
+
+def _der_read(data, pos=0):
+    """(tag, content, end) of the DER element at pos."""
+    tag, size = data[pos], data[pos + 1]
+    pos += 2
+    if size & 0x80:
+        count = size & 0x7f
+        size = int.from_bytes(data[pos:pos + count], 'big')
+        pos += count
+    if pos + size > len(data):
+        raise ValueError('truncated DER element')
+    return tag, data[pos:pos + size], pos + size
+
+
+def _der_children(content):
+    items, pos = [], 0
+    while pos < len(content):
+        tag, value, pos = _der_read(content, pos)
+        items.append((tag, value))
+    return items
+
+
+def _pem_blocks(text, label):
+    begin, end = f'-----BEGIN {label}-----', f'-----END {label}-----'
+    blocks = []
+    while begin in text:
+        start = text.index(begin) + len(begin)
+        stop = text.index(end, start)
+        blocks.append(base64.b64decode(''.join(text[start:stop].split())))
+        text = text[stop + len(end):]
+    return blocks
+
+
+def _pem(label, der):
+    body = base64.b64encode(der).decode()
+    lines = [body[i:i + 64] for i in range(0, len(body), 64)]
+    return f'-----BEGIN {label}-----\n' + '\n'.join(lines) + f'\n-----END {label}-----\n'
+
+
+def _probable_prime(n, rounds=40):
+    for p in SMALL_PRIMES:
+        if n % p == 0:
+            return n == p
+    d, s = n - 1, 0
+    while d % 2 == 0:
+        d, s = d // 2, s + 1
+    for _ in range(rounds):
+        x = pow(secrets.randbelow(n - 3) + 2, d, n)
+        if x in (1, n - 1):
+            continue
+        for _ in range(s - 1):
+            x = pow(x, 2, n)
+            if x == n - 1:
+                break
+        else:
+            return False
+    return True
+
+
+def _random_prime(bits):
+    while True:
+        # The top two bits make the product of two such primes exactly 2 * bits long.
+        candidate = secrets.randbits(bits) | (3 << (bits - 2)) | 1
+        if _probable_prime(candidate):
+            return candidate
+
+
+class RSAKey:
+    """An RSA key that signs RS256 (PKCS#1 v1.5 with SHA-256)."""
+
+    def __init__(self, n, e, d, p, q):
+        self.n, self.e, self.d, self.p, self.q = n, e, d, p, q
+        self.size = (n.bit_length() + 7) // 8
+
+    @classmethod
+    def generate(cls, bits=2048):
+        e = 65537
+        while True:
+            p, q = _random_prime(bits // 2), _random_prime(bits // 2)
+            phi = (p - 1) * (q - 1)
+            if p != q and math.gcd(e, phi) == 1:
+                return cls(p * q, e, pow(e, -1, phi), p, q)
+
+    @classmethod
+    def from_pem(cls, text):
+        blocks = _pem_blocks(text, 'RSA PRIVATE KEY')
+        if not blocks:
+            raise ValueError('no RSA PRIVATE KEY block')
+        _, content, _ = _der_read(blocks[0])
+        fields = [int.from_bytes(value, 'big') for _, value in _der_children(content)]
+        return cls(*fields[1:6])
+
+    def to_pem(self):
+        p, q, d = self.p, self.q, self.d
+        der = _der_seq(*(_der_int(v) for v in (0, self.n, self.e, d, p, q, d % (p - 1), d % (q - 1),
+                                               pow(q, -1, p))))
+        return _pem('RSA PRIVATE KEY', der)
+
+    def public_key_info(self):
+        """DER SubjectPublicKeyInfo."""
+        public = _der_seq(_der_int(self.n), _der_int(self.e))
+        return _der_seq(_der_seq(_der_oid(RSA_ENCRYPTION), b'\x05\x00'), _der(0x03, b'\x00' + public))
+
+    def sign(self, message):
+        digest = SHA256_DIGEST_INFO + hashlib.sha256(message).digest()
+        encoded = b'\x00\x01' + b'\xff' * (self.size - len(digest) - 3) + b'\x00' + digest
+        return pow(int.from_bytes(encoded, 'big'), self.d, self.n).to_bytes(self.size, 'big')
+
+    def jwk(self):
+        return {'e': b64url(self.e.to_bytes((self.e.bit_length() + 7) // 8, 'big')), 'kty': 'RSA',
+                'n': b64url(self.n.to_bytes(self.size, 'big'))}
+
+    def thumbprint(self):
+        """RFC 7638 JWK thumbprint, the account part of every key authorization."""
+        return b64url(hashlib.sha256(json.dumps(self.jwk(), sort_keys=True, separators=(',', ':')).encode()).digest())
+
+
+def make_csr(key, domains):
+    """DER PKCS#10 request for domains (all in subjectAltName, the first as CN when it fits)."""
+    subject = b''
+    if len(domains[0]) <= 64:
+        subject = _der(0x31, _der_seq(_der_oid(COMMON_NAME), _der(0x0c, domains[0].encode())))
+    names = _der_seq(*(_der(0x82, d.encode()) for d in domains))
+    extensions = _der_seq(_der_seq(_der_oid(SUBJECT_ALT_NAME), _der(0x04, names)))
+    attributes = _der(0xa0, _der_seq(_der_oid(EXTENSION_REQUEST), _der(0x31, extensions)))
+    info = _der_seq(_der_int(0), _der(0x30, subject), key.public_key_info(), attributes)
+    return _der_seq(info, _der_seq(_der_oid(SHA256_WITH_RSA), b'\x05\x00'), _der(0x03, b'\x00' + key.sign(info)))
+
+
+def certificate_not_after(pem):
+    """Expiry (epoch seconds) of the first certificate in a PEM chain."""
+    blocks = _pem_blocks(pem, 'CERTIFICATE')
+    if not blocks:
+        raise ValueError('no CERTIFICATE block')
+    _, cert, _ = _der_read(blocks[0])
+    _, tbs, _ = _der_read(cert)
+    fields = _der_children(tbs)
+    if fields[0][0] == 0xa0:
+        fields = fields[1:]
+    tag, not_after = _der_children(fields[3][1])[1]
+    text = not_after.decode()
+    if tag == 0x17:
+        # UTCTime: two-digit years 50-99 are 19xx.
+        text = ('19' if text[:2] >= '50' else '20') + text
+    return calendar.timegm(time.strptime(text, '%Y%m%d%H%M%SZ'))
+
+
+class DNSHookSolver:
+    """dns-01: a hook command publishes and removes the _acme-challenge TXT record."""
+
+    type = 'dns-01'
+
+    def __init__(self, hook, wait=30.0):
+        self.hook = hook
+        self.wait = wait
+
+    def present(self, domain, token, key_authorization):
+        self._run('present', domain, key_authorization)
+        if self.wait > 0:
+            logger.info(f'ACME waiting {self.wait}s for the TXT record of {domain} to propagate')
+            time.sleep(self.wait)
+
+    def cleanup(self, domain, token, key_authorization):
+        try:
+            self._run('cleanup', domain, key_authorization)
+        except ACMEError as e:
+            logger.warning(f'{e}')
+
+    def _run(self, action, domain, key_authorization):
+        fqdn = f'_acme-challenge.{domain}.'
+        value = b64url(hashlib.sha256(key_authorization.encode()).digest())
+        try:
+            result = subprocess.run([*shlex.split(self.hook), action, fqdn, value], capture_output=True,
+                                    text=True, timeout=300)
+        except (OSError, subprocess.TimeoutExpired) as e:
+            raise ACMEError(f'ACME dns hook {action} for {fqdn} failed: {e}') from e
+        if result.returncode != 0:
+            raise ACMEError(f'ACME dns hook {action} for {fqdn} exited {result.returncode}: '
+                            f'{result.stderr.strip()}')
+
+
+class HTTPSolver:
+    """http-01: serves key authorizations from a temporary listener while validation runs."""
+
+    type = 'http-01'
+
+    def __init__(self, port=80, bind='0.0.0.0'):
+        self.port = port
+        self.bind = bind
+        self.tokens = {}
+        self._stop = None
+        self._thread = None
+
+    def present(self, domain, token, key_authorization):
+        if self._thread is None:
+            from yourtestsrv.http_server import HTTPServer
+            try:
+                sock = netutil.listen_tcp(self.bind, self.port)
+            except OSError as e:
+                raise ACMEError(f'ACME http-01 responder cannot listen on port {self.port}: {e}') from e
+            self._stop = threading.Event()
+            srv = HTTPServer(self.port, self.bind, handler=self._handle)
+            self._thread = threading.Thread(target=srv.serve, args=(self._stop, sock), daemon=True)
+            self._thread.start()
+        self.tokens[token] = key_authorization
+
+    def cleanup(self, domain, token, key_authorization):
+        self.tokens.pop(token, None)
+        if not self.tokens and self._thread is not None:
+            self._stop.set()
+            self._thread.join(5.0)
+            self._thread = None
+
+    def _handle(self, req):
+        from yourtestsrv.http_server import HTTPResponse
+        path = req.path.split('?')[0]
+        value = self.tokens.get(path[len(CHALLENGE_PATH):]) if path.startswith(CHALLENGE_PATH) else None
+        if value is None:
+            return HTTPResponse(404, 'Not Found', {'Content-Type': 'text/plain'}, b'not found\n')
+        return HTTPResponse(200, 'OK', {'Content-Type': 'application/octet-stream'}, value.encode())
+
+
+class ACMEClient:
+    """Account and orders against one ACME directory, signing with account_key."""
+
+    poll_interval = 2.0
+
+    def __init__(self, directory_url, account_key, email='', timeout=120.0):
+        self.directory_url = directory_url
+        self.key = account_key
+        self.email = email
+        self.timeout = timeout
+        self.kid = None
+        self._directory = None
+        self._nonce = None
+
+    def _http(self, method, url, body=None, headers=None):
+        request = urllib.request.Request(url, data=body, method=method, headers=headers or {})
+        try:
+            with urllib.request.urlopen(request, timeout=30) as resp:
+                status, headers, data = resp.status, resp.headers, resp.read()
+        except urllib.error.HTTPError as e:
+            status, headers, data = e.code, e.headers, e.read()
+        except (urllib.error.URLError, OSError) as e:
+            raise ACMEError(f'ACME request to {url} failed: {getattr(e, "reason", e)}') from e
+        if headers.get('Replay-Nonce'):
+            self._nonce = headers['Replay-Nonce']
+        return status, headers, data
+
+    def directory(self):
+        if self._directory is None:
+            status, _, data = self._http('GET', self.directory_url)
+            if status != 200:
+                raise ACMEError(f'ACME directory {self.directory_url} answered {status}')
+            self._directory = json.loads(data)
+        return self._directory
+
+    def _take_nonce(self):
+        if not self._nonce:
+            self._http('HEAD', self.directory()['newNonce'])
+        nonce, self._nonce = self._nonce, None
+        if not nonce:
+            raise ACMEError('ACME server sent no Replay-Nonce')
+        return nonce
+
+    def post(self, url, payload):
+        """POST payload as a JWS (None is POST-as-GET); returns (headers, body).
+
+        A badNonce rejection is retried once with the fresh nonce it carries.
+        """
+        for attempt in range(2):
+            protected = {'alg': 'RS256', 'nonce': self._take_nonce(), 'url': url}
+            if self.kid:
+                protected['kid'] = self.kid
+            else:
+                protected['jwk'] = self.key.jwk()
+            protected = b64url(json.dumps(protected).encode())
+            encoded = '' if payload is None else b64url(json.dumps(payload).encode())
+            signature = b64url(self.key.sign(f'{protected}.{encoded}'.encode()))
+            body = json.dumps({'protected': protected, 'payload': encoded, 'signature': signature}).encode()
+            status, headers, data = self._http('POST', url, body, {'Content-Type': 'application/jose+json'})
+            if status < 400:
+                return headers, data
+            try:
+                problem = json.loads(data)
+            except ValueError:
+                problem = {}
+            if problem.get('type') == 'urn:ietf:params:acme:error:badNonce' and not attempt:
+                continue
+            raise ACMEError(f'ACME {url} answered {status}: {problem.get("detail") or problem.get("type") or ""}')
+
+    def register(self):
+        payload = {'termsOfServiceAgreed': True}
+        if self.email:
+            payload['contact'] = [f'mailto:{self.email}']
+        headers, _ = self.post(self.directory()['newAccount'], payload)
+        self.kid = headers['Location']
+
+    def _poll(self, url, waiting):
+        deadline = time.monotonic() + self.timeout
+        while True:
+            _, data = self.post(url, None)
+            obj = json.loads(data)
+            if obj.get('status') not in waiting:
+                return obj
+            if time.monotonic() > deadline:
+                raise ACMEError(f'ACME {url} still {obj.get("status")} after {self.timeout}s')
+            time.sleep(self.poll_interval)
+
+    def _authorize(self, url, solver):
+        _, data = self.post(url, None)
+        authz = json.loads(data)
+        if authz['status'] == 'valid':
+            return
+        domain = authz['identifier']['value']
+        challenge = next((c for c in authz['challenges'] if c['type'] == solver.type), None)
+        if challenge is None:
+            raise ACMEError(f'ACME server offers no {solver.type} challenge for {domain}')
+        key_authorization = f'{challenge["token"]}.{self.key.thumbprint()}'
+        solver.present(domain, challenge['token'], key_authorization)
+        try:
+            self.post(challenge['url'], {})
+            authz = self._poll(url, ('pending',))
+        finally:
+            solver.cleanup(domain, challenge['token'], key_authorization)
+        if authz['status'] != 'valid':
+            errors = [c['error'].get('detail', '') for c in authz['challenges'] if c.get('error')]
+            raise ACMEError(f'ACME authorization for {domain} is {authz["status"]}: {"; ".join(errors)}')
+        logger.info(f'ACME authorization for {domain} valid ({solver.type})')
+
+    def issue(self, domains, cert_key, solver):
+        """Order, prove and finalize a certificate for domains; returns the PEM chain."""
+        if not self.kid:
+            self.register()
+        headers, data = self.post(self.directory()['newOrder'],
+                                  {'identifiers': [{'type': 'dns', 'value': d} for d in domains]})
+        order_url, order = headers['Location'], json.loads(data)
+        for authz_url in order['authorizations']:
+            self._authorize(authz_url, solver)
+        _, data = self.post(order['finalize'], {'csr': b64url(make_csr(cert_key, domains))})
+        order = json.loads(data)
+        if order['status'] != 'valid':
+            order = self._poll(order_url, ('pending', 'ready', 'processing'))
+        if order['status'] != 'valid':
+            raise ACMEError(f'ACME order for {", ".join(domains)} is {order["status"]}')
+        _, chain = self.post(order['certificate'], None)
+        return chain.decode()
+
+
+def certificate_paths(state_dir, domains):
+    base = os.path.join(state_dir, domains[0].replace('*', '_'))
+    return os.path.join(base, 'cert.pem'), os.path.join(base, 'key.pem')
+
+
+def needs_renewal(cert_file, renew_before):
+    try:
+        with open(cert_file) as f:
+            not_after = certificate_not_after(f.read())
+    except (OSError, ValueError, IndexError):
+        return True
+    return not_after - time.time() < renew_before
+
+
+def _write_private(path, text):
+    tmp = path + '.tmp'
+    fd = os.open(tmp, os.O_WRONLY | os.O_CREAT | os.O_TRUNC, 0o600)
+    with os.fdopen(fd, 'w') as f:
+        f.write(text)
+    os.replace(tmp, path)
+
+
+def load_account_key(path, bits=2048):
+    """The account key at path, generated and saved on first use."""
+    try:
+        with open(path) as f:
+            return RSAKey.from_pem(f.read())
+    except FileNotFoundError:
+        key = RSAKey.generate(bits)
+        os.makedirs(os.path.dirname(path) or '.', exist_ok=True)
+        _write_private(path, key.to_pem())
+        return key
+
+
+def ensure_certificate(cfg, bind='0.0.0.0', key_bits=2048):
+    """Return (cert_file, key_file) for cfg.domains, ordering a certificate when missing or due for renewal.
+
+    cfg carries the server.tls.acme settings (config.ACMEConfig).
+    """
+    cert_file, key_file = certificate_paths(cfg.dir, cfg.domains)
+    if not needs_renewal(cert_file, cfg.renew_before):
+        return cert_file, key_file
+    logger.info(f'ACME ordering a certificate for {", ".join(cfg.domains)} from {cfg.directory} ({cfg.challenge})')
+    client = ACMEClient(cfg.directory, load_account_key(os.path.join(cfg.dir, 'account.key'), key_bits), cfg.email)
+    if cfg.challenge == 'dns-01':
+        solver = DNSHookSolver(cfg.dns_hook, cfg.dns_wait)
+    else:
+        solver = HTTPSolver(cfg.http_port, bind)
+    cert_key = RSAKey.generate(key_bits)
+    chain = client.issue(cfg.domains, cert_key, solver)
+    os.makedirs(os.path.dirname(cert_file), exist_ok=True)
+    _write_private(key_file, cert_key.to_pem())
+    with open(cert_file + '.tmp', 'w') as f:
+        f.write(chain)
+    os.replace(cert_file + '.tmp', cert_file)
+    logger.info(f'ACME certificate saved to {cert_file}, valid until '
+                f'{time.strftime("%Y-%m-%d %H:%M", time.gmtime(certificate_not_after(chain)))} UTC')
+    return cert_file, key_file
+
+
+def keep_renewed(cfg, stop_event, bind='0.0.0.0', check_every=43200.0):
+    """Renew the certificate when it gets due and swap it into the running TLS listeners."""
+    while not stop_event.wait(check_every):
+        cert_file, key_file = certificate_paths(cfg.dir, cfg.domains)
+        if not needs_renewal(cert_file, cfg.renew_before):
+            continue
+        try:
+            ensure_certificate(cfg, bind)
+            logger.info(f'ACME renewed certificate loaded into {netutil.reload_certificates(cert_file, key_file)} '
+                        f'TLS listener(s)')
+        except (ACMEError, OSError, ValueError) as e:
+            logger.error(f'ACME renewal failed, retrying in {check_every:.0f}s: {e}')
@@ -0,0 +1,341 @@
+import json
+import logging
+import re
+import sys
+import threading
+import traceback
+import tracemalloc
+from urllib.parse import parse_qs
+
+from yourtestsrv import handlers, scenarios, stats, storage, syslog_server, traffic
+from yourtestsrv.clock import VirtualClock
+from yourtestsrv.config import parse_duration
+from yourtestsrv.http_server import HTTPServer, HTTPResponse
+from yourtestsrv.mqtt_server import load_mqtt_state
+from yourtestsrv.payload import make_generator
+from yourtestsrv.session import SessionManager
+
+logger = logging.getLogger(__name__)
+
+# Idle seconds before GET /traffic sends a blank keep-alive line (which also detects gone clients).
+TRAFFIC_HEARTBEAT = 15.0
+
+
+def json_response(code, message, obj):
+    body = (json.dumps(obj, indent=2, sort_keys=True) + '\n').encode()
+    return HTTPResponse(code, message, {'Content-Type': 'application/json'}, body)
+
+
+def text_response(text):
+    return HTTPResponse(200, 'OK', {'Content-Type': 'text/plain'}, text.encode())
+
+
+class AdminServer(HTTPServer):
+    """Admin API for inspecting the running servers.
+
+    Built on the custom HTTP server so it needs no extra dependencies.
+    Binds to localhost by default.
+    """
+
+    stats_name = 'admin'
+    tap_traffic = False
+
+    def __init__(self, port, bind='127.0.0.1', mqtt_servers=(), pprof=False, clock=None, servers=()):
+        super().__init__(port, bind or '127.0.0.1', clock=clock)
+        self.mqtt_servers = list(mqtt_servers)
+        # Servers whose handlers /handlers manages (besides those of sessions).
+        self.servers = list(servers)
+        self.pprof = pprof
+        self.sessions = SessionManager()
+        self._stop_event = threading.Event()
+
+    def serve(self, stop_event, sock):
+        self._stop_event = stop_event
+        try:
+            super().serve(stop_event, sock)
+        finally:
+            self.sessions.close_all()
+
+    def _default_handle(self, req):
+        path = req.path.split('?', 1)[0]
+        if req.method == 'GET' and path == '/stats':
+            return json_response(200, 'OK', stats.snapshot())
+        if req.method == 'POST' and path == '/mqtt/publish':
+            return self._mqtt_publish(req)
+        if req.method == 'POST' and path == '/mqtt/redirect':
+            return self._mqtt_redirect(req)
+        if path.startswith('/mqtt/state'):
+            return self._mqtt_state(req, path)
+        if path == '/sessions' or path.startswith('/sessions/'):
+            return self._sessions(req, path[len('/sessions/'):])
+        if path == '/scenarios' or path.startswith('/scenarios/'):
+            return self._scenarios(req, path[len('/scenarios/'):])
+        if path == '/clock' or path == '/clock/advance':
+            return self._clock(req, path)
+        if path == '/handlers' or path.startswith('/handlers/'):
+            return self._handlers(req, path[len('/handlers/'):])
+        if req.method == 'GET' and path == '/traffic':
+            return self._traffic(req)
+        if path == '/syslog':
+            return self._syslog(req)
+        if req.method == 'GET' and path == '/debug/connections':
+            return json_response(200, 'OK', stats.connections.snapshot())
+        if req.method == 'GET' and path == '/debug/zombies':
+            return json_response(200, 'OK', [c for c in stats.connections.snapshot() if 'zombie' in c['flags']])
+        if req.method == 'GET' and path.startswith('/debug/pprof/'):
+            return self._pprof(path[len('/debug/pprof/'):])
+        return json_response(404, 'Not Found', {'error': f'no such endpoint: {req.method} {path}'})
+
+    def _mqtt_publish(self, req):
+        """Inject a message into every MQTT server.
+
+        Body: {"topic": ..., one of "payload" (text), "payload_hex" or
+        "generator" (payload spec), optional "qos", "retain" and "session"
+        to target that session's MQTT servers instead}.
+        """
+        try:
+            body = json.loads(req.body or b'{}')
+            topic = body['topic']
+            if 'generator' in body:
+                payload = make_generator(body['generator']).next()
+            elif 'payload_hex' in body:
+                payload = bytes.fromhex(body['payload_hex'])
+            else:
+                payload = body.get('payload', '').encode()
+        except (ValueError, KeyError, TypeError, AttributeError) as e:
+            return json_response(400, 'Bad Request', {'error': f'invalid publish request: {e}'})
+        servers = self.mqtt_servers
+        if 'session' in body:
+            session = self.sessions.get(body['session'])
+            if session is None:
+                return json_response(404, 'Not Found', {'error': f'no such session: {body["session"]}'})
+            servers = session.mqtt_servers()
+        delivered = sum(srv.publish(topic, payload, body.get('qos', 0), body.get('retain', False))
+                        for srv in servers)
+        return json_response(200, 'OK', {'delivered': delivered})
+
+    def _mqtt_redirect(self, req):
+        """Redirect every MQTT server's clients: {"reference": "host:port", optional
+        "code" (use_another_server or server_moved)}; an empty reference ends the redirect.
+        """
+        try:
+            body = json.loads(req.body or b'{}')
+            reference = body['reference']
+            disconnected = sum(srv.redirect_clients(reference, body.get('code', 'use_another_server'))
+                               for srv in self.mqtt_servers)
+        except (ValueError, KeyError, TypeError) as e:
+            return json_response(400, 'Bad Request', {'error': f'invalid redirect request: {e}'})
+        return json_response(200, 'OK', {'disconnected': disconnected})
+
+    def _mqtt_state(self, req, path):
+        """GET /mqtt/state; POST /mqtt/state/export {"path"} saves it under that name in the storage
+        (a file by default); POST /mqtt/state/load {"path"} or {"state": {...}} preloads every MQTT server.
+        """
+        if req.method == 'GET' and path == '/mqtt/state':
+            return json_response(200, 'OK', self._merged_mqtt_state())
+        if req.method != 'POST' or path not in ('/mqtt/state/export', '/mqtt/state/load'):
+            return json_response(405, 'Method Not Allowed', {'error': f'{req.method} not allowed here'})
+        try:
+            body = json.loads(req.body or b'{}')
+            if path == '/mqtt/state/export':
+                state = self._merged_mqtt_state()
+                storage.get().save(body['path'], state)
+                return json_response(200, 'OK', {'path': body['path'], 'retained': len(state['retained']),
+                                                 'subscriptions': len(state['subscriptions'])})
+            state = body['state'] if 'state' in body else load_mqtt_state(body['path'])
+            counts = [srv.load_state(state) for srv in self.mqtt_servers]
+        except (ValueError, KeyError, TypeError, AttributeError) as e:
+            return json_response(400, 'Bad Request', {'error': f'invalid state request: {e}'})
+        except OSError as e:
+            return json_response(500, 'Internal Server Error', {'error': str(e)})
+        retained, subscriptions = counts[0] if counts else (0, 0)
+        return json_response(200, 'OK', {'servers': len(counts), 'retained': retained,
+                                         'subscriptions': subscriptions})
+
+    def _merged_mqtt_state(self):
+        merged = {'retained': [], 'subscriptions': {}}
+        topics = set()
+        for srv in self.mqtt_servers:
+            state = srv.export_state()
+            merged['retained'] += [e for e in state['retained'] if e['topic'] not in topics]
+            topics.update(e['topic'] for e in state['retained'])
+            merged['subscriptions'].update(state['subscriptions'])
+        return merged
+
+    def _sessions(self, req, name):
+        """GET/POST /sessions, GET/DELETE /sessions/<name>; see session.py for the spec."""
+        if not name:
+            if req.method == 'GET':
+                return json_response(200, 'OK', [session.snapshot() for session in self.sessions.list()])
+            if req.method == 'POST':
+                try:
+                    spec = json.loads(req.body or b'{}')
+                    session = self.sessions.create(spec)
+                except (ValueError, TypeError, AttributeError) as e:
+                    return json_response(400, 'Bad Request', {'error': f'invalid session: {e}'})
+                except OSError as e:
+                    return json_response(409, 'Conflict', {'error': f'cannot listen: {e}'})
+                return json_response(201, 'Created', session.snapshot())
+        elif req.method == 'GET':
+            session = self.sessions.get(name)
+            if session:
+                return json_response(200, 'OK', session.snapshot())
+            return json_response(404, 'Not Found', {'error': f'no such session: {name}'})
+        elif req.method == 'DELETE':
+            if self.sessions.delete(name):
+                return json_response(200, 'OK', {'deleted': name})
+            return json_response(404, 'Not Found', {'error': f'no such session: {name}'})
+        return json_response(405, 'Method Not Allowed', {'error': f'{req.method} not allowed here'})
+
+    def _scenarios(self, req, name):
+        """GET /scenarios (?format=text for a table), GET /scenarios/<name>; POST /scenarios/<name>
+        {"session", "params", "bind"} creates a session running it. See scenarios.py.
+        """
+        if not name:
+            if req.method != 'GET':
+                return json_response(405, 'Method Not Allowed', {'error': f'{req.method} not allowed here'})
+            query = parse_qs(req.path.partition('?')[2])
+            if query.get('format') == ['text']:
+                return text_response(scenarios.format_table())
+            return json_response(200, 'OK', [scenarios.summary(n) for n in scenarios.NAMES])
+        if name not in scenarios.SCENARIOS:
+            return json_response(404, 'Not Found', {'error': f'no such scenario: {name}'})
+        if req.method == 'GET':
+            return json_response(200, 'OK', scenarios.describe(name))
+        if req.method != 'POST':
+            return json_response(405, 'Method Not Allowed', {'error': f'{req.method} not allowed here'})
+        try:
+            body = json.loads(req.body or b'{}')
+            spec = scenarios.session_spec(name, body.get('params'), body.get('session', ''), body.get('bind', ''))
+            session = self.sessions.create(spec)
+        except (ValueError, TypeError, AttributeError) as e:
+            return json_response(400, 'Bad Request', {'error': f'invalid scenario request: {e}'})
+        except OSError as e:
+            return json_response(409, 'Conflict', {'error': f'cannot listen: {e}'})
+        logger.info(f'Scenario {name} applied as session {session.name}')
+        return json_response(201, 'Created', {'scenario': name, **session.snapshot()})
+
+    def _syslog(self, req):
+        """GET /syslog?severity=&facility=&host=&app=&text=&since=&limit= lists the received syslog
+        messages; DELETE /syslog forgets them. See syslog_server.py.
+        """
+        if req.method == 'DELETE':
+            return json_response(200, 'OK', {'cleared': syslog_server.log.clear()})
+        if req.method != 'GET':
+            return json_response(405, 'Method Not Allowed', {'error': f'{req.method} not allowed here'})
+        query = {k: v[-1] for k, v in parse_qs(req.path.partition('?')[2]).items()}
+        try:
+            unknown = set(query) - {'severity', 'facility', 'host', 'app', 'text', 'since', 'limit'}
+            if unknown:
+                raise ValueError(f'unknown filters: {", ".join(sorted(unknown))}')
+            messages = syslog_server.log.query(**query)
+        except ValueError as e:
+            return json_response(400, 'Bad Request', {'error': f'invalid syslog query: {e}'})
+        return json_response(200, 'OK', messages)
+
+    def _handler_servers(self):
+        servers = self.servers + [srv for session in self.sessions.list() for _, srv in session.servers]
+        return [srv for srv in servers if hasattr(srv, 'handlers')]
+
+    def _handlers(self, req, name):
+        """GET /handlers; PUT /handlers/<name> {"server": "http:8080" or "http", ...spec};
+        DELETE /handlers/<name>. See handlers.py for the specs.
+        """
+        servers = self._handler_servers()
+        if not name:
+            if req.method != 'GET':
+                return json_response(405, 'Method Not Allowed', {'error': f'{req.method} not allowed here'})
+            installed = [{'name': n, 'server': srv.stats_key, **spec}
+                         for srv in servers for n, spec in srv.handlers.snapshot().items()]
+            return json_response(200, 'OK', installed)
+        if req.method == 'DELETE':
+            removed = [srv.stats_key for srv in servers if srv.handlers.remove(name)]
+            if not removed:
+                return json_response(404, 'Not Found', {'error': f'no such handler: {name}'})
+            logger.info(f'Handler {name} removed from {", ".join(removed)}')
+            return json_response(200, 'OK', {'deleted': name, 'servers': removed})
+        if req.method != 'PUT':
+            return json_response(405, 'Method Not Allowed', {'error': f'{req.method} not allowed here'})
+        try:
+            spec = json.loads(req.body or b'{}')
+            key = spec.pop('server')
+            targets = [srv for srv in servers if key in (srv.stats_key, srv.stats_name)]
+            built = [(srv, handlers.build(srv.stats_name, spec)) for srv in targets]
+        except (ValueError, KeyError, TypeError, AttributeError) as e:
+            return json_response(400, 'Bad Request', {'error': f'invalid handler: {e}'})
+        if not built:
+            return json_response(404, 'Not Found', {'error': f'no such server: {key}'})
+        replaced = [srv.handlers.set(name, handler) for srv, handler in built]
+        keys = [srv.stats_key for srv, _ in built]
+        logger.info(f'Handler {name} installed on {", ".join(keys)}')
+        if any(replaced):
+            return json_response(200, 'OK', {'name': name, 'servers': keys, 'replaced': True})
+        return json_response(201, 'Created', {'name': name, 'servers': keys, 'replaced': False})
+
+    def _clock(self, req, path):
+        """GET /clock; POST /clock/advance {"by": "5s"} moves a virtual clock forward."""
+        virtual = isinstance(self.clock, VirtualClock)
+        if req.method == 'POST' and path == '/clock/advance':
+            if not virtual:
+                return json_response(409, 'Conflict', {'error': 'clock is not virtual, start with --virtual-clock'})
+            try:
+                by = parse_duration(json.loads(req.body or b'{}').get('by', '0s'))
+                self.clock.advance(by)
+            except (ValueError, TypeError, AttributeError) as e:
+                return json_response(400, 'Bad Request', {'error': f'invalid advance request: {e}'})
+        elif req.method != 'GET' or path != '/clock':
+            return json_response(405, 'Method Not Allowed', {'error': f'{req.method} not allowed here'})
+        return json_response(200, 'OK', {'time': self.clock.time(), 'virtual': virtual})
+
+    def _traffic(self, req):
+        """Stream live traffic events as NDJSON until the client goes away.
+
+        Query: protocol, topic (MQTT filter), path (regex) and client, all optional.
+        """
+        query = parse_qs(req.path.partition('?')[2])
+        filters = {k: query[k][-1] for k in ('protocol', 'topic', 'path', 'client') if k in query}
+        try:
+            sub = traffic.subscribe(**filters)
+        except (ValueError, re.error) as e:
+            return json_response(400, 'Bad Request', {'error': f'invalid traffic filter: {e}'})
+        logger.info(f'Traffic tap opened: {filters or "all traffic"}')
+
+        def stream():
+            idle = 0.0
+            try:
+                while not self._stop_event.is_set():
+                    event = sub.get(1.0)
+                    if event is not None:
+                        idle = 0.0
+                        yield (json.dumps(event) + '\n').encode()
+                        continue
+                    idle += 1.0
+                    if idle >= TRAFFIC_HEARTBEAT:
+                        idle = 0.0
+                        yield b'\n'
+            finally:
+                traffic.unsubscribe(sub)
+                logger.info(f'Traffic tap closed: {filters or "all traffic"} ({sub.dropped} events dropped)')
+        return HTTPResponse(200, 'OK', {'Content-Type': 'application/x-ndjson'}, stream=stream())
+
+    def _pprof(self, profile):
+        """Python counterparts of Go's pprof: heap (tracemalloc) and thread stacks."""
+        if not self.pprof:
+            return json_response(404, 'Not Found', {'error': 'profiling disabled, start with --pprof'})
+        if profile == 'heap':
+            if not tracemalloc.is_tracing():
+                tracemalloc.start()
+            snapshot = tracemalloc.take_snapshot()
+            top = snapshot.statistics('lineno')[:50]
+            current, peak = tracemalloc.get_traced_memory()
+            lines = [f'traced: current={current} peak={peak}']
+            lines += [str(stat) for stat in top]
+            return text_response('\n'.join(lines) + '\n')
+        if profile == 'threads':
+            names = {t.ident: t.name for t in threading.enumerate()}
+            lines = []
+            for ident, frame in sys._current_frames().items():
+                lines.append(f'--- {names.get(ident, ident)}')
+                lines.extend(line.rstrip() for line in traceback.format_stack(frame))
+            return text_response('\n'.join(lines) + '\n')
+        return json_response(404, 'Not Found', {'error': f'unknown profile: {profile}'})
@@ -0,0 +1,185 @@
+"""Declarative binary message templates for TCP/UDP stub responses.
+
+A template is a list of fields encoded in order:
+
+  {"endian": "big", "fields": [
+    {"name": "magic", "type": "u16", "value": 43981},
+    {"name": "len",   "type": "u8",  "length_of": ["cmd", "data"]},
+    {"name": "cmd",   "type": "u8",  "value": 129},
+    {"name": "seq",   "type": "bytes", "from_request": [2, 4]},
+    {"name": "data",  "type": "bytes", "hex": "0a0b"},
+    {"name": "crc",   "type": "u16", "endian": "little",
+     "checksum": "crc16_modbus", "over": ["len", "cmd", "seq", "data"]}
+  ]}
+
+Integer types are u8/u16/u32/u64 and i8/i16/i32/i64; "endian" may be set
+per field or for the whole template. "bytes" fields take "hex", "text" or
+"from_request" ([start, end] slice of the request; end may be null).
+"length_of" and "checksum" fields are computed from the encoded bytes of
+the named fields ("over" defaults to every field before the checksum).
+"""
+
+import struct
+import zlib
+
+_INT_FORMATS = {
+    'u8': 'B', 'u16': 'H', 'u32': 'I', 'u64': 'Q',
+    'i8': 'b', 'i16': 'h', 'i32': 'i', 'i64': 'q',
+}
+
+
+def crc16_modbus(data):
+    crc = 0xFFFF
+    for b in data:
+        crc ^= b
+        for _ in range(8):
+            crc = (crc >> 1) ^ 0xA001 if crc & 1 else crc >> 1
+    return crc
+
+
+def crc16_ccitt(data):
+    """CRC-16/CCITT-FALSE (poly 0x1021, init 0xFFFF)."""
+    crc = 0xFFFF
+    for b in data:
+        crc ^= b << 8
+        for _ in range(8):
+            crc = ((crc << 1) ^ 0x1021) & 0xFFFF if crc & 0x8000 else (crc << 1) & 0xFFFF
+    return crc
+
+
+def crc16_xmodem(data):
+    crc = 0
+    for b in data:
+        crc ^= b << 8
+        for _ in range(8):
+            crc = ((crc << 1) ^ 0x1021) & 0xFFFF if crc & 0x8000 else (crc << 1) & 0xFFFF
+    return crc
+
+
+def _xor8(data):
+    value = 0
+    for b in data:
+        value ^= b
+    return value
+
+
+CHECKSUMS = {
+    'crc16_modbus': crc16_modbus,
+    'crc16_ccitt': crc16_ccitt,
+    'crc16_xmodem': crc16_xmodem,
+    'crc32': lambda data: zlib.crc32(data) & 0xFFFFFFFF,
+    'sum8': lambda data: sum(data) & 0xFF,
+    'xor8': _xor8,
+}
+
+
+class Field:
+    def __init__(self, spec, endian):
+        self.name = spec.get('name', '')
+        self.type = spec.get('type', 'bytes')
+        self.spec = spec
+        endian = spec.get('endian', endian)
+        if endian not in ('big', 'little'):
+            raise ValueError(f'unknown endian: {endian!r}')
+        if self.type in _INT_FORMATS:
+            self.format = ('>' if endian == 'big' else '<') + _INT_FORMATS[self.type]
+        elif self.type != 'bytes':
+            raise ValueError(f'unknown field type: {self.type!r}')
+        self.length_of = spec.get('length_of')
+        self.checksum = spec.get('checksum')
+        if self.checksum is not None and self.checksum not in CHECKSUMS:
+            raise ValueError(f'unknown checksum: {self.checksum!r}')
+        if self.type == 'bytes' and (self.length_of is not None or self.checksum is not None):
+            raise ValueError(f'field {self.name!r}: computed fields must be integers')
+        if self.type == 'bytes':
+            if 'hex' in spec:
+                self.data = bytes.fromhex(spec['hex'])
+            elif 'text' in spec:
+                self.data = spec['text'].encode()
+            elif 'from_request' not in spec:
+                raise ValueError(f'field {self.name!r}: bytes need "hex", "text" or "from_request"')
+        elif self.length_of is None and self.checksum is None:
+            self.pack(spec.get('value', 0))
+
+    @property
+    def computed(self):
+        return self.length_of is not None or self.checksum is not None
+
+    def pack(self, value):
+        try:
+            return struct.pack(self.format, value)
+        except struct.error as e:
+            raise ValueError(f'field {self.name!r}: {e}')
+
+    def encode(self, request):
+        if self.type == 'bytes':
+            if 'from_request' in self.spec:
+                start, end = self.spec['from_request']
+                return request[start:end]
+            return self.data
+        return self.pack(self.spec.get('value', 0))
+
+
+class BinaryTemplate:
+    def __init__(self, spec):
+        if isinstance(spec, list):
+            spec = {'fields': spec}
+        endian = spec.get('endian', 'big')
+        self.fields = [Field(f, endian) for f in spec.get('fields', [])]
+        if not self.fields:
+            raise ValueError('binary template needs at least one field')
+        names = [f.name for f in self.fields]
+        for field in self.fields:
+            refs = field.length_of if field.length_of is not None else field.spec.get('over')
+            if refs is None:
+                continue
+            for ref in refs:
+                if ref not in names:
+                    raise ValueError(f'field {field.name!r} refers to unknown field {ref!r}')
+        self.build()
+
+    def build(self, request=b''):
+        """Encode the template, filling computed fields; request feeds from_request."""
+        parts = [None if f.computed else f.encode(request) for f in self.fields]
+        # Lengths first (they may be covered by a checksum), then checksums in order.
+        for i, field in enumerate(self.fields):
+            if field.length_of is not None:
+                parts[i] = field.pack(sum(len(self._part(parts, ref)) for ref in field.length_of))
+        for i, field in enumerate(self.fields):
+            if field.checksum is not None:
+                over = field.spec.get('over')
+                if over is None:
+                    data = b''.join(parts[:i])
+                else:
+                    data = b''.join(self._part(parts, ref) for ref in over)
+                parts[i] = field.pack(CHECKSUMS[field.checksum](data))
+        return b''.join(parts)
+
+    def _part(self, parts, name):
+        for field, part in zip(self.fields, parts):
+            if field.name == name:
+                if part is None:
+                    raise ValueError(f'field {name!r} is computed after the field that refers to it')
+                return part
+        raise ValueError(f'unknown field {name!r}')
+
+
+class FixedResponse:
+    """A canned reply sent unchanged for every request; same interface as BinaryTemplate."""
+
+    def __init__(self, data):
+        if not data:
+            raise ValueError('canned response must not be empty')
+        self.data = data
+
+    @classmethod
+    def from_hex(cls, text):
+        return cls(bytes.fromhex(text))
+
+    @classmethod
+    def from_file(cls, path):
+        with open(path, 'rb') as f:
+            return cls(f.read())
+
+    def build(self, request=b''):
+        return self.data
@@ -0,0 +1,192 @@
+"""Find the smallest fault combination that still reproduces a device failure.
+
+A bisect spec names the faults to narrow down and the test that detects the
+failure:
+
+  {"admin": "127.0.0.1:9090",
+   "server": {"type": "tcp", "port": 9500},
+   "faults": {"delay": "2s", "corrupt_rate": 0.01, "rate_limit": "8kbps",
+              "reset": {"close_mode": "rst", "close_after_bytes": 100}},
+   "command": "./device-test.sh {host} {port}",
+   "timeout": "60s", "repeat": 1}
+
+server holds the options every run shares (the session server spec); each
+fault is one knob: a server option and its value, or a named group of
+options set together. For every candidate combination a session is created
+through the admin API, command runs with {addr}, {host} and {port} (also in
+YOURTESTSRV_ADDR) pointing at it, and the session is deleted again. A
+non-zero exit status or running past timeout counts as a failure; with
+repeat the command runs up to that many times and any failure counts, for
+flaky bugs.
+
+The search is delta debugging (ddmin): it first confirms that all faults
+together fail and none pass, then removes faults in halves, quarters, ...
+until no single fault can be dropped. Results are cached per combination.
+"""
+
+import http.client
+import json
+import os
+import subprocess
+import time
+
+from yourtestsrv.config import parse_duration
+
+
+class BisectSpec:
+    def __init__(self, faults, command='', server=None, admin='127.0.0.1:9090', timeout='60s', repeat=1):
+        if not faults:
+            raise ValueError('bisect needs at least one fault')
+        self.faults = {name: value if isinstance(value, dict) else {name: value} for name, value in faults.items()}
+        self.command = command
+        self.server = dict(server or {'type': 'tcp'})
+        self.server.setdefault('type', 'tcp')
+        self.admin = admin
+        self.timeout = parse_duration(timeout)
+        self.repeat = int(repeat)
+        if self.repeat < 1:
+            raise ValueError(f'bisect repeat must be at least 1: {repeat}')
+
+    def options(self, names):
+        """The session server spec with the named faults switched on."""
+        options = dict(self.server)
+        for name in names:
+            options.update(self.faults[name])
+        return options
+
+
+class Run:
+    def __init__(self, faults, failed, duration, detail=''):
+        self.faults = faults
+        self.failed = failed
+        self.duration = duration
+        self.detail = detail
+
+    def to_dict(self):
+        return {'faults': self.faults, 'failed': self.failed, 'duration': round(self.duration, 3),
+                'detail': self.detail}
+
+
+class AdminRunner:
+    """Runs the test command against a session created through the admin API."""
+
+    BIND_RETRY = 5.0
+
+    def __init__(self, spec):
+        self.spec = spec
+        host, sep, port = spec.admin.rpartition(':')
+        self.host, self.port = (host.strip('[]'), int(port)) if sep else (spec.admin, 9090)
+        self._count = 0
+
+    def _request(self, method, path, body=None):
+        conn = http.client.HTTPConnection(self.host, self.port, timeout=10)
+        try:
+            conn.request(method, path, json.dumps(body) if body is not None else None,
+                         {'Content-Type': 'application/json'})
+            resp = conn.getresponse()
+            return resp.status, json.loads(resp.read() or b'null')
+        finally:
+            conn.close()
+
+    def _create(self, options):
+        """Create a session; a fixed port may still be held by the previous run for a moment."""
+        self._count += 1
+        name = f'bisect-{os.getpid()}-{self._count}'
+        deadline = time.monotonic() + self.BIND_RETRY
+        while True:
+            status, body = self._request('POST', '/sessions', {'name': name, 'servers': [options]})
+            if status == 201:
+                return name, body['listeners'][0]['addr']
+            if status != 409 or time.monotonic() > deadline:
+                raise ValueError(f'admin server refused the session ({status}): {body.get("error", body)}')
+            time.sleep(0.2)
+
+    def __call__(self, names):
+        name, addr = self._create(self.spec.options(names))
+        host, _, port = addr.rpartition(':')
+        host = host.strip('[]')
+        command = self.spec.command.format(addr=addr, host=host, port=port)
+        env = dict(os.environ, YOURTESTSRV_ADDR=addr)
+        try:
+            for _ in range(self.spec.repeat):
+                try:
+                    result = subprocess.run(command, shell=True, env=env, timeout=self.spec.timeout or None,
+                                            stdout=subprocess.DEVNULL, stderr=subprocess.DEVNULL)
+                except subprocess.TimeoutExpired:
+                    return True, f'timed out after {self.spec.timeout}s'
+                if result.returncode != 0:
+                    return True, f'exit status {result.returncode}'
+            return False, ''
+        finally:
+            self._request('DELETE', f'/sessions/{name}')
+
+
+class Bisector:
+    """Delta debugging over the spec's faults; runner(names) returns (failed, detail)."""
+
+    def __init__(self, spec, runner=None, clock=time.monotonic):
+        self.spec = spec
+        self.runner = runner or AdminRunner(spec)
+        self.clock = clock
+        self.runs = []
+        self._results = {}
+
+    def fails(self, names):
+        key = frozenset(names)
+        if key not in self._results:
+            start = self.clock()
+            failed, detail = self.runner(sorted(key))
+            self.runs.append(Run(sorted(key), failed, self.clock() - start, detail))
+            self._results[key] = failed
+        return self._results[key]
+
+    def run(self):
+        """Return the report dict: the verdict, the minimal faults and every run."""
+        names = list(self.spec.faults)
+        if not self.fails(names):
+            return self._report('not_reproduced', [])
+        if self.fails([]):
+            return self._report('fails_without_faults', [])
+        return self._report('minimal', self._ddmin(names))
+
+    def _ddmin(self, names):
+        n = 2
+        while len(names) >= 2:
+            size = len(names) / n
+            chunks = [names[round(i * size):round((i + 1) * size)] for i in range(n)]
+            for chunk in chunks:
+                if self.fails(chunk):
+                    names, n = chunk, 2
+                    break
+            else:
+                for chunk in chunks:
+                    rest = [name for name in names if name not in chunk]
+                    if self.fails(rest):
+                        names, n = rest, max(n - 1, 2)
+                        break
+                else:
+                    if n >= len(names):
+                        break
+                    n = min(len(names), n * 2)
+        return names
+
+    def _report(self, verdict, minimal):
+        return {'verdict': verdict, 'minimal': minimal,
+                'options': self.spec.options(minimal) if verdict == 'minimal' else None,
+                'runs': [run.to_dict() for run in self.runs]}
+
+
+def format_report(report):
+    lines = []
+    for i, run in enumerate(report['runs'], 1):
+        outcome = f'FAIL ({run["detail"]})' if run['failed'] and run['detail'] else 'FAIL' if run['failed'] else 'pass'
+        lines.append(f'run {i:3d}  {outcome:<24} {run["duration"]:7.1f}s  {", ".join(run["faults"]) or "(no faults)"}')
+    verdict = report['verdict']
+    if verdict == 'not_reproduced':
+        lines.append('The failure did not reproduce with all faults enabled.')
+    elif verdict == 'fails_without_faults':
+        lines.append('The failure reproduces without any fault; it is not caused by the injected faults.')
+    else:
+        lines.append(f'Minimal failing combination: {", ".join(report["minimal"])}')
+        lines.append(f'Server options: {json.dumps(report["options"], sort_keys=True)}')
+    return '\n'.join(lines)
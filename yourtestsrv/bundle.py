@@ -0,0 +1,127 @@
+"""Evidence bundles written when a watched condition fires.
+
+Events:
+
+  parse_error       any server's "parse" error counter increased
+  disconnect_storm  at least storm_threshold connections closed within storm_window
+  assertion         fire() called by a run check (e.g. a failed expectation)
+
+A bundle is a timestamped tar.gz holding manifest.json, the config file,
+stats.json, connections.json and log.txt, the most recent log lines which
+include the per-connection transcripts the servers log. Packet captures
+are not recorded by the servers, so no pcap is included.
+"""
+
+import collections
+import io
+import json
+import logging
+import os
+import tarfile
+import threading
+import time
+
+from yourtestsrv import stats
+
+logger = logging.getLogger(__name__)
+
+EVENTS = ('parse_error', 'disconnect_storm', 'assertion')
+
+
+class RecentLogHandler(logging.Handler):
+    """Keeps the last capacity formatted log lines in memory."""
+
+    def __init__(self, capacity=5000):
+        super().__init__()
+        self.lines = collections.deque(maxlen=capacity)
+        self.setFormatter(logging.Formatter('%(asctime)s %(levelname)s %(name)s %(message)s'))
+
+    def emit(self, record):
+        try:
+            self.lines.append(self.format(record))
+        except Exception:
+            self.handleError(record)
+
+    def text(self):
+        return '\n'.join(list(self.lines)) + '\n'
+
+
+class EventBundler:
+    def __init__(self, events, out_dir='bundles', config_path=None, cooldown=60.0,
+                 storm_threshold=20, storm_window=10.0, interval=1.0, table=None):
+        for event in events:
+            if event not in EVENTS:
+                raise ValueError(f'unknown bundle event: {event!r}')
+        self.events = set(events)
+        self.out_dir = out_dir
+        self.config_path = config_path
+        self.cooldown = cooldown
+        self.storm_threshold = storm_threshold
+        self.storm_window = storm_window
+        self.interval = interval
+        self.table = table or stats.connections
+        self.log = RecentLogHandler()
+        self._last_bundle = {}
+        self._lock = threading.Lock()
+
+    def run(self, stop_event):
+        if not self.events:
+            return
+        logging.getLogger().addHandler(self.log)
+        try:
+            parse_errors = self._parse_errors()
+            closes = collections.deque([(time.time(), self.table.closed_total)])
+            while not stop_event.wait(self.interval):
+                current = self._parse_errors()
+                if 'parse_error' in self.events and current > parse_errors:
+                    self.fire('parse_error', f'{current - parse_errors} new parse error(s)')
+                parse_errors = current
+                now = time.time()
+                closes.append((now, self.table.closed_total))
+                while len(closes) > 1 and now - closes[0][0] > self.storm_window:
+                    closes.popleft()
+                closed = closes[-1][1] - closes[0][1]
+                if 'disconnect_storm' in self.events and closed >= self.storm_threshold:
+                    self.fire('disconnect_storm', f'{closed} connections closed within {self.storm_window}s')
+                    closes = collections.deque([closes[-1]])
+        finally:
+            logging.getLogger().removeHandler(self.log)
+
+    @staticmethod
+    def _parse_errors():
+        return sum(s['errors'].get(stats.ERROR_PARSE, 0) for s in stats.snapshot().values())
+
+    def fire(self, event, detail=''):
+        """Write a bundle for event unless one was written within the cooldown; returns its path."""
+        with self._lock:
+            now = time.time()
+            if now - self._last_bundle.get(event, 0.0) < self.cooldown:
+                return None
+            self._last_bundle[event] = now
+        path = self.write(event, detail)
+        logger.warning(f'Bundle written for {event}: {path}')
+        return path
+
+    def write(self, event, detail=''):
+        os.makedirs(self.out_dir, exist_ok=True)
+        stamp = time.strftime('%Y%m%d-%H%M%S')
+        name = f'yourtestsrv-{event}-{stamp}'
+        path = os.path.join(self.out_dir, f'{name}.tar.gz')
+        files = {
+            'manifest.json': json.dumps({'event': event, 'detail': detail, 'time': time.time(),
+                                         'pcap': 'not captured'}, indent=2),
+            'stats.json': json.dumps(stats.snapshot(), indent=2, sort_keys=True),
+            'connections.json': json.dumps(self.table.snapshot(), indent=2),
+            'log.txt': self.log.text(),
+        }
+        if self.config_path and os.path.exists(self.config_path):
+            with open(self.config_path) as f:
+                files['config.json'] = f.read()
+        with tarfile.open(path, 'w:gz') as tar:
+            for filename, content in files.items():
+                data = content.encode()
+                member = tarfile.TarInfo(f'{name}/{filename}')
+                member.size = len(data)
+                member.mtime = int(time.time())
+                tar.addfile(member, io.BytesIO(data))
+        return path
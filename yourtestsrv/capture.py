@@ -0,0 +1,275 @@
+"""Payloads taken straight from packet captures.
+
+Reads pcap / pcapng files and Wireshark hex dumps ("Copy as Hex Dump",
+plain-text packet exports, or a single hex stream) and picks the TCP/UDP
+payloads selected by a filter:
+
+  {"file": "device.pcapng", "filter": {"proto": "udp", "src_port": 5683}}
+  {"file": "login.txt", "filter": {"packet": 12}}
+  {"file": "fw.pcap", "filter": {"stream": 3, "src_port": 9000}, "join": true}
+
+Filter keys (all must match): packet (frame number as shown by Wireshark,
+from 1), proto (tcp or udp), stream (conversation index per protocol, like
+tcp.stream / udp.stream), host, port, src_host, src_port, dst_host, dst_port.
+Packets without payload are skipped. Without join the first match is used
+(generators cycle through all of them); join concatenates the matches, e.g.
+a reply split over several TCP segments.
+
+Hex dump packets are decoded as Ethernet or raw IP frames when they parse
+as one, otherwise the bytes are taken as the payload itself (only the
+packet key can select those).
+"""
+
+import ipaddress
+import re
+import struct
+
+from yourtestsrv.binproto import FixedResponse
+
+PCAP_MAGICS = {
+    b'\xd4\xc3\xb2\xa1': '<', b'\xa1\xb2\xc3\xd4': '>',
+    b'\x4d\x3c\xb2\xa1': '<', b'\xa1\xb2\x3c\x4d': '>',
+}
+PCAPNG_SHB = b'\x0a\x0d\x0d\x0a'
+
+LINK_NULL = 0
+LINK_ETHERNET = 1
+LINK_RAW = (12, 101)
+LINK_LOOP = 108
+LINK_SLL = 113
+LINK_IPV4 = 228
+LINK_IPV6 = 229
+LINK_SLL2 = 276
+
+IP_PROTOS = {6: 'tcp', 17: 'udp'}
+IPV6_EXTENSIONS = (0, 43, 60)
+FILTER_KEYS = ('packet', 'proto', 'stream', 'host', 'port', 'src_host', 'src_port', 'dst_host', 'dst_port')
+_OFFSET_LINE = re.compile(r'^\s*(?:0x)?([0-9a-fA-F]{4,8}):?\s+(.*)$')
+
+
+class Packet:
+    def __init__(self, number, payload, proto=None, src=None, dst=None):
+        self.number = number
+        self.payload = payload
+        self.proto = proto
+        self.src = src
+        self.dst = dst
+        self.stream = None
+
+
+def read_packets(path):
+    """All packets of a pcap, pcapng or hex dump file, numbered from 1."""
+    with open(path, 'rb') as f:
+        data = f.read()
+    if data[:4] in PCAP_MAGICS:
+        frames = _read_pcap(data)
+    elif data[:4] == PCAPNG_SHB:
+        frames = _read_pcapng(data)
+    else:
+        return _number_streams([_decode_dumped(i, raw) for i, raw in enumerate(_read_hexdump(data.decode()), 1)])
+    return _number_streams([decode_frame(i, linktype, raw) for i, (linktype, raw) in enumerate(frames, 1)])
+
+
+def _read_pcap(data):
+    order = PCAP_MAGICS[data[:4]]
+    linktype = struct.unpack_from(order + 'I', data, 20)[0] & 0xFFFF
+    pos = 24
+    while pos + 16 <= len(data):
+        incl_len = struct.unpack_from(order + 'I', data, pos + 8)[0]
+        pos += 16
+        yield linktype, data[pos:pos + incl_len]
+        pos += incl_len
+
+
+def _read_pcapng(data):
+    order = '<'
+    interfaces = []
+    pos = 0
+    while pos + 12 <= len(data):
+        block_type = data[pos:pos + 4]
+        if block_type == PCAPNG_SHB:
+            order = '<' if data[pos + 8:pos + 12] == b'\x4d\x3c\x2b\x1a' else '>'
+            interfaces = []
+        block_type, length = struct.unpack_from(order + 'II', data, pos)
+        if length < 12:
+            raise ValueError(f'corrupt pcapng block at offset {pos}')
+        body = data[pos + 8:pos + length - 4]
+        if block_type == 1:
+            interfaces.append(struct.unpack_from(order + 'H', body)[0])
+        elif block_type == 6:
+            interface, _, _, cap_len = struct.unpack_from(order + 'IIII', body)
+            yield interfaces[interface], body[20:20 + cap_len]
+        elif block_type == 3:
+            orig_len = struct.unpack_from(order + 'I', body)[0]
+            yield interfaces[0], body[4:4 + orig_len]
+        pos += length
+
+
+def _read_hexdump(text):
+    """Packets of a hex dump: offset 0 starts a new packet; without offsets the
+    whole text is one hex stream."""
+    packets = []
+    lines = []
+    for line in text.splitlines():
+        m = _OFFSET_LINE.match(line)
+        if not m:
+            continue
+        offset = int(m.group(1), 16)
+        # The ASCII column follows the hex bytes after a gap of three or more spaces.
+        hex_part = re.split(r'\s{3,}|\|', m.group(2).strip(), maxsplit=1)[0]
+        try:
+            chunk = bytes.fromhex(''.join(t for t in hex_part.split() if re.fullmatch(r'(?:[0-9a-fA-F]{2})+', t)))
+        except ValueError:
+            continue
+        if offset == 0 and lines:
+            packets.append(_join_lines(lines))
+            lines = []
+        lines.append((offset, chunk))
+    if lines:
+        packets.append(_join_lines(lines))
+    if not packets:
+        stream = re.sub(r'[\s:]', '', text)
+        packets.append(bytes.fromhex(stream[2:] if stream.lower().startswith('0x') else stream))
+    return packets
+
+
+def _join_lines(lines):
+    data = b''
+    for i, (offset, chunk) in enumerate(lines):
+        if i + 1 < len(lines):
+            chunk = chunk[:lines[i + 1][0] - offset]
+        data = data[:offset] + chunk
+    return data
+
+
+def _decode_dumped(number, raw):
+    for linktype in (LINK_ETHERNET, LINK_RAW[1]):
+        packet = decode_frame(number, linktype, raw)
+        if packet.proto:
+            return packet
+    return Packet(number, raw)
+
+
+def decode_frame(number, linktype, raw):
+    """Decode a link-layer frame down to its TCP/UDP payload; other frames get proto None."""
+    try:
+        return _decode_ip(number, _strip_link(linktype, raw))
+    except (struct.error, ValueError, IndexError):
+        return Packet(number, b'')
+
+
+def _strip_link(linktype, raw):
+    if linktype == LINK_ETHERNET:
+        ethertype, pos = struct.unpack_from('>H', raw, 12)[0], 14
+        while ethertype in (0x8100, 0x88A8):
+            ethertype, pos = struct.unpack_from('>H', raw, pos + 2)[0], pos + 4
+        return raw[pos:] if ethertype in (0x0800, 0x86DD) else b''
+    if linktype in (LINK_NULL, LINK_LOOP):
+        return raw[4:]
+    if linktype in LINK_RAW or linktype in (LINK_IPV4, LINK_IPV6):
+        return raw
+    if linktype == LINK_SLL:
+        return raw[16:]
+    if linktype == LINK_SLL2:
+        return raw[20:]
+    raise ValueError(f'unsupported link type {linktype}')
+
+
+def _decode_ip(number, ip):
+    version = ip[0] >> 4
+    if version == 4:
+        header_len = (ip[0] & 0x0F) * 4
+        total_len, frag = struct.unpack_from('>H2xH', ip, 2)
+        if header_len < 20 or total_len > len(ip):
+            raise ValueError('bad IPv4 header')
+        if frag & 0x3FFF:
+            raise ValueError('IP fragment')
+        proto = ip[9]
+        src, dst = ipaddress.IPv4Address(ip[12:16]), ipaddress.IPv4Address(ip[16:20])
+        body = ip[header_len:total_len]
+    elif version == 6:
+        payload_len, proto = struct.unpack_from('>HB', ip, 4)
+        src, dst = ipaddress.IPv6Address(ip[8:24]), ipaddress.IPv6Address(ip[24:40])
+        body = ip[40:40 + payload_len]
+        while proto in IPV6_EXTENSIONS:
+            proto, body = body[0], body[(body[1] + 1) * 8:]
+    else:
+        raise ValueError(f'not an IP packet (version {version})')
+    if proto not in IP_PROTOS:
+        raise ValueError(f'IP protocol {proto}')
+    sport, dport = struct.unpack_from('>HH', body)
+    if proto == 6:
+        payload = body[(body[12] >> 4) * 4:]
+    else:
+        payload = body[8:struct.unpack_from('>H', body, 4)[0]]
+    return Packet(number, payload, IP_PROTOS[proto], (str(src), sport), (str(dst), dport))
+
+
+def _number_streams(packets):
+    streams = {}
+    counts = {}
+    for packet in packets:
+        if packet.proto:
+            key = (packet.proto, frozenset((packet.src, packet.dst)))
+            if key not in streams:
+                streams[key] = counts.get(packet.proto, 0)
+                counts[packet.proto] = streams[key] + 1
+            packet.stream = streams[key]
+    return packets
+
+
+def parse_filter(text):
+    """Parse a CLI filter like 'proto=udp,src_port=5683' into a filter dict."""
+    spec = {}
+    for part in filter(None, (p.strip() for p in text.split(','))):
+        key, sep, value = part.partition('=')
+        if not sep:
+            raise ValueError(f'capture filter entries must be key=value: {part!r}')
+        spec[key.strip()] = value.strip()
+    return spec
+
+
+def _match(packet, key, want):
+    want = str(want)
+    if key == 'packet':
+        return packet.number == int(want)
+    if key == 'stream':
+        return packet.stream == int(want)
+    if key == 'proto':
+        return packet.proto == want.lower()
+    if packet.src is None:
+        return False
+    if key == 'host':
+        return want in (packet.src[0], packet.dst[0])
+    if key == 'port':
+        return int(want) in (packet.src[1], packet.dst[1])
+    end, field = key.split('_')
+    host, port = packet.src if end == 'src' else packet.dst
+    return host == want if field == 'host' else port == int(want)
+
+
+def select(packets, spec=None):
+    """Payloads of the packets matching spec, in capture order."""
+    spec = dict(spec or {})
+    unknown = set(spec) - set(FILTER_KEYS)
+    if unknown:
+        raise ValueError(f'unknown capture filter keys: {sorted(unknown)}')
+    return [p.payload for p in packets if p.payload and all(_match(p, k, v) for k, v in spec.items())]
+
+
+def extract(file, filter=None, join=False):
+    """The payloads in file selected by filter; raises ValueError when none match."""
+    payloads = select(read_packets(file), filter)
+    if not payloads:
+        raise ValueError(f'no payload in {file} matches {filter or {}}')
+    return [b''.join(payloads)] if join else payloads
+
+
+def load_response(spec):
+    """A FixedResponse with the first (or joined) payload of a capture spec."""
+    spec = dict(spec)
+    file = spec.pop('file')
+    payloads = extract(file, spec.pop('filter', None), spec.pop('join', False))
+    if spec:
+        raise ValueError(f'unknown capture keys: {sorted(spec)}')
+    return FixedResponse(payloads[0])
@@ -0,0 +1,95 @@
+"""Injectable clock for delay, pacing and scheduling logic.
+
+Servers take a clock= argument and fall back to the module default, a
+RealClock. Tests that embed the servers can pass a VirtualClock instead and
+call advance() to release sleeping delays instantly. Socket timeouts (read
+timeouts, MQTT keep-alive) are enforced by the OS and stay in real time.
+"""
+
+import threading
+import time
+
+
+class RealClock:
+    def time(self):
+        return time.time()
+
+    def monotonic(self):
+        return time.monotonic()
+
+    def sleep(self, seconds):
+        if seconds > 0:
+            time.sleep(seconds)
+
+    def wait(self, event, timeout):
+        """Like event.wait(timeout); returns True if the event was set."""
+        return event.wait(timeout)
+
+
+class VirtualClock:
+    """Time that only moves when advance() is called.
+
+    sleep() and wait() block until the virtual deadline is reached; wait()
+    also returns as soon as its event is set (checked every poll seconds of
+    real time, since setting an Event cannot notify this clock).
+    """
+
+    def __init__(self, start=None, poll=0.01):
+        self._now = time.time() if start is None else start
+        self._start_monotonic = self._now
+        self._poll = poll
+        self._cond = threading.Condition()
+        self._sleepers = 0
+
+    def time(self):
+        with self._cond:
+            return self._now
+
+    def monotonic(self):
+        return self.time() - self._start_monotonic
+
+    def advance(self, seconds):
+        if seconds < 0:
+            raise ValueError('cannot move a virtual clock backwards')
+        with self._cond:
+            self._now += seconds
+            self._cond.notify_all()
+
+    def sleepers(self):
+        """Number of threads currently blocked in sleep() or wait()."""
+        with self._cond:
+            return self._sleepers
+
+    def wait_for_sleepers(self, n, timeout=5.0):
+        """Block (in real time) until at least n threads are sleeping on this clock."""
+        with self._cond:
+            return self._cond.wait_for(lambda: self._sleepers >= n, timeout)
+
+    def sleep(self, seconds):
+        if seconds > 0:
+            self._block(seconds, None)
+
+    def wait(self, event, timeout):
+        if timeout is None:
+            return event.wait()
+        self._block(timeout, event)
+        return event.is_set()
+
+    def _block(self, seconds, event):
+        with self._cond:
+            deadline = self._now + seconds
+            self._sleepers += 1
+            self._cond.notify_all()
+            try:
+                while self._now < deadline and not (event and event.is_set()):
+                    self._cond.wait(self._poll if event else None)
+            finally:
+                self._sleepers -= 1
+
+
+default = RealClock()
+
+
+def get(clock=None):
+    """Return clock, or the module default when it is None."""
+    return clock or default
@@ -0,0 +1,320 @@
+"""Structured bodies: JSON, CBOR (RFC 8949) and MessagePack.
+
+Plain-stdlib encoders/decoders for the data model the three share: None,
+bool, int, float, str, bytes, list and dict. CBOR tags are dropped on decode
+(the tagged value is kept) and indefinite-length items are accepted;
+MessagePack extension types decode to their raw data bytes. JSON has no
+byte strings, so bytes are rendered as hex text there. Map keys must be
+scalars, and nesting deeper than MAX_DEPTH is rejected.
+
+The format is picked by media type, including structured syntax suffixes
+such as application/senml+cbor:
+
+  json     application/json, */*+json
+  cbor     application/cbor, */*+cbor
+  msgpack  application/msgpack, application/x-msgpack, application/vnd.msgpack
+"""
+
+import json
+import struct
+
+FORMATS = ('json', 'cbor', 'msgpack')
+CONTENT_TYPES = {'json': 'application/json', 'cbor': 'application/cbor', 'msgpack': 'application/msgpack'}
+MSGPACK_TYPES = ('application/msgpack', 'application/x-msgpack', 'application/vnd.msgpack')
+# Arrays, maps and CBOR tags nested deeper than this are refused instead of exhausting the stack.
+MAX_DEPTH = 64
+
+
+def format_of(media_type):
+    """The format for a Content-Type or Accept entry, or None."""
+    media_type = media_type.split(';', 1)[0].strip().lower()
+    if media_type in MSGPACK_TYPES:
+        return 'msgpack'
+    for fmt in ('json', 'cbor'):
+        if media_type == f'application/{fmt}' or media_type.endswith(f'+{fmt}'):
+            return fmt
+    return None
+
+
+def accepted_format(accept):
+    """The first structured format listed in an Accept header, or None."""
+    for entry in accept.split(','):
+        fmt = format_of(entry)
+        if fmt:
+            return fmt
+    return None
+
+
+def decode(data, fmt):
+    """Decode a body; raises ValueError for malformed or truncated input."""
+    if fmt == 'json':
+        return json.loads(data) if data.strip() else None
+    try:
+        if fmt == 'cbor':
+            value, pos = _cbor_decode(data, 0)
+        elif fmt == 'msgpack':
+            value, pos = _msgpack_decode(data, 0)
+        else:
+            raise ValueError(f'unknown body format: {fmt!r}')
+    except (IndexError, struct.error):
+        raise ValueError(f'truncated {fmt} body') from None
+    except (TypeError, RecursionError) as e:
+        raise ValueError(f'malformed {fmt} body: {e}') from None
+    if pos != len(data):
+        raise ValueError(f'{len(data) - pos} trailing bytes after {fmt} body')
+    return value
+
+
+def encode(value, fmt):
+    if fmt == 'json':
+        return json.dumps(_json_keys(value), default=_json_default).encode()
+    if fmt == 'cbor':
+        return _cbor_encode(value)
+    if fmt == 'msgpack':
+        return _msgpack_encode(value)
+    raise ValueError(f'unknown body format: {fmt!r}')
+
+
+def _json_default(value):
+    if isinstance(value, (bytes, bytearray)):
+        return bytes(value).hex()
+    raise TypeError(f'{type(value).__name__} is not JSON serializable')
+
+
+def _json_keys(value):
+    """value with byte-string map keys (CBOR/MessagePack allow them) turned into hex text."""
+    if isinstance(value, dict):
+        return {(k.hex() if isinstance(k, bytes) else k): _json_keys(v) for k, v in value.items()}
+    if isinstance(value, (list, tuple)):
+        return [_json_keys(v) for v in value]
+    return value
+
+
+# CBOR
+
+def _cbor_head(major, n):
+    if n < 24:
+        return bytes([major << 5 | n])
+    for info, fmt in ((24, '>B'), (25, '>H'), (26, '>I'), (27, '>Q')):
+        if n < 1 << (8 * struct.calcsize(fmt)):
+            return bytes([major << 5 | info]) + struct.pack(fmt, n)
+    raise ValueError(f'integer too large for CBOR: {n}')
+
+
+def _cbor_encode(value):
+    if value is None:
+        return b'\xf6'
+    if value is True:
+        return b'\xf5'
+    if value is False:
+        return b'\xf4'
+    if isinstance(value, int):
+        return _cbor_head(0, value) if value >= 0 else _cbor_head(1, -1 - value)
+    if isinstance(value, float):
+        return b'\xfb' + struct.pack('>d', value)
+    if isinstance(value, (bytes, bytearray)):
+        return _cbor_head(2, len(value)) + bytes(value)
+    if isinstance(value, str):
+        data = value.encode()
+        return _cbor_head(3, len(data)) + data
+    if isinstance(value, (list, tuple)):
+        return _cbor_head(4, len(value)) + b''.join(_cbor_encode(v) for v in value)
+    if isinstance(value, dict):
+        return _cbor_head(5, len(value)) + b''.join(_cbor_encode(k) + _cbor_encode(v) for k, v in value.items())
+    raise ValueError(f'cannot encode {type(value).__name__} as CBOR')
+
+
+def _cbor_decode(data, pos, depth=0):
+    if depth > MAX_DEPTH:
+        raise ValueError(f'CBOR nested deeper than {MAX_DEPTH}')
+    initial = data[pos]
+    major, info = initial >> 5, initial & 0x1F
+    pos += 1
+    if major == 7:
+        if info == 20:
+            return False, pos
+        if info == 21:
+            return True, pos
+        if info in (22, 23):
+            return None, pos
+        for size, fmt in ((25, '>e'), (26, '>f'), (27, '>d')):
+            if info == size:
+                end = pos + struct.calcsize(fmt)
+                return struct.unpack(fmt, data[pos:end])[0], end
+        if info < 24:
+            return info, pos
+        if info == 24:
+            return data[pos], pos + 1
+        raise ValueError(f'unsupported CBOR simple value {info}')
+    if info == 31:
+        return _cbor_indefinite(data, pos, major, depth)
+    if info < 24:
+        n = info
+    elif info <= 27:
+        fmt = ('>B', '>H', '>I', '>Q')[info - 24]
+        end = pos + struct.calcsize(fmt)
+        n, pos = struct.unpack(fmt, data[pos:end])[0], end
+    else:
+        raise ValueError(f'invalid CBOR additional info {info}')
+    if major == 0:
+        return n, pos
+    if major == 1:
+        return -1 - n, pos
+    if major in (2, 3):
+        if pos + n > len(data):
+            raise ValueError('truncated CBOR string')
+        raw = data[pos:pos + n]
+        return (raw if major == 2 else raw.decode()), pos + n
+    if major == 4:
+        items = []
+        for _ in range(n):
+            item, pos = _cbor_decode(data, pos, depth + 1)
+            items.append(item)
+        return items, pos
+    if major == 5:
+        result = {}
+        for _ in range(n):
+            key, pos = _cbor_decode(data, pos, depth + 1)
+            result[_map_key(key)], pos = _cbor_decode(data, pos, depth + 1)
+        return result, pos
+    # Major type 6: a tag; keep the tagged value.
+    return _cbor_decode(data, pos, depth + 1)
+
+
+def _cbor_indefinite(data, pos, major, depth):
+    if major in (2, 3):
+        chunks = []
+        while data[pos] != 0xFF:
+            chunk, pos = _cbor_decode(data, pos)
+            chunks.append(chunk)
+        return (b''.join(chunks) if major == 2 else ''.join(chunks)), pos + 1
+    if major == 4:
+        items = []
+        while data[pos] != 0xFF:
+            item, pos = _cbor_decode(data, pos, depth + 1)
+            items.append(item)
+        return items, pos + 1
+    if major == 5:
+        result = {}
+        while data[pos] != 0xFF:
+            key, pos = _cbor_decode(data, pos, depth + 1)
+            result[_map_key(key)], pos = _cbor_decode(data, pos, depth + 1)
+        return result, pos + 1
+    raise ValueError(f'indefinite length not allowed for CBOR major type {major}')
+
+
+def _map_key(key):
+    """Only scalar keys: a list or map key has no JSON form and would not even be hashable."""
+    if isinstance(key, (list, dict)):
+        raise ValueError(f'unsupported map key type: {type(key).__name__}')
+    return key
+
+
+# MessagePack
+
+def _msgpack_encode(value):
+    if value is None:
+        return b'\xc0'
+    if value is True:
+        return b'\xc3'
+    if value is False:
+        return b'\xc2'
+    if isinstance(value, int):
+        if 0 <= value < 0x80:
+            return bytes([value])
+        if -32 <= value < 0:
+            return struct.pack('>b', value)
+        if value >= 0:
+            for marker, fmt in ((0xCC, '>B'), (0xCD, '>H'), (0xCE, '>I'), (0xCF, '>Q')):
+                if value < 1 << (8 * struct.calcsize(fmt)):
+                    return bytes([marker]) + struct.pack(fmt, value)
+        else:
+            for marker, fmt in ((0xD0, '>b'), (0xD1, '>h'), (0xD2, '>i'), (0xD3, '>q')):
+                if value >= -(1 << (8 * struct.calcsize(fmt) - 1)):
+                    return bytes([marker]) + struct.pack(fmt, value)
+        raise ValueError(f'integer too large for MessagePack: {value}')
+    if isinstance(value, float):
+        return b'\xcb' + struct.pack('>d', value)
+    if isinstance(value, str):
+        data = value.encode()
+        if len(data) < 32:
+            return bytes([0xA0 | len(data)]) + data
+        return _msgpack_sized(len(data), (0xD9, 0xDA, 0xDB)) + data
+    if isinstance(value, (bytes, bytearray)):
+        return _msgpack_sized(len(value), (0xC4, 0xC5, 0xC6)) + bytes(value)
+    if isinstance(value, (list, tuple)):
+        head = bytes([0x90 | len(value)]) if len(value) < 16 else _msgpack_sized(len(value), (None, 0xDC, 0xDD))
+        return head + b''.join(_msgpack_encode(v) for v in value)
+    if isinstance(value, dict):
+        head = bytes([0x80 | len(value)]) if len(value) < 16 else _msgpack_sized(len(value), (None, 0xDE, 0xDF))
+        return head + b''.join(_msgpack_encode(k) + _msgpack_encode(v) for k, v in value.items())
+    raise ValueError(f'cannot encode {type(value).__name__} as MessagePack')
+
+
+def _msgpack_sized(n, markers):
+    """Marker and length for the smallest of the 8/16/32-bit length forms (None: not available)."""
+    for marker, fmt in zip(markers, ('>B', '>H', '>I')):
+        if marker is not None and n < 1 << (8 * struct.calcsize(fmt)):
+            return bytes([marker]) + struct.pack(fmt, n)
+    raise ValueError(f'length too large for MessagePack: {n}')
+
+
+_MSGPACK_FIXED = {0xCA: '>f', 0xCB: '>d', 0xCC: '>B', 0xCD: '>H', 0xCE: '>I', 0xCF: '>Q',
+                  0xD0: '>b', 0xD1: '>h', 0xD2: '>i', 0xD3: '>q'}
+_MSGPACK_LENGTHS = {0xC4: '>B', 0xC5: '>H', 0xC6: '>I', 0xD9: '>B', 0xDA: '>H', 0xDB: '>I',
+                    0xDC: '>H', 0xDD: '>I', 0xDE: '>H', 0xDF: '>I', 0xC7: '>B', 0xC8: '>H', 0xC9: '>I'}
+_MSGPACK_FIXEXT = {0xD4: 1, 0xD5: 2, 0xD6: 4, 0xD7: 8, 0xD8: 16}
+
+
+def _msgpack_decode(data, pos, depth=0):
+    if depth > MAX_DEPTH:
+        raise ValueError(f'MessagePack nested deeper than {MAX_DEPTH}')
+    marker = data[pos]
+    pos += 1
+    if marker < 0x80:
+        return marker, pos
+    if marker >= 0xE0:
+        return marker - 0x100, pos
+    if marker == 0xC0:
+        return None, pos
+    if marker in (0xC2, 0xC3):
+        return marker == 0xC3, pos
+    if marker in _MSGPACK_FIXED:
+        fmt = _MSGPACK_FIXED[marker]
+        end = pos + struct.calcsize(fmt)
+        return struct.unpack(fmt, data[pos:end])[0], end
+    if marker in _MSGPACK_FIXEXT:
+        n = _MSGPACK_FIXEXT[marker]
+        return data[pos + 1:pos + 1 + n], pos + 1 + n
+    if 0xA0 <= marker <= 0xBF:
+        kind, n = 'str', marker & 0x1F
+    elif 0x90 <= marker <= 0x9F:
+        kind, n = 'array', marker & 0x0F
+    elif 0x80 <= marker <= 0x8F:
+        kind, n = 'map', marker & 0x0F
+    elif marker in _MSGPACK_LENGTHS:
+        fmt = _MSGPACK_LENGTHS[marker]
+        end = pos + struct.calcsize(fmt)
+        n, pos = struct.unpack(fmt, data[pos:end])[0], end
+        kind = {0xC4: 'bin', 0xC5: 'bin', 0xC6: 'bin', 0xD9: 'str', 0xDA: 'str', 0xDB: 'str',
+                0xDC: 'array', 0xDD: 'array', 0xDE: 'map', 0xDF: 'map'}.get(marker, 'ext')
+    else:
+        raise ValueError(f'invalid MessagePack marker 0x{marker:02x}')
+    if kind == 'ext':
+        return data[pos + 1:pos + 1 + n], pos + 1 + n
+    if kind in ('str', 'bin'):
+        if pos + n > len(data):
+            raise ValueError('truncated MessagePack string')
+        raw = data[pos:pos + n]
+        return (raw.decode() if kind == 'str' else raw), pos + n
+    if kind == 'array':
+        items = []
+        for _ in range(n):
+            item, pos = _msgpack_decode(data, pos, depth + 1)
+            items.append(item)
+        return items, pos
+    result = {}
+    for _ in range(n):
+        key, pos = _msgpack_decode(data, pos, depth + 1)
+        result[_map_key(key)], pos = _msgpack_decode(data, pos, depth + 1)
+    return result, pos
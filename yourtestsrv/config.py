@@ -1,14 +1,29 @@
+import ipaddress
 import json
 import re
+import socket
+
+from yourtestsrv.binproto import BinaryTemplate, FixedResponse
+from yourtestsrv.capture import load_response as load_capture_response
+from yourtestsrv.faultrules import FaultRuleSet
+from yourtestsrv.payload import make_generator
+from yourtestsrv.rules import RuleSet
+from yourtestsrv.shaping import Distribution, Latency, parse_rate
 
 
 def parse_duration(s):
     """Parse Go duration string like '5s', '200ms', '1m30s' to seconds (float).
 
+    A leading '-' or '+' sign is accepted, as in Go.
     Raises ValueError for strings that are not valid duration syntax.
     """
     if not s or s == '0' or s == '0s':
         return 0.0
+    if s[0] in '+-':
+        if len(s) == 1 or s[1] in '+-':
+            raise ValueError(f'invalid duration string: {s!r}')
+        sign = -1.0 if s[0] == '-' else 1.0
+        return sign * parse_duration(s[1:])
     total = 0.0
     pattern = re.compile(r'(\d+(?:\.\d+)?)(ns|us|µs|ms|s|m|h)')
     matched_end = 0
@@ -34,56 +49,751 @@ def parse_duration(s):
     return total
 
 
+def parse_escaped(s):
+    """Decode a string given with backslash escapes (e.g. '\\r\\n', '\\x00') to bytes."""
+    return s.encode('latin-1').decode('unicode_escape').encode('latin-1')
+
+
+def parse_banner(s):
+    """Build the TCP connect banner: backslash escapes plus payload template variables."""
+    if not s:
+        return None
+    return make_generator({'type': 'json', 'template': s.encode('latin-1').decode('unicode_escape')})
+
+
+def parse_discovery_reply(text, hex_data):
+    """The UDP discovery reply: text with escapes and template variables (as a banner), or fixed hex bytes."""
+    if text and hex_data:
+        raise ValueError('set only one of discovery_reply and discovery_reply_hex')
+    if hex_data:
+        return bytes.fromhex(hex_data)
+    return parse_banner(text)
+
+
+def parse_delimiter(s):
+    """Decode a delimiter given with backslash escapes to bytes."""
+    delimiter = parse_escaped(s)
+    if not delimiter:
+        raise ValueError('delimiter must not be empty')
+    return delimiter
+
+
+def parse_connection_limit(max_connections, over_limit, over_limit_banner):
+    from yourtestsrv.netutil import OVER_LIMIT_MODES
+    if over_limit not in OVER_LIMIT_MODES:
+        raise ValueError(f'unknown over_limit mode: {over_limit!r}')
+    return max_connections, over_limit, parse_escaped(over_limit_banner)
+
+
+def parse_upstream(s):
+    """Parse 'host:port' into a (host, port) tuple; '' means no upstream."""
+    if not s:
+        return None
+    host, sep, port = s.rpartition(':')
+    if not sep or not host or not port.isdigit():
+        raise ValueError(f'invalid upstream address {s!r}, expected host:port')
+    return host.strip('[]'), int(port)
+
+
+def parse_encap(header, length_offset, length_base):
+    """Validate UDP encapsulation settings; length_base defaults to the header size."""
+    if header < 0:
+        raise ValueError(f'invalid encap_header: {header}')
+    if length_offset >= 0 and length_offset + 2 > header:
+        raise ValueError(f'encap_length_offset {length_offset} does not fit in a {header}-byte header')
+    return header, length_offset, header if length_base is None else length_base
+
+
+def parse_keepalive(value):
+    """TCP keepalive setting: '' keeps the OS default (None), 'off' / 'disabled' / '0s'
+    turns probes off (0.0), a duration enables them with that idle time and interval."""
+    if value in ('', None):
+        return None
+    if value is False or str(value).lower() in ('off', 'disabled', 'false'):
+        return 0.0
+    period = parse_duration(value)
+    if period < 0:
+        raise ValueError(f'invalid keepalive period: {value!r}')
+    return period
+
+
+def parse_dscp(value):
+    """DSCP code point from a number (0-63) or a class name: 'EF', 'CS0'..'CS7', 'AF11'..'AF43'."""
+    name = str(value).strip().upper()
+    if name == 'EF':
+        return 46
+    m = re.fullmatch(r'CS([0-7])', name)
+    if m:
+        return int(m.group(1)) * 8
+    m = re.fullmatch(r'AF([1-4])([1-3])', name)
+    if m:
+        return int(m.group(1)) * 8 + int(m.group(2)) * 2
+    if not name.isdigit() or int(name) > 63:
+        raise ValueError(f'invalid dscp: {value!r}')
+    return int(name)
+
+
+def parse_multicast(groups):
+    """Multicast group addresses from a list or a single comma-separated string."""
+    if isinstance(groups, str):
+        groups = [g for g in groups.split(',') if g.strip()]
+    result = []
+    for group in groups or ():
+        try:
+            address = ipaddress.ip_address(group.strip())
+        except ValueError:
+            raise ValueError(f'invalid multicast group: {group!r}') from None
+        if not address.is_multicast:
+            raise ValueError(f'not a multicast address: {group!r}')
+        result.append(str(address))
+    return result
+
+
+def parse_interface_id(value):
+    """An IPv6 interface identifier such as '::2' (only the low 64 bits count); '' for none."""
+    if not value:
+        return ''
+    try:
+        address = ipaddress.IPv6Address(value)
+    except ValueError:
+        raise ValueError(f'invalid IPv6 interface identifier: {value!r} (e.g. ::2)') from None
+    if int(address) >> 64:
+        raise ValueError(f'interface identifier {value!r} has prefix bits set (use e.g. ::2)')
+    return str(address)
+
+
+def parse_accept_pool(accept_rate, workers):
+    """Validate the accept_rate (connections/s, 0 unlimited) and workers (0: a thread per connection) settings."""
+    if accept_rate < 0:
+        raise ValueError(f'accept_rate must not be negative: {accept_rate}')
+    if workers < 0:
+        raise ValueError(f'workers must not be negative: {workers}')
+    return accept_rate, workers
+
+
+def parse_probe(probe_idle, probe_payload, probe_timeout):
+    """The idle probing settings (see probe.py): durations in seconds and the payload as bytes."""
+    idle, timeout = parse_duration(probe_idle), parse_duration(probe_timeout)
+    if idle and timeout <= 0:
+        raise ValueError('probe_timeout must be positive')
+    return idle, parse_escaped(probe_payload), timeout
+
+
+def parse_socket_options(value):
+    """SocketOptions from a {"rcvbuf", "sndbuf", "user_timeout", "dscp" or "tos"} object."""
+    from yourtestsrv.netutil import SocketOptions
+    value = dict(value or {})
+    unknown = set(value) - {'rcvbuf', 'sndbuf', 'user_timeout', 'dscp', 'tos'}
+    if unknown:
+        raise ValueError(f'unknown socket option(s): {", ".join(sorted(unknown))}')
+    rcvbuf, sndbuf = value.get('rcvbuf', 0), value.get('sndbuf', 0)
+    if rcvbuf < 0 or sndbuf < 0:
+        raise ValueError('socket buffer sizes must not be negative')
+    user_timeout = parse_duration(value.get('user_timeout') or '0s')
+    if user_timeout and not hasattr(socket, 'TCP_USER_TIMEOUT'):
+        raise ValueError('user_timeout needs TCP_USER_TIMEOUT, which this platform lacks')
+    dscp, tos = value.get('dscp', ''), value.get('tos', '')
+    if dscp != '' and tos != '':
+        raise ValueError('set only one of dscp and tos')
+    if dscp != '':
+        tos = parse_dscp(dscp) << 2
+    elif tos != '':
+        tos = int(tos, 0) if isinstance(tos, str) else tos
+        if not 0 <= tos <= 255:
+            raise ValueError(f'invalid tos: {tos}')
+    else:
+        tos = None
+    return SocketOptions(rcvbuf, sndbuf, user_timeout, tos)
+
+
+def parse_proxy_protocol(mode):
+    from yourtestsrv.proxyproto import MODES
+    if mode not in MODES:
+        raise ValueError(f'unknown proxy_protocol mode: {mode!r}')
+    return mode
+
+
+ACCEPT_CLOSE_MODES = ('fin', 'rst')
+
+
 class TCPConfig:
-    def __init__(self, port=9000, delay='0s', close_after='0s'):
+    def __init__(self, port=9000, delay='0s', close_after='0s', response=None, response_hex='',
+                 response_file='', framing='raw', delimiter='\\n', max_line_length=4096, rate_limit='',
+                 corrupt_rate=0.0, close_mode='fin', close_after_bytes=0,
+                 stall=False, ws_port=0, idle_timeout='30s', max_connections=0, over_limit='refuse',
+                 over_limit_banner='ERROR server full\\r\\n', accept_delay='0s', handshake_rate=0, accept_rate=0,
+                 workers=0, proxy_protocol='', upstream='', banner='', rules=None, fault_rules=None,
+                 response_capture=None, keepalive='', trickle_delay='0s', trickle_chunk=1, disconnect_rate=0.0,
+                 socket_options=None, buffer_size=4096, zero_copy=False, drop_link_local=False, record='',
+                 replay='', ws_ping_interval='0s', ws_pong_timeout='0s', ws_ignore_pings=False, jitter='0s',
+                 latency='', accept_close_rate=0.0, accept_close_bytes=0, accept_close_mode='fin', probe_idle='0s',
+                 probe_payload='', probe_timeout='10s'):
         self.port = port
         self.tls_port = port + 10000
         self.delay = parse_duration(delay)
+        self.jitter = parse_duration(jitter)
+        # Draws every delay from a distribution instead (see shaping.Latency).
+        self.latency = Latency(latency) if latency else None
         self.close_after = parse_duration(close_after)
+        if len([r for r in (response, response_hex, response_file, response_capture) if r]) > 1:
+            raise ValueError('tcp: set only one of response, response_hex, response_file and response_capture')
+        if response:
+            self.response = BinaryTemplate(response)
+        elif response_hex:
+            self.response = FixedResponse.from_hex(response_hex)
+        elif response_file:
+            self.response = FixedResponse.from_file(response_file)
+        elif response_capture:
+            self.response = load_capture_response(response_capture)
+        else:
+            self.response = None
+        if framing not in ('raw', 'delim'):
+            raise ValueError(f'unknown tcp framing: {framing!r}')
+        self.framing = framing
+        self.delimiter = parse_delimiter(delimiter)
+        self.max_line_length = max_line_length
+        self.rate_limit = parse_rate(rate_limit)
+        self.trickle_delay = parse_duration(trickle_delay)
+        if trickle_chunk < 1:
+            raise ValueError(f'tcp trickle_chunk must be at least 1: {trickle_chunk}')
+        self.trickle_chunk = trickle_chunk
+        if not 0.0 <= corrupt_rate <= 1.0:
+            raise ValueError(f'tcp corrupt_rate must be between 0 and 1: {corrupt_rate}')
+        self.corrupt_rate = corrupt_rate
+        if not 0.0 <= disconnect_rate <= 1.0:
+            raise ValueError(f'tcp disconnect_rate must be between 0 and 1: {disconnect_rate}')
+        self.disconnect_rate = disconnect_rate
+        if not 0.0 <= accept_close_rate <= 1.0:
+            raise ValueError(f'tcp accept_close_rate must be between 0 and 1: {accept_close_rate}')
+        if accept_close_bytes < 0:
+            raise ValueError(f'tcp accept_close_bytes must not be negative: {accept_close_bytes}')
+        if accept_close_mode not in ACCEPT_CLOSE_MODES:
+            raise ValueError(f'unknown tcp accept_close_mode: {accept_close_mode!r}')
+        # Connections closed right after accept, see TCPServer._close_on_accept.
+        self.accept_close_rate = accept_close_rate
+        self.accept_close_bytes = accept_close_bytes
+        self.accept_close_mode = accept_close_mode
+        self.probe_idle, self.probe_payload, self.probe_timeout = parse_probe(probe_idle, probe_payload, probe_timeout)
+        from yourtestsrv.tcp_server import CLOSE_MODES
+        if close_mode not in CLOSE_MODES:
+            raise ValueError(f'unknown tcp close_mode: {close_mode!r}')
+        self.close_mode = close_mode
+        self.close_after_bytes = close_after_bytes
+        self.stall = stall
+        self.ws_port = ws_port
+        self.ws_ping_interval = parse_duration(ws_ping_interval)
+        self.ws_pong_timeout = parse_duration(ws_pong_timeout)
+        self.ws_ignore_pings = ws_ignore_pings
+        self.idle_timeout = parse_duration(idle_timeout)
+        self.keepalive = parse_keepalive(keepalive)
+        self.socket_options = parse_socket_options(socket_options)
+        if buffer_size < 1:
+            raise ValueError(f'tcp buffer_size must be at least 1: {buffer_size}')
+        self.buffer_size = buffer_size
+        self.zero_copy = zero_copy
+        self.drop_link_local = drop_link_local
+        # Names of the session recording to write and of one to answer from (see yourtestsrv/recording.py);
+        # the replay is read from the store when the server is built.
+        self.record = record
+        self.replay = replay
+        self.max_connections, self.over_limit, self.over_limit_banner = parse_connection_limit(
+            max_connections, over_limit, over_limit_banner)
+        self.accept_delay = parse_duration(accept_delay)
+        self.handshake_rate = handshake_rate
+        self.accept_rate, self.workers = parse_accept_pool(accept_rate, workers)
+        self.proxy_protocol = parse_proxy_protocol(proxy_protocol)
+        self.upstream = parse_upstream(upstream)
+        self.banner = parse_banner(banner)
+        self.rules = RuleSet(rules) if rules else None
+        self.fault_rules = FaultRuleSet(fault_rules) if fault_rules else None
 
 
 class UDPConfig:
-    def __init__(self, port=9001, drop_rate=0.0, delay='0s'):
+    def __init__(self, port=9001, drop_rate=0.0, delay='0s', amplify=1, amplify_cap=0,
+                 outage_every='0s', outage_duration='0s', response=None, encap_header=0,
+                 encap_length_offset=-1, encap_length_base=None, response_capture=None,
+                 socket_options=None, fault_rules=None, reply_from_64='', drop_link_local=False, multicast=None,
+                 multicast_interface='', jitter='0s', rate_limit='', discovery_reply='', discovery_reply_hex='',
+                 duplicate_rate=0.0, duplicate_count=2, duplicate_gap='0s', reorder='', reorder_rate=1.0,
+                 sequence_field='', latency='', truncate_to=0, pad_to=0, stun='', stun_mapped=''):
         self.port = port
         self.drop_rate = drop_rate
+        if duplicate_count < 2:
+            raise ValueError(f'udp duplicate_count must be at least 2: {duplicate_count}')
+        self.duplicate_rate = duplicate_rate
+        self.duplicate_count = duplicate_count
+        self.duplicate_gap = parse_duration(duplicate_gap)
+        self.reorder = Distribution(reorder) if reorder else None
+        if not 0 <= reorder_rate <= 1:
+            raise ValueError(f'udp reorder_rate must be between 0 and 1: {reorder_rate}')
+        self.reorder_rate = reorder_rate
+        from yourtestsrv.sequence import SequenceField
+        self.sequence_field = SequenceField(sequence_field) if sequence_field else None
         self.delay = parse_duration(delay)
+        self.jitter = parse_duration(jitter)
+        self.latency = Latency(latency) if latency else None
+        self.rate_limit = parse_rate(rate_limit)
+        self.amplify = amplify
+        self.amplify_cap = amplify_cap
+        if truncate_to < 0:
+            raise ValueError(f'udp truncate_to must not be negative: {truncate_to}')
+        self.truncate_to = truncate_to
+        from yourtestsrv.udp_server import MAX_UDP_PAYLOAD
+        if not 0 <= pad_to <= MAX_UDP_PAYLOAD:
+            raise ValueError(f'udp pad_to must be between 0 and {MAX_UDP_PAYLOAD}: {pad_to}')
+        self.pad_to = pad_to
+        self.outage_every = parse_duration(outage_every)
+        self.outage_duration = parse_duration(outage_duration)
+        if response and response_capture:
+            raise ValueError('udp: set only one of response and response_capture')
+        self.response = BinaryTemplate(response) if response else None
+        if response_capture:
+            self.response = load_capture_response(response_capture)
+        self.encap_header, self.encap_length_offset, self.encap_length_base = parse_encap(
+            encap_header, encap_length_offset, encap_length_base)
+        self.socket_options = parse_socket_options(socket_options)
+        self.fault_rules = FaultRuleSet(fault_rules) if fault_rules else None
+        self.reply_from_64 = parse_interface_id(reply_from_64)
+        self.drop_link_local = drop_link_local
+        self.multicast = parse_multicast(multicast)
+        self.multicast_interface = multicast_interface
+        self.discovery_reply = parse_discovery_reply(discovery_reply, discovery_reply_hex)
+        from yourtestsrv.stun_server import STUNResponder
+        self.stun = STUNResponder(stun, stun_mapped) if stun else None
 
 
 class HTTPConfig:
-    def __init__(self, port=8080, slow_response=False, slow_duration='0s', error_code=200, chunked=False):
+    def __init__(self, port=8080, slow_response=False, slow_duration='0s', error_code=200, chunked=False,
+                 date_offset='0s', break_keepalive=False, strict=False, range_fault='', accept_delay='0s',
+                 handshake_rate=0, accept_rate=0, workers=0, proxy_protocol='', auth='', lockout_after=0,
+                 lockout_duration='0s',
+                 lockout_code=429, sign='', sign_key='', sign_header='X-Signature', sign_fault='',
+                 fault_rules=None, session_ttl='0s', session_sliding=False, session_login_path='/login',
+                 session_protect='^/api/', socket_options=None, capture='', latency='', upstream='', cache_ttl='0s',
+                 cache_fault=''):
         self.port = port
         self.tls_port = port + 10000
         self.slow_response = slow_response
         self.slow_duration = parse_duration(slow_duration)
+        self.latency = Latency(latency) if latency else None
         self.error_code = error_code
         self.chunked = chunked
+        self.date_offset = parse_duration(date_offset)
+        self.break_keepalive = break_keepalive
+        self.strict = strict
+        from yourtestsrv.http_server import RANGE_FAULTS
+        if range_fault not in RANGE_FAULTS:
+            raise ValueError(f'unknown http range_fault: {range_fault!r}')
+        self.range_fault = range_fault
+        self.accept_delay = parse_duration(accept_delay)
+        self.handshake_rate = handshake_rate
+        self.accept_rate, self.workers = parse_accept_pool(accept_rate, workers)
+        self.proxy_protocol = parse_proxy_protocol(proxy_protocol)
+        if auth and ':' not in auth:
+            raise ValueError('http auth must be user:password')
+        self.auth = auth
+        self.lockout_after = lockout_after
+        self.lockout_duration = parse_duration(lockout_duration)
+        from yourtestsrv.http_server import LOCKOUT_CODES
+        if lockout_code not in LOCKOUT_CODES:
+            raise ValueError(f'unsupported http lockout_code: {lockout_code}')
+        self.lockout_code = lockout_code
+        from yourtestsrv.signing import FAULTS, METHODS
+        if sign and sign not in METHODS:
+            raise ValueError(f'unknown http sign method: {sign!r}')
+        if sign and not sign_key:
+            raise ValueError('http sign needs sign_key')
+        if sign_fault not in FAULTS:
+            raise ValueError(f'unknown http sign_fault: {sign_fault!r}')
+        self.sign = sign
+        self.sign_key = sign_key
+        self.sign_header = sign_header
+        self.sign_fault = sign_fault
+        self.fault_rules = FaultRuleSet(fault_rules) if fault_rules else None
+        self.session_ttl = parse_duration(session_ttl)
+        self.session_sliding = session_sliding
+        self.session_login_path = session_login_path
+        re.compile(session_protect)
+        self.session_protect = session_protect
+        self.socket_options = parse_socket_options(socket_options)
+        # Name of the log every request is captured to (see yourtestsrv/storage.py).
+        self.capture = capture
+        self.upstream = parse_upstream(upstream)
+        self.cache_ttl = parse_duration(cache_ttl)
+        from yourtestsrv.http_proxy import CACHE_FAULTS
+        if cache_fault not in CACHE_FAULTS:
+            raise ValueError(f'unknown http cache_fault: {cache_fault!r}')
+        if (self.cache_ttl or cache_fault) and not self.upstream:
+            raise ValueError('http cache_ttl and cache_fault need an upstream')
+        self.cache_fault = cache_fault
 
 
 class MQTTConfig:
-    def __init__(self, port=1883, retain=False):
+    def __init__(self, port=1883, retain=False, publish=None, idle_timeout='60s', max_connections=0,
+                 over_limit='refuse', over_limit_banner='', accept_delay='0s', handshake_rate=0, accept_rate=0,
+                 workers=0, preload='',
+                 fault_rules=None, redirect='', redirect_code='use_another_server', cluster_port=0,
+                 socket_options=None, validators=None, probe_idle='0s', probe_payload='', probe_timeout='10s'):
         self.port = port
         self.tls_port = port + 10000
         self.retain = retain
+        self.preload = preload
+        self.idle_timeout = parse_duration(idle_timeout)
+        self.probe_idle, self.probe_payload, self.probe_timeout = parse_probe(probe_idle, probe_payload, probe_timeout)
+        self.max_connections, self.over_limit, self.over_limit_banner = parse_connection_limit(
+            max_connections, over_limit, over_limit_banner)
+        self.accept_delay = parse_duration(accept_delay)
+        self.handshake_rate = handshake_rate
+        self.accept_rate, self.workers = parse_accept_pool(accept_rate, workers)
+        self.socket_options = parse_socket_options(socket_options)
+        self.publish = publish or []
+        for spec in self.publish:
+            if 'topic' not in spec or 'payload' not in spec:
+                raise ValueError('mqtt.publish entries require "topic" and "payload"')
+            make_generator(spec['payload'])
+            parse_duration(spec.get('interval', '1s'))
+        self.fault_rules = FaultRuleSet(fault_rules) if fault_rules else None
+        from yourtestsrv.mqtt_server import REDIRECT_CODES
+        if redirect_code not in REDIRECT_CODES:
+            raise ValueError(f'unknown mqtt redirect_code: {redirect_code!r}')
+        self.redirect = redirect
+        self.redirect_code = redirect_code
+        # A second broker on this port shares retained messages, sessions and routing.
+        self.cluster_port = cluster_port
+        from yourtestsrv.payloadschema import ValidatorSet
+        self.validators = ValidatorSet(validators) if validators else None
+
+
+class STUNConfig:
+    def __init__(self, port=3478, mode='normal', mapped='', tcp=True):
+        from yourtestsrv.stun_server import MODES
+        if mode not in MODES:
+            raise ValueError(f'unknown stun mode: {mode!r}')
+        self.port = port
+        self.mode = mode
+        self.mapped = mapped
+        self.tcp = tcp
+
+
+class DNSConfig:
+    def __init__(self, port=1053, records=None, ttl=60, mode='normal', delay='0s', scenarios=None, tcp=True,
+                 dot_port=0, dot_mode='', doh_port=0, doh_mode='', doh_path='/dns-query'):
+        from yourtestsrv.dns_server import DOH_MODES, DOT_MODES, MODES, Scenario, parse_records
+        if mode not in MODES:
+            raise ValueError(f'unknown dns mode: {mode!r}')
+        if dot_mode and dot_mode not in DOT_MODES:
+            raise ValueError(f'unknown dns dot_mode: {dot_mode!r}')
+        if doh_mode and doh_mode not in DOH_MODES:
+            raise ValueError(f'unknown dns doh_mode: {doh_mode!r}')
+        self.port = port
+        # Name -> addresses / CNAME, see yourtestsrv/dns_server.py.
+        self.records = records or {}
+        parse_records(self.records, ttl)
+        self.ttl = ttl
+        self.mode = mode
+        self.delay = parse_duration(delay)
+        self.scenarios = list(scenarios or [])
+        for spec in self.scenarios:
+            Scenario(spec)
+        self.tcp = tcp
+        # DNS over TLS / HTTPS on these ports (0: off), answering like mode unless their own mode is set.
+        self.dot_port = dot_port
+        self.dot_mode = dot_mode
+        self.doh_port = doh_port
+        self.doh_mode = doh_mode
+        self.doh_path = doh_path
+
+
+class NTPConfig:
+    def __init__(self, port=1123, offset='0s', drift=0.0, jitter='0s', flap='0s', stratum=2, leap=0, refid='LOCL'):
+        self.port = port
+        # Added to the served time; see yourtestsrv/ntp_server.py.
+        self.offset = parse_duration(offset)
+        self.drift = drift
+        self.jitter = parse_duration(jitter)
+        self.flap = parse_duration(flap)
+        if not 0 <= stratum <= 16:
+            raise ValueError(f'ntp stratum must be between 0 and 16: {stratum}')
+        self.stratum = stratum
+        if leap not in (0, 1, 2, 3):
+            raise ValueError(f'ntp leap indicator must be 0 to 3: {leap}')
+        self.leap = leap
+        if not refid.isascii() or len(refid) > 4:
+            raise ValueError(f'ntp refid must be at most 4 ASCII characters: {refid!r}')
+        self.refid = refid
+
+
+class TFTPConfig:
+    def __init__(self, port=1069, root='.', blksize=65464, drop_rate=0.0, delay='0s', timeout='1s', retries=5,
+                 read_only=False):
+        from yourtestsrv.tftp_server import MAX_BLKSIZE, MIN_BLKSIZE
+        if not MIN_BLKSIZE <= blksize <= MAX_BLKSIZE:
+            raise ValueError(f'tftp blksize must be between {MIN_BLKSIZE} and {MAX_BLKSIZE}: {blksize}')
+        if not 0.0 <= drop_rate <= 1.0:
+            raise ValueError(f'tftp drop_rate must be between 0 and 1: {drop_rate}')
+        if retries < 0:
+            raise ValueError(f'tftp retries must not be negative: {retries}')
+        self.port = port
+        self.root = root
+        # Largest block size granted to clients asking for one (RFC 2348); 512 without the option.
+        self.blksize = blksize
+        self.drop_rate = drop_rate
+        self.delay = parse_duration(delay)
+        self.timeout = parse_duration(timeout)
+        self.retries = retries
+        self.read_only = read_only
+
+
+class SyslogConfig:
+    def __init__(self, port=1514, tcp=True, limit=1000):
+        if limit < 1:
+            raise ValueError(f'syslog limit must be at least 1: {limit}')
+        self.port = port
+        self.tcp = tcp
+        # Messages kept in memory for the admin API, oldest dropped first.
+        self.limit = limit
+
+
+class PairedConfig:
+    def __init__(self, port=9002, delay='0s', drop_rate=0.0, corrupt_rate=0.0):
+        self.port = port
+        self.delay = parse_duration(delay)
+        self.drop_rate = drop_rate
+        self.corrupt_rate = corrupt_rate
+
+
+class SOCKSConfig:
+    def __init__(self, port=1080, delay='0s', drop_rate=0.0, reply_code=0, auth=''):
+        if not 0 <= reply_code <= 255:
+            raise ValueError(f'invalid socks reply_code: {reply_code}')
+        if auth and ':' not in auth:
+            raise ValueError('socks auth must be user:password')
+        self.port = port
+        self.delay = parse_duration(delay)
+        self.drop_rate = drop_rate
+        self.reply_code = reply_code
+        self.auth = auth
+
+
+class SFTPConfig:
+    def __init__(self, port=2222, root='.', username='', password='', host_key='', delay='0s', rate_limit='',
+                 fail_upload_after=0, fail_download_after=0, fail_mode='error', read_only=False):
+        from yourtestsrv.sftp_server import FAIL_MODES
+        if fail_mode not in FAIL_MODES:
+            raise ValueError(f'unknown sftp fail_mode: {fail_mode!r}')
+        if fail_upload_after < 0 or fail_download_after < 0:
+            raise ValueError('sftp fail_upload_after/fail_download_after must not be negative')
+        self.port = port
+        self.root = root
+        self.username = username
+        self.password = password
+        # File holding the Ed25519 host key seed; created on first start. Empty: a new key every start.
+        self.host_key = host_key
+        self.delay = parse_duration(delay)
+        self.rate_limit = parse_rate(rate_limit)
+        self.fail_upload_after = fail_upload_after
+        self.fail_download_after = fail_download_after
+        self.fail_mode = fail_mode
+        self.read_only = read_only
+
+
+class NTRIPConfig:
+    def __init__(self, port=2101, auth='', mountpoints=None):
+        from yourtestsrv.ntrip_server import Mountpoint
+        if auth and ':' not in auth:
+            raise ValueError('ntrip auth must be user:password')
+        self.port = port
+        self.auth = auth
+        # Raw mountpoint specs (see yourtestsrv/ntrip_server.py), so command-line scenario flags can be merged in.
+        self.mountpoints = mountpoints or [{'name': 'RTCM3'}]
+        for spec in self.mountpoints:
+            Mountpoint(**spec)
+
+
+class TelnetConfig:
+    def __init__(self, port=2323, prompt='$ ', banner='', username='', password='', responses=None, negotiate=True,
+                 echo=True, delay='0s'):
+        self.port = port
+        self.prompt = prompt
+        self.banner = banner
+        # Both empty: no login prompts.
+        self.username = username
+        self.password = password
+        # Command line -> canned reply.
+        self.responses = responses or {}
+        self.negotiate = negotiate
+        self.echo = echo
+        self.delay = parse_duration(delay)
+
+
+class ICMPConfig:
+    def __init__(self, drop_rate=0.0, delay='0s'):
+        self.drop_rate = drop_rate
+        self.delay = parse_duration(delay)
+
+
+class ACMEConfig:
+    """ACME certificate for the HTTP/MQTT TLS listeners (see yourtestsrv/acme.py); off without domains."""
+
+    def __init__(self, domains=None, email='', directory='', challenge='dns-01', dns_hook='', dns_wait='30s',
+                 http_port=80, dir='acme', renew_before='720h'):
+        from yourtestsrv.acme import CHALLENGES, LETSENCRYPT
+        if challenge not in CHALLENGES:
+            raise ValueError(f'unknown acme challenge: {challenge!r}')
+        self.domains = list(domains or [])
+        self.email = email
+        self.directory = directory or LETSENCRYPT
+        self.challenge = challenge
+        self.dns_hook = dns_hook
+        self.dns_wait = parse_duration(dns_wait)
+        self.http_port = http_port
+        self.dir = dir
+        self.renew_before = parse_duration(renew_before)
+        self.validate()
+
+    def validate(self):
+        if self.domains and self.challenge == 'dns-01' and not self.dns_hook:
+            raise ValueError('acme dns-01 needs dns_hook (or use challenge http-01)')
+
+
+class TLSConfig:
+    """Settings shared by every TLS listener (TCP, HTTP and MQTT)."""
+
+    def __init__(self, client_ca_file='', require_client_cert=False, min_version='', max_version='', ciphers='',
+                 alpn=None, alpn_strict=False, acme=None):
+        from yourtestsrv.netutil import TLS_VERSIONS
+        if require_client_cert and not client_ca_file:
+            raise ValueError('tls require_client_cert needs client_ca_file')
+        for version in (min_version, max_version):
+            if version and version not in TLS_VERSIONS:
+                raise ValueError(f'unknown tls version: {version!r} (use 1.0, 1.1, 1.2 or 1.3)')
+        self.client_ca_file = client_ca_file
+        self.require_client_cert = require_client_cert
+        self.min_version = min_version
+        self.max_version = max_version
+        self.ciphers = ciphers
+        self.alpn = list(alpn or [])
+        if alpn_strict and not self.alpn:
+            raise ValueError('tls alpn_strict needs an alpn protocol list')
+        self.alpn_strict = alpn_strict
+        self.acme = ACMEConfig(**(acme or {}))
 
 
 class ServerConfig:
-    def __init__(self, bind='0.0.0.0', tcp=None, udp=None, http=None, mqtt=None):
+    def __init__(self, bind='0.0.0.0', tcp=None, udp=None, http=None, mqtt=None, stun=None, icmp=None,
+                 socks=None, paired=None, sftp=None, ntrip=None, telnet=None, dns=None, ntp=None, tftp=None,
+                 syslog=None, tls=None, network_profile=''):
+        from yourtestsrv import netprofiles
         self.bind = bind or '0.0.0.0'
-        self.tcp = TCPConfig(**(tcp or {}))
-        self.udp = UDPConfig(**(udp or {}))
+        self.tls = TLSConfig(**(tls or {}))
+        # A radio link profile fills in the TCP/UDP settings not given explicitly, see yourtestsrv/netprofiles.py.
+        self.network_profile = network_profile
+        self.tcp = TCPConfig(**netprofiles.merge(network_profile, 'tcp', tcp or {}))
+        self.udp = UDPConfig(**netprofiles.merge(network_profile, 'udp', udp or {}))
         self.http = HTTPConfig(**(http or {}))
         self.mqtt = MQTTConfig(**(mqtt or {}))
+        self.stun = STUNConfig(**(stun or {}))
+        self.icmp = ICMPConfig(**(icmp or {}))
+        self.socks = SOCKSConfig(**(socks or {}))
+        self.paired = PairedConfig(**(paired or {}))
+        self.sftp = SFTPConfig(**(sftp or {}))
+        self.ntrip = NTRIPConfig(**(ntrip or {}))
+        self.telnet = TelnetConfig(**(telnet or {}))
+        self.dns = DNSConfig(**(dns or {}))
+        self.ntp = NTPConfig(**(ntp or {}))
+        self.tftp = TFTPConfig(**(tftp or {}))
+        self.syslog = SyslogConfig(**(syslog or {}))
+
+
+class AdminConfig:
+    def __init__(self, port=0, bind='127.0.0.1', pprof=False, watchdog_interval='30s',
+                 watchdog_max_idle='0s', watchdog_max_buffered=0):
+        self.port = port
+        self.bind = bind or '127.0.0.1'
+        self.pprof = pprof
+        self.watchdog_interval = parse_duration(watchdog_interval)
+        self.watchdog_max_idle = parse_duration(watchdog_max_idle)
+        self.watchdog_max_buffered = watchdog_max_buffered
+
+
+class BundleConfig:
+    def __init__(self, events=None, dir='bundles', cooldown='60s', storm_threshold=20, storm_window='10s'):
+        from yourtestsrv.bundle import EVENTS
+        self.events = list(events or [])
+        for event in self.events:
+            if event not in EVENTS:
+                raise ValueError(f'unknown bundle event: {event!r}')
+        self.dir = dir
+        self.cooldown = parse_duration(cooldown)
+        self.storm_threshold = storm_threshold
+        self.storm_window = parse_duration(storm_window)
+
+
+class LoadGenConfig:
+    def __init__(self, target='', devices=100, device_id='device-${index}', interval='10s', jitter='0s',
+                 ramp_up='0s', duration='0s', topic='devices/${device}/telemetry', qos=0, templates=None,
+                 workers=32, content_type='application/json', username='', password=''):
+        from yourtestsrv.loadgen import parse_target
+        if target:
+            parse_target(target)
+        self.target = target
+        if devices < 1:
+            raise ValueError(f'loadgen devices must be at least 1: {devices}')
+        self.devices = devices
+        self.device_id = device_id
+        self.interval = parse_duration(interval)
+        if self.interval <= 0:
+            raise ValueError(f'loadgen interval must be positive: {interval!r}')
+        self.jitter = parse_duration(jitter)
+        self.ramp_up = parse_duration(ramp_up)
+        self.duration = parse_duration(duration)
+        self.topic = topic
+        if qos not in (0, 1, 2):
+            raise ValueError(f'invalid loadgen qos: {qos!r}')
+        self.qos = qos
+        # {"payload": <generator spec>, "weight": 1} each, see yourtestsrv/loadgen.py.
+        self.templates = list(templates or [])
+        for spec in self.templates:
+            make_generator(spec['payload'])
+            if spec.get('weight', 1) <= 0:
+                raise ValueError(f'loadgen template weight must be positive: {spec["weight"]!r}')
+        if workers < 1:
+            raise ValueError(f'loadgen workers must be at least 1: {workers}')
+        self.workers = workers
+        self.content_type = content_type
+        self.username = username
+        self.password = password
 
 
 class Config:
-    def __init__(self, server=None, logging=None):
+    def __init__(self, server=None, logging=None, admin=None, schedule=None, bundle=None, state_dir='',
+                 storage='files', endpoints_file='', loadgen=None):
+        from yourtestsrv.schedule import parse_schedule
         self.server = ServerConfig(**(server or {}))
         self.logging_level = (logging or {}).get('level', 'info')
+        # Per-event log sampling rules, see yourtestsrv/logthrottle.py.
+        self.log_throttle = (logging or {}).get('throttle', [])
+        from yourtestsrv.logthrottle import ThrottleRule
+        for spec in self.log_throttle:
+            ThrottleRule(spec)
+        self.admin = AdminConfig(**(admin or {}))
+        self.schedule = parse_schedule(schedule)
+        self.bundle = BundleConfig(**(bundle or {}))
+        # Shared directory for everything persisted across restarts (stats.json, ...).
+        self.state_dir = state_dir
+        # Backend for recordings, captured requests and saved state, see yourtestsrv/storage.py.
+        from yourtestsrv.storage import check_spec
+        check_spec(storage)
+        self.storage = storage
+        # The startup banner is also written here, see yourtestsrv/endpoints.py.
+        self.endpoints_file = endpoints_file
+        self.loadgen = LoadGenConfig(**(loadgen or {}))
 
 
 def load(path):
     with open(path) as f:
         data = json.load(f)
+    data.pop('$schema', None)  # editor hint, see yourtestsrv/schema.py
     return Config(**data)
 
 
@@ -0,0 +1,95 @@
+import json
+import logging
+import time
+import urllib.error
+import urllib.request
+
+from yourtestsrv.mqtt_client import MQTTClient, MQTTClientError
+from yourtestsrv.payload import make_generator
+
+logger = logging.getLogger(__name__)
+
+DEFAULT_TELEMETRY = {'type': 'json',
+                     'template': '{"seq": ${counter}, "ts": ${timestamp}, "temp": ${random_float:20:30}}'}
+
+
+class DeviceSimulator:
+    """Scripted device: publishes telemetry on a schedule and answers commands.
+
+    MQTT: connects to mqtt_host:mqtt_port, publishes telemetry to telemetry_topic
+    every interval and replies to messages on command_topic via response_topic.
+    HTTP: POSTs the same telemetry to http_url every interval.
+    """
+
+    def __init__(self, client_id, interval=5.0, payload=None, mqtt_host=None, mqtt_port=1883,
+                 mqtt_tls=False, telemetry_topic=None, command_topic=None, response_topic=None,
+                 http_url=None):
+        self.client_id = client_id
+        self.interval = interval
+        self.generator = make_generator(payload or DEFAULT_TELEMETRY)
+        self.mqtt_host = mqtt_host
+        self.mqtt_port = mqtt_port
+        self.mqtt_tls = mqtt_tls
+        self.telemetry_topic = telemetry_topic or f'devices/{client_id}/telemetry'
+        self.command_topic = command_topic or f'devices/{client_id}/commands'
+        self.response_topic = response_topic or f'devices/{client_id}/responses'
+        self.http_url = http_url
+        self.client = None
+
+    def run(self, stop_event):
+        if self.mqtt_host:
+            self._connect_mqtt()
+        logger.info(f'Device {self.client_id} started, interval={self.interval}s')
+        try:
+            while True:
+                payload = self.generator.next()
+                if self.client:
+                    self._publish_telemetry(payload)
+                if self.http_url:
+                    self._post_telemetry(payload)
+                if stop_event.wait(self.interval):
+                    return
+        finally:
+            if self.client:
+                self.client.disconnect()
+            logger.info(f'Device {self.client_id} stopped')
+
+    def _connect_mqtt(self):
+        self.client = MQTTClient(self.mqtt_host, self.mqtt_port, self.client_id,
+                                 tls=self.mqtt_tls, on_message=self._on_command)
+        self.client.connect()
+        self.client.subscribe(self.command_topic, qos=1)
+        logger.info(f'Device {self.client_id} connected to {self.mqtt_host}:{self.mqtt_port}')
+
+    def _publish_telemetry(self, payload):
+        if self.client.is_closed():
+            logger.warning(f'Device {self.client_id} lost MQTT connection, reconnecting')
+            try:
+                self._connect_mqtt()
+            except (OSError, MQTTClientError) as e:
+                logger.warning(f'Device {self.client_id} reconnect failed: {e}')
+                return
+        try:
+            self.client.publish(self.telemetry_topic, payload)
+        except OSError as e:
+            logger.warning(f'Device {self.client_id} telemetry publish failed: {e}')
+
+    def _post_telemetry(self, payload):
+        req = urllib.request.Request(self.http_url, data=payload, method='POST',
+                                     headers={'Content-Type': 'application/json'})
+        try:
+            with urllib.request.urlopen(req, timeout=10) as resp:
+                logger.info(f'Device {self.client_id} HTTP telemetry: {resp.status}')
+        except (urllib.error.URLError, OSError) as e:
+            logger.warning(f'Device {self.client_id} HTTP telemetry failed: {e}')
+
+    def _on_command(self, topic, payload, qos, retain):
+        logger.info(f'Device {self.client_id} command on {topic}: {payload!r}')
+        response = {
+            'device': self.client_id,
+            'command': payload.decode('utf-8', errors='replace'),
+            'status': 'ok',
+            'ts': int(time.time()),
+        }
+        # QoS 0 so the reader thread never blocks waiting for an ack.
+        self.client.publish(self.response_topic, json.dumps(response).encode())
@@ -0,0 +1,411 @@
+"""DNS stub resolver with fault scenarios, for testing device DNS fallback.
+
+The responder plugs into UDPServer and TCPServer (same port) as their
+handler and answers A, AAAA and CNAME queries from a record map:
+
+  {"device.example.com": "192.0.2.10",
+   "dual.example.com": ["192.0.2.11", "2001:db8::11"],
+   "api.example.com": {"CNAME": "device.example.com", "ttl": 5},
+   "*.lab.example.com": {"A": ["192.0.2.20"], "AAAA": "2001:db8::20"}}
+
+A "*." entry matches any name below it that has no entry of its own.
+CNAMEs are followed through the map. Names not in the map are NXDOMAIN and
+names without a record of the asked type get an empty NOERROR answer.
+Answers too large for the client's UDP size (512 bytes, or its EDNS size)
+are sent truncated so the client retries over TCP. Modes:
+
+  normal     answer from the map
+  nxdomain   NXDOMAIN for every name
+  servfail   SERVFAIL
+  refused    REFUSED
+  truncate   over UDP, an empty answer with the TC bit set (TCP answers normally)
+  aaaa_only  A queries get an empty answer, AAAA are answered: an IPv6-only name
+  silent     no answer at all
+
+Scenarios apply a mode (and delay) to some names only; the first matching
+one wins, rate is the fraction of its queries affected:
+
+  {"name": "primary.example.com", "mode": "servfail", "rate": 0.5}
+  {"name": "*.example.com", "type": "AAAA", "mode": "silent", "delay": "3s"}
+
+The same records can be served encrypted: DNS over TLS (RFC 7858) is
+handle_tcp behind a TLS listener, DNS over HTTPS (RFC 8484) is DoHHandler
+behind an HTTPS one. Each can have a mode of its own (see with_mode), so a
+device can be tested falling back from encrypted to plain DNS; besides the
+modes above there are
+
+  reset       (DoT) connections are reset before the TLS handshake
+  http_error  (DoH) every query gets 503 Service Unavailable
+"""
+
+import base64
+import copy
+import fnmatch
+import ipaddress
+import logging
+import random
+import socket
+import struct
+import time
+import urllib.parse
+
+from yourtestsrv import logthrottle
+
+logger = logging.getLogger(__name__)
+
+TYPES = {'A': 1, 'NS': 2, 'CNAME': 5, 'SOA': 6, 'PTR': 12, 'MX': 15, 'TXT': 16, 'AAAA': 28, 'SRV': 33, 'OPT': 41,
+         'ANY': 255}
+TYPE_NAMES = {value: name for name, value in TYPES.items()}
+MODES = ('normal', 'nxdomain', 'servfail', 'refused', 'truncate', 'aaaa_only', 'silent')
+DOT_MODES = MODES + ('reset',)
+DOH_MODES = MODES + ('http_error',)
+DOH_PATH = '/dns-query'
+DOH_TYPE = 'application/dns-message'
+
+NOERROR, FORMERR, SERVFAIL, NXDOMAIN, NOTIMP, REFUSED = 0, 1, 2, 3, 4, 5
+RCODES = {'nxdomain': NXDOMAIN, 'servfail': SERVFAIL, 'refused': REFUSED}
+
+HEADER_SIZE = 12
+UDP_SIZE = 512
+# The UDP size we advertise in EDNS answers (the DNS flag day 2020 value).
+EDNS_SIZE = 1232
+MAX_CNAME_CHAIN = 8
+QUESTION_POINTER = struct.pack('>H', 0xC000 | HEADER_SIZE)
+
+
+class Query:
+    def __init__(self, id, flags, name, qtype, question, udp_size=UDP_SIZE, edns=False):
+        self.id = id
+        self.flags = flags
+        self.name = name
+        self.qtype = qtype
+        # The question section as received, echoed in the answer.
+        self.question = question
+        self.udp_size = udp_size
+        self.edns = edns
+
+    @property
+    def type_name(self):
+        return TYPE_NAMES.get(self.qtype, str(self.qtype))
+
+
+def read_name(data, pos):
+    """Decode the (possibly compressed) name at pos; returns (name, position after it)."""
+    labels, end, jumps = [], None, 0
+    while True:
+        if pos >= len(data):
+            raise ValueError('dns: truncated name')
+        length = data[pos]
+        if length & 0xC0 == 0xC0:
+            if pos + 2 > len(data) or jumps > 16:
+                raise ValueError('dns: bad name pointer')
+            if end is None:
+                end = pos + 2
+            pos = struct.unpack_from('>H', data, pos)[0] & 0x3FFF
+            jumps += 1
+            continue
+        if length & 0xC0:
+            raise ValueError('dns: bad label length')
+        pos += 1
+        if not length:
+            break
+        if pos + length > len(data):
+            raise ValueError('dns: truncated label')
+        labels.append(data[pos:pos + length].decode('ascii', errors='replace'))
+        pos += length
+    return '.'.join(labels), end if end is not None else pos
+
+
+def encode_name(name):
+    out = b''
+    for label in name.strip('.').split('.') if name.strip('.') else ():
+        raw = label.encode('idna')
+        if not 0 < len(raw) < 64:
+            raise ValueError(f'dns: bad label in {name!r}')
+        out += bytes([len(raw)]) + raw
+    return out + b'\x00'
+
+
+def parse_query(data):
+    """Parse a query message; raises ValueError."""
+    if len(data) < HEADER_SIZE:
+        raise ValueError('dns: message shorter than header')
+    id, flags, qdcount, ancount, nscount, arcount = struct.unpack_from('>HHHHHH', data)
+    if flags & 0x8000:
+        raise ValueError('dns: not a query')
+    if qdcount != 1:
+        raise ValueError(f'dns: {qdcount} questions')
+    name, pos = read_name(data, HEADER_SIZE)
+    if pos + 4 > len(data):
+        raise ValueError('dns: truncated question')
+    qtype = struct.unpack_from('>H', data, pos)[0]
+    question = data[HEADER_SIZE:pos + 4]
+    query = Query(id, flags, name.lower(), qtype, question)
+    pos += 4
+    # Look for an EDNS OPT record among the additional records.
+    for _ in range(ancount + nscount + arcount):
+        try:
+            _, pos = read_name(data, pos)
+        except ValueError:
+            break
+        if pos + 10 > len(data):
+            break
+        rtype, rclass, _, rdlength = struct.unpack_from('>HHIH', data, pos)
+        if rtype == TYPES['OPT']:
+            query.edns = True
+            query.udp_size = max(UDP_SIZE, rclass)
+        pos += 10 + rdlength
+    return query
+
+
+def build_response(query, rcode=NOERROR, answers=(), truncated=False):
+    """Encode the answer to query; answers are (name, type name, ttl, value) tuples."""
+    flags = 0x8000 | (query.flags & 0x7900) | 0x0400 | 0x0080 | rcode
+    if truncated:
+        flags |= 0x0200
+        answers = ()
+    body = query.question
+    for name, rtype, ttl, value in answers:
+        if rtype == 'CNAME':
+            rdata = encode_name(value)
+        else:
+            rdata = ipaddress.ip_address(value).packed
+        # Owner names equal to the question's point back to it.
+        owner = QUESTION_POINTER if name == query.name else encode_name(name)
+        body += owner + struct.pack('>HHIH', TYPES[rtype], 1, ttl, len(rdata)) + rdata
+    additional = 0
+    if query.edns:
+        body += b'\x00' + struct.pack('>HHIH', TYPES['OPT'], EDNS_SIZE, 0, 0)
+        additional = 1
+    return struct.pack('>HHHHHH', query.id, flags, 1, len(answers), 0, additional) + body
+
+
+def parse_response(data):
+    """Decode an answer: (id, flags, rcode, [(name, type name, ttl, value)]); for tests and clients."""
+    id, flags, qdcount, ancount, _, _ = struct.unpack_from('>HHHHHH', data)
+    pos = HEADER_SIZE
+    for _ in range(qdcount):
+        _, pos = read_name(data, pos)
+        pos += 4
+    answers = []
+    for _ in range(ancount):
+        name, pos = read_name(data, pos)
+        rtype, _, ttl, rdlength = struct.unpack_from('>HHIH', data, pos)
+        pos += 10
+        rdata = data[pos:pos + rdlength]
+        type_name = TYPE_NAMES.get(rtype, str(rtype))
+        if type_name == 'CNAME':
+            value = read_name(data, pos)[0]
+        elif type_name in ('A', 'AAAA'):
+            value = str(ipaddress.ip_address(rdata))
+        else:
+            value = rdata
+        answers.append((name, type_name, ttl, value))
+        pos += rdlength
+    return id, flags, flags & 0x000F, answers
+
+
+def parse_records(records, ttl=60):
+    """Normalise the record map to {name: {"A": [...], "AAAA": [...], "CNAME": target, "ttl": n}}."""
+    zone = {}
+    for name, value in (records or {}).items():
+        if not isinstance(value, dict):
+            value = {'addresses': value}
+        value = dict(value)
+        entry = {'A': [], 'AAAA': [], 'CNAME': value.pop('CNAME', None), 'ttl': int(value.pop('ttl', ttl))}
+        addresses = []
+        for key in ('addresses', 'A', 'AAAA'):
+            item = value.pop(key, [])
+            addresses += [item] if isinstance(item, str) else list(item)
+        if value:
+            raise ValueError(f'dns record {name!r}: unknown keys {sorted(value)} (use A, AAAA, CNAME, ttl)')
+        for address in addresses:
+            ip = ipaddress.ip_address(address)
+            entry['A' if ip.version == 4 else 'AAAA'].append(str(ip))
+        if entry['CNAME'] and (entry['A'] or entry['AAAA']):
+            raise ValueError(f'dns record {name!r}: a CNAME cannot have addresses too')
+        zone[name.lower().rstrip('.')] = entry
+    return zone
+
+
+class Scenario:
+    def __init__(self, spec):
+        from yourtestsrv.config import parse_duration
+        spec = dict(spec)
+        self.name = spec.pop('name', '*').lower().rstrip('.')
+        self.type = spec.pop('type', '').upper()
+        self.mode = spec.pop('mode', 'normal')
+        self.rate = float(spec.pop('rate', 1.0))
+        self.delay = parse_duration(spec.pop('delay', '0s'))
+        if spec:
+            raise ValueError(f'unknown dns scenario keys: {sorted(spec)}')
+        if self.mode not in MODES:
+            raise ValueError(f'unknown dns mode: {self.mode!r}')
+        if self.type and self.type not in TYPES:
+            raise ValueError(f'unknown dns record type: {self.type!r}')
+        if not 0 <= self.rate <= 1:
+            raise ValueError('dns scenario rate must be between 0 and 1')
+
+    def matches(self, query):
+        if self.type and TYPES[self.type] != query.qtype:
+            return False
+        if not fnmatch.fnmatchcase(query.name, self.name):
+            return False
+        return self.rate >= 1 or random.random() < self.rate
+
+
+class DNSResponder:
+    def __init__(self, records=None, ttl=60, mode='normal', delay=0.0, scenarios=None):
+        if mode not in MODES:
+            raise ValueError(f'unknown dns mode: {mode!r}')
+        self.zone = parse_records(records, ttl)
+        self.mode = mode
+        self.delay = delay
+        self.scenarios = [Scenario(spec) for spec in scenarios or ()]
+
+    def with_mode(self, mode):
+        """This responder, or one answering from the same records and scenarios in another mode
+        (a DoT/DoH override). Transport modes (reset, http_error) and '' keep this one."""
+        if mode not in MODES or mode == self.mode:
+            return self
+        other = copy.copy(self)
+        other.mode = mode
+        return other
+
+    def lookup(self, name):
+        """The map entry for name: its own, else the closest "*." entry above it."""
+        if name in self.zone:
+            return self.zone[name]
+        labels = name.split('.')
+        for i in range(1, len(labels)):
+            entry = self.zone.get('*.' + '.'.join(labels[i:]))
+            if entry is not None:
+                return entry
+        return None
+
+    def resolve(self, name, qtype):
+        """(rcode, answers) for a query from the map, following CNAMEs."""
+        answers = []
+        for _ in range(MAX_CNAME_CHAIN):
+            entry = self.lookup(name)
+            if entry is None:
+                # A dangling CNAME still answers with the chain so far.
+                return (NOERROR if answers else NXDOMAIN), answers
+            if entry['CNAME'] and qtype != TYPES['CNAME']:
+                answers.append((name, 'CNAME', entry['ttl'], entry['CNAME']))
+                name = entry['CNAME'].lower().rstrip('.')
+                continue
+            for rtype in ('A', 'AAAA', 'CNAME'):
+                if qtype in (TYPES[rtype], TYPES['ANY']) and entry[rtype]:
+                    values = [entry[rtype]] if rtype == 'CNAME' else entry[rtype]
+                    answers += [(name, rtype, entry['ttl'], value) for value in values]
+            return NOERROR, answers
+        logger.warning(f'DNS CNAME chain for {name} longer than {MAX_CNAME_CHAIN}')
+        return SERVFAIL, []
+
+    def respond(self, addr, data, tcp=False):
+        """Return the answer to a query from addr, or None to stay silent."""
+        try:
+            query = parse_query(data)
+        except ValueError as e:
+            logger.debug(f'DNS ignored message from {addr}: {e}')
+            return None
+        mode, delay = self.mode, self.delay
+        for scenario in self.scenarios:
+            if scenario.matches(query):
+                mode, delay = scenario.mode, scenario.delay
+                break
+        logger.info(f'DNS {query.type_name} {query.name} from {addr}, mode {mode}',
+                    extra=logthrottle.event('dns.query'))
+        if delay > 0:
+            time.sleep(delay)
+        if mode == 'silent':
+            return None
+        if (query.flags >> 11) & 0x0F:
+            return build_response(query, NOTIMP)
+        if mode in RCODES:
+            return build_response(query, RCODES[mode])
+        if mode == 'truncate' and not tcp:
+            return build_response(query, truncated=True)
+        rcode, answers = self.resolve(query.name, query.qtype)
+        if mode == 'aaaa_only':
+            answers = [answer for answer in answers if answer[1] != 'A']
+        response = build_response(query, rcode, answers)
+        if not tcp and len(response) > query.udp_size:
+            logger.info(f'DNS answer for {query.name} ({len(response)} bytes) truncated for UDP')
+            response = build_response(query, rcode, truncated=True)
+        return response
+
+    def handle_udp(self, addr, data):
+        return self.respond(addr, data)
+
+    def handle_tcp(self, conn, addr):
+        """Answer queries framed with a 2-byte length prefix (RFC 1035 section 4.2.2)."""
+        conn.settimeout(30.0)
+        buf = b''
+        while True:
+            try:
+                chunk = conn.recv(4096)
+            except (socket.timeout, OSError):
+                return
+            if not chunk:
+                return
+            buf += chunk
+            while len(buf) >= 2:
+                length = struct.unpack_from('>H', buf)[0]
+                if len(buf) < 2 + length:
+                    break
+                message, buf = buf[2:2 + length], buf[2 + length:]
+                response = self.respond(addr, message, tcp=True)
+                if response:
+                    conn.sendall(struct.pack('>H', len(response)) + response)
+
+
+class DoHHandler:
+    """HTTPServer handler answering DNS over HTTPS (RFC 8484) queries on path:
+    GET with a base64url ?dns= parameter, or POST with an application/dns-message body."""
+
+    def __init__(self, responder, path=DOH_PATH, http_error=False):
+        self.responder = responder
+        self.path = path
+        self.http_error = http_error
+
+    def __call__(self, req):
+        from yourtestsrv.http_server import HTTPResponse
+
+        def error(code, message, detail=''):
+            return HTTPResponse(code, message, {'Content-Type': 'text/plain'}, f'{detail or message}\n'.encode())
+
+        url = urllib.parse.urlsplit(req.path)
+        if url.path != self.path:
+            return error(404, 'Not Found')
+        if req.method == 'GET':
+            param = urllib.parse.parse_qs(url.query).get('dns', [''])[0]
+            try:
+                message = base64.urlsafe_b64decode(param + '=' * (-len(param) % 4))
+            except ValueError:
+                return error(400, 'Bad Request', 'dns parameter is not base64url')
+        elif req.method == 'POST':
+            if req.headers.get('content-type', '').split(';', 1)[0].strip().lower() != DOH_TYPE:
+                return error(415, 'Unsupported Media Type', f'expected {DOH_TYPE}')
+            message = req.body
+        else:
+            resp = error(405, 'Method Not Allowed')
+            resp.headers['Allow'] = 'GET, POST'
+            return resp
+        try:
+            parse_query(message)
+        except ValueError as e:
+            return error(400, 'Bad Request', str(e))
+        if self.http_error:
+            logger.info('DoH query answered with 503 (http_error mode)')
+            return error(503, 'Service Unavailable')
+        response = self.responder.respond('DoH', message, tcp=True)
+        if response is None:
+            # 'silent': HTTP has to answer something, so it is what a proxy gives up with.
+            return error(504, 'Gateway Timeout')
+        headers = {'Content-Type': DOH_TYPE}
+        ttls = [ttl for _, _, ttl, _ in parse_response(response)[3]]
+        if ttls:
+            headers['Cache-Control'] = f'max-age={min(ttls)}'
+        return HTTPResponse(200, 'OK', headers, response)
@@ -0,0 +1,44 @@
+"""Traffic dump: a timestamped hexdump of every byte received and sent.
+
+One file can be shared by several servers; each record names the server
+and the peer so per-connection traffic can be followed with grep:
+
+  2026-01-02T03:04:05.678 tcp:9000 ('127.0.0.1', 51234) rx 5 bytes
+    00000000  68 65 6c 6c 6f                                    |hello|
+"""
+
+import threading
+import time
+
+
+def hexdump(data):
+    """Format data as offset / hex / ASCII lines, 16 bytes per line."""
+    lines = []
+    for offset in range(0, len(data), 16):
+        chunk = data[offset:offset + 16]
+        hex_part = ' '.join(f'{b:02x}' for b in chunk[:8])
+        if len(chunk) > 8:
+            hex_part += '  ' + ' '.join(f'{b:02x}' for b in chunk[8:])
+        text = ''.join(chr(b) if 32 <= b < 127 else '.' for b in chunk)
+        lines.append(f'  {offset:08x}  {hex_part:<49} |{text}|')
+    return lines
+
+
+class TrafficDump:
+    def __init__(self, path):
+        self.path = path
+        self._file = open(path, 'a', encoding='ascii')
+        self._lock = threading.Lock()
+
+    def record(self, server, peer, direction, data):
+        """Append one record; direction is 'rx' (from the peer) or 'tx' (to the peer)."""
+        now = time.time()
+        stamp = time.strftime('%Y-%m-%dT%H:%M:%S', time.localtime(now)) + f'.{int(now * 1000) % 1000:03d}'
+        lines = [f'{stamp} {server} {peer} {direction} {len(data)} bytes'] + hexdump(data)
+        with self._lock:
+            self._file.write('\n'.join(lines) + '\n')
+            self._file.flush()
+
+    def close(self):
+        with self._lock:
+            self._file.close()
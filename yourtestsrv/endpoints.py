@@ -0,0 +1,61 @@
+"""The startup banner: one JSON line listing every listener once it is bound.
+
+serve-all and tls print it on stdout after all listeners bind (the log goes
+to stderr), and write the same object to endpoints_file (--endpoints-file)
+when set, so test orchestrators read addresses from it instead of parsing
+log lines:
+
+  {"event": "ready", "version": "v1.0.0", "pid": 4242, "network_profile": "nbiot",
+   "endpoints": [{"protocol": "tcp", "transport": "tcp", "address": "0.0.0.0", "port": 9000,
+                  "tls": false, "listening": true}, ...]}
+
+protocol is one of tcp, udp, http, mqtt, mqtt-cluster, websocket and admin;
+network_profile is null without one. A listener that did not bind within
+TIMEOUT (port in use, ...) is listed with its configured port and
+"listening": false.
+"""
+
+import json
+import os
+import sys
+import time
+
+# Seconds to wait for all listeners to bind.
+TIMEOUT = 5.0
+
+
+def wait_bound(listeners, timeout=TIMEOUT, stop_event=None):
+    """Wait until every server in listeners ((protocol, server, tls) tuples) has an address."""
+    deadline = time.monotonic() + timeout
+    while any(srv.addr() is None for _, srv, _ in listeners) and time.monotonic() < deadline:
+        if stop_event is not None and stop_event.is_set():
+            return
+        time.sleep(0.01)
+
+
+def describe(protocol, srv, tls):
+    addr = srv.addr()
+    entry = {'protocol': protocol, 'transport': 'udp' if protocol == 'udp' else 'tcp',
+             'address': srv.bind, 'port': srv.port, 'tls': tls, 'listening': addr is not None}
+    if isinstance(addr, str):
+        entry.update(transport='unix', address=addr, port=None)
+    elif addr is not None:
+        entry.update(address=addr[0], port=addr[1])
+    return entry
+
+
+def banner(listeners, version, network_profile='', timeout=TIMEOUT, stop_event=None):
+    """The banner for listeners, once they are bound (or timeout passed)."""
+    wait_bound(listeners, timeout, stop_event)
+    return {'event': 'ready', 'version': version, 'pid': os.getpid(), 'network_profile': network_profile or None,
+            'endpoints': [describe(*listener) for listener in listeners]}
+
+
+def announce(info, path='', out=None):
+    """Print info as one JSON line and, with path, write it there (replacing the file atomically)."""
+    print(json.dumps(info), file=out or sys.stdout, flush=True)
+    if path:
+        tmp = path + '.tmp'
+        with open(tmp, 'w', encoding='utf-8') as f:
+            json.dump(info, f, indent=2)
+        os.replace(tmp, path)
@@ -0,0 +1,182 @@
+"""Pass/fail expectations over the server counters, for --run-for runs in CI.
+
+An expectation file is JSON, a list or {"expectations": [...]}:
+
+  {"name": "devices connected", "server": "tcp", "metric": "traffic.connections", "min": 10}
+  {"metric": "errors.parse", "max": 0}
+  {"server": "mqtt:1883", "metric": "frames_in", "equals": 42}
+
+metric is "traffic.<counter>", "errors.<category>" or, for UDP servers
+with a sequence field, "sequence.<counter>" (see sequence.py), for
+servers probing idle clients "probes.<counter>" (see probe.py); a bare
+counter name means traffic. server picks the servers whose counters are summed: a stats
+key ("tcp:9000"), a kind ("tcp" covers every tcp:* server) or nothing for
+all of them. min, max and equals may be combined.
+
+The run exits with EXIT_PASS, EXIT_FAILED when an expectation is not met or
+EXIT_STARTUP when the servers could not start (or one died during the run),
+and writes a JUnit XML report with one test case per expectation.
+"""
+
+import json
+import logging
+import os
+import time
+import xml.etree.ElementTree as ET
+
+from yourtestsrv import probe, sequence, stats
+
+logger = logging.getLogger(__name__)
+
+EXIT_PASS = 0
+EXIT_FAILED = 2
+EXIT_STARTUP = 3
+
+KEYS = ('name', 'server', 'metric', 'min', 'max', 'equals')
+
+
+class Expectation:
+    def __init__(self, metric, name='', server='', min=None, max=None, equals=None):
+        group, _, counter = metric.rpartition('.')
+        group = group or 'traffic'
+        known = {'traffic': stats.TRAFFIC_COUNTERS, 'errors': stats.ERROR_CATEGORIES,
+                 'sequence': sequence.COUNTERS, 'probes': probe.COUNTERS}.get(group, ())
+        if counter not in known:
+            raise ValueError(f'unknown expectation metric {metric!r} '
+                             '(use traffic.<counter>, errors.<category>, sequence.<counter> or probes.<counter>)')
+        if min is None and max is None and equals is None:
+            raise ValueError(f'expectation on {metric!r} needs min, max or equals')
+        self.group = group
+        self.counter = counter
+        self.server = server
+        self.min = min
+        self.max = max
+        self.equals = equals
+        self.name = name or f'{server or "all"} {group}.{counter}'
+
+    def value(self, snapshot):
+        """The metric summed over the selected servers of a stats.snapshot()."""
+        total = 0
+        for key, server_stats in snapshot.items():
+            if self.server and key != self.server and key.split(':', 1)[0] != self.server:
+                continue
+            total += server_stats.get(self.group, {}).get(self.counter, 0)
+        return total
+
+    def check(self, snapshot):
+        value = self.value(snapshot)
+        problems = []
+        if self.min is not None and value < self.min:
+            problems.append(f'below min {self.min}')
+        if self.max is not None and value > self.max:
+            problems.append(f'above max {self.max}')
+        if self.equals is not None and value != self.equals:
+            problems.append(f'expected {self.equals}')
+        return ExpectationResult(self.name, not problems, value, f'{self.group}.{self.counter} = {value}'
+                                 + (f' ({", ".join(problems)})' if problems else ''))
+
+
+class ExpectationResult:
+    def __init__(self, name, passed, value, detail):
+        self.name = name
+        self.passed = passed
+        self.value = value
+        self.detail = detail
+
+    def to_dict(self):
+        return {'name': self.name, 'passed': self.passed, 'value': self.value, 'detail': self.detail}
+
+
+def load(path):
+    with open(path) as f:
+        data = json.load(f)
+    if isinstance(data, dict):
+        data = data.get('expectations', [])
+    expectations = []
+    for entry in data:
+        unknown = set(entry) - set(KEYS)
+        if unknown:
+            raise ValueError(f'unknown expectation key(s): {", ".join(sorted(unknown))}')
+        expectations.append(Expectation(**entry))
+    return expectations
+
+
+def format_report(results):
+    return '\n'.join(f'{"PASS" if r.passed else "FAIL"}  {r.name:<32} {r.detail}' for r in results)
+
+
+def write_junit(path, suite, results, duration, error=''):
+    """Write a JUnit XML report; error (a startup failure) becomes a single errored test case."""
+    root = ET.Element('testsuites')
+    failures = sum(1 for r in results if not r.passed)
+    testsuite = ET.SubElement(root, 'testsuite', name=suite, tests=str(len(results) + bool(error)),
+                              failures=str(failures), errors=str(int(bool(error))), time=f'{duration:.3f}',
+                              timestamp=time.strftime('%Y-%m-%dT%H:%M:%S'))
+    if error:
+        case = ET.SubElement(testsuite, 'testcase', classname=suite, name='startup', time='0')
+        ET.SubElement(case, 'error', message=error).text = error
+    for r in results:
+        case = ET.SubElement(testsuite, 'testcase', classname=suite, name=r.name, time='0')
+        if not r.passed:
+            ET.SubElement(case, 'failure', message=r.detail).text = r.detail
+    ET.indent(root)
+    ET.ElementTree(root).write(path, encoding='utf-8', xml_declaration=True)
+
+
+class ScenarioRun:
+    """A timed run: serves for duration, then checks the expectations and picks the exit code.
+
+    Server threads started through guard() that raise end the run early as a
+    startup error.
+    """
+
+    def __init__(self, duration=0.0, expectations=(), junit_path='', suite='yourtestsrv'):
+        self.duration = duration
+        self.expectations = list(expectations)
+        self.junit_path = junit_path
+        self.suite = suite
+        self.errors = []
+        self._started = time.time()
+
+    def guard(self, fn, stop_event):
+        def run(*args):
+            try:
+                fn(*args)
+            except Exception as e:
+                logger.error(f'Server thread failed: {e}')
+                self.errors.append(str(e) or type(e).__name__)
+                stop_event.set()
+        return run
+
+    def wait(self, stop_event):
+        """Serve until duration has passed (forever without one), a signal or a failed server."""
+        stop_event.wait(self.duration or None)
+        stop_event.set()
+
+    def startup_failed(self, error):
+        logger.error(f'Startup failed: {error}')
+        self._write_junit([], error)
+        return EXIT_STARTUP
+
+    def finish(self, bundler=None):
+        """Evaluate the expectations, report them and return the exit code."""
+        if self.errors:
+            return self.startup_failed('; '.join(self.errors))
+        snapshot = stats.snapshot()
+        results = [e.check(snapshot) for e in self.expectations]
+        if results:
+            print(format_report(results))
+        failed = [r for r in results if not r.passed]
+        if failed and bundler and 'assertion' in bundler.events:
+            bundler.fire('assertion', '; '.join(f'{r.name}: {r.detail}' for r in failed))
+        self._write_junit(results)
+        logger.info(f'Run finished: {len(results) - len(failed)}/{len(results)} expectations passed')
+        return EXIT_FAILED if failed else EXIT_PASS
+
+    def _write_junit(self, results, error=''):
+        if not self.junit_path:
+            return
+        directory = os.path.dirname(self.junit_path)
+        if directory:
+            os.makedirs(directory, exist_ok=True)
+        write_junit(self.junit_path, self.suite, results, time.time() - self._started, error)
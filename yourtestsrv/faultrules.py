@@ -0,0 +1,90 @@
+"""Content-keyed faults: degrade only the messages that match.
+
+A list of rules, each a match key (as in rules.py: prefix / prefix_hex,
+exact / exact_hex, regex or json) plus the faults for matching traffic:
+
+  {"json": {"cmd": "fw_download"}, "delay": "3s", "drop_rate": 0.2}
+  {"path": "^/firmware/", "delay": "500ms", "error_code": 503}
+  {"topic": "devices/+/firmware", "corrupt_rate": 0.01}
+  {"prefix_hex": "a5", "ttl": 2, "dscp": "CS1"}
+
+What is matched depends on the server:
+
+  tcp   each frame (or received chunk with raw framing)
+  udp   each datagram, after any encapsulation header
+  http  the request body; path is a regex searched in the request path
+  mqtt  the PUBLISH payload; topic is an MQTT topic filter
+
+The first matching rule applies:
+
+  delay         wait before answering (TCP/UDP reply, HTTP response, MQTT routing)
+  drop_rate     fraction dropped: no TCP/UDP reply, HTTP connection closed without
+                a response, MQTT message acknowledged but not delivered
+  corrupt_rate  per-byte corruption of the TCP/UDP reply, HTTP body or MQTT payload
+  error_code    HTTP only: answer with this status instead
+  integrity     HTTP only: send a body checksum that does not match, as
+                content_md5, digest or trailer (see integrity.py)
+  ttl, dscp     UDP only: IP TTL (IPv6 hop limit) and DSCP of the reply, as a
+                rewriting router would leave them
+"""
+
+import random
+import re
+
+from yourtestsrv import faults, integrity
+from yourtestsrv.rules import Matcher
+
+
+class FaultRule:
+    def __init__(self, spec):
+        from yourtestsrv.config import parse_dscp, parse_duration
+        spec = dict(spec)
+        self.matcher = Matcher(spec)
+        path = spec.pop('path', None)
+        self.path = re.compile(path) if path else None
+        self.topic = spec.pop('topic', None)
+        self.delay = parse_duration(spec.pop('delay', '0s'))
+        self.drop_rate = float(spec.pop('drop_rate', 0.0))
+        self.corrupt_rate = float(spec.pop('corrupt_rate', 0.0))
+        self.error_code = int(spec.pop('error_code', 0))
+        self.integrity = spec.pop('integrity', '')
+        self.ttl = int(spec.pop('ttl', 0))
+        dscp = spec.pop('dscp', None)
+        self.tos = parse_dscp(dscp) << 2 if dscp is not None else None
+        if spec:
+            raise ValueError(f'unknown fault rule keys: {sorted(spec)}')
+        for name in ('drop_rate', 'corrupt_rate'):
+            if not 0 <= getattr(self, name) <= 1:
+                raise ValueError(f'fault rule {name} must be between 0 and 1')
+        if self.error_code and not 100 <= self.error_code <= 599:
+            raise ValueError(f'invalid fault rule error_code: {self.error_code}')
+        if self.integrity and self.integrity not in integrity.MODES:
+            raise ValueError(f'unknown fault rule integrity: {self.integrity!r} (use one of {integrity.MODES})')
+        if not 0 <= self.ttl <= 255:
+            raise ValueError(f'invalid fault rule ttl: {self.ttl}')
+
+    def matches(self, data, path=None, topic=None):
+        from yourtestsrv.mqtt_server import topic_matches
+        if self.path is not None and (path is None or not self.path.search(path)):
+            return False
+        if self.topic is not None and (topic is None or not topic_matches(self.topic, topic)):
+            return False
+        return self.matcher.matches(data)
+
+    def dropped(self):
+        return self.drop_rate > 0 and random.random() < self.drop_rate
+
+    def corrupt(self, data):
+        return faults.corrupt(data, self.corrupt_rate)
+
+
+class FaultRuleSet:
+    def __init__(self, specs):
+        self.rules = [FaultRule(spec) for spec in specs]
+
+    def match(self, data, path=None, topic=None):
+        """The first rule matching data (and the HTTP path or MQTT topic), or None."""
+        for rule in self.rules:
+            if rule.matches(data, path, topic):
+                return rule
+        return None
@@ -0,0 +1,23 @@
+"""Data mutations used by fault-injection options."""
+
+import random
+
+
+def corrupt(data, rate, rng=random):
+    """Return data with each byte mangled with probability rate.
+
+    A mangled byte either has one random bit flipped or is replaced by a
+    different random byte, so the result never equals the input at that
+    position.
+    """
+    if rate <= 0 or not data:
+        return data
+    out = bytearray(data)
+    for i in range(len(out)):
+        if rng.random() >= rate:
+            continue
+        if rng.random() < 0.5:
+            out[i] ^= 1 << rng.randrange(8)
+        else:
+            out[i] = (out[i] + rng.randrange(1, 256)) & 0xFF
+    return bytes(out)
@@ -0,0 +1,165 @@
+"""Named handlers swapped into running servers (admin API PUT /handlers/<name>).
+
+Iterating on stub behaviour no longer means editing the config and
+restarting, which drops every device connection. A handler is a canned
+behaviour for one scope of a TCP, HTTP or MQTT server:
+
+  tcp   the whole listener (port); the rule table and/or response used for
+        every frame from now on, open connections included:
+          {"rules": [...]}              match -> reply table, see rules.py
+          {"response": {...}}           binary template, see binproto.py
+          {"response_hex": "a55a00"}
+  http  requests whose path matches "route" (a regex searched in the path):
+          {"route": "^/api/v1/status", "status": 503, "headers": {...},
+           "body": "text" | "body_hex": "..." | "json": {...}, "delay": "2s"}
+  mqtt  PUBLISHes whose topic matches "topic" (a filter with +/#) get a
+        reply published by the broker:
+          {"topic": "dev/+/cmd", "reply_topic": "{topic}/ack",
+           "payload": "ok" | "payload_hex": "..." (default: the request's), "delay": "100ms"}
+
+Handlers of a server are kept by name; installing a name again replaces it
+in place, and the most recently installed handler wins when several match.
+Library users can do the same with srv.handlers.set(name, build(kind, spec)).
+"""
+
+import json
+import re
+import threading
+
+from yourtestsrv.binproto import BinaryTemplate, FixedResponse
+from yourtestsrv.config import parse_duration
+from yourtestsrv.rules import RuleSet
+
+KINDS = ('tcp', 'http', 'mqtt')
+
+
+def _check_keys(kind, spec, allowed):
+    unknown = set(spec) - set(allowed)
+    if unknown:
+        raise ValueError(f'unknown {kind} handler key(s): {", ".join(sorted(unknown))}')
+
+
+class TCPHandler:
+    kind = 'tcp'
+
+    def __init__(self, spec):
+        _check_keys('tcp', spec, ('rules', 'response', 'response_hex'))
+        if not spec:
+            raise ValueError('tcp handler needs rules, response or response_hex')
+        if 'response' in spec and 'response_hex' in spec:
+            raise ValueError('tcp handler: set only one of response and response_hex')
+        self.spec = spec
+        self.rules = RuleSet(spec['rules']) if spec.get('rules') else None
+        if 'response' in spec:
+            self.response = BinaryTemplate(spec['response'])
+        elif 'response_hex' in spec:
+            self.response = FixedResponse.from_hex(spec['response_hex'])
+        else:
+            self.response = None
+
+
+class HTTPHandler:
+    kind = 'http'
+
+    def __init__(self, spec):
+        _check_keys('http', spec, ('route', 'status', 'message', 'headers', 'body', 'body_hex', 'json', 'delay'))
+        if 'route' not in spec:
+            raise ValueError('http handler needs a "route"')
+        if len([k for k in ('body', 'body_hex', 'json') if k in spec]) > 1:
+            raise ValueError('http handler: set only one of body, body_hex and json')
+        self.spec = spec
+        self.route = re.compile(spec['route'])
+        self.status = int(spec.get('status', 200))
+        self.message = spec.get('message', 'OK' if self.status < 400 else 'Error')
+        self.headers = dict(spec.get('headers', {}))
+        if 'json' in spec:
+            self.body = (json.dumps(spec['json']) + '\n').encode()
+            self.headers.setdefault('Content-Type', 'application/json')
+        elif 'body_hex' in spec:
+            self.body = bytes.fromhex(spec['body_hex'])
+            self.headers.setdefault('Content-Type', 'application/octet-stream')
+        else:
+            self.body = spec.get('body', '').encode()
+            self.headers.setdefault('Content-Type', 'text/plain')
+        self.delay = parse_duration(spec.get('delay', '0s'))
+
+    def matches(self, path):
+        return self.route.search(path) is not None
+
+    def respond(self):
+        """(code, message, headers, body) for HTTPResponse."""
+        return self.status, self.message, dict(self.headers), self.body
+
+
+class MQTTHandler:
+    kind = 'mqtt'
+
+    def __init__(self, spec):
+        _check_keys('mqtt', spec, ('topic', 'reply_topic', 'payload', 'payload_hex', 'qos', 'delay'))
+        if 'topic' not in spec:
+            raise ValueError('mqtt handler needs a "topic" filter')
+        self.spec = spec
+        self.topic = spec['topic']
+        self.reply_topic = spec.get('reply_topic', '{topic}/reply')
+        if 'payload_hex' in spec:
+            self.payload = bytes.fromhex(spec['payload_hex'])
+        elif 'payload' in spec:
+            self.payload = spec['payload'].encode()
+        else:
+            self.payload = None
+        self.qos = int(spec.get('qos', 0))
+        if self.qos not in (0, 1, 2):
+            raise ValueError(f'mqtt handler qos must be 0, 1 or 2: {self.qos}')
+        self.delay = parse_duration(spec.get('delay', '0s'))
+
+    def reply(self, topic, payload):
+        """(topic, payload) to publish in answer to a PUBLISH."""
+        return self.reply_topic.replace('{topic}', topic), payload if self.payload is None else self.payload
+
+
+HANDLERS = {'tcp': TCPHandler, 'http': HTTPHandler, 'mqtt': MQTTHandler}
+
+
+def build(kind, spec):
+    """Build a handler for a server of kind; raises ValueError for bad specs."""
+    if kind not in HANDLERS:
+        raise ValueError(f'no handlers for {kind} servers (use one of {", ".join(KINDS)})')
+    try:
+        return HANDLERS[kind](dict(spec))
+    except (TypeError, KeyError, AttributeError, re.error) as e:
+        raise ValueError(f'invalid {kind} handler: {e}') from None
+
+
+class HandlerTable:
+    """The named handlers installed on one server."""
+
+    def __init__(self):
+        self._lock = threading.Lock()
+        self._handlers = {}
+
+    def __bool__(self):
+        return bool(self._handlers)
+
+    def set(self, name, handler):
+        """Install handler under name; returns True if it replaced one."""
+        with self._lock:
+            replaced = self._handlers.pop(name, None) is not None
+            self._handlers[name] = handler
+        return replaced
+
+    def remove(self, name):
+        with self._lock:
+            return self._handlers.pop(name, None) is not None
+
+    def match(self, predicate=None):
+        """The most recently installed handler for which predicate(handler) holds, or None."""
+        with self._lock:
+            handlers = list(self._handlers.values())
+        for handler in reversed(handlers):
+            if predicate is None or predicate(handler):
+                return handler
+        return None
+
+    def snapshot(self):
+        with self._lock:
+            return {name: handler.spec for name, handler in self._handlers.items()}
@@ -0,0 +1,294 @@
+"""Probe a device's embedded HTTP server with edge-case requests.
+
+Each probe opens a fresh connection, sends raw bytes and records how the
+server answered: status codes, number of responses, whether it closed the
+connection and how long it took. Nothing is judged pass/fail; the report
+is for comparing devices and spotting parser quirks.
+"""
+
+import logging
+import socket
+import ssl
+import time
+
+logger = logging.getLogger(__name__)
+
+PROBES = []
+
+
+def probe(name, description):
+    def register(fn):
+        PROBES.append((name, description, fn))
+        return fn
+    return register
+
+
+class ProbeResult:
+    def __init__(self, name, description):
+        self.name = name
+        self.description = description
+        self.statuses = []
+        self.closed = False
+        self.elapsed = 0.0
+        self.note = ''
+        self.error = ''
+
+    def to_dict(self):
+        return {'name': self.name, 'description': self.description, 'statuses': self.statuses,
+                'closed': self.closed, 'elapsed': round(self.elapsed, 3), 'note': self.note,
+                'error': self.error}
+
+
+def parse_responses(data):
+    """Split raw bytes into (status, headers, body) tuples; trailing garbage is ignored."""
+    responses = []
+    while data:
+        head_end = data.find(b'\r\n\r\n')
+        if head_end < 0 or not data.startswith(b'HTTP/'):
+            break
+        lines = data[:head_end].split(b'\r\n')
+        parts = lines[0].split(b' ', 2)
+        try:
+            status = int(parts[1])
+        except (IndexError, ValueError):
+            break
+        headers = {}
+        for line in lines[1:]:
+            name, _, value = line.partition(b':')
+            headers[name.strip().lower().decode('latin-1')] = value.strip().decode('latin-1')
+        rest = data[head_end + 4:]
+        if 100 <= status < 200 or status in (204, 304):
+            body = b''
+        elif 'chunked' in headers.get('transfer-encoding', '').lower():
+            body, rest = _dechunk(rest)
+        elif 'content-length' in headers:
+            try:
+                length = int(headers['content-length'])
+            except ValueError:
+                length = len(rest)
+            body, rest = rest[:length], rest[length:]
+        else:
+            body, rest = rest, b''
+        responses.append((status, headers, body))
+        data = rest
+    return responses
+
+
+def _dechunk(data):
+    body = b''
+    while True:
+        line_end = data.find(b'\r\n')
+        if line_end < 0:
+            return body, b''
+        try:
+            size = int(data[:line_end].split(b';')[0], 16)
+        except ValueError:
+            return body, b''
+        data = data[line_end + 2:]
+        if size == 0:
+            trailer_end = data.find(b'\r\n')
+            return body, data[trailer_end + 2:] if trailer_end >= 0 else b''
+        body += data[:size]
+        data = data[size + 2:]
+
+
+class HTTPProber:
+    def __init__(self, host, port, tls=False, timeout=3.0, path='/'):
+        self.host = host
+        self.port = port
+        self.tls = tls
+        self.timeout = timeout
+        self.path = path
+
+    def host_header(self):
+        return self.host if self.port in (80, 443) else f'{self.host}:{self.port}'
+
+    def request(self, method='GET', path=None, version='HTTP/1.1', headers=None, body=b''):
+        """Build a raw request; headers is a list of (name, value) pairs sent verbatim."""
+        if headers is None:
+            headers = [('Host', self.host_header()), ('Connection', 'close')]
+        lines = [f'{method} {path or self.path} {version}'] + [f'{k}: {v}' for k, v in headers]
+        return ('\r\n'.join(lines) + '\r\n\r\n').encode('latin-1') + body
+
+    def connect(self):
+        conn = socket.create_connection((self.host, self.port), timeout=self.timeout)
+        if self.tls:
+            ctx = ssl.create_default_context()
+            ctx.check_hostname = False
+            ctx.verify_mode = ssl.CERT_NONE
+            conn = ctx.wrap_socket(conn, server_hostname=self.host)
+        return conn
+
+    def read(self, conn, result, wait=None):
+        """Read until the server closes or stays quiet for wait seconds."""
+        conn.settimeout(wait or self.timeout)
+        data = b''
+        while True:
+            try:
+                chunk = conn.recv(65536)
+            except socket.timeout:
+                break
+            except OSError as e:
+                result.error = f'{type(e).__name__}: {e}'
+                result.closed = True
+                break
+            if not chunk:
+                result.closed = True
+                break
+            data += chunk
+        return data
+
+    def exchange(self, result, raw):
+        with self.connect() as conn:
+            conn.sendall(raw)
+            data = self.read(conn, result)
+        result.statuses = [status for status, _, _ in parse_responses(data)]
+        if data and not result.statuses:
+            result.note = f'unparseable response: {data[:40]!r}'
+        return data
+
+    def run(self, names=None):
+        results = []
+        for name, description, fn in PROBES:
+            if names and name not in names:
+                continue
+            result = ProbeResult(name, description)
+            start = time.time()
+            try:
+                fn(self, result)
+            except OSError as e:
+                result.error = f'{type(e).__name__}: {e}'
+            result.elapsed = time.time() - start
+            logger.info(f'HTTP probe {name}: {result.statuses} closed={result.closed} {result.error}')
+            results.append(result)
+        return results
+
+
+def format_report(results):
+    lines = []
+    for r in results:
+        statuses = ','.join(str(s) for s in r.statuses) or '-'
+        line = f'{r.name:<22} {statuses:<10} {"closed" if r.closed else "open":<7} {r.elapsed:6.2f}s'
+        extra = r.error or r.note
+        if extra:
+            line += f'  {extra}'
+        lines.append(line)
+    return '\n'.join(lines)
+
+
+@probe('baseline', 'plain GET with Host and Connection: close')
+def probe_baseline(p, r):
+    p.exchange(r, p.request())
+
+
+@probe('http10', 'HTTP/1.0 GET without Host')
+def probe_http10(p, r):
+    p.exchange(r, p.request(version='HTTP/1.0', headers=[]))
+
+
+@probe('missing_host', 'HTTP/1.1 GET without Host (RFC 7230 requires 400)')
+def probe_missing_host(p, r):
+    p.exchange(r, p.request(headers=[('Connection', 'close')]))
+
+
+@probe('pipelining', 'two GETs written back to back')
+def probe_pipelining(p, r):
+    first = p.request(headers=[('Host', p.host_header())])
+    p.exchange(r, first + p.request())
+    if len(r.statuses) < 2:
+        r.note = f'expected 2 responses, got {len(r.statuses)}'
+
+
+@probe('chunked_body', 'POST with a chunked request body')
+def probe_chunked_body(p, r):
+    headers = [('Host', p.host_header()), ('Connection', 'close'), ('Transfer-Encoding', 'chunked')]
+    p.exchange(r, p.request('POST', headers=headers, body=b'5\r\nhello\r\n0\r\n\r\n'))
+
+
+@probe('bad_chunk_size', 'chunked body with a non-hex chunk size')
+def probe_bad_chunk_size(p, r):
+    headers = [('Host', p.host_header()), ('Connection', 'close'), ('Transfer-Encoding', 'chunked')]
+    p.exchange(r, p.request('POST', headers=headers, body=b'zz\r\nhello\r\n0\r\n\r\n'))
+
+
+@probe('expect_100', 'POST with Expect: 100-continue, body sent only after the interim reply')
+def probe_expect_100(p, r):
+    headers = [('Host', p.host_header()), ('Connection', 'close'), ('Content-Length', '5'),
+               ('Expect', '100-continue')]
+    with p.connect() as conn:
+        conn.sendall(p.request('POST', headers=headers))
+        interim = p.read(conn, r, wait=1.0)
+        if interim.startswith(b'HTTP/1.1 100'):
+            r.note = 'sent 100 Continue'
+        elif not interim:
+            r.note = 'no interim response within 1s'
+        if not r.closed:
+            conn.sendall(b'hello')
+            interim += p.read(conn, r)
+    r.statuses = [status for status, _, _ in parse_responses(interim)]
+
+
+@probe('bare_lf', 'request lines terminated by LF only')
+def probe_bare_lf(p, r):
+    p.exchange(r, p.request().replace(b'\r\n', b'\n'))
+
+
+@probe('space_before_colon', 'header name followed by whitespace before the colon')
+def probe_space_before_colon(p, r):
+    p.exchange(r, p.request(headers=[('Host ', p.host_header()), ('Connection', 'close')]))
+
+
+@probe('obs_fold', 'obsolete line folding in a header value')
+def probe_obs_fold(p, r):
+    p.exchange(r, p.request(headers=[('Host', p.host_header()), ('Connection', 'close'),
+                                     ('X-Folded', 'a\r\n b')]))
+
+
+@probe('long_header', '8 KiB header value')
+def probe_long_header(p, r):
+    p.exchange(r, p.request(headers=[('Host', p.host_header()), ('Connection', 'close'),
+                                     ('X-Long', 'a' * 8192)]))
+
+
+@probe('long_uri', '8 KiB request target')
+def probe_long_uri(p, r):
+    p.exchange(r, p.request(path='/' + 'a' * 8192))
+
+
+@probe('unknown_method', 'method the server cannot know')
+def probe_unknown_method(p, r):
+    p.exchange(r, p.request('BREW'))
+
+
+@probe('lowercase_method', 'method in lower case (methods are case-sensitive)')
+def probe_lowercase_method(p, r):
+    p.exchange(r, p.request('get'))
+
+
+@probe('absolute_uri', 'absolute-form request target')
+def probe_absolute_uri(p, r):
+    p.exchange(r, p.request(path=f'http://{p.host_header()}{p.path}'))
+
+
+@probe('conflicting_length', 'two different Content-Length headers')
+def probe_conflicting_length(p, r):
+    headers = [('Host', p.host_header()), ('Connection', 'close'), ('Content-Length', '5'),
+               ('Content-Length', '6')]
+    p.exchange(r, p.request('POST', headers=headers, body=b'hello!'))
+
+
+@probe('length_and_chunked', 'Content-Length together with Transfer-Encoding: chunked')
+def probe_length_and_chunked(p, r):
+    headers = [('Host', p.host_header()), ('Connection', 'close'), ('Content-Length', '3'),
+               ('Transfer-Encoding', 'chunked')]
+    p.exchange(r, p.request('POST', headers=headers, body=b'5\r\nhello\r\n0\r\n\r\n'))
+
+
+@probe('http2_preface', 'HTTP/2 connection preface on a cleartext HTTP/1.1 port')
+def probe_http2_preface(p, r):
+    p.exchange(r, b'PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n')
+
+
+@probe('unsupported_version', 'HTTP/3.0 request line')
+def probe_unsupported_version(p, r):
+    p.exchange(r, p.request(version='HTTP/3.0'))
@@ -0,0 +1,104 @@
+"""Reverse-proxy mode for the HTTP server, with an optional response cache and staleness faults.
+
+Requests are forwarded to an upstream HTTP server (host, port), one upstream
+connection per request; upstream failures answer 502. With a cache TTL, GET
+responses with status 200 are kept per request target (unless the upstream
+says Cache-Control: no-store) and hits carry Age and X-Cache headers. Cache
+faults reproduce CDN staleness bugs:
+
+  stale         expired entries are still served; the upstream is never asked again
+  partial       only half of the body was cached: hits send it under the full Content-Length, then close
+  short_length  hits send the whole body but announce half of its length in Content-Length
+"""
+
+import http.client
+import logging
+import threading
+
+from yourtestsrv import clock as clock_module
+
+logger = logging.getLogger(__name__)
+
+CACHE_FAULTS = ('', 'stale', 'partial', 'short_length')
+# Hop-by-hop headers (RFC 9110 section 7.6.1) are not forwarded; the length is set again on the way out.
+HOP_HEADERS = ('connection', 'keep-alive', 'proxy-connection', 'te', 'trailer', 'transfer-encoding', 'upgrade',
+               'content-length')
+UPSTREAM_TIMEOUT = 10.0
+
+
+class CacheEntry:
+    def __init__(self, code, message, headers, body, stored):
+        self.code = code
+        self.message = message
+        self.headers = headers
+        self.body = body
+        self.stored = stored
+
+
+class ReverseProxy:
+    def __init__(self, upstream, cache_ttl=0.0, cache_fault='', clock=None):
+        if cache_fault not in CACHE_FAULTS:
+            raise ValueError(f'unknown http cache fault: {cache_fault!r}')
+        self.upstream = upstream
+        self.cache_ttl = cache_ttl
+        self.cache_fault = cache_fault
+        self.clock = clock_module.get(clock)
+        self._cache = {}
+        self._lock = threading.Lock()
+
+    def handle(self, req):
+        """The response to req: from the cache, else from the upstream."""
+        from yourtestsrv.http_server import HTTPResponse
+        cacheable = self.cache_ttl > 0 and req.method == 'GET'
+        if cacheable:
+            resp = self._cached(req.path)
+            if resp is not None:
+                return resp
+        host, port = self.upstream
+        try:
+            code, message, headers, body = self._forward(req)
+        except (OSError, http.client.HTTPException) as e:
+            logger.info(f'HTTP upstream {host}:{port} failed for {req.method} {req.path}: {e}')
+            return HTTPResponse(502, 'Bad Gateway', {'Content-Type': 'text/plain'}, f'upstream error: {e}\n'.encode())
+        if cacheable:
+            cache_control = next((v for k, v in headers.items() if k.lower() == 'cache-control'), '')
+            if code == 200 and 'no-store' not in cache_control.lower():
+                with self._lock:
+                    self._cache[req.path] = CacheEntry(code, message, dict(headers), body, self.clock.monotonic())
+            headers['X-Cache'] = 'MISS'
+        return HTTPResponse(code, message, headers, body)
+
+    def _cached(self, path):
+        from yourtestsrv.http_server import HTTPResponse
+        with self._lock:
+            entry = self._cache.get(path)
+        if entry is None:
+            return None
+        age = self.clock.monotonic() - entry.stored
+        if age >= self.cache_ttl and self.cache_fault != 'stale':
+            return None
+        headers = dict(entry.headers, Age=str(int(age)))
+        headers['X-Cache'] = 'HIT'
+        body = entry.body
+        if self.cache_fault == 'partial':
+            headers['Content-Length'] = str(len(body))
+            headers['Connection'] = 'close'
+            body = body[:len(body) // 2]
+        elif self.cache_fault == 'short_length':
+            headers['Content-Length'] = str(len(body) // 2)
+        if self.cache_fault:
+            logger.info(f'HTTP cache serves {path} with fault {self.cache_fault} (age {age:.1f}s)')
+        return HTTPResponse(entry.code, entry.message, headers, body)
+
+    def _forward(self, req):
+        host, port = self.upstream
+        conn = http.client.HTTPConnection(host, port, timeout=UPSTREAM_TIMEOUT)
+        try:
+            headers = {k: v for k, v in req.headers.items() if k.lower() not in HOP_HEADERS}
+            conn.request(req.method, req.path, body=req.body or None, headers=headers)
+            resp = conn.getresponse()
+            body = resp.read()
+            headers = {k: v for k, v in resp.getheaders() if k.lower() not in HOP_HEADERS}
+            return resp.status, resp.reason, headers, body
+        finally:
+            conn.close()
@@ -1,12 +1,72 @@
+import base64
+import re
+import secrets
 import socket
-import ssl
 import threading
 import time
 import logging
+from email.utils import formatdate
+
+from yourtestsrv import clock as clock_module
+from yourtestsrv import codec, handlers, http_proxy, integrity, logthrottle, netutil, proxyproto, stats, storage
+from yourtestsrv import traffic
+from yourtestsrv.signing import ResponseSigner
 
 logger = logging.getLogger(__name__)
 
 
+TOKEN_CHARS = frozenset("!#$%&'*+-.^_`|~0123456789"
+                        'abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ')
+HEX_DIGITS = frozenset(b'0123456789abcdefABCDEF')
+MAX_BYTES = 64 * 1024 * 1024
+RANGE_BOUNDARY = 'yourtestsrv-byteranges'
+# Requests with more ranges get the whole body (200), so 'bytes=0-,0-,...' cannot multiply it.
+MAX_RANGES = 50
+# wrong_boundary:    multipart parts delimited by a boundary other than the one in Content-Type
+# missing_close:     multipart body without the closing boundary
+# ignore:            Range is ignored and the full body is sent with 200
+RANGE_FAULTS = ('', 'wrong_boundary', 'missing_close', 'ignore')
+LOCKOUT_CODES = {423: 'Locked', 429: 'Too Many Requests'}
+
+
+def parse_range(value, length):
+    """Parse a Range header into a list of inclusive (start, end) pairs within length.
+
+    Returns None when the header is not a valid bytes range set (it is then ignored)
+    and an empty list when no range is satisfiable.
+    """
+    unit, _, spec = value.partition('=')
+    if unit.strip().lower() != 'bytes' or not spec.strip():
+        return None
+    ranges = []
+    for part in spec.split(','):
+        m = re.fullmatch(r'(\d*)-(\d*)', part.strip())
+        if not m or not (m.group(1) or m.group(2)):
+            return None
+        first, last = m.groups()
+        if not first:
+            suffix = int(last)
+            if suffix > 0 and length > 0:
+                ranges.append((max(0, length - suffix), length - 1))
+            continue
+        start = int(first)
+        end = int(last) if last else length - 1
+        if end < start:
+            return None
+        if start < length:
+            ranges.append((start, min(end, length - 1)))
+    return ranges
+
+
+class HTTPError(Exception):
+    """Request rejected with a specific status code."""
+
+    def __init__(self, code, message, detail=''):
+        super().__init__(f'{code} {message}: {detail}')
+        self.code = code
+        self.message = message
+
+
 class HTTPRequest:
     def __init__(self, method, path, version, headers, body):
         self.method = method
@@ -14,114 +74,433 @@ class HTTPRequest:
         self.version = version
         self.headers = headers
         self.body = body
+        self.proxy = None
 
 
 class HTTPResponse:
-    def __init__(self, code=200, message='OK', headers=None, body=None):
+    """A response; stream (an iterable of byte chunks) is sent chunked instead of body,
+    and the connection is closed once it is exhausted. A response with trailers is
+    sent chunked, the trailer fields after the last chunk."""
+
+    def __init__(self, code=200, message='OK', headers=None, body=None, stream=None):
         self.code = code
         self.message = message
         self.headers = headers or {}
         self.body = body
+        self.stream = stream
+        self.trailers = {}
+
+
+class AuthLockout:
+    """Basic auth that locks a client out after repeated failures, like cloud login endpoints.
+
+    After max_failures wrong attempts from one client address, every request from it
+    (even with valid credentials) gets code with Retry-After until duration has passed.
+    """
+
+    def __init__(self, credentials, max_failures=0, duration=0.0, code=429, clock=None):
+        if code not in LOCKOUT_CODES:
+            raise ValueError(f'unsupported lockout code: {code}')
+        self.expected = 'Basic ' + base64.b64encode(credentials.encode()).decode()
+        self.max_failures = max_failures
+        self.duration = duration
+        self.code = code
+        self.clock = clock_module.get(clock)
+        self._failures = {}
+        self._locked_until = {}
+        self._lock = threading.Lock()
+
+    def check(self, client, authorization):
+        """Return None when the request may proceed, else the 401 or lockout response."""
+        now = self.clock.time()
+        with self._lock:
+            until = self._locked_until.get(client, 0.0)
+            if until > now:
+                retry = max(1, int(until - now + 0.999))
+                return HTTPResponse(self.code, LOCKOUT_CODES[self.code],
+                                    {'Content-Type': 'text/plain', 'Retry-After': str(retry)},
+                                    f'locked out, retry in {retry}s\n'.encode())
+            if until:
+                del self._locked_until[client]
+            if authorization == self.expected:
+                self._failures.pop(client, None)
+                return None
+            if authorization:
+                failures = self._failures.get(client, 0) + 1
+                if self.max_failures and failures >= self.max_failures:
+                    logger.info(f'HTTP client {client} locked out for {self.duration}s after {failures} failures')
+                    self._failures.pop(client, None)
+                    self._locked_until[client] = now + self.duration
+                else:
+                    self._failures[client] = failures
+        return HTTPResponse(401, 'Unauthorized',
+                            {'Content-Type': 'text/plain', 'WWW-Authenticate': 'Basic realm="yourtestsrv"'},
+                            b'unauthorized\n')
+
+
+class SessionTokens:
+    """Login-issued bearer tokens with a short TTL, for exercising device session refresh.
+
+    A POST to login_path returns a new token (JSON body and a session cookie);
+    requests to paths matching the protect regex need it, as Authorization:
+    Bearer <token> or the cookie, and get 401 once it has expired. With sliding,
+    every accepted request pushes the expiry out by ttl again. Expiry follows
+    the server clock, so a virtual clock makes it deterministic.
+    """
+
+    # Expired tokens are remembered this long so their 401 says "expired", not "unknown".
+    FORGET_AFTER = 3600.0
+
+    def __init__(self, ttl, sliding=False, login_path='/login', protect='^/api/', clock=None):
+        self.ttl = ttl
+        self.sliding = sliding
+        self.login_path = login_path
+        self.protect = re.compile(protect)
+        self.clock = clock_module.get(clock)
+        self._expiry = {}
+        self._lock = threading.Lock()
+
+    def handle(self, req):
+        """Return the login or 401 response, or None when the request may proceed."""
+        path = req.path.split('?', 1)[0]
+        if path == self.login_path and req.method == 'POST':
+            return self._login(req)
+        if not self.protect.search(path):
+            return None
+        token = self._token(req.headers)
+        now = self.clock.time()
+        with self._lock:
+            expiry = self._expiry.get(token) if token else None
+            if expiry is not None and expiry > now:
+                if self.sliding:
+                    self._expiry[token] = now + self.ttl
+                return None
+        if expiry is None:
+            return self._unauthorized('Bearer realm="yourtestsrv"', b'missing or unknown session token\n')
+        logger.info(f'HTTP session token expired {now - expiry:.1f}s ago: {req.method} {req.path}')
+        return self._unauthorized('Bearer realm="yourtestsrv", error="invalid_token", '
+                                  'error_description="token expired"', b'session token expired\n')
+
+    def _login(self, req):
+        token = secrets.token_hex(16)
+        now = self.clock.time()
+        with self._lock:
+            self._expiry = {t: e for t, e in self._expiry.items() if e > now - self.FORGET_AFTER}
+            self._expiry[token] = now + self.ttl
+        fmt = codec.accepted_format(req.headers.get('accept', '')) or 'json'
+        body = codec.encode({'token': token, 'token_type': 'Bearer', 'expires_in': self.ttl}, fmt)
+        return HTTPResponse(200, 'OK', {'Content-Type': codec.CONTENT_TYPES[fmt], 'Cache-Control': 'no-store',
+                                        'Set-Cookie': f'session={token}; Max-Age={int(self.ttl)}; Path=/'}, body)
+
+    @staticmethod
+    def _token(headers):
+        scheme, _, value = headers.get('authorization', '').partition(' ')
+        if scheme.lower() == 'bearer':
+            return value.strip()
+        for part in headers.get('cookie', '').split(';'):
+            name, _, value = part.strip().partition('=')
+            if name == 'session':
+                return value
+        return ''
+
+    @staticmethod
+    def _unauthorized(challenge, body):
+        return HTTPResponse(401, 'Unauthorized', {'Content-Type': 'text/plain', 'WWW-Authenticate': challenge}, body)
 
 
 class HTTPServer:
+    stats_name = 'http'
+    tap_traffic = True
+
     def __init__(self, port, bind='0.0.0.0', slow_response=False, slow_duration=0.0,
-                 error_code=0, chunked=False, handler=None):
+                 error_code=0, chunked=False, handler=None, date_offset=0.0, break_keepalive=False,
+                 strict=False, unix_socket='', clock=None, range_fault='',
+                 accept_delay=0.0, handshake_rate=0.0, accept_rate=0.0, workers=0, proxy_protocol='', auth='',
+                 lockout_after=0,
+                 lockout_duration=0.0, lockout_code=429, sign='', sign_key='', sign_header='X-Signature',
+                 sign_fault='', fault_rules=None, session_ttl=0.0, session_sliding=False,
+                 session_login_path='/login', session_protect='^/api/', socket_options=None, capture='',
+                 store=None, latency=None, upstream=None, cache_ttl=0.0, cache_fault=''):
         self.port = port
         self.bind = bind or '0.0.0.0'
         self.slow_response = slow_response
         self.slow_duration = slow_duration
+        # Every response waits a delay drawn from this latency model (shaping.Latency) first.
+        self.latency = latency
         self.error_code = error_code
         self.chunked = chunked
         self.handler = handler
+        self.date_offset = date_offset
+        self.break_keepalive = break_keepalive
+        self.strict = strict
+        self.unix_socket = unix_socket
+        self.clock = clock_module.get(clock)
+        if range_fault not in RANGE_FAULTS:
+            raise ValueError(f'unknown http range fault: {range_fault!r}')
+        self.range_fault = range_fault
+        self.pacer = netutil.AcceptPacer(accept_delay, handshake_rate, self.clock, accept_rate)
+        self.workers = netutil.WorkerPool(workers, 'HTTP')
+        self.socket_options = socket_options or netutil.SocketOptions()
+        self.proxy_protocol = proxy_protocol
+        self.auth = AuthLockout(auth, lockout_after, lockout_duration, lockout_code, self.clock) if auth else None
+        self.signer = ResponseSigner(sign, sign_key, sign_header, sign_fault) if sign else None
+        self.fault_rules = fault_rules
+        # Reverse-proxy mode: requests go to the upstream (host, port), through a cache when cache_ttl > 0.
+        self.reverse_proxy = None
+        if upstream:
+            self.reverse_proxy = http_proxy.ReverseProxy(upstream, cache_ttl, cache_fault, self.clock)
+        # Every request is appended to the capture log in the store (see storage.py), for later analysis.
+        self.capture = capture
+        self.store = storage.get(store)
+        # Named per-route handlers installed at runtime (admin API), answering before handler.
+        self.handlers = handlers.HandlerTable()
+        self.session_tokens = None
+        if session_ttl > 0:
+            self.session_tokens = SessionTokens(session_ttl, session_sliding, session_login_path, session_protect,
+                                                self.clock)
+        self.stats = stats.ServerStats()
+        self.stats_key = f'{self.stats_name}:{port}'
+        self._addr = None
 
     def _serve(self, sock, stop_event):
+        self.socket_options.apply(sock)
         sock.settimeout(1.0)
-        logger.info(f'HTTP server listening on {self.bind}:{self.port}')
+        logger.info(f'HTTP server listening on {self._listen_name()}')
         try:
             while not stop_event.is_set():
+                if not self.pacer.before_accept(stop_event):
+                    break
                 try:
                     conn, addr = sock.accept()
                 except socket.timeout:
                     continue
                 except OSError:
                     break
-                t = threading.Thread(target=self._handle_conn, args=(conn, addr), daemon=True)
-                t.start()
+                self.pacer.after_accept(stop_event)
+                self.socket_options.apply(conn)
+                self.workers.submit(self._accept_proxied, conn, addr)
         finally:
             sock.close()
 
+    def addr(self):
+        """The bound (host, port) once listening, else None."""
+        return self._addr
+
+    def traffic_totals(self):
+        """Connections, bytes and frames in/out summed over all connections so far, open ones included."""
+        return self.stats.traffic.snapshot()
+
+    def _set_listener(self, sock):
+        self._addr = sock.getsockname()
+        if sock.family != socket.AF_UNIX:
+            self.port = self._addr[1]
+
+    def _listen_name(self):
+        return self.unix_socket or f'{self.bind}:{self.port}'
+
+    def _open_listener(self):
+        if self.unix_socket:
+            return netutil.listen_unix(self.unix_socket)
+        return netutil.listen_tcp(self.bind, self.port)
+
     def listen_and_serve(self, stop_event):
-        sock = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
-        sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
-        sock.bind((self.bind, self.port))
-        sock.listen(128)
+        try:
+            self.serve(stop_event, self._open_listener())
+        finally:
+            if self.unix_socket:
+                netutil.remove_unix(self.unix_socket)
+
+    def serve(self, stop_event, sock):
+        """Serve on a listening socket created by the caller (e.g. bound to port 0)."""
+        self._set_listener(sock)
+        self.stats_key = f'{self.stats_name}:{self.unix_socket or self.port}'
+        stats.register(self.stats_key, self.stats)
         self._serve(sock, stop_event)
 
-    def listen_and_serve_tls(self, stop_event, cert_file, key_file):
-        ctx = ssl.SSLContext(ssl.PROTOCOL_TLS_SERVER)
-        ctx.minimum_version = ssl.TLSVersion.TLSv1_2
-        ctx.load_cert_chain(cert_file, key_file)
-        sock = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
-        sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
-        sock.bind((self.bind, self.port))
-        sock.listen(128)
+    def listen_and_serve_tls(self, stop_event, cert_file, key_file, client_ca_file='', require_client_cert=False,
+                            min_version='', max_version='', ciphers='', alpn=(), alpn_strict=False):
+        try:
+            self.serve_tls(stop_event, self._open_listener(), cert_file, key_file, client_ca_file,
+                           require_client_cert, min_version, max_version, ciphers, alpn, alpn_strict)
+        finally:
+            if self.unix_socket:
+                netutil.remove_unix(self.unix_socket)
+
+    def serve_tls(self, stop_event, sock, cert_file, key_file, client_ca_file='', require_client_cert=False,
+                  min_version='', max_version='', ciphers='', alpn=(), alpn_strict=False):
+        ctx = netutil.server_tls_context(cert_file, key_file, client_ca_file, require_client_cert,
+                                         min_version, max_version, ciphers, alpn)
+        self._set_listener(sock)
+        self.socket_options.apply(sock)
         sock.settimeout(1.0)
-        logger.info(f'HTTP TLS server listening on {self.bind}:{self.port}')
+        self.stats_key = f'{self.stats_name}-tls:{self.unix_socket or self.port}'
+        stats.register(self.stats_key, self.stats)
+        logger.info(f'HTTP TLS server listening on {self._listen_name()}')
         try:
             while not stop_event.is_set():
+                if not self.pacer.before_accept(stop_event):
+                    break
                 try:
                     conn, addr = sock.accept()
                 except socket.timeout:
                     continue
                 except OSError:
                     break
-                try:
-                    conn.settimeout(5.0)
-                    tls_conn = ctx.wrap_socket(conn, server_side=True)
-                    tls_conn.settimeout(None)
-                except ssl.SSLError as e:
-                    logger.debug(f'HTTP TLS handshake error from {addr}: {e}')
-                    conn.close()
-                    continue
-                t = threading.Thread(target=self._handle_conn, args=(tls_conn, addr), daemon=True)
-                t.start()
+                self.pacer.after_accept(stop_event)
+                self.socket_options.apply(conn)
+                self.workers.submit(self._accept_tls, ctx, conn, addr, client_ca_file, alpn, alpn_strict)
         finally:
             sock.close()
 
-    def _handle_conn(self, conn, addr):
+    def _accept_tls(self, ctx, conn, addr, client_ca_file, alpn, alpn_strict):
+        """Read the PROXY header, if configured, and do the TLS handshake in the connection's own thread."""
+        addr, proxy = proxyproto.accept(conn, addr, self.proxy_protocol, self.stats)
+        if addr is None:
+            conn.close()
+            return
+        try:
+            conn.settimeout(5.0)
+            self.pacer.before_handshake()
+            tls_conn, offered = netutil.accept_tls(ctx, conn, alpn, alpn_strict)
+            tls_conn.settimeout(None)
+        except OSError as e:
+            logger.debug(f'HTTP TLS handshake error from {addr}: {e}')
+            self.stats.record_error(stats.ERROR_TLS)
+            conn.close()
+            return
+        if client_ca_file:
+            logger.info(f'HTTP TLS client certificate from {addr}: {netutil.peer_subject(tls_conn) or "none"}')
+        if alpn:
+            logger.info(f'HTTP TLS ALPN from {addr}: offered {offered or "none"}, '
+                        f'negotiated {tls_conn.selected_alpn_protocol() or "none"}')
+        self._handle_conn(tls_conn, addr, proxy)
+
+    def _accept_proxied(self, conn, addr):
+        addr, proxy = proxyproto.accept(conn, addr, self.proxy_protocol, self.stats)
+        if addr is None:
+            conn.close()
+            return
+        self._handle_conn(conn, addr, proxy)
+
+    def _handle_conn(self, conn, addr, proxy=None):
         conn.settimeout(30.0)
+        info = stats.connections.open(self.stats_key, addr, self.stats)
+        if proxy is not None:
+            info.proxy = proxy.to_dict()
+        conn = stats.CountingConn(conn, info)
         try:
             buf = b''
             while True:
                 try:
                     req, buf = self._parse_request(conn, buf)
+                except OSError:
+                    raise
+                except HTTPError as e:
+                    logger.debug(f'HTTP rejected request: {e}')
+                    self.stats.record_error(stats.ERROR_PARSE)
+                    self._send_error(conn, e.code, e.message)
+                    return
                 except Exception as e:
                     logger.debug(f'HTTP parse error: {e}')
+                    self.stats.record_error(stats.ERROR_PARSE)
                     self._send_error(conn, 400, 'Bad Request')
                     return
                 if req is None:
                     return
-                logger.info(f'HTTP request: {req.method} {req.path} {req.version}')
-                if self.handler:
-                    resp = self.handler(req)
-                else:
-                    resp = self._default_handle(req)
+                logger.info(f'HTTP request: {req.method} {req.path} {req.version}',
+                            extra=logthrottle.event('http.request'))
+                req.proxy = proxy
+                info.touch(len(buf) + len(req.body))
+                info.count('frames_in')
+                if self.tap_traffic:
+                    traffic.publish('http', self.stats_key, addr, 'request', req.body, method=req.method,
+                                    path=req.path, content_type=req.headers.get('content-type'))
+                resp = None
+                if self.auth:
+                    resp = self.auth.check(addr[0] if isinstance(addr, tuple) else addr,
+                                           req.headers.get('authorization', ''))
+                if resp is None and self.session_tokens:
+                    resp = self.session_tokens.handle(req)
+                if resp is None and self.handlers:
+                    resp = self._swapped_response(req)
+                if resp is None and self.reverse_proxy:
+                    resp = self.reverse_proxy.handle(req)
+                if resp is None:
+                    resp = self.handler(req) if self.handler else self._default_handle(req)
+                if 'range' in req.headers and req.method == 'GET' and resp.code == 200:
+                    resp = self._apply_range(req.headers['range'], resp)
+                if self.latency:
+                    self.clock.sleep(self.latency.sample())
                 if self.slow_response and self.slow_duration > 0:
-                    time.sleep(self.slow_duration)
+                    self.clock.sleep(self.slow_duration)
                 if self.error_code > 0 and self.error_code != 200:
                     resp.code = self.error_code
+                fault = self.fault_rules.match(req.body, path=req.path) if self.fault_rules else None
+                if fault:
+                    if fault.delay > 0:
+                        self.clock.sleep(fault.delay)
+                    if fault.dropped():
+                        logger.info(f'HTTP fault rule dropped {req.method} {req.path} from {addr}')
+                        self._capture(addr, req, None)
+                        return
+                    if fault.error_code:
+                        resp.code = fault.error_code
+                if self.signer:
+                    resp = self.signer.apply(resp)
+                if fault and resp.body:
+                    resp.body = fault.corrupt(resp.body)
+                if fault and fault.integrity:
+                    logger.info(f'HTTP fault rule sends a mismatching {fault.integrity} for {req.method} {req.path}')
+                    resp = integrity.mismatch(resp, fault.integrity)
+                keep_alive = self._wants_keep_alive(req) and resp.headers.get('Connection', '').lower() != 'close'
+                resp.headers.setdefault('Connection', 'keep-alive' if keep_alive else 'close')
                 self._send_response(conn, resp)
-                if req.headers.get('connection', '').lower() == 'close':
+                info.count('frames_out')
+                self._capture(addr, req, resp.code)
+                if resp.stream is not None:
                     return
-        except (ConnectionResetError, BrokenPipeError, OSError):
-            pass
+                if self.tap_traffic:
+                    traffic.publish('http', self.stats_key, addr, 'response', resp.body or b'', status=resp.code,
+                                    path=req.path, content_type=resp.headers.get('Content-Type'))
+                if self.break_keepalive:
+                    # Do the opposite of what was negotiated: drop keep-alive
+                    # connections and hold "close" connections open.
+                    keep_alive = not keep_alive
+                if not keep_alive:
+                    return
+        except OSError as e:
+            self.stats.record_error(e)
         finally:
+            stats.connections.close(info)
             try:
                 conn.close()
             except Exception:
                 pass
 
+    def _capture(self, addr, req, status):
+        """Append req and the status answered (None when dropped) to the capture log."""
+        if not self.capture:
+            return
+        entry = {'t': round(time.time(), 3), 'server': self.stats_key, 'peer': traffic.peer_name(addr),
+                 'method': req.method, 'path': req.path, 'version': req.version, 'headers': req.headers,
+                 'status': status}
+        try:
+            entry['body'] = req.body.decode()
+        except UnicodeDecodeError:
+            entry['hex'] = req.body.hex()
+        try:
+            self.store.append(self.capture, entry)
+        except OSError as e:
+            logger.warning(f'Capturing HTTP request to {self.capture} failed: {e}')
+
+    def _wants_keep_alive(self, req):
+        tokens = [t.strip().lower() for t in req.headers.get('connection', '').split(',')]
+        if 'close' in tokens:
+            return False
+        if req.version == 'HTTP/1.0':
+            return 'keep-alive' in tokens
+        return True
+
     def _recv_until(self, conn, buf, delimiter):
         while delimiter not in buf:
             chunk = conn.recv(4096)
@@ -131,8 +510,28 @@ class HTTPServer:
         idx = buf.index(delimiter)
         return buf[:idx], buf[idx + len(delimiter):]
 
+    def _recv_line(self, conn, buf):
+        if not self.strict:
+            return self._recv_until(conn, buf, b'\r\n')
+        # Strict mode splits on LF so that bare-LF line endings are detected
+        # instead of waiting forever for a CRLF that never comes.
+        line, buf = self._recv_until(conn, buf, b'\n')
+        if line is None:
+            return None, buf
+        if not line.endswith(b'\r') or b'\r' in line[:-1]:
+            raise HTTPError(400, 'Bad Request', 'bare CR or LF in request')
+        return line[:-1], buf
+
+    def _recv_exact(self, conn, buf, n):
+        while len(buf) < n:
+            chunk = conn.recv(4096)
+            if not chunk:
+                return None, buf
+            buf += chunk
+        return buf[:n], buf[n:]
+
     def _parse_request(self, conn, buf):
-        line_bytes, buf = self._recv_until(conn, buf, b'\r\n')
+        line_bytes, buf = self._recv_line(conn, buf)
         if line_bytes is None:
             return None, buf
         line = line_bytes.decode('latin-1')
@@ -140,21 +539,44 @@ class HTTPServer:
         if len(parts) != 3:
             raise ValueError(f'invalid request line: {line!r}')
         method, path, version = parts
+        if self.strict:
+            self._check_request_line(method, path, version)
 
         headers = {}
         while True:
-            hline_bytes, buf = self._recv_until(conn, buf, b'\r\n')
+            hline_bytes, buf = self._recv_line(conn, buf)
             if hline_bytes is None:
                 return None, buf
             hline = hline_bytes.decode('latin-1')
             if hline == '':
                 break
+            if self.strict:
+                self._check_header_line(hline, headers)
             if ':' in hline:
                 k, v = hline.split(':', 1)
                 headers[k.strip().lower()] = v.strip()
 
+        if self.strict and version == 'HTTP/1.1' and 'host' not in headers:
+            raise HTTPError(400, 'Bad Request', 'missing Host header')
+
+        transfer_encoding = headers.get('transfer-encoding', '').lower()
+        if transfer_encoding and self.strict:
+            if 'content-length' in headers:
+                raise HTTPError(400, 'Bad Request', 'both Content-Length and Transfer-Encoding')
+            if transfer_encoding != 'chunked':
+                raise HTTPError(501, 'Not Implemented', f'unsupported transfer coding: {transfer_encoding}')
+        # Lenient mode decodes chunked bodies and, as before, reads any other coding by Content-Length.
+        if transfer_encoding == 'chunked':
+            body, buf = self._read_chunked_body(conn, buf)
+            if body is None:
+                return None, buf
+            return HTTPRequest(method, path, version, headers, body), buf
+
+        content_length_value = headers.get('content-length', '0')
+        if self.strict and not content_length_value.isdigit():
+            raise HTTPError(400, 'Bad Request', f'invalid Content-Length: {content_length_value!r}')
         body = b''
-        content_length = int(headers.get('content-length', 0))
+        content_length = int(content_length_value)
         if content_length > 0:
             while len(buf) < content_length:
                 chunk = conn.recv(4096)
@@ -167,10 +589,67 @@ class HTTPServer:
         req = HTTPRequest(method, path, version, headers, body)
         return req, buf
 
+    def _check_request_line(self, method, path, version):
+        if not method or not all(c in TOKEN_CHARS for c in method):
+            raise HTTPError(400, 'Bad Request', f'invalid method: {method!r}')
+        if not path or ' ' in path:
+            raise HTTPError(400, 'Bad Request', f'invalid request target: {path!r}')
+        if not re.fullmatch(r'HTTP/\d\.\d', version):
+            raise HTTPError(400, 'Bad Request', f'invalid version: {version!r}')
+        if version not in ('HTTP/1.0', 'HTTP/1.1'):
+            raise HTTPError(505, 'HTTP Version Not Supported', f'unsupported version: {version}')
+
+    def _check_header_line(self, hline, headers):
+        if hline[0] in ' \t':
+            raise HTTPError(400, 'Bad Request', 'obsolete header line folding')
+        name, sep, _ = hline.partition(':')
+        if not sep or not name or not all(c in TOKEN_CHARS for c in name):
+            raise HTTPError(400, 'Bad Request', f'invalid header name: {name!r}')
+        if name.lower() == 'host' and 'host' in headers:
+            raise HTTPError(400, 'Bad Request', 'duplicate Host header')
+
+    def _read_chunked_body(self, conn, buf):
+        body = b''
+        while True:
+            size_line, buf = self._recv_line(conn, buf)
+            if size_line is None:
+                return None, buf
+            size_text = size_line.split(b';', 1)[0]
+            if self.strict:
+                if not size_text or not all(c in HEX_DIGITS for c in size_text):
+                    raise HTTPError(400, 'Bad Request', f'invalid chunk size: {size_line!r}')
+            else:
+                size_text = size_text.strip()
+            try:
+                size = int(size_text, 16)
+            except ValueError:
+                raise HTTPError(400, 'Bad Request', f'invalid chunk size: {size_line!r}') from None
+            if size == 0:
+                break
+            data, buf = self._recv_exact(conn, buf, size + 2)
+            if data is None:
+                return None, buf
+            if self.strict and data[size:] != b'\r\n':
+                raise HTTPError(400, 'Bad Request', 'chunk data not terminated by CRLF')
+            body += data[:size]
+        # Skip trailer fields up to the terminating empty line.
+        while True:
+            trailer, buf = self._recv_line(conn, buf)
+            if trailer is None:
+                return None, buf
+            if trailer == b'':
+                return body, buf
+
     def _send_response(self, conn, resp):
         if resp.headers is None:
             resp.headers = {}
-        if self.chunked and 'Transfer-Encoding' not in resp.headers:
+        if self.date_offset:
+            self._add_skewed_dates(resp)
+        if resp.stream is not None:
+            self._send_stream(conn, resp)
+            return
+        chunked = self.chunked or bool(resp.trailers)
+        if chunked and 'Transfer-Encoding' not in resp.headers:
             resp.headers['Transfer-Encoding'] = 'chunked'
             resp.headers.pop('Content-Length', None)
         elif resp.body is not None and 'Content-Length' not in resp.headers:
@@ -182,22 +661,111 @@ class HTTPServer:
         header += '\r\n'
         conn.sendall(header.encode('latin-1'))
 
-        if self.chunked:
+        if chunked:
             if resp.body:
                 chunk = f'{len(resp.body):x}\r\n'.encode() + resp.body + b'\r\n'
                 conn.sendall(chunk)
-            conn.sendall(b'0\r\n\r\n')
+            trailer = ''.join(f'{k}: {v}\r\n' for k, v in resp.trailers.items())
+            conn.sendall(f'0\r\n{trailer}\r\n'.encode('latin-1'))
         elif resp.body:
             conn.sendall(resp.body)
 
+    def _send_stream(self, conn, resp):
+        resp.headers['Transfer-Encoding'] = 'chunked'
+        resp.headers['Connection'] = 'close'
+        resp.headers.pop('Content-Length', None)
+        header = f'HTTP/1.1 {resp.code} {resp.message}\r\n'
+        header += ''.join(f'{k}: {v}\r\n' for k, v in resp.headers.items()) + '\r\n'
+        try:
+            conn.sendall(header.encode('latin-1'))
+            for chunk in resp.stream:
+                if chunk:
+                    conn.sendall(f'{len(chunk):x}\r\n'.encode() + chunk + b'\r\n')
+            conn.sendall(b'0\r\n\r\n')
+        finally:
+            close = getattr(resp.stream, 'close', None)
+            if close:
+                close()
+
+    def _add_skewed_dates(self, resp):
+        # Simulate a server whose clock is off by date_offset seconds: Date is
+        # skewed, Last-Modified is a day older and Expires is already past.
+        now = self.clock.time() + self.date_offset
+        resp.headers.setdefault('Date', formatdate(now, usegmt=True))
+        resp.headers.setdefault('Last-Modified', formatdate(now - 86400, usegmt=True))
+        resp.headers.setdefault('Expires', formatdate(now - 3600, usegmt=True))
+
     def _send_error(self, conn, code, message):
-        resp = HTTPResponse(code, message, {}, message.encode())
+        resp = HTTPResponse(code, message, {'Connection': 'close'}, message.encode())
         self._send_response(conn, resp)
 
+    def _apply_range(self, value, resp):
+        """Turn a full 200 response into a 206 (single or multipart/byteranges) or 416 one."""
+        body = resp.body or b''
+        ranges = parse_range(value, len(body))
+        if ranges is None or len(ranges) > MAX_RANGES or self.range_fault == 'ignore':
+            return resp
+        if not ranges:
+            return HTTPResponse(416, 'Range Not Satisfiable', {'Content-Range': f'bytes */{len(body)}'}, b'')
+        # A handler may hand out the same response again, so its headers are copied, not changed.
+        content_type = resp.headers.get('Content-Type', 'application/octet-stream')
+        headers = {k: v for k, v in resp.headers.items() if k.lower() not in ('content-length', 'content-type')}
+        if len(ranges) == 1:
+            start, end = ranges[0]
+            headers.update({'Content-Type': content_type, 'Content-Range': f'bytes {start}-{end}/{len(body)}'})
+            return HTTPResponse(206, 'Partial Content', headers, body[start:end + 1])
+        boundary = RANGE_BOUNDARY
+        if self.range_fault == 'wrong_boundary':
+            boundary += '-wrong'
+        parts = b''
+        for start, end in ranges:
+            parts += (f'--{boundary}\r\nContent-Type: {content_type}\r\n'
+                      f'Content-Range: bytes {start}-{end}/{len(body)}\r\n\r\n').encode('latin-1')
+            parts += body[start:end + 1] + b'\r\n'
+        if self.range_fault != 'missing_close':
+            parts += f'--{boundary}--\r\n'.encode('latin-1')
+        headers['Content-Type'] = f'multipart/byteranges; boundary={RANGE_BOUNDARY}'
+        return HTTPResponse(206, 'Partial Content', headers, parts)
+
+    def _swapped_response(self, req):
+        swapped = self.handlers.match(lambda h: h.matches(req.path))
+        if swapped is None:
+            return None
+        if swapped.delay > 0:
+            self.clock.sleep(swapped.delay)
+        return HTTPResponse(*swapped.respond())
+
     def _default_handle(self, req):
         if req.path == '/healthz':
             return HTTPResponse(200, 'OK', {'Content-Type': 'text/plain'}, b'ok\n')
+        m = re.fullmatch(r'/bytes/(\d+)', req.path)
+        if m and int(m.group(1)) <= MAX_BYTES:
+            # Deterministic content (byte i is i % 256) so ranges can be checked by offset.
+            body = bytes(range(256)) * (int(m.group(1)) // 256 + 1)
+            return HTTPResponse(200, 'OK', {'Content-Type': 'application/octet-stream', 'Accept-Ranges': 'bytes'},
+                                body[:int(m.group(1))])
+        fmt_in = codec.format_of(req.headers.get('content-type', ''))
+        fmt_out = codec.accepted_format(req.headers.get('accept', '')) or fmt_in
+        if fmt_out:
+            return self._structured_echo(req, fmt_in, fmt_out)
         body = f'Method: {req.method}\nPath: {req.path}\nVersion: {req.version}\n'
+        if req.proxy is not None:
+            body += f'Proxy: {req.proxy}\n'
         for k, v in req.headers.items():
             body += f'{k}: {v}\n'
         return HTTPResponse(200, 'OK', {'Content-Type': 'text/plain'}, body.encode())
+
+    def _structured_echo(self, req, fmt_in, fmt_out):
+        """Echo the request as a JSON/CBOR/MessagePack map, with the body decoded per Content-Type."""
+        body = req.body
+        if fmt_in and body:
+            try:
+                body = codec.decode(body, fmt_in)
+            except ValueError as e:
+                return HTTPResponse(400, 'Bad Request', {'Content-Type': 'text/plain'},
+                                    f'invalid {fmt_in} body: {e}\n'.encode())
+        echo = {'method': req.method, 'path': req.path, 'version': req.version, 'headers': req.headers,
+                'body': body if body != b'' else None}
+        if req.proxy is not None:
+            echo['proxy'] = req.proxy.to_dict()
+        return HTTPResponse(200, 'OK', {'Content-Type': codec.CONTENT_TYPES[fmt_out]}, codec.encode(echo, fmt_out))
@@ -0,0 +1,105 @@
+"""ICMP echo responder with loss and delay, for degrading device ping checks.
+
+Needs a raw socket (root or CAP_NET_RAW) and IPv4. The kernel answers
+pings itself, so disable that while this runs or clients see one reply
+from each:
+
+  sysctl -w net.ipv4.icmp_echo_ignore_all=1
+"""
+
+import logging
+import random
+import socket
+import struct
+from concurrent.futures import ThreadPoolExecutor
+
+from yourtestsrv import clock as clock_module
+from yourtestsrv import logthrottle, stats
+
+logger = logging.getLogger(__name__)
+
+ICMP_ECHO_REPLY = 0
+ICMP_ECHO_REQUEST = 8
+
+
+def checksum(data):
+    """Internet checksum (RFC 1071)."""
+    if len(data) % 2:
+        data += b'\x00'
+    total = sum(struct.unpack(f'>{len(data) // 2}H', data))
+    while total >> 16:
+        total = (total & 0xFFFF) + (total >> 16)
+    return ~total & 0xFFFF
+
+
+def parse_echo_request(packet):
+    """Return (identifier, sequence, payload) for an IPv4 packet carrying an echo request, else None."""
+    if len(packet) < 20 or packet[0] >> 4 != 4:
+        return None
+    header_len = (packet[0] & 0x0F) * 4
+    icmp = packet[header_len:]
+    if len(icmp) < 8 or icmp[0] != ICMP_ECHO_REQUEST or icmp[1] != 0:
+        return None
+    if checksum(icmp) != 0:
+        return None
+    identifier, sequence = struct.unpack_from('>HH', icmp, 4)
+    return identifier, sequence, icmp[8:]
+
+
+def build_echo_reply(identifier, sequence, payload):
+    header = struct.pack('>BBHHH', ICMP_ECHO_REPLY, 0, 0, identifier, sequence)
+    csum = checksum(header + payload)
+    return struct.pack('>BBHHH', ICMP_ECHO_REPLY, 0, csum, identifier, sequence) + payload
+
+
+class ICMPResponder:
+    def __init__(self, bind='0.0.0.0', drop_rate=0.0, delay=0.0, clock=None):
+        self.bind = bind or '0.0.0.0'
+        self.drop_rate = drop_rate
+        self.delay = delay
+        self.clock = clock_module.get(clock)
+        self.stats = stats.ServerStats()
+
+    def listen_and_serve(self, stop_event):
+        try:
+            sock = socket.socket(socket.AF_INET, socket.SOCK_RAW, socket.IPPROTO_ICMP)
+        except PermissionError:
+            raise PermissionError('ICMP responder needs root or CAP_NET_RAW') from None
+        sock.bind((self.bind, 0))
+        self.serve(stop_event, sock)
+
+    def serve(self, stop_event, sock):
+        """Serve on a raw ICMP socket created by the caller."""
+        stats.register('icmp', self.stats)
+        sock.settimeout(1.0)
+        executor = ThreadPoolExecutor(max_workers=32)
+        logger.info(f'ICMP echo responder listening on {self.bind}')
+        try:
+            while not stop_event.is_set():
+                try:
+                    packet, addr = sock.recvfrom(65535)
+                except socket.timeout:
+                    continue
+                except OSError as e:
+                    self.stats.record_error(e)
+                    return
+                echo = parse_echo_request(packet)
+                if echo is not None:
+                    executor.submit(self._reply, sock, addr, *echo)
+        finally:
+            executor.shutdown(wait=False)
+            sock.close()
+
+    def _reply(self, sock, addr, identifier, sequence, payload):
+        if self.drop_rate > 0 and random.random() < self.drop_rate:
+            logger.info(f'ICMP echo request dropped from {addr[0]} seq={sequence}',
+                        extra=logthrottle.event('icmp.echo'))
+            return
+        if self.delay > 0:
+            self.clock.sleep(self.delay)
+        logger.info(f'ICMP echo reply to {addr[0]} id={identifier} seq={sequence}',
+                    extra=logthrottle.event('icmp.echo'))
+        try:
+            sock.sendto(build_echo_reply(identifier, sequence, payload), addr)
+        except OSError as e:
+            self.stats.record_error(e)
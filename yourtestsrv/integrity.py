@@ -0,0 +1,59 @@
+"""Body checksums that do not match: negative cases for download integrity checks.
+
+An HTTP fault rule with "integrity" (see faultrules.py) sends, on the
+matching routes, a checksum computed over other bytes than the body:
+
+  content_md5  Content-MD5: <base64 MD5>                         (RFC 1864)
+  digest       Digest: SHA-256=<base64>                          (RFC 3230)
+               Repr-Digest: sha-256=:<base64>:                   (RFC 9530)
+  trailer      the body chunked, announced with Trailer: Repr-Digest and
+               followed by the Repr-Digest trailer field
+
+A device verifying what it downloaded must reject all of them. Streamed
+responses are sent unchanged.
+"""
+
+import base64
+import hashlib
+
+MODES = ('content_md5', 'digest', 'trailer')
+TRAILER = 'Repr-Digest'
+
+
+def b64(data):
+    return base64.b64encode(data).decode()
+
+
+def content_md5(body):
+    return b64(hashlib.md5(body).digest())
+
+
+def repr_digest(body):
+    return f'sha-256=:{b64(hashlib.sha256(body).digest())}:'
+
+
+def verify(name, value, body):
+    """Check an integrity header (or trailer) value the way a verifying device would."""
+    name = name.lower()
+    if name == 'content-md5':
+        return value == content_md5(body)
+    if name == 'digest':
+        return value == 'SHA-256=' + b64(hashlib.sha256(body).digest())
+    return value == repr_digest(body)
+
+
+def mismatch(resp, mode):
+    """Attach the mode's checksum to resp, computed over the body with its last byte changed."""
+    if resp.stream is not None:
+        return resp
+    body = resp.body or b''
+    other = body[:-1] + bytes([body[-1] ^ 0x01]) if body else b'\x00'
+    if mode == 'content_md5':
+        resp.headers['Content-MD5'] = content_md5(other)
+    elif mode == 'digest':
+        resp.headers['Digest'] = 'SHA-256=' + b64(hashlib.sha256(other).digest())
+        resp.headers['Repr-Digest'] = repr_digest(other)
+    else:
+        resp.headers['Trailer'] = TRAILER
+        resp.trailers[TRAILER] = repr_digest(other)
+    return resp
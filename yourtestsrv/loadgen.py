@@ -0,0 +1,240 @@
+"""Telemetry load from many virtual devices toward a system under test.
+
+The loadgen command (settings in the "loadgen" section of config.json, see
+LoadGenConfig) runs devices virtual devices, each reporting every interval
+(spread by up to jitter either way) to target:
+
+  mqtt://host[:port]  mqtts://...      one MQTT connection per device (client
+                                       id = its device id), publishing to topic
+  http://host[:port]/path  https://... one POST per report to the path
+
+Device ids come from device_id, "device-${index}" by default with index
+counting from 1. The first reports are spread over ramp_up (else over one
+interval) so the devices do not all start at once. Each report uses one of
+templates, {"payload": <payload generator spec>, "weight": 1}, picked at
+random by weight; the payload specs are those of payload.py, and JSON
+templates, the topic and the URL path can also use ${device}, ${index} and
+${seq} (the device's own report counter):
+
+  {"payload": {"type": "json", "template": "{\\"id\\": \\"${device}\\", \\"seq\\": ${seq}}"}, "weight": 9}
+
+A device whose previous report is still in flight skips its turn (counted
+as skipped) instead of queueing. The run ends after duration (0 runs until
+interrupted) and reports:
+
+  sent            reports delivered (HTTP 2xx/3xx, MQTT published/acked)
+  failed          reports not delivered (connection error, timeout)
+  rejected        HTTP reports answered with status 400 or above
+  skipped         turns skipped because the device was still busy
+  bytes           payload bytes sent
+  connects        MQTT connections established (reconnects included)
+  connect_failed  MQTT connections that failed
+"""
+
+import heapq
+import http.client
+import logging
+import random
+import re
+import ssl
+import threading
+import time
+import urllib.parse
+from base64 import b64encode
+from concurrent.futures import ThreadPoolExecutor
+
+from yourtestsrv import stats
+from yourtestsrv.mqtt_client import MQTTClient, MQTTClientError
+from yourtestsrv.payload import JSONTemplateGenerator, make_generator
+from yourtestsrv.shaping import jittered
+
+logger = logging.getLogger(__name__)
+
+SCHEMES = {'mqtt': 1883, 'mqtts': 8883, 'http': 80, 'https': 443}
+COUNTERS = ('sent', 'failed', 'rejected', 'skipped', 'bytes', 'connects', 'connect_failed')
+DEFAULT_TEMPLATE = {'type': 'json',
+                    'template': '{"device": "${device}", "seq": ${seq}, "ts": ${timestamp}, '
+                                '"temp": ${random_float:20:30}, "battery": ${random:20:100}}'}
+# Seconds between progress log lines.
+PROGRESS = 10.0
+
+_VAR_PATTERN = re.compile(r'\$\{(device|index|seq)\}')
+
+
+def expand(text, **variables):
+    """Substitute ${device}, ${index} and ${seq} in text."""
+    return _VAR_PATTERN.sub(lambda m: str(variables.get(m.group(1), m.group(0))), text)
+
+
+def parse_target(target):
+    """(scheme, host, port, path) of a target URL; raises ValueError."""
+    url = urllib.parse.urlsplit(target)
+    if url.scheme not in SCHEMES or not url.hostname:
+        raise ValueError(f'invalid loadgen target {target!r} (use mqtt://, mqtts://, http:// or https://)')
+    path = url.path or '/'
+    if url.query:
+        path += '?' + url.query
+    return url.scheme, url.hostname, url.port or SCHEMES[url.scheme], path
+
+
+class Device:
+    def __init__(self, index, device_id):
+        self.index = index
+        self.id = device_id
+        self.seq = 0
+        # Held while a report is in flight.
+        self.busy = threading.Lock()
+        self.client = None
+
+    def variables(self):
+        return {'device': self.id, 'index': self.index, 'seq': self.seq}
+
+
+class LoadGenerator:
+    """Runs the virtual devices; run() blocks until the end and returns the report."""
+
+    def __init__(self, target, devices=100, device_id='device-${index}', interval=10.0, jitter=0.0, ramp_up=0.0,
+                 duration=0.0, topic='devices/${device}/telemetry', qos=0, templates=None, workers=32,
+                 content_type='application/json', username='', password='', timeout=10.0):
+        self.target = target
+        self.scheme, self.host, self.port, self.path = parse_target(target)
+        self.devices = [Device(i, expand(device_id, index=i)) for i in range(1, devices + 1)]
+        self.interval = interval
+        self.jitter = jitter
+        self.ramp_up = ramp_up
+        self.duration = duration
+        self.topic = topic
+        self.qos = qos
+        templates = templates or [{'payload': DEFAULT_TEMPLATE}]
+        self.generators = [make_generator(t['payload']) for t in templates]
+        self.weights = [t.get('weight', 1) for t in templates]
+        self.workers = workers
+        self.content_type = content_type
+        self.username = username
+        self.password = password
+        self.timeout = timeout
+        self.counts = stats.Counters(COUNTERS)
+        self._latency = [0, 0.0, 0.0]  # reports timed, total, max
+        self._lock = threading.Lock()
+        self.elapsed = 0.0
+
+    def run(self, stop_event):
+        logger.info(f'Load generator: {len(self.devices)} devices every {self.interval}s -> {self.target}')
+        start = time.monotonic()
+        spread = self.ramp_up or self.interval
+        queue = [(start + spread * i / len(self.devices), i) for i in range(len(self.devices))]
+        end = start + self.duration if self.duration else None
+        next_progress = start + PROGRESS
+        pool = ThreadPoolExecutor(self.workers, thread_name_prefix='loadgen')
+        try:
+            while not stop_event.is_set():
+                due, i = queue[0]
+                if end is not None and due >= end:
+                    stop_event.wait(max(0.0, end - time.monotonic()))
+                    break
+                if stop_event.wait(max(0.0, due - time.monotonic())):
+                    break
+                heapq.heapreplace(queue, (due + jittered(self.interval, self.jitter), i))
+                device = self.devices[i]
+                if device.busy.acquire(blocking=False):
+                    pool.submit(self._report, device)
+                else:
+                    self.counts.incr('skipped')
+                if time.monotonic() >= next_progress:
+                    next_progress += PROGRESS
+                    logger.info(f'Load generator: {self.counts.snapshot()}')
+        finally:
+            pool.shutdown(wait=True, cancel_futures=True)
+            self.elapsed = time.monotonic() - start
+            for device in self.devices:
+                if device.client is not None:
+                    device.client.disconnect()
+        report = self.report()
+        logger.info(f'Load generator finished: {report}')
+        return report
+
+    def _report(self, device):
+        try:
+            device.seq += 1
+            generator = random.choices(self.generators, self.weights)[0]
+            if isinstance(generator, JSONTemplateGenerator):
+                payload = generator.next(**device.variables())
+            else:
+                payload = generator.next()
+            started = time.monotonic()
+            try:
+                if self.scheme.startswith('mqtt'):
+                    self._publish(device, payload)
+                else:
+                    status = self._post(device, payload)
+                    if status >= 400:
+                        self.counts.incr('rejected')
+                        logger.debug(f'Device {device.id}: HTTP {status}')
+                        return
+            except (OSError, MQTTClientError, http.client.HTTPException) as e:
+                self.counts.incr('failed')
+                logger.debug(f'Device {device.id} report failed: {e}')
+                return
+            self._record(time.monotonic() - started)
+            self.counts.incr('sent')
+            self.counts.incr('bytes', len(payload))
+        finally:
+            device.busy.release()
+
+    def _publish(self, device, payload):
+        if device.client is None or device.client.is_closed():
+            client = MQTTClient(self.host, self.port, device.id, tls=self.scheme == 'mqtts',
+                                username=self.username or None, password=self.password or None)
+            try:
+                client.connect(timeout=self.timeout)
+            except (OSError, MQTTClientError):
+                self.counts.incr('connect_failed')
+                client.close()
+                raise
+            self.counts.incr('connects')
+            device.client = client
+        device.client.publish(expand(self.topic, **device.variables()), payload, qos=self.qos, timeout=self.timeout)
+
+    def _post(self, device, payload):
+        if self.scheme == 'https':
+            ctx = ssl.create_default_context()
+            ctx.check_hostname = False
+            ctx.verify_mode = ssl.CERT_NONE
+            conn = http.client.HTTPSConnection(self.host, self.port, timeout=self.timeout, context=ctx)
+        else:
+            conn = http.client.HTTPConnection(self.host, self.port, timeout=self.timeout)
+        headers = {'Content-Type': self.content_type, 'User-Agent': f'yourtestsrv-loadgen/{device.id}'}
+        if self.username:
+            headers['Authorization'] = 'Basic ' + b64encode(f'{self.username}:{self.password}'.encode()).decode()
+        try:
+            conn.request('POST', expand(self.path, **device.variables()), payload, headers)
+            resp = conn.getresponse()
+            resp.read()
+            return resp.status
+        finally:
+            conn.close()
+
+    def _record(self, seconds):
+        with self._lock:
+            self._latency[0] += 1
+            self._latency[1] += seconds
+            self._latency[2] = max(self._latency[2], seconds)
+
+    def report(self):
+        counts = self.counts.snapshot()
+        with self._lock:
+            timed, total, longest = self._latency
+        return dict(target=self.target, devices=len(self.devices), elapsed=round(self.elapsed, 3),
+                    rate=round(counts['sent'] / self.elapsed, 2) if self.elapsed else 0.0, **counts,
+                    latency_avg_ms=round(total / timed * 1000, 2) if timed else 0.0,
+                    latency_max_ms=round(longest * 1000, 2))
+
+
+def format_report(report):
+    return '\n'.join([
+        f"{report['devices']} devices -> {report['target']} for {report['elapsed']}s",
+        f"  sent {report['sent']} ({report['rate']}/s, {report['bytes']} bytes), failed {report['failed']}, "
+        f"rejected {report['rejected']}, skipped {report['skipped']}",
+        f"  connects {report['connects']}, connect_failed {report['connect_failed']}",
+        f"  latency avg {report['latency_avg_ms']}ms, max {report['latency_max_ms']}ms",
+    ])
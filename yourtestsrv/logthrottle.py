@@ -0,0 +1,176 @@
+"""Log sampling for high-rate events.
+
+Per-packet log lines (every UDP datagram, TCP chunk or MQTT PUBLISH as hex)
+can fill a disk in a long load test. The servers tag those lines with an
+event type, and the rules under "logging": {"throttle": [...]} thin them out
+per type:
+
+  {"event": "udp.rx", "every": 1000, "summary": "10s"}
+  {"event": "mqtt.publish", "max_rate": 20}
+  {"event": "*", "max_rate": 100, "summary": "1m"}
+
+every logs 1 in N events, max_rate caps the logged events per second (both
+may be combined) and summary emits a periodic line with how many events of
+that type were seen, logged and suppressed, and their rate. "*" covers every
+tagged event without a rule of its own, each type counted separately.
+Untagged lines (listeners, errors, lifecycle) are never throttled.
+
+Event types: tcp.connect, tcp.rx, tcp.close, udp.rx, udp.drop, http.request,
+mqtt.connect, mqtt.publish, mqtt.ack, mqtt.subscribe, mqtt.disconnect,
+icmp.echo, stun.binding and conn.summary (the per-connection traffic summary
+logged when a TCP, HTTP or MQTT connection closes).
+"""
+
+import logging
+import threading
+
+from yourtestsrv import clock as clock_module
+
+logger = logging.getLogger(__name__)
+
+EVENTS = ('tcp.connect', 'tcp.rx', 'tcp.close', 'udp.rx', 'udp.drop', 'udp.duplicate', 'udp.sequence',
+          'http.request', 'mqtt.connect', 'mqtt.publish', 'mqtt.ack', 'mqtt.subscribe', 'mqtt.disconnect',
+          'icmp.echo', 'stun.binding', 'dns.query', 'ntp.request', 'tftp.transfer',
+          'syslog.message', 'conn.summary')
+
+
+def event(name):
+    """The extra= argument tagging a log call with an event type."""
+    return {'event': name}
+
+
+
+class LazyHex:
+    """Hex of data, formatted only if the record is actually emitted.
+
+    Pass it as a %s argument so per-chunk lines the throttle drops cost no
+    formatting. Handlers format synchronously, so data may be a view of a
+    buffer that is reused after the log call returns.
+    """
+
+    __slots__ = ('data',)
+
+    def __init__(self, data):
+        self.data = data
+
+    def __str__(self):
+        return self.data.hex()
+
+class ThrottleRule:
+    def __init__(self, spec):
+        from yourtestsrv.config import parse_duration
+        spec = dict(spec)
+        self.event = spec.pop('event', '')
+        if self.event != '*' and self.event not in EVENTS:
+            raise ValueError(f'unknown log throttle event {self.event!r} (use one of {", ".join(EVENTS)} or *)')
+        self.every = int(spec.pop('every', 1))
+        self.max_rate = float(spec.pop('max_rate', 0))
+        self.summary = parse_duration(spec.pop('summary', '0s'))
+        if spec:
+            raise ValueError(f'unknown log throttle keys: {sorted(spec)}')
+        if self.every < 1 or self.max_rate < 0:
+            raise ValueError('log throttle every must be at least 1 and max_rate not negative')
+
+
+class _EventState:
+    def __init__(self, now):
+        self.seen = 0
+        self.window = int(now)
+        self.window_logged = 0
+        self.summary_start = now
+        self.summary_seen = 0
+        self.summary_logged = 0
+
+
+class LogThrottle(logging.Filter):
+    """A handler filter applying throttle rules to tagged records."""
+
+    def __init__(self, specs, clock=None):
+        super().__init__()
+        self.rules = {}
+        for spec in specs:
+            rule = ThrottleRule(spec)
+            self.rules[rule.event] = rule
+        self.clock = clock_module.get(clock)
+        self._states = {}
+        self._lock = threading.Lock()
+
+    def filter(self, record):
+        # With several handlers the first decision is reused, so events are counted once.
+        decision = getattr(record, 'throttle_pass', None)
+        if decision is None:
+            decision = record.throttle_pass = self._decide(getattr(record, 'event', None))
+        return decision
+
+    def _decide(self, name):
+        rule = self.rules.get(name) or (self.rules.get('*') if name else None)
+        if rule is None:
+            return True
+        now = self.clock.monotonic()
+        with self._lock:
+            state = self._states.get(name)
+            if state is None:
+                state = self._states[name] = _EventState(now)
+            state.seen += 1
+            state.summary_seen += 1
+            if int(now) != state.window:
+                state.window, state.window_logged = int(now), 0
+            allowed = (state.seen - 1) % rule.every == 0
+            if allowed and rule.max_rate:
+                allowed = state.window_logged < rule.max_rate
+            if allowed:
+                state.summary_logged += 1
+                state.window_logged += 1
+            due = self._due_summaries(now)
+        self._emit(due)
+        return allowed
+
+    def _due_summaries(self, now):
+        """Collect (and reset) the summaries whose interval has passed; call with the lock held."""
+        due = []
+        for name, state in self._states.items():
+            rule = self.rules.get(name) or self.rules['*']
+            elapsed = now - state.summary_start
+            if not rule.summary or elapsed < rule.summary:
+                continue
+            if state.summary_seen > state.summary_logged:
+                due.append((name, state.summary_seen, state.summary_logged, elapsed))
+            state.summary_start, state.summary_seen, state.summary_logged = now, 0, 0
+        return due
+
+    def _emit(self, due):
+        for name, seen, logged, elapsed in due:
+            logger.info(f'log throttle: {name} {seen} events in {elapsed:.0f}s ({seen / elapsed:.1f}/s), '
+                        f'{logged} logged, {seen - logged} suppressed')
+
+    def flush(self):
+        """Emit the summaries that are due even if their events have stopped."""
+        with self._lock:
+            due = self._due_summaries(self.clock.monotonic())
+        self._emit(due)
+
+    def run(self, stop_event, interval=1.0):
+        while not self.clock.wait(stop_event, interval):
+            self.flush()
+
+
+_installed = None
+_installed_stop = None
+
+
+def install(specs):
+    """Attach a LogThrottle for specs to the root handlers, replacing an earlier one."""
+    global _installed, _installed_stop
+    root = logging.getLogger()
+    if _installed is not None:
+        _installed_stop.set()
+        for handler in root.handlers:
+            handler.removeFilter(_installed)
+        _installed = _installed_stop = None
+    if not specs:
+        return None
+    _installed, _installed_stop = LogThrottle(specs), threading.Event()
+    for handler in root.handlers:
+        handler.addFilter(_installed)
+    threading.Thread(target=_installed.run, args=(_installed_stop,), daemon=True).start()
+    return _installed
@@ -0,0 +1,222 @@
+import socket
+import ssl
+import struct
+import threading
+import logging
+
+from yourtestsrv.mqtt_server import (
+    _build_packet, _read_mqtt_string,
+    MQTT_CONNECT, MQTT_CONNACK, MQTT_PUBLISH, MQTT_PUBACK, MQTT_PUBREC, MQTT_PUBREL,
+    MQTT_PUBCOMP, MQTT_SUBSCRIBE, MQTT_SUBACK, MQTT_UNSUBSCRIBE, MQTT_UNSUBACK,
+    MQTT_PINGREQ, MQTT_PINGRESP, MQTT_DISCONNECT,
+)
+
+logger = logging.getLogger(__name__)
+
+
+def _mqtt_string(s):
+    b = s.encode('utf-8')
+    return struct.pack('>H', len(b)) + b
+
+
+class MQTTClientError(Exception):
+    pass
+
+
+class MQTTClient:
+    """Minimal MQTT 3.1.1 client used by the device simulator and conformance checks.
+
+    Incoming PUBLISH packets are passed to on_message(topic, payload, qos, retain)
+    on the reader thread, so the callback must not wait for acknowledgements;
+    every other packet is queued and can be awaited with wait_for().
+    """
+
+    def __init__(self, host, port, client_id, keep_alive=60, clean_session=True,
+                 tls=False, username=None, password=None, will=None, on_message=None):
+        self.host = host
+        self.port = port
+        self.client_id = client_id
+        self.keep_alive = keep_alive
+        self.clean_session = clean_session
+        self.tls = tls
+        self.username = username
+        self.password = password
+        self.will = will
+        self.on_message = on_message
+        self.conn = None
+        self._packets = []
+        self._cond = threading.Condition()
+        self._send_lock = threading.Lock()
+        self._next_packet_id = 0
+        self._closed = threading.Event()
+
+    def connect(self, timeout=5.0):
+        conn = socket.create_connection((self.host, self.port), timeout=timeout)
+        if self.tls:
+            ctx = ssl.create_default_context()
+            ctx.check_hostname = False
+            ctx.verify_mode = ssl.CERT_NONE
+            conn = ctx.wrap_socket(conn)
+        conn.settimeout(None)
+        self.conn = conn
+        flags = 0x02 if self.clean_session else 0
+        payload = _mqtt_string(self.client_id)
+        if self.will:
+            flags |= 0x04 | (self.will.get('qos', 0) << 3) | (0x20 if self.will.get('retain') else 0)
+            payload += _mqtt_string(self.will['topic'])
+            will_payload = self.will.get('payload', b'')
+            payload += struct.pack('>H', len(will_payload)) + will_payload
+        if self.username is not None:
+            flags |= 0x80
+            payload += _mqtt_string(self.username)
+        if self.password is not None:
+            flags |= 0x40
+            payload += _mqtt_string(self.password)
+        variable = _mqtt_string('MQTT') + bytes([4, flags]) + struct.pack('>H', self.keep_alive)
+        self._send(_build_packet(MQTT_CONNECT, 0, variable + payload))
+        threading.Thread(target=self._read_loop, daemon=True).start()
+        _, payload = self.wait_for(MQTT_CONNACK, timeout=timeout)
+        if len(payload) < 2 or payload[1] != 0:
+            raise MQTTClientError(f'connection refused: CONNACK {payload.hex()}')
+        return payload
+
+    def subscribe(self, topic_filter, qos=0, timeout=5.0):
+        packet_id = self._packet_id()
+        body = struct.pack('>H', packet_id) + _mqtt_string(topic_filter) + bytes([qos])
+        self._send(_build_packet(MQTT_SUBSCRIBE, 2, body))
+        _, payload = self.wait_for(MQTT_SUBACK, timeout=timeout)
+        return payload[2:]
+
+    def unsubscribe(self, topic_filter, timeout=5.0):
+        body = struct.pack('>H', self._packet_id()) + _mqtt_string(topic_filter)
+        self._send(_build_packet(MQTT_UNSUBSCRIBE, 2, body))
+        self.wait_for(MQTT_UNSUBACK, timeout=timeout)
+
+    def publish(self, topic, payload, qos=0, retain=False, timeout=5.0):
+        body = _mqtt_string(topic)
+        packet_id = 0
+        if qos > 0:
+            packet_id = self._packet_id()
+            body += struct.pack('>H', packet_id)
+        flags = (qos << 1) | (1 if retain else 0)
+        self._send(_build_packet(MQTT_PUBLISH, flags, body + payload))
+        if qos == 1:
+            self.wait_for(MQTT_PUBACK, timeout=timeout)
+        elif qos == 2:
+            self.wait_for(MQTT_PUBREC, timeout=timeout)
+            self._send(_build_packet(MQTT_PUBREL, 2, struct.pack('>H', packet_id)))
+            self.wait_for(MQTT_PUBCOMP, timeout=timeout)
+
+    def ping(self, timeout=5.0):
+        self._send(_build_packet(MQTT_PINGREQ, 0, b''))
+        self.wait_for(MQTT_PINGRESP, timeout=timeout)
+
+    def disconnect(self):
+        try:
+            self._send(_build_packet(MQTT_DISCONNECT, 0, b''))
+        except OSError:
+            pass
+        self.close()
+
+    def close(self):
+        self._closed.set()
+        if self.conn is not None:
+            # shutdown() wakes the reader thread; close() alone would not send FIN
+            # while it is still blocked in recv().
+            try:
+                self.conn.shutdown(socket.SHUT_RDWR)
+            except OSError:
+                pass
+            try:
+                self.conn.close()
+            except OSError:
+                pass
+
+    def wait_for(self, packet_type, timeout=5.0):
+        """Wait for the next queued packet of the given type."""
+        with self._cond:
+            found = self._cond.wait_for(
+                lambda: any(p[0] == packet_type for p in self._packets) or self._closed.is_set(),
+                timeout)
+            for i, packet in enumerate(self._packets):
+                if packet[0] == packet_type:
+                    return self._packets.pop(i)
+        if not found:
+            raise MQTTClientError(f'timed out waiting for packet type {packet_type}')
+        raise MQTTClientError('connection closed')
+
+    def is_closed(self):
+        return self._closed.is_set()
+
+    def _send(self, packet):
+        with self._send_lock:
+            self.conn.sendall(packet)
+
+    def _packet_id(self):
+        with self._send_lock:
+            self._next_packet_id = self._next_packet_id % 0xFFFF + 1
+            return self._next_packet_id
+
+    def _recv_exact(self, n):
+        buf = b''
+        while len(buf) < n:
+            chunk = self.conn.recv(n - len(buf))
+            if not chunk:
+                return None
+            buf += chunk
+        return buf
+
+    def _read_packet(self):
+        first = self._recv_exact(1)
+        if not first:
+            return None
+        length = 0
+        multiplier = 1
+        while True:
+            b = self._recv_exact(1)
+            if not b:
+                return None
+            length += (b[0] & 127) * multiplier
+            multiplier *= 128
+            if (b[0] & 128) == 0:
+                break
+        payload = self._recv_exact(length) if length else b''
+        if payload is None:
+            return None
+        return first[0] >> 4, first[0] & 0x0F, payload
+
+    def _read_loop(self):
+        try:
+            while True:
+                packet = self._read_packet()
+                if packet is None:
+                    return
+                packet_type, flags, payload = packet
+                if packet_type == MQTT_PUBLISH:
+                    self._handle_publish(flags, payload)
+                    continue
+                if packet_type == MQTT_PUBREL:
+                    self._send(_build_packet(MQTT_PUBCOMP, 0, payload[:2]))
+                    continue
+                with self._cond:
+                    self._packets.append((packet_type, payload))
+                    self._cond.notify_all()
+        except OSError:
+            pass
+        finally:
+            self._closed.set()
+            with self._cond:
+                self._cond.notify_all()
+
+    def _handle_publish(self, flags, payload):
+        topic, pos = _read_mqtt_string(payload, 0)
+        if topic is None:
+            return
+        qos = (flags >> 1) & 0x03
+        if qos > 0:
+            packet_id = struct.unpack_from('>H', payload, pos)[0]
+            pos += 2
+            ack_type = MQTT_PUBACK if qos == 1 else MQTT_PUBREC
+            self._send(_build_packet(ack_type, 0, struct.pack('>H', packet_id)))
+        if self.on_message:
+            self.on_message(topic, payload[pos:], qos, bool(flags & 0x01))
@@ -0,0 +1,234 @@
+"""MQTT 3.1.1 conformance checks run against a broker.
+
+Each check connects fresh clients under a unique topic prefix, so the
+suite can run against shared third-party brokers without interference.
+"""
+
+import logging
+import queue
+import time
+import uuid
+
+from yourtestsrv.mqtt_client import MQTTClient, MQTTClientError
+
+logger = logging.getLogger(__name__)
+
+CHECKS = []
+
+
+def check(name):
+    def register(fn):
+        CHECKS.append((name, fn))
+        return fn
+    return register
+
+
+class CheckFailed(Exception):
+    pass
+
+
+class CheckResult:
+    def __init__(self, name, passed, detail='', duration=0.0):
+        self.name = name
+        self.passed = passed
+        self.detail = detail
+        self.duration = duration
+
+    def to_dict(self):
+        return {'name': self.name, 'passed': self.passed, 'detail': self.detail,
+                'duration': round(self.duration, 3)}
+
+
+class Inbox:
+    """Collects messages delivered to a client's on_message callback."""
+
+    def __init__(self):
+        self._queue = queue.Queue()
+
+    def __call__(self, topic, payload, qos, retain):
+        self._queue.put((topic, payload, qos, retain))
+
+    def expect(self, timeout):
+        try:
+            return self._queue.get(timeout=timeout)
+        except queue.Empty:
+            raise CheckFailed(f'no message within {timeout}s')
+
+    def expect_none(self, wait):
+        try:
+            message = self._queue.get(timeout=wait)
+        except queue.Empty:
+            return
+        raise CheckFailed(f'unexpected message on {message[0]}')
+
+
+class ConformanceRunner:
+    def __init__(self, host, port, tls=False, timeout=5.0, username=None, password=None):
+        self.host = host
+        self.port = port
+        self.tls = tls
+        self.timeout = timeout
+        self.username = username
+        self.password = password
+        self.prefix = f'yourtestsrv/conformance/{uuid.uuid4().hex[:8]}'
+        self._clients = []
+
+    def topic(self, name):
+        return f'{self.prefix}/{name}'
+
+    def client(self, name, inbox=None, connect=True, **kwargs):
+        client = MQTTClient(self.host, self.port, f'conf-{uuid.uuid4().hex[:8]}-{name}'[:23],
+                            tls=self.tls, username=self.username, password=self.password,
+                            on_message=inbox, **kwargs)
+        self._clients.append(client)
+        if connect:
+            client.connect(timeout=self.timeout)
+        return client
+
+    def run(self, names=None):
+        results = []
+        for name, fn in CHECKS:
+            if names and name not in names:
+                continue
+            start = time.time()
+            try:
+                fn(self)
+                result = CheckResult(name, True)
+            except (CheckFailed, MQTTClientError, OSError) as e:
+                result = CheckResult(name, False, str(e) or type(e).__name__)
+            finally:
+                for client in self._clients:
+                    client.close()
+                self._clients = []
+            result.duration = time.time() - start
+            logger.info(f'MQTT conformance {name}: {"PASS" if result.passed else "FAIL"} {result.detail}')
+            results.append(result)
+        return results
+
+
+def format_report(results):
+    lines = []
+    for r in results:
+        status = 'PASS' if r.passed else 'FAIL'
+        line = f'{status}  {r.name:<24} {r.duration:6.2f}s'
+        if r.detail:
+            line += f'  {r.detail}'
+        lines.append(line)
+    passed = sum(r.passed for r in results)
+    lines.append(f'{passed}/{len(results)} checks passed')
+    return '\n'.join(lines)
+
+
+def _expect_message(inbox, timeout, topic, payload, qos=None, retain=None):
+    got_topic, got_payload, got_qos, got_retain = inbox.expect(timeout)
+    if (got_topic, got_payload) != (topic, payload):
+        raise CheckFailed(f'got {got_topic}={got_payload!r}, want {topic}={payload!r}')
+    if qos is not None and got_qos != qos:
+        raise CheckFailed(f'delivered with QoS {got_qos}, want {qos}')
+    if retain is not None and got_retain != retain:
+        raise CheckFailed(f'retain flag {got_retain}, want {retain}')
+
+
+@check('connect')
+def check_connect(r):
+    client = r.client('connect', connect=False)
+    connack = client.connect(timeout=r.timeout)
+    if connack != b'\x00\x00':
+        raise CheckFailed(f'CONNACK for clean session should be 0000, got {connack.hex()}')
+
+
+@check('ping')
+def check_ping(r):
+    r.client('ping').ping(timeout=r.timeout)
+
+
+def _check_qos(r, qos):
+    inbox = Inbox()
+    topic = r.topic(f'qos{qos}')
+    sub = r.client(f'sub{qos}', inbox)
+    granted = sub.subscribe(topic, qos, timeout=r.timeout)
+    if granted != bytes([qos]):
+        raise CheckFailed(f'SUBACK granted {granted.hex()}, want {qos:02x}')
+    r.client(f'pub{qos}').publish(topic, b'qos', qos, timeout=r.timeout)
+    _expect_message(inbox, r.timeout, topic, b'qos', qos=qos)
+
+
+@check('qos0')
+def check_qos0(r):
+    _check_qos(r, 0)
+
+
+@check('qos1')
+def check_qos1(r):
+    _check_qos(r, 1)
+
+
+@check('qos2')
+def check_qos2(r):
+    _check_qos(r, 2)
+
+
+@check('wildcards')
+def check_wildcards(r):
+    inbox = Inbox()
+    sub = r.client('wild', inbox)
+    sub.subscribe(r.topic('single/+/temp'), timeout=r.timeout)
+    sub.subscribe(r.topic('multi/#'), timeout=r.timeout)
+    pub = r.client('wildpub')
+    pub.publish(r.topic('single/a/b/temp'), b'no')
+    pub.publish(r.topic('single/a/temp'), b'yes')
+    _expect_message(inbox, r.timeout, r.topic('single/a/temp'), b'yes')
+    pub.publish(r.topic('multi/x/y/z'), b'deep')
+    _expect_message(inbox, r.timeout, r.topic('multi/x/y/z'), b'deep')
+    pub.publish(r.topic('multi'), b'parent')
+    _expect_message(inbox, r.timeout, r.topic('multi'), b'parent')
+
+
+@check('unsubscribe')
+def check_unsubscribe(r):
+    inbox = Inbox()
+    topic = r.topic('unsub')
+    sub = r.client('unsub', inbox)
+    sub.subscribe(topic, timeout=r.timeout)
+    sub.unsubscribe(topic, timeout=r.timeout)
+    r.client('unsubpub').publish(topic, b'x', 1, timeout=r.timeout)
+    sub.ping(timeout=r.timeout)
+    inbox.expect_none(0.5)
+
+
+@check('retained')
+def check_retained(r):
+    topic = r.topic('retained')
+    pub = r.client('retpub')
+    pub.publish(topic, b'last', 1, retain=True, timeout=r.timeout)
+    inbox = Inbox()
+    r.client('retsub', inbox).subscribe(topic, 1, timeout=r.timeout)
+    _expect_message(inbox, r.timeout, topic, b'last', retain=True)
+    pub.publish(topic, b'', 1, retain=True, timeout=r.timeout)
+    inbox = Inbox()
+    r.client('retsub2', inbox).subscribe(topic, 1, timeout=r.timeout)
+    inbox.expect_none(0.5)
+
+
+@check('will')
+def check_will(r):
+    topic = r.topic('will')
+    inbox = Inbox()
+    r.client('willsub', inbox).subscribe(topic, 1, timeout=r.timeout)
+    graceful = r.client('graceful', will={'topic': topic, 'payload': b'graceful', 'qos': 1})
+    graceful.disconnect()
+    abrupt = r.client('abrupt', will={'topic': topic, 'payload': b'gone', 'qos': 1})
+    abrupt.close()
+    _expect_message(inbox, r.timeout, topic, b'gone')
+    inbox.expect_none(0.5)
+
+
+@check('keep_alive')
+def check_keep_alive(r):
+    client = r.client('keepalive', keep_alive=1)
+    # The broker must drop a silent client after 1.5 keep-alive periods.
+    deadline = time.time() + 1.5 + 1.5
+    while not client.is_closed():
+        if time.time() > deadline:
+            raise CheckFailed('broker kept a silent client past 1.5x keep-alive')
+        time.sleep(0.1)
@@ -1,10 +1,15 @@
 import socket
-import ssl
 import struct
 import threading
 import time
 import logging
 
+from yourtestsrv import clock as clock_module
+from yourtestsrv import handlers, logthrottle, netutil, stats, storage, traffic
+from yourtestsrv.config import parse_duration
+from yourtestsrv.payload import make_generator
+from yourtestsrv.probe import IdleProber
+
 logger = logging.getLogger(__name__)
 
 MQTT_CONNECT     = 1
@@ -22,6 +27,16 @@ MQTT_PINGREQ     = 12
 MQTT_PINGRESP    = 13
 MQTT_DISCONNECT  = 14
 
+MQTT_V5 = 5
+PROP_SERVER_REFERENCE = 0x1C
+REASON_UNSUPPORTED_VERSION = 0x84
+REASON_SERVER_UNAVAILABLE = 0x88
+# v5 reason codes telling a client to reconnect elsewhere; a v3.1.1 client
+# only gets CONNACK "server unavailable" as it has no way to be redirected.
+REDIRECT_CODES = {'use_another_server': 0x9C, 'server_moved': 0x9D}
+# DISCONNECT reason code for a PUBLISH rejected by a payload validator.
+PAYLOAD_FORMAT_INVALID = 0x99
+
 
 def _read_mqtt_string(data, pos):
     if len(data) < pos + 2:
@@ -33,6 +48,28 @@ def _read_mqtt_string(data, pos):
     return data[pos:pos + length].decode('utf-8', errors='replace'), pos + length
 
 
+def _skip_properties(data, pos):
+    """Skip an MQTT v5 property block; returns the position after it, or None if truncated."""
+    length, multiplier = 0, 1
+    for _ in range(4):
+        if pos >= len(data):
+            return None
+        b = data[pos]
+        pos += 1
+        length += (b & 0x7F) * multiplier
+        multiplier *= 128
+        if not b & 0x80:
+            break
+    return pos + length if pos + length <= len(data) else None
+
+
+def _server_reference(reference):
+    """A v5 property block holding only the Server Reference."""
+    value = reference.encode()
+    props = bytes([PROP_SERVER_REFERENCE]) + struct.pack('>H', len(value)) + value
+    return bytes([len(props)]) + props
+
+
 def _build_packet(packet_type, flags, payload):
     header = (packet_type << 4) | flags
     length = len(payload)
@@ -48,70 +85,209 @@ def _build_packet(packet_type, flags, payload):
     return bytes([header]) + length_bytes + payload
 
 
+def load_mqtt_state(name, store=None):
+    """Read the state saved by the admin API's /mqtt/state/export (a JSON file with the files storage)."""
+    state = storage.get(store).load(name)
+    if state is None:
+        raise FileNotFoundError(f'no saved MQTT state {name!r}')
+    return state
+
+
+def topic_matches(topic_filter, topic):
+    """Report whether topic matches a subscription filter with +/# wildcards."""
+    filter_parts = topic_filter.split('/')
+    topic_parts = topic.split('/')
+    if topic.startswith('$') and filter_parts[0] in ('+', '#'):
+        return False
+    for i, part in enumerate(filter_parts):
+        if part == '#':
+            return True
+        if i >= len(topic_parts):
+            return False
+        if part != '+' and part != topic_parts[i]:
+            return False
+    return len(filter_parts) == len(topic_parts)
+
+
+class MQTTCluster:
+    """Brokers that share retained messages, stored sessions and message routing,
+    so a client failing over from one member to another finds its state there."""
+
+    def __init__(self):
+        self.lock = threading.Lock()
+        self.retained = {}
+        self.sessions = {}
+        self.members = []
+
+    def join(self, srv):
+        srv._lock = self.lock
+        srv._retained = self.retained
+        srv._sessions = self.sessions
+        self.members.append(srv)
+
+
 class MQTTServer:
-    def __init__(self, port, bind='0.0.0.0', retain_messages=False, handler=None):
+    stats_name = 'mqtt'
+
+    def __init__(self, port, bind='0.0.0.0', retain_messages=False, handler=None, publish=None, clock=None,
+                 idle_timeout=60.0, max_connections=0, over_limit='refuse', over_limit_banner=b'',
+                 accept_delay=0.0, handshake_rate=0.0, accept_rate=0.0, workers=0, fault_rules=None, redirect='',
+                 redirect_code='use_another_server', cluster=None, socket_options=None, on_accept=None,
+                 on_close=None, validators=None, probe_idle=0.0, probe_payload=b'', probe_timeout=10.0):
         self.port = port
         self.bind = bind or '0.0.0.0'
         self.retain_messages = retain_messages
         self.handler = handler
         self._clients = {}
         self._retained = {}
+        self._wills = {}
+        self._subscriptions = {}
+        # Subscriptions of clean_session=0 clients kept across connections, by client ID,
+        # and the connections those clients currently hold.
+        self._sessions = {}
+        self._persistent = {}
+        self._send_locks = {}
+        # Protocol level of each connection, so v5 clients get v5 framing.
+        self._versions = {}
+        self._next_packet_id = 0
         self._lock = threading.Lock()
+        self.stats = stats.ServerStats()
+        # Clients silent for probe_idle get probe_payload (or TCP keepalive probes), see probe.py.
+        self.prober = IdleProber(probe_idle, probe_payload, probe_timeout) if probe_idle > 0 else None
+        self.stats.probes = self.prober
+        self.stats_key = f'{self.stats_name}:{port}'
+        self._addr = None
+        self.publish_specs = publish or []
+        self.clock = clock_module.get(clock)
+        self.idle_timeout = idle_timeout
+        # Without a banner of its own, 'banner' mode answers with CONNACK "server unavailable".
+        self.limit = netutil.ConnectionLimit(max_connections, over_limit,
+                                             over_limit_banner or _build_packet(MQTT_CONNACK, 0, b'\x00\x03'))
+        self.pacer = netutil.AcceptPacer(accept_delay, handshake_rate, self.clock, accept_rate)
+        self.workers = netutil.WorkerPool(workers, 'MQTT')
+        self.socket_options = socket_options or netutil.SocketOptions()
+        self.fault_rules = fault_rules
+        # Per-topic payload schemas (payloadschema.ValidatorSet) checked on every PUBLISH.
+        self.validators = validators
+        # Named per-topic handlers installed at runtime (admin API) that publish a reply.
+        self.handlers = handlers.HandlerTable()
+        if redirect_code not in REDIRECT_CODES:
+            raise ValueError(f'unknown mqtt redirect code: {redirect_code!r}')
+        # Server Reference new connections are sent to, e.g. 'broker2:1883'.
+        self.redirect = redirect
+        self.redirect_code = redirect_code
+        self.cluster = cluster
+        if cluster is not None:
+            cluster.join(self)
+        # Per-connection hooks, as on TCPServer: on_accept(conn, addr) before the first packet is read,
+        # on_close(conn, addr, error) after the session state is cleaned up.
+        self.on_accept = on_accept
+        self.on_close = on_close
 
     def _serve(self, sock, stop_event):
+        self._start_publishers(stop_event)
+        if self.prober:
+            self.prober.start(stop_event)
+        self.socket_options.apply(sock)
         sock.settimeout(1.0)
         logger.info(f'MQTT server listening on {self.bind}:{self.port}')
         try:
             while not stop_event.is_set():
+                if not self.limit.wait_slot(stop_event):
+                    break
+                if not self.pacer.before_accept(stop_event):
+                    break
                 try:
                     conn, addr = sock.accept()
                 except socket.timeout:
                     continue
                 except OSError:
                     break
-                t = threading.Thread(target=self._handle_conn, args=(conn, addr), daemon=True)
-                t.start()
+                self.pacer.after_accept(stop_event)
+                self.socket_options.apply(conn)
+                if not self.limit.admit(conn, addr):
+                    continue
+                self.workers.submit(self._handle_conn, conn, addr)
         finally:
             sock.close()
 
+    def addr(self):
+        """The bound (host, port) once listening, else None."""
+        return self._addr
+
+    def traffic_totals(self):
+        """Connections, bytes and frames in/out summed over all connections so far, open ones included."""
+        return self.stats.traffic.snapshot()
+
     def listen_and_serve(self, stop_event):
-        sock = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
-        sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
-        sock.bind((self.bind, self.port))
-        sock.listen(128)
+        self.serve(stop_event, netutil.listen_tcp(self.bind, self.port))
+
+    def serve(self, stop_event, sock):
+        """Serve on a listening socket created by the caller (e.g. bound to port 0)."""
+        self._addr = sock.getsockname()
+        self.port = self._addr[1]
+        self.stats_key = f'{self.stats_name}:{self.port}'
+        stats.register(self.stats_key, self.stats)
         self._serve(sock, stop_event)
 
-    def listen_and_serve_tls(self, stop_event, cert_file, key_file):
-        ctx = ssl.SSLContext(ssl.PROTOCOL_TLS_SERVER)
-        ctx.minimum_version = ssl.TLSVersion.TLSv1_2
-        ctx.load_cert_chain(cert_file, key_file)
-        sock = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
-        sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
-        sock.bind((self.bind, self.port))
-        sock.listen(128)
+    def listen_and_serve_tls(self, stop_event, cert_file, key_file, client_ca_file='', require_client_cert=False,
+                            min_version='', max_version='', ciphers='', alpn=(), alpn_strict=False):
+        self.serve_tls(stop_event, netutil.listen_tcp(self.bind, self.port), cert_file, key_file, client_ca_file,
+                           require_client_cert, min_version, max_version, ciphers, alpn, alpn_strict)
+
+    def serve_tls(self, stop_event, sock, cert_file, key_file, client_ca_file='', require_client_cert=False,
+                  min_version='', max_version='', ciphers='', alpn=(), alpn_strict=False):
+        ctx = netutil.server_tls_context(cert_file, key_file, client_ca_file, require_client_cert,
+                                         min_version, max_version, ciphers, alpn)
+        self._addr = sock.getsockname()
+        self.port = self._addr[1]
+        self.socket_options.apply(sock)
         sock.settimeout(1.0)
+        self.stats_key = f'{self.stats_name}-tls:{self.port}'
+        stats.register(self.stats_key, self.stats)
+        self._start_publishers(stop_event)
+        if self.prober:
+            self.prober.start(stop_event)
         logger.info(f'MQTT TLS server listening on {self.bind}:{self.port}')
         try:
             while not stop_event.is_set():
+                if not self.limit.wait_slot(stop_event):
+                    break
+                if not self.pacer.before_accept(stop_event):
+                    break
                 try:
                     conn, addr = sock.accept()
                 except socket.timeout:
                     continue
                 except OSError:
                     break
-                try:
-                    conn.settimeout(5.0)
-                    tls_conn = ctx.wrap_socket(conn, server_side=True)
-                    tls_conn.settimeout(None)
-                except ssl.SSLError as e:
-                    logger.debug(f'MQTT TLS handshake error from {addr}: {e}')
-                    conn.close()
-                    continue
-                t = threading.Thread(target=self._handle_conn, args=(tls_conn, addr), daemon=True)
-                t.start()
+                self.pacer.after_accept(stop_event)
+                self.socket_options.apply(conn)
+                self.workers.submit(self._accept_tls, ctx, conn, addr, client_ca_file, alpn, alpn_strict)
         finally:
             sock.close()
 
+    def _accept_tls(self, ctx, conn, addr, client_ca_file, alpn, alpn_strict):
+        """Do the TLS handshake in the connection's own thread, so a silent client holds up no one else."""
+        try:
+            conn.settimeout(5.0)
+            self.pacer.before_handshake()
+            tls_conn, offered = netutil.accept_tls(ctx, conn, alpn, alpn_strict)
+            tls_conn.settimeout(None)
+        except OSError as e:
+            logger.debug(f'MQTT TLS handshake error from {addr}: {e}')
+            self.stats.record_error(stats.ERROR_TLS)
+            conn.close()
+            return
+        if client_ca_file:
+            logger.info(f'MQTT TLS client certificate from {addr}: {netutil.peer_subject(tls_conn) or "none"}')
+        if alpn:
+            logger.info(f'MQTT TLS ALPN from {addr}: offered {offered or "none"}, '
+                        f'negotiated {tls_conn.selected_alpn_protocol() or "none"}')
+        if not self.limit.admit(tls_conn, addr):
+            return
+        self._handle_conn(tls_conn, addr)
+
     def _recv_exact(self, conn, n):
         buf = b''
         while len(buf) < n:
@@ -135,6 +311,7 @@ class MQTTServer:
         while True:
             if num_bytes >= 4:
                 logger.warning('MQTT Remaining Length exceeds 4-byte limit, closing connection')
+                self.stats.record_error(stats.ERROR_PARSE)
                 return None
             b_bytes = self._recv_exact(conn, 1)
             if not b_bytes:
@@ -155,27 +332,77 @@ class MQTTServer:
         return packet_type, flags, payload
 
     def _handle_conn(self, conn, addr):
-        conn.settimeout(60.0)
-        logger.info(f'MQTT connection from {addr}')
+        conn.settimeout(self.idle_timeout or None)
+        logger.info(f'MQTT connection from {addr}', extra=logthrottle.event('mqtt.connect'))
+        info = stats.connections.open(self.stats_key, addr, self.stats)
+        # Every packet goes out in one sendall(), so each call is one frame.
+        conn = stats.CountingConn(conn, info, frames=True)
+        with self._lock:
+            self._send_locks[conn] = lock = threading.Lock()
+        if self.prober:
+            # Probes go out between packets, never inside one.
+            self.prober.add(conn, info, lock)
         try:
+            if self.on_accept:
+                try:
+                    self.on_accept(conn, addr)
+                except Exception as e:
+                    logger.info(f'MQTT connection from {addr} rejected by on_accept: {e}')
+                    info.error = e
+                    return
             while True:
                 result = self._read_packet(conn)
                 if result is None:
-                    logger.info(f'MQTT client disconnected: {addr}')
+                    logger.info(f'MQTT client disconnected: {addr}', extra=logthrottle.event('mqtt.disconnect'))
                     return
                 packet_type, flags, payload = result
+                info.touch(len(payload))
+                info.count('frames_in')
                 self._handle_packet(conn, addr, packet_type, flags, payload)
-        except (ConnectionResetError, BrokenPipeError, OSError, socket.timeout):
-            pass
+        except OSError as e:
+            # After a DISCONNECT the socket is closed and the next read fails; that is no error.
+            if conn.fileno() != -1:
+                self.stats.record_error(e)
+                info.error = e
         finally:
+            stats.connections.close(info)
+            if self.prober:
+                self.prober.remove(info)
+            self.limit.release()
             with self._lock:
                 to_remove = [cid for cid, c in self._clients.items() if c is conn]
                 for cid in to_remove:
                     del self._clients[cid]
+                subs = self._subscriptions.pop(conn, None)
+                persistent_id = self._persistent.pop(conn, None)
+                if persistent_id is not None:
+                    self._sessions[persistent_id] = dict(subs or {})
+                self._send_locks.pop(conn, None)
+                self._versions.pop(conn, None)
+                will = self._wills.pop(conn, None)
+            traffic.publish('mqtt', self.stats_key, addr, 'disconnect', client=to_remove[0] if to_remove else None)
+            if self.on_close:
+                try:
+                    self.on_close(conn, addr, info.error)
+                except Exception as e:
+                    logger.warning(f'MQTT on_close hook failed for {addr}: {e}')
             try:
                 conn.close()
             except Exception:
                 pass
+            if will:
+                topic, message, qos, retain = will
+                logger.info(f'MQTT publishing will of {addr}: topic={topic}')
+                self.publish(topic, message, qos, retain)
+
+    def _send(self, conn, packet):
+        with self._lock:
+            send_lock = self._send_locks.get(conn)
+        if send_lock is None:
+            conn.sendall(packet)
+            return
+        with send_lock:
+            conn.sendall(packet)
 
     def _handle_packet(self, conn, addr, packet_type, flags, payload):
         if packet_type == MQTT_CONNECT:
@@ -185,25 +412,27 @@ class MQTTServer:
         elif packet_type == MQTT_PUBACK:
             if len(payload) >= 2:
                 pid = struct.unpack_from('>H', payload)[0]
-                logger.info(f'MQTT PUBACK: packetID={pid}')
+                logger.info(f'MQTT PUBACK: packetID={pid}', extra=logthrottle.event('mqtt.ack'))
         elif packet_type == MQTT_PUBREC:
             if len(payload) >= 2:
                 pid = struct.unpack_from('>H', payload)[0]
-                logger.info(f'MQTT PUBREC: packetID={pid}')
-                conn.sendall(_build_packet(MQTT_PUBREL, 2, struct.pack('>H', pid)))
+                logger.info(f'MQTT PUBREC: packetID={pid}', extra=logthrottle.event('mqtt.ack'))
+                self._send(conn, _build_packet(MQTT_PUBREL, 2, struct.pack('>H', pid)))
         elif packet_type == MQTT_PUBREL:
             if len(payload) >= 2:
                 pid = struct.unpack_from('>H', payload)[0]
-                logger.info(f'MQTT PUBREL: packetID={pid}')
-                conn.sendall(_build_packet(MQTT_PUBCOMP, 0, struct.pack('>H', pid)))
+                logger.info(f'MQTT PUBREL: packetID={pid}', extra=logthrottle.event('mqtt.ack'))
+                self._send(conn, _build_packet(MQTT_PUBCOMP, 0, struct.pack('>H', pid)))
         elif packet_type == MQTT_SUBSCRIBE:
             self._handle_subscribe(conn, addr, payload)
         elif packet_type == MQTT_UNSUBSCRIBE:
             self._handle_unsubscribe(conn, addr, payload)
         elif packet_type == MQTT_PINGREQ:
-            conn.sendall(_build_packet(MQTT_PINGRESP, 0, b''))
+            self._send(conn, _build_packet(MQTT_PINGRESP, 0, b''))
         elif packet_type == MQTT_DISCONNECT:
-            logger.info(f'MQTT client sent disconnect: {addr}')
+            logger.info(f'MQTT client sent disconnect: {addr}', extra=logthrottle.event('mqtt.disconnect'))
+            with self._lock:
+                self._wills.pop(conn, None)
             conn.close()
 
     def _handle_connect(self, conn, addr, payload):
@@ -213,72 +442,345 @@ class MQTTServer:
             return
         if pos + 4 > len(payload):
             logger.warning(f'Malformed MQTT CONNECT from {addr}: payload too short')
+            self.stats.record_error(stats.ERROR_PARSE)
             return
         protocol_level = payload[pos]; pos += 1
         connect_flags = payload[pos]; pos += 1
         keep_alive = struct.unpack_from('>H', payload, pos)[0]; pos += 2
+        v5 = protocol_level == MQTT_V5
+        if v5:
+            pos = _skip_properties(payload, pos)
+            if pos is None:
+                logger.warning(f'Malformed MQTT CONNECT from {addr}: bad properties')
+                self.stats.record_error(stats.ERROR_PARSE)
+                return
         client_id, pos = _read_mqtt_string(payload, pos)
         if client_id is None:
             return
+        if self.redirect:
+            self._refuse_redirected(conn, addr, client_id, v5)
+            return
+        will = None
+        if connect_flags & 0x04:
+            if v5:
+                pos = _skip_properties(payload, pos)
+                if pos is None:
+                    logger.warning(f'Malformed MQTT CONNECT from {addr}: bad will properties')
+                    self.stats.record_error(stats.ERROR_PARSE)
+                    return
+            will_topic, pos = _read_mqtt_string(payload, pos)
+            if will_topic is None or pos + 2 > len(payload):
+                logger.warning(f'Malformed MQTT CONNECT from {addr}: bad will')
+                self.stats.record_error(stats.ERROR_PARSE)
+                return
+            length = struct.unpack_from('>H', payload, pos)[0]
+            pos += 2
+            will = (will_topic, payload[pos:pos + length], (connect_flags >> 3) & 0x03,
+                    bool(connect_flags & 0x20))
         clean_session = bool(connect_flags & 0x02)
-        logger.info(f'MQTT CONNECT: client={client_id}, clean={clean_session}')
+        logger.info(f'MQTT CONNECT: client={client_id}, clean={clean_session}, keep_alive={keep_alive}',
+                    extra=logthrottle.event('mqtt.connect'))
+        if keep_alive > 0:
+            # The spec allows one and a half keep-alive periods of silence; a shorter
+            # idle_timeout still wins so non-compliant brokers can be imitated.
+            timeout = keep_alive * 1.5
+            conn.settimeout(min(timeout, self.idle_timeout) if self.idle_timeout else timeout)
+        traffic.publish('mqtt', self.stats_key, addr, 'connect', client=client_id)
         with self._lock:
             self._clients[client_id] = conn
-        connack = _build_packet(MQTT_CONNACK, 0, bytes([0, 0]))
-        conn.sendall(connack)
+            self._versions[conn] = protocol_level
+            if will:
+                self._wills[conn] = will
+            if clean_session:
+                self._sessions.pop(client_id, None)
+                session_present = False
+            else:
+                self._persistent[conn] = client_id
+                session_present = client_id in self._sessions
+                if session_present:
+                    self._subscriptions[conn] = dict(self._sessions[client_id])
+        # A v5 CONNACK carries an (empty) property block after the reason code.
+        connack = _build_packet(MQTT_CONNACK, 0, bytes([1 if session_present else 0, 0]) + (b'\x00' if v5 else b''))
+        self._send(conn, connack)
         if self.handler and hasattr(self.handler, 'on_connect'):
             self.handler.on_connect(conn, client_id, clean_session)
 
+    def _refuse_redirected(self, conn, addr, client_id, v5):
+        """Answer CONNECT with a redirect to self.redirect and hang up."""
+        if v5:
+            body = bytes([0, REDIRECT_CODES[self.redirect_code]]) + _server_reference(self.redirect)
+        else:
+            body = b'\x00\x03'
+        logger.info(f'MQTT CONNECT from {client_id} ({addr}) redirected to {self.redirect} '
+                    f'({self.redirect_code if v5 else "server unavailable, v3.1.1"})')
+        self._send(conn, _build_packet(MQTT_CONNACK, 0, body))
+        try:
+            conn.shutdown(socket.SHUT_RDWR)
+        except OSError:
+            pass
+
+    def redirect_clients(self, reference, code='use_another_server'):
+        """Start a maintenance window: redirect new connections to reference and
+        disconnect the connected clients, telling v5 clients where to go.
+        An empty reference ends the window. Returns the number of clients disconnected.
+        """
+        if code not in REDIRECT_CODES:
+            raise ValueError(f'unknown mqtt redirect code: {code!r}')
+        self.redirect = reference
+        self.redirect_code = code
+        if not reference:
+            logger.info('MQTT redirect cleared')
+            return 0
+        with self._lock:
+            clients = [(conn, self._versions.get(conn)) for conn in self._clients.values()]
+        for conn, version in clients:
+            try:
+                if version == MQTT_V5:
+                    self._send(conn, _build_packet(MQTT_DISCONNECT, 0,
+                                                   bytes([REDIRECT_CODES[code]]) + _server_reference(reference)))
+                conn.shutdown(socket.SHUT_RDWR)
+            except OSError as e:
+                logger.debug(f'MQTT redirect disconnect failed: {e}')
+        logger.info(f'MQTT redirecting to {reference} ({code}), {len(clients)} clients disconnected')
+        return len(clients)
+
+    def _client_id(self, conn):
+        with self._lock:
+            return next((cid for cid, c in self._clients.items() if c is conn), None)
+
     def _handle_publish(self, conn, addr, flags, payload):
         pos = 0
         topic, pos = _read_mqtt_string(payload, pos)
         if topic is None:
             return
         qos = (flags >> 1) & 0x03
+        retain = bool(flags & 0x01)
         packet_id = 0
         if qos > 0:
             if len(payload) - pos < 2:
                 logger.warning('Malformed MQTT PUBLISH: insufficient bytes for packet ID')
+                self.stats.record_error(stats.ERROR_PARSE)
                 return
             packet_id = struct.unpack_from('>H', payload, pos)[0]
             pos += 2
+        if self._is_v5(conn):
+            pos = _skip_properties(payload, pos)
+            if pos is None:
+                logger.warning('Malformed MQTT PUBLISH: bad properties')
+                self.stats.record_error(stats.ERROR_PARSE)
+                return
         msg_payload = payload[pos:]
-        logger.info(f'MQTT PUBLISH: topic={topic}, qos={qos}, payload={msg_payload.hex()}')
-        if self.retain_messages and msg_payload:
-            with self._lock:
-                self._retained[topic] = msg_payload
+        logger.info(f'MQTT PUBLISH: topic={topic}, qos={qos}, payload={msg_payload.hex()}',
+                    extra=logthrottle.event('mqtt.publish'))
+        if traffic.active():
+            traffic.publish('mqtt', self.stats_key, addr, 'publish', msg_payload, client=self._client_id(conn),
+                            topic=topic, qos=qos)
+        if self.validators and not self._validate(conn, addr, topic, msg_payload):
+            return
+        fault = self.fault_rules.match(msg_payload, topic=topic) if self.fault_rules else None
+        if retain or self.retain_messages:
+            self._retain(topic, msg_payload, qos, clear=retain)
         if self.handler and hasattr(self.handler, 'on_publish'):
             self.handler.on_publish(topic, qos, msg_payload, packet_id)
+        if fault and fault.delay > 0:
+            self.clock.sleep(fault.delay)
+        if fault and fault.dropped():
+            logger.info(f'MQTT fault rule dropped PUBLISH to {topic} from {addr}')
+        else:
+            self._deliver(topic, fault.corrupt(msg_payload) if fault else msg_payload, qos)
         if qos == 1:
-            conn.sendall(_build_packet(MQTT_PUBACK, 0, struct.pack('>H', packet_id)))
+            self._send(conn, _build_packet(MQTT_PUBACK, 0, struct.pack('>H', packet_id)))
         elif qos == 2:
-            conn.sendall(_build_packet(MQTT_PUBREC, 0, struct.pack('>H', packet_id)))
+            self._send(conn, _build_packet(MQTT_PUBREC, 0, struct.pack('>H', packet_id)))
+        swapped = self.handlers.match(lambda h: topic_matches(h.topic, topic)) if self.handlers else None
+        if swapped:
+            if swapped.delay > 0:
+                self.clock.sleep(swapped.delay)
+            self.publish(*swapped.reply(topic, msg_payload), swapped.qos)
+
+    def _validate(self, conn, addr, topic, payload):
+        """Check a PUBLISH payload against the validators; False when the client was disconnected for it."""
+        found = self.validators.check(topic, payload)
+        if found is None:
+            return True
+        validator, reason = found
+        logger.warning(f'MQTT PUBLISH to {topic} from {addr} violates {validator.name}: {reason}')
+        self.stats.record_error(stats.ERROR_SCHEMA)
+        if traffic.active():
+            traffic.publish('mqtt', self.stats_key, addr, 'violation', payload, client=self._client_id(conn),
+                            topic=topic, reason=reason)
+        if not validator.disconnect:
+            return True
+        try:
+            if self._is_v5(conn):
+                self._send(conn, _build_packet(MQTT_DISCONNECT, 0, bytes([PAYLOAD_FORMAT_INVALID])))
+            conn.shutdown(socket.SHUT_RDWR)
+        except OSError as e:
+            logger.debug(f'MQTT disconnect of {addr} failed: {e}')
+        return False
 
     def _handle_subscribe(self, conn, addr, payload):
         if len(payload) < 2:
             return
         packet_id = struct.unpack_from('>H', payload)[0]
-        pos = 2
+        v5 = self._is_v5(conn)
+        pos = _skip_properties(payload, 2) if v5 else 2
+        if pos is None:
+            self.stats.record_error(stats.ERROR_PARSE)
+            return
         return_codes = []
+        granted = {}
         while pos < len(payload):
             topic, pos = _read_mqtt_string(payload, pos)
             if topic is None:
                 break
             if pos < len(payload):
-                qos = payload[pos]; pos += 1
+                # v5 packs no-local/retain flags above the QoS bits of the options byte.
+                qos = payload[pos] & 0x03 if v5 else payload[pos]; pos += 1
                 return_codes.append(qos)
-                logger.info(f'MQTT SUBSCRIBE: packetID={packet_id}, topic={topic}, qos={qos}')
-        response = struct.pack('>H', packet_id) + bytes(return_codes)
-        conn.sendall(_build_packet(MQTT_SUBACK, 0, response))
+                granted[topic] = qos
+                logger.info(f'MQTT SUBSCRIBE: packetID={packet_id}, topic={topic}, qos={qos}',
+                            extra=logthrottle.event('mqtt.subscribe'))
+                if traffic.active():
+                    traffic.publish('mqtt', self.stats_key, addr, 'subscribe', client=self._client_id(conn),
+                                    topic=topic, qos=qos)
+        response = struct.pack('>H', packet_id) + (b'\x00' if v5 else b'') + bytes(return_codes)
+        # Hold the connection's send lock so no routed PUBLISH overtakes the SUBACK.
+        with self._lock:
+            send_lock = self._send_locks.get(conn) or threading.Lock()
+        with send_lock:
+            with self._lock:
+                self._subscriptions.setdefault(conn, {}).update(granted)
+                retained = [(topic, payload, min(qos, sub_qos))
+                            for topic, (payload, qos) in self._retained.items()
+                            for f, sub_qos in granted.items() if topic_matches(f, topic)]
+            conn.sendall(_build_packet(MQTT_SUBACK, 0, response))
+            for topic, msg, qos in retained:
+                conn.sendall(self._publish_packet(topic, msg, qos, retain=True, v5=v5))
 
     def _handle_unsubscribe(self, conn, addr, payload):
         if len(payload) < 2:
             return
         packet_id = struct.unpack_from('>H', payload)[0]
-        pos = 2
+        v5 = self._is_v5(conn)
+        pos = _skip_properties(payload, 2) if v5 else 2
+        if pos is None:
+            self.stats.record_error(stats.ERROR_PARSE)
+            return
+        count = 0
         while pos < len(payload):
             topic, pos = _read_mqtt_string(payload, pos)
             if topic is None:
                 break
-            logger.info(f'MQTT UNSUBSCRIBE: packetID={packet_id}, topic={topic}')
-        conn.sendall(_build_packet(MQTT_UNSUBACK, 0, struct.pack('>H', packet_id)))
+            count += 1
+            logger.info(f'MQTT UNSUBSCRIBE: packetID={packet_id}, topic={topic}',
+                        extra=logthrottle.event('mqtt.subscribe'))
+            with self._lock:
+                self._subscriptions.get(conn, {}).pop(topic, None)
+        # v5 UNSUBACK has properties and one reason code (success) per topic filter.
+        body = struct.pack('>H', packet_id) + (b'\x00' + bytes(count) if v5 else b'')
+        self._send(conn, _build_packet(MQTT_UNSUBACK, 0, body))
+
+    def publish(self, topic, payload, qos=0, retain=False):
+        """Inject a message as if published by the broker itself.
+
+        Returns the number of subscribers the message was delivered to.
+        """
+        if retain:
+            self._retain(topic, payload, qos, clear=True)
+        logger.info(f'MQTT inject: topic={topic}, qos={qos}, payload={payload.hex()}')
+        return self._deliver(topic, payload, qos)
+
+    def export_state(self):
+        """Return the retained store and subscription table as JSON-serializable data.
+
+        Subscriptions are listed by client ID and include stored sessions of
+        clean_session=0 clients that are currently offline.
+        """
+        with self._lock:
+            client_ids = {conn: cid for cid, conn in self._clients.items()}
+            subscriptions = {cid: dict(subs) for cid, subs in self._sessions.items()}
+            for conn, subs in self._subscriptions.items():
+                if conn in client_ids:
+                    subscriptions[client_ids[conn]] = dict(subs)
+            retained = [{'topic': topic, 'payload_hex': payload.hex(), 'qos': qos}
+                        for topic, (payload, qos) in sorted(self._retained.items())]
+        return {'retained': retained, 'subscriptions': subscriptions}
+
+    def load_state(self, state):
+        """Preload state from export_state(): retained messages are stored and
+        subscriptions become sessions restored when that client connects with
+        clean_session=0. Returns (retained, subscriptions) counts.
+        """
+        retained = {}
+        for entry in state.get('retained', []):
+            retained[entry['topic']] = (bytes.fromhex(entry['payload_hex']), int(entry.get('qos', 0)))
+        sessions = {}
+        for client_id, subs in state.get('subscriptions', {}).items():
+            sessions[client_id] = {topic_filter: int(qos) for topic_filter, qos in subs.items()}
+        with self._lock:
+            self._retained.update(retained)
+            self._sessions.update(sessions)
+        logger.info(f'MQTT state loaded: {len(retained)} retained, {len(sessions)} client sessions')
+        return len(retained), len(sessions)
+
+    def _retain(self, topic, payload, qos, clear):
+        """Store a retained message; an empty payload clears it when clear is set."""
+        with self._lock:
+            if payload:
+                self._retained[topic] = (payload, qos)
+            elif clear:
+                self._retained.pop(topic, None)
+
+    def _publish_packet(self, topic, payload, qos, retain=False, v5=False):
+        body = struct.pack('>H', len(topic.encode())) + topic.encode()
+        if qos > 0:
+            body += struct.pack('>H', self._packet_id())
+        if v5:
+            body += b'\x00'
+        return _build_packet(MQTT_PUBLISH, (qos << 1) | (1 if retain else 0), body + payload)
+
+    def _is_v5(self, conn):
+        with self._lock:
+            return self._versions.get(conn) == MQTT_V5
+
+    def _deliver(self, topic, payload, qos):
+        """Route to subscribers of this broker, or of every member when clustered."""
+        members = self.cluster.members if self.cluster else [self]
+        return sum(member._route(topic, payload, qos) for member in members)
+
+    def _route(self, topic, payload, qos):
+        targets = []
+        with self._lock:
+            for conn, subs in self._subscriptions.items():
+                granted = [sub_qos for f, sub_qos in subs.items() if topic_matches(f, topic)]
+                if granted:
+                    targets.append((conn, min(qos, max(granted)), self._versions.get(conn) == MQTT_V5))
+        delivered = 0
+        for conn, out_qos, v5 in targets:
+            try:
+                self._send(conn, self._publish_packet(topic, payload, out_qos, v5=v5))
+                delivered += 1
+            except OSError as e:
+                logger.debug(f'MQTT delivery to subscriber failed: {e}')
+        return delivered
+
+    def _packet_id(self):
+        with self._lock:
+            self._next_packet_id = self._next_packet_id % 0xFFFF + 1
+            return self._next_packet_id
+
+    def _start_publishers(self, stop_event):
+        for spec in self.publish_specs:
+            generator = make_generator(spec['payload'])
+            interval = parse_duration(spec.get('interval', '1s'))
+            t = threading.Thread(target=self._run_publisher,
+                                 args=(stop_event, spec['topic'], generator, interval,
+                                       spec.get('qos', 0), spec.get('retain', False)),
+                                 daemon=True)
+            t.start()
+
+    def _run_publisher(self, stop_event, topic, generator, interval, qos, retain):
+        logger.info(f'MQTT publisher started: topic={topic}, interval={interval}s')
+        while not self.clock.wait(stop_event, interval):
+            self.publish(topic, generator.next(), qos, retain)
@@ -0,0 +1,69 @@
+"""Named network profiles: the link of a radio technology in one setting.
+
+Instead of looking up latency and bandwidth figures for each radio, pick a
+profile ("network_profile" in the server config or a session spec,
+--network-profile on serve-all, tcp and udp) and the TCP and UDP servers
+answer like a device on that link:
+
+  profile    latency  jitter  bandwidth  UDP loss
+  nb-iot     1.5s     500ms   20kbps     1%
+  lte-m      150ms    50ms    300kbps    0.5%
+  gprs       700ms    200ms   40kbps     2%
+  satellite  600ms    50ms    512kbps    1%
+
+Latency is added once per exchange (before each reply), so it stands for
+the round trip; jitter spreads it evenly by up to that much either way.
+The figures are typical field values for the technologies: NB-IoT (3GPP
+Cat-NB1, coverage-enhanced single-tone uplink, seconds of latency), LTE-M
+(Cat-M1 with PSM/eDRX off), 2G GPRS (2-4 timeslots) and a geostationary
+satellite terminal, whose ~36000 km hops dominate its latency. Loss only
+applies to UDP: TCP retransmits, which the jitter stands in for.
+
+Settings given explicitly next to a profile win: {"network_profile":
+"nb-iot", "udp": {"drop_rate": 0.1}} is NB-IoT with 10% UDP loss. On the
+command line the profile overrides the config file and explicit flags
+override the profile.
+"""
+
+from yourtestsrv.config import parse_duration
+from yourtestsrv.shaping import parse_rate
+
+PROFILES = {
+    'nb-iot': {'latency': '1500ms', 'jitter': '500ms', 'bandwidth': '20kbps', 'loss': 0.01},
+    'lte-m': {'latency': '150ms', 'jitter': '50ms', 'bandwidth': '300kbps', 'loss': 0.005},
+    'gprs': {'latency': '700ms', 'jitter': '200ms', 'bandwidth': '40kbps', 'loss': 0.02},
+    'satellite': {'latency': '600ms', 'jitter': '50ms', 'bandwidth': '512kbps', 'loss': 0.01},
+}
+NAMES = tuple(PROFILES)
+KINDS = ('tcp', 'udp')
+
+
+def settings(name, kind):
+    """Config-style options (as in server.tcp / server.udp) of profile name for a server of kind."""
+    if name not in PROFILES:
+        raise ValueError(f'unknown network profile: {name!r} (use one of {", ".join(NAMES)})')
+    profile = PROFILES[name]
+    options = {'delay': profile['latency'], 'jitter': profile['jitter'], 'rate_limit': profile['bandwidth']}
+    if kind == 'udp':
+        options['drop_rate'] = profile['loss']
+    return options
+
+
+def merge(name, kind, options):
+    """options with the settings of profile name filled in where they are not set; options itself if no profile."""
+    if not name or kind not in KINDS:
+        return options
+    return {**settings(name, kind), **(options or {})}
+
+
+def apply(server, name):
+    """Overwrite the TCP and UDP settings of a parsed ServerConfig with profile name."""
+    for kind in KINDS:
+        section = getattr(server, kind)
+        for key, value in settings(name, kind).items():
+            if key == 'rate_limit':
+                value = parse_rate(value)
+            elif key != 'drop_rate':
+                value = parse_duration(value)
+            setattr(section, key, value)
+    server.network_profile = name
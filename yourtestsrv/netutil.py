@@ -0,0 +1,679 @@
+import ipaddress
+import itertools
+import logging
+import os
+import queue
+import socket
+import ssl
+import stat
+import struct
+import threading
+import time
+import weakref
+
+from yourtestsrv import clock as clock_module
+from yourtestsrv import privbind
+from yourtestsrv.shaping import TokenBucket
+
+logger = logging.getLogger(__name__)
+
+
+def split_bind(bind):
+    """Return (family, host) for a bind address; IPv6 literals may be bracketed."""
+    host = bind.strip('[]')
+    family = socket.AF_INET6 if ':' in host else socket.AF_INET
+    return family, host
+
+
+TLS_VERSIONS = {
+    '1.0': ssl.TLSVersion.TLSv1,
+    '1.1': ssl.TLSVersion.TLSv1_1,
+    '1.2': ssl.TLSVersion.TLSv1_2,
+    '1.3': ssl.TLSVersion.TLSv1_3,
+}
+
+
+# Live server contexts, so a renewed certificate can be swapped in without restarting the listeners.
+_contexts = weakref.WeakSet()
+
+
+def reload_certificates(cert_file, key_file):
+    """Load a renewed cert_file/key_file into every server context made from them.
+
+    Handshakes started afterwards present the new certificate; established
+    sessions are unaffected. Returns the number of contexts updated.
+    """
+    count = 0
+    for ctx in list(_contexts):
+        if getattr(ctx, 'cert_files', None) == (cert_file, key_file):
+            ctx.load_cert_chain(cert_file, key_file)
+            count += 1
+    return count
+
+
+def server_tls_context(cert_file, key_file, client_ca_file='', require_client_cert=False,
+                       min_version='', max_version='', ciphers='', alpn=()):
+    """TLS context shared by the TCP, HTTP and MQTT listeners.
+
+    With client_ca_file, client certificates signed by that CA are requested
+    (and verified when sent); require_client_cert fails handshakes without one.
+    min_version/max_version ('1.0' .. '1.3') pin the protocol range (default
+    1.2 and up, or just max_version when that is older) and ciphers is an OpenSSL cipher list for TLS 1.2 and older;
+    TLS 1.3 suites are not configurable from Python. alpn is the server's
+    ALPN protocol list in order of preference.
+    """
+    for version in (min_version, max_version):
+        if version and version not in TLS_VERSIONS:
+            raise ValueError(f'unknown TLS version: {version!r}')
+    min_version = min_version or min('1.2', max_version or '1.2')
+    if max_version and max_version < min_version:
+        raise ValueError(f'TLS max version {max_version} is below min version {min_version}')
+    ctx = ssl.SSLContext(ssl.PROTOCOL_TLS_SERVER)
+    ctx.minimum_version = TLS_VERSIONS[min_version]
+    if max_version:
+        ctx.maximum_version = TLS_VERSIONS[max_version]
+    legacy = min_version in ('1.0', '1.1')
+    if ciphers or legacy:
+        # OpenSSL 3 refuses TLS 1.0/1.1 (and their SHA-1 suites) above security level 0.
+        ctx.set_ciphers((ciphers or 'DEFAULT') + (':@SECLEVEL=0' if legacy else ''))
+    ctx.load_cert_chain(cert_file, key_file)
+    ctx.cert_files = (cert_file, key_file)
+    _contexts.add(ctx)
+    if alpn:
+        ctx.set_alpn_protocols(list(alpn))
+    if require_client_cert and not client_ca_file:
+        raise ValueError('require_client_cert needs a client CA file')
+    if client_ca_file:
+        ctx.load_verify_locations(client_ca_file)
+        ctx.verify_mode = ssl.CERT_REQUIRED if require_client_cert else ssl.CERT_OPTIONAL
+    return ctx
+
+
+def peer_subject(tls_conn):
+    """The client certificate's subject as 'CN=..., O=...', or '' without one."""
+    cert = tls_conn.getpeercert()
+    if not cert:
+        return ''
+    return ', '.join(f'{k}={v}' for rdn in cert.get('subject', ()) for k, v in rdn)
+
+
+ALERT_NO_APPLICATION_PROTOCOL = 120
+
+
+def client_hello_alpn(data):
+    """The ALPN protocols offered in a ClientHello record, or None when data
+    is not a complete ClientHello or carries no ALPN extension."""
+    if len(data) < 9 or data[0] != 0x16 or data[5] != 0x01:
+        return None
+    hello = data[9:5 + struct.unpack_from('>H', data, 3)[0]]
+    try:
+        pos = 34 + 1 + hello[34]
+        pos += 2 + struct.unpack_from('>H', hello, pos)[0]
+        pos += 1 + hello[pos]
+        end = pos + 2 + struct.unpack_from('>H', hello, pos)[0]
+        pos += 2
+        while pos + 4 <= end:
+            ext_type, ext_len = struct.unpack_from('>HH', hello, pos)
+            pos += 4
+            if ext_type == 16:
+                protocols = []
+                item, stop = pos + 2, pos + 2 + struct.unpack_from('>H', hello, pos)[0]
+                while item < stop:
+                    protocols.append(hello[item + 1:item + 1 + hello[item]].decode('ascii', 'replace'))
+                    item += 1 + hello[item]
+                return protocols
+            pos += ext_len
+    except (IndexError, struct.error):
+        pass
+    return None
+
+
+def peek_client_alpn(conn, timeout=5.0):
+    """Peek at the ClientHello on conn (without consuming it) and return the
+    ALPN protocols the client offers, or None."""
+    deadline = time.monotonic() + timeout
+    while True:
+        data = conn.recv(16384, socket.MSG_PEEK)
+        if not data or data[0] != 0x16:
+            return None
+        if len(data) >= 5 and len(data) >= 5 + struct.unpack_from('>H', data, 3)[0]:
+            return client_hello_alpn(data)
+        if time.monotonic() >= deadline:
+            return None
+        time.sleep(0.01)
+
+
+def accept_tls(ctx, conn, alpn=(), alpn_strict=False, relay=None):
+    """Run the server handshake on conn; returns (tls_conn, offered) where
+    offered is the client's ALPN list (only looked at when alpn is set).
+
+    With alpn_strict, a client offering ALPN without any protocol from alpn
+    gets a no_application_protocol alert and ssl.SSLError is raised. With a
+    TLSFaultRelay for conn the session runs over the relay.
+    """
+    offered = peek_client_alpn(conn) if alpn else None
+    if alpn_strict and offered and not set(offered) & set(alpn):
+        conn.sendall(bytes([0x15, 0x03, 0x03, 0x00, 0x02, 0x02, ALERT_NO_APPLICATION_PROTOCOL]))
+        raise ssl.SSLError(f'client offered unexpected ALPN protocols {offered}')
+    if relay is not None:
+        relay.start()
+        conn = relay.inner
+    return ctx.wrap_socket(conn, server_side=True), offered
+
+
+class TLSFaultRelay:
+    """A socketpair between a client connection and the TLS layer, so an
+    established session can be broken at the record level:
+
+      alert     a corrupt record is fed to the server's TLS layer, which answers
+                with a genuine (encrypted) fatal bad_record_mac alert, then FIN
+      truncate  one more application record is sent but cut in half, then FIN
+
+    Wrap inner instead of the client connection; once the TLS socket is closed
+    the relay closes the client connection itself.
+    """
+
+    # Bytes of the extra record (encrypted size at least 85) held back by truncate.
+    TRUNCATE_TAIL = 40
+
+    def __init__(self, conn):
+        self.conn = conn
+        self.inner, self._outer = socket.socketpair()
+        self._truncate = False
+        self._to_client = threading.Thread(target=self._tls_to_client, daemon=True)
+
+    def start(self):
+        """Start relaying; inner takes over the connection's timeout."""
+        self.inner.settimeout(self.conn.gettimeout())
+        self.conn.settimeout(None)
+        threading.Thread(target=self._client_to_tls, daemon=True).start()
+        self._to_client.start()
+
+    def _client_to_tls(self):
+        try:
+            while True:
+                data = self.conn.recv(16384)
+                if not data:
+                    break
+                self._outer.sendall(data)
+            self._outer.shutdown(socket.SHUT_WR)
+        except OSError:
+            pass
+
+    def _tls_to_client(self):
+        held = b''
+        try:
+            while True:
+                data = self._outer.recv(16384)
+                if not data:
+                    break
+                if self._truncate:
+                    held += data
+                else:
+                    self.conn.sendall(data)
+            if held:
+                self.conn.sendall(held[:-self.TRUNCATE_TAIL])
+        except OSError:
+            pass
+        finally:
+            self._outer.close()
+            # shutdown() sends the FIN right away; close() alone waits for the
+            # other relay thread to leave its recv().
+            try:
+                self.conn.shutdown(socket.SHUT_RDWR)
+            except OSError:
+                pass
+            self.conn.close()
+
+    def alert(self, tls_conn):
+        """Make tls_conn send a fatal alert and close the session."""
+        try:
+            self._outer.sendall(b'\x17\x03\x03\x00\x20' + os.urandom(32))
+            tls_conn.settimeout(2.0)
+            while tls_conn.recv(4096):
+                pass
+        except (OSError, ValueError):
+            pass
+        self.close(tls_conn)
+
+    def truncate(self, tls_conn):
+        """Send half of one more TLS record and close the session."""
+        self._truncate = True
+        try:
+            tls_conn.sendall(os.urandom(64))
+        except (OSError, ValueError):
+            pass
+        self.close(tls_conn)
+
+    def close(self, tls_conn=None):
+        """Close tls_conn (no close_notify), or just inner after a failed handshake,
+        and wait for the relay to flush to the client."""
+        try:
+            (tls_conn or self.inner).close()
+        except OSError:
+            pass
+        if self._to_client.is_alive():
+            self._to_client.join(5.0)
+
+
+def set_keepalive(conn, period):
+    """Apply a TCP keepalive setting to an accepted connection.
+
+    None leaves the OS default, 0 disables keepalive probes and a positive
+    period enables them, used as both the idle time before the first probe and
+    the interval between probes (like Go's SetKeepAlivePeriod).
+    """
+    if period is None or conn.family not in (socket.AF_INET, socket.AF_INET6):
+        return
+    conn.setsockopt(socket.SOL_SOCKET, socket.SO_KEEPALIVE, 1 if period > 0 else 0)
+    if period > 0:
+        seconds = max(1, int(round(period)))
+        # Linux calls the idle time TCP_KEEPIDLE, macOS TCP_KEEPALIVE.
+        idle = getattr(socket, 'TCP_KEEPIDLE', None) or getattr(socket, 'TCP_KEEPALIVE', None)
+        for option in (idle, getattr(socket, 'TCP_KEEPINTVL', None)):
+            if option is not None:
+                conn.setsockopt(socket.IPPROTO_TCP, option, seconds)
+
+
+def set_keepalive_probes(conn, idle, interval):
+    """Enable TCP keepalive probes after idle seconds of silence, interval seconds apart."""
+    if conn.family not in (socket.AF_INET, socket.AF_INET6):
+        return
+    conn.setsockopt(socket.SOL_SOCKET, socket.SO_KEEPALIVE, 1)
+    idle_option = getattr(socket, 'TCP_KEEPIDLE', None) or getattr(socket, 'TCP_KEEPALIVE', None)
+    for option, seconds in ((idle_option, idle), (getattr(socket, 'TCP_KEEPINTVL', None), interval)):
+        if option is not None:
+            conn.setsockopt(socket.IPPROTO_TCP, option, max(1, int(round(seconds))))
+
+
+def unanswered_keepalive_probes(conn):
+    """Keepalive probes sent on conn and not answered yet (tcpi_probes), or None where TCP_INFO is missing."""
+    if not hasattr(socket, 'TCP_INFO') or conn.family not in (socket.AF_INET, socket.AF_INET6):
+        return None
+    # struct tcp_info starts with the u8 fields state, ca_state, retransmits, probes.
+    return conn.getsockopt(socket.IPPROTO_TCP, socket.TCP_INFO, 8)[3]
+
+
+class SocketOptions:
+    """Per-listener socket tuning: buffer sizes, TCP_USER_TIMEOUT and IP TOS marking.
+
+    Zero (or None for tos) keeps the OS default. Buffer sizes are passed to
+    SO_RCVBUF/SO_SNDBUF as-is, so Linux reports twice the value back.
+    user_timeout is in seconds. tos is the whole TOS / traffic class byte, i.e.
+    DSCP << 2.
+    """
+
+    def __init__(self, rcvbuf=0, sndbuf=0, user_timeout=0.0, tos=None):
+        self.rcvbuf = rcvbuf
+        self.sndbuf = sndbuf
+        self.user_timeout = user_timeout
+        self.tos = tos
+
+    def __bool__(self):
+        return bool(self.rcvbuf or self.sndbuf or self.user_timeout or self.tos is not None)
+
+    def apply(self, sock):
+        """Set the options on sock, logging rather than raising the ones the OS refuses.
+
+        Listeners get them too so the SYN-ACK is already marked and the
+        advertised window reflects rcvbuf.
+        """
+        if not self or sock.family not in (socket.AF_INET, socket.AF_INET6):
+            return
+        options = []
+        if self.rcvbuf:
+            options.append(('SO_RCVBUF', socket.SOL_SOCKET, socket.SO_RCVBUF, self.rcvbuf))
+        if self.sndbuf:
+            options.append(('SO_SNDBUF', socket.SOL_SOCKET, socket.SO_SNDBUF, self.sndbuf))
+        if self.user_timeout and sock.type == socket.SOCK_STREAM:
+            options.append(('TCP_USER_TIMEOUT', socket.IPPROTO_TCP, socket.TCP_USER_TIMEOUT,
+                            max(1, int(self.user_timeout * 1000))))
+        if self.tos is not None:
+            # IPv4-mapped peers of a dual-stack listener take IP_TOS, native IPv6 ones the traffic class.
+            options.append(('IP_TOS', socket.IPPROTO_IP, socket.IP_TOS, self.tos))
+            if sock.family == socket.AF_INET6:
+                options.append(('IPV6_TCLASS', socket.IPPROTO_IPV6, socket.IPV6_TCLASS, self.tos))
+        for name, level, option, value in options:
+            try:
+                sock.setsockopt(level, option, value)
+            except OSError as e:
+                logger.warning(f'Setting {name}={value} failed: {e}')
+
+
+class BufferPool:
+    """Receive buffers shared by the connections of one server.
+
+    A connection takes a buffer for its lifetime and hands it back on close,
+    so thousands of short-lived device connections reuse a few buffers
+    instead of allocating per connection and per read. At most max_idle
+    spare buffers are kept.
+    """
+
+    def __init__(self, size=4096, max_idle=256):
+        self.size = size
+        self.max_idle = max_idle
+        self._idle = []
+        self._lock = threading.Lock()
+
+    def get(self):
+        with self._lock:
+            if self._idle:
+                return self._idle.pop()
+        return bytearray(self.size)
+
+    def put(self, buf):
+        with self._lock:
+            if len(self._idle) < self.max_idle:
+                self._idle.append(buf)
+
+
+def marking_cmsgs(sock, addr, ttl=0, tos=None):
+    """sendmsg() ancillary data setting the TTL / hop limit and TOS / traffic class of one datagram to addr."""
+    # IPv4-mapped peers of a dual-stack socket go out as IPv4 and only honour the IPv4 options.
+    v6 = sock.family == socket.AF_INET6 and not addr[0].startswith('::ffff:')
+    level = socket.IPPROTO_IPV6 if v6 else socket.IPPROTO_IP
+    cmsgs = []
+    if ttl:
+        cmsgs.append((level, socket.IPV6_HOPLIMIT if v6 else socket.IP_TTL, struct.pack('i', ttl)))
+    if tos is not None:
+        cmsgs.append((level, socket.IPV6_TCLASS if v6 else socket.IP_TOS, struct.pack('i', tos)))
+    return cmsgs
+
+
+# Linux values; the socket module does not export them.
+IPV6_FREEBIND = getattr(socket, 'IPV6_FREEBIND', 78)
+IP_PKTINFO = getattr(socket, 'IP_PKTINFO', 8)
+PKTINFO_SPACE = socket.CMSG_SPACE(20)
+
+
+def is_link_local(addr):
+    """True if the peer address tuple addr is IPv6 link-local (fe80::/10)."""
+    try:
+        return ipaddress.IPv6Address(addr[0].split('%', 1)[0]).is_link_local
+    except (ValueError, IndexError, AttributeError):
+        return False
+
+
+def same_64(address, interface_id):
+    """address with its interface identifier (low 64 bits) replaced by that of interface_id."""
+    prefix = int(ipaddress.IPv6Address(address.split('%', 1)[0])) >> 64 << 64
+    return str(ipaddress.IPv6Address(prefix | int(ipaddress.IPv6Address(interface_id)) & (1 << 64) - 1))
+
+
+def enable_pktinfo(sock):
+    """Make an IPv6 UDP socket report each datagram's destination and send from addresses it does not own."""
+    for name, option in (('IPV6_RECVPKTINFO', socket.IPV6_RECVPKTINFO), ('IPV6_FREEBIND', IPV6_FREEBIND)):
+        try:
+            sock.setsockopt(socket.IPPROTO_IPV6, option, 1)
+        except OSError as e:
+            logger.warning(f'Setting {name} failed: {e}')
+
+
+def enable_broadcast_info(sock):
+    """Make an IPv4 UDP socket report each datagram's destination, so broadcasts can be told apart."""
+    try:
+        sock.setsockopt(socket.IPPROTO_IP, IP_PKTINFO, 1)
+    except OSError as e:
+        logger.warning(f'Setting IP_PKTINFO failed: {e}')
+
+
+def broadcast_info(ancdata):
+    """(broadcast address, local interface address) of a datagram received with enable_broadcast_info(),
+    or None if it was not a broadcast.
+
+    The kernel reports the header destination and the receiving interface's address; they differ for
+    255.255.255.255 and subnet broadcasts (and multicast, which is not counted). Datagrams queued before
+    the option was set carry no interface address and only count when sent to 255.255.255.255.
+    """
+    for level, kind, data in ancdata:
+        if level == socket.IPPROTO_IP and kind == IP_PKTINFO and len(data) >= 12:
+            local, destination = socket.inet_ntoa(data[4:8]), socket.inet_ntoa(data[8:12])
+            if local == '0.0.0.0' and destination != '255.255.255.255':
+                return None
+            if destination != local and not ipaddress.IPv4Address(destination).is_multicast:
+                return destination, local
+    return None
+
+
+def pktinfo_address(ancdata):
+    """The destination address in recvmsg() ancillary data of a socket with enable_pktinfo(), or None."""
+    for level, kind, data in ancdata:
+        if level == socket.IPPROTO_IPV6 and kind == socket.IPV6_PKTINFO and len(data) >= 16:
+            return socket.inet_ntop(socket.AF_INET6, data[:16])
+    return None
+
+
+def source_cmsg(address):
+    """sendmsg() ancillary data sending one datagram from the IPv6 address."""
+    return socket.IPPROTO_IPV6, socket.IPV6_PKTINFO, socket.inet_pton(socket.AF_INET6, address) + struct.pack('I', 0)
+
+
+def multicast_interface(interface):
+    """(ifindex, IPv4 address) selecting interface, given by name or IPv4 address; '' lets the kernel pick."""
+    if not interface:
+        return 0, '0.0.0.0'
+    try:
+        return 0, str(ipaddress.IPv4Address(interface))
+    except ValueError:
+        return socket.if_nametoindex(interface), '0.0.0.0'
+
+
+def join_multicast(sock, groups, interface=''):
+    """Join the IPv4 and IPv6 multicast groups on sock, logging rather than raising failures.
+
+    IPv6 groups need the interface by name (or the kernel's choice).
+    """
+    try:
+        index, address = multicast_interface(interface)
+    except OSError as e:
+        logger.warning(f'Multicast interface {interface!r} not found: {e}')
+        return
+    for group in groups:
+        if ':' in group:
+            level, option = socket.IPPROTO_IPV6, socket.IPV6_JOIN_GROUP
+            mreq = socket.inet_pton(socket.AF_INET6, group) + struct.pack('@I', index)
+        else:
+            level, option = socket.IPPROTO_IP, socket.IP_ADD_MEMBERSHIP
+            mreq = socket.inet_aton(group) + socket.inet_aton(address) + struct.pack('@i', index)
+        try:
+            sock.setsockopt(level, option, mreq)
+            logger.info(f'Joined multicast group {group}' + (f' on {interface}' if interface else ''))
+        except OSError as e:
+            logger.warning(f'Joining multicast group {group} failed: {e}')
+
+
+def _bind(sock, proto, host, port):
+    """Bind sock, explaining how to get a privileged port when that is what failed."""
+    try:
+        sock.bind((host, port))
+    except PermissionError as e:
+        sock.close()
+        if privbind.can_bind(port):
+            raise
+        raise PermissionError(e.errno, privbind.guidance(proto, port)) from None
+
+
+def listen_tcp(bind, port, backlog=128):
+    """A listening TCP socket: one inherited from the privbind helper, else newly bound."""
+    family, host = split_bind(bind)
+    sock = privbind.take('tcp', host, port)
+    if sock is not None:
+        return sock
+    sock = socket.socket(family, socket.SOCK_STREAM)
+    sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+    _bind(sock, 'tcp', host, port)
+    sock.listen(backlog)
+    return sock
+
+
+def bind_udp(bind, port):
+    family, host = split_bind(bind)
+    sock = privbind.take('udp', host, port)
+    if sock is not None:
+        return sock
+    sock = socket.socket(family, socket.SOCK_DGRAM)
+    sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+    _bind(sock, 'udp', host, port)
+    return sock
+
+
+def listen_unix(path, backlog=128):
+    """Listen on a Unix domain socket, replacing a stale socket file left behind."""
+    try:
+        if stat.S_ISSOCK(os.stat(path).st_mode):
+            os.unlink(path)
+    except FileNotFoundError:
+        pass
+    sock = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+    sock.bind(path)
+    sock.listen(backlog)
+    return sock
+
+
+def remove_unix(path):
+    try:
+        os.unlink(path)
+    except FileNotFoundError:
+        pass
+
+
+OVER_LIMIT_MODES = ('refuse', 'queue', 'banner')
+
+
+class ConnectionLimit:
+    """Caps concurrent connections of one listener.
+
+    When max_connections is reached, 'refuse' closes new connections right
+    after accept, 'banner' first writes banner to them, and 'queue' stops
+    accepting so clients wait in the listen backlog until a slot frees.
+    """
+
+    def __init__(self, max_connections=0, mode='refuse', banner=b''):
+        if mode not in OVER_LIMIT_MODES:
+            raise ValueError(f'unknown over-limit mode: {mode!r}')
+        self.max_connections = max_connections
+        self.mode = mode
+        self.banner = banner
+        self.active = 0
+        self._cond = threading.Condition()
+
+    def wait_slot(self, stop_event, poll=1.0):
+        """In queue mode block until a slot is free; False if stop_event was set first."""
+        if self.mode != 'queue' or not self.max_connections:
+            return True
+        with self._cond:
+            while self.active >= self.max_connections:
+                if stop_event.is_set():
+                    return False
+                self._cond.wait(poll)
+        return True
+
+    def admit(self, conn, addr):
+        """Count conn as active, or reject and close it; returns False if rejected."""
+        with self._cond:
+            if not self.max_connections or self.active < self.max_connections:
+                self.active += 1
+                return True
+        logger.info(f'Connection from {addr} rejected: {self.max_connections} connections active ({self.mode})')
+        try:
+            if self.mode == 'banner' and self.banner:
+                conn.sendall(self.banner)
+        except OSError:
+            pass
+        finally:
+            conn.close()
+        return False
+
+    def release(self):
+        with self._cond:
+            self.active -= 1
+            self._cond.notify_all()
+
+
+class WorkerPool:
+    """Runs connection handlers on at most size threads (0: one thread per connection).
+
+    With every worker busy, accepted connections wait unread in a queue until
+    one frees up, like a server out of workers: the client's connect succeeds
+    but nothing answers.
+    """
+
+    # Each handler run gets a number, kept on the worker thread as task while it runs, so a
+    # connection opened in it (stats.ConnectionInfo) can tell when the worker has moved on.
+    _tasks = itertools.count(1)
+
+    def __init__(self, size=0, name='server'):
+        self.size = size
+        self.name = name
+        self._queue = queue.Queue()
+        self._lock = threading.Lock()
+        self._threads = 0
+        self._idle = 0
+
+    @property
+    def waiting(self):
+        return self._queue.qsize()
+
+    def submit(self, fn, *args):
+        if not self.size:
+            threading.Thread(target=fn, args=args, daemon=True).start()
+            return
+        with self._lock:
+            if self._idle <= 0 and self._threads < self.size:
+                self._threads += 1
+                self._idle += 1
+                threading.Thread(target=self._work, daemon=True).start()
+            elif self._idle <= 0:
+                logger.info(f'{self.name}: all {self.size} workers busy, connection queued '
+                            f'({self._queue.qsize() + 1} waiting)')
+            self._idle -= 1
+        self._queue.put((fn, args))
+
+    def _work(self):
+        while True:
+            fn, args = self._queue.get()
+            threading.current_thread().task = next(self._tasks)
+            try:
+                fn(*args)
+            except Exception as e:
+                logger.warning(f'{self.name}: connection handler failed: {e}')
+            finally:
+                with self._lock:
+                    self._idle += 1
+
+
+class AcceptPacer:
+    """Slows a listener down like an overloaded server.
+
+    accept_delay is waited in the accept loop after every accept, so later
+    connections back up in the listen queue; accept_rate caps accepts per
+    second the same way; handshake_rate caps TLS handshakes per second, also
+    when they run in the connections' own threads.
+    """
+
+    def __init__(self, accept_delay=0.0, handshake_rate=0.0, clock=None, accept_rate=0.0):
+        self.accept_delay = accept_delay
+        self.accept_rate = accept_rate
+        self.clock = clock_module.get(clock)
+        self._handshakes = TokenBucket(handshake_rate, burst=1, clock=self.clock) if handshake_rate > 0 else None
+        self._handshake_lock = threading.Lock()
+        self._last_accept = None
+
+    def before_accept(self, stop_event):
+        """With accept_rate, wait until the next accept is due; False if stop_event was set first."""
+        if self.accept_rate > 0 and self._last_accept is not None:
+            wait = self._last_accept + 1.0 / self.accept_rate - self.clock.monotonic()
+            if wait > 0 and self.clock.wait(stop_event, wait):
+                return False
+        return True
+
+    def after_accept(self, stop_event):
+        if self.accept_rate > 0:
+            self._last_accept = self.clock.monotonic()
+        if self.accept_delay > 0:
+            self.clock.wait(stop_event, self.accept_delay)
+
+    def before_handshake(self):
+        if self._handshakes:
+            with self._handshake_lock:
+                self._handshakes.consume(1)
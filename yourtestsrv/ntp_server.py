@@ -0,0 +1,112 @@
+"""SNTP (RFC 4330 / RFC 5905) server with a controllable clock.
+
+The responder plugs into UDPServer as its handler and answers client
+(mode 3) requests with the server time shifted to test device clock sync:
+
+  offset   added to every timestamp sent ("-90s", "+2h"; 0 is accurate time)
+  drift    parts per million the offset grows by while the server runs
+  jitter   each reply is off by a further random amount up to this either way
+  flap     the offset is applied only every other flap period, so the source
+           keeps stepping between right and wrong time
+  stratum  1 (primary) to 15; 16 or 0 claim to be unsynchronized
+  leap     leap indicator: 0 none, 1 / 2 last minute of the day has 61 / 59
+           seconds, 3 alarm (clock not synchronized)
+  refid    reference id, 4 ASCII characters ("GPS", "LOCL", ...)
+
+The server time itself comes from the clock (clock.py), so a virtual clock
+moves it as well.
+"""
+
+import logging
+import random
+import struct
+
+from yourtestsrv import clock as clock_module
+from yourtestsrv import logthrottle
+
+logger = logging.getLogger(__name__)
+
+PACKET_SIZE = 48
+# Seconds from the NTP era (1900-01-01) to the Unix epoch.
+NTP_EPOCH = 2208988800
+MODE_CLIENT = 3
+MODE_SERVER = 4
+# 2^-20 s, about a microsecond.
+PRECISION = -20
+
+
+def to_ntp(t):
+    """Unix time t as a 64-bit NTP timestamp."""
+    t += NTP_EPOCH
+    seconds = int(t)
+    return (seconds & 0xFFFFFFFF) << 32 | int((t - seconds) * (1 << 32)) & 0xFFFFFFFF
+
+
+def from_ntp(value):
+    """A 64-bit NTP timestamp as Unix time."""
+    return (value >> 32) + (value & 0xFFFFFFFF) / (1 << 32) - NTP_EPOCH
+
+
+def parse_packet(data):
+    """The fields of an NTP packet as a dict; raises ValueError."""
+    if len(data) < PACKET_SIZE:
+        raise ValueError(f'ntp: packet of {len(data)} bytes')
+    first, stratum, poll, precision, root_delay, root_dispersion, refid, reference, originate, receive, transmit = \
+        struct.unpack_from('>BBbbII4sQQQQ', data)
+    return {'leap': first >> 6, 'version': first >> 3 & 0x07, 'mode': first & 0x07, 'stratum': stratum,
+            'poll': poll, 'precision': precision, 'root_delay': root_delay, 'root_dispersion': root_dispersion,
+            'refid': refid, 'reference': reference, 'originate': originate, 'receive': receive,
+            'transmit': transmit}
+
+
+class NTPResponder:
+    def __init__(self, offset=0.0, drift=0.0, jitter=0.0, flap=0.0, stratum=2, leap=0, refid='LOCL', clock=None):
+        if not 0 <= stratum <= 16:
+            raise ValueError(f'ntp stratum must be between 0 and 16: {stratum}')
+        if leap not in (0, 1, 2, 3):
+            raise ValueError(f'ntp leap indicator must be 0 to 3: {leap}')
+        if len(refid.encode('ascii')) > 4:
+            raise ValueError(f'ntp refid must be at most 4 ASCII characters: {refid!r}')
+        self.offset = offset
+        self.drift = drift
+        self.jitter = jitter
+        self.flap = flap
+        self.stratum = stratum
+        self.leap = leap
+        self.refid = refid.encode('ascii').ljust(4, b'\x00')
+        self.clock = clock_module.get(clock)
+        self.started = self.clock.monotonic()
+
+    def current_offset(self):
+        """The offset applied right now: drift and flapping included, jitter not."""
+        elapsed = self.clock.monotonic() - self.started
+        if self.flap > 0 and int(elapsed // self.flap) % 2:
+            return 0.0
+        return self.offset + elapsed * self.drift / 1e6
+
+    def respond(self, addr, data):
+        """Return the reply to an NTP client request from addr, or None to ignore it."""
+        received = self.clock.time()
+        try:
+            request = parse_packet(data)
+        except ValueError as e:
+            logger.debug(f'NTP ignored datagram from {addr}: {e}')
+            return None
+        if request['mode'] != MODE_CLIENT or not 1 <= request['version'] <= 4:
+            logger.debug(f'NTP ignored mode {request["mode"]} version {request["version"]} packet from {addr}')
+            return None
+        offset = self.current_offset()
+        if self.jitter > 0:
+            offset += random.uniform(-self.jitter, self.jitter)
+        logger.info(f'NTP request from {addr}, answering with offset {offset:+.3f}s',
+                    extra=logthrottle.event('ntp.request'))
+        first = self.leap << 6 | request['version'] << 3 | MODE_SERVER
+        # Root delay 0 and a root dispersion of about 1 ms, in 16.16 fixed point seconds.
+        header = struct.pack('>BBbbII4s', first, self.stratum, request['poll'], PRECISION, 0, 0x0041, self.refid)
+        now = self.clock.time()
+        # The reference timestamp claims the last synchronisation 16 s ago.
+        return header + struct.pack('>QQQQ', to_ntp(now + offset - 16), request['transmit'],
+                                    to_ntp(received + offset), to_ntp(now + offset))
+
+    def handle_udp(self, addr, data):
+        return self.respond(addr, data)
@@ -0,0 +1,369 @@
+"""NTRIP caster mock: RTCM3 correction streams for GNSS receivers, with interruptions.
+
+Runs as a TCPServer handler. Speaks NTRIP 1.0 (ICY 200 OK, raw stream) and
+NTRIP 2.0 (HTTP/1.1, chunked) depending on the client's Ntrip-Version header.
+GET / returns the sourcetable; GET /<mountpoint> streams that mountpoint.
+
+A mountpoint either replays a captured RTCM3 file (one epoch per interval,
+looping) or synthesizes frames with valid framing and CRC: 1005/1006 carry the
+configured position as the reference station ARP, MSM messages (1071-1137)
+carry a header with the current epoch and no satellites, anything else a
+short zero body. That keeps decoders and watchdogs busy but gives no fix;
+replay a capture for that.
+
+Per-mountpoint interruption scenarios:
+
+  disconnect_after  close the stream after this long
+  stall_after       stop sending after this long, keeping the connection open
+  outage_every      every this long, the last outage_for of the period sends nothing
+  outage_for
+  corrupt_rate      fraction of frames sent with a broken CRC
+  require_gga       send nothing until the client reported its position (VRS style)
+"""
+
+import base64
+import binascii
+import logging
+import math
+import random
+import socket
+import struct
+import threading
+
+from yourtestsrv import clock as clock_module
+from yourtestsrv.config import parse_duration
+
+logger = logging.getLogger(__name__)
+
+PREAMBLE = 0xD3
+MAX_REQUEST = 8192
+DEFAULT_MESSAGES = (1005, 1077, 1087, 1097, 1127)
+# WGS84 ellipsoid.
+WGS84_A = 6378137.0
+WGS84_E2 = 6.69437999014e-3
+
+
+def crc24q(data):
+    crc = 0
+    for byte in data:
+        crc ^= byte << 16
+        for _ in range(8):
+            crc <<= 1
+            if crc & 0x1000000:
+                crc ^= 0x1864CFB
+    return crc & 0xFFFFFF
+
+
+def frame(payload):
+    """Wrap a message body in RTCM3 framing: preamble, 10-bit length, body, CRC-24Q."""
+    head = struct.pack('>BH', PREAMBLE, len(payload) & 0x3FF) + payload
+    return head + crc24q(head).to_bytes(3, 'big')
+
+
+def message_number(data):
+    """The message number of a framed RTCM3 message."""
+    return (data[3] << 4) | (data[4] >> 4)
+
+
+def split_frames(data):
+    """Split a captured byte stream into RTCM3 frames, skipping anything between them."""
+    frames = []
+    pos = 0
+    while pos + 6 <= len(data):
+        if data[pos] != PREAMBLE:
+            pos += 1
+            continue
+        length = struct.unpack('>H', data[pos + 1:pos + 3])[0] & 0x3FF
+        end = pos + 3 + length + 3
+        if end <= len(data) and crc24q(data[pos:end - 3]) == int.from_bytes(data[end - 3:end], 'big'):
+            frames.append(data[pos:end])
+            pos = end
+        else:
+            pos += 1
+    return frames
+
+
+def is_msm(number):
+    return 1071 <= number <= 1137 and 1 <= number % 10 <= 7
+
+
+def group_epochs(frames):
+    """Group frames into epochs: an epoch ends with an MSM whose multiple-message bit is clear.
+
+    Without any MSM in the capture every frame is an epoch of its own.
+    """
+    if not any(is_msm(message_number(f)) for f in frames):
+        return list(frames)
+    epochs, current = [], []
+    for data in frames:
+        current.append(data)
+        # Multiple message bit: after message number (12), station (12) and epoch time (30).
+        if is_msm(message_number(data)) and not (data[9] >> 1) & 1:
+            epochs.append(b''.join(current))
+            current = []
+    if current:
+        epochs.append(b''.join(current))
+    return epochs
+
+
+class BitWriter:
+    def __init__(self):
+        self.value = 0
+        self.bits = 0
+
+    def put(self, value, bits):
+        self.value = (self.value << bits) | (value & ((1 << bits) - 1))
+        self.bits += bits
+
+    def bytes(self):
+        pad = -self.bits % 8
+        return (self.value << pad).to_bytes((self.bits + pad) // 8, 'big')
+
+
+def ecef(latitude, longitude, height):
+    lat, lon = math.radians(latitude), math.radians(longitude)
+    n = WGS84_A / math.sqrt(1 - WGS84_E2 * math.sin(lat) ** 2)
+    return ((n + height) * math.cos(lat) * math.cos(lon), (n + height) * math.cos(lat) * math.sin(lon),
+            (n * (1 - WGS84_E2) + height) * math.sin(lat))
+
+
+class Mountpoint:
+    def __init__(self, name, identifier='', format='RTCM 3.2', messages=None, interval='1s', latitude=0.0,
+                 longitude=0.0, height=0.0, station_id=0, file='', auth=None, require_gga=False,
+                 disconnect_after='0s', stall_after='0s', outage_every='0s', outage_for='0s', corrupt_rate=0.0):
+        if not name or '/' in name:
+            raise ValueError(f'invalid ntrip mountpoint name: {name!r}')
+        if auth and ':' not in auth:
+            raise ValueError('ntrip auth must be user:password')
+        self.name = name
+        self.identifier = identifier or name
+        self.format = format
+        self.messages = list(messages or DEFAULT_MESSAGES)
+        self.interval = parse_duration(interval)
+        if self.interval <= 0:
+            raise ValueError(f'ntrip mountpoint {name} interval must be positive')
+        self.latitude = latitude
+        self.longitude = longitude
+        self.height = height
+        self.station_id = station_id
+        self.file = file
+        self.epochs = None
+        if file:
+            with open(file, 'rb') as f:
+                self.epochs = group_epochs(split_frames(f.read()))
+            if not self.epochs:
+                raise ValueError(f'no RTCM3 frames in {file}')
+        # None: the caster-wide credentials apply; '' makes the mountpoint open.
+        self.auth = auth
+        self.require_gga = require_gga
+        self.disconnect_after = parse_duration(disconnect_after)
+        self.stall_after = parse_duration(stall_after)
+        self.outage_every = parse_duration(outage_every)
+        self.outage_for = parse_duration(outage_for)
+        if self.outage_for and not 0 < self.outage_for < self.outage_every:
+            raise ValueError(f'ntrip mountpoint {name} outage_for must be shorter than outage_every')
+        self.corrupt_rate = corrupt_rate
+
+    def source_entry(self, default_auth=''):
+        details = ','.join(str(n) for n in self.messages) if self.epochs is None else 'replay'
+        systems = '+'.join(name for prefix, name in ((107, 'GPS'), (108, 'GLO'), (109, 'GAL'), (112, 'BDS'))
+                           if any(n // 10 == prefix for n in self.messages)) or 'GPS'
+        return (f'STR;{self.name};{self.identifier};{self.format};{details};2;{systems};yourtestsrv;XXX;'
+                f'{self.latitude:.2f};{self.longitude:.2f};{1 if self.require_gga else 0};0;yourtestsrv;none;'
+                f'{"B" if (default_auth if self.auth is None else self.auth) else "N"};N;9600;')
+
+    def in_outage(self, elapsed):
+        return bool(self.outage_for) and elapsed % self.outage_every >= self.outage_every - self.outage_for
+
+    def epoch(self, index, now):
+        """The frames to send for epoch number index at wall-clock time now."""
+        if self.epochs is not None:
+            return self.epochs[index % len(self.epochs)]
+        last_msm = max((i for i, n in enumerate(self.messages) if is_msm(n)), default=-1)
+        return b''.join(frame(self._message(n, now, i < last_msm)) for i, n in enumerate(self.messages))
+
+    def _message(self, number, now, more=False):
+        w = BitWriter()
+        w.put(number, 12)
+        w.put(self.station_id, 12)
+        if number in (1005, 1006):
+            x, y, z = ecef(self.latitude, self.longitude, self.height)
+            w.put(0, 6)
+            w.put(0b1110, 4)
+            w.put(round(x * 10000), 38)
+            w.put(0, 2)
+            w.put(round(y * 10000), 38)
+            w.put(0, 2)
+            w.put(round(z * 10000), 38)
+            if number == 1006:
+                w.put(0, 16)
+        elif is_msm(number):
+            # GPS time of week in ms (leap seconds ignored), no satellites or signals.
+            w.put(int((now - 315964800) * 1000) % (7 * 86400 * 1000), 30)
+            # Multiple message bit: set on all but the epoch's last MSM.
+            w.put(int(more), 1)
+            w.put(0, 3 + 7 + 2 + 2 + 1 + 3 + 64 + 32)
+        else:
+            w.put(0, 64)
+        return w.bytes()
+
+
+class NTRIPCaster:
+    def __init__(self, mountpoints=None, auth='', clock=None):
+        self.mountpoints = {m.name: m for m in (mountpoints or [Mountpoint('RTCM3')])}
+        self.auth = auth
+        self.clock = clock_module.get(clock)
+
+    def sourcetable(self):
+        lines = [m.source_entry(self.auth) for m in self.mountpoints.values()]
+        return ('\r\n'.join(lines + ['ENDSOURCETABLE']) + '\r\n').encode()
+
+    def handle(self, conn, addr):
+        """TCPServer handler: answer one NTRIP request, streaming until the client leaves or a scenario ends it."""
+        conn.settimeout(30.0)
+        try:
+            request = self._read_request(conn)
+        except (OSError, ValueError) as e:
+            logger.info(f'NTRIP request from {addr} failed: {e}')
+            return
+        if request is None:
+            return
+        method, path, headers = request
+        v2 = 'ntrip/2.0' in headers.get('ntrip-version', '').lower()
+        name = path.split('?')[0].lstrip('/')
+        if method != 'GET':
+            self._reply(conn, v2, '405 Method Not Allowed')
+            return
+        mount = self.mountpoints.get(name)
+        if mount is None:
+            if name:
+                logger.info(f'NTRIP unknown mountpoint {name!r} from {addr}')
+            if name and v2:
+                self._reply(conn, v2, '404 Not Found')
+                return
+            self._send_sourcetable(conn, v2)
+            return
+        credentials = self.auth if mount.auth is None else mount.auth
+        if credentials and self._credentials(headers) != credentials:
+            logger.info(f'NTRIP mountpoint {name} from {addr}: bad or missing credentials')
+            self._reply(conn, v2, '401 Unauthorized', f'WWW-Authenticate: Basic realm="/{name}"\r\n')
+            return
+        logger.info(f'NTRIP stream {name} to {addr} (NTRIP {"2.0" if v2 else "1.0"}, '
+                    f'agent {headers.get("user-agent", "unknown")!r})')
+        if v2:
+            conn.sendall(b'HTTP/1.1 200 OK\r\nNtrip-Version: Ntrip/2.0\r\nServer: yourtestsrv\r\n'
+                         b'Content-Type: gnss/data\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n')
+        else:
+            conn.sendall(b'ICY 200 OK\r\n\r\n')
+        conn.settimeout(None)
+        try:
+            self._stream(conn, addr, mount, v2)
+        except OSError as e:
+            logger.info(f'NTRIP stream {name} to {addr} ended: {e}')
+        finally:
+            # Wake the thread reading the client's NMEA so the connection can close.
+            try:
+                conn.shutdown(socket.SHUT_RDWR)
+            except OSError:
+                pass
+
+    @staticmethod
+    def _read_request(conn):
+        data = b''
+        while b'\r\n\r\n' not in data:
+            chunk = conn.recv(1024)
+            if not chunk:
+                return None
+            data += chunk
+            if len(data) > MAX_REQUEST:
+                raise ValueError('request too large')
+        head = data.split(b'\r\n\r\n', 1)[0].decode('latin-1').split('\r\n')
+        parts = head[0].split()
+        if len(parts) < 2:
+            raise ValueError(f'bad request line {head[0]!r}')
+        headers = {}
+        for line in head[1:]:
+            key, sep, value = line.partition(':')
+            if sep:
+                headers[key.strip().lower()] = value.strip()
+        return parts[0], parts[1], headers
+
+    @staticmethod
+    def _credentials(headers):
+        scheme, _, token = headers.get('authorization', '').partition(' ')
+        if scheme.lower() != 'basic':
+            return None
+        try:
+            return base64.b64decode(token.strip()).decode('latin-1')
+        except (binascii.Error, ValueError):
+            return None
+
+    @staticmethod
+    def _reply(conn, v2, status, extra=''):
+        body = status.encode()
+        conn.sendall(f'HTTP/{"1.1" if v2 else "1.0"} {status}\r\n{extra}Content-Type: text/plain\r\n'
+                     f'Content-Length: {len(body)}\r\nConnection: close\r\n\r\n'.encode() + body)
+
+    def _send_sourcetable(self, conn, v2):
+        table = self.sourcetable()
+        if v2:
+            head = 'HTTP/1.1 200 OK\r\nNtrip-Version: Ntrip/2.0\r\nContent-Type: gnss/sourcetable\r\n'
+        else:
+            head = 'SOURCETABLE 200 OK\r\nContent-Type: text/plain\r\n'
+        conn.sendall(f'{head}Server: yourtestsrv\r\nContent-Length: {len(table)}\r\nConnection: close\r\n\r\n'
+                     .encode() + table)
+
+    def _read_upstream(self, conn, addr, gga, closed):
+        """Collect the client's NMEA position reports until it closes the connection."""
+        buf = b''
+        try:
+            while True:
+                data = conn.recv(4096)
+                if not data:
+                    break
+                buf += data
+                *lines, buf = buf.split(b'\n')
+                for line in lines:
+                    line = line.strip().decode('latin-1')
+                    if line[3:6] == 'GGA':
+                        if not gga.is_set():
+                            logger.info(f'NTRIP position from {addr}: {line}')
+                        gga.set()
+                buf = buf[-MAX_REQUEST:]
+        except OSError:
+            pass
+        finally:
+            closed.set()
+
+    def _stream(self, conn, addr, mount, v2):
+        gga, closed = threading.Event(), threading.Event()
+        threading.Thread(target=self._read_upstream, args=(conn, addr, gga, closed), daemon=True).start()
+        start = self.clock.monotonic()
+        index = 0
+        while not closed.is_set():
+            elapsed = self.clock.monotonic() - start
+            if mount.disconnect_after and elapsed >= mount.disconnect_after:
+                logger.info(f'NTRIP stream {mount.name} to {addr} closed by scenario after {elapsed:.1f}s')
+                return
+            if mount.stall_after and elapsed >= mount.stall_after:
+                logger.info(f'NTRIP stream {mount.name} to {addr} stalled by scenario after {elapsed:.1f}s')
+                closed.wait()
+                return
+            if (gga.is_set() or not mount.require_gga) and not mount.in_outage(elapsed):
+                data = self._corrupt(mount, mount.epoch(index, self.clock.time()))
+                index += 1
+                conn.sendall(b'%x\r\n%s\r\n' % (len(data), data) if v2 else data)
+            self.clock.sleep(mount.interval)
+        logger.info(f'NTRIP stream {mount.name} to {addr} closed by client')
+
+    @staticmethod
+    def _corrupt(mount, data):
+        if mount.corrupt_rate <= 0:
+            return data
+        frames = split_frames(data)
+        out = bytearray()
+        for f in frames:
+            if random.random() < mount.corrupt_rate:
+                f = f[:-1] + bytes([f[-1] ^ 0xFF])
+            out += f
+        return bytes(out)
@@ -0,0 +1,54 @@
+"""TCP and UDP echo on the same port number, run as one logical service.
+
+For device protocols that fall back from UDP to TCP on the same port: both
+listeners share one stats object (registered as paired:<port>) and one
+fault configuration, so a scenario such as "UDP lossy, TCP slow" is set up
+and observed in a single place.
+"""
+
+import threading
+
+from yourtestsrv import netutil, stats
+from yourtestsrv.tcp_server import TCPServer
+from yourtestsrv.udp_server import UDPServer
+
+# Faults shared by both transports; drop_rate only applies to UDP datagrams.
+FAULTS = ('delay', 'drop_rate', 'corrupt_rate')
+
+
+class PairedEchoService:
+    def __init__(self, port, bind='0.0.0.0', delay=0.0, drop_rate=0.0, corrupt_rate=0.0, clock=None):
+        self.port = port
+        self.bind = bind or '0.0.0.0'
+        self.stats = stats.ServerStats()
+        self.tcp = TCPServer(port, self.bind, clock=clock)
+        self.udp = UDPServer(port, self.bind, clock=clock)
+        for srv in (self.tcp, self.udp):
+            srv.stats = self.stats
+            srv.stats_name = 'paired'
+        self.configure(delay=delay, drop_rate=drop_rate, corrupt_rate=corrupt_rate)
+
+    def configure(self, **faults):
+        """Change faults on both transports at once; unknown names raise ValueError."""
+        unknown = set(faults) - set(FAULTS)
+        if unknown:
+            raise ValueError(f'unknown paired faults: {sorted(unknown)}')
+        for name, value in faults.items():
+            setattr(self.udp, name, value)
+            if name != 'drop_rate':
+                setattr(self.tcp, name, value)
+
+    def listen_and_serve(self, stop_event):
+        tcp_sock = netutil.listen_tcp(self.bind, self.port)
+        try:
+            udp_sock = netutil.bind_udp(self.bind, tcp_sock.getsockname()[1])
+        except OSError:
+            tcp_sock.close()
+            raise
+        self.serve(stop_event, tcp_sock, udp_sock)
+
+    def serve(self, stop_event, tcp_sock, udp_sock):
+        """Serve on a listening TCP socket and a UDP socket bound to the same port."""
+        self.port = tcp_sock.getsockname()[1]
+        threading.Thread(target=self.tcp.serve, args=(stop_event, tcp_sock), daemon=True).start()
+        self.udp.serve_udp(stop_event, udp_sock)
@@ -0,0 +1,137 @@
+"""Config-driven payload generators.
+
+A generator spec is a dict with a "type" key:
+
+  {"type": "pattern", "pattern": "abc", "size": 64}       repeated text
+  {"type": "pattern", "pattern_hex": "a55a", "size": 64}  repeated bytes
+  {"type": "random", "size": 32}                           random bytes
+  {"type": "counter", "start": 0, "width": 4}              big-endian counter
+  {"type": "counter", "start": 0, "format": "text"}        decimal counter
+  {"type": "json", "template": "{\"seq\": ${counter}}"}    JSON template
+  {"type": "capture", "file": "x.pcap", "filter": {...}}   captured payloads in turn
+
+JSON templates support ${counter}, ${timestamp}, ${timestamp_ms}, ${uuid},
+${random:MIN:MAX} (integer) and ${random_float:MIN:MAX}. Callers may pass
+extra variables to next(), e.g. ${remote} for the TCP connect banner.
+"""
+
+import itertools
+import os
+import random
+import re
+import threading
+import time
+import uuid
+
+from yourtestsrv import capture
+
+_VAR_PATTERN = re.compile(r'\$\{(\w+)((?::[^:}]+)*)\}')
+
+
+class PatternGenerator:
+    def __init__(self, pattern=None, pattern_hex=None, size=0):
+        if pattern_hex is not None:
+            self.pattern = bytes.fromhex(pattern_hex)
+        else:
+            self.pattern = (pattern or '').encode()
+        if not self.pattern:
+            raise ValueError('pattern generator requires a non-empty pattern')
+        self.size = size or len(self.pattern)
+
+    def next(self):
+        repeat = self.size // len(self.pattern) + 1
+        return (self.pattern * repeat)[:self.size]
+
+
+class RandomGenerator:
+    def __init__(self, size=16):
+        self.size = size
+
+    def next(self):
+        return os.urandom(self.size)
+
+
+class CounterGenerator:
+    def __init__(self, start=0, width=4, format='binary'):
+        if format not in ('binary', 'text'):
+            raise ValueError(f'unknown counter format: {format!r}')
+        self.width = width
+        self.format = format
+        self._counter = itertools.count(start)
+        self._lock = threading.Lock()
+
+    def next(self):
+        with self._lock:
+            value = next(self._counter)
+        if self.format == 'text':
+            return str(value).encode()
+        return (value % (1 << (8 * self.width))).to_bytes(self.width, 'big')
+
+
+class JSONTemplateGenerator:
+    def __init__(self, template, start=0):
+        self.template = template
+        self._counter = itertools.count(start)
+        self._lock = threading.Lock()
+
+    def next(self, **variables):
+        with self._lock:
+            counter = next(self._counter)
+        now = time.time()
+
+        def substitute(m):
+            name, args = m.group(1), [a for a in m.group(2).split(':') if a]
+            if name in variables:
+                return str(variables[name])
+            if name == 'counter':
+                return str(counter)
+            if name == 'timestamp':
+                return str(int(now))
+            if name == 'timestamp_ms':
+                return str(int(now * 1000))
+            if name == 'uuid':
+                return str(uuid.uuid4())
+            if name == 'random':
+                low, high = (int(a) for a in args) if args else (0, 100)
+                return str(random.randint(low, high))
+            if name == 'random_float':
+                low, high = (float(a) for a in args) if args else (0.0, 1.0)
+                return f'{random.uniform(low, high):.3f}'
+            raise ValueError(f'unknown template variable: {name!r}')
+
+        return _VAR_PATTERN.sub(substitute, self.template).encode()
+
+
+class CaptureGenerator:
+    """Replays the payloads selected from a capture file (see capture.py), cycling."""
+
+    def __init__(self, file, filter=None, join=False):
+        self.payloads = capture.extract(file, filter, join)
+        self._index = itertools.cycle(range(len(self.payloads)))
+        self._lock = threading.Lock()
+
+    def next(self):
+        with self._lock:
+            return self.payloads[next(self._index)]
+
+
+_GENERATORS = {
+    'pattern': PatternGenerator,
+    'random': RandomGenerator,
+    'counter': CounterGenerator,
+    'json': JSONTemplateGenerator,
+    'capture': CaptureGenerator,
+}
+
+
+def make_generator(spec):
+    """Build a generator from a spec dict; raises ValueError on bad specs."""
+    spec = dict(spec)
+    kind = spec.pop('type', None)
+    cls = _GENERATORS.get(kind)
+    if cls is None:
+        raise ValueError(f'unknown payload generator type: {kind!r}')
+    try:
+        return cls(**spec)
+    except TypeError as e:
+        raise ValueError(f'invalid {kind} generator spec: {e}') from None
@@ -0,0 +1,856 @@
+"""Per-topic payload validation for the MQTT broker.
+
+server.mqtt.validators (or --validators validators.json) is a list of
+entries, each an MQTT topic filter and one schema the PUBLISH payload must
+satisfy:
+
+  {"topic": "devices/+/telemetry", "json_schema": {"type": "object", "required": ["temp"]}}
+  {"topic": "devices/+/cbor", "cddl": "reading = {temp: float, ? hum: 0..100}"}
+  {"topic": "devices/+/pb", "protobuf": "telemetry.desc", "message": "iot.Telemetry", "disconnect": true}
+
+json_schema (inline, or a file with json_schema_file) checks the payload
+decoded as format (json by default, cbor or msgpack) against a JSON Schema.
+The keywords telemetry schemas use are supported: type, enum, const,
+properties, required, additionalProperties, patternProperties, items,
+prefixItems, the min/max bounds, multipleOf, pattern, allOf, anyOf, oneOf,
+not and $ref into the schema's own $defs. Other keywords are ignored.
+
+cddl (inline, or a file with cddl_file) checks a CBOR payload (format json
+also works) against the first rule of an RFC 8610 definition. Supported:
+the prelude types, literals, ranges (0..100, 0...100), type choices, maps
+with optional (?) and repeated (*, +, n*m) members and computed keys
+(tstr => int), arrays, groups and group choices (//), rule references,
+tags (#6.n(type), the tag itself is not checked) and the .size, .regexp,
+.lt/.le/.gt/.ge/.eq/.ne and .default controls.
+
+protobuf is a FileDescriptorSet as written by protoc --descriptor_set_out
+(add --include_imports for imported messages) and message the full name
+of the payload's message type, optional when the set has only one. The
+payload must parse as that message: every field number declared, with the
+wire type of its declared type (packed for repeated numbers), strings valid
+UTF-8, nested messages valid in turn and proto2 required fields present.
+Unknown fields are violations, so a device sending fields the schema does
+not know of is flagged too.
+
+The first entry whose topic filter matches applies. A violation is logged,
+counted under errors.schema in the server stats and published as a
+"violation" traffic event with the reason. The message is still delivered
+unless the entry has "disconnect": true: then it is dropped and the client
+disconnected (MQTT 5 clients first get DISCONNECT with reason 0x99,
+payload format invalid).
+"""
+
+import json
+import math
+import re
+
+from yourtestsrv import codec
+
+
+class Violation(ValueError):
+    pass
+
+
+# JSON Schema
+
+_JSON_TYPES = {'object': dict, 'array': list, 'string': str, 'boolean': bool, 'null': type(None)}
+
+
+def _is_json_type(value, name):
+    if name == 'integer':
+        return (isinstance(value, int) and not isinstance(value, bool)
+                or isinstance(value, float) and value.is_integer())
+    if name == 'number':
+        return isinstance(value, (int, float)) and not isinstance(value, bool)
+    if name not in _JSON_TYPES:
+        raise ValueError(f'unknown JSON Schema type: {name!r}')
+    return isinstance(value, _JSON_TYPES[name])
+
+
+def _json_equal(a, b):
+    if isinstance(a, bool) or isinstance(b, bool):
+        return a is b
+    return a == b
+
+
+class JSONSchemaValidator:
+    def __init__(self, schema, fmt='json'):
+        if fmt not in codec.FORMATS:
+            raise ValueError(f'unknown payload format: {fmt!r} (use one of {", ".join(codec.FORMATS)})')
+        if not isinstance(schema, (dict, bool)):
+            raise ValueError('json_schema must be an object')
+        self.schema = schema
+        self.fmt = fmt
+        self._check_refs(schema)
+
+    def check(self, data):
+        try:
+            value = codec.decode(data, self.fmt)
+        except (ValueError, UnicodeDecodeError) as e:
+            raise Violation(f'not {self.fmt}: {e}') from None
+        self._check(self.schema, value, '$')
+
+    def _check_refs(self, s):
+        if isinstance(s, dict):
+            if isinstance(s.get('$ref'), str):
+                self._resolve(s['$ref'])
+            for sub in s.values():
+                self._check_refs(sub)
+        elif isinstance(s, list):
+            for sub in s:
+                self._check_refs(sub)
+
+    def _resolve(self, ref):
+        if not ref.startswith('#'):
+            raise ValueError(f'only local $ref is supported: {ref!r}')
+        s = self.schema
+        try:
+            for part in filter(None, ref[1:].split('/')):
+                s = s[part.replace('~1', '/').replace('~0', '~')]
+        except (KeyError, TypeError):
+            raise ValueError(f'unresolvable $ref: {ref!r}') from None
+        return s
+
+    def _check(self, s, value, path):
+        if s is True:
+            return
+        if s is False:
+            raise Violation(f'{path}: no value allowed here')
+        if '$ref' in s:
+            self._check(self._resolve(s['$ref']), value, path)
+        types = s.get('type')
+        if types is not None:
+            types = [types] if isinstance(types, str) else types
+            if not any(_is_json_type(value, t) for t in types):
+                raise Violation(f'{path}: {value!r} is not of type {" or ".join(types)}')
+        if 'enum' in s and not any(_json_equal(value, v) for v in s['enum']):
+            raise Violation(f'{path}: {value!r} is not one of {s["enum"]}')
+        if 'const' in s and not _json_equal(value, s['const']):
+            raise Violation(f'{path}: {value!r} is not {s["const"]!r}')
+        if isinstance(value, (int, float)) and not isinstance(value, bool):
+            self._check_number(s, value, path)
+        elif isinstance(value, str):
+            if len(value) < s.get('minLength', 0) or len(value) > s.get('maxLength', math.inf):
+                raise Violation(f'{path}: string length {len(value)} out of bounds')
+            if 'pattern' in s and not re.search(s['pattern'], value):
+                raise Violation(f'{path}: {value!r} does not match {s["pattern"]}')
+        elif isinstance(value, dict):
+            self._check_object(s, value, path)
+        elif isinstance(value, list):
+            self._check_array(s, value, path)
+        for sub in s.get('allOf', ()):
+            self._check(sub, value, path)
+        if 'anyOf' in s and not any(self._valid(sub, value, path) for sub in s['anyOf']):
+            raise Violation(f'{path}: matches none of anyOf')
+        if 'oneOf' in s and sum(self._valid(sub, value, path) for sub in s['oneOf']) != 1:
+            raise Violation(f'{path}: does not match exactly one of oneOf')
+        if 'not' in s and self._valid(s['not'], value, path):
+            raise Violation(f'{path}: matches a schema it must not')
+
+    def _valid(self, s, value, path):
+        try:
+            self._check(s, value, path)
+        except Violation:
+            return False
+        return True
+
+    def _check_number(self, s, value, path):
+        if value < s.get('minimum', value) or value > s.get('maximum', value):
+            raise Violation(f'{path}: {value} out of range')
+        if 'exclusiveMinimum' in s and value <= s['exclusiveMinimum']:
+            raise Violation(f'{path}: {value} not above {s["exclusiveMinimum"]}')
+        if 'exclusiveMaximum' in s and value >= s['exclusiveMaximum']:
+            raise Violation(f'{path}: {value} not below {s["exclusiveMaximum"]}')
+        if 'multipleOf' in s and not (value / s['multipleOf']).is_integer():
+            raise Violation(f'{path}: {value} is not a multiple of {s["multipleOf"]}')
+
+    def _check_object(self, s, value, path):
+        for key in s.get('required', ()):
+            if key not in value:
+                raise Violation(f'{path}: missing {key!r}')
+        if len(value) < s.get('minProperties', 0) or len(value) > s.get('maxProperties', math.inf):
+            raise Violation(f'{path}: {len(value)} properties out of bounds')
+        properties = s.get('properties', {})
+        patterns = s.get('patternProperties', {})
+        for key, item in value.items():
+            key = str(key)
+            matched = False
+            if key in properties:
+                self._check(properties[key], item, f'{path}.{key}')
+                matched = True
+            for pattern, sub in patterns.items():
+                if re.search(pattern, key):
+                    self._check(sub, item, f'{path}.{key}')
+                    matched = True
+            if not matched and 'additionalProperties' in s:
+                if s['additionalProperties'] is False:
+                    raise Violation(f'{path}: unexpected property {key!r}')
+                self._check(s['additionalProperties'], item, f'{path}.{key}')
+
+    def _check_array(self, s, value, path):
+        if len(value) < s.get('minItems', 0) or len(value) > s.get('maxItems', math.inf):
+            raise Violation(f'{path}: {len(value)} items out of bounds')
+        prefix = s.get('prefixItems', [])
+        for i, (sub, item) in enumerate(zip(prefix, value)):
+            self._check(sub, item, f'{path}[{i}]')
+        if 'items' in s:
+            for i, item in enumerate(value[len(prefix):], len(prefix)):
+                self._check(s['items'], item, f'{path}[{i}]')
+        if s.get('uniqueItems'):
+            seen = [json.dumps(item, sort_keys=True, default=repr) for item in value]
+            if len(set(seen)) != len(seen):
+                raise Violation(f'{path}: items are not unique')
+
+
+# CDDL (RFC 8610)
+
+_CDDL_TOKEN = re.compile(r'''
+    (?P<space>\s+|;[^\n]*)
+  | (?P<text>"(?:[^"\\]|\\.)*")
+  | (?P<bytes>h'[0-9a-fA-F\s]*')
+  | (?P<number>-?0x[0-9a-fA-F]+|-?\d+(?:\.\d+)?(?:[eE][+-]?\d+)?)
+  | (?P<control>\.[a-z]+)
+  | (?P<op>\.\.\.|\.\.|=>|/=|//|[/{}\[\](),:?*+=#&~<>^])
+  | (?P<name>[A-Za-z@_$](?:[-.]*[A-Za-z@_$0-9])*)
+''', re.VERBOSE)
+
+_PRELUDE = ('any', 'uint', 'nint', 'int', 'integer', 'unsigned', 'number', 'float', 'float16', 'float32',
+            'float64', 'float16-32', 'float32-64', 'tstr', 'text', 'bstr', 'bytes', 'bool', 'true', 'false',
+            'nil', 'null', 'undefined', 'tdate', 'time', 'uri')
+_CONTROLS = ('.size', '.regexp', '.lt', '.le', '.gt', '.ge', '.eq', '.ne', '.default')
+_OCCURRENCE = {'?': (0, 1), '*': (0, math.inf), '+': (1, math.inf)}
+
+
+def _cddl_tokens(text):
+    tokens, pos = [], 0
+    while pos < len(text):
+        m = _CDDL_TOKEN.match(text, pos)
+        if not m:
+            raise ValueError(f'cddl: unexpected {text[pos:pos + 10]!r}')
+        pos = m.end()
+        if m.lastgroup != 'space':
+            tokens.append((m.lastgroup, m.group()))
+    return tokens
+
+
+def _cddl_literal(kind, text):
+    if kind == 'text':
+        return json.loads(text)
+    if kind == 'bytes':
+        return bytes.fromhex(text[2:-1])
+    if 'x' in text:
+        return int(text, 16)
+    return float(text) if any(c in text for c in '.eE') else int(text)
+
+
+class _CDDLParser:
+    """Recursive descent over the tokens; types and groups become small tuples.
+
+    A type is ('prim', name), ('value', v), ('ref', name), ('range', lo, hi, inclusive),
+    ('choice', [type, ...]), ('map', group), ('array', group), ('control', op, type, arg)
+    or ('tag', type). A group is a list of alternatives, each a list of entries
+    (min, max, key, item): key is None, ('bare', name) or a type; item a type or ('group', group).
+    """
+
+    def __init__(self, text):
+        self.tokens = _cddl_tokens(text)
+        self.pos = 0
+
+    def peek(self, offset=0):
+        i = self.pos + offset
+        return self.tokens[i] if i < len(self.tokens) else (None, None)
+
+    def take(self, expected=None):
+        kind, text = self.peek()
+        if kind is None or expected is not None and text != expected:
+            raise ValueError(f'cddl: expected {expected or "more input"}, got {text!r}')
+        self.pos += 1
+        return kind, text
+
+    def rules(self):
+        rules = {}
+        while self.peek()[0] is not None:
+            kind, name = self.take()
+            if kind != 'name':
+                raise ValueError(f'cddl: expected a rule name, got {name!r}')
+            assign = self.take()[1]
+            if assign not in ('=', '/='):
+                raise ValueError(f'cddl: expected = after {name}, got {assign!r}')
+            if self.peek()[1] == '(' and assign == '=':
+                self.take('(')
+                value = ('group', self.group(')'))
+                self.take(')')
+            else:
+                value = self.type()
+            if assign == '=':
+                rules[name] = value
+            elif name not in rules or rules[name][0] == 'group':
+                raise ValueError(f'cddl: /= extends undefined type {name}')
+            else:
+                rules[name] = ('choice', [rules[name], value])
+        if not rules:
+            raise ValueError('cddl: no rules')
+        return rules
+
+    def type(self):
+        choices = [self.type1()]
+        while self.peek()[1] == '/':
+            self.take()
+            choices.append(self.type1())
+        return choices[0] if len(choices) == 1 else ('choice', choices)
+
+    def type1(self):
+        t = self.type2()
+        kind, text = self.peek()
+        if text in ('..', '...'):
+            self.take()
+            return ('range', t, self.type2(), text == '..')
+        if kind == 'control':
+            if text not in _CONTROLS:
+                raise ValueError(f'cddl: unsupported control {text}')
+            self.take()
+            return ('control', text, t, self.type2())
+        return t
+
+    def type2(self):
+        kind, text = self.take()
+        if kind in ('text', 'bytes', 'number'):
+            return ('value', _cddl_literal(kind, text))
+        if kind == 'name':
+            return ('prim', text) if text in _PRELUDE else ('ref', text)
+        if text == '(':
+            t = self.type()
+            self.take(')')
+            return t
+        if text in ('{', '['):
+            close = '}' if text == '{' else ']'
+            group = self.group(close)
+            self.take(close)
+            return ('map' if text == '{' else 'array', group)
+        if text == '#':
+            if self.peek()[0] != 'number':
+                return ('prim', 'any')
+            major = self.take()[1]
+            if not major.startswith('6.'):
+                raise ValueError(f'cddl: unsupported #{major}')
+            self.take('(')
+            t = self.type()
+            self.take(')')
+            return ('tag', t)
+        raise ValueError(f'cddl: unexpected {text!r}')
+
+    def group(self, close):
+        alternatives = [[]]
+        while self.peek()[1] != close:
+            if self.peek()[1] == '//':
+                self.take()
+                alternatives.append([])
+                continue
+            alternatives[-1].append(self.entry(close))
+            if self.peek()[1] == ',':
+                self.take()
+        return alternatives
+
+    def occurrence(self):
+        kind, text = self.peek()
+        if text in _OCCURRENCE:
+            self.take()
+            return _OCCURRENCE[text]
+        if kind == 'number' and self.peek(1)[1] == '*':
+            self.take()
+            self.take()
+            hi = self.take()[1] if self.peek()[0] == 'number' else None
+            return int(text), int(hi) if hi is not None else math.inf
+        return None
+
+    def entry(self, close):
+        bounds = self.occurrence()
+        if bounds is None and self.peek()[1] == '*':
+            self.take()
+            bounds = (0, math.inf)
+        lo, hi = bounds or (1, 1)
+        if self.peek()[1] == '(':
+            self.take()
+            group = self.group(')')
+            self.take(')')
+            return lo, hi, None, ('group', group)
+        kind, text = self.peek()
+        if kind in ('name', 'text', 'number', 'bytes') and self.peek(1)[1] == ':':
+            self.take()
+            self.take()
+            key = ('bare', text) if kind == 'name' else ('value', _cddl_literal(kind, text))
+            return lo, hi, key, self.type()
+        t = self.type()
+        if self.peek()[1] == '=>':
+            self.take()
+            return lo, hi, t, self.type()
+        return lo, hi, None, t
+
+
+def _describe(t):
+    kind = t[0]
+    if kind in ('prim', 'ref'):
+        return t[1]
+    if kind == 'value':
+        return repr(t[1])
+    if kind == 'choice':
+        return ' / '.join(_describe(c) for c in t[1])
+    if kind == 'range':
+        return f'{_describe(t[1])}{".." if t[3] else "..."}{_describe(t[2])}'
+    if kind == 'control':
+        return f'{_describe(t[2])} {t[1]} {_describe(t[3])}'
+    if kind == 'tag':
+        return _describe(t[1])
+    return kind
+
+
+def _is_int(value):
+    return isinstance(value, int) and not isinstance(value, bool)
+
+
+def _prim_matches(name, value):
+    if name == 'any':
+        return True
+    if name in ('uint', 'unsigned'):
+        return _is_int(value) and value >= 0
+    if name == 'nint':
+        return _is_int(value) and value < 0
+    if name in ('int', 'integer'):
+        return _is_int(value)
+    if name.startswith('float'):
+        return isinstance(value, float)
+    if name in ('number', 'time'):
+        return _is_int(value) or isinstance(value, float)
+    if name in ('tstr', 'text', 'tdate', 'uri'):
+        return isinstance(value, str)
+    if name in ('bstr', 'bytes'):
+        return isinstance(value, (bytes, bytearray))
+    if name == 'bool':
+        return isinstance(value, bool)
+    if name in ('true', 'false'):
+        return value is (name == 'true')
+    return value is None
+
+
+class CDDLValidator:
+    def __init__(self, text, fmt='cbor', rule=''):
+        if fmt not in codec.FORMATS:
+            raise ValueError(f'unknown payload format: {fmt!r} (use one of {", ".join(codec.FORMATS)})')
+        self.rules = _CDDLParser(text).rules()
+        self.rule = rule or next(iter(self.rules))
+        if self.rule not in self.rules:
+            raise ValueError(f'cddl: no rule named {self.rule}')
+        self.fmt = fmt
+        for name, t in self.rules.items():
+            self._check_refs(t, name)
+
+    def _check_refs(self, t, rule):
+        kind = t[0]
+        if kind == 'ref' and t[1] not in self.rules:
+            raise ValueError(f'cddl: {rule} refers to undefined {t[1]}')
+        children = {'choice': lambda: t[1], 'range': lambda: t[1:3], 'control': lambda: t[2:4],
+                    'tag': lambda: [t[1]]}.get(kind)
+        if children:
+            for child in children():
+                self._check_refs(child, rule)
+        if kind in ('map', 'array', 'group'):
+            for alternative in t[1]:
+                for _, _, key, item in alternative:
+                    if key is not None and key[0] != 'bare':
+                        self._check_refs(key, rule)
+                    self._check_refs(item, rule)
+        if kind == 'map':
+            for alternative in t[1]:
+                self._flatten(alternative)
+
+    def check(self, data):
+        try:
+            value = codec.decode(data, self.fmt)
+        except (ValueError, UnicodeDecodeError) as e:
+            raise Violation(f'not {self.fmt}: {e}') from None
+        self._check(('ref', self.rule), value, '$')
+
+    def _check(self, t, value, path):
+        if not self._matches(t, value):
+            raise Violation(self._explain(t, value, path) or f'{path}: {value!r} is not {_describe(t)}')
+
+    def _explain(self, t, value, path):
+        """A precise reason for a map mismatch (missing or unexpected key), when there is one."""
+        while t[0] in ('ref', 'tag'):
+            t = self.rules[t[1]] if t[0] == 'ref' else t[1]
+        if t[0] != 'map' or not isinstance(value, dict) or len(t[1]) != 1:
+            return None
+        remaining = dict(value)
+        for lo, hi, key, item in self._flatten(t[1][0]):
+            if key is None:
+                return None
+            found = [k for k in remaining if self._key_matches(key, k)]
+            for k in found:
+                if not self._matches(item, remaining[k]):
+                    if key[0] == 'bare' or key[0] == 'value':
+                        return self._explain(item, remaining[k], f'{path}.{k}') or \
+                            f'{path}.{k}: {remaining[k]!r} is not {_describe(item)}'
+                    found = [f for f in found if f != k]
+            if len(found) < lo:
+                return f'{path}: missing {key[1] if key[0] in ("bare", "value") else _describe(key)!r}'
+            for k in found[:hi] if hi != math.inf else found:
+                del remaining[k]
+        if remaining:
+            return f'{path}: unexpected key {next(iter(remaining))!r}'
+        return None
+
+    def _matches(self, t, value):
+        kind = t[0]
+        if kind == 'prim':
+            return _prim_matches(t[1], value)
+        if kind == 'value':
+            return value == t[1] and isinstance(value, bool) == isinstance(t[1], bool)
+        if kind == 'ref':
+            rule = self.rules[t[1]]
+            if rule[0] == 'group':
+                return self._matches(('array', rule[1]), [value]) if self._single(rule[1]) else False
+            return self._matches(rule, value)
+        if kind == 'choice':
+            return any(self._matches(c, value) for c in t[1])
+        if kind == 'range':
+            lo, hi = self._literal(t[1]), self._literal(t[2])
+            if not isinstance(value, (int, float)) or isinstance(value, bool):
+                return False
+            if isinstance(lo, int) and isinstance(hi, int) and not _is_int(value):
+                return False
+            return lo <= value <= hi if t[3] else lo <= value < hi
+        if kind == 'control':
+            return self._matches(t[2], value) and self._control(t[1], value, t[3])
+        if kind == 'tag':
+            return self._matches(t[1], value)
+        if kind == 'map':
+            return isinstance(value, dict) and any(self._map_matches(alt, value) for alt in t[1])
+        if kind == 'array':
+            return isinstance(value, list) and any(len(value) in self._sequence(alt, value, 0) for alt in t[1])
+        raise ValueError(f'cddl: cannot match {kind}')
+
+    def _single(self, group):
+        return len(group) == 1 and len(group[0]) == 1 and group[0][0][:3] == (1, 1, None)
+
+    def _literal(self, t):
+        while t[0] == 'ref':
+            t = self.rules[t[1]]
+        if t[0] != 'value':
+            raise ValueError(f'cddl: range bounds must be values, got {_describe(t)}')
+        return t[1]
+
+    def _control(self, op, value, arg):
+        if op == '.default':
+            return True
+        target = self._literal(arg) if arg[0] != 'range' else None
+        if op == '.size':
+            size = len(value) if isinstance(value, (str, bytes, bytearray)) else None
+            if size is None and _is_int(value):
+                size = max(1, (value.bit_length() + 7) // 8)
+            return size is not None and (self._matches(arg, size) if target is None else size <= target)
+        if op == '.regexp':
+            return isinstance(value, str) and re.fullmatch(target, value) is not None
+        try:
+            return {'.lt': value < target, '.le': value <= target, '.gt': value > target, '.ge': value >= target,
+                    '.eq': value == target, '.ne': value != target}[op]
+        except TypeError:
+            return False
+
+    def _flatten(self, entries):
+        """Map entries with groups (inline or by rule name) expanded; only unconditional groups are inlined."""
+        flat = []
+        for lo, hi, key, item in entries:
+            if key is None and item[0] == 'ref' and self.rules[item[1]][0] == 'group':
+                item = self.rules[item[1]]
+            if key is None and item[0] == 'group':
+                if len(item[1]) != 1:
+                    raise ValueError('cddl: group choices inside maps are not supported')
+                flat += [(min(lo, e_lo), e_hi * hi if hi != math.inf else math.inf, e_key, e_item)
+                         for e_lo, e_hi, e_key, e_item in self._flatten(item[1][0])]
+            else:
+                flat.append((lo, hi, key, item))
+        return flat
+
+    def _key_matches(self, key, k):
+        if key[0] == 'bare':
+            return k == key[1]
+        if key[0] == 'value':
+            return k == key[1] and isinstance(k, bool) == isinstance(key[1], bool)
+        return self._matches(key, k)
+
+    def _map_matches(self, entries, value):
+        remaining = dict(value)
+        for lo, hi, key, item in self._flatten(entries):
+            if key is None:
+                return False
+            found = [k for k in remaining if self._key_matches(key, k) and self._matches(item, remaining[k])]
+            if len(found) < lo:
+                return False
+            for k in found if hi == math.inf else found[:hi]:
+                del remaining[k]
+        return not remaining
+
+    def _sequence(self, entries, items, start):
+        """The positions in items at which entries, matched from start, can end."""
+        ends = {start}
+        for lo, hi, _, item in entries:
+            following = set()
+            for position in ends:
+                following |= self._repeat(item, items, position, lo, hi)
+            ends = following
+            if not ends:
+                break
+        return ends
+
+    def _repeat(self, item, items, start, lo, hi):
+        ends, frontier, count = set(), {start}, 0
+        if lo == 0:
+            ends.add(start)
+        while frontier and count < hi:
+            count += 1
+            following = set()
+            for position in frontier:
+                following |= self._one(item, items, position)
+            frontier = following - ends if count >= lo else following
+            if count >= lo:
+                ends |= following
+        return ends
+
+    def _one(self, item, items, position):
+        if item[0] == 'ref' and self.rules[item[1]][0] == 'group':
+            item = self.rules[item[1]]
+        if item[0] == 'group':
+            ends = set()
+            for alternative in item[1]:
+                ends |= self._sequence(alternative, items, position)
+            return ends - {position}
+        if position < len(items) and self._matches(item, items[position]):
+            return {position + 1}
+        return set()
+
+
+# Protocol Buffers
+
+_WIRE_TYPES = {1: 1, 2: 5, 3: 0, 4: 0, 5: 0, 6: 1, 7: 5, 8: 0, 9: 2, 10: 3, 11: 2, 12: 2, 13: 0, 14: 0,
+               15: 5, 16: 1, 17: 0, 18: 0}
+_TYPE_STRING, _TYPE_MESSAGE = 9, 11
+_LABEL_REQUIRED, _LABEL_REPEATED = 2, 3
+
+
+def _varint(data, pos):
+    value = shift = 0
+    while True:
+        if pos >= len(data):
+            raise ValueError('truncated varint')
+        if shift > 63:
+            raise ValueError('varint too long')
+        b = data[pos]
+        pos += 1
+        value |= (b & 0x7F) << shift
+        shift += 7
+        if not b & 0x80:
+            return value, pos
+
+
+def protobuf_fields(data):
+    """(number, wire type, value) of each field of a serialized message; raises ValueError when malformed."""
+    fields, pos = [], 0
+    while pos < len(data):
+        key, pos = _varint(data, pos)
+        number, wire = key >> 3, key & 7
+        if number == 0:
+            raise ValueError('field number 0')
+        if wire == 0:
+            value, pos = _varint(data, pos)
+        elif wire in (1, 5):
+            size = 8 if wire == 1 else 4
+            if pos + size > len(data):
+                raise ValueError(f'truncated field {number}')
+            value, pos = data[pos:pos + size], pos + size
+        elif wire == 2:
+            size, pos = _varint(data, pos)
+            if pos + size > len(data):
+                raise ValueError(f'truncated field {number}')
+            value, pos = data[pos:pos + size], pos + size
+        else:
+            raise ValueError(f'unsupported wire type {wire} in field {number}')
+        fields.append((number, wire, value))
+    return fields
+
+
+def _text(value):
+    return bytes(value).decode('utf-8')
+
+
+def _load_descriptors(data):
+    """{full name: (fields by number, required numbers)} of the messages in a FileDescriptorSet."""
+    messages = {}
+
+    def message(body, scope):
+        name, fields, required = '', {}, set()
+        nested = []
+        for number, wire, value in protobuf_fields(body):
+            if number == 1 and wire == 2:
+                name = _text(value)
+            elif number == 2 and wire == 2:
+                field = {3: 0, 4: 1, 5: 0, 6: b''}
+                field_name = ''
+                for n, w, v in protobuf_fields(value):
+                    if n == 1:
+                        field_name = _text(v)
+                    elif n in field:
+                        field[n] = v
+                fields[field[3]] = (field_name, field[5], field[4], _text(field[6]).lstrip('.'))
+                if field[4] == _LABEL_REQUIRED:
+                    required.add(field[3])
+            elif number == 3 and wire == 2:
+                nested.append(value)
+        full = f'{scope}.{name}' if scope else name
+        messages[full] = (fields, required)
+        for body in nested:
+            message(body, full)
+
+    for number, wire, value in protobuf_fields(data):
+        if number != 1 or wire != 2:
+            continue
+        package, bodies = '', []
+        for n, w, v in protobuf_fields(value):
+            if n == 2 and w == 2:
+                package = _text(v)
+            elif n == 4 and w == 2:
+                bodies.append(v)
+        for body in bodies:
+            message(body, package)
+    return messages
+
+
+class ProtobufValidator:
+    def __init__(self, descriptor_set, message=''):
+        try:
+            self.messages = _load_descriptors(descriptor_set)
+        except (ValueError, UnicodeDecodeError) as e:
+            raise ValueError(f'bad protobuf descriptor set: {e}') from None
+        message = message.lstrip('.')
+        if not message:
+            top = [name for name in self.messages if not any(name.startswith(f'{other}.') for other in self.messages)]
+            if len(top) != 1:
+                raise ValueError(f'protobuf message required, one of {", ".join(sorted(top))}')
+            message = top[0]
+        if message not in self.messages:
+            raise ValueError(f'protobuf message {message} not in the descriptor set')
+        self.message = message
+
+    @classmethod
+    def from_file(cls, path, message=''):
+        with open(path, 'rb') as f:
+            return cls(f.read(), message)
+
+    def check(self, data):
+        self._check(self.message, data, '$')
+
+    def _check(self, message, data, path):
+        fields, required = self.messages[message]
+        try:
+            parsed = protobuf_fields(data)
+        except ValueError as e:
+            raise Violation(f'{path}: not a {message}: {e}') from None
+        seen = set()
+        for number, wire, value in parsed:
+            if number not in fields:
+                raise Violation(f'{path}: unknown field {number} in {message}')
+            name, kind, label, type_name = fields[number]
+            seen.add(number)
+            field_path = f'{path}.{name}'
+            expected = _WIRE_TYPES.get(kind)
+            if wire == 2 and label == _LABEL_REPEATED and expected in (0, 1, 5):
+                self._check_packed(value, expected, field_path)
+                continue
+            if wire != expected:
+                raise Violation(f'{field_path}: wire type {wire}, expected {expected}')
+            if kind == _TYPE_STRING:
+                try:
+                    _text(value)
+                except UnicodeDecodeError:
+                    raise Violation(f'{field_path}: invalid UTF-8') from None
+            elif kind == _TYPE_MESSAGE:
+                if type_name not in self.messages:
+                    raise Violation(f'{field_path}: message type {type_name} not in the descriptor set')
+                self._check(type_name, value, field_path)
+        missing = required - seen
+        if missing:
+            raise Violation(f'{path}: missing required {fields[min(missing)][0]} in {message}')
+
+    def _check_packed(self, data, wire, path):
+        if wire in (1, 5):
+            if len(data) % (8 if wire == 1 else 4):
+                raise Violation(f'{path}: packed length {len(data)} is not a multiple of {8 if wire == 1 else 4}')
+            return
+        pos = 0
+        try:
+            while pos < len(data):
+                _, pos = _varint(data, pos)
+        except ValueError as e:
+            raise Violation(f'{path}: bad packed varints: {e}') from None
+
+
+# Topic table
+
+KINDS = ('json_schema', 'cddl', 'protobuf')
+
+
+class Validator:
+    """One entry of the table: a topic filter, its schema and what a violation does."""
+
+    def __init__(self, spec):
+        spec = dict(spec)
+        self.topic = spec.pop('topic', None)
+        if not self.topic:
+            raise ValueError('payload validator needs a "topic" filter')
+        self.disconnect = bool(spec.pop('disconnect', False))
+        fmt = spec.pop('format', None)
+        if 'json_schema_file' in spec:
+            with open(spec.pop('json_schema_file')) as f:
+                spec['json_schema'] = json.load(f)
+        if 'cddl_file' in spec:
+            with open(spec.pop('cddl_file')) as f:
+                spec['cddl'] = f.read()
+        kinds = [kind for kind in KINDS if kind in spec]
+        if len(kinds) != 1:
+            raise ValueError(f'payload validator for {self.topic} needs exactly one of {", ".join(KINDS)}')
+        self.kind = kinds[0]
+        if self.kind == 'json_schema':
+            self.checker = JSONSchemaValidator(spec.pop('json_schema'), fmt or 'json')
+        elif self.kind == 'cddl':
+            self.checker = CDDLValidator(spec.pop('cddl'), fmt or 'cbor', spec.pop('rule', ''))
+        else:
+            if fmt:
+                raise ValueError('protobuf validators take no format')
+            self.checker = ProtobufValidator.from_file(spec.pop('protobuf'), spec.pop('message', ''))
+        if spec:
+            raise ValueError(f'unknown payload validator keys: {sorted(spec)}')
+        self.name = f'{self.kind} of {self.topic}'
+
+    def matches(self, topic):
+        from yourtestsrv.mqtt_server import topic_matches
+        return topic_matches(self.topic, topic)
+
+
+class ValidatorSet:
+    def __init__(self, specs):
+        self.validators = [Validator(spec) for spec in specs]
+
+    @classmethod
+    def from_file(cls, path):
+        with open(path) as f:
+            return cls(json.load(f))
+
+    def check(self, topic, payload):
+        """(validator, reason) when the first validator for topic rejects payload; None if it passes or none applies."""
+        for validator in self.validators:
+            if validator.matches(topic):
+                try:
+                    validator.checker.check(payload)
+                except Violation as e:
+                    return validator, str(e)
+                return None
+        return None
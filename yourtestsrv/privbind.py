@@ -0,0 +1,188 @@
+"""Serving privileged ports (53, 80, 123, 443, ...) without running the servers as root.
+
+Many firmwares have the standard ports hardcoded. A listener binding a port
+below net.ipv4.ip_unprivileged_port_start (1024 by default) needs one of:
+
+  capability  root or CAP_NET_BIND_SERVICE, e.g. granted to the interpreter with
+                sudo setcap cap_net_bind_service=+ep "$(readlink -f "$(command -v python3)")"
+              or the port range opened with
+                sudo sysctl net.ipv4.ip_unprivileged_port_start=53
+  the helper  sudo ./yourtestsrv privbind tcp:80 tcp:443 -- http --port 80
+              binds the listed sockets as root, drops to the invoking user
+              (SUDO_UID/SUDO_GID, or --user) and runs the command with the sockets
+              inherited; a command that is not a path or program on PATH is taken
+              as yourtestsrv arguments
+
+Specs are proto:port or proto:address:port ("udp:[::]:53"); the address
+defaults to 0.0.0.0. The sockets are listed in YOURTESTSRV_FDS
+("tcp:0.0.0.0:80=3,udp:0.0.0.0:53=4"); netutil.listen_tcp and bind_udp take
+an inherited socket for their protocol and port (the same address, or the
+only one for that port) instead of binding, and a bind that still fails with
+EACCES raises PermissionError naming these fixes. `privbind --check` reports
+what the current process may bind.
+"""
+
+import logging
+import os
+import shutil
+import socket
+import sys
+
+logger = logging.getLogger(__name__)
+
+ENV = 'YOURTESTSRV_FDS'
+PROTOCOLS = ('tcp', 'udp')
+CAP_NET_BIND_SERVICE = 10
+UNPRIVILEGED_PORT_START = '/proc/sys/net/ipv4/ip_unprivileged_port_start'
+
+_inherited = None
+
+
+def unprivileged_port_start():
+    """The lowest port anyone may bind (Linux sysctl; 1024 elsewhere)."""
+    try:
+        with open(UNPRIVILEGED_PORT_START) as f:
+            return int(f.read().strip())
+    except (OSError, ValueError):
+        return 1024
+
+
+def has_bind_capability():
+    """True when running as root or with CAP_NET_BIND_SERVICE in the effective set."""
+    if hasattr(os, 'geteuid') and os.geteuid() == 0:
+        return True
+    try:
+        with open('/proc/self/status') as f:
+            for line in f:
+                if line.startswith('CapEff:'):
+                    return bool(int(line.split()[1], 16) >> CAP_NET_BIND_SERVICE & 1)
+    except (OSError, ValueError, IndexError):
+        pass
+    return False
+
+
+def can_bind(port):
+    return port == 0 or port >= unprivileged_port_start() or has_bind_capability()
+
+
+def guidance(proto, port):
+    """What to do about a privileged port that could not be bound."""
+    return (f'binding {proto} port {port} needs root or CAP_NET_BIND_SERVICE (ports below '
+            f'{unprivileged_port_start()} are privileged): grant it with '
+            f'`sudo setcap cap_net_bind_service=+ep "$(readlink -f "{sys.executable}")"`, '
+            f'lower the range with `sudo sysctl net.ipv4.ip_unprivileged_port_start={port}`, '
+            f'or bind it from the helper: `sudo ./yourtestsrv privbind {proto}:{port} -- <command>`')
+
+
+def parse_spec(spec):
+    """(proto, address, port) of 'tcp:80' or 'udp:[::]:53'; raises ValueError."""
+    proto, sep, rest = spec.partition(':')
+    if proto not in PROTOCOLS or not sep:
+        raise ValueError(f'invalid privbind spec {spec!r} (use tcp:PORT or udp:ADDRESS:PORT)')
+    address, _, port = rest.rpartition(':')
+    try:
+        port = int(port)
+    except ValueError:
+        raise ValueError(f'invalid port in privbind spec {spec!r}') from None
+    if not 0 <= port <= 65535:
+        raise ValueError(f'invalid port in privbind spec {spec!r}')
+    return proto, address.strip('[]') or '0.0.0.0', port
+
+
+def format_entry(proto, address, port, fd):
+    host = f'[{address}]' if ':' in address else address
+    return f'{proto}:{host}:{port}={fd}'
+
+
+def load(environ=None):
+    """(Re)read the inherited sockets from environ (default os.environ)."""
+    global _inherited
+    value = (os.environ if environ is None else environ).get(ENV, '')
+    entries = []
+    for item in filter(None, value.split(',')):
+        spec, _, fd = item.rpartition('=')
+        try:
+            entries.append(parse_spec(spec) + (int(fd),))
+        except ValueError:
+            logger.warning(f'Ignoring malformed {ENV} entry {item!r}')
+    _inherited = entries
+    return entries
+
+
+def take(proto, address, port):
+    """A socket (a duplicate of the inherited one) for proto and port, or None."""
+    entries = _inherited if _inherited is not None else load()
+    if not port:
+        return None
+    address = address.strip('[]') or '0.0.0.0'
+    candidates = [e for e in entries if e[0] == proto and e[2] == port]
+    exact = [e for e in candidates if e[1] == address]
+    chosen = exact or (candidates if len(candidates) == 1 else [])
+    if not chosen:
+        return None
+    fd = chosen[0][3]
+    # A duplicate, so a listener closing and reopening its socket (UDP outages) can take it again.
+    sock = socket.socket(fileno=os.dup(fd))
+    logger.info(f'Using inherited {proto} socket {format_entry(*chosen[0])} for {address}:{port}')
+    return sock
+
+
+def bind(proto, address, port):
+    from yourtestsrv import netutil
+    if proto == 'tcp':
+        return netutil.listen_tcp(address, port)
+    return netutil.bind_udp(address, port)
+
+
+def resolve_user(user=''):
+    """(uid, gid) to drop to: --user, else the sudo caller; None to keep the current ones."""
+    if user:
+        import pwd
+        entry = pwd.getpwnam(user) if not user.isdigit() else pwd.getpwuid(int(user))
+        return entry.pw_uid, entry.pw_gid
+    if os.environ.get('SUDO_UID'):
+        return int(os.environ['SUDO_UID']), int(os.environ.get('SUDO_GID', os.environ['SUDO_UID']))
+    return None
+
+
+def drop_privileges(ids):
+    uid, gid = ids
+    os.setgroups([])
+    os.setgid(gid)
+    os.setuid(uid)
+    logger.info(f'Dropped privileges to uid {uid}, gid {gid}')
+
+
+def command_line(command):
+    """The program to run: command itself if it names one, else yourtestsrv with these arguments."""
+    if os.sep in command[0] or shutil.which(command[0]):
+        return list(command)
+    return [sys.executable, os.path.abspath(sys.argv[0])] + list(command)
+
+
+def run(specs, command, user=''):
+    """Bind specs, drop root, exec command with the sockets inherited; returns only on errors (raised)."""
+    entries = []
+    for spec in specs:
+        proto, address, port = parse_spec(spec)
+        sock = bind(proto, address, port)
+        os.set_inheritable(sock.fileno(), True)
+        entries.append(format_entry(proto, address, sock.getsockname()[1], sock.detach()))
+    if hasattr(os, 'geteuid') and os.geteuid() == 0:
+        ids = resolve_user(user)
+        if ids is None:
+            raise ValueError('running as root: pass --user (or run through sudo) so the servers do not keep root')
+        if ids[0] != 0:
+            drop_privileges(ids)
+    argv = command_line(command)
+    env = dict(os.environ, **{ENV: ','.join(entries)})
+    logger.info(f'privbind: {",".join(entries)} -> {" ".join(argv)}')
+    os.execvpe(argv[0], argv, env)
+
+
+def status(ports=(53, 80, 123, 443)):
+    """What this process may bind, for privbind --check."""
+    return {'euid': os.geteuid() if hasattr(os, 'geteuid') else None,
+            'cap_net_bind_service': has_bind_capability(),
+            'unprivileged_port_start': unprivileged_port_start(),
+            'ports': {port: can_bind(port) for port in ports}}
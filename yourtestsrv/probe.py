@@ -0,0 +1,165 @@
+"""Probing idle clients to find zombie connections.
+
+With probe_idle set (server.tcp / server.mqtt, --probe-idle on the tcp and
+mqtt commands) a listener probes every connection silent for that long and
+waits probe_timeout for a sign of life:
+
+  payload    probe_payload (backslash escapes allowed, e.g. "\\r\\n") is sent,
+             and any data from the client afterwards answers it. MQTT has no
+             server-to-client ping, so pick bytes the devices accept, such as a
+             PUBLISH to a probe topic.
+  keepalive  without a payload, TCP keepalive probes start after probe_idle,
+             probe_timeout apart, and the kernel's count of unanswered ones
+             (TCP_INFO, Linux only) tells whether the client still answers
+
+The counters appear under "probes" in the admin /stats output and can be
+checked with --expect ({"metric": "probes.zombies", "max": 0}):
+
+  probes     payload probes sent
+  answered   probes answered (keepalive: connections answering again)
+  silent     probes unanswered after probe_timeout (keepalive: connections
+             that stopped answering)
+  failed     probes that could not be sent (reset, broken pipe)
+  zombies    connections currently not answering
+
+Such connections are flagged "zombie" in /debug/connections; GET
+/debug/zombies lists only them, with how long they have been silent.
+"""
+
+import logging
+import threading
+import time
+
+from yourtestsrv import netutil, stats
+
+logger = logging.getLogger(__name__)
+
+COUNTERS = ('probes', 'answered', 'silent', 'failed', 'zombies')
+
+
+class ProbeState:
+    def __init__(self, conn, info, lock):
+        self.conn = conn
+        self.info = info
+        self.lock = lock
+        # When the probe awaiting an answer was sent, else None.
+        self.pending = None
+        self.last_probe = 0.0
+        self.unanswered = 0
+
+
+class IdleProber:
+    """Probes the idle connections of one listener; thread-safe."""
+
+    def __init__(self, idle, payload=b'', timeout=10.0):
+        self.idle = idle
+        self.payload = payload
+        self.timeout = timeout
+        self.counts = stats.Counters(COUNTERS[:-1])
+        self._conns = {}
+        self._lock = threading.Lock()
+        self._started = False
+
+    def add(self, conn, info, lock=None):
+        """Watch conn (described by its stats.ConnectionInfo); lock, if given, is held while sending a probe."""
+        if not self.payload:
+            try:
+                netutil.set_keepalive_probes(conn, self.idle, self.timeout)
+            except OSError as e:
+                logger.debug(f'Keepalive probes could not be enabled for {info.remote}: {e}')
+        with self._lock:
+            self._conns[info.id] = ProbeState(conn, info, lock)
+
+    def remove(self, info):
+        with self._lock:
+            self._conns.pop(info.id, None)
+
+    def start(self, stop_event):
+        """Run the prober in a daemon thread, once."""
+        with self._lock:
+            if self._started:
+                return
+            self._started = True
+        threading.Thread(target=self.run, args=(stop_event,), daemon=True, name='idle-prober').start()
+
+    def run(self, stop_event):
+        interval = max(0.05, min(self.idle, self.timeout) / 4)
+        while not stop_event.wait(interval):
+            self.check()
+
+    def check(self, now=None):
+        now = time.time() if now is None else now
+        with self._lock:
+            states = list(self._conns.values())
+        for state in states:
+            if self.payload:
+                self._check_payload(state, now)
+            else:
+                self._check_keepalive(state)
+
+    def _check_payload(self, state, now):
+        info = state.info
+        if 'zombie' in info.flags and state.pending is None and info.last_active > state.last_probe:
+            # Data since the last unanswered probe: alive after all.
+            self._answering(state)
+        if state.pending is not None:
+            if info.last_active > state.pending:
+                state.pending = None
+                self.counts.incr('answered')
+                self._answering(state)
+            elif now - state.pending >= self.timeout:
+                state.pending = None
+                self.counts.incr('silent')
+                self._silent(state, f'no answer to a probe within {self.timeout}s')
+            return
+        if now - max(info.last_active, state.last_probe) < self.idle:
+            return
+        state.last_probe = now
+        try:
+            if state.lock:
+                with state.lock:
+                    state.conn.sendall(self.payload)
+            else:
+                state.conn.sendall(self.payload)
+        except OSError as e:
+            self.counts.incr('failed')
+            self._silent(state, f'probe failed: {e}')
+            return
+        state.pending = now
+        self.counts.incr('probes')
+
+    def _check_keepalive(self, state):
+        try:
+            unanswered = netutil.unanswered_keepalive_probes(state.conn)
+        except OSError:
+            return
+        if unanswered is None:
+            return
+        if unanswered and 'zombie' not in state.info.flags:
+            self.counts.incr('silent')
+            self._silent(state, f'{unanswered} keepalive probes unanswered')
+        elif not unanswered and 'zombie' in state.info.flags:
+            self.counts.incr('answered')
+            self._answering(state)
+
+    def _silent(self, state, reason):
+        state.unanswered += 1
+        info = state.info
+        if 'zombie' not in info.flags:
+            info.flags.add('zombie')
+            info.probe = {'silent_since': round(info.last_active, 3)}
+            logger.warning(f'Connection {info.id} ({info.server} {info.remote}) looks dead: {reason}')
+        info.probe['unanswered'] = state.unanswered
+
+    def _answering(self, state):
+        state.unanswered = 0
+        info = state.info
+        if 'zombie' in info.flags:
+            info.flags.discard('zombie')
+            info.probe = None
+            logger.info(f'Connection {info.id} ({info.server} {info.remote}) answers again')
+
+    def snapshot(self):
+        with self._lock:
+            zombies = sum('zombie' in state.info.flags for state in self._conns.values())
+        return dict(self.counts.snapshot(), zombies=zombies)
@@ -0,0 +1,167 @@
+"""HAProxy PROXY protocol (v1 text and v2 binary) headers on accepted connections.
+
+Modes: '' ignores headers, 'optional' consumes a header when present and
+'strict' rejects connections that do not start with one. The header is
+read with MSG_PEEK first, so without one no application bytes are lost.
+"""
+
+import ipaddress
+import logging
+import socket
+import struct
+import time
+
+from yourtestsrv import stats
+
+logger = logging.getLogger(__name__)
+
+MODES = ('', 'optional', 'strict')
+V1_PREFIX = b'PROXY '
+V1_MAX = 107
+V2_SIGNATURE = b'\r\n\r\n\x00\r\nQUIT\n'
+
+
+class ProxyHeader:
+    def __init__(self, version, command, family, source=None, dest=None):
+        self.version = version
+        self.command = command
+        self.family = family
+        self.source = source
+        self.dest = dest
+
+    def to_dict(self):
+        return {'version': self.version, 'command': self.command, 'family': self.family,
+                'source': list(self.source) if self.source else None,
+                'dest': list(self.dest) if self.dest else None}
+
+    def __str__(self):
+        if not self.source:
+            return f'v{self.version} {self.command} {self.family}'
+        return f'v{self.version} {self.source[0]}:{self.source[1]} -> {self.dest[0]}:{self.dest[1]}'
+
+
+def _peek(conn, n, deadline):
+    """Peek until n bytes are buffered, the peer closes or the deadline passes."""
+    data = b''
+    while len(data) < n:
+        conn.settimeout(max(0.01, deadline - time.monotonic()))
+        try:
+            data = conn.recv(n, socket.MSG_PEEK)
+        except socket.timeout:
+            break
+        if not data or len(data) >= n or time.monotonic() >= deadline:
+            break
+        if data.startswith(V1_PREFIX) and b'\r\n' in data:
+            break
+        if not (V1_PREFIX.startswith(data[:6]) or V2_SIGNATURE.startswith(data[:12])):
+            break
+        time.sleep(0.01)
+    return data
+
+
+def _recv_exact(conn, n):
+    buf = b''
+    while len(buf) < n:
+        chunk = conn.recv(n - len(buf))
+        if not chunk:
+            raise ValueError('proxy: connection closed inside header')
+        buf += chunk
+    return buf
+
+
+def parse_v1(line):
+    """Parse a v1 header line without its CRLF."""
+    parts = line.decode('ascii', 'replace').split(' ')
+    if parts[0] != 'PROXY' or len(parts) < 2:
+        raise ValueError(f'proxy: bad v1 header {line!r}')
+    if parts[1] == 'UNKNOWN':
+        return ProxyHeader(1, 'PROXY', 'UNKNOWN')
+    if parts[1] not in ('TCP4', 'TCP6') or len(parts) != 6:
+        raise ValueError(f'proxy: bad v1 header {line!r}')
+    try:
+        src, dst = ipaddress.ip_address(parts[2]), ipaddress.ip_address(parts[3])
+        sport, dport = int(parts[4]), int(parts[5])
+    except ValueError:
+        raise ValueError(f'proxy: bad v1 addresses {line!r}') from None
+    version = 4 if parts[1] == 'TCP4' else 6
+    if src.version != version or dst.version != version or not (0 <= sport < 65536 and 0 <= dport < 65536):
+        raise ValueError(f'proxy: bad v1 addresses {line!r}')
+    return ProxyHeader(1, 'PROXY', parts[1], (str(src), sport), (str(dst), dport))
+
+
+def parse_v2(header, body):
+    """Parse a v2 header: the 16 fixed bytes and the address block that follows."""
+    ver_cmd, fam = header[12], header[13]
+    if ver_cmd >> 4 != 2 or ver_cmd & 0x0F not in (0, 1):
+        raise ValueError(f'proxy: bad v2 version/command {ver_cmd:#04x}')
+    command = 'LOCAL' if ver_cmd & 0x0F == 0 else 'PROXY'
+    if command == 'LOCAL':
+        return ProxyHeader(2, command, 'UNSPEC')
+    if fam == 0x11 and len(body) >= 12:
+        src, dst, sport, dport = struct.unpack_from('>4s4sHH', body)
+        return ProxyHeader(2, command, 'TCP4', (str(ipaddress.IPv4Address(src)), sport),
+                           (str(ipaddress.IPv4Address(dst)), dport))
+    if fam == 0x21 and len(body) >= 36:
+        src, dst, sport, dport = struct.unpack_from('>16s16sHH', body)
+        return ProxyHeader(2, command, 'TCP6', (str(ipaddress.IPv6Address(src)), sport),
+                           (str(ipaddress.IPv6Address(dst)), dport))
+    return ProxyHeader(2, command, f'{fam:#04x}')
+
+
+def read_header(conn, timeout=5.0):
+    """Consume a PROXY header from conn; returns None when the stream does not start with one."""
+    deadline = time.monotonic() + timeout
+    saved_timeout = conn.gettimeout()
+    try:
+        data = _peek(conn, 16, deadline)
+        if len(data) >= 16 and data[:12] == V2_SIGNATURE:
+            length = struct.unpack_from('>H', data, 14)[0]
+            header = _recv_exact(conn, 16)
+            return parse_v2(header, _recv_exact(conn, length))
+        if not data.startswith(V1_PREFIX):
+            return None
+        data = _peek(conn, V1_MAX, deadline) if b'\r\n' not in data else data
+        end = data.find(b'\r\n')
+        if end < 0:
+            raise ValueError('proxy: v1 header without CRLF')
+        _recv_exact(conn, end + 2)
+        return parse_v1(data[:end])
+    finally:
+        conn.settimeout(saved_timeout)
+
+
+def accept(conn, addr, mode, server_stats):
+    """Apply mode to a new connection.
+
+    Returns (addr, header): addr is the proxied source when the header names
+    one, header is None without a header, and addr is None if the connection
+    must be rejected.
+    """
+    if not mode:
+        return addr, None
+    try:
+        header = read_header(conn)
+    except (OSError, ValueError) as e:
+        logger.info(f'PROXY header from {addr} rejected: {e}')
+        server_stats.record_error(stats.ERROR_PARSE)
+        return None, None
+    if header is None:
+        if mode == 'strict':
+            logger.info(f'Connection from {addr} rejected: no PROXY header')
+            server_stats.record_error(stats.ERROR_PARSE)
+            return None, None
+        return addr, None
+    logger.info(f'PROXY header from {addr}: {header}')
+    return header.source or addr, header
+
+
+def build_v1(source, dest):
+    family = 'TCP6' if ':' in source[0] else 'TCP4'
+    return f'PROXY {family} {source[0]} {dest[0]} {source[1]} {dest[1]}\r\n'.encode()
+
+
+def build_v2(source, dest):
+    src, dst = ipaddress.ip_address(source[0]), ipaddress.ip_address(dest[0])
+    fam = 0x11 if src.version == 4 else 0x21
+    body = src.packed + dst.packed + struct.pack('>HH', source[1], dest[1])
+    return V2_SIGNATURE + bytes([0x21, fam]) + struct.pack('>H', len(body)) + body
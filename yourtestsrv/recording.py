@@ -0,0 +1,122 @@
+"""TCP session recording and strict replay.
+
+--record writes every connection of a TCP server (typically one forwarding
+to a real device backend with --upstream) to a log in the store (see
+storage.py), by default a JSON Lines file:
+
+  {"conn": 1, "t": 0.0, "event": "open", "server": "tcp:9000", "peer": "127.0.0.1:51234"}
+  {"conn": 1, "t": 0.012, "event": "rx", "hex": "68656c6c6f0a"}
+  {"conn": 1, "t": 0.013, "event": "tx", "hex": "6f6b0a"}
+  {"conn": 1, "t": 0.020, "event": "close"}
+
+t is seconds since the recording started, rx is data from the client and tx
+data to it. --replay answers strictly from such a recording: the n-th connection
+replays the n-th recorded one (cycling when all were used), each step in
+order. Consecutive chunks in one direction are one step, so TCP segmentation
+does not matter. The client must send exactly the recorded bytes and nothing
+more; the first divergence (other bytes, data after the last step, closing
+early) is logged with both sides, counted as a parse error and the
+connection reset, so a --run-for run with {"metric": "errors.parse", "max": 0}
+fails.
+"""
+
+import threading
+import time
+
+from yourtestsrv import storage
+
+# Bytes shown of each side in a divergence message.
+SHOW_BYTES = 32
+
+
+class ReplayDivergence(ValueError):
+    pass
+
+
+def _peer(addr):
+    if isinstance(addr, tuple):
+        return f'{addr[0]}:{addr[1]}'
+    return str(addr)
+
+
+class SessionRecorder:
+    """Writes the connections of one or more TCP servers to a recording, replacing an earlier one of that name."""
+
+    def __init__(self, name, store=None):
+        self.name = name
+        self.store = storage.get(store)
+        self.store.clear(name)
+        self._lock = threading.Lock()
+        self._conns = {}
+        self._next = 1
+        self._started = time.monotonic()
+
+    def _write(self, number, event, **fields):
+        self.store.append(self.name, dict(conn=number, t=round(time.monotonic() - self._started, 3), event=event,
+                                          **fields))
+
+    def open(self, server, addr):
+        with self._lock:
+            number, self._next = self._next, self._next + 1
+            self._conns[addr] = number
+            self._write(number, 'open', server=server, peer=_peer(addr))
+
+    def record(self, addr, direction, data):
+        """Append data sent in direction ('rx' from the client, 'tx' to it) on the connection from addr."""
+        with self._lock:
+            number = self._conns.get(addr)
+            if number is not None and data:
+                self._write(number, direction, hex=data.hex())
+
+    def close(self, addr):
+        with self._lock:
+            number = self._conns.pop(addr, None)
+            if number is not None:
+                self._write(number, 'close')
+
+
+def load(name, store=None):
+    """The recorded connections in order, each a list of (direction, bytes) steps."""
+    connections = {}
+    for index, entry in enumerate(storage.get(store).entries(name), 1):
+        try:
+            steps = connections.setdefault(entry['conn'], [])
+            if entry['event'] not in ('rx', 'tx'):
+                continue
+            data = bytes.fromhex(entry['hex'])
+        except (ValueError, KeyError, TypeError) as e:
+            raise ValueError(f'{name}: bad recording entry {index}: {e}') from None
+        if steps and steps[-1][0] == entry['event']:
+            steps[-1] = (entry['event'], steps[-1][1] + data)
+        else:
+            steps.append((entry['event'], data))
+    return [connections[number] for number in sorted(connections)]
+
+
+class SessionReplay:
+    """Hands the recorded connections out to new client connections in order."""
+
+    def __init__(self, connections):
+        if not connections:
+            raise ValueError('the recording has no connections')
+        self.connections = connections
+        self._next = 0
+        self._lock = threading.Lock()
+
+    @classmethod
+    def from_store(cls, name, store=None):
+        return cls(load(name, store))
+
+    def next_connection(self):
+        """(number, steps) of the recorded connection the next client replays; numbers start at 1."""
+        with self._lock:
+            index = self._next % len(self.connections)
+            self._next += 1
+        return index + 1, self.connections[index]
+
+
+def divergence(step, expected, got):
+    """ReplayDivergence for the bytes got from the client where a step expected others (or more)."""
+    offset = next((i for i, (a, b) in enumerate(zip(got, expected)) if a != b), len(got))
+    return ReplayDivergence(f'step {step}: expected {expected[offset:offset + SHOW_BYTES].hex() or "<end>"} '
+                            f'at byte {offset}, got {got[offset:offset + SHOW_BYTES].hex() or "<close>"}')
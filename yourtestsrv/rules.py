@@ -0,0 +1,126 @@
+"""Rule-based TCP responder: a match -> reply table from the config file.
+
+Each frame (or received chunk with raw framing) is checked against the
+rules in order; the first match decides what happens:
+
+  {"prefix_hex": "a55a01", "reply_hex": "a55a8100"}
+  {"regex": "^AT\\+CSQ", "reply": "+CSQ: 20,99\\r\\nOK\\r\\n", "delay": "200ms"}
+  {"exact": "PING", "reply": "PONG\\n"}
+  {"exact_hex": "ff", "action": "rst"}
+  {"template": {"fields": [...]}}   binary template built from the request
+  {"action": "ignore"}              no match key: matches everything
+
+Match keys are prefix / prefix_hex, exact / exact_hex, regex (searched
+in the raw frame) and json (an object of dotted field paths and the values
+they must equal, checked against the frame parsed as JSON). Text values
+accept backslash escapes.
+Actions: reply (default), ignore (send nothing), close (FIN) and rst.
+Frames no rule matches get the server's usual echo or response.
+"""
+
+import json
+import re
+
+from yourtestsrv.binproto import BinaryTemplate
+
+ACTIONS = ('reply', 'ignore', 'close', 'rst')
+MATCH_KEYS = ('prefix', 'prefix_hex', 'exact', 'exact_hex', 'regex', 'json')
+
+
+def _escaped(s):
+    return s.encode('latin-1').decode('unicode_escape').encode('latin-1')
+
+
+def _json_field(doc, path):
+    for part in path.split('.'):
+        if isinstance(doc, dict) and part in doc:
+            doc = doc[part]
+        elif isinstance(doc, list) and part.isdigit() and int(part) < len(doc):
+            doc = doc[int(part)]
+        else:
+            raise KeyError(path)
+    return doc
+
+
+class Matcher:
+    """The content test of a rule; pops its match key from spec."""
+
+    def __init__(self, spec):
+        keys = [k for k in MATCH_KEYS if k in spec]
+        if len(keys) > 1:
+            raise ValueError(f'rule has more than one match key: {keys}')
+        self.kind, self.pattern = None, None
+        if keys:
+            key = keys[0]
+            value = spec.pop(key)
+            self.kind = key.replace('_hex', '')
+            if key == 'regex':
+                self.pattern = re.compile(value.encode('latin-1'), re.DOTALL)
+            elif key == 'json':
+                if not isinstance(value, dict) or not value:
+                    raise ValueError('json match needs an object of field paths and values')
+                self.pattern = value
+            else:
+                self.pattern = bytes.fromhex(value) if key.endswith('_hex') else _escaped(value)
+
+    def matches(self, data):
+        if self.kind is None:
+            return True
+        if self.kind == 'prefix':
+            return data.startswith(self.pattern)
+        if self.kind == 'exact':
+            return data == self.pattern
+        if self.kind == 'json':
+            try:
+                doc = json.loads(data)
+                return all(_json_field(doc, path) == want for path, want in self.pattern.items())
+            except (ValueError, KeyError):
+                return False
+        return self.pattern.search(data) is not None
+
+
+class Rule:
+    def __init__(self, spec):
+        from yourtestsrv.config import parse_duration
+        spec = dict(spec)
+        self.matcher = Matcher(spec)
+        self.action = spec.pop('action', 'reply')
+        if self.action not in ACTIONS:
+            raise ValueError(f'unknown rule action: {self.action!r}')
+        self.delay = parse_duration(spec.pop('delay', '0s'))
+        replies = [k for k in ('reply', 'reply_hex', 'template') if k in spec]
+        if len(replies) > 1:
+            raise ValueError(f'rule has more than one reply: {replies}')
+        self.reply = None
+        self.template = None
+        if 'reply' in spec:
+            self.reply = _escaped(spec.pop('reply'))
+        elif 'reply_hex' in spec:
+            self.reply = bytes.fromhex(spec.pop('reply_hex'))
+        elif 'template' in spec:
+            self.template = BinaryTemplate(spec.pop('template'))
+        if spec:
+            raise ValueError(f'unknown rule keys: {sorted(spec)}')
+        if self.action == 'reply' and self.reply is None and self.template is None:
+            raise ValueError('reply rule needs reply, reply_hex or template')
+
+    def matches(self, frame):
+        return self.matcher.matches(frame)
+
+    def build(self, frame):
+        """The reply bytes for frame, or b'' when the rule sends nothing."""
+        if self.template is not None:
+            return self.template.build(frame)
+        return self.reply or b''
+
+
+class RuleSet:
+    def __init__(self, specs):
+        self.rules = [Rule(spec) for spec in specs]
+
+    def match(self, frame):
+        """The first rule matching frame, or None."""
+        for rule in self.rules:
+            if rule.matches(frame):
+                return rule
+        return None
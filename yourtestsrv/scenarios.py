@@ -0,0 +1,246 @@
+"""Registry of ready-made fault scenarios, discoverable from the running server.
+
+A scenario is a named session spec (see session.py) with documented
+parameters. Where the template has "${param}" the parameter's value goes in:
+a string that is only the placeholder takes the value as is (a number stays
+a number), otherwise the value is formatted into the string. An entry is:
+
+  description  what the device sees and what it tests
+  parameters   name -> {"default", "description"}; a given value must have the
+               type of the default (an int is fine for a float)
+  template     session spec without the name: "servers" and optionally
+               "network_profile"
+
+The protocols a scenario affects are the types of its servers. The admin
+API lists them (GET /scenarios, ?format=text for a table), shows one with an
+example (GET /scenarios/<name>) and applies one as a session
+(POST /scenarios/<name> {"session", "params", "bind"}); the `scenarios`
+command prints the same offline.
+"""
+
+import copy
+import re
+
+SCENARIOS = {
+    'cellular-link': {
+        'description': 'TCP and UDP echo behind a cellular or satellite link: latency, jitter, bandwidth and '
+                       'UDP loss of a network profile (netprofiles.py).',
+        'parameters': {
+            'profile': {'default': 'nb-iot', 'description': 'network profile: nb-iot, lte-m, gprs or satellite'},
+        },
+        'template': {'network_profile': '${profile}', 'servers': [{'type': 'tcp'}, {'type': 'udp'}]},
+    },
+    'half-open': {
+        'description': 'TCP connections are accepted and read but never answered, like a peer that vanished '
+                       'without closing; tests application timeouts and keepalives.',
+        'parameters': {
+            'idle_timeout': {'default': '300s', 'description': 'close the connection after this long idle'},
+        },
+        'template': {'servers': [{'type': 'tcp', 'stall': True, 'idle_timeout': '${idle_timeout}'}]},
+    },
+    'reset-mid-stream': {
+        'description': 'TCP echo that resets the connection (RST) after some bytes; tests reconnect logic and '
+                       'handling of partially sent messages.',
+        'parameters': {
+            'bytes': {'default': 1024, 'description': 'bytes echoed before the reset'},
+        },
+        'template': {'servers': [{'type': 'tcp', 'close_mode': 'rst', 'close_after_bytes': '${bytes}'}]},
+    },
+    'corrupt-bytes': {
+        'description': 'TCP echo flipping random bytes of the replies; tests checksums and framing recovery.',
+        'parameters': {
+            'rate': {'default': 0.01, 'description': 'probability of corrupting each byte (0-1)'},
+        },
+        'template': {'servers': [{'type': 'tcp', 'corrupt_rate': '${rate}'}]},
+    },
+    'trickle': {
+        'description': 'TCP echo sending replies a few bytes at a time; tests reads that assume a whole message '
+                       'arrives at once.',
+        'parameters': {
+            'delay': {'default': '200ms', 'description': 'pause between chunks'},
+            'chunk': {'default': 1, 'description': 'bytes per chunk'},
+        },
+        'template': {'servers': [{'type': 'tcp', 'trickle_delay': '${delay}', 'trickle_chunk': '${chunk}'}]},
+    },
+    'server-full': {
+        'description': 'TCP server at its connection limit; further connections are refused, queued or get a '
+                       'banner; tests connection retry and backoff.',
+        'parameters': {
+            'limit': {'default': 1, 'description': 'concurrent connections accepted'},
+            'over_limit': {'default': 'refuse', 'description': 'what happens beyond it: refuse, queue or banner'},
+        },
+        'template': {'servers': [{'type': 'tcp', 'max_connections': '${limit}', 'over_limit': '${over_limit}'}]},
+    },
+    'lossy-udp': {
+        'description': 'UDP echo dropping and duplicating datagrams; tests retransmission and deduplication.',
+        'parameters': {
+            'drop_rate': {'default': 0.2, 'description': 'probability of dropping a datagram (0-1)'},
+            'duplicate_rate': {'default': 0.05, 'description': 'probability of sending a reply twice (0-1)'},
+        },
+        'template': {'servers': [{'type': 'udp', 'drop_rate': '${drop_rate}',
+                                  'duplicate_rate': '${duplicate_rate}'}]},
+    },
+    'udp-outage': {
+        'description': 'UDP echo that goes silent periodically, like a backhaul outage; tests offline buffering '
+                       'and recovery.',
+        'parameters': {
+            'every': {'default': '60s', 'description': 'time between outage starts'},
+            'duration': {'default': '10s', 'description': 'length of each outage'},
+        },
+        'template': {'servers': [{'type': 'udp', 'outage_every': '${every}', 'outage_duration': '${duration}'}]},
+    },
+    'udp-fragmented': {
+        'description': 'UDP echo padding every reply to a large datagram, so it arrives IP-fragmented; tests '
+                       'reassembly and receive buffer limits.',
+        'parameters': {
+            'size': {'default': 4096, 'description': 'size of each reply datagram in bytes'},
+        },
+        'template': {'servers': [{'type': 'udp', 'pad_to': '${size}'}]},
+    },
+    'stun-endpoint': {
+        'description': 'UDP echo that also answers STUN binding requests with the reflexive address '
+                       '(XOR-MAPPED-ADDRESS), or a wrong answer; tests NAT traversal against a local STUN server.',
+        'parameters': {
+            'mode': {'default': 'normal', 'description': 'stun mode: normal, wrong_port, wrong_ip, legacy, '
+                                                         'unxored, no_address, error or silent'},
+            'mapped': {'default': '', 'description': "host:port reported instead of the client's ('' for its own)"},
+        },
+        'template': {'servers': [{'type': 'udp', 'stun': '${mode}', 'stun_mapped': '${mapped}'}]},
+    },
+    'http-error': {
+        'description': 'HTTP server answering every request with an error status; tests error handling and '
+                       'retry policies.',
+        'parameters': {
+            'code': {'default': 503, 'description': 'status code of every response'},
+        },
+        'template': {'servers': [{'type': 'http', 'error_code': '${code}'}]},
+    },
+    'http-slow': {
+        'description': 'HTTP server sending its responses slowly; tests request timeouts.',
+        'parameters': {
+            'duration': {'default': '30s', 'description': 'time taken to send each response'},
+        },
+        'template': {'servers': [{'type': 'http', 'slow_response': True, 'slow_duration': '${duration}'}]},
+    },
+    'http-lockout': {
+        'description': 'HTTP basic auth locking the client out after failed logins; tests credential handling '
+                       'and lockout backoff.',
+        'parameters': {
+            'auth': {'default': 'admin:secret', 'description': 'valid user:password'},
+            'after': {'default': 3, 'description': 'failed attempts before the lockout'},
+            'duration': {'default': '60s', 'description': 'length of the lockout'},
+        },
+        'template': {'servers': [{'type': 'http', 'auth': '${auth}', 'lockout_after': '${after}',
+                                  'lockout_duration': '${duration}'}]},
+    },
+    'http-bad-range': {
+        'description': 'HTTP range responses that are malformed or ignored; tests resumable downloads (OTA).',
+        'parameters': {
+            'fault': {'default': 'wrong_boundary', 'description': 'wrong_boundary, missing_close or ignore'},
+        },
+        'template': {'servers': [{'type': 'http', 'range_fault': '${fault}'}]},
+    },
+    'mqtt-redirect': {
+        'description': 'MQTT broker refusing connections with a redirect to another server (v5 Server '
+                       'Reference); tests broker migration.',
+        'parameters': {
+            'reference': {'default': '127.0.0.1:1884', 'description': 'host:port the clients are sent to'},
+            'code': {'default': 'use_another_server', 'description': 'use_another_server or server_moved'},
+        },
+        'template': {'servers': [{'type': 'mqtt', 'redirect': '${reference}', 'redirect_code': '${code}'}]},
+    },
+    'mqtt-slow-accept': {
+        'description': 'MQTT broker that is slow to accept connections, like one under load; tests connect '
+                       'timeouts.',
+        'parameters': {
+            'delay': {'default': '5s', 'description': 'time before each connection is accepted'},
+        },
+        'template': {'servers': [{'type': 'mqtt', 'accept_delay': '${delay}'}]},
+    },
+}
+NAMES = tuple(SCENARIOS)
+
+_PLACEHOLDER = re.compile(r'\$\{(\w+)\}')
+
+
+def get(name):
+    if name not in SCENARIOS:
+        raise ValueError(f'unknown scenario: {name!r} (use one of {", ".join(NAMES)})')
+    return SCENARIOS[name]
+
+
+def protocols(name):
+    """The server types scenario name runs, in order."""
+    return list(dict.fromkeys(server['type'] for server in get(name)['template']['servers']))
+
+
+def _check(name, param, value, default):
+    if isinstance(default, bool):
+        ok = isinstance(value, bool)
+    elif isinstance(default, (int, float)):
+        ok = isinstance(value, (int, float)) and not isinstance(value, bool)
+        ok = ok and (isinstance(default, float) or isinstance(value, int))
+    else:
+        ok = isinstance(value, type(default))
+    if not ok:
+        raise ValueError(f'scenario {name} parameter {param} must be {type(default).__name__}: {value!r}')
+
+
+def _substitute(value, params):
+    if isinstance(value, dict):
+        return {k: _substitute(v, params) for k, v in value.items()}
+    if isinstance(value, list):
+        return [_substitute(v, params) for v in value]
+    if isinstance(value, str):
+        whole = _PLACEHOLDER.fullmatch(value)
+        if whole:
+            return params[whole.group(1)]
+        return _PLACEHOLDER.sub(lambda m: str(params[m.group(1)]), value)
+    return value
+
+
+def resolve(name, params=None):
+    """The session spec (without a name) of scenario name with params over the defaults; raises ValueError."""
+    scenario = get(name)
+    values = {param: spec['default'] for param, spec in scenario['parameters'].items()}
+    for param, value in (params or {}).items():
+        if param not in values:
+            raise ValueError(f'scenario {name} has no parameter {param!r} '
+                             f'(use {", ".join(values) or "none"})')
+        _check(name, param, value, values[param])
+        values[param] = value
+    return _substitute(copy.deepcopy(scenario['template']), values)
+
+
+def session_spec(name, params=None, session='', bind=''):
+    """The session spec applying scenario name, for SessionManager.create."""
+    spec = {'name': session or name, **resolve(name, params)}
+    if bind:
+        spec['bind'] = bind
+    return spec
+
+
+def summary(name):
+    scenario = get(name)
+    return {'name': name, 'description': scenario['description'], 'protocols': protocols(name),
+            'parameters': {param: dict(spec) for param, spec in scenario['parameters'].items()}}
+
+
+def describe(name):
+    """summary plus the session the defaults give and the admin request applying it."""
+    info = summary(name)
+    defaults = {param: spec['default'] for param, spec in info['parameters'].items()}
+    info['session'] = resolve(name)
+    info['example'] = {'method': 'POST', 'path': f'/scenarios/{name}', 'body': {'session': name, 'params': defaults}}
+    return info
+
+
+def format_table(names=NAMES):
+    """Scenarios as text: name, protocols and description, then the parameters with their defaults."""
+    lines = []
+    for name in names:
+        info = summary(name)
+        lines.append(f'{name:<18} {",".join(info["protocols"]):<8} {info["description"]}')
+        for param, spec in info['parameters'].items():
+            lines.append(f'{"":<18} {"":<8}   {param}={spec["default"]}: {spec["description"]}')
+    return '\n'.join(lines) + '\n'
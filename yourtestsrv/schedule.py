@@ -0,0 +1,196 @@
+"""Scheduled server-initiated (downlink) actions.
+
+Each schedule entry has a trigger, either "every" (a duration) or "cron"
+(5 fields: minute hour day-of-month month day-of-week, supporting *, */N,
+A-B and comma lists), and an "action":
+
+  mqtt_publish   topic, payload, qos, retain   publish to MQTT subscribers
+  mqtt_redirect  reference, code               redirect MQTT clients elsewhere ("" ends it)
+  tcp_push       payload                       send to all TCP clients
+  udp_heartbeat  payload, target (host:port)   send to target or recent UDP peers
+  webhook        url, payload, method          HTTP request via urllib
+
+"payload" is a payload generator spec (see payload.py) or a plain string.
+"""
+
+import datetime
+import logging
+import urllib.error
+import urllib.request
+
+from yourtestsrv import clock as clock_module
+from yourtestsrv.config import parse_duration
+from yourtestsrv.payload import make_generator
+
+logger = logging.getLogger(__name__)
+
+ACTIONS = ('mqtt_publish', 'mqtt_redirect', 'tcp_push', 'udp_heartbeat', 'webhook')
+
+_CRON_RANGES = ((0, 59), (0, 23), (1, 31), (1, 12), (0, 6))
+_MONTH_DAYS = (31, 29, 31, 30, 31, 30, 31, 31, 30, 31, 30, 31)
+# Every date falls on every weekday within 28 years, leap days included.
+_CRON_SEARCH_DAYS = 28 * 366
+
+
+def _parse_cron_field(field, low, high):
+    values = set()
+    for part in field.split(','):
+        step = 1
+        if '/' in part:
+            part, step_text = part.split('/', 1)
+            step = int(step_text)
+            if step <= 0:
+                raise ValueError(f'invalid cron step: {step_text!r}')
+        if part == '*':
+            start, end = low, high
+        elif '-' in part:
+            start, end = (int(v) for v in part.split('-', 1))
+        else:
+            start = end = int(part)
+        if start < low or end > high or start > end:
+            raise ValueError(f'cron value out of range {low}-{high}: {part!r}')
+        values.update(range(start, end + 1, step))
+    return values
+
+
+class CronTrigger:
+    def __init__(self, expr):
+        fields = expr.split()
+        if len(fields) != 5:
+            raise ValueError(f'cron expression needs 5 fields: {expr!r}')
+        self.expr = expr
+        self.minutes, self.hours, self.days, self.months, self.weekdays = (
+            _parse_cron_field(f, low, high) for f, (low, high) in zip(fields, _CRON_RANGES))
+        if not any(day <= _MONTH_DAYS[month - 1] for month in self.months for day in self.days):
+            raise ValueError(f'cron expression never fires: {expr!r}')
+
+    def matches(self, dt):
+        # cron counts Sunday as 0; Python's weekday() counts Monday as 0.
+        return (dt.minute in self.minutes and dt.hour in self.hours and dt.day in self.days
+                and dt.month in self.months and (dt.weekday() + 1) % 7 in self.weekdays)
+
+    def next_after(self, t):
+        start = datetime.datetime.fromtimestamp(t).replace(second=0, microsecond=0) + datetime.timedelta(minutes=1)
+        day = start.date()
+        for _ in range(_CRON_SEARCH_DAYS):
+            if day.day in self.days and day.month in self.months and (day.weekday() + 1) % 7 in self.weekdays:
+                for hour in sorted(self.hours):
+                    for minute in sorted(self.minutes):
+                        dt = datetime.datetime.combine(day, datetime.time(hour, minute))
+                        if dt >= start:
+                            return dt.timestamp()
+            day += datetime.timedelta(days=1)
+        raise ValueError(f'cron expression never fires: {self.expr!r}')
+
+
+class IntervalTrigger:
+    def __init__(self, every):
+        self.every = parse_duration(every)
+        if self.every <= 0:
+            raise ValueError(f'schedule interval must be positive: {every!r}')
+
+    def next_after(self, t):
+        return t + self.every
+
+
+class ScheduledAction:
+    def __init__(self, spec):
+        self.spec = spec
+        self.action = spec.get('action')
+        if self.action not in ACTIONS:
+            raise ValueError(f'unknown schedule action: {self.action!r}')
+        if 'cron' in spec:
+            self.trigger = CronTrigger(spec['cron'])
+        elif 'every' in spec:
+            self.trigger = IntervalTrigger(spec['every'])
+        else:
+            raise ValueError('schedule entry needs "every" or "cron"')
+        payload = spec.get('payload', '')
+        if isinstance(payload, str):
+            self.generator = None
+            self.fixed_payload = payload.encode()
+        else:
+            self.generator = make_generator(payload)
+        if self.action == 'mqtt_publish' and 'topic' not in spec:
+            raise ValueError('mqtt_publish schedule entry needs "topic"')
+        if self.action == 'mqtt_redirect':
+            from yourtestsrv.mqtt_server import REDIRECT_CODES
+            if 'reference' not in spec:
+                raise ValueError('mqtt_redirect schedule entry needs "reference"')
+            if spec.get('code', 'use_another_server') not in REDIRECT_CODES:
+                raise ValueError(f'unknown mqtt_redirect code: {spec["code"]!r}')
+        if self.action == 'webhook' and 'url' not in spec:
+            raise ValueError('webhook schedule entry needs "url"')
+
+    def payload(self):
+        return self.generator.next() if self.generator else self.fixed_payload
+
+
+def parse_schedule(entries):
+    return [ScheduledAction(spec) for spec in entries or []]
+
+
+class Scheduler:
+    def __init__(self, actions, tcp_servers=(), udp_servers=(), mqtt_servers=(), clock=None):
+        self.actions = actions
+        self.clock = clock_module.get(clock)
+        self.tcp_servers = list(tcp_servers)
+        self.udp_servers = list(udp_servers)
+        self.mqtt_servers = list(mqtt_servers)
+
+    def run(self, stop_event):
+        if not self.actions:
+            return
+        now = self.clock.time()
+        due = [(t, i) for i, t in enumerate(self._next_time(a, now) for a in self.actions) if t is not None]
+        logger.info(f'Scheduler started with {len(self.actions)} action(s)')
+        while due:
+            next_time, index = min(due)
+            if self.clock.wait(stop_event, max(0.0, next_time - self.clock.time())):
+                return
+            action = self.actions[index]
+            try:
+                self.fire(action)
+            except Exception as e:
+                logger.warning(f'Scheduled {action.action} failed: {e}')
+            due.remove((next_time, index))
+            next_time = self._next_time(action, max(next_time, self.clock.time()))
+            if next_time is not None:
+                due.append((next_time, index))
+
+    def _next_time(self, action, t):
+        """When action is due after t, or None (logged) if it never is again; the others carry on."""
+        try:
+            return action.trigger.next_after(t)
+        except ValueError as e:
+            logger.warning(f'Scheduled {action.action} dropped: {e}')
+            return None
+
+    def fire(self, action):
+        spec = action.spec
+        payload = action.payload()
+        if action.action == 'mqtt_publish':
+            count = sum(srv.publish(spec['topic'], payload, spec.get('qos', 0), spec.get('retain', False))
+                        for srv in self.mqtt_servers)
+        elif action.action == 'mqtt_redirect':
+            count = sum(srv.redirect_clients(spec['reference'], spec.get('code', 'use_another_server'))
+                        for srv in self.mqtt_servers)
+        elif action.action == 'tcp_push':
+            count = sum(srv.push(payload) for srv in self.tcp_servers)
+        elif action.action == 'udp_heartbeat':
+            target = None
+            if 'target' in spec:
+                host, _, port = spec['target'].rpartition(':')
+                target = (host, int(port))
+            count = sum(srv.send_to(payload, target) for srv in self.udp_servers)
+        else:
+            req = urllib.request.Request(spec['url'], data=payload, method=spec.get('method', 'POST'),
+                                         headers={'Content-Type': spec.get('content_type', 'application/json')})
+            try:
+                with urllib.request.urlopen(req, timeout=10) as resp:
+                    count = 1 if resp.status < 400 else 0
+            except (urllib.error.URLError, OSError) as e:
+                logger.warning(f'Scheduled webhook to {spec["url"]} failed: {e}')
+                count = 0
+        logger.info(f'Scheduled {action.action} delivered to {count} target(s)')
+        return count
@@ -0,0 +1,370 @@
+"""JSON Schema of the configuration file (yourtestsrv.py config-schema).
+
+Editors and CI linters can validate and autocomplete config files against
+it. The schema is derived from the config classes themselves rather than
+written by hand: every keyword argument of TCPConfig, UDPConfig, ... becomes
+a property, typed from its default (bool, integer, number, string; strings
+defaulting to a duration such as "30s" get the duration pattern). Settings
+whose default does not tell the type (None or no default) and nested specs
+(latency models, rule tables, fault rules, binary templates, payload generators, MQTT
+payload validators, NTRIP mountpoints, DNS records, the schedule, log throttling,
+loadgen templates) are given explicitly below, with enums taken from the modules that
+check them. schema() raises KeyError for a setting with neither, so a new
+option cannot be added without its schema.
+"""
+
+import inspect
+import re
+
+from yourtestsrv import config
+
+DRAFT = 'https://json-schema.org/draft/2020-12/schema'
+DURATION_PATTERN = r'^([+-]?(\d+(\.\d+)?(ns|us|µs|ms|s|m|h))+|0?)$'
+_DURATION = re.compile(DURATION_PATTERN)
+
+
+def duration(**extra):
+    return dict(type='string', pattern=DURATION_PATTERN, **extra)
+
+
+def enum(values, **extra):
+    return dict(enum=list(values), **extra)
+
+
+def array(items, **extra):
+    return dict(type='array', items=items, **extra)
+
+
+def obj(properties, required=(), additional=False):
+    schema = {'type': 'object', 'properties': properties, 'additionalProperties': additional}
+    if required:
+        schema['required'] = list(required)
+    return schema
+
+
+def _scalar(default):
+    if isinstance(default, bool):
+        return {'type': 'boolean', 'default': default}
+    if isinstance(default, int):
+        return {'type': 'integer', 'default': default}
+    if isinstance(default, float):
+        return {'type': 'number', 'default': default}
+    if isinstance(default, str):
+        if default and _DURATION.match(default):
+            return duration(default=default)
+        return {'type': 'string', 'default': default}
+    raise KeyError
+
+
+def from_signature(cls, fields=None):
+    """Object schema for the keyword arguments of cls; fields gives the schema of those not typed by their default."""
+    fields = fields or {}
+    properties, required = {}, []
+    for name, param in inspect.signature(cls).parameters.items():
+        if name in ('self', 'clock'):
+            continue
+        if param.default is inspect.Parameter.empty:
+            required.append(name)
+        if name in fields:
+            properties[name] = fields[name]
+            continue
+        try:
+            properties[name] = _scalar(param.default)
+        except KeyError:
+            raise KeyError(f'{cls.__name__}.{name} has no schema') from None
+    return obj(properties, required)
+
+
+def _match_keys():
+    from yourtestsrv.rules import MATCH_KEYS
+    keys = {key: {'type': 'string'} for key in MATCH_KEYS}
+    keys['json'] = {'type': 'object', 'description': 'field path -> value the JSON message must have'}
+    return keys
+
+
+def template():
+    """A binary template (see binproto.py): an object with fields, or just the list of fields."""
+    from yourtestsrv.binproto import CHECKSUMS, _INT_FORMATS
+    names = array({'type': 'string'})
+    field = obj({
+        'name': {'type': 'string'},
+        'type': enum(list(_INT_FORMATS) + ['bytes'], default='bytes'),
+        'endian': enum(('big', 'little')),
+        'value': {'type': 'integer'},
+        'hex': {'type': 'string'},
+        'text': {'type': 'string'},
+        'from_request': array({'type': ['integer', 'null']}, minItems=2, maxItems=2),
+        'length_of': names,
+        'checksum': enum(CHECKSUMS),
+        'over': names,
+    })
+    fields = array(field, minItems=1)
+    return {'anyOf': [obj({'endian': enum(('big', 'little'), default='big'), 'fields': fields}, ['fields']),
+                      fields]}
+
+
+def capture_filter():
+    from yourtestsrv.capture import FILTER_KEYS
+    return obj({key: {'type': ['string', 'integer']} for key in FILTER_KEYS})
+
+
+def capture_spec():
+    return obj({'file': {'type': 'string'}, 'filter': capture_filter(), 'join': {'type': 'boolean', 'default': False}},
+               ['file'])
+
+
+def payload():
+    """A payload generator spec (see payload.py), one schema per generator type."""
+    from yourtestsrv.payload import _GENERATORS
+    fields = {'pattern': {'type': 'string'}, 'pattern_hex': {'type': 'string'}, 'template': {'type': 'string'},
+              'file': {'type': 'string'}, 'filter': capture_filter()}
+    variants = []
+    for kind, cls in _GENERATORS.items():
+        schema = from_signature(cls, fields)
+        schema['properties'] = {'type': {'const': kind}, **schema['properties']}
+        schema['required'] = ['type'] + schema.get('required', [])
+        variants.append(schema)
+    return {'oneOf': variants}
+
+
+def rule():
+    from yourtestsrv.rules import ACTIONS
+    return obj({**_match_keys(), 'action': enum(ACTIONS, default='reply'), 'delay': duration(default='0s'),
+                'reply': {'type': 'string'}, 'reply_hex': {'type': 'string'}, 'template': template()})
+
+
+def fault_rule():
+    from yourtestsrv.integrity import MODES
+    rate = {'type': 'number', 'minimum': 0, 'maximum': 1}
+    return obj({
+        **_match_keys(),
+        'path': {'type': 'string', 'description': 'HTTP: regex searched in the request path'},
+        'topic': {'type': 'string', 'description': 'MQTT: topic filter'},
+        'delay': duration(default='0s'),
+        'drop_rate': rate,
+        'corrupt_rate': rate,
+        'error_code': {'type': 'integer', 'minimum': 100, 'maximum': 599},
+        'integrity': enum(MODES),
+        'ttl': {'type': 'integer', 'minimum': 0, 'maximum': 255},
+        'dscp': dscp(),
+    })
+
+
+def dscp():
+    return {'type': ['string', 'integer'], 'description': '0-63 or EF, CS0-CS7, AF11-AF43'}
+
+
+def socket_options():
+    return obj({'rcvbuf': {'type': 'integer', 'minimum': 0}, 'sndbuf': {'type': 'integer', 'minimum': 0},
+                'user_timeout': duration(), 'dscp': dscp(),
+                'tos': {'type': ['integer', 'string'], 'description': '0-255, or a string such as "0xb8"'}})
+
+
+def schedule_entry():
+    from yourtestsrv.mqtt_server import REDIRECT_CODES
+    from yourtestsrv.schedule import ACTIONS
+    entry = obj({
+        'action': enum(ACTIONS),
+        'every': duration(),
+        'cron': {'type': 'string', 'description': 'minute hour day-of-month month day-of-week'},
+        'payload': {'anyOf': [{'type': 'string'}, payload()]},
+        'topic': {'type': 'string'}, 'qos': enum((0, 1, 2)), 'retain': {'type': 'boolean'},
+        'reference': {'type': 'string'}, 'code': enum(REDIRECT_CODES),
+        'target': {'type': 'string', 'description': 'host:port'},
+        'url': {'type': 'string'}, 'method': {'type': 'string'}, 'content_type': {'type': 'string'},
+    }, ['action'], additional=True)
+    entry['anyOf'] = [{'required': ['every']}, {'required': ['cron']}]
+    return entry
+
+
+def latency():
+    """A latency model (see shaping.Latency): a distribution string or an object with bounds."""
+    from yourtestsrv.shaping import DISTRIBUTIONS, LATENCY_REQUIRED
+    spec = {'type': 'string', 'pattern': f'^(({"|".join(DISTRIBUTIONS)})(:[^:]+)+)?$',
+            'description': "e.g. 'normal:200ms:50ms', 'uniform:100ms:300ms', 'pareto:100ms:1.5'"}
+    bounds = obj({'distribution': enum(LATENCY_REQUIRED), 'min': duration(), 'max': duration(), 'mean': duration(),
+                  'stddev': duration(), 'shape': {'type': 'number', 'exclusiveMinimum': 0}}, ['distribution'])
+    return {'anyOf': [spec, bounds], 'default': ''}
+
+
+def validator():
+    from yourtestsrv.codec import FORMATS
+    return obj({
+        'topic': {'type': 'string', 'description': 'MQTT topic filter'},
+        'json_schema': {'type': ['object', 'boolean']},
+        'json_schema_file': {'type': 'string'},
+        'cddl': {'type': 'string'},
+        'cddl_file': {'type': 'string'},
+        'rule': {'type': 'string', 'description': 'CDDL rule to check, default the first'},
+        'protobuf': {'type': 'string', 'description': 'FileDescriptorSet file (protoc --descriptor_set_out)'},
+        'message': {'type': 'string'},
+        'format': enum(FORMATS),
+        'disconnect': {'type': 'boolean', 'default': False},
+    }, ['topic'])
+
+
+def dns_record():
+    """A DNS stub record (see dns_server.py): one address, a list of them, or an object by type."""
+    addresses = [{'type': 'string'}, array({'type': 'string'})]
+    by_type = obj({'A': {'anyOf': addresses}, 'AAAA': {'anyOf': addresses}, 'CNAME': {'type': 'string'},
+                   'ttl': {'type': 'integer', 'minimum': 0}})
+    return {'anyOf': addresses + [by_type]}
+
+
+def throttle_rule():
+    from yourtestsrv.logthrottle import EVENTS
+    return obj({'event': enum(EVENTS + ('*',)), 'every': {'type': 'integer', 'minimum': 1},
+                'max_rate': {'type': 'number', 'minimum': 0}, 'summary': duration()}, ['event'])
+
+
+def _servers():
+    from yourtestsrv.acme import CHALLENGES
+    from yourtestsrv.dns_server import DOH_MODES, DOT_MODES, MODES as DNS_MODES, TYPES as DNS_TYPES
+    from yourtestsrv.bundle import EVENTS as BUNDLE_EVENTS
+    from yourtestsrv.http_proxy import CACHE_FAULTS
+    from yourtestsrv.http_server import LOCKOUT_CODES, RANGE_FAULTS
+    from yourtestsrv.mqtt_server import REDIRECT_CODES
+    from yourtestsrv.netprofiles import NAMES as NETWORK_PROFILES
+    from yourtestsrv.netutil import OVER_LIMIT_MODES, TLS_VERSIONS
+    from yourtestsrv.shaping import DISTRIBUTIONS
+    from yourtestsrv.ntrip_server import Mountpoint
+    from yourtestsrv.proxyproto import MODES as PROXY_MODES
+    from yourtestsrv.sftp_server import FAIL_MODES
+    from yourtestsrv.signing import FAULTS as SIGN_FAULTS, METHODS as SIGN_METHODS
+    from yourtestsrv.stun_server import MODES as STUN_MODES
+    from yourtestsrv.tcp_server import CLOSE_MODES
+    from yourtestsrv.udp_server import MAX_UDP_PAYLOAD
+
+    rate = {'type': ['string', 'number'], 'default': '', 'description': "e.g. '16kbps' or '2KB/s'; '' unlimited"}
+    common = {
+        'over_limit': enum(OVER_LIMIT_MODES, default='refuse'),
+        'proxy_protocol': enum(PROXY_MODES, default=''),
+        'socket_options': socket_options(),
+        'fault_rules': array(fault_rule()),
+    }
+    tcp = from_signature(config.TCPConfig, {
+        **common,
+        'latency': latency(),
+        'framing': enum(('raw', 'delim'), default='raw'),
+        'close_mode': enum(CLOSE_MODES, default='fin'),
+        'accept_close_rate': {'type': 'number', 'minimum': 0, 'maximum': 1, 'default': 0.0},
+        'accept_close_bytes': {'type': 'integer', 'minimum': 0, 'default': 0},
+        'accept_close_mode': enum(config.ACCEPT_CLOSE_MODES, default='fin'),
+        'rate_limit': rate,
+        'keepalive': {'type': ['string', 'boolean'], 'default': '',
+                      'description': "'' keeps the OS default, 'off' or a duration"},
+        'response': template(),
+        'response_capture': capture_spec(),
+        'rules': array(rule()),
+    })
+    udp = from_signature(config.UDPConfig, {
+        **common,
+        'latency': latency(),
+        'response': template(),
+        'response_capture': capture_spec(),
+        'encap_length_base': {'type': ['integer', 'null'], 'default': None},
+        'rate_limit': rate,
+        'multicast': {'type': ['array', 'string'], 'items': {'type': 'string'}, 'default': []},
+        'reorder': {'type': 'string', 'default': '', 'pattern': f'^(({"|".join(DISTRIBUTIONS)})(:[^:]+)+)?$',
+                    'description': "e.g. 'uniform:0:50ms', 'normal:20ms:10ms', 'exponential:30ms', 'pareto:10ms:1.5'"},
+        'reorder_rate': {'type': 'number', 'minimum': 0, 'maximum': 1, 'default': 1.0},
+        'stun': enum(('',) + STUN_MODES, default=''),
+        'pad_to': {'type': 'integer', 'minimum': 0, 'maximum': MAX_UDP_PAYLOAD, 'default': 0},
+        'sequence_field': {'type': 'string', 'default': '', 'pattern': r'^(\d+:\d+(:(big|little))?|json:.+|regex:.+)?$',
+                           'description': "e.g. '0:4', '2:2:little', 'json:hdr.seq', 'regex:seq=(\\d+)'"},
+    })
+    http = from_signature(config.HTTPConfig, {
+        **common,
+        'latency': latency(),
+        'range_fault': enum(RANGE_FAULTS, default=''),
+        'lockout_code': enum(LOCKOUT_CODES, default=429),
+        'sign': enum(('',) + SIGN_METHODS, default=''),
+        'sign_fault': enum(SIGN_FAULTS, default=''),
+        'cache_fault': enum(CACHE_FAULTS, default=''),
+    })
+    publish = obj({'topic': {'type': 'string'}, 'payload': payload(), 'interval': duration(default='1s'),
+                   'qos': enum((0, 1, 2)), 'retain': {'type': 'boolean'}}, ['topic', 'payload'], additional=True)
+    mqtt = from_signature(config.MQTTConfig, {
+        **common,
+        'publish': array(publish),
+        'validators': array(validator()),
+        'redirect_code': enum(REDIRECT_CODES, default='use_another_server'),
+    })
+    mountpoint = from_signature(Mountpoint, {
+        'name': {'type': 'string', 'pattern': '^[^/]+$'},
+        'messages': array({'type': 'integer'}),
+        'auth': {'type': ['string', 'null'], 'description': "user:password; null uses the caster's, '' is open"},
+    })
+    acme_schema = from_signature(config.ACMEConfig, {
+        'domains': array({'type': 'string'}),
+        'challenge': enum(CHALLENGES, default='dns-01'),
+    })
+    tls = from_signature(config.TLSConfig, {
+        'min_version': enum(('',) + tuple(TLS_VERSIONS), default=''),
+        'max_version': enum(('',) + tuple(TLS_VERSIONS), default=''),
+        'alpn': array({'type': 'string'}),
+        'acme': acme_schema,
+    })
+    servers = {
+        'tcp': tcp,
+        'udp': udp,
+        'http': http,
+        'mqtt': mqtt,
+        'stun': from_signature(config.STUNConfig, {'mode': enum(STUN_MODES, default='normal')}),
+        'icmp': from_signature(config.ICMPConfig),
+        'socks': from_signature(config.SOCKSConfig),
+        'paired': from_signature(config.PairedConfig),
+        'sftp': from_signature(config.SFTPConfig, {'fail_mode': enum(FAIL_MODES, default='error'),
+                                                   'rate_limit': rate}),
+        'ntrip': from_signature(config.NTRIPConfig, {'mountpoints': array(mountpoint)}),
+        'telnet': from_signature(config.TelnetConfig, {
+            'responses': {'type': 'object', 'additionalProperties': {'type': 'string'},
+                          'description': 'command line -> canned reply'}}),
+        'dns': from_signature(config.DNSConfig, {
+            'records': {'type': 'object', 'additionalProperties': dns_record(),
+                        'description': 'name (or *.domain) -> addresses or {"A", "AAAA", "CNAME", "ttl"}'},
+            'mode': enum(DNS_MODES, default='normal'),
+            'scenarios': array(obj({'name': {'type': 'string'}, 'type': enum(DNS_TYPES),
+                                    'mode': enum(DNS_MODES), 'rate': {'type': 'number', 'minimum': 0, 'maximum': 1},
+                                    'delay': duration()})),
+            'dot_mode': enum(('',) + DOT_MODES, default=''),
+            'doh_mode': enum(('',) + DOH_MODES, default=''),
+        }),
+        'ntp': from_signature(config.NTPConfig, {
+            'stratum': {'type': 'integer', 'minimum': 0, 'maximum': 16, 'default': 2},
+            'leap': enum((0, 1, 2, 3), default=0),
+            'refid': {'type': 'string', 'maxLength': 4, 'default': 'LOCL'},
+        }),
+        'tftp': from_signature(config.TFTPConfig, {
+            'blksize': {'type': 'integer', 'minimum': 8, 'maximum': 65464, 'default': 65464},
+            'drop_rate': {'type': 'number', 'minimum': 0, 'maximum': 1, 'default': 0.0},
+        }),
+        'syslog': from_signature(config.SyslogConfig, {'limit': {'type': 'integer', 'minimum': 1, 'default': 1000}}),
+        'tls': tls,
+        'network_profile': enum(('',) + NETWORK_PROFILES, default=''),
+    }
+    bundle = from_signature(config.BundleConfig, {'events': array(enum(BUNDLE_EVENTS))})
+    return from_signature(config.ServerConfig, servers), bundle
+
+
+def schema():
+    """The JSON Schema (a dict) of a config file as read by config.load()."""
+    server, bundle = _servers()
+    logging = obj({'level': {'type': 'string', 'default': 'info'},
+                   'throttle': array(throttle_rule())})
+    root = from_signature(config.Config, {
+        'server': server,
+        'logging': logging,
+        'admin': from_signature(config.AdminConfig),
+        'schedule': array(schedule_entry()),
+        'bundle': bundle,
+        'loadgen': from_signature(config.LoadGenConfig, {
+            'qos': enum((0, 1, 2), default=0),
+            'templates': array(obj({'payload': payload(), 'weight': {'type': 'number', 'exclusiveMinimum': 0}},
+                                   ['payload'])),
+        }),
+        'storage': {'type': 'string', 'default': 'files', 'pattern': '^(files|sqlite(:.+)?)$',
+                    'description': "'files', 'sqlite' (<state_dir>/yourtestsrv.db) or 'sqlite:PATH'"},
+    })
+    root['properties'] = {'$schema': {'type': 'string'}, **root['properties']}
+    return {'$schema': DRAFT, 'title': 'yourtestsrv configuration', **root}
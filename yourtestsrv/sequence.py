@@ -0,0 +1,193 @@
+"""Sequence-number accounting for UDP datagrams from devices.
+
+With a sequence field configured ("sequence_field" in server.udp,
+--sequence-field on the udp command) the UDP server reads a sequence
+number from every datagram and keeps, per client address, how reliably
+the device sends:
+
+  received    datagrams counted
+  lost        numbers skipped and not (yet) received late
+  gaps        jumps forward by more than one
+  duplicates  numbers received again
+  reordered   numbers received after a later one (filling a gap)
+  resets      jumps back by more than WINDOW, taken as a device restart
+  unparsable  datagrams without a readable sequence field
+
+The field is given as a string:
+
+  OFFSET:SIZE[:little]  unsigned integer of SIZE (1, 2, 4 or 8) bytes at OFFSET in
+                        the datagram as received, big-endian unless :little; it wraps
+                        around at its width, so 65535 -> 0 is not a gap
+  json:PATH             dotted path to an integer in a JSON datagram, e.g. json:hdr.seq
+  regex:PATTERN         the first group of PATTERN, a decimal number in a text datagram
+
+The counters appear in the admin /stats output under "sequence" (totals,
+plus "clients" keyed by host:port) and can be checked with --expect
+({"metric": "sequence.lost", "max": 0}). Echo replies are unaffected.
+"""
+
+import collections
+import json
+import re
+import threading
+
+# Numbers remembered per client for duplicate and late-arrival detection; a jump
+# back by more than this is a restart.
+WINDOW = 1024
+# Clients tracked per server; the least recently seen is forgotten beyond this.
+MAX_CLIENTS = 4096
+COUNTERS = ('received', 'lost', 'gaps', 'duplicates', 'reordered', 'resets', 'unparsable')
+SIZES = (1, 2, 4, 8)
+
+
+class SequenceField:
+    def __init__(self, spec):
+        self.spec = spec
+        self.offset = self.size = self.bits = self.path = self.pattern = None
+        self.little = False
+        kind, _, rest = spec.partition(':')
+        if kind == 'json':
+            if not rest:
+                raise ValueError('sequence field json: needs a path, e.g. json:seq')
+            self.path = rest.split('.')
+        elif kind == 'regex':
+            self.pattern = re.compile(rest.encode())
+            if self.pattern.groups < 1:
+                raise ValueError(f'sequence field regex needs a group: {rest!r}')
+        else:
+            parts = spec.split(':')
+            if len(parts) not in (2, 3) or len(parts) == 3 and parts[2] not in ('big', 'little'):
+                raise ValueError(f'invalid sequence field {spec!r} (use OFFSET:SIZE[:little], json:PATH or regex:RE)')
+            try:
+                self.offset, self.size = int(parts[0]), int(parts[1])
+            except ValueError:
+                raise ValueError(f'invalid sequence field {spec!r}') from None
+            if self.offset < 0 or self.size not in SIZES:
+                raise ValueError(f'invalid sequence field {spec!r}: offset >= 0, size one of {SIZES}')
+            self.little = len(parts) == 3 and parts[2] == 'little'
+            self.bits = self.size * 8
+
+    def read(self, data):
+        """The sequence number in data, or None."""
+        if self.size:
+            field = data[self.offset:self.offset + self.size]
+            if len(field) < self.size:
+                return None
+            return int.from_bytes(field, 'little' if self.little else 'big')
+        if self.pattern:
+            m = self.pattern.search(data)
+            try:
+                return int(m.group(1)) if m else None
+            except (TypeError, ValueError):
+                return None
+        try:
+            value = json.loads(data)
+            for key in self.path:
+                value = value[int(key)] if isinstance(value, list) else value[key]
+        except (ValueError, UnicodeDecodeError, KeyError, IndexError, TypeError):
+            return None
+        return value if isinstance(value, int) and not isinstance(value, bool) else None
+
+
+class ClientSequence:
+    """The counters of one client and the numbers needed to classify its next datagram."""
+
+    def __init__(self, bits=None):
+        self.modulus = 1 << bits if bits else None
+        # Narrow fields wrap quickly: remember at most half their range.
+        self.window = min(WINDOW, self.modulus // 2 - 1) if self.modulus else WINDOW
+        self.counts = dict.fromkeys(COUNTERS, 0)
+        self.last = None
+        self._seen = collections.deque()
+        self._seen_set = set()
+        self._missing = {}
+
+    def _ahead(self, seq):
+        """How far seq is past the last number, negative when behind (modulo the field width)."""
+        d = seq - self.last
+        if self.modulus:
+            d %= self.modulus
+            if d >= self.modulus // 2:
+                d -= self.modulus
+        return d
+
+    def _wrap(self, n):
+        return n % self.modulus if self.modulus else n
+
+    def _remember(self, seq):
+        self._seen.append(seq)
+        self._seen_set.add(seq)
+        if len(self._seen) > self.window:
+            self._seen_set.discard(self._seen.popleft())
+
+    def record(self, seq):
+        """Count seq; returns what it was: 'first', 'next', 'gap', 'duplicate', 'reordered' or 'reset'."""
+        self.counts['received'] += 1
+        if self.last is None:
+            self.last = seq
+            self._remember(seq)
+            return 'first'
+        ahead = self._ahead(seq)
+        if ahead < -self.window:
+            self.counts['resets'] += 1
+            self._seen.clear()
+            self._seen_set.clear()
+            self._missing.clear()
+            self.last = seq
+            self._remember(seq)
+            return 'reset'
+        if seq in self._seen_set:
+            self.counts['duplicates'] += 1
+            return 'duplicate'
+        self._remember(seq)
+        if ahead < 0:
+            self.counts['reordered'] += 1
+            if self._missing.pop(seq, None) is not None:
+                self.counts['lost'] -= 1
+            return 'reordered'
+        kind = 'next'
+        if ahead > 1:
+            kind = 'gap'
+            self.counts['gaps'] += 1
+            self.counts['lost'] += ahead - 1
+            for back in range(min(ahead - 1, self.window), 0, -1):
+                self._missing[self._wrap(seq - back)] = True
+            while len(self._missing) > self.window:
+                self._missing.pop(next(iter(self._missing)))
+        self.last = seq
+        return kind
+
+    def snapshot(self):
+        return dict(self.counts, last=self.last)
+
+
+class SequenceTracker:
+    """Per-client sequence accounting for one server; thread-safe."""
+
+    def __init__(self, field):
+        self.field = field
+        self._clients = collections.OrderedDict()
+        self._lock = threading.Lock()
+
+    def record(self, client, data):
+        """Read the sequence number of a datagram from client (a 'host:port' string) and count it.
+
+        Returns (kind, seq, client state) with kind as from ClientSequence.record or
+        'unparsable' (seq None).
+        """
+        seq = self.field.read(data)
+        with self._lock:
+            state = self._clients.pop(client, None) or ClientSequence(self.field.bits)
+            self._clients[client] = state
+            if len(self._clients) > MAX_CLIENTS:
+                self._clients.popitem(last=False)
+            if seq is None:
+                state.counts['unparsable'] += 1
+                return 'unparsable', None, state
+            return state.record(seq), seq, state
+
+    def snapshot(self):
+        with self._lock:
+            clients = {client: state.snapshot() for client, state in self._clients.items()}
+        totals = {name: sum(c[name] for c in clients.values()) for name in COUNTERS}
+        return dict(totals, clients=clients)
@@ -0,0 +1,198 @@
+"""Named sessions: groups of listeners created and torn down at runtime.
+
+A session lets several independent test runs share one long-lived process
+without restarting it. Each session owns its servers, their stop event and
+their stats; deleting the session stops the listeners and drops the stats.
+
+A session spec looks like:
+
+  {"name": "run-42", "bind": "127.0.0.1",
+   "servers": [{"type": "tcp", "port": 0, "delay": "100ms"},
+               {"type": "http", "strict": true}]}
+
+Server options use the same keys as the matching config section; "port"
+defaults to 0 so the OS picks a free port, reported back as "addr". A
+"network_profile" (see netprofiles.py) applies to the session's TCP and UDP
+servers, as it does in the config file.
+"""
+
+import threading
+
+from yourtestsrv import netprofiles, netutil, stats
+from yourtestsrv.config import HTTPConfig, MQTTConfig, TCPConfig, UDPConfig
+from yourtestsrv.http_server import HTTPServer
+from yourtestsrv.mqtt_server import MQTTServer
+from yourtestsrv.recording import SessionRecorder, SessionReplay
+from yourtestsrv.tcp_server import TCPServer
+from yourtestsrv.udp_server import UDPServer
+
+SERVER_TYPES = ('tcp', 'udp', 'http', 'mqtt')
+
+
+def build_server(kind, bind, options):
+    """Build an unstarted server of kind from config-style options."""
+    options = dict(options)
+    port = options.pop('port', 0)
+    if kind == 'tcp':
+        c = TCPConfig(port, **options)
+        return TCPServer(port, bind, c.delay, c.close_after, response=c.response, framing=c.framing,
+                         delimiter=c.delimiter, max_line_length=c.max_line_length, rate_limit=c.rate_limit,
+                         corrupt_rate=c.corrupt_rate, close_mode=c.close_mode,
+                         close_after_bytes=c.close_after_bytes, stall=c.stall, idle_timeout=c.idle_timeout,
+                         max_connections=c.max_connections, over_limit=c.over_limit,
+                         over_limit_banner=c.over_limit_banner, accept_delay=c.accept_delay,
+                         handshake_rate=c.handshake_rate, accept_rate=c.accept_rate, workers=c.workers,
+                         proxy_protocol=c.proxy_protocol,
+                         upstream=c.upstream, banner=c.banner, rules=c.rules, fault_rules=c.fault_rules,
+                         keepalive=c.keepalive, trickle_delay=c.trickle_delay, trickle_chunk=c.trickle_chunk,
+                         disconnect_rate=c.disconnect_rate, socket_options=c.socket_options,
+                         buffer_size=c.buffer_size, zero_copy=c.zero_copy, drop_link_local=c.drop_link_local,
+                         recorder=SessionRecorder(c.record) if c.record else None,
+                         replay=SessionReplay.from_store(c.replay) if c.replay else None, jitter=c.jitter,
+                         latency=c.latency, accept_close_rate=c.accept_close_rate,
+                         accept_close_bytes=c.accept_close_bytes, accept_close_mode=c.accept_close_mode,
+                         probe_idle=c.probe_idle, probe_payload=c.probe_payload, probe_timeout=c.probe_timeout)
+    if kind == 'udp':
+        c = UDPConfig(port, **options)
+        return UDPServer(port, bind, c.drop_rate, c.delay, amplify=c.amplify, amplify_cap=c.amplify_cap,
+                         outage_every=c.outage_every, outage_duration=c.outage_duration,
+                         response=c.response, encap_header=c.encap_header,
+                         encap_length_offset=c.encap_length_offset, encap_length_base=c.encap_length_base,
+                         socket_options=c.socket_options, fault_rules=c.fault_rules,
+                         reply_from_64=c.reply_from_64, drop_link_local=c.drop_link_local, multicast=c.multicast,
+                         multicast_interface=c.multicast_interface, jitter=c.jitter, rate_limit=c.rate_limit,
+                         discovery_reply=c.discovery_reply, duplicate_rate=c.duplicate_rate,
+                         duplicate_count=c.duplicate_count, duplicate_gap=c.duplicate_gap, reorder=c.reorder,
+                         reorder_rate=c.reorder_rate, sequence_field=c.sequence_field, latency=c.latency,
+                         truncate_to=c.truncate_to, pad_to=c.pad_to, stun=c.stun)
+    if kind == 'http':
+        c = HTTPConfig(port, **options)
+        return HTTPServer(port, bind, c.slow_response, c.slow_duration, c.error_code, c.chunked,
+                          date_offset=c.date_offset, break_keepalive=c.break_keepalive, strict=c.strict,
+                          range_fault=c.range_fault, accept_delay=c.accept_delay, handshake_rate=c.handshake_rate,
+                          accept_rate=c.accept_rate, workers=c.workers,
+                          proxy_protocol=c.proxy_protocol, auth=c.auth, lockout_after=c.lockout_after,
+                          lockout_duration=c.lockout_duration, lockout_code=c.lockout_code, sign=c.sign,
+                          sign_key=c.sign_key, sign_header=c.sign_header, sign_fault=c.sign_fault,
+                          fault_rules=c.fault_rules, session_ttl=c.session_ttl, session_sliding=c.session_sliding,
+                          session_login_path=c.session_login_path, session_protect=c.session_protect,
+                          socket_options=c.socket_options, capture=c.capture, latency=c.latency)
+    if kind == 'mqtt':
+        c = MQTTConfig(port, **options)
+        return MQTTServer(port, bind, c.retain, publish=c.publish, idle_timeout=c.idle_timeout,
+                          max_connections=c.max_connections, over_limit=c.over_limit,
+                          over_limit_banner=c.over_limit_banner, accept_delay=c.accept_delay,
+                          handshake_rate=c.handshake_rate, accept_rate=c.accept_rate, workers=c.workers,
+                          fault_rules=c.fault_rules, redirect=c.redirect,
+                          redirect_code=c.redirect_code, socket_options=c.socket_options,
+                          validators=c.validators, probe_idle=c.probe_idle, probe_payload=c.probe_payload,
+                          probe_timeout=c.probe_timeout)
+    raise ValueError(f'unknown server type: {kind!r}')
+
+
+class Session:
+    def __init__(self, name, servers, bind='127.0.0.1', network_profile=''):
+        self.name = name
+        self.bind = bind or '127.0.0.1'
+        self.stop_event = threading.Event()
+        self.servers = []
+        self.addrs = []
+        for spec in servers:
+            spec = dict(spec)
+            kind = spec.pop('type', None)
+            if kind not in SERVER_TYPES:
+                raise ValueError(f'unknown server type: {kind!r}')
+            try:
+                spec = netprofiles.merge(network_profile, kind, spec)
+                self.servers.append((kind, build_server(kind, self.bind, spec)))
+            except TypeError as e:
+                raise ValueError(f'invalid {kind} options: {e}')
+
+    def start(self):
+        """Bind every listener, then serve them in background threads.
+
+        Binding happens before returning so addresses are known to the caller.
+        If any bind fails, the listeners already opened are closed again.
+        """
+        socks = []
+        try:
+            for kind, srv in self.servers:
+                if kind == 'udp':
+                    socks.append(netutil.bind_udp(self.bind, srv.port))
+                else:
+                    socks.append(netutil.listen_tcp(self.bind, srv.port))
+        except OSError:
+            for sock in socks:
+                sock.close()
+            raise
+        for (kind, srv), sock in zip(self.servers, socks):
+            self.addrs.append(sock.getsockname())
+            srv.port = sock.getsockname()[1]
+            target = srv.serve_udp if kind == 'udp' else srv.serve
+            threading.Thread(target=target, args=(self.stop_event, sock), daemon=True,
+                             name=f'session-{self.name}-{kind}-{srv.port}').start()
+
+    def stop(self):
+        self.stop_event.set()
+        for kind, srv in self.servers:
+            stats.unregister(srv.stats_key)
+
+    def mqtt_servers(self):
+        return [srv for kind, srv in self.servers if kind == 'mqtt']
+
+    def snapshot(self):
+        listeners = []
+        for (kind, srv), addr in zip(self.servers, self.addrs):
+            host, port = addr[:2]
+            listeners.append({
+                'type': kind,
+                'addr': f'[{host}]:{port}' if ':' in host else f'{host}:{port}',
+                'stats': srv.stats.snapshot(),
+            })
+        return {'name': self.name, 'listeners': listeners}
+
+
+class SessionManager:
+    def __init__(self):
+        self._lock = threading.Lock()
+        self._sessions = {}
+
+    def create(self, spec):
+        """Create and start a session; raises ValueError for bad specs or duplicates."""
+        name = spec.get('name')
+        if not name or not isinstance(name, str):
+            raise ValueError('session needs a "name"')
+        session = Session(name, spec.get('servers', []), spec.get('bind', '127.0.0.1'),
+                          spec.get('network_profile', ''))
+        with self._lock:
+            if name in self._sessions:
+                raise ValueError(f'session already exists: {name!r}')
+            self._sessions[name] = session
+        try:
+            session.start()
+        except OSError:
+            with self._lock:
+                self._sessions.pop(name, None)
+            raise
+        return session
+
+    def get(self, name):
+        with self._lock:
+            return self._sessions.get(name)
+
+    def list(self):
+        with self._lock:
+            return list(self._sessions.values())
+
+    def delete(self, name):
+        with self._lock:
+            session = self._sessions.pop(name, None)
+        if session:
+            session.stop()
+        return session
+
+    def close_all(self):
+        with self._lock:
+            sessions, self._sessions = list(self._sessions.values()), {}
+        for session in sessions:
+            session.stop()
@@ -0,0 +1,1020 @@
+"""SFTP and SCP mock: a minimal SSH server serving one directory, with transfer faults.
+
+Runs as a TCPServer handler (like the SOCKS proxy), so connection limits,
+accept pacing and stats come from the TCP server. The SSH side is the
+smallest set a stock OpenSSH client negotiates by default: curve25519-sha256
+key exchange, an ssh-ed25519 host key and chacha20-poly1305@openssh.com
+(see sshcrypto.py). Clients authenticate with a password, or with nothing
+when no password is configured. A session channel serves either the "sftp"
+subsystem (SFTP version 3) or an exec of "scp -t" / "scp -f" (the legacy
+protocol, `scp -O` on OpenSSH 9+). Paths are confined to the root directory.
+
+Faults:
+
+  delay                before every file read/write reply (SFTP) and every file (SCP)
+  rate_limit           shape file data in both directions to this many bytes/s
+  fail_upload_after    fail an upload once this many bytes of the file are written
+  fail_download_after  fail a download once this many bytes of the file are sent
+  fail_mode            how a transfer fails: error (an SFTP/SCP error reply),
+                       disconnect (drop the TCP connection) or stall (stop answering)
+  read_only            refuse every change with permission denied
+"""
+
+import hashlib
+import logging
+import os
+import posixpath
+import shlex
+import stat
+import struct
+import time
+
+from yourtestsrv import clock as clock_module
+from yourtestsrv.shaping import TokenBucket
+from yourtestsrv.socks_server import recv_exact
+from yourtestsrv.sshcrypto import X25519_BASE, ChaChaPoly, Ed25519Key, fingerprint, x25519
+
+logger = logging.getLogger(__name__)
+
+VERSION = 'SSH-2.0-yourtestsrv'
+FAIL_MODES = ('error', 'disconnect', 'stall')
+
+MSG_DISCONNECT = 1
+MSG_IGNORE = 2
+MSG_UNIMPLEMENTED = 3
+MSG_DEBUG = 4
+MSG_SERVICE_REQUEST = 5
+MSG_SERVICE_ACCEPT = 6
+MSG_KEXINIT = 20
+MSG_NEWKEYS = 21
+MSG_KEX_ECDH_INIT = 30
+MSG_KEX_ECDH_REPLY = 31
+MSG_USERAUTH_REQUEST = 50
+MSG_USERAUTH_FAILURE = 51
+MSG_USERAUTH_SUCCESS = 52
+MSG_GLOBAL_REQUEST = 80
+MSG_REQUEST_FAILURE = 82
+MSG_CHANNEL_OPEN = 90
+MSG_CHANNEL_OPEN_CONFIRMATION = 91
+MSG_CHANNEL_OPEN_FAILURE = 92
+MSG_CHANNEL_WINDOW_ADJUST = 93
+MSG_CHANNEL_DATA = 94
+MSG_CHANNEL_EXTENDED_DATA = 95
+MSG_CHANNEL_EOF = 96
+MSG_CHANNEL_CLOSE = 97
+MSG_CHANNEL_REQUEST = 98
+MSG_CHANNEL_SUCCESS = 99
+MSG_CHANNEL_FAILURE = 100
+
+DISCONNECT_PROTOCOL_ERROR = 2
+DISCONNECT_KEY_EXCHANGE_FAILED = 3
+DISCONNECT_NO_MORE_AUTH_METHODS = 14
+OPEN_UNKNOWN_CHANNEL_TYPE = 3
+
+KEX_ALGORITHMS = ('curve25519-sha256', 'curve25519-sha256@libssh.org')
+HOST_KEY_ALGORITHM = 'ssh-ed25519'
+CIPHER = 'chacha20-poly1305@openssh.com'
+MAX_PACKET = 256 * 1024
+WINDOW = 2 * 1024 * 1024
+CHUNK = 32 * 1024
+MAX_AUTH_ATTEMPTS = 10
+
+FXP_INIT = 1
+FXP_VERSION = 2
+FXP_OPEN = 3
+FXP_CLOSE = 4
+FXP_READ = 5
+FXP_WRITE = 6
+FXP_LSTAT = 7
+FXP_FSTAT = 8
+FXP_SETSTAT = 9
+FXP_FSETSTAT = 10
+FXP_OPENDIR = 11
+FXP_READDIR = 12
+FXP_REMOVE = 13
+FXP_MKDIR = 14
+FXP_RMDIR = 15
+FXP_REALPATH = 16
+FXP_STAT = 17
+FXP_RENAME = 18
+FXP_STATUS = 101
+FXP_HANDLE = 102
+FXP_DATA = 103
+FXP_NAME = 104
+FXP_ATTRS = 105
+
+FX_OK = 0
+FX_EOF = 1
+FX_NO_SUCH_FILE = 2
+FX_PERMISSION_DENIED = 3
+FX_FAILURE = 4
+FX_BAD_MESSAGE = 5
+FX_OP_UNSUPPORTED = 8
+
+FXF_READ = 0x01
+FXF_WRITE = 0x02
+FXF_APPEND = 0x04
+FXF_CREAT = 0x08
+FXF_TRUNC = 0x10
+FXF_EXCL = 0x20
+
+ATTR_SIZE = 0x01
+ATTR_UIDGID = 0x02
+ATTR_PERMISSIONS = 0x04
+ATTR_ACMODTIME = 0x08
+ATTR_EXTENDED = 0x80000000
+
+
+class SSHError(Exception):
+    pass
+
+
+class SCPError(Exception):
+    pass
+
+
+class Disconnect(Exception):
+    """Raised by a fault to drop the TCP connection without a goodbye."""
+
+
+def sha256(data):
+    return hashlib.sha256(data).digest()
+
+
+def pack_string(data):
+    if isinstance(data, str):
+        data = data.encode()
+    return struct.pack('>I', len(data)) + data
+
+
+def pack_mpint(n):
+    return pack_string(n.to_bytes((n.bit_length() + 8) // 8, 'big') if n else b'')
+
+
+class Reader:
+    """Sequential decoder for SSH and SFTP wire fields."""
+
+    def __init__(self, data):
+        self.data = data
+        self.pos = 0
+
+    def take(self, n):
+        if self.pos + n > len(self.data):
+            raise SSHError('truncated message')
+        chunk = self.data[self.pos:self.pos + n]
+        self.pos += n
+        return chunk
+
+    def byte(self):
+        return self.take(1)[0]
+
+    def bool(self):
+        return self.byte() != 0
+
+    def uint32(self):
+        return struct.unpack('>I', self.take(4))[0]
+
+    def uint64(self):
+        return struct.unpack('>Q', self.take(8))[0]
+
+    def string(self):
+        return self.take(self.uint32())
+
+    def text(self):
+        return self.string().decode('utf-8', errors='replace')
+
+    def name_list(self):
+        text = self.text()
+        return text.split(',') if text else []
+
+
+def load_host_key(path=''):
+    """The server's Ed25519 host key; kept in path (the hex seed) so clients see the same key across restarts."""
+    if not path:
+        return Ed25519Key()
+    try:
+        with open(path) as f:
+            return Ed25519Key(bytes.fromhex(f.read().strip()))
+    except FileNotFoundError:
+        key = Ed25519Key()
+        with open(path, 'w') as f:
+            f.write(key.seed.hex() + '\n')
+        return key
+
+
+class FileFaults:
+    def __init__(self, delay=0.0, rate_limit=0.0, fail_upload_after=0, fail_download_after=0, fail_mode='error',
+                 read_only=False):
+        if fail_mode not in FAIL_MODES:
+            raise ValueError(f'unknown sftp fail_mode: {fail_mode!r} (use one of {", ".join(FAIL_MODES)})')
+        self.delay = delay
+        self.rate_limit = rate_limit
+        self.fail_upload_after = fail_upload_after
+        self.fail_download_after = fail_download_after
+        self.fail_mode = fail_mode
+        self.read_only = read_only
+
+    @staticmethod
+    def limit(after, offset, size):
+        """How many of size bytes at offset may pass before the fault; None when there is no fault."""
+        if not after or offset + size <= after:
+            return None
+        return max(0, after - offset)
+
+
+class Channel:
+    """A session channel; reads and writes pump the transport until they can proceed."""
+
+    def __init__(self, transport, local_id, remote_id, window, max_packet):
+        self.transport = transport
+        self.local_id = local_id
+        self.remote_id = remote_id
+        self.remote_window = window
+        self.max_packet = max(1, min(max_packet, CHUNK))
+        self.local_window = WINDOW
+        self.buffer = bytearray()
+        self.eof = False
+        self.closed = False
+        self.close_sent = False
+
+    def read(self, n):
+        """Up to n bytes; b'' once the client sent EOF."""
+        while not self.buffer and not (self.eof or self.closed):
+            self.transport.pump()
+        data = bytes(self.buffer[:n])
+        del self.buffer[:n]
+        return data
+
+    def read_exact(self, n):
+        data = b''
+        while len(data) < n:
+            chunk = self.read(n - len(data))
+            if not chunk:
+                raise EOFError('channel closed')
+            data += chunk
+        return data
+
+    def read_line(self, limit=4096):
+        line = b''
+        while not line.endswith(b'\n'):
+            if len(line) >= limit:
+                raise SSHError('line too long')
+            chunk = self.read(1)
+            if not chunk:
+                raise EOFError('channel closed')
+            line += chunk
+        return line[:-1]
+
+    def write(self, data):
+        while data:
+            while self.remote_window <= 0:
+                if self.closed:
+                    raise EOFError('channel closed')
+                self.transport.pump()
+            n = min(len(data), self.remote_window, self.max_packet)
+            self.transport.send(struct.pack('>BI', MSG_CHANNEL_DATA, self.remote_id) + pack_string(data[:n]))
+            self.remote_window -= n
+            data = data[n:]
+
+    def received(self, data):
+        self.buffer += data
+        self.local_window -= len(data)
+        if self.local_window < WINDOW // 2:
+            self.transport.send(struct.pack('>BII', MSG_CHANNEL_WINDOW_ADJUST, self.remote_id,
+                                            WINDOW - self.local_window))
+            self.local_window = WINDOW
+
+    def request(self, name, payload=b''):
+        self.transport.send(struct.pack('>BI', MSG_CHANNEL_REQUEST, self.remote_id) + pack_string(name) + b'\x00'
+                            + payload)
+
+    def finish(self, status):
+        """Report the exit status and close our side."""
+        if self.closed:
+            return
+        self.request('exit-status', struct.pack('>I', status))
+        self.transport.send(struct.pack('>BI', MSG_CHANNEL_EOF, self.remote_id))
+        self.close()
+
+    def close(self):
+        if not self.close_sent:
+            self.close_sent = True
+            self.transport.send(struct.pack('>BI', MSG_CHANNEL_CLOSE, self.remote_id))
+
+
+class SSHTransport:
+    """One SSH connection: key exchange, user auth and the session channels."""
+
+    def __init__(self, conn, addr, host_key, username='', password='', on_session=None):
+        self.conn = conn
+        self.addr = addr
+        self.host_key = host_key
+        self.username = username
+        self.password = password
+        self.on_session = on_session
+        self.session_id = None
+        self.channels = {}
+        self._next_channel = 0
+        self._busy = False
+        self._in_seq = 0
+        self._out_seq = 0
+        self._in_cipher = None
+        self._out_cipher = None
+        self._client_version = b''
+
+    def host_key_blob(self):
+        return pack_string(HOST_KEY_ALGORITHM) + pack_string(self.host_key.public)
+
+    def send(self, payload):
+        pad = 8 - (len(payload) + (1 if self._out_cipher else 5)) % 8
+        if pad < 4:
+            pad += 8
+        packet = struct.pack('>IB', len(payload) + pad + 1, pad) + payload + os.urandom(pad)
+        if self._out_cipher:
+            packet = self._out_cipher.encrypt(self._out_seq, packet)
+        self._out_seq = (self._out_seq + 1) & 0xffffffff
+        self.conn.sendall(packet)
+
+    def read_packet(self):
+        head = recv_exact(self.conn, 4)
+        if self._in_cipher:
+            length = self._in_cipher.decrypt_length(self._in_seq, head)
+        else:
+            length = struct.unpack('>I', head)[0]
+        if not 5 <= length <= MAX_PACKET + 1024:
+            raise SSHError(f'bad packet length {length}')
+        if self._in_cipher:
+            body = recv_exact(self.conn, length + ChaChaPoly.TAG_SIZE)
+            try:
+                plain = self._in_cipher.decrypt(self._in_seq, head, body[:length], body[length:])
+            except ValueError as e:
+                raise SSHError(str(e))
+        else:
+            plain = recv_exact(self.conn, length)
+        self._in_seq = (self._in_seq + 1) & 0xffffffff
+        return plain[1:length - plain[0]]
+
+    def disconnect(self, reason, description):
+        try:
+            self.send(struct.pack('>BI', MSG_DISCONNECT, reason) + pack_string(description) + pack_string(''))
+        except OSError:
+            pass
+        raise SSHError(description)
+
+    def expect(self, msg_type):
+        while True:
+            payload = self.read_packet()
+            if not payload:
+                raise SSHError('empty packet')
+            if payload[0] in (MSG_IGNORE, MSG_DEBUG, MSG_UNIMPLEMENTED):
+                continue
+            if payload[0] == MSG_DISCONNECT:
+                raise EOFError('client disconnected')
+            if payload[0] != msg_type:
+                self.disconnect(DISCONNECT_PROTOCOL_ERROR, f'expected message {msg_type}, got {payload[0]}')
+            return payload
+
+    def handshake(self):
+        self.conn.sendall(VERSION.encode() + b'\r\n')
+        for _ in range(50):
+            line = b''
+            while not line.endswith(b'\n'):
+                if len(line) > 255:
+                    raise SSHError('version line too long')
+                line += recv_exact(self.conn, 1)
+            if line.startswith(b'SSH-'):
+                self._client_version = line.rstrip(b'\r\n')
+                break
+        else:
+            raise SSHError('no SSH version line')
+        if not self._client_version.startswith(b'SSH-2.0-'):
+            raise SSHError(f'unsupported version {self._client_version!r}')
+        self.key_exchange()
+
+    def _kexinit(self):
+        lists = [','.join(KEX_ALGORITHMS), HOST_KEY_ALGORITHM, CIPHER, CIPHER, 'hmac-sha2-256', 'hmac-sha2-256',
+                 'none', 'none', '', '']
+        return bytes([MSG_KEXINIT]) + os.urandom(16) + b''.join(pack_string(s) for s in lists) + b'\x00' + bytes(4)
+
+    def _negotiate(self, client_kexinit):
+        r = Reader(client_kexinit)
+        r.take(17)
+        lists = [r.name_list() for _ in range(8)]
+        offers = (KEX_ALGORITHMS, (HOST_KEY_ALGORITHM,), (CIPHER,), (CIPHER,), None, None, ('none',), ('none',))
+        for client, server in zip(lists, offers):
+            if server is not None and not any(name in server for name in client):
+                self.disconnect(DISCONNECT_KEY_EXCHANGE_FAILED,
+                                f'no common algorithm: client offers {",".join(client)}, server {",".join(server)}')
+
+    def key_exchange(self, client_kexinit=None):
+        server_kexinit = self._kexinit()
+        self.send(server_kexinit)
+        if client_kexinit is None:
+            client_kexinit = self.expect(MSG_KEXINIT)
+        self._negotiate(client_kexinit)
+        client_public = Reader(self.expect(MSG_KEX_ECDH_INIT)[1:]).string()
+        if len(client_public) != 32:
+            self.disconnect(DISCONNECT_KEY_EXCHANGE_FAILED, 'bad curve25519 public key')
+        secret = os.urandom(32)
+        server_public = x25519(secret, X25519_BASE)
+        shared = x25519(secret, client_public)
+        if shared == bytes(32):
+            self.disconnect(DISCONNECT_KEY_EXCHANGE_FAILED, 'degenerate curve25519 key')
+        k = pack_mpint(int.from_bytes(shared, 'big'))
+        blob = self.host_key_blob()
+        h = sha256(pack_string(self._client_version) + pack_string(VERSION) + pack_string(client_kexinit)
+                           + pack_string(server_kexinit) + pack_string(blob) + pack_string(client_public)
+                           + pack_string(server_public) + k)
+        if self.session_id is None:
+            self.session_id = h
+        signature = pack_string(HOST_KEY_ALGORITHM) + pack_string(self.host_key.sign(h))
+        self.send(bytes([MSG_KEX_ECDH_REPLY]) + pack_string(blob) + pack_string(server_public)
+                  + pack_string(signature))
+        self.send(bytes([MSG_NEWKEYS]))
+        self._out_cipher = ChaChaPoly(self._derive(b'D', k, h))
+        self.expect(MSG_NEWKEYS)
+        self._in_cipher = ChaChaPoly(self._derive(b'C', k, h))
+
+    def _derive(self, letter, k, h, size=64):
+        key = sha256(k + h + letter + self.session_id)
+        while len(key) < size:
+            key += sha256(k + h + key)
+        return key[:size]
+
+    def authenticate(self):
+        """Run the ssh-userauth service; returns the user name."""
+        service = Reader(self.expect(MSG_SERVICE_REQUEST)[1:]).text()
+        if service != 'ssh-userauth':
+            self.disconnect(DISCONNECT_PROTOCOL_ERROR, f'unsupported service {service}')
+        self.send(bytes([MSG_SERVICE_ACCEPT]) + pack_string(service))
+        for _ in range(MAX_AUTH_ATTEMPTS):
+            r = Reader(self.expect(MSG_USERAUTH_REQUEST)[1:])
+            user, _, method = r.text(), r.text(), r.text()
+            if self.username and user != self.username:
+                ok = False
+            elif method == 'none':
+                ok = not self.password
+            elif method == 'password':
+                r.bool()
+                ok = r.text() == self.password
+            else:
+                ok = False
+            if ok:
+                self.send(bytes([MSG_USERAUTH_SUCCESS]))
+                return user
+            if method == 'password':
+                logger.info(f'SSH login {user!r} from {self.addr} rejected')
+            self.send(bytes([MSG_USERAUTH_FAILURE]) + pack_string('password') + b'\x00')
+        self.disconnect(DISCONNECT_NO_MORE_AUTH_METHODS, 'too many authentication failures')
+
+    def serve(self):
+        """Answer connection-protocol messages until the client disconnects."""
+        while True:
+            self.pump()
+
+    def pump(self):
+        """Read and handle one message."""
+        seq = self._in_seq
+        payload = self.read_packet()
+        if not payload:
+            raise SSHError('empty packet')
+        msg = payload[0]
+        r = Reader(payload[1:])
+        if msg == MSG_DISCONNECT:
+            raise EOFError('client disconnected')
+        if msg in (MSG_IGNORE, MSG_DEBUG, MSG_UNIMPLEMENTED, MSG_USERAUTH_REQUEST):
+            return
+        if msg == MSG_KEXINIT:
+            self.key_exchange(payload)
+        elif msg == MSG_GLOBAL_REQUEST:
+            r.text()
+            if r.bool():
+                self.send(bytes([MSG_REQUEST_FAILURE]))
+        elif msg == MSG_CHANNEL_OPEN:
+            self._open_channel(r)
+        elif MSG_CHANNEL_WINDOW_ADJUST <= msg <= MSG_CHANNEL_FAILURE:
+            channel = self.channels.get(r.uint32())
+            if channel is not None:
+                self._channel_message(channel, msg, r)
+        else:
+            self.send(struct.pack('>BI', MSG_UNIMPLEMENTED, seq))
+
+    def _open_channel(self, r):
+        kind, remote_id, window, max_packet = r.text(), r.uint32(), r.uint32(), r.uint32()
+        if kind != 'session':
+            self.send(struct.pack('>BII', MSG_CHANNEL_OPEN_FAILURE, remote_id, OPEN_UNKNOWN_CHANNEL_TYPE)
+                      + pack_string(f'unsupported channel type {kind}') + pack_string(''))
+            return
+        channel = Channel(self, self._next_channel, remote_id, window, max_packet)
+        self.channels[channel.local_id] = channel
+        self._next_channel += 1
+        self.send(struct.pack('>BIIII', MSG_CHANNEL_OPEN_CONFIRMATION, remote_id, channel.local_id, WINDOW, CHUNK))
+
+    def _channel_message(self, channel, msg, r):
+        if msg == MSG_CHANNEL_WINDOW_ADJUST:
+            channel.remote_window += r.uint32()
+        elif msg == MSG_CHANNEL_DATA:
+            channel.received(r.string())
+        elif msg == MSG_CHANNEL_EXTENDED_DATA:
+            r.uint32()
+            channel.local_window -= len(r.string())
+        elif msg == MSG_CHANNEL_EOF:
+            channel.eof = True
+        elif msg == MSG_CHANNEL_CLOSE:
+            channel.closed = True
+            channel.close()
+            del self.channels[channel.local_id]
+        elif msg == MSG_CHANNEL_REQUEST:
+            name, want_reply = r.text(), r.bool()
+            command = None
+            if name == 'subsystem' and r.text() == 'sftp':
+                command = 'sftp'
+            elif name == 'exec':
+                command = r.text()
+            ok = command is not None and not self._busy and self.on_session is not None
+            if want_reply:
+                self.send(struct.pack('>BI', MSG_CHANNEL_SUCCESS if ok else MSG_CHANNEL_FAILURE, channel.remote_id))
+            if ok:
+                self._busy = True
+                try:
+                    status = self.on_session(channel, command)
+                finally:
+                    self._busy = False
+                channel.finish(status)
+
+
+def attrs_of(st):
+    return struct.pack('>IQIIIII', ATTR_SIZE | ATTR_UIDGID | ATTR_PERMISSIONS | ATTR_ACMODTIME, st.st_size,
+                       st.st_uid, st.st_gid, st.st_mode, int(st.st_atime), int(st.st_mtime))
+
+
+def read_attrs(r):
+    """The fields we act on from an SFTP ATTRS block: size, permissions, (atime, mtime)."""
+    flags = r.uint32()
+    size = r.uint64() if flags & ATTR_SIZE else None
+    if flags & ATTR_UIDGID:
+        r.uint32(), r.uint32()
+    mode = r.uint32() if flags & ATTR_PERMISSIONS else None
+    times = (r.uint32(), r.uint32()) if flags & ATTR_ACMODTIME else None
+    if flags & ATTR_EXTENDED:
+        for _ in range(r.uint32()):
+            r.string(), r.string()
+    return size, mode, times
+
+
+def long_name(name, st):
+    when = time.strftime('%b %d %H:%M', time.localtime(st.st_mtime))
+    return f'{stat.filemode(st.st_mode)} {st.st_nlink:4d} {st.st_uid:<8d} {st.st_gid:<8d} {st.st_size:8d} {when} {name}'
+
+
+class FileRoot:
+    """Maps client paths onto the served directory; '/' is the root and nothing escapes it."""
+
+    def __init__(self, root):
+        self.root = os.path.realpath(root)
+
+    def virtual(self, path):
+        path = posixpath.normpath(posixpath.join('/', path))
+        return '/' + path.lstrip('/')
+
+    def local(self, path):
+        local = os.path.join(self.root, self.virtual(path).lstrip('/'))
+        real = os.path.realpath(local)
+        if real != self.root and not real.startswith(self.root + os.sep):
+            raise PermissionError(f'{path}: outside the served directory')
+        return local
+
+
+class SFTPSession:
+    """SFTP version 3 over a channel, against a FileRoot."""
+
+    def __init__(self, channel, root, faults, addr='', clock=None):
+        self.channel = channel
+        self.root = root
+        self.faults = faults
+        self.addr = addr
+        self.clock = clock_module.get(clock)
+        self.bucket = TokenBucket(faults.rate_limit, clock=self.clock) if faults.rate_limit > 0 else None
+        self.handles = {}
+        self._next_handle = 0
+        self.stalled = False
+
+    def run(self):
+        """Serve requests until the client closes the channel; returns the exit status."""
+        try:
+            while True:
+                head = self.channel.read(4)
+                if not head:
+                    return 0
+                head += self.channel.read_exact(4 - len(head))
+                length = struct.unpack('>I', head)[0]
+                if not 1 <= length <= MAX_PACKET + 1024:
+                    raise SSHError(f'bad sftp packet length {length}')
+                packet = self.channel.read_exact(length)
+                if not self.stalled:
+                    self.dispatch(packet)
+        finally:
+            for handle in self.handles.values():
+                if handle['file'] is not None:
+                    handle['file'].close()
+
+    def send(self, msg, payload):
+        data = bytes([msg]) + payload
+        self.channel.write(struct.pack('>I', len(data)) + data)
+
+    def status(self, rid, code, message=''):
+        self.send(FXP_STATUS, struct.pack('>II', rid, code) + pack_string(message) + pack_string('en'))
+
+    def dispatch(self, packet):
+        r = Reader(packet)
+        msg = r.byte()
+        if msg == FXP_INIT:
+            self.send(FXP_VERSION, struct.pack('>I', 3))
+            return
+        rid = r.uint32()
+        handler = self.HANDLERS.get(msg)
+        if handler is None:
+            self.status(rid, FX_OP_UNSUPPORTED, f'unsupported request {msg}')
+            return
+        try:
+            handler(self, rid, r)
+        except FileNotFoundError as e:
+            self.status(rid, FX_NO_SUCH_FILE, e.strerror or str(e))
+        except PermissionError as e:
+            self.status(rid, FX_PERMISSION_DENIED, e.strerror or str(e))
+        except OSError as e:
+            self.status(rid, FX_FAILURE, e.strerror or str(e))
+        except (SSHError, KeyError):
+            self.status(rid, FX_BAD_MESSAGE, 'bad message')
+
+    def _writable(self):
+        if self.faults.read_only:
+            raise PermissionError(1, 'read-only server')
+
+    def _handle(self, r):
+        return self.handles[r.string()]
+
+    def _new_handle(self, entry):
+        handle = str(self._next_handle).encode()
+        self._next_handle += 1
+        self.handles[handle] = entry
+        return handle
+
+    def _fault(self, rid, direction, path):
+        mode = self.faults.fail_mode
+        logger.info(f'SFTP {direction} of {path} from {self.addr} failed by scenario ({mode})')
+        if mode == 'disconnect':
+            raise Disconnect(f'{direction} fault')
+        if mode == 'stall':
+            self.stalled = True
+            return
+        self.status(rid, FX_FAILURE, f'injected {direction} fault')
+
+    def _paced(self, n):
+        if self.faults.delay > 0:
+            self.clock.sleep(self.faults.delay)
+        if self.bucket is not None:
+            self.bucket.consume(n)
+
+    def do_open(self, rid, r):
+        path, pflags = r.text(), r.uint32()
+        _, mode, _ = read_attrs(r)
+        flags = 0
+        if pflags & FXF_WRITE:
+            self._writable()
+            flags = os.O_RDWR if pflags & FXF_READ else os.O_WRONLY
+        flags |= (os.O_CREAT if pflags & FXF_CREAT else 0) | (os.O_TRUNC if pflags & FXF_TRUNC else 0)
+        flags |= (os.O_EXCL if pflags & FXF_EXCL else 0) | (os.O_APPEND if pflags & FXF_APPEND else 0)
+        fd = os.open(self.root.local(path), flags | getattr(os, 'O_BINARY', 0), (mode or 0o644) & 0o7777)
+        f = os.fdopen(fd, 'r+b' if flags & os.O_RDWR else 'wb' if pflags & FXF_WRITE else 'rb')
+        entry = {'file': f, 'path': self.root.virtual(path), 'written': 0, 'sent': 0}
+        self.send(FXP_HANDLE, struct.pack('>I', rid) + pack_string(self._new_handle(entry)))
+
+    def do_close(self, rid, r):
+        handle = r.string()
+        entry = self.handles.pop(handle)
+        if entry['file'] is not None:
+            entry['file'].close()
+            if entry['written']:
+                logger.info(f'SFTP upload {entry["path"]} ({entry["written"]} bytes) from {self.addr}')
+            elif entry['sent']:
+                logger.info(f'SFTP download {entry["path"]} ({entry["sent"]} bytes) to {self.addr}')
+        self.status(rid, FX_OK)
+
+    def do_read(self, rid, r):
+        entry = self._handle(r)
+        offset, size = r.uint64(), min(r.uint32(), MAX_PACKET)
+        entry['file'].seek(offset)
+        data = entry['file'].read(size)
+        allowed = FileFaults.limit(self.faults.fail_download_after, offset, len(data))
+        if allowed == 0:
+            self._fault(rid, 'download', entry['path'])
+            return
+        if allowed is not None:
+            data = data[:allowed]
+        if not data:
+            self.status(rid, FX_EOF)
+            return
+        self._paced(len(data))
+        entry['sent'] += len(data)
+        self.send(FXP_DATA, struct.pack('>I', rid) + pack_string(data))
+
+    def do_write(self, rid, r):
+        entry = self._handle(r)
+        offset, data = r.uint64(), r.string()
+        allowed = FileFaults.limit(self.faults.fail_upload_after, offset, len(data))
+        self._paced(len(data))
+        f = entry['file']
+        f.seek(offset)
+        f.write(data if allowed is None else data[:allowed])
+        f.flush()
+        entry['written'] += len(data) if allowed is None else allowed
+        if allowed is not None:
+            self._fault(rid, 'upload', entry['path'])
+            return
+        self.status(rid, FX_OK)
+
+    def _stat(self, rid, st):
+        self.send(FXP_ATTRS, struct.pack('>I', rid) + attrs_of(st))
+
+    def do_stat(self, rid, r):
+        self._stat(rid, os.stat(self.root.local(r.text())))
+
+    def do_lstat(self, rid, r):
+        self._stat(rid, os.lstat(self.root.local(r.text())))
+
+    def do_fstat(self, rid, r):
+        self._stat(rid, os.fstat(self._handle(r)['file'].fileno()))
+
+    def _apply_attrs(self, path, r):
+        size, mode, times = read_attrs(r)
+        if size is not None:
+            os.truncate(path, size)
+        if mode is not None:
+            os.chmod(path, mode & 0o7777)
+        if times is not None:
+            os.utime(path, times)
+
+    def do_setstat(self, rid, r):
+        self._writable()
+        self._apply_attrs(self.root.local(r.text()), r)
+        self.status(rid, FX_OK)
+
+    def do_fsetstat(self, rid, r):
+        self._writable()
+        entry = self._handle(r)
+        entry['file'].flush()
+        self._apply_attrs(self.root.local(entry['path']), r)
+        self.status(rid, FX_OK)
+
+    def do_opendir(self, rid, r):
+        path = r.text()
+        local = self.root.local(path)
+        names = ['.', '..'] + sorted(os.listdir(local))
+        entry = {'file': None, 'path': self.root.virtual(path), 'local': local, 'names': names}
+        self.send(FXP_HANDLE, struct.pack('>I', rid) + pack_string(self._new_handle(entry)))
+
+    def do_readdir(self, rid, r):
+        entry = self._handle(r)
+        batch, entry['names'] = entry['names'][:100], entry['names'][100:]
+        if not batch:
+            self.status(rid, FX_EOF)
+            return
+        out = []
+        for name in batch:
+            try:
+                st = os.lstat(os.path.join(entry['local'], name))
+            except OSError:
+                continue
+            out.append(pack_string(name) + pack_string(long_name(name, st)) + attrs_of(st))
+        self.send(FXP_NAME, struct.pack('>II', rid, len(out)) + b''.join(out))
+
+    def do_remove(self, rid, r):
+        self._writable()
+        os.remove(self.root.local(r.text()))
+        self.status(rid, FX_OK)
+
+    def do_mkdir(self, rid, r):
+        self._writable()
+        path = r.text()
+        _, mode, _ = read_attrs(r)
+        os.mkdir(self.root.local(path), (mode or 0o755) & 0o7777)
+        self.status(rid, FX_OK)
+
+    def do_rmdir(self, rid, r):
+        self._writable()
+        os.rmdir(self.root.local(r.text()))
+        self.status(rid, FX_OK)
+
+    def do_realpath(self, rid, r):
+        path = self.root.virtual(r.text())
+        self.send(FXP_NAME, struct.pack('>II', rid, 1) + pack_string(path) + pack_string(path) + bytes(4))
+
+    def do_rename(self, rid, r):
+        self._writable()
+        old, new = self.root.local(r.text()), self.root.local(r.text())
+        if os.path.exists(new):
+            raise FileExistsError(17, 'target exists')
+        os.rename(old, new)
+        self.status(rid, FX_OK)
+
+    HANDLERS = {FXP_OPEN: do_open, FXP_CLOSE: do_close, FXP_READ: do_read, FXP_WRITE: do_write,
+                FXP_LSTAT: do_lstat, FXP_FSTAT: do_fstat, FXP_SETSTAT: do_setstat, FXP_FSETSTAT: do_fsetstat,
+                FXP_OPENDIR: do_opendir, FXP_READDIR: do_readdir, FXP_REMOVE: do_remove, FXP_MKDIR: do_mkdir,
+                FXP_RMDIR: do_rmdir, FXP_REALPATH: do_realpath, FXP_STAT: do_stat, FXP_RENAME: do_rename}
+
+
+class SCPSession:
+    """The legacy scp protocol: `scp -t` receives files, `scp -f` sends them."""
+
+    def __init__(self, channel, root, faults, args, addr='', clock=None):
+        self.channel = channel
+        self.root = root
+        self.faults = faults
+        self.addr = addr
+        self.clock = clock_module.get(clock)
+        self.bucket = TokenBucket(faults.rate_limit, clock=self.clock) if faults.rate_limit > 0 else None
+        self.sink = '-t' in args
+        self.recursive = '-r' in args
+        self.preserve = '-p' in args
+        self.target = args[-1] if args and not args[-1].startswith('-') else '.'
+
+    def run(self):
+        try:
+            return self._sink() if self.sink else self._source()
+        except SCPError as e:
+            self.channel.write(b'\x01scp: ' + str(e).encode() + b'\n')
+            return 1
+
+    def _paced(self, n):
+        if self.bucket is not None:
+            self.bucket.consume(n)
+
+    def _ack(self):
+        code = self.channel.read_exact(1)
+        if code != b'\x00':
+            message = self.channel.read_line().decode(errors='replace')
+            raise EOFError(f'client error: {message}')
+
+    def _fault(self, direction, path):
+        mode = self.faults.fail_mode
+        logger.info(f'SCP {direction} of {path} from {self.addr} failed by scenario ({mode})')
+        if mode == 'disconnect':
+            raise Disconnect(f'{direction} fault')
+        if mode == 'stall':
+            while self.channel.read(CHUNK):
+                pass
+            raise EOFError('stalled until the client gave up')
+
+    def _sink(self):
+        target = self.root.local(self.target)
+        dirs = [target] if os.path.isdir(target) else []
+        times = None
+        self.channel.write(b'\x00')
+        while True:
+            try:
+                line = self.channel.read_line().decode('utf-8', errors='replace')
+            except EOFError:
+                return 0
+            kind = line[:1]
+            if kind == 'T':
+                parts = line[1:].split()
+                times = (int(parts[2]), int(parts[0]))
+            elif kind == 'E':
+                dirs.pop()
+            elif kind in ('C', 'D'):
+                mode, size, name = line[1:].split(' ', 2)
+                if '/' in name or name in ('..', '.'):
+                    raise SCPError(f'{name}: invalid file name')
+                self._check_writable()
+                path = os.path.join(dirs[-1], name) if dirs else target
+                if kind == 'D':
+                    os.makedirs(path, int(mode, 8), exist_ok=True)
+                    dirs.append(path)
+                else:
+                    self.channel.write(b'\x00')
+                    self._receive(path, int(size), int(mode, 8))
+                if times is not None:
+                    os.utime(path, times)
+                    times = None
+            else:
+                return 1 if kind in ('\x01', '\x02') else 0
+            self.channel.write(b'\x00')
+
+    def _check_writable(self):
+        if self.faults.read_only:
+            raise SCPError('read-only server')
+
+    def _receive(self, path, size, mode):
+        name = self.root.virtual(os.path.relpath(path, self.root.root))
+        if self.faults.delay > 0:
+            self.clock.sleep(self.faults.delay)
+        allowed = FileFaults.limit(self.faults.fail_upload_after, 0, size)
+        written = 0
+        with open(path, 'wb') as f:
+            while written < size:
+                data = self.channel.read(min(CHUNK, size - written))
+                if not data:
+                    raise EOFError('channel closed mid-file')
+                self._paced(len(data))
+                if allowed is not None and written + len(data) > allowed:
+                    f.write(data[:max(0, allowed - written)])
+                    f.close()
+                    self._fault('upload', name)
+                    self.channel.read_exact(size - written - len(data))
+                    self.channel.read_exact(1)
+                    raise SCPError(f'{name}: injected upload fault')
+                f.write(data)
+                written += len(data)
+        os.chmod(path, mode & 0o7777)
+        self.channel.read_exact(1)
+        logger.info(f'SCP upload {name} ({size} bytes) from {self.addr}')
+
+    def _source(self):
+        path = self.root.local(self.target)
+        self._ack()
+        if not os.path.exists(path):
+            raise SCPError(f'{self.target}: No such file or directory')
+        if os.path.isdir(path) and not self.recursive:
+            raise SCPError(f'{self.target}: not a regular file')
+        self._send_path(path)
+        return 0
+
+    def _send_path(self, path):
+        st = os.stat(path)
+        if self.preserve:
+            self.channel.write(f'T{int(st.st_mtime)} 0 {int(st.st_atime)} 0\n'.encode())
+            self._ack()
+        name = os.path.basename(path.rstrip(os.sep)) or '.'
+        if os.path.isdir(path):
+            self.channel.write(f'D{stat.S_IMODE(st.st_mode):04o} 0 {name}\n'.encode())
+            self._ack()
+            for child in sorted(os.listdir(path)):
+                self._send_path(os.path.join(path, child))
+            self.channel.write(b'E\n')
+            self._ack()
+            return
+        self.channel.write(f'C{stat.S_IMODE(st.st_mode):04o} {st.st_size} {name}\n'.encode())
+        self._ack()
+        virtual = self.root.virtual(os.path.relpath(path, self.root.root))
+        if self.faults.delay > 0:
+            self.clock.sleep(self.faults.delay)
+        allowed = FileFaults.limit(self.faults.fail_download_after, 0, st.st_size)
+        sent = 0
+        with open(path, 'rb') as f:
+            while sent < st.st_size:
+                data = f.read(CHUNK).ljust(min(CHUNK, st.st_size - sent), b'\x00')
+                if allowed is not None and sent + len(data) > allowed:
+                    self.channel.write(data[:allowed - sent])
+                    self._fault('download', virtual)
+                    # Like scp after a read error: pad the file out, then report the failure.
+                    self.channel.write(bytes(st.st_size - allowed))
+                    raise SCPError(f'{virtual}: injected download fault')
+                self._paced(len(data))
+                self.channel.write(data)
+                sent += len(data)
+        self.channel.write(b'\x00')
+        self._ack()
+        logger.info(f'SCP download {virtual} ({st.st_size} bytes) to {self.addr}')
+
+
+class SFTPHandler:
+    def __init__(self, root='.', username='', password='', host_key=None, faults=None, clock=None):
+        self.root = FileRoot(root)
+        self.username = username
+        self.password = password
+        self.host_key = host_key or Ed25519Key()
+        self.faults = faults or FileFaults()
+        self.clock = clock_module.get(clock)
+        self.fingerprint = fingerprint(pack_string(HOST_KEY_ALGORITHM) + pack_string(self.host_key.public))
+
+    def handle(self, conn, addr):
+        """TCPServer handler: SSH handshake, authentication, then SFTP/SCP sessions until the client leaves."""
+        transport = SSHTransport(conn, addr, self.host_key, self.username, self.password,
+                                 on_session=lambda channel, command: self._session(channel, command, addr))
+        conn.settimeout(30.0)
+        try:
+            transport.handshake()
+            user = transport.authenticate()
+            logger.info(f'SSH login {user!r} from {addr}')
+            conn.settimeout(None)
+            transport.serve()
+        except Disconnect as e:
+            logger.info(f'SSH connection from {addr} dropped by scenario: {e}')
+        except (OSError, EOFError, SSHError) as e:
+            logger.info(f'SSH connection from {addr} closed: {e}')
+
+    def _session(self, channel, command, addr):
+        if command == 'sftp':
+            logger.info(f'SFTP session from {addr}')
+            return SFTPSession(channel, self.root, self.faults, addr, self.clock).run()
+        try:
+            args = shlex.split(command)
+        except ValueError:
+            args = []
+        if len(args) < 2 or posixpath.basename(args[0]) != 'scp' or not ({'-t', '-f'} & set(args)):
+            channel.transport.send(struct.pack('>BII', MSG_CHANNEL_EXTENDED_DATA, channel.remote_id, 1)
+                                   + pack_string(f'{command}: command not supported\n'))
+            return 127
+        logger.info(f'SCP {"upload" if "-t" in args else "download"} session from {addr}: {command}')
+        return SCPSession(channel, self.root, self.faults, args[1:], addr, self.clock).run()
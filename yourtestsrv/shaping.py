@@ -0,0 +1,223 @@
+"""Traffic shaping helpers."""
+
+import heapq
+import itertools
+import logging
+import random
+import re
+import threading
+
+from yourtestsrv import clock as clock_module
+
+logger = logging.getLogger(__name__)
+
+_RATE_PATTERN = re.compile(r'^(\d+(?:\.\d+)?)\s*([kKmMgG]?)(bps|Bps|B/s|b/s)?$')
+_RATE_PREFIXES = {'': 1, 'k': 1e3, 'K': 1e3, 'm': 1e6, 'M': 1e6, 'g': 1e9, 'G': 1e9}
+
+
+def parse_rate(s):
+    """Parse a rate like '16kbps' (bits) or '2KB/s' / '2KBps' (bytes) to bytes per second.
+
+    A bare number is bytes per second; 0 or an empty string means unlimited.
+    """
+    if s in (None, '', 0, '0'):
+        return 0.0
+    if isinstance(s, (int, float)):
+        return float(s)
+    m = _RATE_PATTERN.match(s.strip())
+    if not m:
+        raise ValueError(f'invalid rate: {s!r}')
+    value = float(m.group(1)) * _RATE_PREFIXES[m.group(2)]
+    unit = m.group(3) or 'B/s'
+    return value / 8 if unit in ('bps', 'b/s') else value
+
+
+def jittered(delay, jitter):
+    """delay spread evenly by up to jitter either way, never below zero."""
+    if jitter <= 0:
+        return delay
+    return max(0.0, delay + random.uniform(-jitter, jitter))
+
+
+# Distribution name -> number of parameters.
+DISTRIBUTIONS = {'uniform': 2, 'normal': 2, 'exponential': 1, 'pareto': 2}
+
+
+class Distribution:
+    """Random delays: 'uniform:MIN:MAX', 'normal:MEAN:STDDEV', 'exponential:MEAN' or 'pareto:SCALE:SHAPE'.
+
+    Parameters are durations ('20ms'), except the Pareto shape, a plain number
+    (smaller is heavier-tailed; 1.5 gives mostly short delays and a few long
+    ones). Samples are seconds and never negative: normal draws below zero
+    count as zero.
+    """
+
+    def __init__(self, spec):
+        from yourtestsrv.config import parse_duration
+        name, *args = spec.split(':')
+        if name not in DISTRIBUTIONS:
+            raise ValueError(f'unknown distribution {name!r} (use one of {", ".join(DISTRIBUTIONS)})')
+        if len(args) != DISTRIBUTIONS[name]:
+            raise ValueError(f'{name} takes {DISTRIBUTIONS[name]} parameters: {spec!r}')
+        self.spec = spec
+        self.name = name
+        if name == 'pareto':
+            self.params = (parse_duration(args[0]), float(args[1]))
+        else:
+            self.params = tuple(parse_duration(arg) for arg in args)
+        if name == 'uniform' and self.params[0] > self.params[1]:
+            raise ValueError(f'uniform minimum above maximum: {spec!r}')
+        if name in ('exponential', 'pareto') and self.params[-1] <= 0:
+            raise ValueError(f'{name} needs a positive {"mean" if name == "exponential" else "shape"}: {spec!r}')
+
+    def sample(self):
+        a, *rest = self.params
+        if self.name == 'uniform':
+            return random.uniform(a, rest[0])
+        if self.name == 'normal':
+            return max(0.0, random.gauss(a, rest[0]))
+        if self.name == 'exponential':
+            return random.expovariate(1 / a) if a > 0 else 0.0
+        return a * random.paretovariate(rest[0])
+
+
+# Keys of a latency object and the ones each distribution needs.
+LATENCY_KEYS = ('distribution', 'min', 'max', 'mean', 'stddev', 'shape')
+LATENCY_REQUIRED = {'uniform': ('min', 'max'), 'normal': ('mean', 'stddev'), 'exponential': ('mean',),
+                    'pareto': ('min',)}
+
+
+class Latency:
+    """Reply delays drawn from a distribution instead of a fixed delay ("latency" on TCP, UDP and HTTP).
+
+    Either a Distribution string ('normal:200ms:50ms') or an object:
+
+      {"distribution": "uniform", "min": "100ms", "max": "300ms"}
+      {"distribution": "normal", "mean": "200ms", "stddev": "50ms", "min": "50ms", "max": "1s"}
+      {"distribution": "exponential", "mean": "200ms", "max": "2s"}
+      {"distribution": "pareto", "min": "100ms", "mean": "300ms"}
+
+    min and max bound every sample. Uniform draws between them; Pareto starts
+    at min and takes its shape from mean (or "shape", default 1.5), giving
+    mostly short delays with a long tail.
+    """
+
+    def __init__(self, spec):
+        from yourtestsrv.config import parse_duration
+        self.spec = spec
+        self.min, self.max = 0.0, None
+        if isinstance(spec, str):
+            self.distribution = Distribution(spec)
+            return
+        spec = dict(spec)
+        unknown = set(spec) - set(LATENCY_KEYS)
+        if unknown:
+            raise ValueError(f'unknown latency keys: {sorted(unknown)}')
+        name = spec.get('distribution')
+        if name not in LATENCY_REQUIRED:
+            raise ValueError(f'latency distribution must be one of {", ".join(LATENCY_REQUIRED)}: {name!r}')
+        missing = [key for key in LATENCY_REQUIRED[name] if key not in spec]
+        if missing:
+            raise ValueError(f'{name} latency needs {" and ".join(missing)}')
+        if 'min' in spec:
+            self.min = parse_duration(spec['min'])
+        if 'max' in spec:
+            self.max = parse_duration(spec['max'])
+            if self.max < self.min:
+                raise ValueError(f'latency max below min: {spec}')
+        if name == 'uniform':
+            params = (spec['min'], spec['max'])
+        elif name == 'normal':
+            params = (spec['mean'], spec['stddev'])
+        elif name == 'exponential':
+            params = (spec['mean'],)
+        else:
+            if self.min <= 0:
+                raise ValueError(f'pareto latency needs a positive min: {spec}')
+            shape = spec.get('shape', 1.5)
+            if 'mean' in spec:
+                mean = parse_duration(spec['mean'])
+                if mean <= self.min:
+                    raise ValueError(f'pareto latency mean must be above min: {spec}')
+                # The mean of a Pareto distribution is min * shape / (shape - 1).
+                shape = mean / (mean - self.min)
+            params = (spec['min'], shape)
+        self.distribution = Distribution(':'.join([name] + [str(p) for p in params]))
+
+    def sample(self):
+        delay = max(self.min, self.distribution.sample())
+        return delay if self.max is None else min(delay, self.max)
+
+
+class JitterBuffer:
+    """Runs queued sends once their delays run out, in deadline order, from one thread.
+
+    Sleeping in each handler thread would tie the reordering to the size of the
+    thread pool; here any number of packets can be in flight and each one
+    overtakes exactly those with later deadlines.
+    """
+
+    def __init__(self, clock=None):
+        self.clock = clock_module.get(clock)
+        self._heap = []
+        self._order = itertools.count()
+        self._lock = threading.Lock()
+        self._wake = threading.Event()
+        self._closed = threading.Event()
+        self._thread = None
+
+    def put(self, delay, fn, *args):
+        """Call fn(*args) after delay seconds."""
+        with self._lock:
+            heapq.heappush(self._heap, (self.clock.monotonic() + delay, next(self._order), fn, args))
+            if self._thread is None:
+                self._thread = threading.Thread(target=self._run, daemon=True)
+                self._thread.start()
+        self._wake.set()
+
+    def __len__(self):
+        with self._lock:
+            return len(self._heap)
+
+    def close(self):
+        """Stop the thread; sends still held are dropped."""
+        self._closed.set()
+        self._wake.set()
+
+    def _run(self):
+        while not self._closed.is_set():
+            self._wake.clear()
+            with self._lock:
+                due = self._heap[0][0] if self._heap else None
+                wait = None if due is None else due - self.clock.monotonic()
+                entry = heapq.heappop(self._heap) if wait is not None and wait <= 0 else None
+            if entry is None:
+                self.clock.wait(self._wake, wait)
+                continue
+            _, _, fn, args = entry
+            try:
+                fn(*args)
+            except Exception as e:
+                logger.warning(f'Delayed send failed: {e}')
+
+
+class TokenBucket:
+    """Token bucket in bytes; consume() sleeps until the bytes are allowed through.
+
+    burst defaults to a tenth of a second worth of traffic.
+    """
+
+    def __init__(self, rate, burst=0, clock=None):
+        self.rate = rate
+        self.burst = burst or max(1, int(rate / 10))
+        self.clock = clock_module.get(clock)
+        self._tokens = float(self.burst)
+        self._last = self.clock.monotonic()
+
+    def consume(self, n):
+        now = self.clock.monotonic()
+        self._tokens = min(self.burst, self._tokens + (now - self._last) * self.rate)
+        self._last = now
+        self._tokens -= n
+        if self._tokens < 0:
+            self.clock.sleep(-self._tokens / self.rate)
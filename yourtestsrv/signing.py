@@ -0,0 +1,76 @@
+"""HTTP response signing: HMAC-SHA256 or detached HS256 JWS over the body.
+
+hmac  <header>: sha256=<hex HMAC-SHA256 of the body>
+jws   <header>: <b64url protected header>..<b64url signature>  (RFC 7515 detached payload)
+
+Faults produce responses a careful client must reject:
+
+  corrupt     one bit of the signature flipped
+  wrong_key   signed with a different key
+  tamper      the body changed after signing
+  missing     no signature header at all
+"""
+
+import base64
+import hashlib
+import hmac
+import json
+
+METHODS = ('hmac', 'jws')
+FAULTS = ('', 'corrupt', 'wrong_key', 'tamper', 'missing')
+JWS_HEADER = {'alg': 'HS256', 'b64': False, 'crit': ['b64']}
+
+
+def b64url(data):
+    return base64.urlsafe_b64encode(data).rstrip(b'=').decode()
+
+
+def flip_bit(mac):
+    """The MAC with its lowest bit flipped. Done before encoding: changing a character of the
+    encoded form can land in base64 padding bits or only change hex case, and still verify."""
+    return mac[:-1] + bytes([mac[-1] ^ 0x01])
+
+
+def sign_hmac(key, body, corrupt=False):
+    mac = hmac.new(key, body, hashlib.sha256).digest()
+    return 'sha256=' + (flip_bit(mac) if corrupt else mac).hex()
+
+
+def sign_jws(key, body, corrupt=False):
+    """Detached JWS with an unencoded payload (RFC 7797), so the body is signed as sent."""
+    protected = b64url(json.dumps(JWS_HEADER, separators=(',', ':')).encode())
+    signature = hmac.new(key, protected.encode() + b'.' + body, hashlib.sha256).digest()
+    return f'{protected}..{b64url(flip_bit(signature) if corrupt else signature)}'
+
+
+def verify(method, key, body, value):
+    """Check a signature header value the way a verifying device would."""
+    expected = sign_hmac(key, body) if method == 'hmac' else sign_jws(key, body)
+    return hmac.compare_digest(expected, value or '')
+
+
+class ResponseSigner:
+    def __init__(self, method, key, header='X-Signature', fault=''):
+        if method not in METHODS:
+            raise ValueError(f'unknown signing method: {method!r}')
+        if fault not in FAULTS:
+            raise ValueError(f'unknown signing fault: {fault!r}')
+        if not key:
+            raise ValueError('signing needs a key')
+        self.method = method
+        self.key = key.encode() if isinstance(key, str) else key
+        self.header = header
+        self.fault = fault
+
+    def apply(self, resp):
+        """Attach the signature header to resp, honouring the configured fault."""
+        if self.fault == 'missing':
+            return resp
+        body = resp.body or b''
+        key = self.key + b'-wrong' if self.fault == 'wrong_key' else self.key
+        sign = sign_hmac if self.method == 'hmac' else sign_jws
+        value = sign(key, body, corrupt=self.fault == 'corrupt')
+        if self.fault == 'tamper':
+            resp.body = body[:-1] + bytes([body[-1] ^ 0x01]) if body else b'\x00'
+        resp.headers[self.header] = value
+        return resp
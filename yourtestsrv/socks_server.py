@@ -0,0 +1,200 @@
+"""SOCKS5 (RFC 1928) proxy that terminates CONNECT requests, with faults.
+
+Runs as a TCPServer handler, so connection limits, accept pacing and stats
+come from the TCP server. Faults:
+
+  delay       before the CONNECT reply and before each relayed chunk
+  drop_rate   fraction of CONNECT requests dropped (connection closed, no reply)
+  reply_code  answer every CONNECT with this failure code instead of connecting
+"""
+
+import errno
+import ipaddress
+import logging
+import random
+import socket
+import struct
+import threading
+
+from yourtestsrv import clock as clock_module
+
+logger = logging.getLogger(__name__)
+
+VERSION = 5
+METHOD_NONE = 0x00
+METHOD_USERPASS = 0x02
+METHOD_UNACCEPTABLE = 0xFF
+CMD_CONNECT = 1
+ATYP_IPV4 = 1
+ATYP_DOMAIN = 3
+ATYP_IPV6 = 4
+
+REP_SUCCEEDED = 0
+REP_GENERAL_FAILURE = 1
+REP_NOT_ALLOWED = 2
+REP_NETWORK_UNREACHABLE = 3
+REP_HOST_UNREACHABLE = 4
+REP_CONNECTION_REFUSED = 5
+REP_TTL_EXPIRED = 6
+REP_COMMAND_NOT_SUPPORTED = 7
+REP_ADDRESS_NOT_SUPPORTED = 8
+
+
+class SOCKSError(Exception):
+    pass
+
+
+def recv_exact(conn, n):
+    buf = b''
+    while len(buf) < n:
+        chunk = conn.recv(n - len(buf))
+        if not chunk:
+            raise EOFError('connection closed')
+        buf += chunk
+    return buf
+
+
+def encode_address(host, port):
+    """Encode (host, port) as ATYP, address and port fields."""
+    try:
+        ip = ipaddress.ip_address(host)
+    except ValueError:
+        name = host.encode('idna')
+        return bytes([ATYP_DOMAIN, len(name)]) + name + struct.pack('>H', port)
+    atyp = ATYP_IPV4 if ip.version == 4 else ATYP_IPV6
+    return bytes([atyp]) + ip.packed + struct.pack('>H', port)
+
+
+def read_address(conn, atyp):
+    if atyp == ATYP_IPV4:
+        host = str(ipaddress.IPv4Address(recv_exact(conn, 4)))
+    elif atyp == ATYP_IPV6:
+        host = str(ipaddress.IPv6Address(recv_exact(conn, 16)))
+    elif atyp == ATYP_DOMAIN:
+        host = recv_exact(conn, recv_exact(conn, 1)[0]).decode('idna')
+    else:
+        return None
+    return host, struct.unpack('>H', recv_exact(conn, 2))[0]
+
+
+def connect_error_code(exc):
+    """Map a failed upstream connect to a SOCKS reply code."""
+    if isinstance(exc, ConnectionRefusedError):
+        return REP_CONNECTION_REFUSED
+    if isinstance(exc, (socket.gaierror, socket.timeout)):
+        return REP_HOST_UNREACHABLE
+    if getattr(exc, 'errno', None) == errno.ENETUNREACH:
+        return REP_NETWORK_UNREACHABLE
+    if getattr(exc, 'errno', None) == errno.EHOSTUNREACH:
+        return REP_HOST_UNREACHABLE
+    return REP_GENERAL_FAILURE
+
+
+class SOCKS5Handler:
+    def __init__(self, delay=0.0, drop_rate=0.0, reply_code=0, auth='', connect_timeout=10.0, clock=None):
+        self.delay = delay
+        self.drop_rate = drop_rate
+        self.reply_code = reply_code
+        self.auth = auth
+        self.connect_timeout = connect_timeout
+        self.clock = clock_module.get(clock)
+
+    def handle(self, conn, addr):
+        """TCPServer handler: negotiate, CONNECT and relay until either side closes."""
+        conn.settimeout(30.0)
+        try:
+            self._negotiate(conn, addr)
+            target = self._read_request(conn)
+            if target is None:
+                return
+            upstream = self._connect(conn, addr, target)
+            if upstream is None:
+                return
+        except (OSError, EOFError, SOCKSError) as e:
+            logger.info(f'SOCKS handshake with {addr} failed: {e}')
+            return
+        conn.settimeout(None)
+        try:
+            t = threading.Thread(target=self._pump, args=(conn, upstream), daemon=True)
+            t.start()
+            self._pump(upstream, conn)
+        finally:
+            try:
+                conn.shutdown(socket.SHUT_RD)
+            except OSError:
+                pass
+            upstream.close()
+            logger.info(f'SOCKS connection closed: {addr}')
+
+    def _negotiate(self, conn, addr):
+        version, count = recv_exact(conn, 2)
+        if version != VERSION:
+            raise SOCKSError(f'unsupported version {version}')
+        methods = recv_exact(conn, count)
+        wanted = METHOD_USERPASS if self.auth else METHOD_NONE
+        if wanted not in methods:
+            conn.sendall(bytes([VERSION, METHOD_UNACCEPTABLE]))
+            raise SOCKSError(f'no acceptable auth method in {list(methods)}')
+        conn.sendall(bytes([VERSION, wanted]))
+        if not self.auth:
+            return
+        # RFC 1929 username/password subnegotiation.
+        version, ulen = recv_exact(conn, 2)
+        user = recv_exact(conn, ulen)
+        password = recv_exact(conn, recv_exact(conn, 1)[0])
+        if f'{user.decode("latin-1")}:{password.decode("latin-1")}' != self.auth:
+            conn.sendall(b'\x01\x01')
+            raise SOCKSError(f'bad credentials from {addr}')
+        conn.sendall(b'\x01\x00')
+
+    def _read_request(self, conn):
+        version, cmd, _, atyp = recv_exact(conn, 4)
+        if version != VERSION:
+            raise SOCKSError(f'unsupported version {version}')
+        target = read_address(conn, atyp)
+        if target is None:
+            self._reply(conn, REP_ADDRESS_NOT_SUPPORTED)
+            return None
+        if cmd != CMD_CONNECT:
+            self._reply(conn, REP_COMMAND_NOT_SUPPORTED)
+            return None
+        return target
+
+    def _connect(self, conn, addr, target):
+        host, port = target
+        if self.drop_rate > 0 and random.random() < self.drop_rate:
+            logger.info(f'SOCKS CONNECT {host}:{port} from {addr} dropped')
+            return None
+        if self.delay > 0:
+            self.clock.sleep(self.delay)
+        if self.reply_code:
+            logger.info(f'SOCKS CONNECT {host}:{port} from {addr} failed by scenario ({self.reply_code})')
+            self._reply(conn, self.reply_code)
+            return None
+        try:
+            upstream = socket.create_connection((host, port), timeout=self.connect_timeout)
+        except OSError as e:
+            logger.info(f'SOCKS CONNECT {host}:{port} from {addr} failed: {e}')
+            self._reply(conn, connect_error_code(e))
+            return None
+        upstream.settimeout(None)
+        logger.info(f'SOCKS CONNECT {host}:{port} from {addr}')
+        self._reply(conn, REP_SUCCEEDED, upstream.getsockname()[:2])
+        return upstream
+
+    @staticmethod
+    def _reply(conn, code, bound=('0.0.0.0', 0)):
+        conn.sendall(bytes([VERSION, code, 0]) + encode_address(*bound))
+
+    def _pump(self, src, dst):
+        try:
+            while True:
+                data = src.recv(4096)
+                if not data:
+                    break
+                if self.delay > 0:
+                    self.clock.sleep(self.delay)
+                dst.sendall(data)
+            dst.shutdown(socket.SHUT_WR)
+        except OSError as e:
+            logger.debug(f'SOCKS relay ended: {e}')
@@ -0,0 +1,183 @@
+"""Pure-Python primitives for the SSH mock in sftp_server.py.
+
+X25519 (RFC 7748) for curve25519-sha256 key exchange, Ed25519 (RFC 8032)
+host keys and the chacha20-poly1305@openssh.com cipher. Stdlib only and slow
+(a few hundred KB/s of channel data), which is plenty for a test server.
+Nothing here is constant-time; it must never protect anything real.
+"""
+
+import base64
+import hashlib
+import hmac
+import os
+import struct
+
+P = 2 ** 255 - 19
+L = 2 ** 252 + 27742317777372353535851937790883648493
+D = -121665 * pow(121666, P - 2, P) % P
+A24 = 121665
+MASK32 = 0xffffffff
+
+X25519_BASE = (9).to_bytes(32, 'little')
+_G_X = 15112221349535400772501151409588531511454012693041857206046113283949847762202
+_G_Y = 46316835694926478169428394003475163141307993866256225615783033603165251855960
+_G = (_G_X, _G_Y, 1, _G_X * _G_Y % P)
+
+
+def _clamp(k):
+    k = bytearray(k)
+    k[0] &= 248
+    k[31] &= 127
+    k[31] |= 64
+    return int.from_bytes(k, 'little')
+
+
+def x25519(scalar, u):
+    """The X25519 function: scalar times the point with u-coordinate u, both 32 bytes."""
+    k = _clamp(scalar)
+    x1 = int.from_bytes(u, 'little') & ((1 << 255) - 1)
+    x2, z2, x3, z3 = 1, 0, x1, 1
+    swap = 0
+    for t in reversed(range(255)):
+        bit = (k >> t) & 1
+        if swap ^ bit:
+            x2, x3, z2, z3 = x3, x2, z3, z2
+        swap = bit
+        a, b = x2 + z2, x2 - z2
+        c, d = x3 + z3, x3 - z3
+        aa, bb = a * a % P, b * b % P
+        e = aa - bb
+        da, cb = d * a % P, c * b % P
+        x3 = (da + cb) ** 2 % P
+        z3 = x1 * (da - cb) ** 2 % P
+        x2 = aa * bb % P
+        z2 = e * (aa + A24 * e) % P
+    if swap:
+        x2, z2 = x3, z3
+    return (x2 * pow(z2, P - 2, P) % P).to_bytes(32, 'little')
+
+
+def _edwards_add(p, q):
+    x1, y1, z1, t1 = p
+    x2, y2, z2, t2 = q
+    a = (y1 - x1) * (y2 - x2) % P
+    b = (y1 + x1) * (y2 + x2) % P
+    c = 2 * t1 * t2 * D % P
+    d = 2 * z1 * z2 % P
+    e, f, g, h = b - a, d - c, d + c, b + a
+    return e * f % P, g * h % P, f * g % P, e * h % P
+
+
+def _edwards_mul(s, p):
+    q = (0, 1, 1, 0)
+    while s:
+        if s & 1:
+            q = _edwards_add(q, p)
+        p = _edwards_add(p, p)
+        s >>= 1
+    return q
+
+
+def _edwards_encode(p):
+    x, y, z, _ = p
+    zi = pow(z, P - 2, P)
+    x, y = x * zi % P, y * zi % P
+    return (y | (x & 1) << 255).to_bytes(32, 'little')
+
+
+class Ed25519Key:
+    """An Ed25519 signing key from a 32-byte seed (random when omitted)."""
+
+    def __init__(self, seed=None):
+        self.seed = seed or os.urandom(32)
+        if len(self.seed) != 32:
+            raise ValueError('ed25519 seed must be 32 bytes')
+        digest = hashlib.sha512(self.seed).digest()
+        self._scalar = _clamp(digest[:32])
+        self._prefix = digest[32:]
+        self.public = _edwards_encode(_edwards_mul(self._scalar, _G))
+
+    def sign(self, message):
+        r = int.from_bytes(hashlib.sha512(self._prefix + message).digest(), 'little') % L
+        encoded_r = _edwards_encode(_edwards_mul(r, _G))
+        k = int.from_bytes(hashlib.sha512(encoded_r + self.public + message).digest(), 'little') % L
+        return encoded_r + ((r + k * self._scalar) % L).to_bytes(32, 'little')
+
+
+def fingerprint(blob):
+    """OpenSSH-style SHA256 fingerprint of a public key blob."""
+    return 'SHA256:' + base64.b64encode(hashlib.sha256(blob).digest()).decode().rstrip('=')
+
+
+def _rotl(v, n):
+    return ((v << n) & MASK32) | (v >> (32 - n))
+
+
+def _chacha_block(key_words, counter, nonce_words):
+    state = [0x61707865, 0x3320646e, 0x79622d32, 0x6b206574, *key_words,
+             counter & MASK32, counter >> 32, *nonce_words]
+    x = list(state)
+    for _ in range(10):
+        for a, b, c, d in ((0, 4, 8, 12), (1, 5, 9, 13), (2, 6, 10, 14), (3, 7, 11, 15),
+                           (0, 5, 10, 15), (1, 6, 11, 12), (2, 7, 8, 13), (3, 4, 9, 14)):
+            x[a] = (x[a] + x[b]) & MASK32
+            x[d] = _rotl(x[d] ^ x[a], 16)
+            x[c] = (x[c] + x[d]) & MASK32
+            x[b] = _rotl(x[b] ^ x[c], 12)
+            x[a] = (x[a] + x[b]) & MASK32
+            x[d] = _rotl(x[d] ^ x[a], 8)
+            x[c] = (x[c] + x[d]) & MASK32
+            x[b] = _rotl(x[b] ^ x[c], 7)
+    return struct.pack('<16I', *((x[i] + state[i]) & MASK32 for i in range(16)))
+
+
+def chacha20(key, nonce, counter, data):
+    """Original ChaCha20 (64-bit nonce and block counter) applied to data."""
+    key_words = struct.unpack('<8I', key)
+    nonce_words = struct.unpack('<2I', nonce)
+    blocks = (len(data) + 63) // 64
+    stream = b''.join(_chacha_block(key_words, counter + i, nonce_words) for i in range(blocks))[:len(data)]
+    return (int.from_bytes(data, 'little') ^ int.from_bytes(stream, 'little')).to_bytes(len(data), 'little')
+
+
+def poly1305(key, message):
+    r = int.from_bytes(key[:16], 'little') & 0x0ffffffc0ffffffc0ffffffc0fffffff
+    s = int.from_bytes(key[16:32], 'little')
+    p = (1 << 130) - 5
+    acc = 0
+    for i in range(0, len(message), 16):
+        acc = (acc + int.from_bytes(message[i:i + 16] + b'\x01', 'little')) * r % p
+    return ((acc + s) & ((1 << 128) - 1)).to_bytes(16, 'little')
+
+
+class ChaChaPoly:
+    """One direction of chacha20-poly1305@openssh.com, keyed with 64 bytes.
+
+    The second half of the key encrypts the 4-byte packet length, the first
+    half the rest of the packet; the Poly1305 key is the first 32 bytes of
+    keystream. The nonce is the packet sequence number.
+    """
+
+    TAG_SIZE = 16
+
+    def __init__(self, key):
+        self.main_key = key[:32]
+        self.header_key = key[32:64]
+
+    def encrypt(self, seq, packet):
+        nonce = struct.pack('>Q', seq)
+        length = chacha20(self.header_key, nonce, 0, packet[:4])
+        body = chacha20(self.main_key, nonce, 1, packet[4:])
+        tag = poly1305(chacha20(self.main_key, nonce, 0, bytes(32)), length + body)
+        return length + body + tag
+
+    def decrypt_length(self, seq, length):
+        return struct.unpack('>I', chacha20(self.header_key, struct.pack('>Q', seq), 0, length))[0]
+
+    def decrypt(self, seq, length, body, tag):
+        """The plaintext of body; raises ValueError when the tag does not match."""
+        nonce = struct.pack('>Q', seq)
+        expected = poly1305(chacha20(self.main_key, nonce, 0, bytes(32)), length + body)
+        if not hmac.compare_digest(expected, tag):
+            raise ValueError('packet authentication failed')
+        return chacha20(self.main_key, nonce, 1, body)
@@ -0,0 +1,336 @@
+import itertools
+import logging
+import socket
+import ssl
+import struct
+import threading
+import time
+
+from yourtestsrv import logthrottle, storage
+
+logger = logging.getLogger(__name__)
+
+# Error taxonomy shared by all servers.
+ERROR_TIMEOUT = 'timeout'
+ERROR_RESET = 'reset'
+ERROR_PARSE = 'parse'
+ERROR_TLS = 'tls'
+# Well-formed traffic whose payload fails a configured schema (MQTT payload validators).
+ERROR_SCHEMA = 'schema'
+ERROR_OTHER = 'other'
+
+ERROR_CATEGORIES = (ERROR_TIMEOUT, ERROR_RESET, ERROR_PARSE, ERROR_TLS, ERROR_SCHEMA, ERROR_OTHER)
+
+# Per-server traffic totals, summed over its connections (live ones included).
+TRAFFIC_COUNTERS = ('connections', 'bytes_in', 'bytes_out', 'frames_in', 'frames_out')
+
+
+def classify_error(exc):
+    """Map an exception raised while serving a client to an error category."""
+    if isinstance(exc, ssl.SSLError):
+        return ERROR_TLS
+    if isinstance(exc, socket.timeout):
+        return ERROR_TIMEOUT
+    if isinstance(exc, (ConnectionResetError, ConnectionAbortedError, BrokenPipeError)):
+        return ERROR_RESET
+    if isinstance(exc, (ValueError, UnicodeDecodeError, struct.error)):
+        return ERROR_PARSE
+    return ERROR_OTHER
+
+
+class Counters:
+    """Thread-safe named counters."""
+
+    def __init__(self, names=()):
+        self._lock = threading.Lock()
+        self._values = {name: 0 for name in names}
+
+    def incr(self, name, n=1):
+        with self._lock:
+            self._values[name] = self._values.get(name, 0) + n
+
+    def get(self, name):
+        with self._lock:
+            return self._values.get(name, 0)
+
+    def snapshot(self):
+        with self._lock:
+            return dict(self._values)
+
+
+class ServerStats:
+    def __init__(self):
+        self.errors = Counters(ERROR_CATEGORIES)
+        self.traffic = Counters(TRAFFIC_COUNTERS)
+        # Per-client sequence accounting (sequence.SequenceTracker) of a UDP server with a sequence field.
+        self.sequence = None
+        # The idle prober (probe.IdleProber) of a TCP or MQTT server probing its clients.
+        self.probes = None
+
+    def record_error(self, error):
+        """Count an error given either an exception or a category name."""
+        category = error if isinstance(error, str) else classify_error(error)
+        self.errors.incr(category)
+
+    def snapshot(self):
+        snapshot = {'errors': self.errors.snapshot(), 'traffic': self.traffic.snapshot()}
+        if self.sequence:
+            snapshot['sequence'] = self.sequence.snapshot()
+        if self.probes:
+            snapshot['probes'] = self.probes.snapshot()
+        return snapshot
+
+    def restore(self, snapshot):
+        """Add counts from an earlier snapshot, e.g. one persisted before a restart."""
+        for category, n in snapshot.get('errors', {}).items():
+            self.errors.incr(category, n)
+        for name, n in snapshot.get('traffic', {}).items():
+            self.traffic.incr(name, n)
+
+
+_registry = {}
+_registry_lock = threading.Lock()
+# Persisted snapshots not yet claimed by a registered server; see StatsPersister.
+_restored = {}
+
+
+def register(name, server_stats):
+    with _registry_lock:
+        _registry[name] = server_stats
+        restored = _restored.pop(name, None)
+    if restored:
+        server_stats.restore(restored)
+
+
+def unregister(name):
+    with _registry_lock:
+        _registry.pop(name, None)
+
+
+def snapshot():
+    with _registry_lock:
+        items = list(_registry.items())
+    return {name: s.snapshot() for name, s in items}
+
+
+class StatsPersister:
+    """Save the aggregate counters to path periodically and reload them at startup.
+
+    Counters restored from the file are added to each server as it registers,
+    so soak-test totals survive deliberate restarts.
+    """
+
+    def __init__(self, path, interval=10.0, store=None):
+        self.path = path
+        self.interval = interval
+        self.store = storage.get(store)
+
+    def load(self):
+        """Read the saved counters, if any; returns how many servers they cover."""
+        try:
+            data = self.store.load(self.path)
+        except (OSError, ValueError) as e:
+            logger.warning(f'Ignoring unreadable stats file {self.path}: {e}')
+            return 0
+        if data is None:
+            return 0
+        with _registry_lock:
+            _restored.update(data)
+        logger.info(f'Restored counters for {len(data)} servers from {self.path}')
+        return len(data)
+
+    def save(self):
+        data = snapshot()
+        with _registry_lock:
+            # Keep counters of servers that have not registered yet in this run.
+            data = {**_restored, **data}
+        self.store.save(self.path, data)
+
+    def run(self, stop_event):
+        """Save every interval until stop_event is set; the caller saves once more on exit."""
+        while not stop_event.wait(self.interval):
+            self.save_logged()
+
+    def save_logged(self):
+        try:
+            self.save()
+        except OSError as e:
+            logger.warning(f'Saving stats to {self.path} failed: {e}')
+
+
+class ConnectionInfo:
+    """Bookkeeping for one active connection and the thread serving it.
+
+    Traffic counted here is added to totals (the server's traffic counters) as well.
+    """
+
+    def __init__(self, conn_id, server, remote, totals=None):
+        self.id = conn_id
+        self.server = server
+        self.remote = remote
+        self.thread = threading.current_thread()
+        # Pooled workers (netutil.WorkerPool) serve one connection after another.
+        self.task = getattr(self.thread, 'task', None)
+        self.started = time.time()
+        self.last_active = self.started
+        self.buffered = 0
+        self.peak_buffered = 0
+        self.flags = set()
+        self.proxy = None
+        # Set while idle probing finds the client silent (see probe.py).
+        self.probe = None
+        # The exception that ended the connection, None for an orderly close.
+        self.error = None
+        self.traffic = Counters(TRAFFIC_COUNTERS[1:])
+        self.totals = totals
+        if totals:
+            totals.incr('connections')
+
+    def count(self, name, n=1):
+        """Add n to a traffic counter (bytes_in, bytes_out, frames_in or frames_out)."""
+        self.traffic.incr(name, n)
+        if self.totals:
+            self.totals.incr(name, n)
+
+    def summary(self, now):
+        return dict(self.traffic.snapshot(), duration=round(now - self.started, 3))
+
+    def serving(self):
+        """True while the thread that opened the connection is alive and has not moved on to another."""
+        return self.thread.is_alive() and getattr(self.thread, 'task', None) == self.task
+
+    def touch(self, buffered=None):
+        """Mark activity; buffered is the bytes the handler currently holds."""
+        self.last_active = time.time()
+        if buffered is not None:
+            self.buffered = buffered
+            self.peak_buffered = max(self.peak_buffered, buffered)
+
+    def snapshot(self, now):
+        return {
+            'id': self.id,
+            'server': self.server,
+            'remote': str(self.remote),
+            'thread': self.thread.name,
+            'thread_alive': self.thread.is_alive(),
+            'age': round(now - self.started, 3),
+            'idle': round(now - self.last_active, 3),
+            'buffered': self.buffered,
+            'peak_buffered': self.peak_buffered,
+            'flags': sorted(self.flags),
+            'proxy': self.proxy,
+            'probe': self.probe,
+            'traffic': self.traffic.snapshot(),
+        }
+
+
+class ConnectionTable:
+    def __init__(self):
+        self._lock = threading.Lock()
+        self._ids = itertools.count(1)
+        self._conns = {}
+        self.closed_total = 0
+
+    def open(self, server, remote, server_stats=None):
+        info = ConnectionInfo(next(self._ids), server, remote, server_stats.traffic if server_stats else None)
+        with self._lock:
+            self._conns[info.id] = info
+        return info
+
+    def close(self, info):
+        """Drop info from the table and log its traffic summary."""
+        with self._lock:
+            if not self._conns.pop(info.id, None):
+                return
+            self.closed_total += 1
+        summary = info.summary(time.time())
+        logger.info(f'Connection summary: server={info.server} remote={info.remote} '
+                    + ' '.join(f'{k}={v}' for k, v in sorted(summary.items())),
+                    extra=logthrottle.event('conn.summary'))
+
+    def list(self):
+        with self._lock:
+            return list(self._conns.values())
+
+    def snapshot(self):
+        now = time.time()
+        return [info.snapshot(now) for info in self.list()]
+
+
+connections = ConnectionTable()
+
+
+class CountingConn:
+    """Socket wrapper counting received and sent bytes into a ConnectionInfo.
+
+    With frames, every sendall() call also counts as one frame out (for
+    protocols sending one packet per call, like MQTT).
+    """
+
+    def __init__(self, conn, info, frames=False):
+        self._conn = conn
+        self._info = info
+        self._frames = frames
+
+    def recv(self, bufsize, *flags):
+        data = self._conn.recv(bufsize, *flags)
+        if data and not (flags and flags[0] & socket.MSG_PEEK):
+            self._info.count('bytes_in', len(data))
+        return data
+
+    def recv_into(self, buffer, nbytes=0, *flags):
+        n = self._conn.recv_into(buffer, nbytes, *flags)
+        if n and not (flags and flags[0] & socket.MSG_PEEK):
+            self._info.count('bytes_in', n)
+        return n
+
+    def sendall(self, data, *flags):
+        self._conn.sendall(data, *flags)
+        self._info.count('bytes_out', len(data))
+        if self._frames:
+            self._info.count('frames_out')
+
+    def __getattr__(self, name):
+        return getattr(self._conn, name)
+
+
+class ConnectionWatchdog:
+    """Periodically flags connections that look leaked during long soaks.
+
+    - "thread-dead": the serving thread exited, or its pool worker moved on to
+      another connection, but the entry was never closed.
+    - "idle": no activity for longer than max_idle seconds (0 disables).
+    - "buffer": the handler holds more than max_buffered bytes (0 disables).
+    """
+
+    def __init__(self, table=None, interval=30.0, max_idle=0.0, max_buffered=0):
+        self.table = table or connections
+        self.interval = interval
+        self.max_idle = max_idle
+        self.max_buffered = max_buffered
+
+    def run(self, stop_event):
+        if self.interval <= 0:
+            return
+        while not stop_event.wait(self.interval):
+            self.check()
+
+    def check(self):
+        now = time.time()
+        flagged = []
+        for info in self.table.list():
+            reasons = set()
+            if not info.serving():
+                reasons.add('thread-dead')
+            if self.max_idle and now - info.last_active > self.max_idle:
+                reasons.add('idle')
+            if self.max_buffered and info.buffered > self.max_buffered:
+                reasons.add('buffer')
+            new = reasons - info.flags
+            info.flags |= reasons
+            if new:
+                logger.warning(f'Connection {info.id} ({info.server} {info.remote}) flagged: '
+                               f'{", ".join(sorted(new))}')
+            if reasons:
+                flagged.append(info)
+        return flagged
@@ -0,0 +1,221 @@
+"""Where recordings, captured requests and saved state are kept.
+
+Two kinds of items, each under a name:
+
+  logs       append-only sequences of JSON entries: TCP session recordings
+             (--record), captured HTTP requests (capture)
+  documents  one JSON value replaced as a whole: MQTT retained messages and
+             subscriptions (/mqtt/state/export, preload), the counters kept in
+             <state_dir>/stats.json
+
+The backend is chosen with "storage" in the config (--storage):
+
+  files        one file per name, the name being its path (the default): a log
+               is a JSON Lines file, a document a JSON file
+  sqlite       every item in one SQLite database, <state_dir>/yourtestsrv.db
+  sqlite:PATH  the same in the database at PATH
+
+Names stay the same across backends, so a config switches by changing
+storage alone. In SQLite logs are rows of the entries table (name, seq, at,
+data) and documents rows of the documents table (name, at, data), data
+being the JSON text; one store is easy to query instead of thousands of
+small files:
+
+  sqlite3 yourtestsrv.db "SELECT json_extract(data, '$.path'), count(*)
+                          FROM entries WHERE name = 'requests.jsonl' GROUP BY 1"
+
+Servers take a store= argument and fall back to the module default, which
+the command line replaces once the config is read (see clock.py).
+"""
+
+import contextlib
+import json
+import os
+import sqlite3
+import threading
+import time
+
+BACKENDS = ('files', 'sqlite')
+DATABASE = 'yourtestsrv.db'
+
+
+class Store:
+    """The interface of the backends."""
+
+    def append(self, name, entry):
+        """Add entry (JSON-serializable) at the end of log name, creating it."""
+        raise NotImplementedError
+
+    def entries(self, name):
+        """The entries of log name in order; raises FileNotFoundError when there is none."""
+        raise NotImplementedError
+
+    def clear(self, name):
+        """Empty log name, creating it."""
+        raise NotImplementedError
+
+    def save(self, name, value):
+        """Replace document name with value."""
+        raise NotImplementedError
+
+    def load(self, name):
+        """Document name, or None when it was never saved."""
+        raise NotImplementedError
+
+    def close(self):
+        pass
+
+
+class FileStore(Store):
+    def __init__(self):
+        self._files = {}
+        self._lock = threading.Lock()
+
+    def _open(self, name, mode):
+        f = self._files.pop(name, None)
+        if f:
+            f.close()
+        self._files[name] = f = open(name, mode, encoding='utf-8')
+        return f
+
+    def append(self, name, entry):
+        line = json.dumps(entry) + '\n'
+        with self._lock:
+            f = self._files.get(name) or self._open(name, 'a')
+            f.write(line)
+            f.flush()
+
+    def clear(self, name):
+        with self._lock:
+            self._open(name, 'w')
+
+    def entries(self, name):
+        entries = []
+        with open(name, encoding='utf-8') as f:
+            for lineno, line in enumerate(f, 1):
+                if not line.strip():
+                    continue
+                try:
+                    entries.append(json.loads(line))
+                except ValueError as e:
+                    raise ValueError(f'{name}:{lineno}: {e}') from None
+        return entries
+
+    def save(self, name, value):
+        tmp = name + '.tmp'
+        with open(tmp, 'w', encoding='utf-8') as f:
+            json.dump(value, f, indent=2, sort_keys=True)
+        os.replace(tmp, name)
+
+    def load(self, name):
+        try:
+            with open(name, encoding='utf-8') as f:
+                return json.load(f)
+        except FileNotFoundError:
+            return None
+
+    def close(self):
+        with self._lock:
+            for f in self._files.values():
+                f.close()
+            self._files.clear()
+
+
+class SQLiteStore(Store):
+    def __init__(self, path):
+        self.path = path
+        self._lock = threading.Lock()
+        with self._locked():
+            self._db = sqlite3.connect(path, check_same_thread=False, isolation_level=None)
+            # WAL lets sqlite3 and other readers query the database while the servers write.
+            self._db.execute('PRAGMA journal_mode=WAL')
+            self._db.execute('PRAGMA synchronous=NORMAL')
+            self._db.execute('CREATE TABLE IF NOT EXISTS entries '
+                             '(name TEXT NOT NULL, seq INTEGER PRIMARY KEY AUTOINCREMENT, at REAL, data TEXT)')
+            self._db.execute('CREATE INDEX IF NOT EXISTS entries_name ON entries (name, seq)')
+            self._db.execute('CREATE TABLE IF NOT EXISTS documents (name TEXT PRIMARY KEY, at REAL, data TEXT)')
+            self._db.execute('CREATE TABLE IF NOT EXISTS logs (name TEXT PRIMARY KEY)')
+
+    @contextlib.contextmanager
+    def _locked(self):
+        """Serialize access; database errors (locked, disk full) surface as OSError like file errors."""
+        with self._lock:
+            try:
+                yield
+            except sqlite3.Error as e:
+                raise OSError(f'{self.path}: {e}') from e
+
+    def append(self, name, entry):
+        data = json.dumps(entry)
+        with self._locked():
+            self._db.execute('INSERT OR IGNORE INTO logs VALUES (?)', (name,))
+            self._db.execute('INSERT INTO entries (name, at, data) VALUES (?, ?, ?)', (name, time.time(), data))
+
+    def clear(self, name):
+        with self._locked():
+            self._db.execute('DELETE FROM entries WHERE name = ?', (name,))
+            self._db.execute('INSERT OR IGNORE INTO logs VALUES (?)', (name,))
+
+    def entries(self, name):
+        with self._locked():
+            known = self._db.execute('SELECT 1 FROM logs WHERE name = ?', (name,)).fetchone()
+            rows = self._db.execute('SELECT seq, data FROM entries WHERE name = ? ORDER BY seq', (name,)).fetchall()
+        if not known:
+            raise FileNotFoundError(f'no log {name!r} in {self.path}')
+        entries = []
+        for seq, data in rows:
+            try:
+                entries.append(json.loads(data))
+            except ValueError as e:
+                raise ValueError(f'{self.path}: {name} entry {seq}: {e}') from None
+        return entries
+
+    def save(self, name, value):
+        data = json.dumps(value, sort_keys=True)
+        with self._locked():
+            self._db.execute('INSERT OR REPLACE INTO documents VALUES (?, ?, ?)', (name, time.time(), data))
+
+    def load(self, name):
+        with self._locked():
+            row = self._db.execute('SELECT data FROM documents WHERE name = ?', (name,)).fetchone()
+        return json.loads(row[0]) if row else None
+
+    def close(self):
+        with self._locked():
+            self._db.close()
+
+
+def check_spec(spec):
+    """Raise ValueError unless spec names a backend: 'files', 'sqlite' or 'sqlite:PATH'."""
+    backend, _, path = spec.partition(':')
+    if backend not in BACKENDS or backend == 'files' and path:
+        raise ValueError(f"unknown storage {spec!r} (use 'files', 'sqlite' or 'sqlite:PATH')")
+
+
+def open_store(spec, state_dir=''):
+    """The store spec selects; a bare 'sqlite' keeps its database in state_dir."""
+    check_spec(spec)
+    backend, _, path = spec.partition(':')
+    if backend == 'files':
+        return FileStore()
+    if not path:
+        if state_dir:
+            os.makedirs(state_dir, exist_ok=True)
+        path = os.path.join(state_dir, DATABASE)
+    return SQLiteStore(path)
+
+
+default = FileStore()
+
+
+def get(store=None):
+    """Return store, or the module default when it is None."""
+    return store or default
+
+
+def use(store):
+    """Make store the default, closing the one it replaces."""
+    global default
+    previous, default = default, store
+    if previous is not store:
+        previous.close()
@@ -0,0 +1,196 @@
+"""STUN (RFC 5389) binding responder with wrong-answer scenarios.
+
+The responder plugs into UDPServer and TCPServer as their handler. Modes:
+
+  normal       XOR-MAPPED-ADDRESS with the client's reflexive address
+  wrong_port   reflexive address with the port shifted by one
+  wrong_ip     a fixed address (mapped, default 192.0.2.1 from TEST-NET-1)
+  legacy       only the RFC 3489 MAPPED-ADDRESS attribute, not XORed
+  unxored      XOR-MAPPED-ADDRESS carrying the plain (un-XORed) address
+  no_address   a success response without any address attribute
+  error        a 400 Bad Request error response
+  silent       no response at all
+
+mapped ("host:port") overrides the reported address in every mode that
+reports one. With udp.stun set to a mode, the UDP echo server answers binding
+requests the same way and echoes everything else, so a device can use one
+port for both.
+"""
+
+import ipaddress
+import logging
+import socket
+import struct
+import zlib
+
+from yourtestsrv import logthrottle
+
+logger = logging.getLogger(__name__)
+
+MAGIC_COOKIE = 0x2112A442
+HEADER_SIZE = 20
+
+BINDING_REQUEST = 0x0001
+BINDING_SUCCESS = 0x0101
+BINDING_ERROR = 0x0111
+
+ATTR_MAPPED_ADDRESS = 0x0001
+ATTR_ERROR_CODE = 0x0009
+ATTR_XOR_MAPPED_ADDRESS = 0x0020
+ATTR_SOFTWARE = 0x8022
+ATTR_FINGERPRINT = 0x8028
+
+FINGERPRINT_XOR = 0x5354554E
+SOFTWARE = b'yourtestsrv'
+
+MODES = ('normal', 'wrong_port', 'wrong_ip', 'legacy', 'unxored', 'no_address', 'error', 'silent')
+WRONG_IP = '192.0.2.1'
+
+
+def parse_message(data):
+    """Return (msg_type, transaction_id, attrs) for a STUN message; attrs is a list of (type, value).
+
+    Raises ValueError if data is not a well-formed STUN message.
+    """
+    if len(data) < HEADER_SIZE:
+        raise ValueError('stun: message shorter than header')
+    msg_type, length, cookie = struct.unpack_from('>HHI', data)
+    if msg_type & 0xC000 or cookie != MAGIC_COOKIE:
+        raise ValueError('stun: not a STUN message')
+    if length % 4 or HEADER_SIZE + length != len(data):
+        raise ValueError(f'stun: bad message length {length}')
+    txid = data[8:20]
+    attrs = []
+    pos = HEADER_SIZE
+    while pos < len(data):
+        if pos + 4 > len(data):
+            raise ValueError('stun: truncated attribute header')
+        attr_type, attr_len = struct.unpack_from('>HH', data, pos)
+        value = data[pos + 4:pos + 4 + attr_len]
+        if len(value) != attr_len:
+            raise ValueError('stun: truncated attribute')
+        attrs.append((attr_type, value))
+        pos += 4 + (attr_len + 3) // 4 * 4
+    return msg_type, txid, attrs
+
+
+def is_binding_request(data):
+    """True if data is a well-formed STUN binding request."""
+    try:
+        return parse_message(data)[0] == BINDING_REQUEST
+    except ValueError:
+        return False
+
+
+def _attr(attr_type, value):
+    padding = b'\x00' * (-len(value) % 4)
+    return struct.pack('>HH', attr_type, len(value)) + value + padding
+
+
+def _address(host, port, xor_key=None):
+    """Encode a (XOR-)MAPPED-ADDRESS value; xor_key is cookie + transaction id when XORing."""
+    ip = ipaddress.ip_address(host)
+    raw = ip.packed
+    if xor_key is not None:
+        port ^= MAGIC_COOKIE >> 16
+        raw = bytes(a ^ b for a, b in zip(raw, xor_key))
+    family = 0x01 if ip.version == 4 else 0x02
+    return struct.pack('>BBH', 0, family, port) + raw
+
+
+def decode_address(value, txid=None):
+    """Decode a (XOR-)MAPPED-ADDRESS value to (host, port); pass txid to undo the XOR."""
+    family, port = struct.unpack_from('>xBH', value)
+    raw = value[4:]
+    if family not in (0x01, 0x02) or len(raw) != (4 if family == 0x01 else 16):
+        raise ValueError('stun: bad address attribute')
+    if txid is not None:
+        port ^= MAGIC_COOKIE >> 16
+        raw = bytes(a ^ b for a, b in zip(raw, struct.pack('>I', MAGIC_COOKIE) + txid))
+    return str(ipaddress.ip_address(raw)), port
+
+
+def build_message(msg_type, txid, attrs, fingerprint=True):
+    """Encode a STUN message from (type, value) attributes, appending FINGERPRINT."""
+    body = b''.join(_attr(t, v) for t, v in attrs)
+    if fingerprint:
+        header = struct.pack('>HHI', msg_type, len(body) + 8, MAGIC_COOKIE) + txid
+        crc = (zlib.crc32(header + body) ^ FINGERPRINT_XOR) & 0xFFFFFFFF
+        body += _attr(ATTR_FINGERPRINT, struct.pack('>I', crc))
+    return struct.pack('>HHI', msg_type, len(body), MAGIC_COOKIE) + txid + body
+
+
+class STUNResponder:
+    def __init__(self, mode='normal', mapped=''):
+        if mode not in MODES:
+            raise ValueError(f'unknown stun mode: {mode!r}')
+        self.mode = mode
+        self.mapped = None
+        if mapped:
+            host, _, port = mapped.rpartition(':')
+            ipaddress.ip_address(host.strip('[]'))
+            self.mapped = (host.strip('[]'), int(port))
+        elif mode == 'wrong_ip':
+            self.mapped = (WRONG_IP, None)
+
+    def respond(self, addr, data):
+        """Return the response to a STUN request from addr, or None to stay silent."""
+        try:
+            msg_type, txid, _ = parse_message(data)
+        except ValueError as e:
+            logger.debug(f'STUN ignored datagram from {addr}: {e}')
+            return None
+        if msg_type != BINDING_REQUEST:
+            logger.debug(f'STUN ignored message type {msg_type:#06x} from {addr}')
+            return None
+        if self.mode == 'silent':
+            return None
+        if self.mode == 'error':
+            reason = b'Bad Request'
+            return build_message(BINDING_ERROR, txid, [(ATTR_ERROR_CODE, bytes([0, 0, 4, 0]) + reason),
+                                                      (ATTR_SOFTWARE, SOFTWARE)])
+        host, port = addr[0], addr[1]
+        # IPv4 clients of a dual-stack listener arrive as ::ffff:a.b.c.d; report their IPv4 address.
+        ip = ipaddress.ip_address(host)
+        host = str(ip.ipv4_mapped or ip) if ip.version == 6 else host
+        if self.mapped:
+            host = self.mapped[0]
+            port = self.mapped[1] if self.mapped[1] is not None else port
+        if self.mode == 'wrong_port':
+            port = (port % 0xFFFF) + 1
+        attrs = []
+        if self.mode in ('normal', 'wrong_port', 'wrong_ip'):
+            attrs.append((ATTR_XOR_MAPPED_ADDRESS,
+                          _address(host, port, struct.pack('>I', MAGIC_COOKIE) + txid)))
+        elif self.mode == 'unxored':
+            attrs.append((ATTR_XOR_MAPPED_ADDRESS, _address(host, port)))
+        elif self.mode == 'legacy':
+            attrs.append((ATTR_MAPPED_ADDRESS, _address(host, port)))
+        attrs.append((ATTR_SOFTWARE, SOFTWARE))
+        logger.info(f'STUN binding request from {addr}, mode {self.mode}, reporting {host}:{port}',
+                    extra=logthrottle.event('stun.binding'))
+        return build_message(BINDING_SUCCESS, txid, attrs)
+
+    def handle_udp(self, addr, data):
+        return self.respond(addr, data)
+
+    def handle_tcp(self, conn, addr):
+        """Answer STUN messages framed back to back on a TCP stream (RFC 5389 section 7.2.2)."""
+        conn.settimeout(60.0)
+        buf = b''
+        while True:
+            try:
+                chunk = conn.recv(4096)
+            except (socket.timeout, OSError):
+                return
+            if not chunk:
+                return
+            buf += chunk
+            while len(buf) >= HEADER_SIZE:
+                length = struct.unpack_from('>H', buf, 2)[0]
+                if len(buf) < HEADER_SIZE + length:
+                    break
+                message, buf = buf[:HEADER_SIZE + length], buf[HEADER_SIZE + length:]
+                response = self.respond(addr, message)
+                if response:
+                    conn.sendall(response)
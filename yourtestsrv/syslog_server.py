@@ -0,0 +1,281 @@
+"""Syslog sink: receives, parses and keeps device log messages for assertions.
+
+The receiver plugs into UDPServer (one message per datagram) and TCPServer
+as their handler. On TCP, messages are framed by octet counting
+("LEN SP MSG", RFC 6587) or end at a newline (or NUL); each message picks
+its framing by its first byte. Both formats are parsed:
+
+  RFC 5424  <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD-ID k="v"...] MSG
+  RFC 3164  <PRI>Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG
+
+and a message without a valid PRI is kept as user.notice, as RFC 3164
+says a relay does. Parsed messages are dicts:
+
+  {"seq": 7, "received": 1767322800.123, "peer": "192.168.1.20:514",
+   "transport": "udp", "format": "rfc5424", "facility": "daemon",
+   "severity": "err", "timestamp": "2026-01-02T03:04:05.678Z",
+   "hostname": "dev-1", "app_name": "ota", "procid": "412", "msgid": "FAIL",
+   "structured_data": {"meta@1": {"step": "verify"}}, "message": "bad image"}
+
+The last limit messages are kept in memory (the module's log, shared by
+every receiver in the process). The admin API serves them at GET /syslog,
+filtered by severity (that level and more severe), facility, host, app,
+text (substring of the message) and since (seq), and clears them with
+DELETE /syslog; the `syslog-dump` command prints them.
+"""
+
+import collections
+import http.client
+import json
+import logging
+import re
+import socket
+import threading
+import time
+from urllib.parse import urlencode
+
+from yourtestsrv import logthrottle
+from yourtestsrv.traffic import peer_name
+
+logger = logging.getLogger(__name__)
+
+FACILITIES = ('kern', 'user', 'mail', 'daemon', 'auth', 'syslog', 'lpr', 'news', 'uucp', 'cron', 'authpriv',
+              'ftp', 'ntp', 'security', 'console', 'solaris-cron', 'local0', 'local1', 'local2', 'local3',
+              'local4', 'local5', 'local6', 'local7')
+SEVERITIES = ('emerg', 'alert', 'crit', 'err', 'warning', 'notice', 'info', 'debug')
+# user.notice, for messages without a PRI.
+DEFAULT_PRI = 13
+MAX_MESSAGE = 65536
+NIL = '-'
+
+_PRI = re.compile(rb'<(\d{1,3})>')
+_RFC3164_TIMESTAMP = re.compile(r'([A-Z][a-z]{2} [ \d]\d \d\d:\d\d:\d\d) ')
+_TAG = re.compile(r'([^\s:\[\]]{1,48})(?:\[([^\]]*)\])?: ?')
+_SD_PARAM = re.compile(r'\s*([^\s=\]"]+)="((?:[^"\\]|\\.)*)"')
+
+
+def severity_level(value):
+    """Severity number of a name ('warning') or number; raises ValueError."""
+    if isinstance(value, int) or str(value).isdigit():
+        level = int(value)
+        if 0 <= level < len(SEVERITIES):
+            return level
+    elif value in SEVERITIES:
+        return SEVERITIES.index(value)
+    raise ValueError(f'unknown syslog severity: {value!r} (use one of {", ".join(SEVERITIES)} or 0-7)')
+
+
+def _unescape(value):
+    return re.sub(r'\\(["\\\]])', r'\1', value)
+
+
+def parse_structured_data(text):
+    """(structured data as {id: {param: value}}, rest of the text); raises ValueError."""
+    if text.startswith(NIL):
+        return {}, text[1:]
+    elements = {}
+    while text.startswith('['):
+        match = re.match(r'[^\s=\]"]+', text[1:])
+        if not match:
+            raise ValueError('syslog: structured data element without an id')
+        sd_id, end = match.group(0), 1 + match.end()
+        params = {}
+        while True:
+            param = _SD_PARAM.match(text, end)
+            if not param:
+                break
+            params[param.group(1)] = _unescape(param.group(2))
+            end = param.end()
+        if text[end:end + 1] != ']':
+            raise ValueError(f'syslog: unterminated structured data element {sd_id}')
+        elements[sd_id] = params
+        text = text[end + 1:]
+    if not elements:
+        raise ValueError('syslog: missing structured data')
+    return elements, text
+
+
+def _parse_rfc5424(text, fields):
+    parts = text.split(' ', 5)
+    if len(parts) < 6:
+        raise ValueError('syslog: truncated RFC 5424 header')
+    names = ('timestamp', 'hostname', 'app_name', 'procid', 'msgid')
+    fields.update((name, None if value == NIL else value) for name, value in zip(names, parts[:5]))
+    fields['structured_data'], rest = parse_structured_data(parts[5])
+    message = rest[1:] if rest.startswith(' ') else rest
+    fields['message'] = message[1:] if message.startswith('\ufeff') else message
+    fields['format'] = 'rfc5424'
+
+
+def _parse_rfc3164(text, fields):
+    timestamp = _RFC3164_TIMESTAMP.match(text)
+    if timestamp:
+        fields['timestamp'] = timestamp.group(1)
+        text = text[timestamp.end():]
+        hostname, sep, rest = text.partition(' ')
+        # Some senders leave the hostname out: a "tag:" right after the timestamp.
+        if sep and not _TAG.fullmatch(hostname + ' '):
+            fields['hostname'] = hostname
+            text = rest
+    tag = _TAG.match(text)
+    if tag:
+        fields['app_name'], fields['procid'] = tag.group(1), tag.group(2)
+        text = text[tag.end():]
+    fields['message'] = text
+    fields['format'] = 'rfc3164'
+
+
+def parse(data):
+    """The fields of a syslog message (bytes) as a dict; never fails, unparsable parts end up in message."""
+    data = data.rstrip(b'\r\n\x00')
+    fields = {'format': 'rfc3164', 'timestamp': None, 'hostname': None, 'app_name': None, 'procid': None,
+              'msgid': None, 'structured_data': {}}
+    pri = _PRI.match(data)
+    if pri and int(pri.group(1)) < len(FACILITIES) * 8:
+        value, data = int(pri.group(1)), data[pri.end():]
+    else:
+        value = DEFAULT_PRI
+    fields['facility'], fields['severity'] = FACILITIES[value >> 3], SEVERITIES[value & 7]
+    text = data.decode('utf-8', 'replace')
+    if text.startswith('1 '):
+        try:
+            _parse_rfc5424(text[2:], fields)
+            return fields
+        except ValueError as e:
+            logger.debug(f'Syslog message taken as RFC 3164: {e}')
+            fields.update(timestamp=None, hostname=None, app_name=None, procid=None, msgid=None,
+                          structured_data={})
+    _parse_rfc3164(text, fields)
+    return fields
+
+
+class MessageLog:
+    """The last limit messages, numbered in arrival order (seq)."""
+
+    def __init__(self, limit=1000):
+        self._lock = threading.Lock()
+        self._messages = collections.deque(maxlen=limit)
+        self._seq = 0
+
+    def configure(self, limit):
+        if limit < 1:
+            raise ValueError(f'syslog limit must be at least 1: {limit}')
+        with self._lock:
+            self._messages = collections.deque(self._messages, maxlen=limit)
+
+    def add(self, fields):
+        with self._lock:
+            self._seq += 1
+            message = {'seq': self._seq, **fields}
+            self._messages.append(message)
+        return message
+
+    def query(self, severity=None, facility=None, host=None, app=None, text=None, since=0, limit=0):
+        """The kept messages matching every given filter, oldest first; the newest limit of them if set."""
+        level = severity_level(severity) if severity not in (None, '') else None
+        if facility and facility not in FACILITIES:
+            raise ValueError(f'unknown syslog facility: {facility!r}')
+        with self._lock:
+            messages = list(self._messages)
+        found = [m for m in messages
+                 if m['seq'] > int(since or 0)
+                 and (level is None or SEVERITIES.index(m['severity']) <= level)
+                 and (not facility or m['facility'] == facility)
+                 and (not host or m['hostname'] == host)
+                 and (not app or m['app_name'] == app)
+                 and (not text or text in m['message'])]
+        return found[-int(limit):] if limit else found
+
+    def clear(self):
+        with self._lock:
+            cleared = len(self._messages)
+            self._messages.clear()
+        return cleared
+
+
+log = MessageLog()
+
+
+class SyslogReceiver:
+    def __init__(self, messages=None):
+        self.log = messages or log
+
+    def receive(self, addr, data, transport):
+        fields = parse(data)
+        message = self.log.add({'received': round(time.time(), 3), 'peer': peer_name(addr),
+                                'transport': transport, **fields})
+        logger.info(f'Syslog {message["facility"]}.{message["severity"]} from {message["peer"]}: '
+                    f'{message["message"]}', extra=logthrottle.event('syslog.message'))
+        return message
+
+    def handle_udp(self, addr, data):
+        if data.strip(b'\r\n\x00'):
+            self.receive(addr, data, 'udp')
+        return None
+
+    def handle_tcp(self, conn, addr):
+        """Read octet-counted or newline/NUL-terminated messages until the sender closes."""
+        conn.settimeout(300.0)
+        buf = b''
+        while True:
+            while buf:
+                buf = buf.lstrip(b'\r\n\x00')
+                counted = re.match(rb'(\d{1,5}) ', buf)
+                if counted:
+                    length = int(counted.group(1))
+                    if len(buf) < counted.end() + length:
+                        break
+                    message, buf = buf[counted.end():counted.end() + length], buf[counted.end() + length:]
+                else:
+                    end = re.search(rb'[\n\x00]', buf)
+                    if not end:
+                        if len(buf) > MAX_MESSAGE:
+                            message, buf = buf, b''
+                        else:
+                            break
+                    else:
+                        message, buf = buf[:end.start()], buf[end.end():]
+                if message.strip(b'\r\n\x00'):
+                    self.receive(addr, message, 'tcp')
+            try:
+                chunk = conn.recv(4096)
+            except (socket.timeout, OSError):
+                chunk = b''
+            if not chunk:
+                if buf.strip(b'\r\n\x00'):
+                    self.receive(addr, buf, 'tcp')
+                return
+            buf += chunk
+
+
+def format_message(message):
+    """One line per message, like a syslog file: time host app[pid]: <facility.severity> text."""
+    when = message.get('timestamp') or time.strftime('%Y-%m-%dT%H:%M:%S', time.localtime(message['received']))
+    app = message.get('app_name') or '-'
+    if message.get('procid'):
+        app += f'[{message["procid"]}]'
+    return (f'{when} {message.get("hostname") or message["peer"]} {app}: '
+            f'<{message["facility"]}.{message["severity"]}> {message["message"]}')
+
+
+def fetch(host, port, filters=None, clear=False, timeout=10.0):
+    """The messages an admin server keeps (GET /syslog) matching filters (query keys), then clears them if asked.
+
+    Raises OSError when the admin server cannot be reached and ValueError when
+    it rejects the filters.
+    """
+    query = urlencode({k: v for k, v in (filters or {}).items() if v})
+    conn = http.client.HTTPConnection(host, port, timeout=timeout)
+    try:
+        conn.request('GET', '/syslog' + (f'?{query}' if query else ''))
+        resp = conn.getresponse()
+        body = resp.read()
+        if resp.status != 200:
+            raise ValueError(f'admin server answered {resp.status}: {body.decode(errors="replace").strip()}')
+        messages = json.loads(body)
+        if clear:
+            conn.request('DELETE', '/syslog')
+            conn.getresponse().read()
+        return messages
+    finally:
+        conn.close()
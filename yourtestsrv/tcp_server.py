@@ -1,105 +1,708 @@
+import os
+import random
+import select
 import socket
 import ssl
+import struct
 import threading
-import time
 import logging
 
+from yourtestsrv import clock as clock_module
+from yourtestsrv import faults, handlers, logthrottle, netutil, proxyproto, recording, stats, traffic
+from yourtestsrv.probe import IdleProber
+from yourtestsrv.shaping import TokenBucket, jittered
+
 logger = logging.getLogger(__name__)
 
+# fin and rst close the TCP connection; alert (fatal TLS alert) and truncate (a
+# TLS record cut in half) break the session on TLS listeners and act as fin elsewhere.
+CLOSE_MODES = ('fin', 'rst', 'alert', 'truncate')
+TLS_CLOSE_MODES = ('alert', 'truncate')
+
 
 class TCPServer:
-    def __init__(self, port, bind='0.0.0.0', delay=0.0, close_after=0.0, handler=None):
+    stats_name = 'tcp'
+
+    def __init__(self, port, bind='0.0.0.0', delay=0.0, close_after=0.0, handler=None, response=None,
+                 unix_socket='', framing='raw', delimiter=b'\n', max_line_length=4096, rate_limit=0.0,
+                 clock=None, corrupt_rate=0.0, close_mode='fin', close_after_bytes=0,
+                 stall=False, idle_timeout=30.0, max_connections=0, over_limit='refuse',
+                 over_limit_banner=b'', accept_delay=0.0, handshake_rate=0.0, accept_rate=0.0, workers=0,
+                 proxy_protocol='',
+                 upstream=None, banner=None, dump=None, rules=None, fault_rules=None, keepalive=None,
+                 trickle_delay=0.0, trickle_chunk=1, disconnect_rate=0.0, socket_options=None, buffer_size=4096,
+                 zero_copy=False, drop_link_local=False, recorder=None, replay=None, on_accept=None, on_close=None,
+                 jitter=0.0, latency=None, accept_close_rate=0.0, accept_close_bytes=0, accept_close_mode='fin',
+                 probe_idle=0.0, probe_payload=b'', probe_timeout=10.0):
         self.port = port
         self.bind = bind or '0.0.0.0'
         self.delay = delay
+        # Each delay is spread evenly by up to jitter either way; a latency model
+        # (shaping.Latency) draws every delay from a distribution instead.
+        self.jitter = jitter
+        self.latency = latency
         self.close_after = close_after
         self.handler = handler
+        self.response = response
+        self.unix_socket = unix_socket
+        self.framing = framing
+        self.delimiter = delimiter
+        self.max_line_length = max_line_length
+        self.rate_limit = rate_limit
+        self.trickle_delay = trickle_delay
+        self.trickle_chunk = trickle_chunk
+        self.clock = clock_module.get(clock)
+        self.corrupt_rate = corrupt_rate
+        self.disconnect_rate = disconnect_rate
+        self.close_mode = close_mode
+        self.close_after_bytes = close_after_bytes
+        self.stall = stall
+        self.idle_timeout = idle_timeout
+        self.keepalive = keepalive
+        self.socket_options = socket_options or netutil.SocketOptions()
+        self.buffers = netutil.BufferPool(buffer_size)
+        # Plain echo connections move data socket -> pipe -> socket with os.splice (Linux).
+        self.zero_copy = zero_copy and hasattr(os, 'splice')
+        # IPv6 scenario: reset connections from link-local (fe80::/10) peers.
+        self.drop_link_local = drop_link_local
+        # Accept fuzzing: an accept_close_rate fraction of connections is closed right after accept,
+        # having sent up to accept_close_bytes random bytes, with a FIN or (accept_close_mode 'rst') a RST.
+        self.accept_close_rate = accept_close_rate
+        self.accept_close_bytes = accept_close_bytes
+        self.accept_close_mode = accept_close_mode
+        self.limit = netutil.ConnectionLimit(max_connections, over_limit, over_limit_banner)
+        self.pacer = netutil.AcceptPacer(accept_delay, handshake_rate, self.clock, accept_rate)
+        self.workers = netutil.WorkerPool(workers, 'TCP')
+        self.proxy_protocol = proxy_protocol
+        self.upstream = upstream
+        self.banner = banner
+        self.dump = dump
+        # recorder (recording.SessionRecorder) writes every connection to a file;
+        # replay (recording.SessionReplay) answers strictly from one instead of echoing.
+        self.recorder = recorder
+        self.replay = replay
+        self.rules = rules
+        self.fault_rules = fault_rules
+        # Named handlers installed at runtime (admin API); they override rules and response.
+        self.handlers = handlers.HandlerTable()
+        # Per-connection hooks for library users: on_accept(conn, addr) before anything is sent,
+        # on_close(conn, addr, error) once the connection is done; see _handle_conn.
+        self.on_accept = on_accept
+        self.on_close = on_close
+        self.stats = stats.ServerStats()
+        # Connections silent for probe_idle get probe_payload (or TCP keepalive probes), see probe.py.
+        self.prober = IdleProber(probe_idle, probe_payload, probe_timeout) if probe_idle > 0 else None
+        self.stats.probes = self.prober
+        self._conns = set()
+        self._conns_lock = threading.Lock()
+        self.stats_key = f'{self.stats_name}:{port}'
+        self._addr = None
+        self._stop_event = threading.Event()
 
     def _serve(self, sock, stop_event):
+        self._stop_event = stop_event
+        if self.prober:
+            self.prober.start(stop_event)
+        self.socket_options.apply(sock)
         sock.settimeout(1.0)
-        logger.info(f'TCP server listening on {self.bind}:{self.port}')
+        logger.info(f'TCP server listening on {self._listen_name()}')
         try:
             while not stop_event.is_set():
+                if not self.limit.wait_slot(stop_event):
+                    break
+                if not self.pacer.before_accept(stop_event):
+                    break
                 try:
                     conn, addr = sock.accept()
                 except socket.timeout:
                     continue
                 except OSError:
                     break
-                t = threading.Thread(target=self._handle_conn, args=(conn, addr), daemon=True)
-                t.start()
+                self.pacer.after_accept(stop_event)
+                if self._drop_link_local(conn, addr):
+                    continue
+                self._set_keepalive(conn, addr)
+                self.socket_options.apply(conn)
+                if self._close_on_accept(conn, addr):
+                    continue
+                if not self.limit.admit(conn, addr):
+                    continue
+                self.workers.submit(self._accept_proxied, conn, addr)
         finally:
             sock.close()
 
+    def _set_listener(self, sock):
+        self._addr = sock.getsockname()
+        if sock.family != socket.AF_UNIX:
+            self.port = self._addr[1]
+
+    def _listen_name(self):
+        return self.unix_socket or f'{self.bind}:{self.port}'
+
+    def _open_listener(self):
+        if self.unix_socket:
+            return netutil.listen_unix(self.unix_socket)
+        return netutil.listen_tcp(self.bind, self.port)
+
+    def addr(self):
+        """The bound (host, port) once listening, else None."""
+        return self._addr
+
+    def traffic_totals(self):
+        """Connections, bytes and frames in/out summed over all connections so far, open ones included."""
+        return self.stats.traffic.snapshot()
+
     def listen_and_serve(self, stop_event):
-        sock = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
-        sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
-        sock.bind((self.bind, self.port))
-        sock.listen(128)
+        try:
+            self.serve(stop_event, self._open_listener())
+        finally:
+            if self.unix_socket:
+                netutil.remove_unix(self.unix_socket)
+
+    def serve(self, stop_event, sock):
+        """Serve on a listening socket created by the caller (e.g. bound to port 0)."""
+        self._set_listener(sock)
+        self.stats_key = f'{self.stats_name}:{self.unix_socket or self.port}'
+        stats.register(self.stats_key, self.stats)
         self._serve(sock, stop_event)
 
-    def listen_and_serve_tls(self, stop_event, cert_file, key_file):
-        ctx = ssl.SSLContext(ssl.PROTOCOL_TLS_SERVER)
-        ctx.minimum_version = ssl.TLSVersion.TLSv1_2
-        ctx.load_cert_chain(cert_file, key_file)
-        sock = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
-        sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
-        sock.bind((self.bind, self.port))
-        sock.listen(128)
+    def listen_and_serve_tls(self, stop_event, cert_file, key_file, client_ca_file='', require_client_cert=False,
+                            min_version='', max_version='', ciphers='', alpn=(), alpn_strict=False):
+        try:
+            self.serve_tls(stop_event, self._open_listener(), cert_file, key_file, client_ca_file,
+                           require_client_cert, min_version, max_version, ciphers, alpn, alpn_strict)
+        finally:
+            if self.unix_socket:
+                netutil.remove_unix(self.unix_socket)
+
+    def serve_tls(self, stop_event, sock, cert_file, key_file, client_ca_file='', require_client_cert=False,
+                  min_version='', max_version='', ciphers='', alpn=(), alpn_strict=False):
+        ctx = netutil.server_tls_context(cert_file, key_file, client_ca_file, require_client_cert,
+                                         min_version, max_version, ciphers, alpn)
+        self._set_listener(sock)
+        self._stop_event = stop_event
+        if self.prober:
+            self.prober.start(stop_event)
+        self.socket_options.apply(sock)
         sock.settimeout(1.0)
-        logger.info(f'TCP TLS server listening on {self.bind}:{self.port}')
+        self.stats_key = f'{self.stats_name}-tls:{self.unix_socket or self.port}'
+        stats.register(self.stats_key, self.stats)
+        logger.info(f'TCP TLS server listening on {self._listen_name()}')
         try:
             while not stop_event.is_set():
+                if not self.limit.wait_slot(stop_event):
+                    break
+                if not self.pacer.before_accept(stop_event):
+                    break
                 try:
                     conn, addr = sock.accept()
                 except socket.timeout:
                     continue
                 except OSError:
                     break
-                conn.settimeout(5.0)
-                try:
-                    tls_conn = ctx.wrap_socket(conn, server_side=True)
-                    tls_conn.settimeout(None)
-                except ssl.SSLError as e:
-                    logger.debug(f'TCP TLS handshake error from {addr}: {e}')
-                    conn.close()
+                self.pacer.after_accept(stop_event)
+                if self._drop_link_local(conn, addr):
+                    continue
+                self._set_keepalive(conn, addr)
+                self.socket_options.apply(conn)
+                if self._close_on_accept(conn, addr):
                     continue
-                t = threading.Thread(target=self._handle_conn, args=(tls_conn, addr), daemon=True)
-                t.start()
+                self.workers.submit(self._accept_tls, ctx, conn, addr, client_ca_file, alpn, alpn_strict)
         finally:
             sock.close()
 
-    def _handle_conn(self, conn, addr):
-        logger.info(f'TCP connection from {addr}')
+    def _accept_tls(self, ctx, conn, addr, client_ca_file, alpn, alpn_strict):
+        """Read the PROXY header, if configured, and do the TLS handshake in the connection's own thread."""
+        addr, proxy = proxyproto.accept(conn, addr, self.proxy_protocol, self.stats)
+        if addr is None:
+            conn.close()
+            return
+        conn.settimeout(5.0)
+        relay = netutil.TLSFaultRelay(conn) if self.close_mode in TLS_CLOSE_MODES else None
         try:
+            self.pacer.before_handshake()
+            tls_conn, offered = netutil.accept_tls(ctx, conn, alpn, alpn_strict, relay)
+            tls_conn.settimeout(None)
+        except OSError as e:
+            logger.debug(f'TCP TLS handshake error from {addr}: {e}')
+            self.stats.record_error(stats.ERROR_TLS)
+            if relay:
+                relay.close()
+            conn.close()
+            return
+        if client_ca_file:
+            logger.info(f'TCP TLS client certificate from {addr}: {netutil.peer_subject(tls_conn) or "none"}')
+        if alpn:
+            logger.info(f'TCP TLS ALPN from {addr}: offered {offered or "none"}, '
+                        f'negotiated {tls_conn.selected_alpn_protocol() or "none"}')
+        if not self.limit.admit(tls_conn, addr):
+            return
+        self._handle_conn(tls_conn, addr, proxy, relay)
+
+    def serve_connection(self, conn, addr):
+        """Serve a connection accepted elsewhere (e.g. the WebSocket bridge's socket pair) like one of its own.
+
+        It counts against the connection limit and runs on the worker pool; returns
+        False if the limit rejected (and closed) it.
+        """
+        if not self.limit.admit(conn, addr):
+            return False
+        self.workers.submit(self._handle_conn, conn, addr)
+        return True
+
+    def _accept_proxied(self, conn, addr):
+        """Read the PROXY header, if configured, in the connection's own thread."""
+        addr, proxy = proxyproto.accept(conn, addr, self.proxy_protocol, self.stats)
+        if addr is None:
+            self.limit.release()
+            conn.close()
+            return
+        self._handle_conn(conn, addr, proxy)
+
+    def _handle_conn(self, conn, addr, proxy=None, relay=None):
+        """Serve one connection, wrapped in the on_accept/on_close hooks.
+
+        An exception from on_accept closes the connection without serving it and
+        becomes the error handed to on_close.
+        """
+        logger.info(f'TCP connection from {addr}', extra=logthrottle.event('tcp.connect'))
+        info = stats.connections.open(self.stats_key, addr, self.stats)
+        if proxy is not None:
+            info.proxy = proxy.to_dict()
+        with self._conns_lock:
+            self._conns.add(conn)
+        if self.recorder:
+            self.recorder.open(self.stats_key, addr)
+        counted = stats.CountingConn(conn, info)
+        if self.prober:
+            self.prober.add(counted, info)
+        try:
+            if self.on_accept:
+                try:
+                    self.on_accept(counted, addr)
+                except Exception as e:
+                    logger.info(f'TCP connection from {addr} rejected by on_accept: {e}')
+                    info.error = e
+                    return
+            if self.banner and not (self.close_mode == 'rst' and not self.close_after_bytes):
+                self._send_banner(counted, addr)
+                info.count('frames_out')
             if self.close_after > 0:
-                time.sleep(self.close_after)
+                self.clock.sleep(self.close_after)
                 logger.info(f'TCP connection closed (close-after): {addr}')
                 return
+            if self.stall:
+                self._stall(conn, addr)
+                return
+            if self.close_mode == 'rst' and not self.close_after_bytes:
+                logger.info(f'TCP connection reset on accept: {addr}')
+                return
             if self.handler:
-                self.handler(conn, addr)
+                self.handler(counted, addr)
+            elif self.replay:
+                self._replay(counted, addr, info)
+            elif self.upstream:
+                self._forward(counted, addr, info)
+            elif self._can_splice(conn):
+                self._splice_echo(counted, addr, info)
             else:
-                self._default_handle(conn, addr)
+                self._default_handle(counted, addr, info)
+        except Exception as e:
+            info.error = e
+            raise
         finally:
+            if self.on_close:
+                try:
+                    self.on_close(counted, addr, info.error)
+                except Exception as e:
+                    logger.warning(f'TCP on_close hook failed for {addr}: {e}')
+            with self._conns_lock:
+                self._conns.discard(conn)
+            if self.prober:
+                self.prober.remove(info)
+            if self.recorder:
+                self.recorder.close(addr)
+            stats.connections.close(info)
+            self.limit.release()
+            if self.close_mode == 'rst':
+                self._set_abortive_close(conn)
+            if relay and self.close_mode == 'alert':
+                relay.alert(conn)
+            elif relay:
+                relay.truncate(conn)
             try:
                 conn.close()
             except Exception:
                 pass
 
-    def _default_handle(self, conn, addr):
-        conn.settimeout(30.0)
+    def _fail(self, info, error):
+        """Count error in the server stats and keep it as the reason the connection ends."""
+        self.stats.record_error(error)
+        if info:
+            info.error = error
+
+    def _send_banner(self, conn, addr):
+        """Greet the client before reading anything, SMTP/FTP style."""
+        host, port = addr[:2] if isinstance(addr, tuple) else (addr, '')
+        data = self.banner.next(remote=f'{host}:{port}' if port != '' else host, remote_host=host, remote_port=port)
+        logger.info(f'TCP banner to {addr}: {data!r}')
+        try:
+            self._write(conn, data, None, addr)
+        except OSError as e:
+            self.stats.record_error(e)
+
+    def _stall(self, conn, addr):
+        """Never read from conn so the client's writes back up, until it closes or the server stops.
+
+        A client close is noticed by polling the socket for a hang-up, which works on TLS
+        connections too; where POLLRDHUP is missing (not Linux), only once nothing is
+        buffered, since unread data sits in front of the FIN.
+        """
+        logger.info(f'TCP connection stalled (not reading): {addr}')
+        poller = select.poll()
+        poller.register(conn.fileno(), select.POLLHUP | select.POLLERR | getattr(select, 'POLLRDHUP', 0))
+        while not self._stop_event.wait(1.0):
+            if poller.poll(0):
+                logger.info(f'TCP stalled connection closed by client: {addr}')
+                return
+
+    def _set_keepalive(self, conn, addr):
+        try:
+            netutil.set_keepalive(conn, self.keepalive)
+        except OSError as e:
+            logger.debug(f'TCP keepalive setup failed for {addr}: {e}')
+
+    def _drop_link_local(self, conn, addr):
+        """Reset conn if it comes from a link-local peer and drop_link_local is on.
+
+        The SYN cannot be dropped from user space, so the client sees a reset
+        right after connecting instead of a timeout.
+        """
+        if not self.drop_link_local or not netutil.is_link_local(addr):
+            return False
+        logger.info(f'TCP connection from link-local {addr} dropped')
+        self._set_abortive_close(conn)
+        conn.close()
+        return True
+
+    def _close_on_accept(self, conn, addr):
+        """Close conn before reading anything for an accept_close_rate fraction of connections,
+        first sending 0 to accept_close_bytes random bytes; returns True if it did.
+
+        This happens in the accept loop, ahead of PROXY headers and TLS handshakes.
+        """
+        if self.accept_close_rate <= 0 or random.random() >= self.accept_close_rate:
+            return False
+        info = stats.connections.open(self.stats_key, addr, self.stats)
+        data = os.urandom(random.randint(0, self.accept_close_bytes))
+        try:
+            if data:
+                conn.settimeout(1.0)
+                stats.CountingConn(conn, info).sendall(data)
+        except OSError as e:
+            self.stats.record_error(e)
+        logger.info(f'TCP connection from {addr} closed on accept ({self.accept_close_mode}) after {len(data)} bytes',
+                    extra=logthrottle.event('tcp.close'))
+        if self.accept_close_mode == 'rst':
+            self._set_abortive_close(conn)
+        conn.close()
+        stats.connections.close(info)
+        return True
+
+    @staticmethod
+    def _set_abortive_close(conn):
+        # SO_LINGER with a zero timeout makes close() send RST instead of FIN.
+        try:
+            conn.setsockopt(socket.SOL_SOCKET, socket.SO_LINGER, struct.pack('ii', 1, 0))
+        except OSError as e:
+            logger.debug(f'TCP SO_LINGER failed: {e}')
+
+    def _default_handle(self, conn, addr, info=None):
+        conn.settimeout(self.idle_timeout or None)
+        buf = b''
+        # Separate buckets shape each direction to rate_limit bytes/s.
+        reader = TokenBucket(self.rate_limit, clock=self.clock) if self.rate_limit > 0 else None
+        writer = TokenBucket(self.rate_limit, clock=self.clock) if self.rate_limit > 0 else None
+        sent = 0
+
+        def reply(data):
+            """Write data, cut at close_after_bytes; returns False once the limit is reached."""
+            nonlocal sent
+            if self.close_after_bytes:
+                data = data[:self.close_after_bytes - sent]
+            self._write(conn, data, writer, addr)
+            if info:
+                info.count('frames_out')
+            sent += len(data)
+            if self.close_after_bytes and sent >= self.close_after_bytes:
+                logger.info(f'TCP connection closed after {sent} bytes ({self.close_mode}): {addr}')
+                return False
+            return True
+
+        def answer(frame, echo):
+            """Reply to one frame by the first matching rule, else echo/response; False ends the connection."""
+            if self.disconnect_rate > 0 and random.random() < self.disconnect_rate:
+                logger.info(f'TCP random disconnect ({self.close_mode}) after a frame from {addr}')
+                return False
+            fault = self.fault_rules.match(frame) if self.fault_rules else None
+            if fault:
+                if fault.delay > 0:
+                    self.clock.sleep(fault.delay)
+                if fault.dropped():
+                    logger.info(f'TCP fault rule dropped the reply to {addr}')
+                    return True
+            swapped = self.handlers.match() if self.handlers else None
+            # A handler replaces the parts it sets; the rest stay the listener's own.
+            rules = (swapped and swapped.rules) or self.rules
+            response = (swapped and swapped.response) or self.response
+            rule = rules.match(frame) if rules else None
+            if rule is None:
+                data = response.build(frame) if response else echo
+                return reply(fault.corrupt(data) if fault else data)
+            if rule.delay > 0:
+                self.clock.sleep(rule.delay)
+            if rule.action in ('close', 'rst'):
+                logger.info(f'TCP rule closed connection ({rule.action}): {addr}')
+                if rule.action == 'rst':
+                    self._set_abortive_close(conn)
+                return False
+            data = rule.build(frame)
+            if fault:
+                data = fault.corrupt(data)
+            return reply(data) if data else True
+
+        # Chunks are read into a pooled buffer. A plain echo sends the received view straight
+        # back; everything else works on a bytes copy, since frames may outlive the next read.
+        plain = self.framing == 'raw' and not (self.response or self.rules or self.fault_rules
+                                               or self.disconnect_rate)
+        buffer = self.buffers.get()
+        view = memoryview(buffer)
         try:
             while True:
-                if self.delay > 0:
-                    time.sleep(self.delay)
+                self._pause()
                 try:
-                    data = conn.recv(4096)
-                except socket.timeout:
+                    n = conn.recv_into(view, min(len(view), reader.burst) if reader else len(view))
+                    if reader and n:
+                        reader.consume(n)
+                except socket.timeout as e:
+                    logger.info(f'TCP connection idle for {self.idle_timeout}s, closing: {addr}')
+                    self._fail(info, e)
+                    return
+                if not n:
+                    logger.info(f'TCP connection closed by client: {addr}', extra=logthrottle.event('tcp.close'))
+                    return
+                data = view[:n] if plain and not self.handlers else bytes(view[:n])
+                if logger.isEnabledFor(logging.INFO):
+                    logger.info('TCP received from %s: %s', addr, logthrottle.LazyHex(data),
+                                extra=logthrottle.event('tcp.rx'))
+                self._record_rx(addr, data)
+                if self.framing == 'delim':
+                    buf += data
+                    *frames, buf = buf.split(self.delimiter)
+                    if info:
+                        info.touch(len(buf))
+                    for frame in frames:
+                        if info:
+                            info.count('frames_in')
+                        if not answer(frame, frame + self.delimiter):
+                            return
+                    if len(buf) > self.max_line_length:
+                        logger.info(f'TCP line from {addr} exceeds {self.max_line_length} bytes, closing')
+                        self._fail(info, ValueError(f'line exceeds {self.max_line_length} bytes'))
+                        return
+                    continue
+                if info:
+                    info.touch(len(data))
+                    info.count('frames_in')
+                if not answer(data, data):
+                    return
+        except (OSError, ValueError) as e:
+            self._fail(info, e)
+        finally:
+            view.release()
+            self.buffers.put(buffer)
+
+    def _pause(self):
+        delay = self.latency.sample() if self.latency else jittered(self.delay, self.jitter)
+        if delay > 0:
+            self.clock.sleep(delay)
+
+    def _can_splice(self, conn):
+        """Whether conn is a plain echo on a kernel socket that _splice_echo can serve."""
+        return (self.zero_copy and not isinstance(conn, ssl.SSLSocket) and self.framing == 'raw'
+                and not (self.response or self.rules or self.handlers or self.fault_rules or self.delay
+                         or self.jitter or self.latency or self.rate_limit or self.corrupt_rate or self.disconnect_rate
+                         or self.close_after_bytes or self.trickle_delay or self.dump or self.recorder))
+
+    def _splice_echo(self, conn, addr, info):
+        """Echo through a pipe with os.splice, so the data never enters Python.
+
+        Bytes and chunks are counted as usual, but chunks are neither logged
+        nor published to the traffic tail.
+        """
+        logger.info(f'TCP zero-copy echo for {addr}')
+        fd = conn.fileno()
+        conn.setblocking(True)
+        poller = select.poll()
+        poller.register(fd, select.POLLIN)
+        pipe_r, pipe_w = os.pipe()
+        try:
+            while True:
+                if not poller.poll(self.idle_timeout * 1000 if self.idle_timeout else None):
+                    logger.info(f'TCP connection idle for {self.idle_timeout}s, closing: {addr}')
+                    self._fail(info, socket.timeout('timed out'))
+                    return
+                n = os.splice(fd, pipe_w, self.buffers.size)
+                if not n:
+                    logger.info(f'TCP connection closed by client: {addr}', extra=logthrottle.event('tcp.close'))
                     return
+                info.count('bytes_in', n)
+                info.touch(n)
+                info.count('frames_in')
+                left = n
+                while left:
+                    left -= os.splice(pipe_r, fd, left)
+                info.count('bytes_out', n)
+                info.count('frames_out')
+        except OSError as e:
+            self._fail(info, e)
+        finally:
+            os.close(pipe_r)
+            os.close(pipe_w)
+
+    def _forward(self, conn, addr, info=None):
+        """Relay conn to the upstream address, applying delay, rate limit, corruption and
+        close_after_bytes to the relayed data like the echo path does."""
+        host, port = self.upstream
+        try:
+            upstream = socket.create_connection((host, port), timeout=10.0)
+        except OSError as e:
+            logger.info(f'TCP upstream {host}:{port} unreachable for {addr}: {e}')
+            self._fail(info, e)
+            return
+        upstream.settimeout(None)
+        conn.settimeout(None)
+        logger.info(f'TCP forwarding {addr} to upstream {host}:{port}')
+        try:
+            threading.Thread(target=self._pump, args=(conn, upstream, addr, 'to upstream', info, False),
+                             daemon=True).start()
+            self._pump(upstream, conn, addr, 'from upstream', info, True)
+        finally:
+            # Wake the thread still reading the client so the connection can close.
+            try:
+                conn.shutdown(socket.SHUT_RD)
+            except OSError:
+                pass
+            upstream.close()
+
+    def _pump(self, src, dst, addr, direction, info, to_client):
+        """Copy src to dst until EOF; close_after_bytes applies to the direction towards the client."""
+        bucket = TokenBucket(self.rate_limit, clock=self.clock) if self.rate_limit > 0 else None
+        sent = 0
+        try:
+            while True:
+                data = src.recv(min(4096, bucket.burst) if bucket else 4096)
                 if not data:
-                    logger.info(f'TCP connection closed by client: {addr}')
+                    break
+                self._pause()
+                logger.debug(f'TCP {direction} for {addr}: {data.hex()}')
+                if not to_client:
+                    self._record_rx(addr, data)
+                if info:
+                    info.touch(len(data))
+                    info.count('frames_out' if to_client else 'frames_in')
+                if to_client and self.close_after_bytes:
+                    data = data[:self.close_after_bytes - sent]
+                self._write(dst, data, bucket, addr if to_client else None)
+                sent += len(data)
+                if to_client and self.close_after_bytes and sent >= self.close_after_bytes:
+                    logger.info(f'TCP connection closed after {sent} bytes ({self.close_mode}): {addr}')
                     return
-                logger.info(f'TCP received from {addr}: {data.hex()}')
+            dst.shutdown(socket.SHUT_WR)
+        except (OSError, ValueError) as e:
+            logger.debug(f'TCP relay {direction} for {addr} ended: {e}')
+
+    def _record_rx(self, addr, data):
+        """Hand data received from addr to the dump, the recorder and the traffic tail."""
+        if self.dump:
+            self.dump.record(self.stats_key, addr, 'rx', data)
+        if self.recorder:
+            self.recorder.record(addr, 'rx', data)
+        traffic.publish('tcp', self.stats_key, addr, 'rx', data)
+
+    def _replay(self, conn, addr, info):
+        """Play the next recorded connection; the first divergence from it resets the connection."""
+        number, steps = self.replay.next_connection()
+        logger.info(f'TCP replaying recorded connection {number} ({len(steps)} steps) to {addr}')
+        conn.settimeout(self.idle_timeout or None)
+        try:
+            for i, (direction, expected) in enumerate(steps, 1):
+                if direction == 'tx':
+                    self._write(conn, expected, None, addr)
+                    info.count('frames_out')
+                    continue
+                got = b''
+                while len(got) < len(expected):
+                    data = conn.recv(len(expected) - len(got))
+                    if data:
+                        self._record_rx(addr, data)
+                    got += data
+                    if not data or not expected.startswith(got):
+                        raise recording.divergence(i, expected, got)
+                info.count('frames_in')
+            try:
+                data = conn.recv(4096)
+            except socket.timeout:
+                data = b''
+            if data:
+                self._record_rx(addr, data)
+                raise recording.ReplayDivergence(f'data after the last recorded step: {data.hex()}')
+            logger.info(f'TCP replay of recorded connection {number} matched: {addr}')
+        except recording.ReplayDivergence as e:
+            logger.warning(f'TCP replay of recorded connection {number} diverged for {addr}: {e}')
+            self._fail(info, e)
+            self._set_abortive_close(conn)
+        except OSError as e:
+            logger.info(f'TCP replay of recorded connection {number} to {addr} failed: {e}')
+            self._fail(info, e)
+
+    def _write(self, conn, data, bucket, peer=None):
+        """Send data (corrupted and shaped as configured); peer names the client for the dump."""
+        if self.corrupt_rate > 0:
+            data = faults.corrupt(data, self.corrupt_rate)
+        if peer is not None:
+            if self.dump:
+                self.dump.record(self.stats_key, peer, 'tx', data)
+            if self.recorder:
+                self.recorder.record(peer, 'tx', data)
+            traffic.publish('tcp', self.stats_key, peer, 'tx', data)
+        if peer is not None and self.trickle_delay > 0:
+            # Dribble replies to the client trickle_chunk bytes at a time.
+            for i in range(0, len(data), self.trickle_chunk):
+                if i:
+                    self.clock.sleep(self.trickle_delay)
+                chunk = data[i:i + self.trickle_chunk]
+                if bucket:
+                    bucket.consume(len(chunk))
+                conn.sendall(chunk)
+            return
+        if bucket is None:
+            conn.sendall(data)
+            return
+        for i in range(0, len(data), bucket.burst):
+            chunk = data[i:i + bucket.burst]
+            bucket.consume(len(chunk))
+            conn.sendall(chunk)
+
+    def push(self, data):
+        """Send data to every connected client; returns how many were reached."""
+        with self._conns_lock:
+            conns = list(self._conns)
+        sent = 0
+        for conn in conns:
+            try:
                 conn.sendall(data)
-        except (ConnectionResetError, BrokenPipeError, OSError):
-            pass
+                sent += 1
+            except OSError as e:
+                logger.debug(f'TCP push failed: {e}')
+        return sent
@@ -0,0 +1,209 @@
+"""Telnet responder: the shell embedded gateways probe during provisioning.
+
+Runs as a TCPServer handler. On connect it offers WILL ECHO and WILL
+SUPPRESS-GO-AHEAD (the character-at-a-time mode of most device shells),
+accepts the client's SUPPRESS-GO-AHEAD and refuses every other option, so
+negotiation always terminates. Subnegotiations (terminal type, window size)
+are skipped, IAC IAC is a literal 0xff and AYT is answered.
+
+After the optional banner and login (username/password prompts; the
+password is not echoed) every line is echoed back as typed and the prompt
+sent again. Lines found in responses get that canned reply (handy for
+"show version" probes); exit, quit and logout close the session.
+
+  negotiate=False  send no options and leave echoing to the client, like a raw TCP console
+  echo=False       offer WONT ECHO and leave echoing to the client
+  delay            pause before each reply
+"""
+
+import logging
+
+from yourtestsrv import clock as clock_module
+
+logger = logging.getLogger(__name__)
+
+IAC = 255
+DONT = 254
+DO = 253
+WONT = 252
+WILL = 251
+SB = 250
+AYT = 246
+SE = 240
+
+OPT_ECHO = 1
+OPT_SGA = 3
+
+EXIT_COMMANDS = ('exit', 'quit', 'logout')
+MAX_LINE = 4096
+
+
+class TelnetSession:
+    """Protocol state of one connection: strips IAC sequences from the input and answers them."""
+
+    def __init__(self, conn, echo=True):
+        self.conn = conn
+        self.local = {OPT_SGA: True}  # options we perform
+        if echo:
+            self.local[OPT_ECHO] = True
+        self.remote = {OPT_SGA: False}  # options the client performs
+        self._pending = b''
+        self._input = bytearray()
+        self._after_cr = False
+
+    @property
+    def echo(self):
+        return self.local.get(OPT_ECHO, False)
+
+    def offer(self):
+        self.conn.sendall(bytes([IAC, WILL if self.echo else WONT, OPT_ECHO, IAC, WILL, OPT_SGA]))
+
+    def feed(self, data):
+        """Returns the data bytes in data, replying to the commands in between."""
+        data = self._pending + data
+        out = bytearray()
+        replies = bytearray()
+        i = 0
+        while i < len(data):
+            b = data[i]
+            if b != IAC:
+                out.append(b)
+                i += 1
+                continue
+            if i + 1 >= len(data):
+                break
+            cmd = data[i + 1]
+            if cmd == IAC:
+                out.append(IAC)
+                i += 2
+            elif cmd in (DO, DONT, WILL, WONT):
+                if i + 2 >= len(data):
+                    break
+                replies += self._negotiate(cmd, data[i + 2])
+                i += 3
+            elif cmd == SB:
+                end = data.find(bytes([IAC, SE]), i + 2)
+                if end < 0:
+                    break
+                i = end + 2
+            else:
+                if cmd == AYT:
+                    replies += b'\r\n[yes]\r\n'
+                i += 2
+        self._pending = data[i:]
+        if replies:
+            self.conn.sendall(bytes(replies))
+        return bytes(out)
+
+    def _negotiate(self, cmd, option):
+        # Only state changes are answered, which keeps two implementations from looping (RFC 854).
+        if cmd in (DO, DONT):
+            state, yes, no = self.local, WILL, WONT
+        else:
+            state, yes, no = self.remote, DO, DONT
+        wanted = cmd in (DO, WILL)
+        if option not in state:
+            return bytes([IAC, no, option]) if wanted else b''
+        if state[option] == wanted:
+            return b''
+        state[option] = wanted
+        return bytes([IAC, yes if wanted else no, option])
+
+    def read_line(self, echo=True):
+        """Next line of input without its terminator (CR LF, CR NUL or LF), or None at EOF.
+
+        Typed characters are echoed while the ECHO option is on and echo is set.
+        """
+        line = bytearray()
+        echoed = bytearray()
+        while True:
+            if not self._input:
+                if echoed and self.echo:
+                    self.conn.sendall(bytes(echoed))
+                echoed.clear()
+                data = self.conn.recv(1024)
+                if not data:
+                    return None
+                self._input += self.feed(data)
+                continue
+            b = self._input.pop(0)
+            if self._after_cr and b in (0x0a, 0x00):
+                self._after_cr = False
+                continue
+            self._after_cr = b == 0x0d
+            if b in (0x0d, 0x0a):
+                if echo and self.echo:
+                    self.conn.sendall(bytes(echoed) + b'\r\n')
+                return line.decode('utf-8', 'replace')
+            if b in (0x08, 0x7f):
+                if line:
+                    line.pop()
+                    if echo:
+                        echoed += b'\b \b'
+            elif b and len(line) < MAX_LINE:
+                line.append(b)
+                if echo:
+                    echoed.append(b)
+
+
+class TelnetResponder:
+    def __init__(self, prompt='$ ', banner='', username='', password='', responses=None, negotiate=True,
+                 echo=True, delay=0.0, clock=None):
+        self.prompt = prompt
+        self.banner = banner
+        self.username = username
+        self.password = password
+        self.responses = dict(responses or {})
+        self.negotiate = negotiate
+        self.echo = echo
+        self.delay = delay
+        self.clock = clock_module.get(clock)
+
+    def handle(self, conn, addr):
+        """TCPServer handler: negotiate, log in and answer lines until the client leaves."""
+        conn.settimeout(300.0)
+        session = TelnetSession(conn, self.echo and self.negotiate)
+        try:
+            if self.negotiate:
+                session.offer()
+            if self.banner:
+                conn.sendall(self._text(self.banner) + b'\r\n')
+            if (self.username or self.password) and not self._login(session, addr):
+                return
+            while True:
+                conn.sendall(self._text(self.prompt))
+                line = session.read_line()
+                if line is None:
+                    break
+                command = line.strip()
+                logger.info(f'Telnet {addr}: {command!r}')
+                if command in EXIT_COMMANDS:
+                    break
+                if command in self.responses:
+                    if self.delay > 0:
+                        self.clock.sleep(self.delay)
+                    conn.sendall(self._text(self.responses[command]) + b'\r\n')
+        except OSError as e:
+            logger.info(f'Telnet session with {addr} failed: {e}')
+        finally:
+            logger.info(f'Telnet connection closed: {addr}')
+
+    def _login(self, session, addr):
+        conn = session.conn
+        conn.sendall(b'login: ')
+        user = session.read_line()
+        conn.sendall(b'Password: ')
+        password = session.read_line(echo=False)
+        if user is None or password is None:
+            return False
+        conn.sendall(b'\r\n')  # the password line was not echoed
+        if user.strip() == self.username and password == self.password:
+            logger.info(f'Telnet login from {addr} as {user.strip()!r}')
+            return True
+        logger.info(f'Telnet login from {addr} failed for {user.strip()!r}')
+        conn.sendall(b'Login incorrect\r\n')
+        return False
+
+    @staticmethod
+    def _text(text):
+        return text.replace('\r\n', '\n').replace('\n', '\r\n').encode()
@@ -0,0 +1,371 @@
+"""TFTP server (RFC 1350, options of RFC 2347/2348/2349) for firmware transfer tests.
+
+The responder plugs into UDPServer as its handler. Each read (RRQ) or write
+(WRQ) request is served from a socket of its own, whose port is the transfer
+ID, as the protocol requires. The options blksize (8 bytes up to blksize),
+timeout (seconds the server waits before retransmitting) and tsize are
+acknowledged with an OACK. Paths are confined to the root directory. An
+upload goes to NAME.part and is renamed once complete, so a failed one does
+not leave a truncated file. netascii transfers convert line ends.
+
+Faults:
+
+  drop_rate  probability of not sending a DATA (reads) or ACK (writes)
+             packet, so the client has to time out and retransmit
+  delay      before every DATA or ACK packet (per block)
+  read_only  refuse writes with an access violation
+
+The server retransmits its last packet when the client does not answer
+within the timeout, retries times, then gives up with an error; a client
+repeating its previous packet gets the last one again at once. After the
+last ACK of an upload it keeps answering a retransmitted last block for as
+long, in case that ACK got lost. A request repeated while its transfer runs
+(the client missed the first answer) is left to that transfer's
+retransmission.
+"""
+
+import errno
+import logging
+import os
+import random
+import socket
+import struct
+import threading
+import time
+
+from yourtestsrv import clock as clock_module
+from yourtestsrv import logthrottle
+from yourtestsrv.sftp_server import FileRoot
+
+logger = logging.getLogger(__name__)
+
+RRQ, WRQ, DATA, ACK, ERROR, OACK = 1, 2, 3, 4, 5, 6
+OPCODES = {RRQ: 'RRQ', WRQ: 'WRQ', DATA: 'DATA', ACK: 'ACK', ERROR: 'ERROR', OACK: 'OACK'}
+# Error codes.
+NOT_DEFINED, NOT_FOUND, ACCESS_VIOLATION, DISK_FULL, ILLEGAL_OPERATION, UNKNOWN_TID, FILE_EXISTS, NO_SUCH_USER, \
+    BAD_OPTION = range(9)
+MODES = ('octet', 'netascii')
+BLOCK_SIZE = 512
+MIN_BLKSIZE = 8
+MAX_BLKSIZE = 65464
+
+
+def parse_request(data):
+    """(opcode, filename, mode, options) of an RRQ or WRQ; raises ValueError."""
+    if len(data) < 4:
+        raise ValueError(f'tftp: packet of {len(data)} bytes')
+    opcode = struct.unpack_from('>H', data)[0]
+    if opcode not in (RRQ, WRQ):
+        raise ValueError(f'tftp: opcode {opcode} is not a request')
+    fields = data[2:].split(b'\x00')
+    if len(fields) < 3 or fields[-1] != b'' or len(fields) % 2 == 0:
+        raise ValueError('tftp: malformed request')
+    try:
+        fields = [field.decode('ascii') for field in fields[:-1]]
+    except UnicodeDecodeError:
+        raise ValueError('tftp: request is not ASCII') from None
+    options = {fields[i].lower(): fields[i + 1] for i in range(2, len(fields), 2)}
+    return opcode, fields[0], fields[1].lower(), options
+
+
+def encode_request(opcode, filename, mode='octet', options=None):
+    fields = [filename, mode] + [str(item) for pair in (options or {}).items() for item in pair]
+    return struct.pack('>H', opcode) + b''.join(field.encode('ascii') + b'\x00' for field in fields)
+
+
+def encode_error(code, message):
+    return struct.pack('>HH', ERROR, code) + message.encode('ascii', 'replace') + b'\x00'
+
+
+def encode_oack(options):
+    return struct.pack('>H', OACK) + b''.join(f'{k}\x00{v}\x00'.encode('ascii') for k, v in options.items())
+
+
+def to_netascii(data):
+    return data.replace(b'\r', b'\r\x00').replace(b'\n', b'\r\n')
+
+
+def from_netascii(data):
+    return data.replace(b'\r\n', b'\n').replace(b'\r\x00', b'\r')
+
+
+class TransferError(Exception):
+    def __init__(self, code, message):
+        super().__init__(message)
+        self.code = code
+
+
+class Transfer:
+    """One read or write, run on its own socket (transfer ID) in a thread."""
+
+    def __init__(self, responder, sock, addr, opcode, filename, mode, options):
+        self.responder = responder
+        self.sock = sock
+        self.addr = addr
+        self.opcode = opcode
+        self.filename = filename
+        self.mode = mode
+        self.options = options
+        self.blksize = BLOCK_SIZE
+        self.timeout = responder.timeout
+        self.bytes = 0
+        # The final ACK of an upload and its block number, for _dally.
+        self.last = None
+
+    def run(self):
+        kind = OPCODES[self.opcode]
+        try:
+            if self.mode not in MODES:
+                raise TransferError(ILLEGAL_OPERATION, f'unsupported mode {self.mode}')
+            if self.opcode == RRQ:
+                self._read()
+            else:
+                self._write()
+            self.responder.completed += 1
+            logger.info(f'TFTP {kind} {self.filename} from {self.addr} done, {self.bytes} bytes in blocks of '
+                        f'{self.blksize}', extra=logthrottle.event('tftp.transfer'))
+            if self.opcode == WRQ:
+                self._dally(*self.last)
+        except TransferError as e:
+            self.responder.failed += 1
+            logger.info(f'TFTP {kind} {self.filename} from {self.addr} failed: {e}',
+                        extra=logthrottle.event('tftp.transfer'))
+            if e.code is not None:
+                self._send(encode_error(e.code, str(e)))
+        except OSError as e:
+            self.responder.failed += 1
+            logger.info(f'TFTP {kind} {self.filename} from {self.addr} failed: {e}',
+                        extra=logthrottle.event('tftp.transfer'))
+        finally:
+            self.sock.close()
+            self.responder.finished(self.addr)
+
+    def _send(self, packet):
+        self.sock.sendto(packet, self.addr)
+
+    def _send_block(self, packet):
+        """Send a DATA or ACK packet, subject to the delay and drop faults."""
+        responder = self.responder
+        if responder.delay > 0:
+            responder.clock.sleep(responder.delay)
+        if responder.drop_rate > 0 and random.random() < responder.drop_rate:
+            responder.dropped += 1
+            logger.debug(f'TFTP dropped {OPCODES[struct.unpack_from(">H", packet)[0]]} to {self.addr}')
+            return
+        self._send(packet)
+
+    def _receive(self, packet, expected, fault=True):
+        """Send packet and return the body of the client packet that expected(opcode, number, body) accepts.
+
+        packet is sent again on a timeout or when expected returns 'retransmit'.
+        """
+        send = self._send_block if fault else self._send
+        send(packet)
+        retries = 0
+        while True:
+            self.sock.settimeout(self.timeout)
+            try:
+                data, addr = self.sock.recvfrom(MAX_BLKSIZE + 4)
+            except socket.timeout:
+                retries += 1
+                if retries > self.responder.retries:
+                    raise TransferError(NOT_DEFINED, 'timed out') from None
+                send(packet)
+                continue
+            if addr[:2] != self.addr[:2]:
+                self.sock.sendto(encode_error(UNKNOWN_TID, 'unknown transfer ID'), addr)
+                continue
+            if len(data) < 4:
+                continue
+            opcode, number = struct.unpack_from('>HH', data)
+            if opcode == ERROR:
+                message = data[4:].split(b'\x00', 1)[0].decode('ascii', 'replace')
+                raise TransferError(None, f'client error {number}: {message}')
+            answer = expected(opcode, number, data[4:])
+            if answer == 'retransmit':
+                send(packet)
+            elif answer:
+                return data[4:]
+
+    def _negotiate(self, size):
+        """The accepted options, applied to this transfer."""
+        accepted = {}
+        if 'blksize' in self.options:
+            try:
+                requested = int(self.options['blksize'])
+            except ValueError:
+                raise TransferError(BAD_OPTION, 'invalid blksize') from None
+            if requested >= MIN_BLKSIZE:
+                self.blksize = min(requested, self.responder.blksize)
+                accepted['blksize'] = self.blksize
+        if 'timeout' in self.options:
+            try:
+                timeout = int(self.options['timeout'])
+            except ValueError:
+                raise TransferError(BAD_OPTION, 'invalid timeout') from None
+            if 1 <= timeout <= 255:
+                self.timeout = timeout
+                accepted['timeout'] = timeout
+        if 'tsize' in self.options:
+            accepted['tsize'] = size if size is not None else self.options['tsize']
+        return accepted
+
+    def _read(self):
+        path = self._local()
+        try:
+            with open(path, 'rb') as f:
+                data = f.read()
+        except FileNotFoundError:
+            raise TransferError(NOT_FOUND, 'file not found') from None
+        except (IsADirectoryError, PermissionError):
+            raise TransferError(ACCESS_VIOLATION, 'access violation') from None
+        if self.mode == 'netascii':
+            data = to_netascii(data)
+        accepted = self._negotiate(len(data))
+        if accepted:
+            self._receive(encode_oack(accepted), lambda opcode, number, body: opcode == ACK and number == 0,
+                          fault=False)
+        block = 1
+        while True:
+            chunk = data[(block - 1) * self.blksize:block * self.blksize]
+            number = block & 0xFFFF
+
+            def acked(opcode, ack, body, number=number):
+                if opcode != ACK:
+                    return False
+                # The client timed out waiting for this block and acknowledged the previous one again.
+                return True if ack == number else 'retransmit' if ack == (number - 1) & 0xFFFF else False
+
+            self._receive(struct.pack('>HH', DATA, number) + chunk, acked)
+            self.bytes += len(chunk)
+            if len(chunk) < self.blksize:
+                return
+            block += 1
+
+    def _write(self):
+        if self.responder.read_only:
+            raise TransferError(ACCESS_VIOLATION, 'server is read-only')
+        path = self._local()
+        if os.path.isdir(path):
+            raise TransferError(ACCESS_VIOLATION, 'access violation')
+        accepted = self._negotiate(None)
+        if accepted:
+            packet = encode_oack(accepted)
+        else:
+            packet = struct.pack('>HH', ACK, 0)
+        chunks = []
+        block = 1
+        while True:
+            number = block & 0xFFFF
+
+            def data_block(opcode, received, body, number=number):
+                if opcode != DATA:
+                    return False
+                if received == number:
+                    return True
+                # The client missed our ACK and sent the previous block again.
+                return 'retransmit' if received == (number - 1) & 0xFFFF else False
+
+            body = self._receive(packet, data_block, fault=block > 1 or not accepted)
+            if len(body) > self.blksize:
+                raise TransferError(ILLEGAL_OPERATION, f'block larger than {self.blksize} bytes')
+            chunks.append(body)
+            self.bytes += len(body)
+            packet = struct.pack('>HH', ACK, number)
+            if len(body) < self.blksize:
+                break
+            block += 1
+        data = b''.join(chunks)
+        if self.mode == 'netascii':
+            data = from_netascii(data)
+        try:
+            with open(path + '.part', 'wb') as f:
+                f.write(data)
+            os.replace(path + '.part', path)
+        except OSError as e:
+            raise TransferError(DISK_FULL if e.errno == errno.ENOSPC else ACCESS_VIOLATION,
+                                f'cannot write: {e.strerror or e}') from None
+        self._send_block(packet)
+        self.last = packet, number
+
+    def _dally(self, packet, number):
+        """Answer a retransmitted last DATA block (our final ACK got lost) for retries timeouts."""
+        deadline = time.monotonic() + self.timeout * max(self.responder.retries, 1)
+        while True:
+            remaining = deadline - time.monotonic()
+            if remaining <= 0:
+                return
+            self.sock.settimeout(remaining)
+            try:
+                data, addr = self.sock.recvfrom(MAX_BLKSIZE + 4)
+            except socket.timeout:
+                return
+            if addr[:2] == self.addr[:2] and data[:4] == struct.pack('>HH', DATA, number):
+                self._send_block(packet)
+
+    def _local(self):
+        try:
+            return self.responder.root.local(self.filename)
+        except PermissionError:
+            raise TransferError(ACCESS_VIOLATION, 'outside the served directory') from None
+
+
+class TFTPResponder:
+    def __init__(self, root='.', blksize=MAX_BLKSIZE, drop_rate=0.0, delay=0.0, timeout=1.0, retries=5,
+                 read_only=False, bind='', clock=None):
+        if not MIN_BLKSIZE <= blksize <= MAX_BLKSIZE:
+            raise ValueError(f'tftp blksize must be between {MIN_BLKSIZE} and {MAX_BLKSIZE}: {blksize}')
+        if not 0.0 <= drop_rate <= 1.0:
+            raise ValueError(f'tftp drop_rate must be between 0 and 1: {drop_rate}')
+        self.root = FileRoot(root)
+        # Largest block size granted to a client asking for the blksize option.
+        self.blksize = blksize
+        self.drop_rate = drop_rate
+        self.delay = delay
+        self.timeout = timeout
+        self.retries = retries
+        self.read_only = read_only
+        self.bind = bind
+        self.clock = clock_module.get(clock)
+        self.completed = 0
+        self.failed = 0
+        self.dropped = 0
+        self._lock = threading.Lock()
+        self._active = set()
+
+    def finished(self, addr):
+        with self._lock:
+            self._active.discard(addr[:2])
+
+    def _transfer_socket(self, addr):
+        family = socket.AF_INET6 if ':' in addr[0] else socket.AF_INET
+        host = self.bind if self.bind and (':' in self.bind) == (family == socket.AF_INET6) else ''
+        sock = socket.socket(family, socket.SOCK_DGRAM)
+        sock.bind((host.strip('[]') or ('::' if family == socket.AF_INET6 else '0.0.0.0'), 0))
+        return sock
+
+    def handle_udp(self, addr, data):
+        """Start a transfer for a request; the reply comes from the transfer's own port, so nothing is returned."""
+        try:
+            opcode, filename, mode, options = parse_request(data)
+        except ValueError as e:
+            logger.debug(f'TFTP ignored datagram from {addr}: {e}')
+            if len(data) >= 2 and struct.unpack_from('>H', data)[0] not in (RRQ, WRQ, ERROR):
+                return encode_error(ILLEGAL_OPERATION, 'expected a read or write request')
+            return None
+        with self._lock:
+            if addr[:2] in self._active:
+                logger.debug(f'TFTP ignored repeated {OPCODES[opcode]} from {addr}, its transfer is running')
+                return None
+            self._active.add(addr[:2])
+        logger.info(f'TFTP {OPCODES[opcode]} {filename} ({mode}) from {addr} options {options}',
+                    extra=logthrottle.event('tftp.transfer'))
+        try:
+            sock = self._transfer_socket(addr)
+        except OSError as e:
+            self.finished(addr)
+            logger.warning(f'TFTP cannot open a transfer socket for {addr}: {e}')
+            return encode_error(NOT_DEFINED, 'server busy')
+        transfer = Transfer(self, sock, addr, opcode, filename, mode, options)
+        threading.Thread(target=transfer.run, daemon=True, name=f'tftp-{addr[0]}:{addr[1]}').start()
+        return None
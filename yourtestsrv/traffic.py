@@ -0,0 +1,172 @@
+"""Live traffic tap behind `yourtestsrv tail` and the admin GET /traffic stream.
+
+Servers publish one event per decoded unit of traffic: TCP/UDP rx and tx
+chunks, HTTP requests and responses, MQTT connect, publish, subscribe,
+disconnect and payload validator violations (with the reason). Nothing is
+built while no one is subscribed. Events are dicts:
+
+  {"time": 1767322800.123, "protocol": "mqtt", "server": "mqtt:1883",
+   "peer": "192.168.1.20:40000", "kind": "publish", "client": "dev-1",
+   "topic": "devices/dev-1/temp", "qos": 1, "hex": "7b2274223a32317d"}
+
+Subscribers filter by protocol, MQTT topic filter, HTTP path regex and client
+(a substring of the MQTT client id or the peer address). Each subscriber has
+a bounded queue; events are dropped (and counted) when it falls behind.
+"""
+
+import http.client
+import json
+import queue
+import re
+import threading
+import time
+from urllib.parse import urlencode
+
+from yourtestsrv import codec
+
+PROTOCOLS = ('tcp', 'udp', 'http', 'mqtt')
+
+_subscribers = []
+_lock = threading.Lock()
+
+
+def peer_name(addr):
+    """'host:port' for an address tuple, the path for a Unix socket peer."""
+    if isinstance(addr, tuple):
+        host = addr[0]
+        return f'[{host}]:{addr[1]}' if ':' in host else f'{host}:{addr[1]}'
+    return str(addr or '')
+
+
+def active():
+    return bool(_subscribers)
+
+
+def publish(protocol, server, addr, kind, data=None, **fields):
+    """Hand an event to the matching subscribers; cheap when there are none."""
+    if not _subscribers:
+        return
+    event = {'time': round(time.time(), 3), 'protocol': protocol, 'server': server,
+             'peer': peer_name(addr), 'kind': kind}
+    event.update((k, v) for k, v in fields.items() if v is not None)
+    if data is not None:
+        event['hex'] = bytes(data).hex()
+    with _lock:
+        subscribers = list(_subscribers)
+    for sub in subscribers:
+        if sub.matches(event):
+            sub.put(event)
+
+
+class Subscription:
+    def __init__(self, protocol='', topic='', path='', client='', max_queue=10000):
+        if protocol and protocol not in PROTOCOLS:
+            raise ValueError(f'unknown protocol {protocol!r} (use one of {", ".join(PROTOCOLS)})')
+        self.protocol = protocol
+        self.topic = topic
+        self.path = re.compile(path) if path else None
+        self.client = client
+        self.dropped = 0
+        self._queue = queue.Queue(max_queue)
+
+    def matches(self, event):
+        from yourtestsrv.mqtt_server import topic_matches
+        if self.protocol and event['protocol'] != self.protocol:
+            return False
+        if self.topic and ('topic' not in event or not topic_matches(self.topic, event['topic'])):
+            return False
+        if self.path and ('path' not in event or not self.path.search(event['path'])):
+            return False
+        if self.client and self.client not in event.get('client', '') and self.client not in event['peer']:
+            return False
+        return True
+
+    def put(self, event):
+        try:
+            self._queue.put_nowait(event)
+        except queue.Full:
+            self.dropped += 1
+
+    def get(self, timeout):
+        """The next event, or None after timeout seconds."""
+        try:
+            return self._queue.get(timeout=timeout)
+        except queue.Empty:
+            return None
+
+
+def subscribe(**filters):
+    sub = Subscription(**filters)
+    with _lock:
+        _subscribers.append(sub)
+    return sub
+
+
+def unsubscribe(sub):
+    with _lock:
+        if sub in _subscribers:
+            _subscribers.remove(sub)
+
+
+def render_data(data, content_type=''):
+    """Payload bytes as decoded JSON (structured content types), text when printable, else hex."""
+    fmt = codec.format_of(content_type) if content_type else None
+    if fmt and data:
+        try:
+            return codec.encode(codec.decode(data, fmt), 'json').decode()
+        except ValueError:
+            pass
+    try:
+        text = data.decode()
+    except UnicodeDecodeError:
+        return data.hex()
+    if all(c.isprintable() or c in '\r\n\t' for c in text):
+        return text.replace('\r', '\\r').replace('\n', '\\n').replace('\t', '\\t')
+    return data.hex()
+
+
+def format_event(event):
+    """One line for the tail command."""
+    stamp = time.strftime('%H:%M:%S', time.localtime(event['time'])) + f'.{int(event["time"] * 1000) % 1000:03d}'
+    parts = [stamp, event['server'], event['peer']]
+    if event.get('client'):
+        parts.append(f'client={event["client"]}')
+    kind = event['kind']
+    parts.append(kind)
+    if kind == 'request':
+        parts += [event['method'], event['path']]
+    elif kind == 'response':
+        parts.append(str(event['status']))
+    elif 'topic' in event:
+        parts.append(event['topic'])
+        if 'qos' in event:
+            parts.append(f'qos={event["qos"]}')
+        if 'reason' in event:
+            parts.append(f'({event["reason"]})')
+    line = ' '.join(parts)
+    if 'hex' in event:
+        data = bytes.fromhex(event['hex'])
+        line += f' ({len(data)} bytes)'
+        if data:
+            line += ': ' + render_data(data, event.get('content_type', ''))
+    return line
+
+
+def follow(host, port, timeout=60.0, **filters):
+    """Yield the events of an admin server's GET /traffic stream until it ends.
+
+    Raises OSError when the admin server cannot be reached and ValueError when
+    it rejects the filters.
+    """
+    query = urlencode({k: v for k, v in filters.items() if v})
+    conn = http.client.HTTPConnection(host, port, timeout=timeout)
+    try:
+        conn.request('GET', '/traffic' + (f'?{query}' if query else ''))
+        resp = conn.getresponse()
+        if resp.status != 200:
+            raise ValueError(f'admin server answered {resp.status}: {resp.read().decode(errors="replace").strip()}')
+        for line in resp:
+            if line.strip():
+                yield json.loads(line)
+    finally:
+        conn.close()
@@ -1,54 +1,335 @@
 import socket
+import struct
 import threading
 import time
 import random
 import logging
 from concurrent.futures import ThreadPoolExecutor
 
+from yourtestsrv import clock as clock_module
+from yourtestsrv import faults, logthrottle, netutil, stats, traffic
+from yourtestsrv.sequence import SequenceTracker
+from yourtestsrv.shaping import JitterBuffer, jittered
+from yourtestsrv.stun_server import is_binding_request
+
 logger = logging.getLogger(__name__)
 
+MAX_UDP_PAYLOAD = 65507
+PEER_TTL = 300.0
+
 
 class UDPServer:
-    def __init__(self, port, bind='0.0.0.0', drop_rate=0.0, delay=0.0, handler=None):
+    stats_name = 'udp'
+
+    def __init__(self, port, bind='0.0.0.0', drop_rate=0.0, delay=0.0, handler=None,
+                 amplify=1, amplify_cap=0, outage_every=0.0, outage_duration=0.0, response=None,
+                 clock=None, encap_header=0, encap_length_offset=-1, encap_length_base=None, dump=None,
+                 corrupt_rate=0.0, socket_options=None, fault_rules=None, reply_from_64='', drop_link_local=False,
+                 multicast=(), multicast_interface='', jitter=0.0, rate_limit=0.0, discovery_reply=None,
+                 duplicate_rate=0.0, duplicate_count=2, duplicate_gap=0.0, reorder=None, reorder_rate=1.0,
+                 sequence_field=None, latency=None, truncate_to=0, stun=None, pad_to=0):
         self.port = port
         self.bind = bind or '0.0.0.0'
+        self.stats_key = f'{self.stats_name}:{port}'
         self.drop_rate = drop_rate
+        # A duplicate_rate fraction of replies goes out duplicate_count times, duplicate_gap apart,
+        # to exercise the client's deduplication.
+        self.duplicate_rate = duplicate_rate
+        self.duplicate_count = duplicate_count
+        self.duplicate_gap = duplicate_gap
+        # Reordering: a reorder_rate fraction of replies waits an extra delay drawn from the
+        # reorder distribution (shaping.Distribution) in a jitter buffer, so later replies overtake them.
+        self.reorder = reorder
+        self.reorder_rate = reorder_rate
         self.delay = delay
+        # Each delay is spread evenly by up to jitter either way, so replies may overtake each other;
+        # a latency model (shaping.Latency) draws every delay from a distribution instead.
+        self.jitter = jitter
+        self.latency = latency
+        # Link bandwidth in bytes/s: a reply waits the time it would take to transmit.
+        self.rate_limit = rate_limit
         self.handler = handler
+        self.response = response
+        # A STUN responder (stun.STUNResponder) answers binding requests; other datagrams get the usual reply.
+        self.stun = stun
+        self.clock = clock_module.get(clock)
+        self.amplify = amplify
+        self.amplify_cap = amplify_cap
+        # Replies are cut to their first truncate_to bytes (0: whole), to test short-reply handling.
+        self.truncate_to = truncate_to
+        # Shorter replies are padded with zero bytes to a pad_to-byte datagram (0: as is), so a large
+        # pad_to (e.g. 4096) makes every reply IP-fragmented, to test the device's reassembly.
+        self.pad_to = pad_to
+        self.outage_every = outage_every
+        self.outage_duration = outage_duration
+        # Encapsulation (e.g. GTP-U): the first encap_header bytes are an outer header that
+        # is kept as-is on the reply, with the 16-bit length at encap_length_offset (if any)
+        # rewritten to count the bytes after encap_length_base.
+        self.encap_header = encap_header
+        self.encap_length_offset = encap_length_offset
+        self.encap_length_base = encap_header if encap_length_base is None else encap_length_base
+        self.dump = dump
+        self.corrupt_rate = corrupt_rate
+        self.fault_rules = fault_rules
+        # IPv6 scenarios: reply from this interface identifier in the /64 the datagram was sent to
+        # (e.g. '::2', the address need not be configured), and ignore link-local (fe80::/10) peers.
+        self.reply_from_64 = reply_from_64
+        self.drop_link_local = drop_link_local
+        # Multicast groups joined on multicast_interface (name or IPv4 address); replies go to the sender.
+        self.multicast = list(multicast)
+        self.multicast_interface = multicast_interface
+        # LAN discovery: broadcast datagrams get this reply (bytes, or a payload template expanded
+        # with ${remote}, ${local} and ${broadcast}) sent back unicast, instead of the usual answer.
+        self.discovery_reply = discovery_reply
+        self.socket_options = socket_options or netutil.SocketOptions()
+        self.stats = stats.ServerStats()
+        if sequence_field:
+            self.stats.sequence = SequenceTracker(sequence_field)
+        self._outage_lock = threading.Lock()
+        self._outage_duration = 0.0
+        self._next_outage = 0.0
+        self._sock = None
+        self._addr = None
+        self._peers = {}
+        self._peers_lock = threading.Lock()
+        self._jitter_buffer = JitterBuffer(self.clock) if reorder else None
+
+    def addr(self):
+        """The bound (host, port) once listening, else None."""
+        return self._addr
 
     def listen_and_serve(self, stop_event):
-        sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
-        sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
-        sock.bind((self.bind, self.port))
-        sock.settimeout(1.0)
-        logger.info(f'UDP server listening on {self.bind}:{self.port}')
+        self.serve_udp(stop_event, self._open_socket())
+
+    def serve_udp(self, stop_event, sock):
+        """Serve on a bound UDP socket created by the caller (e.g. bound to port 0).
+
+        After an outage the socket is reopened on the same address.
+        """
+        self._addr = sock.getsockname()
+        self.port = self._addr[1]
+        self.stats_key = f'{self.stats_name}:{self.port}'
+        stats.register(self.stats_key, self.stats)
         executor = ThreadPoolExecutor(max_workers=32)
+        if self.outage_every > 0:
+            self._next_outage = self.clock.time() + self.outage_every
         try:
-            while not stop_event.is_set():
+            while True:
+                self.socket_options.apply(sock)
+                if self.multicast:
+                    netutil.join_multicast(sock, self.multicast, self.multicast_interface)
+                sock.settimeout(1.0)
+                logger.info(f'UDP server listening on {self.bind}:{self.port}')
+                self._sock = sock
                 try:
-                    data, addr = sock.recvfrom(65535)
-                except socket.timeout:
-                    continue
-                except OSError:
+                    self._serve(sock, stop_event, executor)
+                finally:
+                    self._sock = None
+                    sock.close()
+                self._wait_outage(stop_event)
+                if stop_event.is_set():
                     break
-                executor.submit(self._handle_packet, sock, addr, data)
+                sock = self._open_socket()
         finally:
-            sock.close()
             executor.shutdown(wait=False)
+            if self._jitter_buffer:
+                self._jitter_buffer.close()
+
+    def start_outage(self, duration):
+        """Close the socket for duration seconds so clients get ICMP port unreachable.
+
+        Takes effect within the 1-second receive poll interval.
+        """
+        with self._outage_lock:
+            self._outage_duration = duration
+
+    def _open_socket(self):
+        return netutil.bind_udp(self.bind, self.port)
+
+    def _serve(self, sock, stop_event, executor):
+        pktinfo = bool(self.reply_from_64) and sock.family == socket.AF_INET6
+        if pktinfo:
+            netutil.enable_pktinfo(sock)
+        elif self.reply_from_64:
+            logger.warning(f'UDP reply_from_64 needs an IPv6 bind address (e.g. ::), not {self.bind}')
+        discovery = self.discovery_reply is not None and sock.family == socket.AF_INET
+        if discovery:
+            netutil.enable_broadcast_info(sock)
+        elif self.discovery_reply is not None:
+            logger.warning(f'UDP discovery replies need an IPv4 bind address (e.g. 0.0.0.0), not {self.bind}')
+        local = broadcast = None
+        while not stop_event.is_set() and not self._outage_pending():
+            try:
+                if pktinfo or discovery:
+                    data, ancdata, _, addr = sock.recvmsg(65535, netutil.PKTINFO_SPACE)
+                    if pktinfo:
+                        local = netutil.pktinfo_address(ancdata)
+                    else:
+                        broadcast = netutil.broadcast_info(ancdata)
+                else:
+                    data, addr = sock.recvfrom(65535)
+            except socket.timeout:
+                continue
+            except OSError:
+                return
+            with self._peers_lock:
+                self._peers[addr] = time.time()
+            executor.submit(self._handle_packet, sock, addr, data, local, broadcast)
+
+    def _outage_pending(self):
+        if self._next_outage and self.clock.time() >= self._next_outage:
+            self._next_outage += self.outage_every
+            self.start_outage(self.outage_duration)
+        with self._outage_lock:
+            return self._outage_duration > 0
+
+    def _wait_outage(self, stop_event):
+        with self._outage_lock:
+            duration, self._outage_duration = self._outage_duration, 0.0
+        if duration > 0:
+            logger.info(f'UDP server closed for {duration}s (port unreachable): {self.bind}:{self.port}')
+            self.clock.wait(stop_event, duration)
 
-    def _handle_packet(self, sock, addr, data):
+    def _handle_packet(self, sock, addr, data, local=None, broadcast=None):
+        if self.dump:
+            self.dump.record(self.stats_key, addr, 'rx', data)
+        traffic.publish('udp', self.stats_key, addr, 'rx', data)
+        if self.stats.sequence:
+            self._count_sequence(addr, data)
+        if self.drop_link_local and netutil.is_link_local(addr):
+            logger.info(f'UDP packet from link-local {addr} dropped', extra=logthrottle.event('udp.drop'))
+            return
         if self.drop_rate > 0 and random.random() < self.drop_rate:
-            logger.info(f'UDP packet dropped from {addr}')
+            logger.info(f'UDP packet dropped from {addr}', extra=logthrottle.event('udp.drop'))
+            return
+        delay = self.latency.sample() if self.latency else jittered(self.delay, self.jitter)
+        if delay > 0:
+            self.clock.sleep(delay)
+        logger.info(f'UDP received from {addr}: {data.hex()}', extra=logthrottle.event('udp.rx'))
+        if broadcast:
+            self._send(sock, addr, self._discovery(addr, *broadcast))
             return
-        if self.delay > 0:
-            time.sleep(self.delay)
-        logger.info(f'UDP received from {addr}: {data.hex()}')
-        if self.handler:
+        outer = b''
+        if self.encap_header:
+            if len(data) < self.encap_header:
+                logger.debug(f'UDP packet from {addr} shorter than the {self.encap_header}-byte outer header')
+                self.stats.record_error(stats.ERROR_PARSE)
+                return
+            outer, data = data[:self.encap_header], data[self.encap_header:]
+        fault = self.fault_rules.match(data) if self.fault_rules else None
+        if fault:
+            if fault.delay > 0:
+                self.clock.sleep(fault.delay)
+            if fault.dropped():
+                logger.info(f'UDP fault rule dropped the reply to {addr}', extra=logthrottle.event('udp.drop'))
+                return
+        if self.stun and is_binding_request(data):
+            response = self.stun.respond(addr, data)
+        elif self.handler:
             response = self.handler(addr, data)
+        elif self.response:
+            try:
+                response = self.response.build(data)
+            except ValueError as e:
+                logger.debug(f'UDP response template failed for {addr}: {e}')
+                self.stats.record_error(e)
+                return
         else:
             response = data
+        if response and self.amplify > 1:
+            response = self._amplify(response)
+        if response and self.pad_to:
+            response = response.ljust(self.pad_to - len(outer), b'\x00')
+        if response and self.truncate_to:
+            response = response[:self.truncate_to]
+        if response and self.corrupt_rate > 0:
+            response = faults.corrupt(response, self.corrupt_rate)
+        if response and fault:
+            response = fault.corrupt(response)
+        if response and outer:
+            response = self._encapsulate(outer, response)
         if response:
+            cmsgs = netutil.marking_cmsgs(sock, addr, fault.ttl, fault.tos) if fault else []
+            # IPv4-mapped peers go out as IPv4, where there is no /64 to move within.
+            if local and self.reply_from_64 and not local.startswith('::ffff:'):
+                cmsgs.append(netutil.source_cmsg(netutil.same_64(local, self.reply_from_64)))
+            self._send(sock, addr, response, cmsgs)
+
+    def _count_sequence(self, addr, data):
+        kind, seq, state = self.stats.sequence.record(traffic.peer_name(addr), data)
+        if kind == 'gap':
+            logger.info(f'UDP sequence gap from {addr}: {seq} after {state.last}',
+                        extra=logthrottle.event('udp.sequence'))
+        elif kind not in ('first', 'next'):
+            logger.info(f'UDP sequence {kind} from {addr}: {seq}', extra=logthrottle.event('udp.sequence'))
+
+    def _send(self, sock, addr, response, cmsgs=()):
+        if self.reorder and (self.reorder_rate >= 1 or random.random() < self.reorder_rate):
+            self._jitter_buffer.put(self.reorder.sample(), self._emit, sock, addr, response, cmsgs)
+        else:
+            self._emit(sock, addr, response, cmsgs)
+
+    def _emit(self, sock, addr, response, cmsgs):
+        copies = 1
+        if self.duplicate_rate > 0 and random.random() < self.duplicate_rate:
+            copies = self.duplicate_count
+            logger.info(f'UDP reply to {addr} sent {copies} times', extra=logthrottle.event('udp.duplicate'))
+        for i in range(copies):
+            if i and self.duplicate_gap > 0:
+                self.clock.sleep(self.duplicate_gap)
+            if self.rate_limit > 0:
+                self.clock.sleep(len(response) / self.rate_limit)
+            if self.dump:
+                self.dump.record(self.stats_key, addr, 'tx', response)
+            traffic.publish('udp', self.stats_key, addr, 'tx', response)
             try:
-                sock.sendto(response, addr)
-            except OSError:
-                pass
+                if cmsgs:
+                    sock.sendmsg([response], list(cmsgs), 0, addr)
+                else:
+                    sock.sendto(response, addr)
+            except OSError as e:
+                self.stats.record_error(e)
+
+    def _discovery(self, addr, broadcast, local):
+        """The discovery reply to a datagram from addr sent to the broadcast address, received on local."""
+        logger.info(f'UDP discovery broadcast to {broadcast} from {addr}, answering from {local}')
+        if isinstance(self.discovery_reply, bytes):
+            return self.discovery_reply
+        return self.discovery_reply.next(remote=f'{addr[0]}:{addr[1]}', remote_host=addr[0], remote_port=addr[1],
+                                         local=local, broadcast=broadcast)
+
+    def _amplify(self, response):
+        cap = min(self.amplify_cap or MAX_UDP_PAYLOAD, MAX_UDP_PAYLOAD) - self.encap_header
+        return (response * self.amplify)[:cap]
+
+    def _encapsulate(self, outer, inner):
+        if self.encap_length_offset < 0:
+            return outer + inner
+        header = bytearray(outer)
+        length = len(outer) + len(inner) - self.encap_length_base
+        struct.pack_into('>H', header, self.encap_length_offset, length & 0xFFFF)
+        return bytes(header) + inner
+
+    def send_to(self, data, addr=None):
+        """Send an unsolicited datagram to addr, or to every peer seen recently.
+
+        Returns the number of datagrams sent.
+        """
+        sock = self._sock
+        if sock is None:
+            return 0
+        if addr is not None:
+            targets = [addr]
+        else:
+            now = time.time()
+            with self._peers_lock:
+                self._peers = {a: t for a, t in self._peers.items() if now - t < PEER_TTL}
+                targets = list(self._peers)
+        sent = 0
+        for target in targets:
+            try:
+                sock.sendto(data, target)
+                sent += 1
+            except OSError as e:
+                self.stats.record_error(e)
+        return sent
@@ -0,0 +1,234 @@
+"""WebSocket (RFC 6455) bridge to the TCP scenario engine.
+
+Each WebSocket connection is handed to a TCPServer as if it were a plain
+TCP client: message payloads are written into one end of a socket pair
+whose other end the TCP handler reads, and everything the handler writes
+comes back as binary messages. Delay, framing, rate limit, corruption and
+close scenarios therefore behave the same for browser clients.
+
+Keepalive policy, for checking how devices handle idle connections (cellular
+NATs silently drop idle flows after a few minutes):
+
+  ping_interval  send a ping this long after the previous one; 0 never pings
+  pong_timeout   drop the connection (no close frame, like a dead path) when a
+                 ping is not answered within this long; 0 waits forever
+  ignore_pings   never answer the client's pings, so its own keepalive fires
+"""
+
+import base64
+import hashlib
+import logging
+import socket
+import struct
+import threading
+import time
+
+from yourtestsrv import netutil
+
+logger = logging.getLogger(__name__)
+
+GUID = '258EAFA5-E914-47DA-95CA-C5AB0DC85B11'
+MAX_HEADER = 8192
+MAX_MESSAGE = 16 * 1024 * 1024
+
+OP_CONTINUATION = 0x0
+OP_TEXT = 0x1
+OP_BINARY = 0x2
+OP_CLOSE = 0x8
+OP_PING = 0x9
+OP_PONG = 0xA
+
+
+class WebSocketError(Exception):
+    pass
+
+
+def accept_key(key):
+    return base64.b64encode(hashlib.sha1((key + GUID).encode()).digest()).decode()
+
+
+def encode_frame(opcode, payload, mask=None):
+    """Encode a single final frame; mask is the 4-byte key for client-to-server frames."""
+    header = bytes([0x80 | opcode])
+    mask_bit = 0x80 if mask else 0
+    if len(payload) < 126:
+        header += bytes([mask_bit | len(payload)])
+    elif len(payload) < 65536:
+        header += bytes([mask_bit | 126]) + struct.pack('>H', len(payload))
+    else:
+        header += bytes([mask_bit | 127]) + struct.pack('>Q', len(payload))
+    if mask:
+        payload = bytes(b ^ mask[i % 4] for i, b in enumerate(payload))
+        header += mask
+    return header + payload
+
+
+def recv_exact(conn, n):
+    buf = b''
+    while len(buf) < n:
+        chunk = conn.recv(n - len(buf))
+        if not chunk:
+            raise EOFError('connection closed')
+        buf += chunk
+    return buf
+
+
+def read_frame(conn):
+    """Return (fin, opcode, payload) for the next frame, unmasking it if needed."""
+    first, second = recv_exact(conn, 2)
+    length = second & 0x7F
+    if length == 126:
+        length = struct.unpack('>H', recv_exact(conn, 2))[0]
+    elif length == 127:
+        length = struct.unpack('>Q', recv_exact(conn, 8))[0]
+    if length > MAX_MESSAGE:
+        raise WebSocketError(f'frame of {length} bytes exceeds {MAX_MESSAGE}')
+    mask = recv_exact(conn, 4) if second & 0x80 else None
+    payload = recv_exact(conn, length) if length else b''
+    if mask:
+        payload = bytes(b ^ mask[i % 4] for i, b in enumerate(payload))
+    return bool(first & 0x80), first & 0x0F, payload
+
+
+def read_request_head(conn):
+    """Read an HTTP request head; returns (request_line, headers) with lower-cased header names."""
+    data = b''
+    while b'\r\n\r\n' not in data:
+        chunk = conn.recv(1024)
+        if not chunk:
+            raise EOFError('connection closed during handshake')
+        data += chunk
+        if len(data) > MAX_HEADER:
+            raise WebSocketError('handshake headers too large')
+    head = data.split(b'\r\n\r\n', 1)[0].decode('latin-1')
+    lines = head.split('\r\n')
+    headers = {}
+    for line in lines[1:]:
+        name, _, value = line.partition(':')
+        headers[name.strip().lower()] = value.strip()
+    return lines[0], headers
+
+
+class WebSocketBridge:
+    def __init__(self, port, bind='0.0.0.0', target=None, ping_interval=0.0, pong_timeout=0.0, ignore_pings=False):
+        self.port = port
+        self.bind = bind or '0.0.0.0'
+        self.target = target
+        self.ping_interval = ping_interval
+        self.pong_timeout = pong_timeout
+        self.ignore_pings = ignore_pings
+        self._addr = None
+
+    def addr(self):
+        """The bound (host, port) once listening, else None."""
+        return self._addr
+
+    def listen_and_serve(self, stop_event):
+        self.serve(stop_event, netutil.listen_tcp(self.bind, self.port))
+
+    def serve(self, stop_event, sock):
+        """Serve on a listening socket created by the caller (e.g. bound to port 0)."""
+        self._addr = sock.getsockname()
+        self.port = self._addr[1]
+        sock.settimeout(1.0)
+        logger.info(f'WebSocket bridge listening on {self.bind}:{self.port}')
+        try:
+            while not stop_event.is_set():
+                try:
+                    conn, addr = sock.accept()
+                except socket.timeout:
+                    continue
+                except OSError:
+                    break
+                threading.Thread(target=self._handle_conn, args=(conn, addr), daemon=True).start()
+        finally:
+            sock.close()
+
+    def _handshake(self, conn):
+        conn.settimeout(10.0)
+        request_line, headers = read_request_head(conn)
+        key = headers.get('sec-websocket-key')
+        if (not request_line.startswith('GET ') or 'websocket' not in headers.get('upgrade', '').lower()
+                or not key):
+            conn.sendall(b'HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n')
+            raise WebSocketError(f'not a WebSocket upgrade: {request_line!r}')
+        conn.sendall(('HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n'
+                      f'Sec-WebSocket-Accept: {accept_key(key)}\r\n\r\n').encode())
+        conn.settimeout(None)
+
+    def _handle_conn(self, conn, addr):
+        try:
+            self._handshake(conn)
+        except (OSError, EOFError, WebSocketError) as e:
+            logger.debug(f'WebSocket handshake failed from {addr}: {e}')
+            conn.close()
+            return
+        logger.info(f'WebSocket connection from {addr}')
+        inner, outer = socket.socketpair()
+        send_lock = threading.Lock()
+        pong = threading.Event()
+        closed = threading.Event()
+        self.target.serve_connection(inner, addr)
+        threading.Thread(target=self._pump_in, args=(conn, outer, send_lock, pong, addr), daemon=True).start()
+        if self.ping_interval > 0:
+            threading.Thread(target=self._keepalive, args=(conn, send_lock, pong, closed, addr), daemon=True).start()
+        try:
+            while True:
+                data = outer.recv(65536)
+                if not data:
+                    break
+                with send_lock:
+                    conn.sendall(encode_frame(OP_BINARY, data))
+            with send_lock:
+                conn.sendall(encode_frame(OP_CLOSE, struct.pack('>H', 1000)))
+        except OSError:
+            pass
+        finally:
+            closed.set()
+            outer.close()
+            conn.close()
+            logger.info(f'WebSocket connection closed: {addr}')
+
+    def _keepalive(self, conn, send_lock, pong, closed, addr):
+        """Ping every ping_interval; drop the connection when a pong is overdue by pong_timeout."""
+        count = 0
+        wait = self.ping_interval
+        while not closed.wait(wait):
+            count += 1
+            pong.clear()
+            try:
+                with send_lock:
+                    conn.sendall(encode_frame(OP_PING, str(count).encode()))
+            except OSError:
+                return
+            sent = time.monotonic()
+            if self.pong_timeout and not pong.wait(self.pong_timeout) and not closed.is_set():
+                logger.info(f'WebSocket pong from {addr} overdue after {self.pong_timeout}s, dropping the connection')
+                try:
+                    conn.shutdown(socket.SHUT_RDWR)
+                except OSError:
+                    pass
+                return
+            # The wait for the pong counts towards the next interval.
+            wait = max(0.0, self.ping_interval - (time.monotonic() - sent))
+
+    def _pump_in(self, conn, outer, send_lock, pong, addr):
+        """Forward client messages into the socket pair and answer control frames."""
+        try:
+            while True:
+                _, opcode, payload = read_frame(conn)
+                if opcode in (OP_TEXT, OP_BINARY, OP_CONTINUATION):
+                    outer.sendall(payload)
+                elif opcode == OP_PING and not self.ignore_pings:
+                    with send_lock:
+                        conn.sendall(encode_frame(OP_PONG, payload))
+                elif opcode == OP_PONG:
+                    pong.set()
+                elif opcode == OP_CLOSE:
+                    break
+        except (OSError, EOFError, WebSocketError) as e:
+            logger.debug(f'WebSocket read from {addr} ended: {e}')
+        try:
+            outer.shutdown(socket.SHUT_WR)
+        except OSError:
+            pass